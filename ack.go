@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// acker replies to each line read from a TCP connection, with -tcp.ack, with
+// "+OK <name>" if it's accepted, or "-ERR <reason>" if it's rejected, one
+// reply per line, in order. Replies are buffered, and flushed whenever there
+// are no more lines to read without waiting, so pipelined lines are
+// acknowledged in batches. A nil acker doesn't reply.
+type acker struct {
+	w *bufio.Writer
+}
+
+func newAcker(w io.Writer) *acker {
+	return &acker{w: bufio.NewWriter(w)}
+}
+
+// reply buffers the reply to a line with the metric name, which may be empty
+// if the line couldn't be parsed, and was rejected with err, if it's not nil.
+func (a *acker) reply(name string, err error) error {
+	if a == nil {
+		return nil
+	}
+	if err != nil {
+		// The reason mustn't end the reply early.
+		reason := strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+		_, werr := a.w.WriteString("-ERR " + reason + "\n")
+		return werr
+	}
+	_, werr := a.w.WriteString("+OK " + name + "\n")
+	return werr
+}
+
+func (a *acker) flush() error {
+	if a == nil {
+		return nil
+	}
+	return a.w.Flush()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestAck(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		strict bool
+		want   []string
+	}{
+		"lenient": {false, []string{
+			"+OK foo_total",
+			"+OK foo_total",
+			"-ERR parse error: ",
+			"-ERR observation error: ",
+			"-ERR line exceeds maximum of 64 bytes",
+			"+OK foo_total",
+		}},
+		"strict": {true, []string{
+			"+OK foo_total",
+			"+OK foo_total",
+			"-ERR parse error: ",
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var (
+				dst, _ = aggregator.NewUniverse()
+				in     = newIngester(dst, newTelemetry(dst), log.NewNopLogger())
+				src, w = net.Pipe()
+			)
+			in.ack = true
+			in.strict = testcase.strict
+			in.maxLineBytes = 64
+			defer w.Close()
+			go in.handleConn(src)
+
+			go func() {
+				for _, line := range []string{
+					`{"name":"foo_total","type":"counter","help":"Total foos."}`,
+					`foo_total{} 1`,
+					`foo_total{ 1`,
+					`bar_total{} 1`, // undeclared
+					`foo_total{label="` + fmt.Sprintf("%080d", 0) + `"} 1`,
+					`foo_total{} 2`,
+				} {
+					if _, err := fmt.Fprintln(w, line); err != nil {
+						return // closed by strict
+					}
+				}
+			}()
+
+			w.SetReadDeadline(time.Now().Add(time.Second))
+			s := bufio.NewScanner(w)
+			for i, want := range testcase.want {
+				if !s.Scan() {
+					t.Fatalf("reply %d: want %q, have %v", i, want, s.Err())
+				}
+				if have := s.Text(); len(have) < len(want) || have[:len(want)] != want {
+					t.Errorf("reply %d: want prefix %q, have %q", i, want, have)
+				}
+			}
+			if testcase.strict && s.Scan() {
+				t.Errorf("want connection closed, have %q", s.Text())
+			}
+		})
+	}
+}
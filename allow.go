@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// cidrList is the networks that senders are allowed to connect or send
+// packets from. It's a flag that may be given more than once, each time with
+// one or more comma-separated CIDRs. An empty list allows every sender.
+type cidrList []*net.IPNet
+
+// cidrListVar defines a cidrList flag, like fs.String defines a string flag.
+func cidrListVar(fs *flag.FlagSet, name, usage string) *cidrList {
+	l := &cidrList{}
+	fs.Var(l, name, usage)
+	return l
+}
+
+func (l *cidrList) String() string {
+	cidrs := make([]string, len(*l))
+	for i, n := range *l {
+		cidrs[i] = n.String()
+	}
+	return strings.Join(cidrs, ",")
+}
+
+func (l *cidrList) Set(s string) error {
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q", cidr)
+		}
+		*l = append(*l, n)
+	}
+	return nil
+}
+
+// allows reports whether a sender at addr is allowed. Senders without an IP
+// address, i.e. over Unix sockets, are local, and always allowed.
+func (l cidrList) allows(addr net.Addr) bool {
+	if len(l) == 0 {
+		return true
+	}
+	ip := addrIP(addr)
+	return ip == nil || l.match(ip) >= 0
+}
+
+// match returns the prefix length of the most specific network in the list
+// that contains ip, or -1 if none does.
+func (l cidrList) match(ip net.IP) int {
+	longest := -1
+	for _, n := range l {
+		if ones, _ := n.Mask.Size(); n.Contains(ip) && ones > longest {
+			longest = ones
+		}
+	}
+	return longest
+}
+
+// addrIP returns the IP address of addr, or nil if it hasn't got one.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// strictFor reports whether a TCP client at addr is disconnected when it
+// sends bad data. The most specific of -strict.cidr and -strict.exempt-cidr
+// that contains it decides, with exemptions winning ties, and -strict decides
+// for clients in neither, and for those without an IP address.
+func (in *ingester) strictFor(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return in.strict
+	}
+	strict, exempt := in.strictNets.match(ip), in.exemptNets.match(ip)
+	if strict < 0 && exempt < 0 {
+		return in.strict
+	}
+	return strict > exempt
+}
+
+// allowedPacketConn discards packets from senders that aren't allowed,
+// counting them, before they're decompressed or parsed.
+type allowedPacketConn struct {
+	net.PacketConn
+	allowed cidrList
+	t       *telemetry
+}
+
+func (c allowedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.allowed.allows(addr) {
+			return n, addr, err
+		}
+		c.t.denied.add(1, "udp")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestCIDRList(t *testing.T) {
+	var l cidrList
+	for _, s := range []string{"10.0.0.0/8, 192.168.1.0/24", "fd00::/8"} {
+		if err := l.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, have := "10.0.0.0/8,192.168.1.0/24,fd00::/8", l.String(); want != have {
+		t.Errorf("String: want %q, have %q", want, have)
+	}
+	if err := l.Set("10.0.0.1"); err == nil {
+		t.Errorf("Set without prefix length: want error, have none")
+	}
+
+	for name, testcase := range map[string]struct {
+		addr net.Addr
+		want bool
+	}{
+		"tcp allowed":     {&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, true},
+		"udp allowed":     {&net.UDPAddr{IP: net.ParseIP("192.168.1.9")}, true},
+		"ipv6 allowed":    {&net.UDPAddr{IP: net.ParseIP("fd12::1")}, true},
+		"tcp denied":      {&net.TCPAddr{IP: net.ParseIP("192.168.2.1")}, false},
+		"ipv4 in ipv6":    {&net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.1")}, true},
+		"unix is allowed": {&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, true},
+	} {
+		if want, have := testcase.want, l.allows(testcase.addr); want != have {
+			t.Errorf("%s: want %v, have %v", name, want, have)
+		}
+	}
+	if !(cidrList{}).allows(&net.TCPAddr{IP: net.ParseIP("1.2.3.4")}) {
+		t.Errorf("empty list: want every sender allowed")
+	}
+}
+
+func TestStrictFor(t *testing.T) {
+	tcp := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip)} }
+	for name, testcase := range map[string]struct {
+		strict     bool
+		strictNets string
+		exemptNets string
+		addr       net.Addr
+		want       bool
+	}{
+		"default lenient":      {false, "", "", tcp("10.1.2.3"), false},
+		"default strict":       {true, "", "", tcp("10.1.2.3"), true},
+		"strict network":       {false, "10.0.0.0/8", "", tcp("10.1.2.3"), true},
+		"outside network":      {false, "10.0.0.0/8", "", tcp("192.168.1.1"), false},
+		"exempt network":       {true, "", "10.0.0.0/8", tcp("10.1.2.3"), false},
+		"exempt within strict": {false, "10.0.0.0/8", "10.9.0.0/16", tcp("10.9.2.3"), false},
+		"strict within exempt": {true, "10.9.0.0/16", "10.0.0.0/8", tcp("10.9.2.3"), true},
+		"exempt wins ties":     {false, "10.0.0.0/8", "10.0.0.0/8", tcp("10.1.2.3"), false},
+		"unix is default":      {true, "", "10.0.0.0/8", &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, true},
+	} {
+		in := newIngester(nil, nil, log.NewNopLogger())
+		in.strict = testcase.strict
+		in.strictNets.Set(testcase.strictNets)
+		in.exemptNets.Set(testcase.exemptNets)
+		if want, have := testcase.want, in.strictFor(testcase.addr); want != have {
+			t.Errorf("%s: want %v, have %v", name, want, have)
+		}
+	}
+}
+
+func TestDeniedSources(t *testing.T) {
+	var (
+		dst, _ = aggregator.NewUniverse()
+		tm     = newTelemetry(dst)
+		in     = newIngester(dst, tm, log.NewNopLogger())
+	)
+	in.allowed.Set("10.0.0.0/8")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go in.forwardListener(ln)
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("TCP: want EOF, have %v", err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- in.forwardPacketConn(conn) }()
+
+	sender, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	fmt.Fprint(sender, `{"name":"foo","type":"gauge","help":"Current foo."}`)
+	in.drain(50 * time.Millisecond)
+	if err := <-errc; err != nil {
+		t.Fatalf("forwardPacketConn: want nil error, have %v", err)
+	}
+
+	for _, transport := range []string{"tcp", "udp"} {
+		if want, have := uint64(1), tm.denied.value(transport); want != have {
+			t.Errorf("%s: want %d denied, have %d", transport, want, have)
+		}
+	}
+	if want, have := uint64(0), tm.linesReceived.value(); want != have {
+		t.Errorf("lines received: want %d, have %d", want, have)
+	}
+}
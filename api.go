@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+// seriesHandler serves (GET) or deletes (DELETE) a single timeseries,
+// identified by the name query parameter and zero or more labels parameters,
+// e.g. /api/v1/series?name=foo_total&labels=code=200,method=GET.
+func seriesHandler(u *aggregator.Universe) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "DELETE" {
+			respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			respondError(w, http.StatusBadRequest, "name is required")
+			return
+		}
+		labels, err := parseLabelsParams(r.URL.Query()["labels"])
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if r.Method == "DELETE" {
+			if !u.Delete(name, labels) {
+				respondError(w, http.StatusNotFound, "series not found")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		s, ok := u.Lookup(name, labels)
+		if !ok {
+			respondError(w, http.StatusNotFound, "series not found")
+			return
+		}
+		respondJSON(w, http.StatusOK, s)
+	})
+}
+
+// snapshotHandler downloads (GET) the state of every metric, or restores
+// (POST) a downloaded snapshot, merging it into the current state, or, with
+// mode=replace, replacing it, e.g. to move series between instances.
+func snapshotHandler(u *aggregator.Universe) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Header().Set("content-type", "application/x-ndjson")
+			w.Header().Set("content-disposition", `attachment; filename="snapshot.ndjson"`)
+			u.WriteSnapshot(w) // an error is the client going away
+		case "POST":
+			var replace bool
+			switch mode := r.URL.Query().Get("mode"); mode {
+			case "", "merge":
+			case "replace":
+				replace = true
+			default:
+				respondError(w, http.StatusBadRequest, fmt.Sprintf("invalid mode %q, must be merge or replace", mode))
+				return
+			}
+			n, err := u.ReadSnapshot(r.Body, replace)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			respondJSON(w, http.StatusOK, struct {
+				Series int `json:"series"`
+			}{
+				Series: n,
+			})
+		default:
+			respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+}
+
+// parseLabelsParams parses label matchers of the form k=v, which may be
+// comma-separated within a single parameter, or spread over several.
+func parseLabelsParams(params []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, param := range params {
+		if param == "" {
+			continue
+		}
+		for _, pair := range strings.Split(param, ",") {
+			z := strings.IndexByte(pair, '=')
+			if z < 1 {
+				return nil, fmt.Errorf("bad labels parameter (%s): want k=v", pair)
+			}
+			labels[pair[:z]] = strings.Trim(pair[z+1:], `"`)
+		}
+	}
+	return labels, nil
+}
+
+func respondJSON(w http.ResponseWriter, code int, v interface{}) {
+	buf, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(buf)
+	w.Write([]byte("\n"))
+}
+
+func respondError(w http.ResponseWriter, code int, msg string) {
+	buf, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{
+		Error: msg,
+	})
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(buf)
+	w.Write([]byte("\n"))
+}
+
+// bucketsHandler serves the buckets suggested for a histogram, from the
+// values sampled by -ingest.bucket-samples, e.g.
+// /api/v1/buckets?name=myapp_req_dur_seconds&buckets=8.
+func bucketsHandler(u *aggregator.Universe) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			respondError(w, http.StatusBadRequest, "name is required")
+			return
+		}
+		n := aggregator.DefaultSuggestedBuckets
+		if s := r.URL.Query().Get("buckets"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil || n < 1 {
+				respondError(w, http.StatusBadRequest, "buckets must be a positive integer")
+				return
+			}
+		}
+		suggestion, err := u.SuggestBuckets(name, n)
+		if err != nil {
+			respondError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		respondJSON(w, http.StatusOK, suggestion)
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestSeriesHandler(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`foo_total{code="200"} 3`,
+		`foo_total{code="404"} 1`,
+		`{"name":"bar_seconds","type":"histogram","help":"Bar duration in seconds.","buckets":[0.1, 1]}`,
+		`bar_seconds{} 0.5`,
+	}))
+
+	h := seriesHandler(u)
+	fp := func(f float64) *float64 { return &f }
+	up := func(n uint64) *uint64 { return &n }
+
+	for name, testcase := range map[string]struct {
+		query string
+		code  int
+		want  aggregator.SeriesSnapshot
+	}{
+		"counter": {
+			query: "name=foo_total&labels=code=200",
+			code:  http.StatusOK,
+			want:  aggregator.SeriesSnapshot{Name: "foo_total", Type: "counter", Help: "Total number of foos.", Labels: map[string]string{"code": "200"}, Value: fp(3)},
+		},
+		"histogram": {
+			query: "name=bar_seconds",
+			code:  http.StatusOK,
+			want: aggregator.SeriesSnapshot{Name: "bar_seconds", Type: "histogram", Help: "Bar duration in seconds.", Labels: map[string]string{}, Sum: fp(0.5), Count: up(1), Buckets: []aggregator.BucketSnapshot{
+				{LE: "0.1", Count: 0},
+				{LE: "1", Count: 1},
+				{LE: "+Inf", Count: 1},
+			}},
+		},
+		"missing name": {
+			query: "labels=code=200",
+			code:  http.StatusBadRequest,
+		},
+		"bad labels": {
+			query: "name=foo_total&labels=code",
+			code:  http.StatusBadRequest,
+		},
+		"unknown labels": {
+			query: "name=foo_total&labels=code=500",
+			code:  http.StatusNotFound,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/v1/series?"+testcase.query, nil)
+			h.ServeHTTP(rec, req)
+			if want, have := testcase.code, rec.Code; want != have {
+				t.Fatalf("code: want %d, have %d (%s)", want, have, rec.Body.String())
+			}
+			if testcase.code != http.StatusOK {
+				return
+			}
+			var have aggregator.SeriesSnapshot
+			if err := json.Unmarshal(rec.Body.Bytes(), &have); err != nil {
+				t.Fatal(err)
+			}
+			if want := testcase.want; !cmp.Equal(want, have) {
+				t.Fatal(cmp.Diff(want, have))
+			}
+		})
+	}
+}
+
+func TestSeriesHandlerDelete(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`foo_total{code="200"} 3`,
+		`foo_total{code="404"} 1`,
+	}))
+
+	h := seriesHandler(u)
+	do := func(method, query string) int {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/api/v1/series?"+query, nil)
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if want, have := http.StatusNoContent, do("DELETE", "name=foo_total&labels=code=404"); want != have {
+		t.Fatalf("first delete: want %d, have %d", want, have)
+	}
+	if want, have := http.StatusNotFound, do("DELETE", "name=foo_total&labels=code=404"); want != have {
+		t.Fatalf("second delete: want %d, have %d", want, have)
+	}
+	if want, have := normalizeResponse(`
+		# HELP foo_total Total number of foos.
+		# TYPE foo_total counter
+		foo_total{code="200"} 3.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestSnapshotHandler(t *testing.T) {
+	src, _ := aggregator.NewUniverse()
+	loadObservations(t, src, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`foo_total{code="200"} 3`,
+	}))
+	dst, _ := aggregator.NewUniverse()
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/snapshot", nil)
+	snapshotHandler(src).ServeHTTP(rec, req)
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("GET: want %d, have %d", want, have)
+	}
+	snapshot := rec.Body.String()
+
+	for _, testcase := range []struct {
+		query string
+		code  int
+		want  string
+	}{
+		{"", http.StatusOK, "3.000000"},
+		{"mode=merge", http.StatusOK, "6.000000"},
+		{"mode=replace", http.StatusOK, "3.000000"},
+		{"mode=append", http.StatusBadRequest, "3.000000"},
+	} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/snapshot?"+testcase.query, strings.NewReader(snapshot))
+		snapshotHandler(dst).ServeHTTP(rec, req)
+		if want, have := testcase.code, rec.Code; want != have {
+			t.Fatalf("POST %q: want %d, have %d (%s)", testcase.query, want, have, rec.Body.String())
+		}
+		if want, have := normalizeResponse(`
+			# HELP foo_total Total number of foos.
+			# TYPE foo_total counter
+			foo_total{code="200"} `+testcase.want+`
+		`), normalizeResponse(scrape(t, dst)); want != have {
+			t.Fatalf("POST %q:\n---WANT---\n%s\n\n---HAVE---\n%s\n", testcase.query, want, have)
+		}
+	}
+}
+
+func TestBucketsHandler(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	if err := u.SetBucketSamples(100); err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{
+		`{"name":"foo_seconds","type":"histogram","help":"Foo duration in seconds.","buckets":[1]}`,
+		`{"name":"bar_seconds","type":"histogram","help":"Bar duration in seconds.","buckets":[1]}`,
+		`{"name":"baz_total","type":"counter","help":"Total number of bazzes."}`,
+	}
+	for i := 1; i <= 8; i++ {
+		lines = append(lines, fmt.Sprintf(`foo_seconds{} %d`, i))
+	}
+	loadObservations(t, u, makeObservations(t, lines))
+
+	h := bucketsHandler(u)
+	for name, testcase := range map[string]struct {
+		query string
+		code  int
+		want  aggregator.BucketSuggestion
+	}{
+		"histogram": {
+			query: "name=foo_seconds&buckets=4",
+			code:  http.StatusOK,
+			want:  aggregator.BucketSuggestion{Name: "foo_seconds", Buckets: []float64{1}, Suggested: []float64{2, 4, 6, 8}, Samples: 8, Observed: 8, Min: 1, Max: 8},
+		},
+		"missing name":   {query: "buckets=4", code: http.StatusBadRequest},
+		"bad buckets":    {query: "name=foo_seconds&buckets=0", code: http.StatusBadRequest},
+		"not sampled":    {query: "name=bar_seconds", code: http.StatusNotFound},
+		"not histogram":  {query: "name=baz_total", code: http.StatusNotFound},
+		"unknown metric": {query: "name=qux_seconds", code: http.StatusNotFound},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/v1/buckets?"+testcase.query, nil)
+			h.ServeHTTP(rec, req)
+			if want, have := testcase.code, rec.Code; want != have {
+				t.Fatalf("code: want %d, have %d (%s)", want, have, rec.Body.String())
+			}
+			if testcase.code != http.StatusOK {
+				return
+			}
+			var have aggregator.BucketSuggestion
+			if err := json.Unmarshal(rec.Body.Bytes(), &have); err != nil {
+				t.Fatal(err)
+			}
+			if want := testcase.want; !cmp.Equal(want, have) {
+				t.Fatal(cmp.Diff(want, have))
+			}
+		})
+	}
+}
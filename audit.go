@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+// Outcomes of a declaration, as recorded in the audit log.
+const (
+	auditCreated  = "created"  // a new metric
+	auditExisting = "existing" // the same type and buckets as the existing metric
+	auditConflict = "conflict" // a different type or buckets, so it's ignored or rejected
+	auditInvalid  = "invalid"  // e.g. an unknown type, or no help, so it's rejected
+)
+
+// auditSourceConfig is the source of declarations from a config reload.
+const auditSourceConfig = "config.file"
+
+// auditEntry is a single declaration, or attempted redeclaration.
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Help    string    `json:"help"`
+	Buckets []float64 `json:"buckets,omitempty"`
+	Unit    string    `json:"unit,omitempty"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// auditLog records declarations received by the aggregator, so that changes
+// to types and bucket layouts can be traced to their source. The most recent
+// entries are kept in memory, and every entry is optionally appended to a
+// file, as a line of JSON, which is rotated once it grows too large. A nil
+// auditLog records nothing.
+type auditLog struct {
+	u   *aggregator.Universe
+	now func() time.Time
+
+	mtx     sync.Mutex
+	entries []auditEntry // ring buffer
+	next    int          // index of the next entry in entries
+	full    bool         // entries has wrapped
+
+	file     *rotatingFile // nil doesn't write a file
+	failures uint64        // writes to file that failed
+}
+
+// defaultAuditEntries is the number of entries kept in memory.
+const defaultAuditEntries = 1000
+
+func newAuditLog(u *aggregator.Universe, max int) *auditLog {
+	return &auditLog{u: u, now: time.Now, entries: make([]auditEntry, max)}
+}
+
+// declaration records a declaration received from source, before it's
+// observed. Its outcome is worked out from the current state of the
+// universe, so concurrent declarations of the same new metric may all be
+// recorded as created.
+func (a *auditLog) declaration(source string, o aggregator.Observation) {
+	if a == nil {
+		return
+	}
+	outcome, err := auditExisting, error(nil)
+	if _, newMetric, _, dryErr := a.u.DryRun(o); newMetric {
+		outcome, err = auditCreated, dryErr
+		if err != nil {
+			outcome = auditInvalid
+		}
+	} else if err = a.u.CheckDeclaration(o); err != nil {
+		outcome = auditConflict
+	}
+	a.record(source, o, outcome, err)
+}
+
+// record records a declaration with a known outcome.
+func (a *auditLog) record(source string, o aggregator.Observation, outcome string, err error) {
+	if a == nil {
+		return
+	}
+	e := auditEntry{
+		Time:    a.now(),
+		Source:  source,
+		Name:    o.Name,
+		Type:    o.Type,
+		Help:    o.Help,
+		Buckets: o.Buckets,
+		Unit:    o.Unit,
+		Outcome: outcome,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.entries[a.next] = e
+	a.next = (a.next + 1) % len(a.entries)
+	a.full = a.full || a.next == 0
+	if a.file != nil {
+		buf, _ := json.Marshal(e)
+		if err := a.file.write(append(buf, '\n')); err != nil {
+			a.failures++
+		}
+	}
+}
+
+// recent returns the entries in memory, newest first, optionally only those
+// for the named metric.
+func (a *auditLog) recent(name string) []auditEntry {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	n := a.next
+	if a.full {
+		n = len(a.entries)
+	}
+	entries := []auditEntry{}
+	for i := 1; i <= n; i++ {
+		e := a.entries[(a.next-i+len(a.entries))%len(a.entries)]
+		if name == "" || e.Name == name {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// metrics returns the audit log's self-telemetry.
+func (a *auditLog) metrics() []selfMetric {
+	return []selfMetric{
+		newSelfCounterFunc("aggregator_audit_write_failures_total", "Total number of audit log entries that couldn't be written to -audit.file.", nil, func() []selfSample {
+			a.mtx.Lock()
+			defer a.mtx.Unlock()
+			return []selfSample{{value: float64(a.failures)}}
+		}),
+	}
+}
+
+// auditHandler lists recent audit log entries, newest first, optionally
+// filtered by the name query parameter.
+func auditHandler(a *auditLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		respondJSON(w, http.StatusOK, a.recent(r.URL.Query().Get("name")))
+	})
+}
+
+// rotatingFile appends to a file, and once it's larger than maxBytes, renames
+// it with the suffix .1, and starts a new one. Older files are renamed .2,
+// .3, and so on, up to maxFiles, and the oldest is removed. Writes aren't
+// buffered, so that nothing is lost if the process exits.
+type rotatingFile struct {
+	filename string
+	maxBytes int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func newRotatingFile(filename string, maxBytes int64, maxFiles int) (*rotatingFile, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("maximum size must be positive")
+	}
+	if maxFiles < 0 {
+		return nil, fmt.Errorf("maximum number of files can't be negative")
+	}
+	r := &rotatingFile{filename: filename, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+// write appends p, after rotating the file if p would make it too large.
+func (r *rotatingFile) write(p []byte) error {
+	if r.f == nil {
+		if err := r.open(); err != nil { // a previous rotation failed
+			return err
+		}
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return err
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	if r.maxFiles == 0 {
+		os.Remove(r.filename)
+	} else {
+		for i := r.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.filename, i), fmt.Sprintf("%s.%d", r.filename, i+1))
+		}
+		if err := os.Rename(r.filename, r.filename+".1"); err != nil {
+			return err
+		}
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) close() error {
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
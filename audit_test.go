@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestAuditLog(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	a := newAuditLog(u, 3)
+	a.now = func() time.Time { return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC) }
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	f, err := newRotatingFile(filename, 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+	a.file = f
+
+	in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+	in.audit = a
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`{"name":"foo_total","type":"counter","help":"Total foos."}`,
+		`foo_total{} 1`,
+		`{"name":"foo_total","type":"counter","help":"Total foos.","value":1}`,
+		`{"name":"foo_total","type":"gauge","help":"Current foos."}`,
+		`{"name":"bar","type":"frob","help":"Frobs."}`,
+	}, "\n"))))
+
+	entry := func(name, typ, help, outcome, err string) auditEntry {
+		return auditEntry{Time: a.now(), Source: sourceLocal, Name: name, Type: typ, Help: help, Outcome: outcome, Error: err}
+	}
+	all := []auditEntry{
+		entry("bar", "frob", "Frobs.", auditInvalid, "error creating new timeseries collection: invalid type 'frob'"),
+		entry("foo_total", "gauge", "Current foos.", auditConflict, "can't change type from 'counter' to 'gauge'"),
+		entry("foo_total", "counter", "Total foos.", auditExisting, ""),
+	}
+	if want, have := all, a.recent(""); !cmp.Equal(want, have) {
+		t.Errorf("recent: %s", cmp.Diff(want, have))
+	}
+
+	rec := httptest.NewRecorder()
+	auditHandler(a).ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/audit?name=bar", nil))
+	var listed []auditEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := all[:1], listed; !cmp.Equal(want, have) {
+		t.Errorf("?name=bar: %s", cmp.Diff(want, have))
+	}
+
+	// The file has every entry, including those no longer in memory.
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var outcomes []string
+	for s := bufio.NewScanner(file); s.Scan(); {
+		var e auditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		outcomes = append(outcomes, e.Outcome)
+	}
+	if want, have := []string{auditCreated, auditExisting, auditConflict, auditInvalid}, outcomes; !cmp.Equal(want, have) {
+		t.Errorf("file: %s", cmp.Diff(want, have))
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	f, err := newRotatingFile(filename, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if err := f.write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.close()
+
+	for suffix, want := range map[string]string{
+		"":   "dddddddd\n",
+		".1": "cccccccc\n",
+		".2": "bbbbbbbb\n",
+	} {
+		buf, err := os.ReadFile(filename + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := string(buf); want != have {
+			t.Errorf("%s: want %q, have %q", suffix, want, have)
+		}
+	}
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Errorf(".3: want not to exist, have %v", err)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// awsCredentials are the keys that AWS requests are signed with.
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string // only for temporary credentials
+}
+
+// Where AWS serves credentials to containers and EC2 instances, and STS
+// exchanges web identity tokens for them; variables, for tests.
+var (
+	awsContainerEndpoint = "http://169.254.170.2"
+	awsIMDSEndpoint      = "http://169.254.169.254"
+	awsSTSEndpoint       = func(region string) string {
+		if region == "" {
+			return "https://sts.amazonaws.com/"
+		}
+		return "https://sts." + region + ".amazonaws.com/"
+	}
+)
+
+// awsCredentialSource returns the credentials of the first provider the
+// environment configures, each cached until shortly before it expires, in
+// the same order as the AWS SDKs: keys in the environment, as set for Lambda
+// functions or by aws-vault and the like; a web identity token, as for IAM
+// roles for Kubernetes service accounts; the container endpoint, as for ECS
+// tasks and EKS Pod Identity; or else the EC2 instance metadata service.
+type awsCredentialSource struct {
+	mtx    sync.Mutex
+	creds  awsCredentials
+	expiry time.Time // zero doesn't expire
+	fetch  func(ctx context.Context) (awsCredentials, time.Time, error)
+	now    func() time.Time
+}
+
+func newAWSCredentialSource(client *http.Client, region string) *awsCredentialSource {
+	s := &awsCredentialSource{now: time.Now}
+	switch {
+	case os.Getenv("AWS_ACCESS_KEY_ID") != "" || os.Getenv("AWS_SECRET_ACCESS_KEY") != "":
+		s.fetch = func(context.Context) (awsCredentials, time.Time, error) {
+			c, err := awsEnvCredentials()
+			return c, time.Time{}, err
+		}
+	case os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "":
+		s.fetch = func(ctx context.Context) (awsCredentials, time.Time, error) {
+			return awsWebIdentityCredentials(ctx, client, region)
+		}
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "":
+		s.fetch = func(ctx context.Context) (awsCredentials, time.Time, error) {
+			return awsContainerCredentials(ctx, client)
+		}
+	case strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true"):
+		s.fetch = func(context.Context) (awsCredentials, time.Time, error) {
+			return awsCredentials{}, time.Time{}, errors.New("no AWS credentials in the environment, and the instance metadata service is disabled")
+		}
+	default:
+		s.fetch = func(ctx context.Context) (awsCredentials, time.Time, error) {
+			return awsIMDSCredentials(ctx, client)
+		}
+	}
+	return s
+}
+
+// Credentials returns current credentials.
+func (s *awsCredentialSource) Credentials(ctx context.Context) (awsCredentials, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.creds.accessKeyID != "" && (s.expiry.IsZero() || s.now().Before(s.expiry)) {
+		return s.creds, nil
+	}
+	creds, expiry, err := s.fetch(ctx)
+	if err != nil {
+		return awsCredentials{}, errors.Wrap(err, "getting AWS credentials")
+	}
+	// Refresh a minute early, so credentials don't expire in flight.
+	s.creds, s.expiry = creds, expiry
+	if !expiry.IsZero() {
+		s.expiry = expiry.Add(-time.Minute)
+	}
+	return creds, nil
+}
+
+// awsEnvCredentials returns the keys in the environment.
+func awsEnvCredentials() (awsCredentials, error) {
+	c := awsCredentials{
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.accessKeyID == "" || c.secretAccessKey == "" {
+		return c, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return c, nil
+}
+
+// awsWebIdentityCredentials exchanges the token in
+// $AWS_WEB_IDENTITY_TOKEN_FILE for temporary credentials of $AWS_ROLE_ARN,
+// with STS AssumeRoleWithWebIdentity, which isn't signed.
+func awsWebIdentityCredentials(ctx context.Context, client *http.Client, region string) (awsCredentials, time.Time, error) {
+	token, err := os.ReadFile(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	role := os.Getenv("AWS_ROLE_ARN")
+	if role == "" {
+		return awsCredentials{}, time.Time{}, errors.New("AWS_ROLE_ARN must be set with AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = fmt.Sprintf("prometheus-aggregator-%d", time.Now().UnixNano())
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequest("POST", awsSTSEndpoint(region), strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&e)
+		return awsCredentials{}, time.Time{}, errors.Wrap(&awsError{Code: e.Code, Message: e.Message, status: resp.StatusCode}, "AssumeRoleWithWebIdentity")
+	}
+	var out struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return awsCredentials{}, time.Time{}, errors.Wrap(err, "decoding AssumeRoleWithWebIdentity response")
+	}
+	c := out.Credentials
+	return awsCredentials{c.AccessKeyID, c.SecretAccessKey, c.SessionToken}, c.Expiration, nil
+}
+
+// awsContainerCredentials returns the credentials served at
+// $AWS_CONTAINER_CREDENTIALS_RELATIVE_URI of the ECS container endpoint, or
+// else at $AWS_CONTAINER_CREDENTIALS_FULL_URI, with the authorization token
+// in $AWS_CONTAINER_AUTHORIZATION_TOKEN, or in the file at
+// $AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE.
+func awsContainerCredentials(ctx context.Context, client *http.Client) (awsCredentials, time.Time, error) {
+	u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		u = awsContainerEndpoint + relative
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if filename := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); filename != "" {
+		buf, err := os.ReadFile(filename)
+		if err != nil {
+			return awsCredentials{}, time.Time{}, err
+		}
+		token = strings.TrimSpace(string(buf))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return awsCredentialsResponse(client, req.WithContext(ctx))
+}
+
+// awsIMDSCredentials returns the credentials of the instance profile's role
+// from the EC2 instance metadata service, with a session token, as IMDSv2
+// requires.
+func awsIMDSCredentials(ctx context.Context, client *http.Client) (awsCredentials, time.Time, error) {
+	req, err := http.NewRequest("PUT", awsIMDSEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "300")
+	token, err := awsIMDSGet(client, req.WithContext(ctx))
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	const credentialsPath = "/latest/meta-data/iam/security-credentials/"
+	if req, err = http.NewRequest("GET", awsIMDSEndpoint+credentialsPath, nil); err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	roles, err := awsIMDSGet(client, req.WithContext(ctx))
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return awsCredentials{}, time.Time{}, errors.New("the instance has no IAM role")
+	}
+	if req, err = http.NewRequest("GET", awsIMDSEndpoint+credentialsPath+url.PathEscape(role), nil); err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	return awsCredentialsResponse(client, req.WithContext(ctx))
+}
+
+// awsIMDSGet returns the body of the response to req, of the instance
+// metadata service.
+func awsIMDSGet(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "instance metadata service")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("instance metadata service: %s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	return string(buf), err
+}
+
+// awsCredentialsResponse returns the credentials in the response to req, of
+// the container endpoint or the instance metadata service, which both serve
+// them as JSON.
+func awsCredentialsResponse(client *http.Client, req *http.Request) (awsCredentials, time.Time, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("%s: %s", req.URL.Redacted(), resp.Status)
+	}
+	var c struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return awsCredentials{}, time.Time{}, errors.Wrap(err, "decoding credentials")
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("%s: no credentials", req.URL.Redacted())
+	}
+	return awsCredentials{c.AccessKeyID, c.SecretAccessKey, c.Token}, c.Expiration, nil
+}
+
+// awsRegion returns the region in the environment, if any.
+func awsRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// awsClient calls the actions of AWS services with JSON APIs, such as SQS and
+// Kinesis, directly, signing each request with Signature Version 4.
+type awsClient struct {
+	creds  func(ctx context.Context) (awsCredentials, error)
+	region string
+	client *http.Client
+	now    func() time.Time
+}
+
+func newAWSClient(region string) *awsClient {
+	client := &http.Client{Timeout: time.Minute}
+	return &awsClient{
+		creds:  newAWSCredentialSource(client, region).Credentials,
+		region: region,
+		client: client,
+		now:    time.Now,
+	}
+}
+
+// awsError is an error response from an AWS service.
+type awsError struct {
+	Code    string `json:"__type"`
+	Message string `json:"message"`
+	status  int
+}
+
+func (e *awsError) Error() string {
+	code := e.Code
+	if i := strings.LastIndexByte(code, '#'); i >= 0 {
+		code = code[i+1:] // e.g. com.amazonaws.sqs#QueueDoesNotExist
+	}
+	if code == "" {
+		code = http.StatusText(e.status)
+	}
+	if e.Message == "" {
+		return code
+	}
+	return code + ": " + e.Message
+}
+
+// call calls the target action of service at endpoint, e.g.
+// AmazonSQS.ReceiveMessage, with in, and decodes the response into out.
+// version is the version of the service's JSON protocol, 1.0 or 1.1.
+func (c *awsClient) call(ctx context.Context, service, version, endpoint, target string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-"+version)
+	req.Header.Set("X-Amz-Target", target)
+	creds, err := c.creds(ctx)
+	if err != nil {
+		return err
+	}
+	signAWS(req, body, creds, c.region, service, c.now())
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		e := &awsError{status: resp.StatusCode}
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(e)
+		return errors.Wrap(e, target)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return errors.Wrapf(err, "decoding %s response", target)
+	}
+	return nil
+}
+
+// signAWS signs req, whose body is body, with Signature Version 4, by setting
+// its X-Amz-Date and Authorization headers. Every header already set is
+// signed, along with the host.
+func signAWS(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	stamp := now.Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.secretAccessKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.accessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery returns the query sorted by name and value, and encoded as
+// Signature Version 4 requires.
+func canonicalQuery(query map[string][]string) string {
+	var pairs []string
+	for k, vs := range query {
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes every byte of s but the unreserved characters.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// inputRetryInterval is how long inputs wait to retry a failed poll.
+const inputRetryInterval = 5 * time.Second
+
+// sqsInput receives lines from an SQS queue, for producers that can't hold a
+// socket open, e.g. Lambda functions. Each message's body is a payload of
+// lines, as decoded by decodePayload. Messages are deleted once they're
+// handled, whether or not their lines are accepted, so that a bad message
+// isn't received forever; a message that can't be deleted is received again.
+type sqsInput struct {
+	aws      *awsClient
+	queueURL string
+	endpoint string // of the SQS API
+	source   string
+	in       *ingester
+	logger   log.Logger
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// newSQSInput returns an input for the queue at queueURL. The region is taken
+// from the URL, if it's an AWS endpoint, or else must be given.
+func newSQSInput(queueURL, region string, in *ingester, logger log.Logger) (*sqsInput, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return nil, err
+	}
+	name := u.Path[strings.LastIndexByte(u.Path, '/')+1:]
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || name == "" {
+		return nil, fmt.Errorf("%s isn't a queue URL, e.g. https://sqs.us-east-1.amazonaws.com/123456789012/metrics", queueURL)
+	}
+	if parts := strings.Split(u.Hostname(), "."); len(parts) >= 4 && parts[0] == "sqs" && parts[len(parts)-2] == "amazonaws" {
+		region = parts[1]
+	}
+	if region == "" {
+		return nil, fmt.Errorf("the region of %s must be given", queueURL)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &sqsInput{
+		aws:      newAWSClient(region),
+		queueURL: queueURL,
+		endpoint: u.Scheme + "://" + u.Host + "/",
+		source:   "sqs/" + name,
+		in:       in,
+		logger:   log.With(logger, "input", "sqs", "queue_url", queueURL),
+		ctx:      ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+type sqsMessage struct {
+	MessageID     string `json:"MessageId"`
+	ReceiptHandle string `json:"ReceiptHandle"`
+	Body          string `json:"Body"`
+}
+
+// run receives messages until the input is closed, or drained.
+func (s *sqsInput) run() error {
+	s.in.track(s)
+	defer s.in.untrack(s)
+	for {
+		var resp struct {
+			Messages []sqsMessage `json:"Messages"`
+		}
+		err := s.aws.call(s.ctx, "sqs", "1.0", s.endpoint, "AmazonSQS.ReceiveMessage", map[string]interface{}{
+			"QueueUrl":            s.queueURL,
+			"MaxNumberOfMessages": 10,
+			"WaitTimeSeconds":     20,
+		}, &resp)
+		if s.ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			level.Warn(s.logger).Log("during", "receive", "err", err)
+			if !sleepContext(s.ctx, inputRetryInterval) {
+				return nil
+			}
+			continue
+		}
+		if len(resp.Messages) == 0 {
+			continue
+		}
+		for _, m := range resp.Messages {
+			s.in.handlePayload(log.With(s.logger, "message_id", m.MessageID), s.source, handshake{}, []byte(m.Body))
+		}
+		s.delete(resp.Messages)
+	}
+}
+
+// delete deletes handled messages, even if the input's been closed since
+// they were received, so that they're not received again.
+func (s *sqsInput) delete(messages []sqsMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	entries := make([]map[string]string, len(messages))
+	for i, m := range messages {
+		entries[i] = map[string]string{"Id": strconv.Itoa(i), "ReceiptHandle": m.ReceiptHandle}
+	}
+	var resp struct {
+		Failed []struct {
+			ID      string `json:"Id"`
+			Message string `json:"Message"`
+		} `json:"Failed"`
+	}
+	err := s.aws.call(ctx, "sqs", "1.0", s.endpoint, "AmazonSQS.DeleteMessageBatch", map[string]interface{}{
+		"QueueUrl": s.queueURL,
+		"Entries":  entries,
+	}, &resp)
+	if err == nil && len(resp.Failed) > 0 {
+		err = fmt.Errorf("%d of %d messages: %s", len(resp.Failed), len(messages), resp.Failed[0].Message)
+	}
+	if err != nil {
+		level.Warn(s.logger).Log("during", "delete", "err", err, "consequence", "messages will be received again")
+	}
+}
+
+// Close stops receiving messages, once those already received are handled.
+func (s *sqsInput) Close() error {
+	s.cancel()
+	return nil
+}
+
+// kinesisListInterval is how often a Kinesis stream's shards are listed, to
+// find new shards after it's resharded.
+const kinesisListInterval = time.Minute
+
+// kinesisInput receives lines from every shard of a Kinesis stream, for
+// producers that can't hold a socket open. Each record's data is a payload of
+// lines, as decoded by decodePayload. Nothing is checkpointed: the shards are
+// read from the latest record when the input starts, and shards created by
+// resharding since then from their oldest record.
+type kinesisInput struct {
+	aws      *awsClient
+	stream   string
+	endpoint string
+	interval time.Duration
+	source   string
+	in       *ingester
+	logger   log.Logger
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+type kinesisShard struct {
+	iterator string
+	last     string // sequence number of the last record read
+}
+
+func newKinesisInput(stream, region string, interval time.Duration, in *ingester, logger log.Logger) (*kinesisInput, error) {
+	if region == "" {
+		return nil, errors.New("the region of the stream must be given")
+	}
+	if interval <= 0 {
+		return nil, errors.New("poll interval must be positive")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &kinesisInput{
+		aws:      newAWSClient(region),
+		stream:   stream,
+		endpoint: "https://kinesis." + region + ".amazonaws.com/",
+		interval: interval,
+		source:   "kinesis/" + stream,
+		in:       in,
+		logger:   log.With(logger, "input", "kinesis", "stream", stream),
+		ctx:      ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+// run reads records from the stream's shards every interval, until the input
+// is closed, or drained.
+func (k *kinesisInput) run() error {
+	k.in.track(k)
+	defer k.in.untrack(k)
+	var (
+		shards = map[string]*kinesisShard{} // open shards
+		seen   = map[string]bool{}          // every shard ever listed
+		first  = true
+		listed time.Time
+	)
+	for {
+		if time.Since(listed) >= kinesisListInterval {
+			if err := k.list(shards, seen, first); err != nil {
+				level.Warn(k.logger).Log("during", "list shards", "err", err)
+			} else {
+				first, listed = false, time.Now()
+			}
+		}
+		for id, shard := range shards {
+			closed, err := k.read(id, shard)
+			if k.ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				level.Warn(k.logger).Log("during", "get records", "shard", id, "err", err)
+			}
+			if closed {
+				delete(shards, id)
+				listed = time.Time{} // look for its children
+			}
+		}
+		if !sleepContext(k.ctx, k.interval) {
+			return nil
+		}
+	}
+}
+
+// list adds the shards of the stream that haven't been seen before, with
+// iterators at their latest record if they're the first listed, or else at
+// their oldest.
+func (k *kinesisInput) list(shards map[string]*kinesisShard, seen map[string]bool, first bool) error {
+	req := map[string]interface{}{"StreamName": k.stream}
+	for {
+		var resp struct {
+			Shards []struct {
+				ShardID string `json:"ShardId"`
+			} `json:"Shards"`
+			NextToken string `json:"NextToken"`
+		}
+		if err := k.aws.call(k.ctx, "kinesis", "1.1", k.endpoint, "Kinesis_20131202.ListShards", req, &resp); err != nil {
+			return err
+		}
+		for _, s := range resp.Shards {
+			if seen[s.ShardID] {
+				continue
+			}
+			position := "TRIM_HORIZON"
+			if first {
+				position = "LATEST"
+			}
+			iterator, err := k.iterator(s.ShardID, position, "")
+			if err != nil {
+				return err
+			}
+			seen[s.ShardID] = true
+			shards[s.ShardID] = &kinesisShard{iterator: iterator}
+		}
+		if resp.NextToken == "" {
+			return nil
+		}
+		req = map[string]interface{}{"NextToken": resp.NextToken}
+	}
+}
+
+func (k *kinesisInput) iterator(shardID, position, after string) (string, error) {
+	req := map[string]interface{}{
+		"StreamName":        k.stream,
+		"ShardId":           shardID,
+		"ShardIteratorType": position,
+	}
+	if after != "" {
+		req["StartingSequenceNumber"] = after
+	}
+	var resp struct {
+		ShardIterator string `json:"ShardIterator"`
+	}
+	err := k.aws.call(k.ctx, "kinesis", "1.1", k.endpoint, "Kinesis_20131202.GetShardIterator", req, &resp)
+	return resp.ShardIterator, err
+}
+
+// read handles the records of the shard since it was last read, and reports
+// whether it's been closed, by resharding, and read to its end.
+func (k *kinesisInput) read(id string, shard *kinesisShard) (closed bool, err error) {
+	var resp struct {
+		Records []struct {
+			Data           []byte `json:"Data"`
+			SequenceNumber string `json:"SequenceNumber"`
+		} `json:"Records"`
+		NextShardIterator string `json:"NextShardIterator"`
+	}
+	err = k.aws.call(k.ctx, "kinesis", "1.1", k.endpoint, "Kinesis_20131202.GetRecords", map[string]interface{}{
+		"ShardIterator": shard.iterator,
+		"Limit":         1000,
+	}, &resp)
+	if e, ok := errors.Cause(err).(*awsError); ok && strings.HasSuffix(e.Code, "ExpiredIteratorException") {
+		position := "AFTER_SEQUENCE_NUMBER"
+		if shard.last == "" {
+			position = "LATEST"
+		}
+		shard.iterator, err = k.iterator(id, position, shard.last)
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, r := range resp.Records {
+		k.in.handlePayload(k.logger, k.source, handshake{}, r.Data)
+		shard.last = r.SequenceNumber
+	}
+	shard.iterator = resp.NextShardIterator
+	return shard.iterator == "", nil
+}
+
+// Close stops reading records, once those already read are handled.
+func (k *kinesisInput) Close() error {
+	k.cancel()
+	return nil
+}
+
+// sleepContext waits for d, and returns false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
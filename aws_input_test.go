@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+// fakeAWS serves the actions of a fake AWS service, by X-Amz-Target.
+type fakeAWS struct {
+	mtx     sync.Mutex
+	actions map[string]func(req map[string]interface{}) interface{}
+	calls   []string
+}
+
+func (f *fakeAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		http.Error(w, `{"__type":"MissingAuthenticationToken"}`, http.StatusForbidden)
+		return
+	}
+	var req map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&req)
+	target := r.Header.Get("X-Amz-Target")
+	f.mtx.Lock()
+	f.calls = append(f.calls, target)
+	action, ok := f.actions[target]
+	f.mtx.Unlock()
+	if !ok {
+		http.Error(w, `{"__type":"UnknownOperationException"}`, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(action(req))
+}
+
+func (f *fakeAWS) called(target string) int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	var n int
+	for _, call := range f.calls {
+		if call == target {
+			n++
+		}
+	}
+	return n
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testCredentials(context.Context) (awsCredentials, error) {
+	return awsCredentials{accessKeyID: "AKID", secretAccessKey: "secret"}, nil
+}
+
+func TestSQSInput(t *testing.T) {
+	var (
+		deleted  []string
+		received bool
+	)
+	fake := &fakeAWS{actions: map[string]func(map[string]interface{}) interface{}{
+		"AmazonSQS.ReceiveMessage": func(map[string]interface{}) interface{} {
+			var messages []sqsMessage
+			if !received {
+				received = true
+				messages = []sqsMessage{
+					{MessageID: "1", ReceiptHandle: "r1", Body: `{"name":"foo","type":"counter","help":"Total foos."}` + "\n" + `foo{} 1`},
+					{MessageID: "2", ReceiptHandle: "r2", Body: `[{"name":"foo","value":2}]`},
+					{MessageID: "3", ReceiptHandle: "r3", Body: base64.StdEncoding.EncodeToString(gzipped(t, `foo{} 3`))},
+					{MessageID: "4", ReceiptHandle: "r4", Body: gzipBase64Prefix + "!!!"}, // rejected, but deleted
+				}
+			} else {
+				time.Sleep(10 * time.Millisecond) // a short poll
+			}
+			return map[string]interface{}{"Messages": messages}
+		},
+		"AmazonSQS.DeleteMessageBatch": func(req map[string]interface{}) interface{} {
+			for _, e := range req["Entries"].([]interface{}) {
+				deleted = append(deleted, e.(map[string]interface{})["ReceiptHandle"].(string))
+			}
+			return map[string]interface{}{}
+		},
+	}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	u, _ := aggregator.NewUniverse()
+	in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+	s, err := newSQSInput(srv.URL+"/123456789012/metrics", "us-east-1", in, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.aws.creds = testCredentials
+	done := make(chan error)
+	go func() { done <- s.run() }()
+	waitFor(t, "delete", func() bool { return fake.called("AmazonSQS.DeleteMessageBatch") > 0 })
+	s.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := "r1 r2 r3 r4", strings.Join(deleted, " "); want != have {
+		t.Errorf("deleted: want %s, have %s", want, have)
+	}
+	if want, have := normalizeResponse(`
+		# HELP foo Total foos.
+		# TYPE foo counter
+		foo{} 6.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestNewSQSInput(t *testing.T) {
+	for name, tc := range map[string]struct {
+		url        string
+		region     string
+		wantRegion string
+		wantErr    bool
+	}{
+		"AWS":             {url: "https://sqs.eu-west-1.amazonaws.com/123456789012/metrics", wantRegion: "eu-west-1"},
+		"AWS with region": {url: "https://sqs.eu-west-1.amazonaws.com/123456789012/metrics", region: "us-east-1", wantRegion: "eu-west-1"},
+		"local":           {url: "http://localhost:4566/000000000000/metrics", region: "us-east-1", wantRegion: "us-east-1"},
+		"local no region": {url: "http://localhost:4566/000000000000/metrics", wantErr: true},
+		"no queue":        {url: "https://sqs.eu-west-1.amazonaws.com/", wantErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, err := newSQSInput(tc.url, tc.region, nil, log.NewNopLogger())
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, have none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, have := tc.wantRegion, s.aws.region; want != have {
+				t.Fatalf("want %s, have %s", want, have)
+			}
+		})
+	}
+}
+
+func TestKinesisInput(t *testing.T) {
+	var mtx sync.Mutex
+	positions := map[string]string{}
+	fake := &fakeAWS{actions: map[string]func(map[string]interface{}) interface{}{
+		"Kinesis_20131202.ListShards": func(map[string]interface{}) interface{} {
+			return map[string]interface{}{"Shards": []map[string]string{{"ShardId": "shard-0"}, {"ShardId": "shard-1"}}}
+		},
+		"Kinesis_20131202.GetShardIterator": func(req map[string]interface{}) interface{} {
+			id := req["ShardId"].(string)
+			mtx.Lock()
+			positions[id] = req["ShardIteratorType"].(string)
+			mtx.Unlock()
+			return map[string]string{"ShardIterator": id + "/0"}
+		},
+		"Kinesis_20131202.GetRecords": func(req map[string]interface{}) interface{} {
+			switch req["ShardIterator"] {
+			case "shard-0/0":
+				return map[string]interface{}{
+					"Records": []map[string]interface{}{
+						{"Data": []byte(`{"name":"foo","type":"counter","help":"Total foos."}`), "SequenceNumber": "1"},
+						{"Data": gzipped(t, "foo{} 1\nfoo{} 2"), "SequenceNumber": "2"},
+					},
+					"NextShardIterator": "shard-0/1",
+				}
+			case "shard-1/0":
+				return map[string]interface{}{"Records": []interface{}{}} // closed
+			}
+			return map[string]interface{}{"Records": []interface{}{}, "NextShardIterator": req["ShardIterator"]}
+		},
+	}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	u, _ := aggregator.NewUniverse()
+	in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+	k, err := newKinesisInput("metrics", "us-east-1", 10*time.Millisecond, in, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.aws.creds = testCredentials
+	k.endpoint = srv.URL + "/"
+	done := make(chan error)
+	go func() { done <- k.run() }()
+	waitFor(t, "records", func() bool { return fake.called("Kinesis_20131202.GetRecords") > 4 })
+	k.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// The shards were listed again once shard-1 was closed, but they'd
+	// already been seen.
+	if want, have := 2, fake.called("Kinesis_20131202.ListShards"); want != have {
+		t.Errorf("ListShards: want %d calls, have %d", want, have)
+	}
+	mtx.Lock()
+	if want, have := "LATEST LATEST", positions["shard-0"]+" "+positions["shard-1"]; want != have {
+		t.Errorf("positions: want %s, have %s", want, have)
+	}
+	mtx.Unlock()
+	if want, have := normalizeResponse(`
+		# HELP foo Total foos.
+		# TYPE foo counter
+		foo{} 3.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSignAWS(t *testing.T) {
+	// From the Signature Version 4 test suite.
+	creds := awsCredentials{
+		accessKeyID:     "AKIDEXAMPLE",
+		secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	for name, tc := range map[string]struct {
+		method string
+		url    string
+		want   string
+	}{
+		"get-vanilla": {
+			method: "GET",
+			url:    "https://example.amazonaws.com/",
+			want:   "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		"get-vanilla-query-order-key-case": {
+			method: "GET",
+			url:    "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			want:   "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, tc.url, nil)
+			signAWS(req, nil, creds, "us-east-1", "service", now)
+			if want, have := tc.want, req.Header.Get("Authorization"); want != have {
+				t.Fatalf("\nwant %s\nhave %s", want, have)
+			}
+		})
+	}
+}
+
+func TestAWSCredentialSource(t *testing.T) {
+	expiration := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	credentialsJSON := fmt.Sprintf(`{"AccessKeyId":"AKID","SecretAccessKey":"secret","Token":"token","Expiration":%q}`, expiration.Format(time.RFC3339))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/container", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "auth" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, credentialsJSON)
+	})
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds") == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, "imds-token")
+	})
+	mux.HandleFunc("/latest/meta-data/iam/security-credentials/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Aws-Ec2-Metadata-Token") != "imds-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/latest/meta-data/iam/security-credentials/" {
+			fmt.Fprint(w, "my-role\n")
+			return
+		}
+		fmt.Fprint(w, credentialsJSON)
+	})
+	mux.HandleFunc("/sts/", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("Action") != "AssumeRoleWithWebIdentity" || r.FormValue("WebIdentityToken") != "jwt" || r.FormValue("RoleArn") != "arn:aws:iam::123456789012:role/metrics" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>nope</Message></Error></ErrorResponse>`)
+			return
+		}
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+			<AccessKeyId>AKID</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken>
+			<Expiration>%s</Expiration></Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`, expiration.Format(time.RFC3339))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	defer func(container, imds string, sts func(string) string) {
+		awsContainerEndpoint, awsIMDSEndpoint, awsSTSEndpoint = container, imds, sts
+	}(awsContainerEndpoint, awsIMDSEndpoint, awsSTSEndpoint)
+	awsContainerEndpoint, awsIMDSEndpoint = srv.URL, srv.URL
+	awsSTSEndpoint = func(string) string { return srv.URL + "/sts/" }
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("jwt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	temporary := awsCredentials{"AKID", "secret", "token"}
+	for name, tc := range map[string]struct {
+		env     map[string]string
+		want    awsCredentials
+		expires bool
+		wantErr bool
+	}{
+		"environment": {
+			env:  map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret"},
+			want: awsCredentials{accessKeyID: "AKID", secretAccessKey: "secret"},
+		},
+		"environment without secret": {
+			env:     map[string]string{"AWS_ACCESS_KEY_ID": "AKID"},
+			wantErr: true,
+		},
+		"web identity": {
+			env:     map[string]string{"AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile, "AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/metrics"},
+			want:    temporary,
+			expires: true,
+		},
+		"web identity, other role": {
+			env:     map[string]string{"AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile, "AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/other"},
+			wantErr: true,
+		},
+		"container": {
+			env:     map[string]string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/container", "AWS_CONTAINER_AUTHORIZATION_TOKEN": "auth"},
+			want:    temporary,
+			expires: true,
+		},
+		"container, full URI": {
+			env:     map[string]string{"AWS_CONTAINER_CREDENTIALS_FULL_URI": srv.URL + "/container", "AWS_CONTAINER_AUTHORIZATION_TOKEN": "auth"},
+			want:    temporary,
+			expires: true,
+		},
+		"container, unauthorized": {
+			env:     map[string]string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/container"},
+			wantErr: true,
+		},
+		"instance metadata": {
+			want:    temporary,
+			expires: true,
+		},
+		"instance metadata disabled": {
+			env:     map[string]string{"AWS_EC2_METADATA_DISABLED": "true"},
+			wantErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for _, k := range []string{
+				"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+				"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN", "AWS_ROLE_SESSION_NAME",
+				"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+				"AWS_CONTAINER_AUTHORIZATION_TOKEN", "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE",
+				"AWS_EC2_METADATA_DISABLED",
+			} {
+				t.Setenv(k, tc.env[k])
+			}
+			s := newAWSCredentialSource(srv.Client(), "us-east-1")
+			have, err := s.Credentials(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want error %v, have %v", tc.wantErr, err)
+			}
+			if have != tc.want {
+				t.Errorf("want %+v, have %+v", tc.want, have)
+			}
+			if want, have := tc.expires, !s.expiry.IsZero(); want != have {
+				t.Errorf("expires: want %v, have %v", want, have)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"github.com/pkg/errors"
+)
+
+// benchConfig describes the synthetic traffic generated by the bench
+// subcommand.
+type benchConfig struct {
+	network, address string
+	rate             float64 // lines per second over all connections, 0 is unlimited
+	duration         time.Duration
+	connections      int
+	metrics          int // distinct metric names
+	series           int // distinct label values per metric
+	format           string
+	gzip             bool
+}
+
+// benchResult is what the senders achieved.
+type benchResult struct {
+	lines   uint64
+	bytes   uint64
+	errors  uint64
+	elapsed time.Duration
+}
+
+// runBench implements the bench subcommand, and returns the exit code.
+func runBench(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	var (
+		target  = fs.String("target", "tcp://127.0.0.1:8191", "socket address of the aggregator under test")
+		promURL = fs.String("prometheus", "", "URL of the aggregator's /metrics, to report accepted and rejected lines (optional)")
+		rate    = fs.Float64("rate", 0, "lines per second over all connections (0 is as fast as possible)")
+		dur     = fs.Duration("duration", 10*time.Second, "how long to send for")
+		conns   = fs.Int("connections", 4, "number of concurrent connections, or UDP senders")
+		metrics = fs.Int("metrics", 10, "number of distinct metric names")
+		series  = fs.Int("series", 100, "number of distinct series per metric")
+		format  = fs.String("format", "prometheus", "line format: prometheus, json")
+		gz      = fs.Bool("gzip", false, "compress each datagram (UDP only)")
+	)
+	fs.Usage = usageFor(fs, "prometheus-aggregator bench [flags]")
+	fs.Parse(args)
+
+	c := benchConfig{
+		rate:        *rate,
+		duration:    *dur,
+		connections: *conns,
+		metrics:     *metrics,
+		series:      *series,
+		format:      *format,
+		gzip:        *gz,
+	}
+	if err := c.setTarget(*target); err != nil {
+		fmt.Fprintf(stdout, "-target: %v\n", err)
+		return 1
+	}
+	if err := c.validate(); err != nil {
+		fmt.Fprintf(stdout, "bench: %v\n", err)
+		return 1
+	}
+
+	var before map[string]float64
+	if *promURL != "" {
+		var err error
+		if before, err = scrapeSelfTelemetry(*promURL); err != nil {
+			fmt.Fprintf(stdout, "-prometheus: %v\n", err)
+			return 1
+		}
+	}
+
+	res, err := c.run(context.Background())
+	if err != nil {
+		fmt.Fprintf(stdout, "bench: %v\n", err)
+		return 1
+	}
+	c.report(stdout, res)
+
+	if *promURL != "" {
+		time.Sleep(time.Second) // let the aggregator catch up
+		after, err := scrapeSelfTelemetry(*promURL)
+		if err != nil {
+			fmt.Fprintf(stdout, "-prometheus: %v\n", err)
+			return 1
+		}
+		reportAggregatorDelta(stdout, res, before, after)
+	}
+	return 0
+}
+
+func (c *benchConfig) setTarget(target string) (err error) {
+	c.network, c.address, err = parseTarget(target)
+	return err
+}
+
+func (c benchConfig) packets() bool {
+	return isPacketNetwork(c.network)
+}
+
+// parseTarget parses the socket address of an aggregator, in the same form
+// as -socket, for clients like bench and replay.
+func parseTarget(target string) (network, address string, err error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", "", err
+	}
+	network = strings.ToLower(u.Scheme)
+	switch network {
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		address = u.Host
+	case "unix", "unixgram":
+		address = u.Path
+	default:
+		return "", "", fmt.Errorf("unsupported network %q", u.Scheme)
+	}
+	return network, address, nil
+}
+
+// isPacketNetwork reports whether each line is sent as a datagram, rather
+// than followed by a newline.
+func isPacketNetwork(network string) bool {
+	return strings.HasPrefix(network, "udp") || network == "unixgram"
+}
+
+func (c benchConfig) validate() error {
+	switch c.format {
+	case "prometheus", "json":
+	default:
+		return fmt.Errorf("invalid format %q", c.format)
+	}
+	if c.gzip && !c.packets() {
+		return fmt.Errorf("-gzip is only supported with UDP targets, as compressed lines may contain newlines")
+	}
+	if c.connections <= 0 || c.metrics <= 0 || c.series <= 0 {
+		return fmt.Errorf("connections, metrics, and series must be positive")
+	}
+	return nil
+}
+
+// declarations returns the declaration line for each metric.
+func (c benchConfig) declarations() [][]byte {
+	lines := make([][]byte, c.metrics)
+	for i := range lines {
+		lines[i], _ = json.Marshal(aggregator.Observation{
+			Name: benchMetricName(i),
+			Type: "counter",
+			Help: "Synthetic benchmark counter.",
+		})
+	}
+	return lines
+}
+
+func benchMetricName(i int) string {
+	return "bench_metric_" + strconv.Itoa(i) + "_total"
+}
+
+// appendLine appends the k'th line, which cycles through every series of
+// every metric.
+func (c benchConfig) appendLine(b []byte, k int) []byte {
+	name, series := benchMetricName(k%c.metrics), strconv.Itoa((k/c.metrics)%c.series)
+	if c.format == "json" {
+		b = append(b, `{"name":"`...)
+		b = append(b, name...)
+		b = append(b, `","labels":{"series":"`...)
+		b = append(b, series...)
+		return append(b, `"},"value":1}`...)
+	}
+	b = append(b, name...)
+	b = append(b, `{series="`...)
+	b = append(b, series...)
+	return append(b, `"} 1`...)
+}
+
+// run sends lines from each connection until the duration elapses.
+func (c benchConfig) run(ctx context.Context) (benchResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.duration)
+	defer cancel()
+
+	conns := make([]net.Conn, c.connections)
+	for i := range conns {
+		conn, err := net.Dial(c.network, c.address)
+		if err != nil {
+			for _, conn := range conns[:i] {
+				conn.Close()
+			}
+			return benchResult{}, errors.Wrap(err, "dial")
+		}
+		conns[i] = conn
+	}
+
+	var (
+		res   benchResult
+		wg    sync.WaitGroup
+		begin = time.Now()
+	)
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn net.Conn) {
+			defer wg.Done()
+			defer conn.Close()
+			c.send(ctx, i, conn, &res)
+		}(i, conn)
+	}
+	wg.Wait()
+	res.elapsed = time.Since(begin)
+	return res, nil
+}
+
+// send declares the metrics, and then sends lines at the connection's share
+// of the rate. Lines are numbered so that connections send distinct series.
+func (c benchConfig) send(ctx context.Context, worker int, conn net.Conn, res *benchResult) {
+	var (
+		w     = bufio.NewWriter(conn)
+		buf   []byte
+		zbuf  bytes.Buffer
+		zw    = gzip.NewWriter(&zbuf)
+		rate  = c.rate / float64(c.connections)
+		begin = time.Now()
+	)
+	write := func(line []byte) error {
+		if c.gzip {
+			zbuf.Reset()
+			zw.Reset(&zbuf)
+			zw.Write(line)
+			zw.Close()
+			line = zbuf.Bytes()
+		}
+		var err error
+		if c.packets() {
+			_, err = conn.Write(line)
+		} else if _, err = w.Write(line); err == nil {
+			err = w.WriteByte('\n')
+		}
+		if err != nil {
+			atomic.AddUint64(&res.errors, 1)
+			return err
+		}
+		atomic.AddUint64(&res.lines, 1)
+		atomic.AddUint64(&res.bytes, uint64(len(line)))
+		return nil
+	}
+	defer w.Flush()
+
+	// Errors writing datagrams may be transient, but a stream that fails
+	// to write is broken.
+	for _, line := range c.declarations() {
+		if err := write(line); err != nil && !c.packets() {
+			return
+		}
+	}
+	for sent := 0; ; sent++ {
+		if ctx.Err() != nil {
+			return
+		}
+		if rate > 0 {
+			for float64(sent) >= time.Since(begin).Seconds()*rate {
+				w.Flush()
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Millisecond):
+				}
+			}
+		}
+		buf = c.appendLine(buf[:0], sent*c.connections+worker)
+		if err := write(buf); err != nil && !c.packets() {
+			return
+		}
+	}
+}
+
+func (c benchConfig) report(w io.Writer, res benchResult) {
+	secs := res.elapsed.Seconds()
+	fmt.Fprintf(w, "target       %s://%s\n", c.network, c.address)
+	fmt.Fprintf(w, "series       %d (%d metrics x %d series)\n", c.metrics*c.series, c.metrics, c.series)
+	fmt.Fprintf(w, "elapsed      %s\n", res.elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "sent         %d lines (%.0f/s), %d bytes (%.0f/s)\n", res.lines, float64(res.lines)/secs, res.bytes, float64(res.bytes)/secs)
+	fmt.Fprintf(w, "send errors  %d (%.2f%%)\n", res.errors, percent(res.errors, res.lines+res.errors))
+}
+
+// reportAggregatorDelta reports how many lines the aggregator accepted and
+// rejected during the run, according to its self-telemetry. Lines sent by
+// other clients in the meantime are included.
+func reportAggregatorDelta(w io.Writer, res benchResult, before, after map[string]float64) {
+	delta := func(name string) uint64 { return uint64(after[name] - before[name]) }
+	accepted, rejected := delta("aggregator_lines_accepted_total"), delta("aggregator_lines_rejected_total")
+	fmt.Fprintf(w, "accepted     %d (%.2f%%)\n", accepted, percent(accepted, res.lines))
+	fmt.Fprintf(w, "rejected     %d (%.2f%%)\n", rejected, percent(rejected, res.lines))
+	if res.lines > accepted+rejected {
+		fmt.Fprintf(w, "lost         %d (%.2f%%)\n", res.lines-accepted-rejected, percent(res.lines-accepted-rejected, res.lines))
+	}
+}
+
+func percent(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// scrapeSelfTelemetry returns the aggregator's self-telemetry from its
+// /metrics, summed over labels, by metric name.
+func scrapeSelfTelemetry(u string) (map[string]float64, error) {
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return parseSelfTelemetry(resp.Body)
+}
+
+func parseSelfTelemetry(r io.Reader) (map[string]float64, error) {
+	values := map[string]float64{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, "aggregator_") {
+			continue
+		}
+		x := strings.LastIndexByte(line, ' ')
+		if x < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[x+1:], 64)
+		if err != nil {
+			continue
+		}
+		name := line[:x]
+		if y := strings.IndexByte(name, '{'); y >= 0 {
+			name = name[:y]
+		}
+		values[name] += value
+	}
+	return values, s.Err()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestBench(t *testing.T) {
+	for _, format := range []string{"prometheus", "json"} {
+		t.Run(format, func(t *testing.T) {
+			u, _ := aggregator.NewUniverse()
+			tm := newTelemetry(u)
+			in := newIngester(u, tm, log.NewNopLogger())
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go in.forwardListener(ln)
+
+			c := benchConfig{
+				rate:        1000,
+				duration:    200 * time.Millisecond,
+				connections: 2,
+				metrics:     2,
+				series:      3,
+				format:      format,
+			}
+			if err := c.setTarget("tcp://" + ln.Addr().String()); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.validate(); err != nil {
+				t.Fatal(err)
+			}
+			res, err := c.run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln.Close()
+			in.drain(time.Second)
+
+			if res.lines < 10 || res.errors != 0 {
+				t.Fatalf("want some lines and no errors, have %d lines, %d errors", res.lines, res.errors)
+			}
+			if want, have := res.lines, tm.linesAccepted.value(); want != have {
+				t.Errorf("accepted: want %d, have %d", want, have)
+			}
+			// Each metric's declaration is also an (untouched) series.
+			if want, have := map[string]int{"bench_metric_0_total": 4, "bench_metric_1_total": 4}, u.SeriesCounts(); !cmp.Equal(want, have) {
+				t.Errorf("series: %s", cmp.Diff(want, have))
+			}
+		})
+	}
+}
+
+func TestBenchValidate(t *testing.T) {
+	c := benchConfig{connections: 1, metrics: 1, series: 1, format: "prometheus", gzip: true}
+	if err := c.setTarget("tcp://127.0.0.1:8191"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.validate(); err == nil {
+		t.Errorf("gzip over TCP: want error, have none")
+	}
+	if err := c.setTarget("udp://127.0.0.1:8191"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.validate(); err != nil {
+		t.Errorf("gzip over UDP: want no error, have %v", err)
+	}
+}
+
+func TestParseSelfTelemetry(t *testing.T) {
+	have, err := parseSelfTelemetry(strings.NewReader(`
+foo_total{} 1.000000
+
+# HELP aggregator_lines_accepted_total Total number of lines accepted.
+# TYPE aggregator_lines_accepted_total counter
+aggregator_lines_accepted_total 10
+aggregator_lines_rejected_total{reason="parse"} 2
+aggregator_lines_rejected_total{reason="observe"} 3
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"aggregator_lines_accepted_total": 10,
+		"aggregator_lines_rejected_total": 5,
+	}
+	if !cmp.Equal(want, have) {
+		t.Error(cmp.Diff(want, have))
+	}
+}
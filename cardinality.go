@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+// seriesGrowth remembers the total number of series over a recent window, so
+// that a sudden rise in cardinality shows up as a growth rate.
+type seriesGrowth struct {
+	window time.Duration
+
+	mtx     sync.Mutex
+	samples []growthSample // oldest first
+}
+
+type growthSample struct {
+	at     time.Time
+	series int
+}
+
+// growthWindow is how far back the series growth rate is measured.
+const growthWindow = 5 * time.Minute
+
+func newSeriesGrowth(window time.Duration) *seriesGrowth {
+	return &seriesGrowth{window: window}
+}
+
+// record samples the total number of series at now, and forgets samples from
+// before the window, keeping one to measure it from.
+func (g *seriesGrowth) record(now time.Time, series int) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.samples = append(g.samples, growthSample{now, series})
+	var i int
+	for i < len(g.samples)-1 && now.Sub(g.samples[i+1].at) >= g.window {
+		i++
+	}
+	g.samples = g.samples[i:]
+}
+
+// rate returns the number of series added per second, net of those removed,
+// from the oldest sample in the window to series at now. It's zero until
+// there's a sample to measure from.
+func (g *seriesGrowth) rate(now time.Time, series int) float64 {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if len(g.samples) == 0 {
+		return 0
+	}
+	first := g.samples[0]
+	elapsed := now.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(series-first.series) / elapsed
+}
+
+// totalSeries returns the number of series in every collection.
+func totalSeries(counts map[string]int) int {
+	var series int
+	for _, n := range counts {
+		series += n
+	}
+	return series
+}
+
+// cardinalityReport is served by /api/v1/status/cardinality, like the TSDB
+// status of Prometheus, to find what's behind a cardinality incident.
+type cardinalityReport struct {
+	Series                     int            `json:"series"`
+	MemoryBytes                int64          `json:"memory_bytes"`
+	SeriesGrowthPerSecond      float64        `json:"series_growth_per_second"`
+	SeriesCountByMetricName    []nameAndValue `json:"series_count_by_metric_name"`
+	MemoryBytesByMetricName    []nameAndValue `json:"memory_bytes_by_metric_name"`
+	LabelValueCountByLabelName []nameAndValue `json:"label_value_count_by_label_name"`
+}
+
+type nameAndValue struct {
+	Name  string `json:"name"`
+	Value int64  `json:"value"`
+}
+
+// defaultCardinalityLimit is how many of each top list are reported, unless
+// the limit query parameter says otherwise.
+const defaultCardinalityLimit = 10
+
+// cardinalityHandler serves the cardinality report, with the top limit
+// metrics and labels, e.g. /api/v1/status/cardinality?limit=20.
+func cardinalityHandler(u *aggregator.Universe, g *seriesGrowth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultCardinalityLimit
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				respondError(w, http.StatusBadRequest, "limit must be a positive integer")
+				return
+			}
+			limit = n
+		}
+		var (
+			counts  = u.SeriesCounts()
+			series  = totalSeries(counts)
+			byName  = map[string]int64{}
+			byLabel = map[string]int64{}
+		)
+		for name, n := range counts {
+			byName[name] = int64(n)
+		}
+		for name, n := range u.LabelValueCounts() {
+			byLabel[name] = int64(n)
+		}
+		respondJSON(w, http.StatusOK, cardinalityReport{
+			Series:                     series,
+			MemoryBytes:                u.MemoryBytes(),
+			SeriesGrowthPerSecond:      g.rate(time.Now(), series),
+			SeriesCountByMetricName:    topValues(byName, limit),
+			MemoryBytesByMetricName:    topValues(u.FamilyMemoryBytes(), limit),
+			LabelValueCountByLabelName: topValues(byLabel, limit),
+		})
+	})
+}
+
+// topValues returns the limit largest values, largest first, and then by
+// name.
+func topValues(values map[string]int64, limit int) []nameAndValue {
+	top := make([]nameAndValue, 0, len(values))
+	for name, value := range values {
+		top = append(top, nameAndValue{name, value})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Value != top[j].Value {
+			return top[i].Value > top[j].Value
+		}
+		return top[i].Name < top[j].Name
+	})
+	if len(top) > limit {
+		top = top[:limit]
+	}
+	return top
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestSeriesGrowth(t *testing.T) {
+	var (
+		g     = newSeriesGrowth(time.Minute)
+		start = time.Unix(1000, 0)
+		at    = func(d time.Duration) time.Time { return start.Add(d) }
+	)
+	if want, have := 0.0, g.rate(start, 10); want != have {
+		t.Errorf("without samples: want %v, have %v", want, have)
+	}
+	g.record(at(0), 10)
+	g.record(at(30*time.Second), 40)
+	if want, have := 1.0, g.rate(at(40*time.Second), 50); want != have {
+		t.Errorf("within the window: want %v, have %v", want, have)
+	}
+	g.record(at(90*time.Second), 100) // forgets the first sample
+	if want, have := 2.0, g.rate(at(100*time.Second), 180); want != have {
+		t.Errorf("after the window: want %v, have %v", want, have)
+	}
+	if want, have := -0.5, g.rate(at(110*time.Second), 0); want != have {
+		t.Errorf("shrinking: want %v, have %v", want, have)
+	}
+}
+
+func TestCardinalityHandler(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`foo_total{code="200",method="GET"} 1`,
+		`foo_total{code="404",method="GET"} 1`,
+		`foo_total{code="500",method="GET"} 1`,
+		`{"name":"bar_total","type":"counter","help":"Total number of bars."}`,
+		`bar_total{code="200"} 1`,
+		`bar_total{code="503"} 1`,
+	}))
+	g := newSeriesGrowth(growthWindow)
+	g.record(time.Now().Add(-10*time.Second), 0)
+	h := cardinalityHandler(u, g)
+
+	for name, testcase := range map[string]struct {
+		query  string
+		code   int
+		series []nameAndValue
+		labels []nameAndValue
+	}{
+		"default": {
+			code:   http.StatusOK,
+			series: []nameAndValue{{"foo_total", 4}, {"bar_total", 3}}, // and the declarations
+			labels: []nameAndValue{{"code", 4}, {"method", 1}},
+		},
+		"limit": {
+			query:  "limit=1",
+			code:   http.StatusOK,
+			series: []nameAndValue{{"foo_total", 4}},
+			labels: []nameAndValue{{"code", 4}},
+		},
+		"bad limit": {
+			query: "limit=0",
+			code:  http.StatusBadRequest,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/v1/status/cardinality?"+testcase.query, nil)
+			h.ServeHTTP(rec, req)
+			if want, have := testcase.code, rec.Code; want != have {
+				t.Fatalf("code: want %d, have %d (%s)", want, have, rec.Body.String())
+			}
+			if testcase.code != http.StatusOK {
+				return
+			}
+			var have cardinalityReport
+			if err := json.Unmarshal(rec.Body.Bytes(), &have); err != nil {
+				t.Fatal(err)
+			}
+			if want, have := 7, have.Series; want != have {
+				t.Errorf("series: want %d, have %d", want, have)
+			}
+			if have.SeriesGrowthPerSecond <= 0 {
+				t.Errorf("growth: want positive, have %v", have.SeriesGrowthPerSecond)
+			}
+			if want, have := testcase.series, have.SeriesCountByMetricName; !cmp.Equal(want, have) {
+				t.Error(cmp.Diff(want, have))
+			}
+			if want, have := testcase.labels, have.LabelValueCountByLabelName; !cmp.Equal(want, have) {
+				t.Error(cmp.Diff(want, have))
+			}
+			if want, have := len(testcase.series), len(have.MemoryBytesByMetricName); want != have {
+				t.Errorf("memory: want %d families, have %d", want, have)
+			}
+		})
+	}
+}
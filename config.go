@@ -0,0 +1,553 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// config is the contents of -config.file. Each setting corresponds to a
+// command-line flag, which takes precedence if it's given explicitly.
+// Settings that are omitted from the file keep their flag defaults.
+type config struct {
+	Listeners struct {
+		Socket     string `yaml:"socket"`
+		Prometheus string `yaml:"prometheus"`
+		Admin      string `yaml:"admin"`
+		IngestPath string `yaml:"ingest_path"`
+		H2C        *bool  `yaml:"h2c"`
+		QUICCert   string `yaml:"quic_cert_file"`
+		QUICKey    string `yaml:"quic_key_file"`
+		DTLSCert   string `yaml:"dtls_cert_file"`
+		DTLSKey    string `yaml:"dtls_key_file"`
+		DTLSCA     string `yaml:"dtls_client_ca_file"`
+		DTLSMax    *int   `yaml:"dtls_max_associations"`
+		DTLSIdle   string `yaml:"dtls_idle_timeout"`
+	} `yaml:"listeners"`
+	Inputs struct {
+		SQSQueueURL         string   `yaml:"sqs_queue_url"`
+		KinesisStream       string   `yaml:"kinesis_stream"`
+		KinesisPollInterval string   `yaml:"kinesis_poll_interval"`
+		AWSRegion           string   `yaml:"aws_region"`
+		PubSubSubscription  string   `yaml:"pubsub_subscription"`
+		PubSubDeadLetter    string   `yaml:"pubsub_dead_letter_topic"`
+		MQTTBroker          string   `yaml:"mqtt_broker"`
+		MQTTTopics          []string `yaml:"mqtt_topics"`
+		MQTTClientID        string   `yaml:"mqtt_client_id"`
+		MQTTQoS             *int     `yaml:"mqtt_qos"`
+		JournaldField       string   `yaml:"journald_field"`
+		JournaldMatches     []string `yaml:"journald_matches"`
+	} `yaml:"inputs"`
+	Log struct {
+		Format         string `yaml:"format"`
+		RejectSample   *int   `yaml:"reject_sample"`
+		RejectInterval string `yaml:"reject_interval"`
+	} `yaml:"log"`
+	Limits struct {
+		Strict               *bool    `yaml:"strict"`
+		StrictCIDRs          []string `yaml:"strict_cidrs"`
+		StrictExemptCIDRs    []string `yaml:"strict_exempt_cidrs"`
+		MaxLineBytes         *int     `yaml:"max_line_bytes"`
+		MaxConnections       *int     `yaml:"max_connections"`
+		IdleTimeout          string   `yaml:"idle_timeout"`
+		MaxSources           *int     `yaml:"max_sources"`
+		SourceLinesPerSecond *float64 `yaml:"source_lines_per_second"`
+		SourceBytesPerSecond *float64 `yaml:"source_bytes_per_second"`
+		LinesPerSecond       *float64 `yaml:"lines_per_second"`
+		SeriesTTL            string   `yaml:"series_ttl"`
+		SeriesMemoryLimit    *int64   `yaml:"series_memory_limit"`
+		SeriesMemoryShed     string   `yaml:"series_memory_shed"`
+		SeriesSpillDir       string   `yaml:"series_spill_dir"`
+		MaxLabels            *int     `yaml:"max_labels"`
+		MaxLabelValueBytes   *int     `yaml:"max_label_value_bytes"`
+		MaxNameBytes         *int     `yaml:"max_name_bytes"`
+	} `yaml:"limits"`
+	Ingest struct {
+		QueueSize      *int              `yaml:"queue_size"`
+		Workers        *int              `yaml:"workers"`
+		QueueOverflow  string            `yaml:"queue_overflow"`
+		Shards         *int              `yaml:"shards"`
+		InternMax      *int              `yaml:"intern_max_strings"`
+		NonFinite      map[string]string `yaml:"non_finite"`
+		RecentIDs      *int              `yaml:"recent_ids"`
+		MaxClockSkew   string            `yaml:"max_clock_skew"`
+		TypeConflict   string            `yaml:"type_conflict"`
+		ReplaceAfter   *int              `yaml:"type_conflict_replace_after"`
+		IdentityLabels string            `yaml:"identity_labels"`
+		TenantLabel    string            `yaml:"tenant_label"`
+		MaxTenants     *int              `yaml:"max_tenants"`
+		UnitSuffix     *bool             `yaml:"require_unit_suffix"`
+		CounterSuffix  string            `yaml:"counter_suffix"`
+		BucketSamples  *int              `yaml:"bucket_samples"`
+		AllowCIDRs     []string          `yaml:"allow_cidrs"`
+	} `yaml:"ingest"`
+	Scrape struct {
+		CacheTTL       string            `yaml:"cache_ttl"`
+		MaxConcurrency *int              `yaml:"max_concurrency"`
+		Timeout        string            `yaml:"timeout"`
+		ETag           *bool             `yaml:"etag"`
+		OpenMetrics    *bool             `yaml:"openmetrics"`
+		TargetInfo     map[string]string `yaml:"target_info"`
+		Quantiles      []float64         `yaml:"quantiles"`
+	} `yaml:"scrape"`
+	Declarations []aggregator.Observation `yaml:"declarations"`
+	Transforms   []transformRule          `yaml:"transforms"`
+	Routes       []routeRule              `yaml:"routes"`
+	Tenants      map[string]tenantConfig  `yaml:"tenants"`
+}
+
+func loadConfig(filename string) (config, error) {
+	var c config
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return c, err
+	}
+	if err := yaml.UnmarshalStrict(buf, &c); err != nil {
+		return c, errors.Wrap(err, "error parsing config")
+	}
+	for i, o := range c.Declarations {
+		if o.Name == "" {
+			return c, fmt.Errorf("declarations: %d: name is required", i)
+		}
+	}
+	return c, nil
+}
+
+// flags returns the settings given in the config, by flag name.
+func (c config) flags() map[string]string {
+	m := map[string]string{}
+	str := func(name, value string) {
+		if value != "" {
+			m[name] = value
+		}
+	}
+	str("socket", c.Listeners.Socket)
+	str("prometheus", c.Listeners.Prometheus)
+	str("admin", c.Listeners.Admin)
+	str("ingest.http-path", c.Listeners.IngestPath)
+	if c.Listeners.H2C != nil {
+		m["web.h2c"] = strconv.FormatBool(*c.Listeners.H2C)
+	}
+	str("quic.cert-file", c.Listeners.QUICCert)
+	str("quic.key-file", c.Listeners.QUICKey)
+	str("dtls.cert-file", c.Listeners.DTLSCert)
+	str("dtls.key-file", c.Listeners.DTLSKey)
+	str("dtls.client-ca-file", c.Listeners.DTLSCA)
+	if c.Listeners.DTLSMax != nil {
+		m["dtls.max-associations"] = strconv.Itoa(*c.Listeners.DTLSMax)
+	}
+	str("dtls.idle-timeout", c.Listeners.DTLSIdle)
+	str("sqs.queue-url", c.Inputs.SQSQueueURL)
+	str("kinesis.stream", c.Inputs.KinesisStream)
+	str("kinesis.poll-interval", c.Inputs.KinesisPollInterval)
+	str("aws.region", c.Inputs.AWSRegion)
+	str("pubsub.subscription", c.Inputs.PubSubSubscription)
+	str("pubsub.dead-letter-topic", c.Inputs.PubSubDeadLetter)
+	str("mqtt.broker", c.Inputs.MQTTBroker)
+	if len(c.Inputs.MQTTTopics) > 0 {
+		m["mqtt.topic"] = strings.Join(c.Inputs.MQTTTopics, ",")
+	}
+	str("mqtt.client-id", c.Inputs.MQTTClientID)
+	if c.Inputs.MQTTQoS != nil {
+		m["mqtt.qos"] = strconv.Itoa(*c.Inputs.MQTTQoS)
+	}
+	str("journald.field", c.Inputs.JournaldField)
+	if len(c.Inputs.JournaldMatches) > 0 {
+		m["journald.match"] = strings.Join(c.Inputs.JournaldMatches, ",")
+	}
+	str("log.format", c.Log.Format)
+	if c.Log.RejectSample != nil {
+		m["log.reject-sample"] = strconv.Itoa(*c.Log.RejectSample)
+	}
+	str("log.reject-interval", c.Log.RejectInterval)
+	if c.Limits.Strict != nil {
+		m["strict"] = strconv.FormatBool(*c.Limits.Strict)
+	}
+	if len(c.Limits.StrictCIDRs) > 0 {
+		m["strict.cidr"] = strings.Join(c.Limits.StrictCIDRs, ",")
+	}
+	if len(c.Limits.StrictExemptCIDRs) > 0 {
+		m["strict.exempt-cidr"] = strings.Join(c.Limits.StrictExemptCIDRs, ",")
+	}
+	if c.Limits.MaxLineBytes != nil {
+		m["ingest.max-line-bytes"] = strconv.Itoa(*c.Limits.MaxLineBytes)
+	}
+	if c.Limits.MaxConnections != nil {
+		m["tcp.max-connections"] = strconv.Itoa(*c.Limits.MaxConnections)
+	}
+	str("tcp.idle-timeout", c.Limits.IdleTimeout)
+	str("series.ttl", c.Limits.SeriesTTL)
+	if c.Limits.SeriesMemoryLimit != nil {
+		m["series.memory-limit"] = strconv.FormatInt(*c.Limits.SeriesMemoryLimit, 10)
+	}
+	str("series.memory-shed", c.Limits.SeriesMemoryShed)
+	str("series.spill-dir", c.Limits.SeriesSpillDir)
+	if c.Limits.MaxLabels != nil {
+		m["ingest.max-labels"] = strconv.Itoa(*c.Limits.MaxLabels)
+	}
+	if c.Limits.MaxLabelValueBytes != nil {
+		m["ingest.max-label-value-bytes"] = strconv.Itoa(*c.Limits.MaxLabelValueBytes)
+	}
+	if c.Limits.MaxNameBytes != nil {
+		m["ingest.max-name-bytes"] = strconv.Itoa(*c.Limits.MaxNameBytes)
+	}
+	if c.Limits.MaxSources != nil {
+		m["sources.max"] = strconv.Itoa(*c.Limits.MaxSources)
+	}
+	float := func(name string, value *float64) {
+		if value != nil {
+			m[name] = strconv.FormatFloat(*value, 'g', -1, 64)
+		}
+	}
+	float("ratelimit.source-lines", c.Limits.SourceLinesPerSecond)
+	float("ratelimit.source-bytes", c.Limits.SourceBytesPerSecond)
+	float("ratelimit.lines", c.Limits.LinesPerSecond)
+	if c.Ingest.QueueSize != nil {
+		m["ingest.queue-size"] = strconv.Itoa(*c.Ingest.QueueSize)
+	}
+	if c.Ingest.Workers != nil {
+		m["ingest.workers"] = strconv.Itoa(*c.Ingest.Workers)
+	}
+	str("ingest.queue-overflow", c.Ingest.QueueOverflow)
+	if c.Ingest.Shards != nil {
+		m["ingest.shards"] = strconv.Itoa(*c.Ingest.Shards)
+	}
+	if c.Ingest.InternMax != nil {
+		m["ingest.intern-max-strings"] = strconv.Itoa(*c.Ingest.InternMax)
+	}
+	if len(c.Ingest.AllowCIDRs) > 0 {
+		m["ingest.allow-cidr"] = strings.Join(c.Ingest.AllowCIDRs, ",")
+	}
+	if c.Ingest.RecentIDs != nil {
+		m["ingest.recent-ids"] = strconv.Itoa(*c.Ingest.RecentIDs)
+	}
+	str("ingest.max-clock-skew", c.Ingest.MaxClockSkew)
+	str("ingest.type-conflict", c.Ingest.TypeConflict)
+	str("ingest.identity-labels", c.Ingest.IdentityLabels)
+	str("ingest.tenant-label", c.Ingest.TenantLabel)
+	if c.Ingest.MaxTenants != nil {
+		m["ingest.max-tenants"] = strconv.Itoa(*c.Ingest.MaxTenants)
+	}
+	if c.Ingest.UnitSuffix != nil {
+		m["ingest.require-unit-suffix"] = strconv.FormatBool(*c.Ingest.UnitSuffix)
+	}
+	str("ingest.counter-suffix", c.Ingest.CounterSuffix)
+	if c.Ingest.BucketSamples != nil {
+		m["ingest.bucket-samples"] = strconv.Itoa(*c.Ingest.BucketSamples)
+	}
+	if c.Ingest.ReplaceAfter != nil {
+		m["ingest.type-conflict-replace-after"] = strconv.Itoa(*c.Ingest.ReplaceAfter)
+	}
+	if len(c.Ingest.NonFinite) > 0 {
+		policies := make([]string, 0, len(c.Ingest.NonFinite))
+		for typ, p := range c.Ingest.NonFinite {
+			policies = append(policies, typ+"="+p)
+		}
+		sort.Strings(policies)
+		m["ingest.non-finite"] = strings.Join(policies, ",")
+	}
+	str("scrape.cache-ttl", c.Scrape.CacheTTL)
+	if c.Scrape.MaxConcurrency != nil {
+		m["scrape.max-concurrency"] = strconv.Itoa(*c.Scrape.MaxConcurrency)
+	}
+	str("scrape.timeout", c.Scrape.Timeout)
+	if c.Scrape.OpenMetrics != nil {
+		m["scrape.openmetrics"] = strconv.FormatBool(*c.Scrape.OpenMetrics)
+	}
+	if c.Scrape.ETag != nil {
+		m["scrape.etag"] = strconv.FormatBool(*c.Scrape.ETag)
+	}
+	if len(c.Scrape.TargetInfo) > 0 {
+		attrs := make([]string, 0, len(c.Scrape.TargetInfo))
+		for name, value := range c.Scrape.TargetInfo {
+			attrs = append(attrs, name+"="+value)
+		}
+		sort.Strings(attrs)
+		m["scrape.target-info"] = strings.Join(attrs, ",")
+	}
+	if len(c.Scrape.Quantiles) > 0 {
+		qs := make([]string, len(c.Scrape.Quantiles))
+		for i, q := range c.Scrape.Quantiles {
+			qs[i] = strconv.FormatFloat(q, 'g', -1, 64)
+		}
+		m["scrape.quantiles"] = strings.Join(qs, ",")
+	}
+	return m
+}
+
+// applyFlags sets the flags given in the config, except those that were set
+// explicitly on the command line.
+func (c config) applyFlags(fs *flag.FlagSet) error {
+	explicit := explicitFlags(fs)
+	for name, value := range c.flags() {
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return errors.Wrapf(err, "%s", name)
+		}
+	}
+	return nil
+}
+
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	return explicit
+}
+
+// reloadableFlags can be changed by reloading the config file. Changing any
+// other setting requires a restart.
+var reloadableFlags = map[string]bool{
+	"log.reject-sample":            true,
+	"sources.max":                  true,
+	"scrape.cache-ttl":             true,
+	"ratelimit.source-lines":       true,
+	"ratelimit.source-bytes":       true,
+	"ratelimit.lines":              true,
+	"series.ttl":                   true,
+	"series.memory-limit":          true,
+	"ingest.max-labels":            true,
+	"ingest.max-label-value-bytes": true,
+	"ingest.max-name-bytes":        true,
+}
+
+// seriesTTL is the -series.ttl that series are expired with, which a reload
+// may change while the expire loop reads it.
+type seriesTTL struct {
+	nanos int64 // atomic
+}
+
+func newSeriesTTL(ttl time.Duration) *seriesTTL { return &seriesTTL{nanos: int64(ttl)} }
+
+func (t *seriesTTL) get() time.Duration { return time.Duration(atomic.LoadInt64(&t.nanos)) }
+
+func (t *seriesTTL) set(ttl time.Duration) {
+	if t == nil {
+		return
+	}
+	atomic.StoreInt64(&t.nanos, int64(ttl))
+}
+
+// reloader re-reads the config file, and applies it to the running
+// aggregator. Accumulated series are never discarded: new declarations are
+// added, the help of existing declarations may change, and declarations that
+// are removed from the file remain in the universe.
+type reloader struct {
+	filename   string
+	explicit   map[string]bool // flags set on the command line
+	u          *aggregator.Universe
+	declarer   declarer // applies declarations to u, and its tenants and routes
+	sources    *sourceStats
+	rejects    *rejectLogger
+	limiter    *rateLimiter
+	cache      *scrapeCache
+	transforms *transformer
+	audit      *auditLog
+	logger     log.Logger
+	ttl        *seriesTTL                    // nil isn't reloaded
+	universes  func() []*aggregator.Universe // of tenants and routes, whose limits are u's
+
+	mtx     sync.Mutex
+	running map[string]string       // settings from the config file at startup
+	routes  []routeRule             // from the config file at startup
+	tenants map[string]tenantConfig // from the config file at startup
+}
+
+// newReloader returns a reloader for the config file, which was initially
+// loaded as initial. Settings in explicit, i.e. flags that were given on the
+// command line, are never reloaded.
+func newReloader(filename string, initial config, explicit map[string]bool, u *aggregator.Universe, d declarer, sources *sourceStats, rejects *rejectLogger, limiter *rateLimiter, cache *scrapeCache, transforms *transformer, audit *auditLog, logger log.Logger) *reloader {
+	return &reloader{
+		filename:   filename,
+		explicit:   explicit,
+		u:          u,
+		declarer:   d,
+		sources:    sources,
+		rejects:    rejects,
+		limiter:    limiter,
+		cache:      cache,
+		transforms: transforms,
+		audit:      audit,
+		logger:     logger,
+		running:    initial.flags(),
+		routes:     initial.Routes,
+		tenants:    initial.Tenants,
+	}
+}
+
+func (r *reloader) reload() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	c, err := loadConfig(r.filename)
+	if err != nil {
+		return err
+	}
+
+	// Validate everything before applying anything.
+	for _, o := range c.Declarations {
+		if err := r.u.CheckDeclaration(o); err != nil {
+			r.audit.declaration(auditSourceConfig, o)
+			return errors.Wrapf(err, "declaration %s", o.Name)
+		}
+	}
+	var ttl time.Duration
+	if c.Scrape.CacheTTL != "" {
+		if ttl, err = time.ParseDuration(c.Scrape.CacheTTL); err != nil {
+			return errors.Wrap(err, "scrape.cache_ttl")
+		}
+	}
+	if v := c.Limits.MaxSources; v != nil && *v <= 0 {
+		return fmt.Errorf("limits.max_sources must be positive")
+	}
+	var seriesTTL time.Duration
+	if c.Limits.SeriesTTL != "" {
+		if seriesTTL, err = time.ParseDuration(c.Limits.SeriesTTL); err != nil {
+			return errors.Wrap(err, "limits.series_ttl")
+		}
+		if seriesTTL < 0 {
+			return fmt.Errorf("limits.series_ttl can't be negative")
+		}
+	}
+	if v := c.Limits.SeriesMemoryLimit; v != nil && *v < 0 {
+		return fmt.Errorf("limits.series_memory_limit can't be negative")
+	}
+	sizeLimits := r.u.Limits()
+	for _, x := range []struct {
+		flag, name string
+		value      *int
+		limit      *int
+	}{
+		{"ingest.max-labels", "max_labels", c.Limits.MaxLabels, &sizeLimits.MaxLabels},
+		{"ingest.max-label-value-bytes", "max_label_value_bytes", c.Limits.MaxLabelValueBytes, &sizeLimits.MaxLabelValueBytes},
+		{"ingest.max-name-bytes", "max_name_bytes", c.Limits.MaxNameBytes, &sizeLimits.MaxNameBytes},
+	} {
+		if x.value == nil || r.explicit[x.flag] {
+			continue
+		}
+		if *x.value < 0 {
+			return fmt.Errorf("limits.%s can't be negative", x.name)
+		}
+		*x.limit = *x.value
+	}
+	for name, v := range map[string]*float64{
+		"source_lines_per_second": c.Limits.SourceLinesPerSecond,
+		"source_bytes_per_second": c.Limits.SourceBytesPerSecond,
+		"lines_per_second":        c.Limits.LinesPerSecond,
+	} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("limits.%s can't be negative", name)
+		}
+	}
+	transforms, err := compileTransforms(c.Transforms)
+	if err != nil {
+		return err
+	}
+
+	var declared int
+	for _, o := range c.Declarations {
+		added, err := r.declarer.Declare(o)
+		if err != nil {
+			return errors.Wrapf(err, "declaration %s", o.Name)
+		}
+		if added {
+			declared++
+			r.audit.record(auditSourceConfig, o, auditCreated, nil)
+		} else {
+			r.audit.record(auditSourceConfig, o, auditExisting, nil)
+		}
+	}
+	if v := c.Log.RejectSample; v != nil && !r.explicit["log.reject-sample"] {
+		r.rejects.setSample(*v)
+	}
+	if v := c.Limits.MaxSources; v != nil && !r.explicit["sources.max"] {
+		r.sources.setMax(*v)
+	}
+	if c.Scrape.CacheTTL != "" && !r.explicit["scrape.cache-ttl"] {
+		r.cache.setTTL(ttl)
+	}
+	limits := r.limiter.current()
+	for _, x := range []struct {
+		flag  string
+		value *float64
+		limit *float64
+	}{
+		{"ratelimit.source-lines", c.Limits.SourceLinesPerSecond, &limits.SourceLines},
+		{"ratelimit.source-bytes", c.Limits.SourceBytesPerSecond, &limits.SourceBytes},
+		{"ratelimit.lines", c.Limits.LinesPerSecond, &limits.Lines},
+	} {
+		if x.value != nil && !r.explicit[x.flag] {
+			*x.limit = *x.value
+		}
+	}
+	r.limiter.set(limits)
+	r.transforms.set(transforms)
+	if c.Limits.SeriesTTL != "" && !r.explicit["series.ttl"] {
+		r.ttl.set(seriesTTL)
+	}
+	if v := c.Limits.SeriesMemoryLimit; v != nil && !r.explicit["series.memory-limit"] {
+		r.u.ResizeMemoryLimit(*v) // shared by tenants and routes
+	}
+	universes := []*aggregator.Universe{r.u}
+	if r.universes != nil {
+		universes = append(universes, r.universes()...)
+	}
+	for _, u := range universes {
+		u.SetLimits(sizeLimits) // validated above
+	}
+
+	settings := c.flags()
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if r.explicit[name] || reloadableFlags[name] {
+			continue
+		}
+		if running := r.running[name]; running != settings[name] {
+			level.Warn(r.logger).Log("reload", "setting requires restart", "flag", name, "running", running, "config", settings[name])
+		}
+	}
+	if !reflect.DeepEqual(r.routes, c.Routes) {
+		level.Warn(r.logger).Log("reload", "setting requires restart", "config", "routes")
+	}
+	if !reflect.DeepEqual(r.tenants, c.Tenants) {
+		level.Warn(r.logger).Log("reload", "setting requires restart", "config", "tenants")
+	}
+
+	level.Info(r.logger).Log("reload", "success", "config.file", r.filename, "new_declarations", declared)
+	return nil
+}
+
+// reloadHandler reloads the config on each PUT or POST request.
+func reloadHandler(r *reloader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "PUT" && req.Method != "POST" {
+			http.Error(w, "only PUT or POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.reload(); err != nil {
+			level.Error(r.logger).Log("reload", "failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "reloaded")
+	})
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestConfigApplyFlags(t *testing.T) {
+	filename := writeConfig(t, `
+listeners:
+  socket: udp://127.0.0.1:9191
+  prometheus: tcp://127.0.0.1:9192/metrics
+  ingest_path: /write
+  h2c: true
+  quic_cert_file: cert.pem
+  quic_key_file: key.pem
+inputs:
+  sqs_queue_url: https://sqs.us-east-1.amazonaws.com/123456789012/metrics
+  kinesis_poll_interval: 2s
+  pubsub_subscription: projects/p/subscriptions/metrics
+  mqtt_broker: tcp://mosquitto:1883
+  mqtt_topics: ["devices/{device_id}/telemetry", gateways/+/telemetry]
+  mqtt_qos: 0
+  journald_field: METRICS
+  journald_matches: [SYSLOG_IDENTIFIER=myd, +, _SYSTEMD_UNIT=other.service]
+limits:
+  strict: true
+  strict_exempt_cidrs: [10.3.0.0/16]
+  max_sources: 50
+  series_ttl: 1h
+  series_memory_limit: 1073741824
+  series_memory_shed: evict
+  max_label_value_bytes: 256
+ingest:
+  non_finite:
+    histogram: clamp
+    counter: reject
+  recent_ids: 64
+  bucket_samples: 1000
+  type_conflict: replace
+  type_conflict_replace_after: 3
+  tenant_label: tenant
+  max_tenants: 20
+  allow_cidrs: [10.1.0.0/16, 10.2.0.0/16]
+scrape:
+  cache_ttl: 5s
+  max_concurrency: 4
+  timeout: 10s
+  etag: true
+  target_info:
+    service.name: checkout
+    deployment.environment: prod
+  quantiles: [0.5, 0.99]
+`)
+	c, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var (
+		socket   = fs.String("socket", "tcp://127.0.0.1:8191", "")
+		prom     = fs.String("prometheus", "tcp://127.0.0.1:8192/metrics", "")
+		httpPath = fs.String("ingest.http-path", "", "")
+		webH2C   = fs.Bool("web.h2c", false, "")
+		quicCert = fs.String("quic.cert-file", "", "")
+		quicKey  = fs.String("quic.key-file", "", "")
+		sqsURL   = fs.String("sqs.queue-url", "", "")
+		kinIntv  = fs.Duration("kinesis.poll-interval", time.Second, "")
+		psSub    = fs.String("pubsub.subscription", "", "")
+		mqttBrkr = fs.String("mqtt.broker", "", "")
+		mqttTopc = fs.String("mqtt.topic", "", "")
+		mqttQoS  = fs.Int("mqtt.qos", 1, "")
+		jrnField = fs.String("journald.field", "", "")
+		jrnMatch = fs.String("journald.match", "", "")
+		strict   = fs.Bool("strict", false, "")
+		exempt   = cidrListVar(fs, "strict.exempt-cidr", "")
+		max      = fs.Int("sources.max", defaultMaxSources, "")
+		cacheTTL = fs.Duration("scrape.cache-ttl", 0, "")
+		scrapeN  = fs.Int("scrape.max-concurrency", 0, "")
+		scrapeTO = fs.Duration("scrape.timeout", 0, "")
+		etag     = fs.Bool("scrape.etag", false, "")
+		tgtInfo  = fs.String("scrape.target-info", "", "")
+		quantile = fs.String("scrape.quantiles", "", "")
+		ttl      = fs.Duration("series.ttl", 0, "")
+		memLimit = fs.Int64("series.memory-limit", 0, "")
+		memShed  = fs.String("series.memory-shed", "reject", "")
+		nonFin   = fs.String("ingest.non-finite", "", "")
+		maxValue = fs.Int("ingest.max-label-value-bytes", 0, "")
+		recentID = fs.Int("ingest.recent-ids", aggregator.DefaultRecentIDs, "")
+		bktSamp  = fs.Int("ingest.bucket-samples", 0, "")
+		typeConf = fs.String("ingest.type-conflict", "ignore", "")
+		confN    = fs.Int("ingest.type-conflict-replace-after", aggregator.DefaultConflictReplaceAfter, "")
+		allowed  = cidrListVar(fs, "ingest.allow-cidr", "")
+		tenLabel = fs.String("ingest.tenant-label", "", "")
+		maxTen   = fs.Int("ingest.max-tenants", defaultMaxTenants, "")
+	)
+	if err := fs.Parse([]string{"-prometheus", "tcp://0.0.0.0:1234/metrics"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.applyFlags(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := "udp://127.0.0.1:9191", *socket; want != have {
+		t.Errorf("socket: want %q, have %q", want, have)
+	}
+	if want, have := "tcp://0.0.0.0:1234/metrics", *prom; want != have {
+		t.Errorf("prometheus: want %q (command line wins), have %q", want, have)
+	}
+	if want, have := "/write", *httpPath; want != have {
+		t.Errorf("ingest.http-path: want %q, have %q", want, have)
+	}
+	if want, have := true, *webH2C; want != have {
+		t.Errorf("web.h2c: want %v, have %v", want, have)
+	}
+	if want, have := "cert.pem", *quicCert; want != have {
+		t.Errorf("quic.cert-file: want %q, have %q", want, have)
+	}
+	if want, have := "key.pem", *quicKey; want != have {
+		t.Errorf("quic.key-file: want %q, have %q", want, have)
+	}
+	if want, have := "https://sqs.us-east-1.amazonaws.com/123456789012/metrics", *sqsURL; want != have {
+		t.Errorf("sqs.queue-url: want %q, have %q", want, have)
+	}
+	if want, have := 2*time.Second, *kinIntv; want != have {
+		t.Errorf("kinesis.poll-interval: want %s, have %s", want, have)
+	}
+	if want, have := "projects/p/subscriptions/metrics", *psSub; want != have {
+		t.Errorf("pubsub.subscription: want %q, have %q", want, have)
+	}
+	if want, have := "tenant", *tenLabel; want != have {
+		t.Errorf("ingest.tenant-label: want %q, have %q", want, have)
+	}
+	if want, have := 20, *maxTen; want != have {
+		t.Errorf("ingest.max-tenants: want %d, have %d", want, have)
+	}
+	if want, have := "tcp://mosquitto:1883", *mqttBrkr; want != have {
+		t.Errorf("mqtt.broker: want %q, have %q", want, have)
+	}
+	if want, have := "devices/{device_id}/telemetry,gateways/+/telemetry", *mqttTopc; want != have {
+		t.Errorf("mqtt.topic: want %q, have %q", want, have)
+	}
+	if want, have := 0, *mqttQoS; want != have {
+		t.Errorf("mqtt.qos: want %d, have %d", want, have)
+	}
+	if want, have := "METRICS", *jrnField; want != have {
+		t.Errorf("journald.field: want %q, have %q", want, have)
+	}
+	if want, have := "SYSLOG_IDENTIFIER=myd,+,_SYSTEMD_UNIT=other.service", *jrnMatch; want != have {
+		t.Errorf("journald.match: want %q, have %q", want, have)
+	}
+	if want, have := true, *strict; want != have {
+		t.Errorf("strict: want %v, have %v", want, have)
+	}
+	if want, have := "10.3.0.0/16", exempt.String(); want != have {
+		t.Errorf("strict.exempt-cidr: want %q, have %q", want, have)
+	}
+	if want, have := 50, *max; want != have {
+		t.Errorf("sources.max: want %d, have %d", want, have)
+	}
+	if want, have := 5*time.Second, *cacheTTL; want != have {
+		t.Errorf("scrape.cache-ttl: want %s, have %s", want, have)
+	}
+	if want, have := 4, *scrapeN; want != have {
+		t.Errorf("scrape.max-concurrency: want %d, have %d", want, have)
+	}
+	if want, have := 10*time.Second, *scrapeTO; want != have {
+		t.Errorf("scrape.timeout: want %s, have %s", want, have)
+	}
+	if want, have := true, *etag; want != have {
+		t.Errorf("scrape.etag: want %v, have %v", want, have)
+	}
+	if want, have := "deployment.environment=prod,service.name=checkout", *tgtInfo; want != have {
+		t.Errorf("scrape.target-info: want %q, have %q", want, have)
+	}
+	if want, have := "0.5,0.99", *quantile; want != have {
+		t.Errorf("scrape.quantiles: want %q, have %q", want, have)
+	}
+	if want, have := time.Hour, *ttl; want != have {
+		t.Errorf("series.ttl: want %s, have %s", want, have)
+	}
+	if want, have := int64(1<<30), *memLimit; want != have {
+		t.Errorf("series.memory-limit: want %d, have %d", want, have)
+	}
+	if want, have := "evict", *memShed; want != have {
+		t.Errorf("series.memory-shed: want %q, have %q", want, have)
+	}
+	if want, have := "counter=reject,histogram=clamp", *nonFin; want != have {
+		t.Errorf("ingest.non-finite: want %q, have %q", want, have)
+	}
+	if want, have := 256, *maxValue; want != have {
+		t.Errorf("ingest.max-label-value-bytes: want %d, have %d", want, have)
+	}
+	if want, have := 64, *recentID; want != have {
+		t.Errorf("ingest.recent-ids: want %d, have %d", want, have)
+	}
+	if want, have := 1000, *bktSamp; want != have {
+		t.Errorf("ingest.bucket-samples: want %d, have %d", want, have)
+	}
+	if want, have := "replace", *typeConf; want != have {
+		t.Errorf("ingest.type-conflict: want %q, have %q", want, have)
+	}
+	if want, have := 3, *confN; want != have {
+		t.Errorf("ingest.type-conflict-replace-after: want %d, have %d", want, have)
+	}
+	if want, have := "10.1.0.0/16,10.2.0.0/16", allowed.String(); want != have {
+		t.Errorf("ingest.allow-cidr: want %q, have %q", want, have)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for name, input := range map[string]string{
+		"unknown field":   "limits:\n  max_frobs: 10\n",
+		"unnamed decl":    "declarations:\n  - type: counter\n    help: Total foos.\n",
+		"malformed value": "limits:\n  strict: maybe\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadConfig(writeConfig(t, input)); err == nil {
+				t.Fatal("want error, have none")
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	filename := writeConfig(t, `
+declarations:
+  - name: foo_total
+    type: counter
+    help: Total number of foos.
+`)
+	c, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := aggregator.NewUniverse(c.Declarations...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadObservations(t, u, makeObservations(t, []string{`foo_total{} 3`}))
+
+	var (
+		sources    = newSourceStats(defaultMaxSources)
+		rejects    = newRejectLogger(log.NewNopLogger(), defaultRejectSample)
+		limiter    = newRateLimiter(rateLimits{}, defaultMaxSources)
+		cache      = newScrapeCache(u, 0)
+		transforms = newTransformer(nil)
+		r          = newReloader(filename, c, map[string]bool{}, u, u, sources, rejects, limiter, cache, transforms, nil, log.NewNopLogger())
+	)
+
+	// Change the help, add a declaration, change some limits, and add a
+	// transform.
+	if err := os.WriteFile(filename, []byte(`
+limits:
+  max_sources: 10
+  source_lines_per_second: 100
+scrape:
+  cache_ttl: 1m
+transforms:
+  - match: debug_.*
+    drop: true
+declarations:
+  - name: foo_total
+    type: counter
+    help: Total number of foos, ever.
+  - name: bar
+    type: gauge
+    help: Current bar.
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	loadObservations(t, u, makeObservations(t, []string{`bar{} 1`}))
+	if want, have := normalizeResponse(`
+		# HELP bar Current bar.
+		# TYPE bar gauge
+		bar{} 1.000000
+
+		# HELP foo_total Total number of foos, ever.
+		# TYPE foo_total counter
+		foo_total{} 3.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+	if want, have := 10, sources.max; want != have {
+		t.Errorf("sources max: want %d, have %d", want, have)
+	}
+	if want, have := time.Minute, cache.ttl; want != have {
+		t.Errorf("cache TTL: want %s, have %s", want, have)
+	}
+	if want, have := (rateLimits{SourceLines: 100}), limiter.current(); want != have {
+		t.Errorf("rate limits: want %+v, have %+v", want, have)
+	}
+	if _, ok := transforms.apply(aggregator.Observation{Name: "debug_total"}); ok {
+		t.Errorf("transforms: want debug_total dropped, have kept")
+	}
+
+	// Changing the type of an existing declaration fails the whole reload.
+	if err := os.WriteFile(filename, []byte(`
+limits:
+  max_sources: 20
+declarations:
+  - name: foo_total
+    type: gauge
+    help: Total number of foos.
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err == nil {
+		t.Fatal("want error, have none")
+	}
+	if want, have := 10, sources.max; want != have {
+		t.Errorf("sources max after failed reload: want %d, have %d", want, have)
+	}
+}
+
+func TestReloadLimits(t *testing.T) {
+	filename := writeConfig(t, "limits: {}\n")
+	c, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := aggregator.NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	tenant, _ := aggregator.NewUniverse()
+	if err := u.SetMemoryLimit(0, aggregator.ShedReject); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.ShareMemoryLimit(u); err != nil {
+		t.Fatal(err)
+	}
+	r := newReloader(filename, c, map[string]bool{"ingest.max-name-bytes": true}, u, u, newSourceStats(defaultMaxSources), newRejectLogger(log.NewNopLogger(), defaultRejectSample), newRateLimiter(rateLimits{}, defaultMaxSources), newScrapeCache(u, 0), newTransformer(nil), nil, log.NewNopLogger())
+	r.ttl = newSeriesTTL(0)
+	r.universes = func() []*aggregator.Universe { return []*aggregator.Universe{tenant} }
+
+	if err := os.WriteFile(filename, []byte(`
+limits:
+  series_ttl: 1h
+  series_memory_limit: 1
+  max_labels: 5
+  max_name_bytes: 10
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := time.Hour, r.ttl.get(); want != have {
+		t.Errorf("series TTL: want %s, have %s", want, have)
+	}
+	want := aggregator.Limits{MaxLabels: 5} // max_name_bytes is set on the command line
+	for name, u := range map[string]*aggregator.Universe{"default": u, "tenant": tenant} {
+		if have := u.Limits(); want != have {
+			t.Errorf("%s limits: want %+v, have %+v", name, want, have)
+		}
+	}
+	if err := u.Observe(makeObservations(t, []string{`foo_total{a="1"} 1`})[0]); err == nil {
+		t.Errorf("new series over the reloaded memory limit: want error, have none")
+	}
+
+	if err := os.WriteFile(filename, []byte("limits:\n  series_ttl: -1h\n  max_labels: 6\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err == nil {
+		t.Fatal("negative series_ttl: want error, have none")
+	}
+	if want, have := 5, u.Limits().MaxLabels; want != have {
+		t.Errorf("max labels after failed reload: want %d, have %d", want, have)
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+// unitConversion is the convert action of a transform, which converts a
+// metric from one unit to another, like milliseconds to seconds.
+type unitConversion struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+// unitFactor is the size of a unit, in its dimension's base unit.
+type unitFactor struct {
+	dimension string
+	factor    float64
+}
+
+// units are the units that can be converted, by the suffixes that name them.
+var units = map[string]unitFactor{
+	"ns":           {"time", 1e-9},
+	"nanoseconds":  {"time", 1e-9},
+	"us":           {"time", 1e-6},
+	"microseconds": {"time", 1e-6},
+	"ms":           {"time", 1e-3},
+	"milliseconds": {"time", 1e-3},
+	"s":            {"time", 1},
+	"seconds":      {"time", 1},
+	"minutes":      {"time", 60},
+	"hours":        {"time", 3600},
+	"days":         {"time", 86400},
+	"bytes":        {"size", 1},
+	"kb":           {"size", 1e3},
+	"kilobytes":    {"size", 1e3},
+	"mb":           {"size", 1e6},
+	"megabytes":    {"size", 1e6},
+	"gb":           {"size", 1e9},
+	"gigabytes":    {"size", 1e9},
+	"kib":          {"size", 1 << 10},
+	"kibibytes":    {"size", 1 << 10},
+	"mib":          {"size", 1 << 20},
+	"mebibytes":    {"size", 1 << 20},
+	"gib":          {"size", 1 << 30},
+	"gibibytes":    {"size", 1 << 30},
+	"percent":      {"ratio", 0.01},
+	"ratio":        {"ratio", 1},
+}
+
+// conversion is a compiled unitConversion. A value is multiplied by mul, or
+// divided by div, whichever is a whole number, so that e.g. 1500ms is exactly
+// 1.5s.
+type conversion struct {
+	from, to string // suffixes, without the underscore
+	mul, div float64
+}
+
+func compileConversion(c unitConversion) (*conversion, error) {
+	from, ok := units[c.From]
+	if !ok {
+		return nil, fmt.Errorf("unknown unit %q", c.From)
+	}
+	to, ok := units[c.To]
+	if !ok {
+		return nil, fmt.Errorf("unknown unit %q", c.To)
+	}
+	if from.dimension != to.dimension {
+		return nil, fmt.Errorf("can't convert %s, a unit of %s, to %s, a unit of %s", c.From, from.dimension, c.To, to.dimension)
+	}
+	if c.From == c.To {
+		return nil, fmt.Errorf("can't convert %s to itself", c.From)
+	}
+	conv := &conversion{from: c.From, to: c.To, mul: 1, div: 1}
+	if from.factor >= to.factor {
+		conv.mul = roundFactor(from.factor / to.factor)
+	} else {
+		conv.div = roundFactor(to.factor / from.factor)
+	}
+	return conv, nil
+}
+
+// roundFactor rounds away the error of dividing one factor by another, like
+// 1e-3 by 1e-6, which isn't exactly 1000.
+func roundFactor(f float64) float64 {
+	if r := math.Round(f); math.Abs(f-r) < 1e-9*f {
+		return r
+	}
+	return f
+}
+
+// rename returns the name with the from suffix replaced by the to suffix,
+// before any _total, and false if the name doesn't have the from suffix.
+func (c *conversion) rename(name string) (string, bool) {
+	base, total := name, ""
+	if strings.HasSuffix(name, "_total") {
+		base, total = strings.TrimSuffix(name, "_total"), "_total"
+	}
+	if !strings.HasSuffix(base, "_"+c.from) {
+		return name, false
+	}
+	return strings.TrimSuffix(base, c.from) + c.to + total, true
+}
+
+func (c *conversion) scale(v float64) float64 {
+	return v * c.mul / c.div
+}
+
+// apply converts obs, which must have the from suffix: its name, value, the
+// buckets of a histogram declaration, and a declared unit.
+func (c *conversion) apply(obs aggregator.Observation) aggregator.Observation {
+	obs.Name, _ = c.rename(obs.Name)
+	if obs.Value != nil {
+		v := c.scale(*obs.Value)
+		obs.Value = &v
+	}
+	if len(obs.Buckets) > 0 {
+		buckets := make([]float64, len(obs.Buckets))
+		for i, max := range obs.Buckets {
+			buckets[i] = c.scale(max)
+		}
+		obs.Buckets = buckets
+	}
+	if obs.Unit != "" {
+		obs.Unit = c.to
+	}
+	return obs
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestConvert(t *testing.T) {
+	c, err := loadConfig(writeConfig(t, `
+transforms:
+  - convert: {from: ms, to: seconds}
+  - match: upload_.*
+    convert: {from: kib, to: bytes}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transforms, err := compileTransforms(c.Transforms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := aggregator.NewUniverse()
+	in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+	in.transforms = newTransformer(transforms)
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`{"name":"request_duration_ms","type":"histogram","help":"Request duration.","buckets":[100,500,1000],"unit":"ms"}`,
+		`request_duration_ms{} 250`,
+		`{"name":"busy_ms_total","type":"counter","help":"Total time busy."}`,
+		`busy_ms_total{} 1500`,
+		`{"name":"upload_size_kib","type":"gauge","help":"Size of the last upload."}`,
+		`upload_size_kib{} 2`,
+		`{"name":"download_size_kib","type":"gauge","help":"Size of the last download."}`,
+		`download_size_kib{} 2`,
+	}, "\n"))))
+
+	if want, have := normalizeResponse(`
+		# HELP busy_seconds_total Total time busy.
+		# TYPE busy_seconds_total counter
+		busy_seconds_total{} 1.500000
+
+		# HELP download_size_kib Size of the last download.
+		# TYPE download_size_kib gauge
+		download_size_kib{} 2.000000
+
+		# HELP request_duration_seconds Request duration.
+		# TYPE request_duration_seconds histogram
+		request_duration_seconds_bucket{le="0.1"} 0
+		request_duration_seconds_bucket{le="0.5"} 1
+		request_duration_seconds_bucket{le="1"} 1
+		request_duration_seconds_bucket{le="+Inf"} 1
+		request_duration_seconds_sum{} 0.250000
+		request_duration_seconds_count{} 1
+
+		# HELP upload_size_bytes Size of the last upload.
+		# TYPE upload_size_bytes gauge
+		upload_size_bytes{} 2048.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestConversionFactors(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		from, to string
+		in, want float64
+	}{
+		"ms to s":   {"ms", "seconds", 1500, 1.5},
+		"s to ms":   {"seconds", "ms", 1.5, 1500},
+		"us to ms":  {"us", "ms", 2500, 2.5},
+		"ms to us":  {"ms", "us", 2.5, 2500},
+		"ns to s":   {"ns", "seconds", 3e8, 0.3},
+		"mib to kb": {"mib", "kb", 1, 1048.576},
+		"percent":   {"percent", "ratio", 25, 0.25},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := compileConversion(unitConversion{testcase.from, testcase.to})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, have := testcase.want, c.scale(testcase.in); want != have {
+				t.Errorf("want %v, have %v", want, have)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"github.com/pkg/errors"
+)
+
+// auditSourceAPI is the source of declarations posted to
+// /api/v1/declarations.
+const auditSourceAPI = "api.declarations"
+
+// maxDeclarationsBytes is the largest batch of declarations accepted.
+const maxDeclarationsBytes = 8 << 20
+
+// declarer applies declarations, as Universe.Declare does. The tenant and
+// route routers apply them to every universe they observe in, so that
+// declarations that aren't ingested, e.g. from a reload or the API, reach
+// those universes too.
+type declarer interface {
+	Declare(aggregator.Observation) (added bool, err error)
+}
+
+// declarationResult is the outcome of one declaration of a batch, as in the
+// audit log. If the batch isn't applied, only the declarations that failed
+// have an outcome.
+type declarationResult struct {
+	Name    string `json:"name"`
+	Outcome string `json:"outcome,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// declarationsHandler lists (GET) the declaration of every metric, or applies
+// (POST) a batch of declarations, as a JSON array, or as lines of JSON, for
+// deployment tooling that pushes metric schemas. Every declaration is checked
+// before any is applied, so the batch is applied as a whole, or not at all,
+// unless a conflicting declaration is ingested in between. Declarations are
+// checked against u, and applied with d.
+func declarationsHandler(u *aggregator.Universe, d declarer, audit *auditLog) http.Handler {
+	var mtx sync.Mutex // serializes batches
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			respondJSON(w, http.StatusOK, u.Declarations())
+			return
+		case "POST":
+		default:
+			respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxDeclarationsBytes+1))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(body) > maxDeclarationsBytes {
+			respondError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("declarations exceed %d bytes", maxDeclarationsBytes))
+			return
+		}
+		decls, err := parseDeclarations(body)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		results, ok := checkDeclarations(u, decls)
+		if !ok {
+			for i, res := range results {
+				if res.Outcome != "" {
+					audit.record(auditSourceAPI, decls[i], res.Outcome, errors.New(res.Error))
+				}
+			}
+			respondJSON(w, http.StatusBadRequest, declarationsResponse{Declarations: results})
+			return
+		}
+		for i, o := range decls {
+			added, err := d.Declare(o)
+			switch {
+			case err != nil: // a conflicting declaration was ingested since the check
+				results[i] = declarationResult{Name: o.Name, Outcome: auditConflict, Error: err.Error()}
+				audit.record(auditSourceAPI, o, auditConflict, err)
+				continue
+			case added:
+				results[i].Outcome = auditCreated
+			default:
+				results[i].Outcome = auditExisting
+			}
+			audit.record(auditSourceAPI, o, results[i].Outcome, nil)
+		}
+		respondJSON(w, http.StatusOK, declarationsResponse{Applied: true, Declarations: results})
+	})
+}
+
+type declarationsResponse struct {
+	Applied      bool                `json:"applied"`
+	Declarations []declarationResult `json:"declarations"`
+}
+
+// parseDeclarations parses a JSON array of declarations, or lines of JSON,
+// skipping blank lines and comments.
+func parseDeclarations(body []byte) ([]aggregator.Observation, error) {
+	var lines [][]byte
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, errors.Wrap(err, "decoding declarations")
+		}
+		for _, r := range raw {
+			lines = append(lines, r)
+		}
+	} else {
+		s := bufio.NewScanner(bytes.NewReader(body))
+		s.Buffer(nil, maxDeclarationsBytes)
+		for s.Scan() {
+			if line := bytes.TrimSpace(s.Bytes()); !aggregator.IsComment(line) {
+				lines = append(lines, append([]byte(nil), line...))
+			}
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("no declarations")
+	}
+	decls := make([]aggregator.Observation, len(lines))
+	for i, line := range lines {
+		o, err := aggregator.ParseLineAs(line, nil, aggregator.LineFormatJSON)
+		if err != nil {
+			return nil, errors.Wrapf(err, "declaration %d", i+1)
+		}
+		if o.Type == "" || o.Value != nil {
+			return nil, fmt.Errorf("declaration %d (%s): want a type, and no value", i+1, o.Name)
+		}
+		decls[i] = o
+	}
+	return decls, nil
+}
+
+// checkDeclarations returns the outcome of each declaration that would fail,
+// against u, or an earlier declaration of the batch, and whether none would.
+func checkDeclarations(u *aggregator.Universe, decls []aggregator.Observation) ([]declarationResult, bool) {
+	var (
+		batch, _ = aggregator.NewUniverse()
+		results  = make([]declarationResult, len(decls))
+		seen     = map[string]bool{}
+		ok       = true
+	)
+	for i, o := range decls {
+		results[i].Name = o.Name
+		err := u.CheckDeclaration(o)
+		if err == nil {
+			_, err = batch.Declare(o)
+		}
+		if err != nil {
+			results[i].Outcome, results[i].Error = auditInvalid, err.Error()
+			if _, newMetric, _, _ := u.DryRun(o); !newMetric || seen[o.Name] {
+				results[i].Outcome = auditConflict
+			}
+			ok = false
+		}
+		seen[o.Name] = true
+	}
+	return results, ok
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestDeclarationsHandler(t *testing.T) {
+	for name, tc := range map[string]struct {
+		body     string
+		wantCode int
+		want     declarationsResponse
+		wantType string // of foo_total, after the batch
+	}{
+		"array": {
+			body:     `[{"name":"foo_total","type":"counter","help":"Foos."},{"name":"bar","type":"gauge","help":"Bars."}]`,
+			wantCode: http.StatusOK,
+			want: declarationsResponse{Applied: true, Declarations: []declarationResult{
+				{Name: "foo_total", Outcome: auditCreated},
+				{Name: "bar", Outcome: auditCreated},
+			}},
+			wantType: "counter",
+		},
+		"lines": {
+			body:     "# schemas\n{\"name\":\"foo_total\",\"type\":\"counter\",\"help\":\"Foos.\"}\n\n{\"name\":\"existing\",\"type\":\"gauge\",\"help\":\"Still.\"}\n",
+			wantCode: http.StatusOK,
+			want: declarationsResponse{Applied: true, Declarations: []declarationResult{
+				{Name: "foo_total", Outcome: auditCreated},
+				{Name: "existing", Outcome: auditExisting},
+			}},
+			wantType: "counter",
+		},
+		"conflict with existing": {
+			body:     `[{"name":"foo_total","type":"counter","help":"Foos."},{"name":"existing","type":"counter","help":"Changed."}]`,
+			wantCode: http.StatusBadRequest,
+			want: declarationsResponse{Declarations: []declarationResult{
+				{Name: "foo_total"},
+				{Name: "existing", Outcome: auditConflict, Error: "can't change type from 'gauge' to 'counter'"},
+			}},
+		},
+		"conflict within batch": {
+			body:     `[{"name":"foo_total","type":"counter","help":"Foos."},{"name":"foo_total","type":"gauge","help":"Foos."}]`,
+			wantCode: http.StatusBadRequest,
+			want: declarationsResponse{Declarations: []declarationResult{
+				{Name: "foo_total"},
+				{Name: "foo_total", Outcome: auditConflict, Error: "can't change type from 'counter' to 'gauge'"},
+			}},
+		},
+		"invalid": {
+			body:     `[{"name":"foo_total","type":"counter","help":"Foos."},{"name":"bar","type":"frob","help":"Frobs."}]`,
+			wantCode: http.StatusBadRequest,
+			want: declarationsResponse{Declarations: []declarationResult{
+				{Name: "foo_total"},
+				{Name: "bar", Outcome: auditInvalid, Error: "invalid type 'frob'"},
+			}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			u, _ := aggregator.NewUniverse()
+			if _, err := u.Declare(aggregator.Observation{Name: "existing", Type: "gauge", Help: "Existing."}); err != nil {
+				t.Fatal(err)
+			}
+			a := newAuditLog(u, 10)
+			rec := httptest.NewRecorder()
+			declarationsHandler(u, u, a).ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/declarations", strings.NewReader(tc.body)))
+			if want, have := tc.wantCode, rec.Code; want != have {
+				t.Fatalf("code: want %d, have %d: %s", want, have, rec.Body)
+			}
+			var have declarationsResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &have); err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(tc.want, have) {
+				t.Errorf("response: %s", cmp.Diff(tc.want, have))
+			}
+			typ, newMetric, _, _ := u.DryRun(aggregator.Observation{Name: "foo_total"})
+			if newMetric {
+				typ = ""
+			}
+			if want, have := tc.wantType, typ; want != have {
+				t.Errorf("foo_total: want type %q, have %q", want, have)
+			}
+			var audited int
+			for _, res := range tc.want.Declarations {
+				if res.Outcome != "" {
+					audited++
+				}
+			}
+			if want, have := audited, len(a.recent("")); want != have {
+				t.Errorf("audit log: want %d entries, have %d", want, have)
+			}
+		})
+	}
+}
+
+func TestParseDeclarations(t *testing.T) {
+	for name, body := range map[string]string{
+		"empty":       "",
+		"comments":    "# nothing\n",
+		"bad array":   `[{"name":"foo"`,
+		"value":       `{"name":"foo_total","type":"counter","help":"Foos.","value":1}`,
+		"no type":     `{"name":"foo_total","help":"Foos."}`,
+		"text format": `foo_total 1`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseDeclarations([]byte(body)); err == nil {
+				t.Fatal("want error, have none")
+			}
+		})
+	}
+}
+
+func TestDeclarationsHandlerList(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	h := declarationsHandler(u, u, nil)
+	body := `[{"name":"foo_total","type":"counter","help":"Foos."},{"name":"bar_seconds","type":"histogram","help":"Bars.","buckets":[1,2],"ttl":"5m"}]`
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/declarations", strings.NewReader(body)))
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("POST: want %d, have %d: %s", want, have, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/declarations", nil))
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("GET: want %d, have %d: %s", want, have, rec.Body)
+	}
+	var have []aggregator.Observation
+	if err := json.Unmarshal(rec.Body.Bytes(), &have); err != nil {
+		t.Fatal(err)
+	}
+	want := []aggregator.Observation{
+		{Name: "bar_seconds", Type: "histogram", Help: "Bars.", Buckets: []float64{1, 2}, TTL: "5m0s"},
+		{Name: "foo_total", Type: "counter", Help: "Foos."},
+	}
+	if !cmp.Equal(want, have) {
+		t.Errorf("GET: %s", cmp.Diff(want, have))
+	}
+
+	// The listing can be posted back, as it is.
+	rec2 := httptest.NewRecorder()
+	h.ServeHTTP(rec2, httptest.NewRequest("POST", "/api/v1/declarations", strings.NewReader(rec.Body.String())))
+	if want, have := http.StatusOK, rec2.Code; want != have {
+		t.Fatalf("POST listing: want %d, have %d: %s", want, have, rec2.Body)
+	}
+}
@@ -0,0 +1,254 @@
+//go:build dtls
+// +build dtls
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/protocol"
+	"github.com/pion/dtls/v2/pkg/protocol/recordlayer"
+	"github.com/pion/transport/v2/udp"
+	"github.com/pkg/errors"
+)
+
+// errDTLSWrite is returned by writes to a DTLS listener, whose senders are
+// never replied to.
+var errDTLSWrite = errors.New("DTLS senders aren't replied to")
+
+// dtlsHandshakeTimeout is how long a sender has to complete the DTLS
+// handshake of an association.
+const dtlsHandshakeTimeout = 10 * time.Second
+
+// dtlsMaxDatagram is the largest datagram a DTLS association can carry.
+const dtlsMaxDatagram = 1<<16 - 1
+
+// dtlsPacketConn reads the datagrams of every DTLS association with the
+// listener as if they'd been sent to a UDP socket, so that they're handled
+// like UDP packets, fire-and-forget, but encrypted in transit, and, with
+// client CAs, authenticated. Writes aren't supported, as UDP packets are
+// never replied to.
+type dtlsPacketConn struct {
+	ln          net.Listener
+	config      *dtls.Config
+	sem         chan struct{} // a slot per association, nil is unlimited
+	idleTimeout time.Duration // 0 disables
+	packets     chan dtlsPacket
+	ctx         context.Context // done once the conn is closed
+	cancel      context.CancelFunc
+
+	mtx      sync.Mutex
+	conns    map[net.Conn]struct{} // associations, once handshaken
+	deadline time.Time
+	changed  chan struct{} // closed when the deadline changes
+}
+
+type dtlsPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// listenDTLS listens for DTLS associations, with the certificates of
+// tlsConfig, and, if it has client CAs, requires senders to present a
+// certificate signed by one of them. At most maxConns associations, including
+// those handshaking, are kept, if it's positive, and an association that
+// sends nothing for idleTimeout, if it's positive, is closed.
+func listenDTLS(address string, tlsConfig *tls.Config, readBuffer, maxConns int, idleTimeout time.Duration) (*dtlsPacketConn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	lc := udp.ListenConfig{
+		ReadBufferSize: readBuffer,
+		AcceptFilter:   isDTLSHandshake, // so stray packets don't create associations
+	}
+	ln, err := lc.Listen("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &dtlsPacketConn{
+		ln: ln,
+		config: &dtls.Config{
+			Certificates:         tlsConfig.Certificates,
+			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+			ConnectContextMaker: func() (context.Context, func()) {
+				return context.WithTimeout(ctx, dtlsHandshakeTimeout)
+			},
+		},
+		idleTimeout: idleTimeout,
+		packets:     make(chan dtlsPacket),
+		ctx:         ctx,
+		cancel:      cancel,
+		conns:       map[net.Conn]struct{}{},
+		changed:     make(chan struct{}),
+	}
+	if tlsConfig.ClientCAs != nil {
+		c.config.ClientCAs = tlsConfig.ClientCAs
+		c.config.ClientAuth = dtls.RequireAndVerifyClientCert
+	}
+	if maxConns > 0 {
+		c.sem = make(chan struct{}, maxConns)
+	}
+	go c.accept()
+	return c, nil
+}
+
+func isDTLSHandshake(packet []byte) bool {
+	pkts, err := recordlayer.UnpackDatagram(packet)
+	if err != nil || len(pkts) < 1 {
+		return false
+	}
+	var h recordlayer.Header
+	if err := h.Unmarshal(pkts[0]); err != nil {
+		return false
+	}
+	return h.ContentType == protocol.ContentTypeHandshake
+}
+
+// accept handshakes each new association concurrently, so that a slow
+// sender doesn't hold up the others. Associations beyond the maximum are
+// closed at once.
+func (c *dtlsPacketConn) accept() {
+	for {
+		conn, err := c.ln.Accept()
+		if err != nil {
+			return
+		}
+		if c.sem != nil {
+			select {
+			case c.sem <- struct{}{}:
+			default:
+				conn.Close()
+				continue
+			}
+		}
+		go c.read(conn)
+	}
+}
+
+func (c *dtlsPacketConn) read(conn net.Conn) {
+	if c.sem != nil {
+		defer func() { <-c.sem }()
+	}
+	defer conn.Close()
+	d, err := dtls.Server(conn, c.config)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	if !c.add(d) {
+		return
+	}
+	defer c.remove(d)
+	addr := conn.RemoteAddr()
+	buf := make([]byte, dtlsMaxDatagram)
+	for {
+		if c.idleTimeout > 0 {
+			d.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		}
+		n, err := d.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case c.packets <- dtlsPacket{append([]byte(nil), buf[:n]...), addr}:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *dtlsPacketConn) add(conn net.Conn) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.ctx.Err() != nil {
+		return false
+	}
+	c.conns[conn] = struct{}{}
+	return true
+}
+
+func (c *dtlsPacketConn) remove(conn net.Conn) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.conns, conn)
+}
+
+// ReadFrom reads the next datagram of any association, truncated to p, and
+// returns the address of its sender.
+func (c *dtlsPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		packet, ok, err := c.next()
+		if err != nil {
+			return 0, nil, err
+		}
+		if ok {
+			return copy(p, packet.data), packet.addr, nil
+		}
+	}
+}
+
+// next waits for the next datagram until the read deadline, and returns
+// false if the deadline changes first.
+func (c *dtlsPacketConn) next() (dtlsPacket, bool, error) {
+	c.mtx.Lock()
+	deadline, changed := c.deadline, c.changed
+	c.mtx.Unlock()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return dtlsPacket{}, false, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case packet := <-c.packets:
+		return packet, true, nil
+	case <-expired:
+		return dtlsPacket{}, false, os.ErrDeadlineExceeded
+	case <-c.ctx.Done():
+		return dtlsPacket{}, false, net.ErrClosed
+	case <-changed:
+		return dtlsPacket{}, false, nil
+	}
+}
+
+func (c *dtlsPacketConn) WriteTo([]byte, net.Addr) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "udp+dtls", Err: errDTLSWrite}
+}
+
+// Close stops accepting associations, and closes those already accepted.
+func (c *dtlsPacketConn) Close() error {
+	c.mtx.Lock()
+	c.cancel()
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.mtx.Unlock()
+	return c.ln.Close()
+}
+
+func (c *dtlsPacketConn) LocalAddr() net.Addr { return c.ln.Addr() }
+
+func (c *dtlsPacketConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *dtlsPacketConn) SetReadDeadline(t time.Time) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.deadline = t
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return nil
+}
+
+func (c *dtlsPacketConn) SetWriteDeadline(time.Time) error { return nil }
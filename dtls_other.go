@@ -0,0 +1,23 @@
+//go:build !dtls
+// +build !dtls
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errDTLSUnsupported is returned by listenDTLS in builds without the dtls
+// tag, which leave out github.com/pion/dtls.
+var errDTLSUnsupported = errors.New("DTLS isn't supported by this build; build with -tags dtls")
+
+// dtlsPacketConn is never listening without the dtls tag.
+type dtlsPacketConn struct{ net.PacketConn }
+
+func listenDTLS(string, *tls.Config, int, int, time.Duration) (*dtlsPacketConn, error) {
+	return nil, errDTLSUnsupported
+}
@@ -0,0 +1,189 @@
+//go:build dtls
+// +build dtls
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"github.com/pion/dtls/v2"
+)
+
+func TestDTLSListener(t *testing.T) {
+	// Borrow the test server's certificate, for 127.0.0.1.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	conn, err := listenDTLS("127.0.0.1:0", srv.TLS, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var (
+		dst, _ = aggregator.NewUniverse()
+		in     = newIngester(dst, newTelemetry(dst), log.NewNopLogger())
+		done   = make(chan error, 1)
+	)
+	go func() { done <- in.forwardPacketConn(conn) }()
+
+	client, err := dtls.Dial("udp", conn.LocalAddr().(*net.UDPAddr), &dtls.Config{
+		RootCAs:              roots,
+		ServerName:           "127.0.0.1",
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Each datagram is handled like a UDP packet.
+	for _, packet := range []string{
+		`{"name":"foo","type":"counter","help":"Total foos."}`,
+		`foo{} 1`,
+		`foo{} 2`,
+	} {
+		if _, err := client.Write([]byte(packet)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForSeriesValue(t, dst, "foo", map[string]string{}, 3)
+
+	// Draining stops reading, without closing the listener.
+	in.drain(0)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("forward: want no error, have %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("forward: still reading after the drain")
+	}
+}
+
+func TestDTLSListenerLimits(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	conn, err := listenDTLS("127.0.0.1:0", srv.TLS, 0, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	dial := func(timeout time.Duration) (*dtls.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return dtls.DialWithContext(ctx, "udp", conn.LocalAddr().(*net.UDPAddr), &dtls.Config{
+			RootCAs:              roots,
+			ServerName:           "127.0.0.1",
+			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		})
+	}
+
+	first, err := dial(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if second, err := dial(300 * time.Millisecond); err == nil {
+		second.Close()
+		t.Fatal("association over the maximum: want error, have none")
+	}
+
+	// The first association is closed once it's idle, making room for another.
+	time.Sleep(1500 * time.Millisecond)
+	third, err := dial(time.Second)
+	if err != nil {
+		t.Fatalf("association after the idle timeout: want none, have %v", err)
+	}
+	third.Close()
+}
+
+func TestDTLSListenerClientCA(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	trusted, ca := newClientCert(t)
+	untrusted, _ := newClientCert(t)
+	config := srv.TLS.Clone()
+	config.ClientCAs = x509.NewCertPool()
+	config.ClientCAs.AddCert(ca)
+	conn, err := listenDTLS("127.0.0.1:0", config, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for name, tc := range map[string]struct {
+		certs []tls.Certificate
+		ok    bool
+	}{
+		"no certificate": {nil, false},
+		"untrusted":      {[]tls.Certificate{untrusted}, false},
+		"trusted":        {[]tls.Certificate{trusted}, true},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		client, err := dtls.DialWithContext(ctx, "udp", conn.LocalAddr().(*net.UDPAddr), &dtls.Config{
+			Certificates:         tc.certs,
+			RootCAs:              roots,
+			ServerName:           "127.0.0.1",
+			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		})
+		cancel()
+		if err == nil {
+			client.Close()
+		}
+		if want, have := tc.ok, err == nil; want != have {
+			t.Errorf("%s: want handshake to succeed %v, have %v (%v)", name, want, have, err)
+		}
+	}
+}
+
+// newClientCert returns a self-signed client certificate, and its parsed
+// form, to trust as its own CA.
+func newClientCert(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sender"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+// etagHandler tags each response of the wrapped handler with a hash of its
+// body, and answers a scrape whose If-None-Match has the tag with 304, so
+// that scrapers of a slowly changing universe needn't download it again. The
+// aggregator's telemetry of scrapes, and the Go runtime metrics, are left out
+// of the hash, as they change with every scrape.
+type etagHandler struct {
+	next        http.Handler
+	volatile    [][]byte // prefixes of lines left out of the hash
+	notModified *selfCounter
+}
+
+func newETagHandler(next http.Handler, t *telemetry) *etagHandler {
+	h := &etagHandler{next: next, notModified: t.scrapesNotModified}
+	volatile := []selfMetric{t.scrapeDuration, t.scrapesRejected, t.scrapesNotModified}
+	for _, m := range t.metrics {
+		if _, ok := m.(*runtimeMetrics); ok {
+			volatile = append(volatile, m)
+		}
+	}
+	for _, m := range volatile {
+		h.volatile = append(h.volatile, []byte(m.name()))
+	}
+	return h
+}
+
+func (h *etagHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := &bufferedResponseWriter{header: http.Header{}, code: http.StatusOK}
+	h.next.ServeHTTP(rec, r)
+	for k, vs := range rec.header {
+		w.Header()[k] = vs
+	}
+	if rec.code != http.StatusOK {
+		w.WriteHeader(rec.code)
+		w.Write(rec.buf.Bytes())
+		return
+	}
+	tag := h.tag(rec.buf.Bytes())
+	w.Header().Set("ETag", tag)
+	if matchesETag(r.Header.Get("If-None-Match"), tag) {
+		h.notModified.add(1)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(rec.code)
+	w.Write(rec.buf.Bytes())
+}
+
+// tag returns the quoted hash of every line of body but the volatile ones.
+func (h *etagHandler) tag(body []byte) string {
+	hash := fnv.New64a()
+lines:
+	for len(body) > 0 {
+		line := body
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			line, body = body[:i+1], body[i+1:]
+		} else {
+			body = nil
+		}
+		for _, prefix := range h.volatile {
+			if bytes.HasPrefix(line, prefix) {
+				continue lines
+			}
+		}
+		hash.Write(line)
+	}
+	return fmt.Sprintf(`"%016x"`, hash.Sum64())
+}
+
+// matchesETag returns true if the If-None-Match header has the tag, or is *.
+// Weak comparison is used, as a GET is conditional on it.
+func matchesETag(ifNoneMatch, tag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == tag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
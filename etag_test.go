@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestETag(t *testing.T) {
+	u, _ := aggregator.NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	loadObservations(t, u, makeObservations(t, []string{`foo_total{} 1`}))
+	tel := newTelemetry(u)
+	h := newETagHandler(exposition(u, tel), tel)
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := get("")
+	tag := first.Header().Get("ETag")
+	if want, have := http.StatusOK, first.Code; want != have || tag == "" {
+		t.Fatalf("first: want %d with an ETag, have %d with %q", want, have, tag)
+	}
+
+	// The scrape duration has changed, but nothing else has.
+	second := get(tag)
+	if want, have := http.StatusNotModified, second.Code; want != have {
+		t.Fatalf("unchanged: want %d, have %d", want, have)
+	}
+	if second.Body.Len() != 0 {
+		t.Errorf("unchanged: want no body, have %q", second.Body.String())
+	}
+	if want, have := uint64(1), tel.scrapesNotModified.value(); want != have {
+		t.Errorf("not modified: want %d, have %d", want, have)
+	}
+
+	loadObservations(t, u, makeObservations(t, []string{`foo_total{} 1`}))
+	third := get(tag)
+	if want, have := http.StatusOK, third.Code; want != have {
+		t.Fatalf("changed: want %d, have %d", want, have)
+	}
+	if have := third.Header().Get("ETag"); have == tag {
+		t.Errorf("changed: want a new ETag, have %q again", have)
+	}
+}
+
+func TestMatchesETag(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		"none":      {``, false},
+		"same":      {`"abc"`, true},
+		"different": {`"abd"`, false},
+		"weak":      {`W/"abc"`, true},
+		"list":      {`"xyz", W/"abc"`, true},
+		"any":       {`*`, true},
+		"unquoted":  {`abc`, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if want, have := testcase.want, matchesETag(testcase.ifNoneMatch, `"abc"`); want != have {
+				t.Errorf("want %v, have %v", want, have)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"github.com/pkg/errors"
+)
+
+// explanation is what would happen to a line, if it were received.
+type explanation struct {
+	Line        string                  `json:"line"`
+	Accepted    bool                    `json:"accepted"`
+	Reason      string                  `json:"reason,omitempty"` // as in aggregator_lines_rejected_total
+	Error       string                  `json:"error,omitempty"`
+	Format      string                  `json:"format,omitempty"` // json or prometheus
+	Observation *aggregator.Observation `json:"observation,omitempty"`
+	Type        string                  `json:"type,omitempty"`
+	Declaration bool                    `json:"declaration"` // no value, so nothing is rendered yet
+	NewMetric   bool                    `json:"new_metric"`
+	NewSeries   bool                    `json:"new_series"`
+	Dropped     bool                    `json:"dropped,omitempty"` // by a transform
+
+	// Values explains each value of a multi-value line, as if it were a
+	// line of its own. The line is accepted if none of them is rejected, and
+	// otherwise has the reason and error of the first that is.
+	Values []explanation `json:"values,omitempty"`
+}
+
+// explainHandler takes a single line as the body of a POST, and explains
+// whether it would be accepted, and if not, why not, without observing it.
+// Rate limits aren't considered, as they depend on the sender. Lines are
+// parsed in the format of the socket listener.
+func explainHandler(u *aggregator.Universe, transforms *transformer, format aggregator.LineFormat, maxLineBytes int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, int64(16*maxLineBytes)))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		body = bytes.TrimSuffix(body, []byte("\n"))
+		body = bytes.TrimSuffix(body, []byte("\r"))
+		if bytes.IndexByte(body, '\n') >= 0 {
+			respondError(w, http.StatusBadRequest, "explain one line at a time")
+			return
+		}
+		respondJSON(w, http.StatusOK, explainLine(u, transforms, format, maxLineBytes, body))
+	})
+}
+
+// explainLine runs a line through the same stages as ingest, stopping at the
+// first that rejects it. The observation is shown as transformed.
+func explainLine(u *aggregator.Universe, transforms *transformer, format aggregator.LineFormat, maxLineBytes int, line []byte) explanation {
+	e := explanation{Line: string(line)}
+	reject := func(reason string, err error) explanation {
+		e.Reason, e.Error = reason, err.Error()
+		return e
+	}
+
+	if len(line) > maxLineBytes {
+		return reject(rejectTooLong, lineTooLongError{maxLineBytes})
+	}
+	var d aggregator.Decompressor
+	defer d.Release()
+	data, err := d.Decompress(line)
+	if err != nil {
+		return reject(rejectDecompress, decompressError{err})
+	}
+	if len(data) > maxLineBytes {
+		return reject(rejectTooLong, lineTooLongError{maxLineBytes})
+	}
+	e.Line = string(data)
+
+	e.Format = "prometheus"
+	if format == aggregator.LineFormatJSON || (format != aggregator.LineFormatPrometheus && aggregator.IsJSON(data)) {
+		e.Format = "json"
+	}
+	obs, err := aggregator.ParseLineAs(data, nil, format)
+	if err != nil {
+		return reject(rejectParse, errors.Wrap(err, "parse error"))
+	}
+	if len(obs.Values) > 0 {
+		e.Observation, e.Accepted = &obs, true
+		for _, o := range obs.Split() {
+			v := explainObservation(u, transforms, o, explanation{Format: e.Format})
+			if e.Accepted && !v.Accepted && !v.Dropped {
+				e.Accepted, e.Reason, e.Error = false, v.Reason, v.Error
+			}
+			e.Values = append(e.Values, v)
+		}
+		return e
+	}
+	return explainObservation(u, transforms, obs, e)
+}
+
+// explainObservation continues the explanation e of a line with its parsed
+// observation.
+func explainObservation(u *aggregator.Universe, transforms *transformer, obs aggregator.Observation, e explanation) explanation {
+	obs, ok := transforms.apply(obs)
+	e.Observation = &obs
+	e.Declaration = obs.Value == nil
+	if !ok {
+		e.Dropped = true
+		return e
+	}
+
+	var err error
+	e.Type, e.NewMetric, e.NewSeries, err = u.DryRun(obs)
+	if err != nil {
+		e.Reason, e.Error = rejectObserve, errors.Wrap(err, "observation error").Error()
+		return e
+	}
+	e.Accepted = true
+	return e
+}
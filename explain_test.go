@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestExplainHandler(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`foo_total{code="200"} 3`,
+	}))
+	before := scrape(t, u)
+	h := explainHandler(u, nil, aggregator.LineFormatAuto, 64)
+
+	for name, testcase := range map[string]struct {
+		line string
+		want explanation
+	}{
+		"existing series": {
+			line: `foo_total{code="200"} 1`,
+			want: explanation{Accepted: true, Format: "prometheus", Type: "counter"},
+		},
+		"new series": {
+			line: "foo_total{code=\"500\"} 1\n",
+			want: explanation{Accepted: true, Format: "prometheus", Type: "counter", NewSeries: true},
+		},
+		"declaration": {
+			line: `{"name":"bar","type":"gauge","help":"Current bar."}`,
+			want: explanation{Accepted: true, Format: "json", Type: "gauge", Declaration: true, NewMetric: true, NewSeries: true},
+		},
+		"undeclared": {
+			line: `bar{} 1`,
+			want: explanation{Reason: rejectObserve, Format: "prometheus", NewMetric: true},
+		},
+		"values": {
+			line: `{"values":{"foo_total":1}}`,
+			want: explanation{Accepted: true, Format: "json"},
+		},
+		"values, one undeclared": {
+			line: `{"values":{"foo_total":1,"bar":1}}`,
+			want: explanation{Reason: rejectObserve, Format: "json"},
+		},
+		"bad format": {
+			line: `foo_total{code=200} 1`,
+			want: explanation{Reason: rejectParse, Format: "prometheus"},
+		},
+		"too long": {
+			line: `foo_total{code="` + strings.Repeat("x", 64) + `"} 1`,
+			want: explanation{Reason: rejectTooLong},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("POST", "/debug/explain", strings.NewReader(testcase.line)))
+			if want, have := http.StatusOK, rec.Code; want != have {
+				t.Fatalf("code: want %d, have %d: %s", want, have, rec.Body.String())
+			}
+			var have explanation
+			if err := json.Unmarshal(rec.Body.Bytes(), &have); err != nil {
+				t.Fatal(err)
+			}
+			want := testcase.want
+			if want.Accepted != have.Accepted || want.Reason != have.Reason || want.Format != have.Format || want.Type != have.Type ||
+				want.Declaration != have.Declaration || want.NewMetric != have.NewMetric || want.NewSeries != have.NewSeries {
+				t.Errorf("want %+v, have %+v", want, have)
+			}
+			if want.Accepted == (have.Error != "") {
+				t.Errorf("error: want error %v, have %q", !want.Accepted, have.Error)
+			}
+		})
+	}
+
+	if want, have := before, scrape(t, u); want != have {
+		t.Errorf("explaining changed the universe:\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	for _, testcase := range []struct {
+		method, body string
+		code         int
+	}{
+		{"GET", "", http.StatusMethodNotAllowed},
+		{"POST", "foo_total{} 1\nfoo_total{} 2", http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(testcase.method, "/debug/explain", strings.NewReader(testcase.body)))
+		if want, have := testcase.code, rec.Code; want != have {
+			t.Errorf("%s %q: want %d, have %d", testcase.method, testcase.body, want, have)
+		}
+	}
+}
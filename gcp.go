@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// gcpMetadataTokenURL is where the metadata server of GCE, GKE, Cloud Run,
+// and Cloud Functions serves access tokens for the default service account.
+const gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcpTokenSource returns OAuth2 access tokens for Google APIs, each cached
+// until shortly before it expires, from a service account key file, or the
+// metadata server.
+type gcpTokenSource struct {
+	mtx    sync.Mutex
+	token  string
+	expiry time.Time
+	fetch  func(ctx context.Context) (token string, expiresIn time.Duration, err error)
+	now    func() time.Time
+}
+
+// newGCPTokenSource returns a token source with the scope, for the service
+// account key in $GOOGLE_APPLICATION_CREDENTIALS, if it's set, or else the
+// default service account of the metadata server.
+func newGCPTokenSource(client *http.Client, scope string) (*gcpTokenSource, error) {
+	ts := &gcpTokenSource{now: time.Now}
+	filename := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if filename == "" {
+		ts.fetch = func(ctx context.Context) (string, time.Duration, error) {
+			req, err := http.NewRequest("GET", gcpMetadataTokenURL+"?scopes="+url.QueryEscape(scope), nil)
+			if err != nil {
+				return "", 0, err
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			return gcpTokenResponse(client, req.WithContext(ctx))
+		}
+		return ts, nil
+	}
+
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var key struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKeyID string `json:"private_key_id"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(buf, &key); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", filename)
+	}
+	if key.Type != "service_account" {
+		return nil, fmt.Errorf("%s: only service account keys are supported, not %q", filename, key.Type)
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s: private key isn't PEM-encoded", filename)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: parsing private key", filename)
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: private key isn't an RSA key", filename)
+	}
+	ts.fetch = func(ctx context.Context) (string, time.Duration, error) {
+		assertion, err := signJWT(rsaKey, key.PrivateKeyID, map[string]interface{}{
+			"iss":   key.ClientEmail,
+			"scope": scope,
+			"aud":   key.TokenURI,
+			"iat":   ts.now().Unix(),
+			"exp":   ts.now().Add(time.Hour).Unix(),
+		})
+		if err != nil {
+			return "", 0, err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+		req, err := http.NewRequest("POST", key.TokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return gcpTokenResponse(client, req.WithContext(ctx))
+	}
+	return ts, nil
+}
+
+// gcpTokenResponse returns the access token in the response to req.
+func gcpTokenResponse(client *http.Client, req *http.Request) (string, time.Duration, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "getting access token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("getting access token: %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", 0, errors.Wrap(err, "decoding access token")
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
+
+// Token returns a current access token.
+func (ts *gcpTokenSource) Token(ctx context.Context) (string, error) {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	if ts.token != "" && ts.now().Before(ts.expiry) {
+		return ts.token, nil
+	}
+	token, expiresIn, err := ts.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	// Refresh a minute early, so a token doesn't expire in flight.
+	ts.token, ts.expiry = token, ts.now().Add(expiresIn-time.Minute)
+	return token, nil
+}
+
+// signJWT returns the claims as a JWT signed with RS256.
+func signJWT(key *rsa.PrivateKey, keyID string, claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
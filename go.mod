@@ -1,13 +1,26 @@
 module github.com/peterbourgon/prometheus-aggregator
 
-go 1.16
+go 1.20
 
 require (
+	github.com/expr-lang/expr v1.16.9
 	github.com/go-kit/kit v0.6.0
+	github.com/google/go-cmp v0.6.0
+	github.com/klauspost/compress v1.17.9
+	github.com/oklog/run v1.0.0
+	github.com/pion/dtls/v2 v2.2.12
+	github.com/pion/transport/v2 v2.2.4
+	github.com/pkg/errors v0.8.0
+	golang.org/x/crypto v0.29.0
+	golang.org/x/net v0.31.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
 	github.com/go-logfmt/logfmt v0.3.0 // indirect
 	github.com/go-stack/stack v1.7.0 // indirect
-	github.com/google/go-cmp v0.2.0
 	github.com/kr/logfmt v0.0.0-20140226030751-b84e30acd515 // indirect
-	github.com/oklog/run v1.0.0
-	github.com/pkg/errors v0.8.0
+	github.com/pion/logging v0.2.2 // indirect
+	golang.org/x/sys v0.27.0 // indirect
+	golang.org/x/text v0.20.0 // indirect
 )
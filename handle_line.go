@@ -3,176 +3,805 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
-	"strconv"
+	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
 	"github.com/pkg/errors"
 )
 
-type observer interface{ observe(observation) error }
+// readFromPacketConn reads a packet from the given packet connection and
+// returns the data as a byte slice, along with the address of the sender. The
+// data is transparently decompressed by d if it is gzipped. If decompression
+// fails, the error is a decompressError, and the connection remains usable.
+// The read and decompression are traced as children of sp, which may be nil,
+// and decompression is recorded in t, which may also be nil.
+func readFromPacketConn(conn net.PacketConn, buf []byte, d *aggregator.Decompressor, sp *span, t *telemetry) ([]byte, net.Addr, error) {
+	read := sp.child("read")
+	n, addr, err := conn.ReadFrom(buf)
+	read.finish(err)
+	if err != nil {
+		return nil, addr, err
+	}
 
-// readFromPacketConn reads a packet from the given packet connection and returns the data as a byte slice. The data is transparently decompressed if it is gzipped.
-func readFromPacketConn(conn net.PacketConn, buf []byte) ([]byte, error) {
-	n, _, err := conn.ReadFrom(buf)
+	decompress := sp.child("decompress")
+	result, err := d.Decompress(buf[:n])
+	decompress.finish(err)
 	if err != nil {
-		return nil, err
+		return nil, addr, decompressError{err}
+	}
+	if t != nil {
+		t.decompressed(buf[:n], result)
 	}
 
-	result, _ := decompressIfGzipped(buf[:n]) // ignore error, we're just reading
+	return result, addr, nil
+}
+
+// errRateLimited is the error for lines rejected by the rate limiter.
+var errRateLimited = errors.New("rate limit exceeded")
+
+// lineTooLongError is returned for a line or packet longer than the maximum.
+type lineTooLongError struct{ max int }
+
+func (e lineTooLongError) Error() string {
+	return fmt.Sprintf("line exceeds maximum of %d bytes", e.max)
+}
+
+// decompressError wraps an error decompressing a single packet or line.
+type decompressError struct{ err error }
+
+func (e decompressError) Error() string { return "decompression error: " + e.err.Error() }
+
+// parseError wraps an error parsing a single line.
+type parseError struct{ err error }
+
+func (e parseError) Error() string { return "parse error: " + e.err.Error() }
+
+// Cause returns the error, for aggregator.RejectReason.
+func (e parseError) Cause() error { return e.err }
+
+// undeclaredError is the error for an observation of a metric that wasn't
+// declared first on a connection that must declare its metrics first.
+type undeclaredError struct{ name string }
+
+func (e undeclaredError) Error() string {
+	return fmt.Sprintf("%s wasn't declared first on this connection", e.name)
+}
+
+// decryptError wraps an error decrypting a single packet.
+type decryptError struct{ err error }
+
+func (e decryptError) Error() string { return "decryption error: " + e.err.Error() }
+
+// ingester forwards lines received by listeners to an observer.
+type ingester struct {
+	o          aggregator.Observer
+	strict     bool     // disconnect TCP clients when they send bad data
+	strictNets cidrList // clients that are strict regardless
+	exemptNets cidrList // clients that aren't strict regardless
+	t          *telemetry
+	rejects    *rejectLogger
+	tracer     *tracer                  // nil disables tracing
+	limiter    *rateLimiter             // nil is unlimited
+	allowed    cidrList                 // empty allows every sender
+	cipher     *aggregator.PacketCipher // nil doesn't decrypt packets
+	queue      *ingestQueue             // nil observes synchronously
+	strings    *aggregator.Interner     // nil doesn't intern
+	record     *recorder                // nil doesn't record
+	transforms *transformer             // nil doesn't transform
+	shadow     *shadow                  // nil doesn't observe in a shadow universe
+	tenants    *tenantAccess            // nil without tenants
+	audit      *auditLog                // nil doesn't audit declarations
+	sequences  *sequenceTracker
+	heartbeats *heartbeatTracker
+	webhook    *webhook // nil doesn't notify limit breaches
+	identity   string   // policy for the job and instance labels
+	format     aggregator.LineFormat
+	logger     log.Logger
+
+	ack          bool          // reply to each line read from a TCP connection
+	declareFirst bool          // close TCP connections that observe metrics they haven't declared
+	maxConns     int           // concurrent TCP connections, 0 is unlimited
+	idleTimeout  time.Duration // close TCP connections idle for this long, 0 disables
+	maxLineBytes int           // longer lines and packets are rejected
 
-	return result, nil
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	active   map[io.Closer]struct{}
+	draining time.Time // read deadline once drain is called
 }
 
-func forwardPacketConn(conn net.PacketConn, o observer, logger log.Logger) error {
-	buf := make([]byte, bufio.MaxScanTokenSize)
+func newIngester(o aggregator.Observer, t *telemetry, logger log.Logger) *ingester {
+	in := &ingester{
+		o:          o,
+		t:          t,
+		rejects:    newRejectLogger(logger, defaultRejectSample),
+		sequences:  newSequenceTracker(defaultMaxSources),
+		heartbeats: newHeartbeatTracker(defaultMaxSources),
+		logger:     logger,
+		format:     aggregator.LineFormatAuto,
+		active:     map[io.Closer]struct{}{},
+
+		maxLineBytes: defaultMaxLineBytes,
+	}
+	in.cond = sync.NewCond(&in.mtx)
+	return in
+}
+
+// defaultMaxLineBytes is the default maximum line or packet size.
+const defaultMaxLineBytes = bufio.MaxScanTokenSize
+
+type readDeadliner interface{ SetReadDeadline(time.Time) error }
+
+// track registers an active connection, so that drain can wait for it.
+func (in *ingester) track(c io.Closer) {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	in.active[c] = struct{}{}
+	if !in.draining.IsZero() {
+		in.stop(c)
+	}
+}
+
+func (in *ingester) untrack(c io.Closer) {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	delete(in.active, c)
+	in.cond.Broadcast()
+}
+
+// stop makes reads from c fail once the drain deadline passes, or immediately
+// if c doesn't support deadlines. It must be called with the mutex held.
+func (in *ingester) stop(c io.Closer) {
+	if d, ok := c.(readDeadliner); ok {
+		d.SetReadDeadline(in.draining)
+		return
+	}
+	c.Close()
+}
+
+// drain stops reading from active connections once timeout elapses, and
+// waits for them to finish processing the lines they've already read,
+// including any that are queued. New connections should be refused, i.e.
+// listeners closed, before calling drain.
+func (in *ingester) drain(timeout time.Duration) {
+	in.mtx.Lock()
+	in.draining = time.Now().Add(timeout)
+	for c := range in.active {
+		in.stop(c)
+	}
+	for len(in.active) > 0 {
+		in.cond.Wait()
+	}
+	in.mtx.Unlock()
+	in.queue.close()
+}
+
+func (in *ingester) isDraining() bool {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	return !in.draining.IsZero()
+}
+
+// forwardPacketConn reads packets from conn until it's closed or drained, in
+// which case it returns nil.
+func (in *ingester) forwardPacketConn(conn net.PacketConn) error {
+	in.track(conn)
+	defer in.untrack(conn)
+	if len(in.allowed) > 0 {
+		conn = allowedPacketConn{conn, in.allowed, in.t}
+	}
+	conn = countingPacketConn{conn, in.t}
+	if in.cipher != nil {
+		conn = decryptingPacketConn{conn, in.cipher}
+	}
+	conn = maxSizePacketConn{conn, in.maxLineBytes}
+	buf := make([]byte, in.maxLineBytes+in.cipher.Overhead()+1) // room to detect truncation
+	var d aggregator.Decompressor
+	defer d.Release()
 	for {
-		packet, err := readFromPacketConn(conn, buf)
+		sp := in.tracer.start("ingest.packet")
+		packet, addr, err := readFromPacketConn(conn, buf, &d, sp, in.t)
+		source := sourceOf(addr)
+		sp.setAttr("source", source)
+		logger := log.With(in.logger, "remote_addr", addr)
+		switch err.(type) {
+		case decompressError:
+			in.t.lineReceived(source)
+			in.reject(logger, sp, source, rejectDecompress, err)
+			continue
+		case decryptError:
+			in.t.lineReceived(source)
+			in.reject(logger, sp, source, rejectDecrypt, err)
+			continue
+		case lineTooLongError:
+			in.t.lineReceived(source)
+			in.reject(logger, sp, source, rejectTooLong, err)
+			continue
+		}
 		if err != nil {
+			sp.finish(err)
+			if in.isDraining() {
+				return nil
+			}
 			return err
 		}
-		name, err := handleLine(packet, o)
+		in.t.lineReceived(source)
+		if len(packet) > in.maxLineBytes { // after decompression
+			in.reject(logger, sp, source, rejectTooLong, lineTooLongError{in.maxLineBytes})
+			continue
+		}
+		header, packet, err := aggregator.SplitSequenceHeader(packet)
 		if err != nil {
-			level.Error(logger).Log("line", "rejected", "err", err)
+			in.reject(logger, sp, source, rejectParse, parseError{err})
 			continue
 		}
-		level.Debug(logger).Log("line", "accepted", "name", name)
+		if header != nil {
+			in.sequences.observe(source, header)
+			if len(packet) == 0 {
+				sp.finish(nil)
+				continue
+			}
+		}
+		if !in.limiter.allow(source, len(packet)) {
+			in.reject(logger, sp, source, rejectRateLimit, errRateLimited)
+			in.breach(source, limitRate, errRateLimited)
+			continue
+		}
+		in.handleLine(logger, source, identityOf(source, handshake{}), nil, packet, sp)
 	}
 }
 
-func forwardListener(ln net.Listener, o observer, strict bool, logger log.Logger) error {
+// forwardListener accepts connections from ln until it's closed. Connections
+// beyond the maximum are closed immediately.
+func (in *ingester) forwardListener(ln net.Listener) error {
+	var sem chan struct{}
+	if in.maxConns > 0 {
+		sem = make(chan struct{}, in.maxConns)
+	}
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			return err
 		}
-		go handleConn(conn, o, strict, log.With(logger, "remote_addr", conn.RemoteAddr()))
+		if !in.allowed.allows(conn.RemoteAddr()) {
+			in.t.denied.add(1, "tcp")
+			level.Debug(in.logger).Log("remote_addr", conn.RemoteAddr(), "conn", "rejected", "reason", "source not allowed")
+			conn.Close()
+			continue
+		}
+		in.t.tcpConnections.add(1)
+		if sem == nil {
+			go in.handleConn(conn)
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+			go func() {
+				defer func() { <-sem }()
+				in.handleConn(conn)
+			}()
+		default:
+			in.t.tcpConnectionsRejected.add(1)
+			level.Debug(in.logger).Log("remote_addr", conn.RemoteAddr(), "conn", "rejected", "reason", "too many connections")
+			conn.Close()
+		}
 	}
 }
 
-func handleConn(rc io.ReadCloser, o observer, strict bool, logger log.Logger) {
+// handleConn reads lines from rc until it's closed, or drained. Lines that
+// have already been read when the connection is drained are still processed.
+func (in *ingester) handleConn(rc io.ReadCloser) {
+	in.track(rc)
+	defer in.untrack(rc)
+	in.t.tcpConnectionsActive.add(1)
+	defer in.t.tcpConnectionsActive.add(-1)
 	defer rc.Close()
-	s := bufio.NewScanner(rc)
-	for s.Scan() {
-		data, err := decompressIfGzipped(s.Bytes())
-		if err != nil {
-			level.Error(logger).Log("line", "rejected", "err", err)
+	var (
+		r   io.Reader = rc
+		w   io.Writer // nil if replies can't be written
+		ack *acker
+		h   handshake
+	)
+	source, logger, strict := sourceLocal, in.logger, in.strict
+	declareFirst := false
+	if conn, ok := rc.(net.Conn); ok {
+		w = conn
+		strict = in.strictFor(conn.RemoteAddr())
+		declareFirst = in.declareFirst
+		if in.ack {
+			ack = newAcker(conn)
+		}
+		source = sourceOf(conn.RemoteAddr())
+		logger = log.With(logger, "remote_addr", conn.RemoteAddr())
+		if in.idleTimeout > 0 {
+			r = idleTimeoutReader{conn, in}
+		}
+	}
+	lr := newLineReader(countingReader{r, source, in.t}, in.maxLineBytes)
+	for first := true; ; first = false {
+		if lr.buffered() == 0 {
+			if err := ack.flush(); err != nil {
+				return
+			}
+		}
+		line, err := lr.next()
+		if err != nil && !isLineTooLong(err) {
+			if err, ok := err.(net.Error); ok && err.Timeout() && !in.isDraining() {
+				in.t.tcpConnectionsTimedOut.add(1)
+				level.Debug(logger).Log("conn", "closed", "reason", "idle timeout")
+			}
+			return
+		}
+		if first && err == nil && isHandshake(line) {
+			reply := ack
+			if reply == nil && w != nil {
+				reply = newAcker(w)
+			}
+			var herr error
+			if h, herr = parseHandshake(line); herr == nil {
+				herr = in.tenants.handshake(&h)
+			}
+			if herr != nil {
+				in.t.lineReceived(source)
+				in.reject(logger, nil, source, rejectHandshake, herr)
+				reply.reply("", herr)
+				reply.flush()
+				return
+			}
+			if h.Ack {
+				ack = reply
+			}
+			declareFirst = declareFirst || h.DeclareFirst
+			level.Debug(logger).Log("handshake", string(line[len(handshakePrefix):]))
+			if reply.reply("HELLO", nil) != nil || reply.flush() != nil {
+				return
+			}
+			continue
+		}
+		if err == nil && isDefaults(line) {
+			defaults, derr := parseDefaults(line)
+			if derr != nil {
+				derr = parseError{derr}
+				in.t.lineReceived(source)
+				in.reject(logger, nil, source, rejectParse, derr)
+				if ack.reply("", derr) != nil || strict {
+					ack.flush()
+					return
+				}
+				continue
+			}
+			h.defaults = defaults
+			level.Debug(logger).Log("defaults", string(line[len(defaultsPrefix):]))
+			if ack.reply("DEFAULTS", nil) != nil {
+				ack.flush()
+				return
+			}
 			continue
 		}
-		name, err := handleLine(data, o)
+		in.t.lineReceived(source)
+		sp := in.tracer.start("ingest.line")
+		sp.setAttr("source", source)
 		if err != nil {
-			level.Error(logger).Log("line", "rejected", "err", err)
-			if strict {
+			in.reject(logger, sp, source, rejectTooLong, err)
+			if ack.reply("", err) != nil || strict {
+				ack.flush()
 				return
 			}
 			continue
 		}
-		level.Debug(logger).Log("line", "accepted", "name", name)
+		if declareFirst && h.declared == nil {
+			h.declared = map[string]bool{}
+		}
+		name, keep, err := in.handleConnLine(logger, source, strict, h, line, sp)
+		if ack.reply(name, err) != nil || !keep {
+			ack.flush()
+			return
+		}
+	}
+}
+
+// handleLines handles the lines read from r, as if they were sent over a
+// connection with the handshake h, until it's exhausted, or, if strict, a line
+// is rejected. It returns the number of lines accepted and rejected, and the
+// first error, with its line number. Each error is also passed to rejected,
+// if it isn't nil.
+func (in *ingester) handleLines(logger log.Logger, source string, strict bool, h handshake, r io.Reader, rejected func(err error)) (accepted, rejections int, first error) {
+	lr := newLineReader(r, in.maxLineBytes)
+	for n := 1; ; n++ {
+		line, err := lr.next()
+		if err != nil && !isLineTooLong(err) {
+			return accepted, rejections, first
+		}
+		in.t.lineReceived(source)
+		sp := in.tracer.start("ingest.line")
+		sp.setAttr("source", source)
+		keep := !strict
+		if err != nil {
+			in.reject(logger, sp, source, rejectTooLong, err)
+		} else {
+			_, keep, err = in.handleConnLine(logger, source, strict, h, line, sp)
+		}
+		if err == nil {
+			accepted++
+			continue
+		}
+		rejections++
+		if first == nil {
+			first = fmt.Errorf("line %d: %v", n, err)
+		}
+		if rejected != nil {
+			rejected(err)
+		}
+		if !keep {
+			return accepted, rejections, first
+		}
 	}
 }
 
-func handleLine(line []byte, o observer) (string, error) {
-	obs, err := parseLine(line)
+// handleConnLine decompresses and handles a line read by handleConn, as
+// negotiated by the connection's handshake, h. It returns the metric name of
+// the line, if it was parsed, whether the connection should stay open, which
+// it shouldn't after bad data if it's strict, and the error the line was
+// rejected with, if any. The decompression buffer is released after each
+// line, so that idle connections don't hold onto one.
+func (in *ingester) handleConnLine(logger log.Logger, source string, strict bool, h handshake, line []byte, sp *span) (name string, keep bool, err error) {
+	var d aggregator.Decompressor
+	defer d.Release()
+	decompress := sp.child("decompress")
+	data, err := h.decompress(&d, line)
+	decompress.finish(err)
 	if err != nil {
-		return "", errors.Wrap(err, "parse error")
+		err = decompressError{err}
+		in.reject(logger, sp, source, rejectDecompress, err)
+		return "", true, err
+	}
+	in.t.decompressed(line, data)
+	if len(data) > in.maxLineBytes {
+		err = lineTooLongError{in.maxLineBytes}
+		in.reject(logger, sp, source, rejectTooLong, err)
+		return "", !strict, err
+	}
+	if err := h.checkFormat(data); err != nil {
+		err = parseError{err}
+		in.reject(logger, sp, source, rejectParse, err)
+		return "", !strict, err
 	}
-	if err := o.observe(obs); err != nil {
-		return obs.Name, errors.Wrap(err, "observation error")
+	if !in.limiter.allow(source, len(data)) {
+		in.reject(logger, sp, source, rejectRateLimit, errRateLimited)
+		in.breach(source, limitRate, errRateLimited)
+		return "", true, errRateLimited
 	}
-	return obs.Name, nil
+	name, err = in.handleLine(logger, source, identityOf(source, h), h.declared, data, sp)
+	if _, ok := err.(undeclaredError); ok {
+		return name, false, err
+	}
+	return name, err == nil || !strict, err
 }
 
-func parseLine(p []byte) (o observation, err error) {
-	if len(p) <= 0 {
-		err = errors.New("invalid (empty) line")
-	} else if p[0] == '{' {
-		err = json.Unmarshal(p, &o)
-	} else {
-		err = prometheusUnmarshal(p, &o)
+// handleLine parses, transforms, and observes a single line from source,
+// tracing each stage as a child of sp, which may be nil. Heartbeats are
+// recorded, rather than observed, and blank lines and comments are skipped.
+// A line with several values is split into an observation of each. The job
+// and instance labels are set from id, according to the ingester's identity
+// label policy, before transforms are applied. If declared isn't nil, the
+// names of metrics declared by the line's connection are added to it, and
+// observations of metrics that aren't in it are rejected with an
+// undeclaredError. Lines dropped by a transform aren't errors. If the
+// ingester has a queue, the line is observed asynchronously, and only parse
+// errors are returned. Otherwise, any error is returned. Either way,
+// rejections are recorded. The metric name is returned once the line is
+// parsed. The line's size, and the time spent on it, are recorded; a queued
+// line's time is recorded once it's observed.
+func (in *ingester) handleLine(logger log.Logger, source string, id identity, declared map[string]bool, line []byte, sp *span) (name string, err error) {
+	begin, queued := time.Now(), false
+	defer func() {
+		if !queued {
+			in.t.lineDuration.observe(time.Since(begin).Seconds())
+		}
+	}()
+	in.t.lineBytes.observe(float64(len(line)))
+	parse := sp.child("parse")
+	if sender, ok, err := aggregator.ParseHeartbeat(line); ok {
+		parse.finish(err)
+		if err != nil {
+			err = parseError{err}
+			in.reject(logger, sp, source, rejectParse, err)
+			return "", err
+		}
+		in.heartbeats.observe(source, sender)
+		in.t.lineAccepted()
+		sp.setAttr("heartbeat", sender)
+		sp.finish(nil)
+		return "", nil
+	}
+	if aggregator.IsComment(line) {
+		parse.finish(nil)
+		in.t.linesSkipped.add(1)
+		sp.setAttr("skipped", "true")
+		sp.finish(nil)
+		return "", nil
+	}
+	obs, err := aggregator.ParseLineAs(line, in.strings, in.format)
+	parse.finish(err)
+	if err != nil {
+		err = parseError{err}
+		in.reject(logger, sp, source, rejectParse, err)
+		return "", err
 	}
-	return o, err
+	if len(obs.Values) == 0 {
+		queued, err = in.handleObservation(logger, source, id, declared, obs, line, len(line), sp, begin)
+		return obs.Name, err
+	}
+
+	// Each value of a multi-value line is handled, counted, and recorded as
+	// if it were a line of its own, with a span of its own, and its share of
+	// the line's bytes. The name and error of the first value rejected, if
+	// any, are returned.
+	sp.setAttr("prefix", obs.Prefix)
+	values := obs.Split()
+	for i, o := range values {
+		var vline []byte
+		if in.record != nil {
+			vline, _ = json.Marshal(o)
+		}
+		size := len(line)*(i+1)/len(values) - len(line)*i/len(values)
+		q, verr := in.handleObservation(logger, source, id, declared, o, vline, size, sp.child("value"), begin)
+		queued = q
+		if name == "" || (verr != nil && err == nil) {
+			name = o.Name
+		}
+		if err == nil {
+			err = verr
+		}
+	}
+	sp.finish(err)
+	return name, err
 }
 
-func prometheusUnmarshal(p []byte, o *observation) error {
-	p = bytes.TrimSpace(p)
-	x := bytes.LastIndexByte(p, ' ')
-	if x < 1 {
-		return fmt.Errorf("bad format: couldn't find space")
+// handleObservation handles a parsed observation of a line, as in
+// handleLine, and reports whether it was queued. Its size is counted against
+// the quotas of its tenant, if any. Its outcome is recorded in sp, which is
+// finished, either here or once it's observed.
+func (in *ingester) handleObservation(logger log.Logger, source string, id identity, declared map[string]bool, obs aggregator.Observation, line []byte, size int, sp *span, begin time.Time) (queued bool, err error) {
+	sp.setAttr("name", obs.Name)
+	if declared != nil {
+		if obs.Type != "" {
+			declared[obs.Name] = true
+		} else if !declared[obs.Name] {
+			err = undeclaredError{obs.Name}
+			in.reject(logger, sp, source, rejectUndeclared, err)
+			return false, err
+		}
+	}
+	obs = applyIdentity(in.identity, obs, id)
+	in.shadow.observe(obs)
+	obs, ok := in.transforms.apply(obs)
+	if !ok {
+		in.t.linesDropped.add(1)
+		sp.setAttr("dropped", "true")
+		sp.finish(nil)
+		level.Debug(logger).Log("line", "dropped", "name", obs.Name)
+		return false, nil
+	}
+	if err := in.tenants.check(id, obs, size); err != nil {
+		if e, ok := err.(aggregator.LimitError); ok {
+			in.reject(logger, sp, source, rejectQuota, err)
+			in.breach(source, e.Limit, e)
+		} else {
+			in.reject(logger, sp, source, rejectUnauthorized, err)
+		}
+		return false, err
 	}
+	if obs.Type != "" {
+		in.audit.declaration(source, obs)
+	}
+	raw := in.record.capture(line)
+	if in.queue.push(queuedObservation{obs, source, logger, sp, sp.child("queue"), raw, time.Since(begin)}) {
+		return true, nil
+	}
+	if err := in.observe(logger, source, obs, sp); err != nil {
+		return false, err
+	}
+	in.record.record(raw)
+	return false, nil
+}
 
-	id, val := bytes.TrimSpace(p[:x]), bytes.TrimSpace(p[x+1:])
+// observe applies a parsed observation, and records the outcome.
+func (in *ingester) observe(logger log.Logger, source string, obs aggregator.Observation, sp *span) error {
+	observe := sp.child("observe")
+	return in.observed(logger, source, obs, sp, observe, in.o.Observe(obs))
+}
 
-	value, err := strconv.ParseFloat(string(val), 64)
+// observed records the result of observing obs, and finishes its spans.
+func (in *ingester) observed(logger log.Logger, source string, obs aggregator.Observation, sp, observe *span, err error) error {
+	observe.finish(err)
+	if e, ok := err.(aggregator.LimitError); ok {
+		in.breach(source, e.Limit, e)
+	}
 	if err != nil {
-		return errors.Wrapf(err, "bad value (%s)", string(val))
+		err = errors.Wrap(err, "observation error")
+		in.reject(logger, sp, source, rejectObserve, err)
+		return err
 	}
+	in.t.lineAccepted()
+	sp.finish(nil)
+	level.Debug(logger).Log("line", "accepted", "name", obs.Name)
+	return nil
+}
 
-	y := bytes.IndexByte(id, '{')
-	if y < 0 {
-		return fmt.Errorf("bad format: couldn't find opening brace")
-	}
-	if id[len(id)-1] != '}' {
-		return fmt.Errorf("bad format: couldn't find terminating brace")
+// breach records that a limit was breached, by a line from source, or by
+// the universe as a whole if source is empty.
+func (in *ingester) breach(source, limit string, err error) {
+	in.t.limitBreaches.add(1, limit)
+	in.webhook.breach(source, limit, err)
+}
+
+// reject records a rejected line, and finishes its span, which may be nil.
+func (in *ingester) reject(logger log.Logger, sp *span, source, reason string, err error) {
+	in.t.lineRejected(source, reason, err)
+	if !in.rejects.reject(logger, source, reason, err) {
+		level.Debug(logger).Log("line", "rejected", "reason", reason, "err", err)
 	}
+	sp.setAttr("reject_reason", reason)
+	sp.finish(err)
+}
+
+// countingPacketConn records received packets and bytes in telemetry.
+type countingPacketConn struct {
+	net.PacketConn
+	t *telemetry
+}
 
-	name, labels := id[:y], id[y+1:len(id)-1]
-	if bytes.ContainsRune(labels, ' ') {
-		return fmt.Errorf("bad format: labels section may not contain spaces")
+func (c countingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if n > 0 {
+		c.t.udpPackets.add(1)
+		c.t.bytesRead(sourceOf(addr), n)
 	}
+	return n, addr, err
+}
 
-	labelmap := map[string]string{}
-	for _, pair := range bytes.Split(labels, []byte(",")) {
-		z := bytes.IndexByte(pair, '=')
-		if z < 0 {
-			continue
+// lineReader reads newline-delimited lines of up to max bytes, excluding the
+// line ending. Unlike bufio.Scanner, a longer line doesn't end the stream:
+// it's discarded, and reported as a lineTooLongError. Like bufio.Scanner, a
+// trailing \r is removed, the last line needn't end with a newline, and lines
+// already read are still returned after a read error.
+type lineReader struct {
+	r   *bufio.Reader
+	max int
+	buf []byte
+}
+
+func newLineReader(r io.Reader, max int) *lineReader {
+	return &lineReader{r: bufio.NewReader(r), max: max}
+}
+
+// next returns the next line, which is only valid until the next call.
+func (lr *lineReader) next() ([]byte, error) {
+	lr.buf = lr.buf[:0]
+	tooLong := false
+	for {
+		chunk, err := lr.r.ReadSlice('\n')
+		if err == nil && len(lr.buf) == 0 && !tooLong {
+			return lr.trim(chunk) // fast path, no copy
+		}
+		if !tooLong && len(lr.buf)+len(chunk) > lr.max+2 { // +2 for \r\n
+			tooLong, lr.buf = true, lr.buf[:0]
+		}
+		if !tooLong {
+			lr.buf = append(lr.buf, chunk...)
 		}
-		k, v := pair[:z], pair[z+1:]
-		if v[0] != '"' || v[len(v)-1] != '"' {
-			return fmt.Errorf("bad format: label value must be wrapped in quotes")
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case tooLong:
+			return nil, lineTooLongError{lr.max}
+		case err != nil && len(lr.buf) > 0:
+			return lr.trim(lr.buf) // final line; the error is returned next time
+		case err != nil:
+			return nil, err
+		default:
+			return lr.trim(lr.buf)
 		}
-		v = v[1 : len(v)-1]
-		labelmap[string(k)] = string(v)
 	}
+}
 
-	o.Name = string(name)
-	o.Labels = labelmap
-	o.Value = new(float64)
-	(*o.Value) = value
+// buffered returns the number of bytes that can be read without blocking.
+func (lr *lineReader) buffered() int {
+	return lr.r.Buffered()
+}
 
-	return nil
+func (lr *lineReader) trim(line []byte) ([]byte, error) {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) > lr.max {
+		return nil, lineTooLongError{lr.max}
+	}
+	return line, nil
 }
 
-// unZipData decompresses gzipped data.
-func unZipData(data []byte) ([]byte, error) {
-	reader := bytes.NewReader(data)
-	gzreader, e1 := gzip.NewReader(reader)
-	if e1 != nil {
-		return nil, e1
+func isLineTooLong(err error) bool {
+	_, ok := err.(lineTooLongError)
+	return ok
+}
+
+// maxSizePacketConn returns a lineTooLongError for packets longer than max.
+// The read buffer must be at least one byte longer than max, to detect
+// truncated packets.
+type maxSizePacketConn struct {
+	net.PacketConn
+	max int
+}
+
+func (c maxSizePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil && n > c.max {
+		return 0, addr, lineTooLongError{c.max}
 	}
+	return n, addr, err
+}
 
-	output, e2 := io.ReadAll(gzreader)
-	if e2 != nil {
-		return nil, e2
+// decryptingPacketConn decrypts each packet in place. A packet that fills
+// the read buffer was truncated, so it can't be decrypted, but it's too long
+// anyway, so its length is returned without the overhead, for
+// maxSizePacketConn to reject.
+type decryptingPacketConn struct {
+	net.PacketConn
+	cipher *aggregator.PacketCipher
+}
+
+func (c decryptingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err != nil {
+		return n, addr, err
 	}
+	if n == len(p) {
+		return n - c.cipher.Overhead(), addr, nil
+	}
+	payload, err := c.cipher.Open(p[:n])
+	if err != nil {
+		return 0, addr, decryptError{err}
+	}
+	return copy(p, payload), addr, nil
+}
 
-	return output, nil
+// idleTimeoutReader fails a read that waits longer than the idle timeout for
+// data, by pushing the read deadline back before each read. It never pushes
+// the deadline past the drain deadline.
+type idleTimeoutReader struct {
+	conn net.Conn
+	in   *ingester
 }
 
-// decompressIfGzipped decompresses data if it is gzipped.
-func decompressIfGzipped(data []byte) ([]byte, error) {
-	if isGzipped(data) { // gzip
-		return unZipData(data)
+func (r idleTimeoutReader) Read(p []byte) (int, error) {
+	deadline := time.Now().Add(r.in.idleTimeout)
+	r.in.mtx.Lock()
+	if d := r.in.draining; !d.IsZero() && d.Before(deadline) {
+		deadline = d
 	}
+	r.conn.SetReadDeadline(deadline)
+	r.in.mtx.Unlock()
+	return r.conn.Read(p)
+}
 
-	return data, nil
+// countingReader records received bytes in telemetry.
+type countingReader struct {
+	r      io.Reader
+	source string
+	t      *telemetry
 }
 
-// isGzipped checks if the given byte slice represents a gzip-compressed stream.
-func isGzipped(packet []byte) bool {
-	return len(packet) >= 2 && packet[0] == 31 && packet[1] == 139
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.t.bytesRead(r.source, n)
+	}
+	return n, err
 }
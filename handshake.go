@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"github.com/pkg/errors"
+)
+
+// handshakePrefix starts the optional first line of a TCP connection, like
+// `HELLO {"compression":"gzip","format":"prometheus"}`, with which the client
+// says how the rest of its lines are encoded, rather than leaving the
+// aggregator to guess from the first bytes of each line.
+const handshakePrefix = "HELLO "
+
+// defaultsPrefix starts a line of a TCP connection, like
+// `DEFAULTS {"labels":{"service":"checkout"}}`, with which the client sets
+// labels for its later observations, rather than repeating them on each line.
+const defaultsPrefix = "DEFAULTS "
+
+// handshake is the JSON object of a handshake line. Every field is optional.
+type handshake struct {
+	Compression string `json:"compression"` // "none", "gzip", or "zstd"
+	Format      string `json:"format"`      // "json" or "prometheus"
+	Tenant      string `json:"tenant"`
+	Key         string `json:"key"` // an API key of the tenant
+	Ack         bool   `json:"ack"` // reply to each line, as with -tcp.ack
+
+	// DeclareFirst requires every metric to be declared on the connection
+	// before it's observed, as with -tcp.declare-first.
+	DeclareFirst bool `json:"declare_first"`
+
+	// Job and Instance identify the client, for -ingest.identity-labels.
+	Job      string `json:"job"`
+	Instance string `json:"instance"`
+
+	// labels are set on every observation, by an input rather than the
+	// client, e.g. from the topic of an MQTT message, or the tenant label.
+	labels map[string]string
+
+	// tenant is the tenant the client authenticated as with Key, if any.
+	tenant string
+
+	// declared are the metrics declared on the connection, if it must
+	// declare them first, or else nil.
+	declared map[string]bool
+
+	// defaults are the labels set by the client's latest defaults line,
+	// which fill in those missing from its observations.
+	defaults map[string]string
+}
+
+func isHandshake(line []byte) bool {
+	return bytes.HasPrefix(line, []byte(handshakePrefix))
+}
+
+func isDefaults(line []byte) bool {
+	return bytes.HasPrefix(line, []byte(defaultsPrefix))
+}
+
+// parseDefaults parses a defaults line, returning its labels. As with the
+// handshake, unknown fields are errors.
+func parseDefaults(line []byte) (map[string]string, error) {
+	var d struct {
+		Labels map[string]string `json:"labels"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(line[len(defaultsPrefix):]))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&d); err != nil {
+		return nil, errors.Wrap(err, "bad defaults")
+	}
+	for name := range d.Labels {
+		if name == "" {
+			return nil, errors.New("bad defaults: empty label name")
+		}
+	}
+	return d.Labels, nil
+}
+
+// parseHandshake parses a handshake line. Fields and values that the
+// aggregator doesn't support are errors, rather than being ignored, so that
+// a client never sends lines the aggregator can't read.
+func parseHandshake(line []byte) (h handshake, err error) {
+	dec := json.NewDecoder(bytes.NewReader(line[len(handshakePrefix):]))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&h); err != nil {
+		return h, errors.Wrap(err, "bad handshake")
+	}
+	switch h.Compression {
+	case "", "none", "gzip", "zstd":
+	default:
+		return h, fmt.Errorf("unsupported compression %q, must be none, gzip, or zstd", h.Compression)
+	}
+	switch h.Format {
+	case "", "json", "prometheus":
+	default:
+		return h, fmt.Errorf("unsupported format %q, must be json or prometheus", h.Format)
+	}
+	return h, nil
+}
+
+// decompress decompresses a line as negotiated by the handshake: always, with
+// gzip or zstd, never, or, without a handshake, if it looks gzipped.
+func (h handshake) decompress(d *aggregator.Decompressor, line []byte) ([]byte, error) {
+	switch h.Compression {
+	case "none":
+		return line, nil
+	case "gzip":
+		if !aggregator.IsGzipped(line) {
+			return nil, errors.New("line isn't gzipped, as negotiated")
+		}
+	case "zstd":
+		if !aggregator.IsZstd(line) {
+			return nil, errors.New("line isn't zstd-compressed, as negotiated")
+		}
+		return d.DecompressZstd(line)
+	}
+	return d.Decompress(line)
+}
+
+// checkFormat returns an error if a decompressed line isn't in the format
+// negotiated by the handshake, if any. Comments, including heartbeats, and
+// blank lines are allowed in either.
+func (h handshake) checkFormat(line []byte) error {
+	if aggregator.IsComment(line) {
+		return nil
+	}
+	switch isJSON := len(line) > 0 && aggregator.IsJSON(line); {
+	case h.Format == "json" && !isJSON:
+		return errors.New("line isn't JSON, as negotiated")
+	case h.Format == "prometheus" && isJSON:
+		return errors.New("line isn't in the Prometheus exposition format, as negotiated")
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/klauspost/compress/zstd"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestHandshake(t *testing.T) {
+	const declaration = `{"name":"foo_total","type":"counter","help":"Total foos."}`
+	for name, testcase := range map[string]struct {
+		ack          bool // -tcp.ack
+		declareFirst bool // -tcp.declare-first
+		lines        []string
+		want         []string
+		final        bool // no more replies are wanted
+	}{
+		"ack": {
+			lines: []string{`HELLO {"ack":true}`, declaration, `foo_total{} 1`},
+			want:  []string{"+OK HELLO", "+OK foo_total", "+OK foo_total"},
+		},
+		"not first": {
+			ack:   true,
+			lines: []string{declaration, `HELLO {}`},
+			want:  []string{"+OK foo_total", "-ERR parse error: "},
+		},
+		"json": {
+			lines: []string{`HELLO {"format":"json","ack":true}`, declaration, `foo_total{} 1`},
+			want:  []string{"+OK HELLO", "+OK foo_total", "-ERR parse error: line isn't JSON"},
+		},
+		"prometheus": {
+			lines: []string{`HELLO {"format":"prometheus","ack":true}`, declaration},
+			want:  []string{"+OK HELLO", "-ERR parse error: line isn't in the Prometheus exposition format"},
+		},
+		"gzip": {
+			lines: []string{`HELLO {"compression":"gzip","ack":true}`, declaration},
+			want:  []string{"+OK HELLO", "-ERR decompression error: line isn't gzipped"},
+		},
+		"none": {
+			lines: []string{`HELLO {"compression":"none","ack":true}`, "\x1f\x8b"},
+			want:  []string{"+OK HELLO", "-ERR parse error: "},
+		},
+		"declare first": {
+			lines: []string{`HELLO {"declare_first":true,"ack":true}`, declaration, `foo_total{} 1`, `bar_total{} 1`, `foo_total{} 1`},
+			want:  []string{"+OK HELLO", "+OK foo_total", "+OK foo_total", "-ERR bar_total wasn't declared first on this connection"},
+			final: true,
+		},
+		"declare first, values": {
+			lines: []string{`HELLO {"declare_first":true,"ack":true}`, declaration, `{"values":{"foo_total":1,"bar_total":1}}`},
+			want:  []string{"+OK HELLO", "+OK foo_total", "-ERR bar_total wasn't declared first on this connection"},
+			final: true,
+		},
+		"-tcp.declare-first": {
+			ack:          true,
+			declareFirst: true,
+			lines:        []string{`foo_total{} 1`, declaration},
+			want:         []string{"-ERR foo_total wasn't declared first on this connection"},
+			final:        true,
+		},
+		"without ack": {
+			lines: []string{`HELLO {}`, declaration},
+			want:  []string{"+OK HELLO"},
+			final: true,
+		},
+		"zstd": {
+			lines: []string{`HELLO {"compression":"zstd","ack":true}`, zstdCompress(t, declaration), declaration},
+			want:  []string{"+OK HELLO", "+OK foo_total", "-ERR decompression error: line isn't zstd-compressed"},
+		},
+		"brotli": {
+			lines: []string{`HELLO {"compression":"br"}`, declaration},
+			want:  []string{`-ERR unsupported compression "br"`},
+			final: true,
+		},
+		"proto": {
+			lines: []string{`HELLO {"format":"proto"}`, declaration},
+			want:  []string{`-ERR unsupported format "proto"`},
+			final: true,
+		},
+		"tenant": {
+			lines: []string{`HELLO {"tenant":"team-a"}`, declaration},
+			want:  []string{`-ERR tenants aren't supported without -ingest.tenant-label`},
+			final: true,
+		},
+		"unknown field": {
+			lines: []string{`HELLO {"encoding":"utf-8"}`, declaration},
+			want:  []string{`-ERR bad handshake: `},
+			final: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var (
+				dst, _ = aggregator.NewUniverse()
+				in     = newIngester(dst, newTelemetry(dst), log.NewNopLogger())
+				src, w = net.Pipe()
+			)
+			in.ack = testcase.ack
+			in.declareFirst = testcase.declareFirst
+			defer w.Close()
+			go in.handleConn(src)
+
+			go func() {
+				for _, line := range testcase.lines {
+					if _, err := fmt.Fprintln(w, line); err != nil {
+						return // closed after a bad handshake
+					}
+				}
+			}()
+
+			w.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			s := bufio.NewScanner(w)
+			for i, want := range testcase.want {
+				if !s.Scan() {
+					t.Fatalf("reply %d: want %q, have %v", i, want, s.Err())
+				}
+				if have := s.Text(); len(have) < len(want) || have[:len(want)] != want {
+					t.Errorf("reply %d: want prefix %q, have %q", i, want, have)
+				}
+			}
+			if testcase.final && s.Scan() {
+				t.Errorf("want no more replies, have %q", s.Text())
+			}
+		})
+	}
+}
+
+// zstdCompress compresses a line, which mustn't compress to a newline.
+func zstdCompress(t *testing.T, line string) string {
+	t.Helper()
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	compressed := string(enc.EncodeAll([]byte(line), nil))
+	if strings.Contains(compressed, "\n") {
+		t.Fatalf("%q compresses to a newline", line)
+	}
+	return compressed
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// readiness reports whether the aggregator is ready to receive traffic,
+// i.e. its listeners are bound and its initial declarations are loaded.
+type readiness struct {
+	ready int32 // atomic
+}
+
+func (r *readiness) set(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&r.ready, v)
+}
+
+func (r *readiness) isReady() bool {
+	return atomic.LoadInt32(&r.ready) == 1
+}
+
+// healthyHandler always succeeds, as long as the HTTP server is up.
+func healthyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "healthy")
+	})
+}
+
+func readyHandler(rd *readiness) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rd.isReady() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+}
+
+// quitHandler closes quit on the first PUT or POST request.
+func quitHandler(quit chan struct{}) http.Handler {
+	var once sync.Once
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" && r.Method != "POST" {
+			http.Error(w, "only PUT or POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		once.Do(func() { close(quit) })
+		fmt.Fprintln(w, "quitting")
+	})
+}
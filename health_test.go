@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyHandler(t *testing.T) {
+	var rd readiness
+	h := readyHandler(&rd)
+	get := func() int {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/-/ready", nil)
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if want, have := http.StatusServiceUnavailable, get(); want != have {
+		t.Fatalf("before ready: want %d, have %d", want, have)
+	}
+	rd.set(true)
+	if want, have := http.StatusOK, get(); want != have {
+		t.Fatalf("after ready: want %d, have %d", want, have)
+	}
+	rd.set(false)
+	if want, have := http.StatusServiceUnavailable, get(); want != have {
+		t.Fatalf("after unready: want %d, have %d", want, have)
+	}
+}
+
+func TestQuitHandler(t *testing.T) {
+	quit := make(chan struct{})
+	h := quitHandler(quit)
+
+	for _, method := range []string{"GET", "POST", "PUT"} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/-/quit", nil)
+		h.ServeHTTP(rec, req)
+	}
+
+	select {
+	case <-quit:
+	default:
+		t.Fatal("quit channel not closed")
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/-/version", nil)
+	versionHandler().ServeHTTP(rec, req)
+	var have buildInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &have); err != nil {
+		t.Fatal(err)
+	}
+	if want := currentBuildInfo(); want != have {
+		t.Fatalf("want %+v, have %+v", want, have)
+	}
+}
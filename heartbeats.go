@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// heartbeatTracker records when each sender last sent a heartbeat, so that a
+// sender that has stopped can be alerted on, even though the series it
+// observed are still exposed. Once max senders are being tracked, new
+// senders aren't.
+type heartbeatTracker struct {
+	max int
+	now func() time.Time
+
+	mtx     sync.Mutex
+	senders map[senderKey]time.Time
+}
+
+func newHeartbeatTracker(max int) *heartbeatTracker {
+	return &heartbeatTracker{max: max, now: time.Now, senders: map[senderKey]time.Time{}}
+}
+
+// observe records a heartbeat from the named sender, which may be empty, at
+// source.
+func (t *heartbeatTracker) observe(source, sender string) {
+	k := senderKey{source, sender}
+	now := t.now()
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, ok := t.senders[k]; !ok && len(t.senders) >= t.max {
+		return
+	}
+	t.senders[k] = now
+}
+
+func (t *heartbeatTracker) metrics() []selfMetric {
+	return []selfMetric{
+		newSelfGaugeFunc("aggregator_sender_last_seen_timestamp_seconds", "Time a heartbeat was last received, by source and sender.", []string{"source", "sender"}, func() []selfSample {
+			t.mtx.Lock()
+			defer t.mtx.Unlock()
+			samples := make([]selfSample, 0, len(t.senders))
+			for k, seen := range t.senders {
+				samples = append(samples, selfSample{labelValues: []string{k.source, k.sender}, value: float64(seen.UnixNano()) / 1e9})
+			}
+			return samples
+		}),
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestHeartbeatTracker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	h := newHeartbeatTracker(2)
+	h.now = func() time.Time { return now }
+	h.observe("10.0.0.1", "web-1")
+	h.observe("10.0.0.1", "")
+	now = now.Add(time.Minute)
+	h.observe("10.0.0.1", "web-1")
+	h.observe("10.0.0.2", "web-1") // too many senders
+	for k, want := range map[senderKey]time.Time{
+		{"10.0.0.1", "web-1"}: time.Unix(1060, 0),
+		{"10.0.0.1", ""}:      time.Unix(1000, 0),
+	} {
+		if have := h.senders[k]; !want.Equal(have) {
+			t.Errorf("%v: want %v, have %v", k, want, have)
+		}
+	}
+	if _, ok := h.senders[senderKey{"10.0.0.2", "web-1"}]; ok {
+		t.Errorf("want sender beyond the maximum untracked")
+	}
+}
+
+func TestHeartbeatLines(t *testing.T) {
+	var (
+		dst, _ = aggregator.NewUniverse()
+		tm     = newTelemetry(dst)
+		in     = newIngester(dst, tm, log.NewNopLogger())
+		src, w = net.Pipe()
+	)
+	in.heartbeats.now = func() time.Time { return time.Unix(1000, 0) }
+	tm.register(in.heartbeats.metrics()...)
+	done := make(chan struct{})
+	go func() { in.handleConn(src); close(done) }()
+	fmt.Fprintln(w, "#heartbeat web-1")
+	fmt.Fprintln(w, "#heartbeat")
+	fmt.Fprintln(w, "#heartbeat web-1 web-2")
+	w.Close()
+	<-done
+
+	if want, have := uint64(2), tm.linesAccepted.value(); want != have {
+		t.Errorf("accepted: want %d, have %d", want, have)
+	}
+	if want, have := uint64(1), tm.linesRejected.value(rejectParse); want != have {
+		t.Errorf("rejected: want %d, have %d", want, have)
+	}
+	output := scrape(t, exposition(dst, tm))
+	for _, want := range []string{
+		`aggregator_sender_last_seen_timestamp_seconds{sender="web-1",source="pipe"} 1000.000000`,
+		`aggregator_sender_last_seen_timestamp_seconds{sender="",source="pipe"} 1000.000000`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output missing %q\n%s", want, output)
+		}
+	}
+}
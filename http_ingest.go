@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ingestHandler serves POSTs of lines, in any of the formats accepted on the
+// socket, for producers that would rather speak HTTP than hold a connection
+// open. Each request body is handled like a connection without a handshake,
+// subject to the same allowed sources, strictness, and limits. It's answered
+// with 204 if every line was observed, and otherwise with 400, and the number
+// of lines accepted and rejected, and the first error; a strict client's lines
+// after the first rejection aren't read. The status is 429 if that line
+// exceeded a quota of its tenant, and 403 if it was for a tenant with API
+// keys, and the request had none of them in its X-API-Key header, which is
+// answered with 401 if it has a key that isn't valid.
+func ingestHandler(in *ingester) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		addr := requestAddr(r)
+		if !in.allowed.allows(addr) {
+			in.t.denied.add(1, "http")
+			respondError(w, http.StatusForbidden, "source not allowed")
+			return
+		}
+		h := handshake{Key: r.Header.Get(apiKeyHeader)}
+		if err := in.tenants.handshake(&h); err != nil {
+			respondError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		var (
+			source = sourceOf(addr)
+			logger = log.With(in.logger, "remote_addr", r.RemoteAddr)
+			body   = countingReader{r.Body, source, in.t}
+			status int // of the first rejection
+		)
+		accepted, rejected, first := in.handleLines(logger, source, in.strictFor(addr), h, body, func(err error) {
+			if status == 0 {
+				status = ingestStatus(err)
+			}
+		})
+		if first == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		respondJSON(w, status, struct {
+			Accepted int    `json:"accepted"`
+			Rejected int    `json:"rejected"`
+			Error    string `json:"error"`
+		}{accepted, rejected, first.Error()})
+	})
+}
+
+// requestAddr returns the address of the client of r, or nil if it isn't an
+// IP address and port.
+func requestAddr(r *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	n, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: ip, Port: n}
+}
+
+// withH2C serves HTTP/2 without TLS, i.e. h2c, as well as HTTP/1, from next,
+// so that clients, or load balancers, that speak it can multiplex many
+// requests over one connection. Connections may start with the HTTP/2
+// preface, or upgrade from HTTP/1.
+func withH2C(next http.Handler) http.Handler {
+	return h2c.NewHandler(next, &http2.Server{})
+}
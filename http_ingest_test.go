@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"golang.org/x/net/http2"
+)
+
+func TestIngestHandler(t *testing.T) {
+	for name, tc := range map[string]struct {
+		method       string
+		remote       string
+		strict       bool
+		body         string
+		wantCode     int
+		wantAccepted int
+		wantRejected int
+		wantErr      string
+		want         string
+	}{
+		"all accepted": {
+			body: `{"name":"foo","type":"counter","help":"Total foos."}
+				{"name":"foo","value":1}
+				foo{} 2`,
+			wantCode: http.StatusNoContent,
+			want: `
+				# HELP foo Total foos.
+				# TYPE foo counter
+				foo{} 3.000000
+			`,
+		},
+		"some rejected": {
+			body: `{"name":"foo","type":"counter","help":"Total foos."}
+				foo{} 1
+				foo{ 2
+				foo{} 3`,
+			wantCode:     http.StatusBadRequest,
+			wantAccepted: 3,
+			wantRejected: 1,
+			wantErr:      "line 3: ",
+			want: `
+				# HELP foo Total foos.
+				# TYPE foo counter
+				foo{} 4.000000
+			`,
+		},
+		"strict": {
+			strict: true,
+			body: `{"name":"foo","type":"counter","help":"Total foos."}
+				foo{ 2
+				foo{} 3`,
+			wantCode:     http.StatusBadRequest,
+			wantAccepted: 1,
+			wantRejected: 1,
+			wantErr:      "line 2: ",
+		},
+		"source not allowed": {
+			remote:   "192.0.2.1:1234",
+			body:     `{"name":"foo","type":"counter","help":"Total foos."}`,
+			wantCode: http.StatusForbidden,
+		},
+		"GET": {
+			method:   "GET",
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			u, _ := aggregator.NewUniverse()
+			in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+			in.strict = tc.strict
+			in.allowed.Set("10.0.0.0/8")
+
+			if tc.method == "" {
+				tc.method = "POST"
+			}
+			if tc.remote == "" {
+				tc.remote = "10.1.2.3:1234"
+			}
+			body := strings.ReplaceAll(tc.body, "\t", "")
+			req := httptest.NewRequest(tc.method, "/write", strings.NewReader(body))
+			req.RemoteAddr = tc.remote
+			rec := httptest.NewRecorder()
+			ingestHandler(in).ServeHTTP(rec, req)
+
+			if want, have := tc.wantCode, rec.Code; want != have {
+				t.Fatalf("code: want %d, have %d: %s", want, have, rec.Body.String())
+			}
+			if tc.wantCode == http.StatusBadRequest {
+				var response struct {
+					Accepted int    `json:"accepted"`
+					Rejected int    `json:"rejected"`
+					Error    string `json:"error"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+					t.Fatal(err)
+				}
+				if want, have := tc.wantAccepted, response.Accepted; want != have {
+					t.Errorf("accepted: want %d, have %d", want, have)
+				}
+				if want, have := tc.wantRejected, response.Rejected; want != have {
+					t.Errorf("rejected: want %d, have %d", want, have)
+				}
+				if !strings.HasPrefix(response.Error, tc.wantErr) {
+					t.Errorf("error: want prefix %q, have %q", tc.wantErr, response.Error)
+				}
+			}
+			if tc.want != "" {
+				if want, have := normalizeResponse(tc.want), normalizeResponse(scrape(t, u)); want != have {
+					t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestH2C(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+	s := httptest.NewServer(withH2C(ingestHandler(in)))
+	defer s.Close()
+
+	// Prior knowledge: the client speaks HTTP/2 from the start, without TLS.
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	for _, line := range []string{
+		`{"name":"foo","type":"counter","help":"Total foos."}`,
+		`foo{} 1`,
+		`foo{} 2`,
+	} {
+		resp, err := client.Post(s.URL, "text/plain", strings.NewReader(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want, have := http.StatusNoContent, resp.StatusCode; want != have {
+			t.Fatalf("%s: want %d, have %d", line, want, have)
+		}
+		if want, have := "HTTP/2.0", resp.Proto; want != have {
+			t.Fatalf("%s: want %s, have %s", line, want, have)
+		}
+	}
+	if want, have := normalizeResponse(`
+		# HELP foo Total foos.
+		# TYPE foo counter
+		foo{} 3.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	// HTTP/1 clients are unaffected.
+	resp, err := http.Post(s.URL, "text/plain", strings.NewReader(`foo{} 1`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want, have := "HTTP/1.1", resp.Proto; want != have {
+		t.Fatalf("want %s, have %s", want, have)
+	}
+}
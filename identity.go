@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+// Policies for the job and instance labels of observations, which are
+// otherwise lost when Prometheus scrapes the aggregator as a single target.
+const (
+	identityNone     = "none"     // labels are observed as sent
+	identityFill     = "fill"     // the sender's identity fills in missing labels
+	identityOverride = "override" // the sender's identity replaces sent labels
+)
+
+// identity is who sent a line: the job and instance given in the handshake
+// of its connection, if any, or else the source address as the instance, any
+// labels its input sets, any default labels set by the client, and the
+// tenant it authenticated as, if any.
+type identity struct {
+	job, instance string
+	labels        map[string]string
+	defaults      map[string]string
+	tenant        string
+}
+
+func identityOf(source string, h handshake) identity {
+	id := identity{job: h.Job, instance: h.Instance, labels: h.labels, defaults: h.defaults, tenant: h.tenant}
+	if id.instance == "" && source != sourceLocal {
+		id.instance = source
+	}
+	return id
+}
+
+func parseIdentityPolicy(s string) (string, error) {
+	switch s {
+	case identityNone, identityFill, identityOverride:
+		return s, nil
+	default:
+		return "", fmt.Errorf("invalid identity label policy %q, must be none, fill, or override", s)
+	}
+}
+
+// applyIdentity fills in the labels missing from obs with the defaults of id,
+// as if they'd been sent, then sets the job and instance labels from id,
+// according to the policy, and then the labels of id, whatever the policy, as
+// they're configured rather than sent. Declarations without a value are left
+// alone, as they have no series.
+func applyIdentity(policy string, obs aggregator.Observation, id identity) aggregator.Observation {
+	if obs.Value == nil || ((policy == identityNone || policy == "") && len(id.labels) == 0 && len(id.defaults) == 0) {
+		return obs
+	}
+	var labels map[string]string
+	set := func(name, value string) {
+		if labels == nil {
+			labels = make(map[string]string, len(obs.Labels)+2+len(id.labels)+len(id.defaults))
+			for k, v := range obs.Labels {
+				labels[k] = v
+			}
+		}
+		labels[name] = value
+	}
+	for name, value := range id.defaults {
+		if _, ok := obs.Labels[name]; !ok {
+			set(name, value)
+		}
+	}
+	if labels != nil {
+		obs.Labels = labels
+	}
+	if policy != identityNone && policy != "" {
+		for _, l := range []struct{ name, value string }{{"job", id.job}, {"instance", id.instance}} {
+			if l.value == "" {
+				continue
+			}
+			if _, ok := obs.Labels[l.name]; ok && policy == identityFill {
+				continue
+			}
+			set(l.name, l.value)
+		}
+	}
+	for name, value := range id.labels {
+		set(name, value)
+	}
+	if labels != nil {
+		obs.Labels = labels
+	}
+	return obs
+}
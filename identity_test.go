@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestApplyIdentity(t *testing.T) {
+	value := 1.0
+	id := identity{job: "checkout", instance: "10.1.2.3"}
+	for name, testcase := range map[string]struct {
+		policy string
+		obs    aggregator.Observation
+		id     identity
+		want   map[string]string
+	}{
+		"none": {
+			policy: identityNone,
+			obs:    aggregator.Observation{Labels: map[string]string{"code": "200"}, Value: &value},
+			id:     id,
+			want:   map[string]string{"code": "200"},
+		},
+		"fill": {
+			policy: identityFill,
+			obs:    aggregator.Observation{Labels: map[string]string{"code": "200"}, Value: &value},
+			id:     id,
+			want:   map[string]string{"code": "200", "job": "checkout", "instance": "10.1.2.3"},
+		},
+		"fill keeps sent labels": {
+			policy: identityFill,
+			obs:    aggregator.Observation{Labels: map[string]string{"job": "cart"}, Value: &value},
+			id:     id,
+			want:   map[string]string{"job": "cart", "instance": "10.1.2.3"},
+		},
+		"override replaces sent labels": {
+			policy: identityOverride,
+			obs:    aggregator.Observation{Labels: map[string]string{"job": "cart", "instance": "a"}, Value: &value},
+			id:     id,
+			want:   map[string]string{"job": "checkout", "instance": "10.1.2.3"},
+		},
+		"unknown job": {
+			policy: identityOverride,
+			obs:    aggregator.Observation{Labels: map[string]string{"job": "cart"}, Value: &value},
+			id:     identity{instance: "10.1.2.3"},
+			want:   map[string]string{"job": "cart", "instance": "10.1.2.3"},
+		},
+		"input labels whatever the policy": {
+			policy: identityNone,
+			obs:    aggregator.Observation{Labels: map[string]string{"code": "200", "device_id": "sent"}, Value: &value},
+			id:     identity{instance: "10.1.2.3", labels: map[string]string{"device_id": "thermostat-7"}},
+			want:   map[string]string{"code": "200", "device_id": "thermostat-7"},
+		},
+		"defaults fill in sent labels": {
+			policy: identityNone,
+			obs:    aggregator.Observation{Labels: map[string]string{"code": "200", "az": "sent"}, Value: &value},
+			id:     identity{defaults: map[string]string{"service": "checkout", "az": "eu-1a"}},
+			want:   map[string]string{"code": "200", "service": "checkout", "az": "sent"},
+		},
+		"defaults are as if sent": {
+			policy: identityFill,
+			obs:    aggregator.Observation{Value: &value},
+			id:     identity{job: "checkout", defaults: map[string]string{"job": "cart"}},
+			want:   map[string]string{"job": "cart"},
+		},
+		"declaration": {
+			policy: identityFill,
+			obs:    aggregator.Observation{Type: "counter"},
+			id:     id,
+			want:   nil,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var sent map[string]string
+			if testcase.obs.Labels != nil {
+				sent = map[string]string{}
+				for k, v := range testcase.obs.Labels {
+					sent[k] = v
+				}
+			}
+			obs := applyIdentity(testcase.policy, testcase.obs, testcase.id)
+			if want, have := testcase.want, obs.Labels; !reflect.DeepEqual(want, have) {
+				t.Errorf("want %v, have %v", want, have)
+			}
+			if want, have := sent, testcase.obs.Labels; !reflect.DeepEqual(want, have) {
+				t.Errorf("sent labels changed: want %v, have %v", want, have)
+			}
+		})
+	}
+}
+
+func TestIdentityOf(t *testing.T) {
+	if want, have := (identity{instance: "10.1.2.3"}), identityOf("10.1.2.3", handshake{}); !reflect.DeepEqual(want, have) {
+		t.Errorf("source: want %+v, have %+v", want, have)
+	}
+	if want, have := (identity{job: "checkout", instance: "pod-1"}), identityOf("10.1.2.3", handshake{Job: "checkout", Instance: "pod-1"}); !reflect.DeepEqual(want, have) {
+		t.Errorf("handshake: want %+v, have %+v", want, have)
+	}
+	if want, have := (identity{}), identityOf(sourceLocal, handshake{}); !reflect.DeepEqual(want, have) {
+		t.Errorf("local: want %+v, have %+v", want, have)
+	}
+}
+
+func TestIdentityLabels(t *testing.T) {
+	var (
+		dst, _ = aggregator.NewUniverse()
+		in     = newIngester(dst, newTelemetry(dst), log.NewNopLogger())
+		src, w = net.Pipe()
+	)
+	in.identity = identityFill
+	defer w.Close()
+	go in.handleConn(src)
+	go func() {
+		for _, line := range []string{
+			`HELLO {"job":"checkout","instance":"pod-1","ack":true}`,
+			`{"name":"foo_total","type":"counter","help":"Total foos."}`,
+			`foo_total{} 1`,
+		} {
+			fmt.Fprintln(w, line)
+		}
+	}()
+	w.SetReadDeadline(time.Now().Add(time.Second))
+	s := bufio.NewScanner(w)
+	for i := 0; i < 3; i++ {
+		if !s.Scan() {
+			t.Fatalf("reply %d: %v", i, s.Err())
+		}
+	}
+	if _, ok := dst.Lookup("foo_total", map[string]string{"job": "checkout", "instance": "pod-1"}); !ok {
+		t.Errorf("want foo_total with the handshake's job and instance, have none")
+	}
+}
+
+func TestDefaultLabels(t *testing.T) {
+	var (
+		dst, _ = aggregator.NewUniverse()
+		in     = newIngester(dst, newTelemetry(dst), log.NewNopLogger())
+		src, w = net.Pipe()
+	)
+	defer w.Close()
+	go in.handleConn(src)
+	go func() {
+		for _, line := range []string{
+			`HELLO {"ack":true}`,
+			`{"name":"foo_total","type":"counter","help":"Total foos."}`,
+			`DEFAULTS {"labels":{"service":"checkout","az":"eu-1a"}}`,
+			`foo_total{code="200"} 1`,
+			`foo_total{az="eu-1b"} 2`,
+			`DEFAULTS {}`,
+			`foo_total{} 3`,
+			`DEFAULTS {"lables":{}}`,
+		} {
+			fmt.Fprintln(w, line)
+		}
+	}()
+	w.SetReadDeadline(time.Now().Add(time.Second))
+	s := bufio.NewScanner(w)
+	for i, want := range []string{"+OK HELLO", "+OK foo_total", "+OK DEFAULTS", "+OK foo_total", "+OK foo_total", "+OK DEFAULTS", "+OK foo_total", "-ERR parse error: bad defaults: "} {
+		if !s.Scan() {
+			t.Fatalf("reply %d: %v", i, s.Err())
+		}
+		if have := s.Text(); len(have) < len(want) || have[:len(want)] != want {
+			t.Errorf("reply %d: want prefix %q, have %q", i, want, have)
+		}
+	}
+	for _, labels := range []map[string]string{
+		{"code": "200", "service": "checkout", "az": "eu-1a"},
+		{"service": "checkout", "az": "eu-1b"},
+		{},
+	} {
+		if _, ok := dst.Lookup("foo_total", labels); !ok {
+			t.Errorf("want foo_total%v, have none", labels)
+		}
+	}
+}
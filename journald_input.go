@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// journaldInput follows the systemd journal, for host daemons that emit
+// their metrics by logging, e.g. with sd_journal_send("METRICS=foo{} 1").
+// The value of the field of each entry with it is a payload of lines, as
+// decoded by decodePayload. The journal is followed by journalctl, rather
+// than by reading its files, whose format is only stable through libsystemd.
+// If journalctl exits, it's restarted after the last entry that was handled.
+type journaldInput struct {
+	field   string   // of the lines, e.g. METRICS
+	matches []string // for journalctl, e.g. SYSLOG_IDENTIFIER=myd
+	command []string // journalctl, and any leading arguments
+	in      *ingester
+	logger  log.Logger
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mtx    sync.Mutex
+	cursor string // of the last entry handled
+}
+
+// newJournaldInput returns an input for the field of entries matching every
+// match, as journalctl takes them: FIELD=value, or + between alternatives.
+func newJournaldInput(field string, matches []string, in *ingester, logger log.Logger) (*journaldInput, error) {
+	if field == "" || strings.ContainsAny(field, "= ") {
+		return nil, fmt.Errorf("bad journal field %q", field)
+	}
+	for _, m := range matches {
+		if m != "+" && strings.IndexByte(m, '=') < 1 {
+			return nil, fmt.Errorf("bad journal match %q: want FIELD=value, or +", m)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &journaldInput{
+		field:   field,
+		matches: matches,
+		command: []string{"journalctl"},
+		in:      in,
+		logger:  log.With(logger, "input", "journald", "field", field),
+		ctx:     ctx,
+		cancel:  cancel,
+	}, nil
+}
+
+// args returns the arguments of journalctl, following entries after the
+// cursor, if any, or else new entries.
+func (j *journaldInput) args(cursor string) []string {
+	args := []string{
+		"--follow",
+		"--output=json",
+		"--all", // or fields over 4 KiB are null
+		"--output-fields=" + j.field + ",SYSLOG_IDENTIFIER,_COMM",
+		"--no-pager",
+		"--quiet",
+	}
+	if cursor != "" {
+		args = append(args, "--after-cursor="+cursor)
+	} else {
+		args = append(args, "--lines=0")
+	}
+	return append(args, j.matches...)
+}
+
+// run follows the journal until the input is closed, or drained.
+func (j *journaldInput) run() error {
+	j.in.track(j)
+	defer j.in.untrack(j)
+	for {
+		err := j.follow()
+		if j.ctx.Err() != nil {
+			return nil
+		}
+		level.Warn(j.logger).Log("during", "follow", "err", err)
+		if !sleepContext(j.ctx, inputRetryInterval) {
+			return nil
+		}
+	}
+}
+
+// follow runs journalctl, and handles its entries until it exits.
+func (j *journaldInput) follow() error {
+	j.mtx.Lock()
+	cursor := j.cursor
+	j.mtx.Unlock()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(j.ctx, j.command[0], append(j.command[1:], j.args(cursor)...)...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	err = j.read(stdout)
+	if waitErr := cmd.Wait(); waitErr != nil && err == nil {
+		err = waitErr
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", waitErr, msg)
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("journalctl exited")
+	}
+	return err
+}
+
+// read handles the entries read from r, until it's exhausted.
+func (j *journaldInput) read(r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			j.handle(line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handle handles the lines of an entry, if it has the field.
+func (j *journaldInput) handle(entry []byte) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(entry, &fields); err != nil {
+		level.Warn(j.logger).Log("during", "decode", "err", errors.Wrap(err, "decoding entry"))
+		return
+	}
+	source := "journald"
+	for _, f := range []string{"SYSLOG_IDENTIFIER", "_COMM"} {
+		if values := journalValues(fields[f]); len(values) > 0 {
+			source = "journald/" + string(values[0])
+			break
+		}
+	}
+	for _, payload := range journalValues(fields[j.field]) {
+		j.in.handlePayload(j.logger, source, handshake{}, payload)
+	}
+	if cursor := journalValues(fields["__CURSOR"]); len(cursor) > 0 {
+		j.mtx.Lock()
+		j.cursor = string(cursor[0])
+		j.mtx.Unlock()
+	}
+}
+
+// journalValues returns the values of a field of an entry as journalctl
+// encodes them: a string, an array of bytes if it isn't UTF-8, an array of
+// either if the field is repeated, or null if it's too large.
+func journalValues(raw json.RawMessage) [][]byte {
+	var (
+		s      string
+		ints   []int
+		values []json.RawMessage
+	)
+	switch {
+	case len(raw) == 0 || string(raw) == "null":
+		return nil
+	case json.Unmarshal(raw, &s) == nil:
+		return [][]byte{[]byte(s)}
+	case json.Unmarshal(raw, &ints) == nil:
+		b := make([]byte, len(ints))
+		for i, v := range ints {
+			b[i] = byte(v)
+		}
+		return [][]byte{b}
+	case json.Unmarshal(raw, &values) == nil:
+		var all [][]byte
+		for _, v := range values {
+			all = append(all, journalValues(v)...)
+		}
+		return all
+	}
+	return nil
+}
+
+// Close stops following the journal. An entry being handled is still handled.
+func (j *journaldInput) Close() error {
+	j.cancel()
+	return nil
+}
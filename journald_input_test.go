@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+// TestJournalctlHelper isn't a test, but journalctl, as run by
+// TestJournaldInput, which writes entries and then follows nothing.
+func TestJournalctlHelper(t *testing.T) {
+	if os.Getenv("JOURNALCTL_HELPER") != "1" {
+		return
+	}
+	for _, entry := range []string{
+		`{"__CURSOR":"c1","SYSLOG_IDENTIFIER":"myd","METRICS":"{\"name\":\"foo\",\"type\":\"counter\",\"help\":\"Total foos.\"}\nfoo{} 1"}`,
+		`{"__CURSOR":"c2","_COMM":"myd","MESSAGE":"not metrics"}`,
+		`not JSON`,
+		`{"__CURSOR":"c3","_COMM":"myd","METRICS":["foo{} 2",[102,111,111,123,125,32,52]]}`,
+	} {
+		fmt.Println(entry)
+	}
+	time.Sleep(time.Minute)
+	os.Exit(0)
+}
+
+func TestJournaldInput(t *testing.T) {
+	os.Setenv("JOURNALCTL_HELPER", "1")
+	defer os.Unsetenv("JOURNALCTL_HELPER")
+
+	u, _ := aggregator.NewUniverse()
+	in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+	j, err := newJournaldInput("METRICS", []string{"SYSLOG_IDENTIFIER=myd"}, in, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.command = []string{os.Args[0], "-test.run=^TestJournalctlHelper$", "--"}
+	done := make(chan error)
+	go func() { done <- j.run() }()
+	waitFor(t, "cursor", func() bool {
+		j.mtx.Lock()
+		defer j.mtx.Unlock()
+		return j.cursor == "c3"
+	})
+	in.drain(time.Second) // closes the input
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := normalizeResponse(`
+		# HELP foo Total foos.
+		# TYPE foo counter
+		foo{} 7.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+	if want, have := uint64(4), in.t.linesAccepted.value(); want != have {
+		t.Errorf("lines accepted: want %d, have %d", want, have)
+	}
+}
+
+func TestJournaldInputArgs(t *testing.T) {
+	j, err := newJournaldInput("METRICS", []string{"SYSLOG_IDENTIFIER=myd", "+", "_SYSTEMD_UNIT=other.service"}, nil, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "--lines=0 SYSLOG_IDENTIFIER=myd + _SYSTEMD_UNIT=other.service", strings.Join(j.args("")[6:], " "); want != have {
+		t.Errorf("new: want %q, have %q", want, have)
+	}
+	if want, have := "--after-cursor=c1 SYSLOG_IDENTIFIER=myd + _SYSTEMD_UNIT=other.service", strings.Join(j.args("c1")[6:], " "); want != have {
+		t.Errorf("after cursor: want %q, have %q", want, have)
+	}
+	for _, tc := range []struct{ field, match string }{{"", ""}, {"METRICS=x", ""}, {"METRICS", "myd"}, {"METRICS", "=myd"}} {
+		if _, err := newJournaldInput(tc.field, []string{tc.match}, nil, log.NewNopLogger()); err == nil {
+			t.Errorf("field %q, match %q: want error, have none", tc.field, tc.match)
+		}
+	}
+}
+
+func TestJournalValues(t *testing.T) {
+	for name, tc := range map[string]struct {
+		raw  string
+		want []string
+	}{
+		"string":    {raw: `"foo{} 1"`, want: []string{"foo{} 1"}},
+		"bytes":     {raw: `[102,111,111]`, want: []string{"foo"}},
+		"repeated":  {raw: `["foo{} 1",[102,111,111]]`, want: []string{"foo{} 1", "foo"}},
+		"too large": {raw: `null`},
+		"missing":   {raw: ``},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var have []string
+			for _, v := range journalValues(json.RawMessage(tc.raw)) {
+				have = append(have, string(v))
+			}
+			if !reflect.DeepEqual(tc.want, have) {
+				t.Fatalf("want %q, have %q", tc.want, have)
+			}
+		})
+	}
+}
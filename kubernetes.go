@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// podEnv is the labels added to every observation in Kubernetes sidecar
+// mode, and the environment variables they're read from, which the pod spec
+// sets from its own metadata with the downward API.
+var podEnv = []struct{ label, env string }{
+	{"pod", "POD_NAME"},
+	{"namespace", "POD_NAMESPACE"},
+	{"node", "NODE_NAME"},
+}
+
+// podLabels returns the labels of the pod the aggregator is running in, from
+// the environment. Variables that aren't set are skipped, but at least one
+// must be, or the pod spec is probably missing them.
+func podLabels(getenv func(string) string) (map[string]string, error) {
+	labels := map[string]string{}
+	names := make([]string, len(podEnv))
+	for i, p := range podEnv {
+		if value := getenv(p.env); value != "" {
+			labels[p.label] = value
+		}
+		names[i] = p.env
+	}
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("none of %s are set; set them in the pod spec, with the downward API", strings.Join(names, ", "))
+	}
+	return labels, nil
+}
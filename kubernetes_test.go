@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestPodLabels(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		env  map[string]string
+		want map[string]string
+	}{
+		"all": {
+			env:  map[string]string{"POD_NAME": "web-7d4b9", "POD_NAMESPACE": "shop", "NODE_NAME": "node-3"},
+			want: map[string]string{"pod": "web-7d4b9", "namespace": "shop", "node": "node-3"},
+		},
+		"some": {
+			env:  map[string]string{"POD_NAME": "web-7d4b9", "POD_NAMESPACE": "shop"},
+			want: map[string]string{"pod": "web-7d4b9", "namespace": "shop"},
+		},
+		"none": {
+			env: map[string]string{"HOSTNAME": "web-7d4b9"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			labels, err := podLabels(func(name string) string { return testcase.env[name] })
+			if testcase.want == nil {
+				if err == nil {
+					t.Fatalf("want error, have %v", labels)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(testcase.want, labels); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestPodLabelsObserved(t *testing.T) {
+	transforms, err := compileTransforms([]transformRule{{Match: "foo_total", SetLabels: map[string]string{"pod": "spoofed", "env": "prod"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := aggregator.NewUniverse()
+	in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+	in.transforms = newTransformer(transforms)
+	in.transforms.labels = map[string]string{"pod": "web-7d4b9", "namespace": "shop"}
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`{"name":"foo_total","type":"counter","help":"Total foos."}`,
+		`foo_total{code="200"} 1`,
+		`foo_total{code="200",pod="spoofed"} 2`,
+	}, "\n"))))
+
+	if want, have := normalizeResponse(`
+		# HELP foo_total Total foos.
+		# TYPE foo_total counter
+		foo_total{code="200",env="prod",namespace="shop",pod="web-7d4b9"} 3.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// leaseElector elects one of several replicas of the aggregator the leader,
+// by holding a Kubernetes Lease, so that only the leader serves aggregated
+// series, and there are no duplicates downstream. It talks to the API server
+// directly, with the pod's service account, in the same way as client-go's
+// leader election: a replica holds the lease by renewing it, and any replica
+// may take it once it's gone unrenewed for the lease duration.
+type leaseElector struct {
+	leading int32 // atomic, 1 if this replica is the leader
+
+	base     string // URL of the lease collection
+	name     string
+	ns       string
+	identity string
+	duration time.Duration
+	client   *http.Client
+	token    func() (string, error)
+	now      func() time.Time
+	logger   log.Logger
+
+	renewed time.Time // when the lease was last held; only used by run
+}
+
+// defaultLeaseDuration is how long a lease is held without being renewed.
+// It's renewed every third of that.
+const defaultLeaseDuration = 15 * time.Second
+
+// serviceAccountDir is where Kubernetes mounts the pod's service account.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// newInClusterElector returns an elector for the named lease in the pod's
+// namespace, with the pod's name, or hostname, as its identity.
+func newInClusterElector(name string, duration time.Duration, logger log.Logger) (*leaseElector, error) {
+	if duration < time.Second {
+		return nil, errors.New("lease duration must be at least a second")
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in Kubernetes: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT aren't set")
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading service account")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, errors.New("service account CA certificate is invalid")
+	}
+	ns := os.Getenv("POD_NAMESPACE")
+	if ns == "" {
+		buf, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, errors.Wrap(err, "reading service account")
+		}
+		ns = strings.TrimSpace(string(buf))
+	}
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		if identity, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	token := func() (string, error) {
+		// Read every time, as the kubelet rotates it.
+		buf, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+		return strings.TrimSpace(string(buf)), err
+	}
+	return newLeaseElector("https://"+net.JoinHostPort(host, port), ns, name, identity, duration, client, token, logger), nil
+}
+
+func newLeaseElector(server, ns, name, identity string, duration time.Duration, client *http.Client, token func() (string, error), logger log.Logger) *leaseElector {
+	return &leaseElector{
+		base:     server + "/apis/coordination.k8s.io/v1/namespaces/" + ns + "/leases",
+		name:     name,
+		ns:       ns,
+		identity: identity,
+		duration: duration,
+		client:   client,
+		token:    token,
+		now:      time.Now,
+		logger:   log.With(logger, "lease", ns+"/"+name, "identity", identity),
+	}
+}
+
+// isLeader reports whether this replica is the leader. Without an elector,
+// every replica is.
+func (e *leaseElector) isLeader() bool {
+	return e == nil || atomic.LoadInt32(&e.leading) == 1
+}
+
+func (e *leaseElector) setLeader(leading bool) {
+	var v int32
+	if leading {
+		v = 1
+	}
+	if atomic.SwapInt32(&e.leading, v) != v {
+		level.Info(e.logger).Log("leader", leading)
+	}
+}
+
+// run tries to acquire or renew the lease every third of the lease
+// duration, until ctx is canceled, when it releases the lease, if it's held,
+// so that another replica can take over straight away.
+func (e *leaseElector) run(ctx context.Context) error {
+	ticker := time.NewTicker(e.duration / 3)
+	defer ticker.Stop()
+	for {
+		e.elect(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			e.release()
+			return ctx.Err()
+		}
+	}
+}
+
+// elect tries to acquire or renew the lease once. If it can't be renewed, the
+// leader steps down before another replica could take the lease over.
+func (e *leaseElector) elect(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, e.duration/3)
+	defer cancel()
+	now := e.now()
+	held, err := e.acquire(ctx, now)
+	switch {
+	case err != nil:
+		level.Warn(e.logger).Log("err", err)
+		if now.Sub(e.renewed) >= e.duration*2/3 {
+			e.setLeader(false)
+		}
+	case held:
+		e.renewed = now
+		e.setLeader(true)
+	default:
+		e.setLeader(false)
+	}
+}
+
+// acquire creates, takes over, or renews the lease, and returns whether it's
+// held.
+func (e *leaseElector) acquire(ctx context.Context, now time.Time) (bool, error) {
+	l, err := e.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	if l == nil {
+		l = &lease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		l.Metadata.Name, l.Metadata.Namespace = e.name, e.ns
+		l.Spec = e.spec(now, now, 0)
+		return e.write(ctx, http.MethodPost, e.base, l)
+	}
+	if h := l.Spec.HolderIdentity; h != e.identity && h != "" && !l.expired(now) {
+		return false, nil
+	}
+	acquired, transitions := now, l.Spec.LeaseTransitions+1
+	if l.Spec.HolderIdentity == e.identity {
+		acquired, transitions = parseLeaseTime(l.Spec.AcquireTime), l.Spec.LeaseTransitions
+	}
+	l.Spec = e.spec(acquired, now, transitions)
+	return e.write(ctx, http.MethodPut, e.base+"/"+e.name, l)
+}
+
+// release gives up the lease, if it's held.
+func (e *leaseElector) release() {
+	if !e.isLeader() {
+		return
+	}
+	e.setLeader(false)
+	ctx, cancel := context.WithTimeout(context.Background(), e.duration/3)
+	defer cancel()
+	l, err := e.get(ctx)
+	if err == nil && l != nil && l.Spec.HolderIdentity == e.identity {
+		l.Spec.HolderIdentity, l.Spec.LeaseDurationSeconds = "", 1
+		_, err = e.write(ctx, http.MethodPut, e.base+"/"+e.name, l)
+	}
+	if err != nil {
+		level.Warn(e.logger).Log("release", "failed", "err", err)
+	}
+}
+
+func (e *leaseElector) spec(acquired, renewed time.Time, transitions int) leaseSpec {
+	return leaseSpec{
+		HolderIdentity:       e.identity,
+		LeaseDurationSeconds: int(e.duration / time.Second),
+		AcquireTime:          formatLeaseTime(acquired),
+		RenewTime:            formatLeaseTime(renewed),
+		LeaseTransitions:     transitions,
+	}
+}
+
+// get returns the lease, or nil if it doesn't exist yet.
+func (e *leaseElector) get(ctx context.Context) (*lease, error) {
+	var l lease
+	code, err := e.do(ctx, http.MethodGet, e.base+"/"+e.name, nil, &l)
+	switch {
+	case err != nil:
+		return nil, err
+	case code == http.StatusNotFound:
+		return nil, nil
+	case code != http.StatusOK:
+		return nil, fmt.Errorf("getting lease: %s", http.StatusText(code))
+	}
+	return &l, nil
+}
+
+// write creates or updates the lease, and returns whether it was written. It
+// isn't if another replica wrote it first.
+func (e *leaseElector) write(ctx context.Context, method, url string, l *lease) (bool, error) {
+	code, err := e.do(ctx, method, url, l, nil)
+	switch {
+	case err != nil:
+		return false, err
+	case code == http.StatusConflict:
+		return false, nil
+	case code != http.StatusOK && code != http.StatusCreated:
+		return false, fmt.Errorf("writing lease: %s", http.StatusText(code))
+	}
+	return true, nil
+}
+
+// do makes a request to the API server, and decodes a successful response
+// into out, if it's not nil.
+func (e *leaseElector) do(ctx context.Context, method, url string, in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return 0, err
+	}
+	token, err := e.token()
+	if err != nil {
+		return 0, errors.Wrap(err, "reading service account token")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return 0, errors.Wrap(err, "decoding lease")
+		}
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+func (e *leaseElector) metrics() []selfMetric {
+	return []selfMetric{
+		newSelfGaugeFunc("aggregator_leader", "Whether this replica is the leader, and serves aggregated series.", nil, func() []selfSample {
+			var v float64
+			if e.isLeader() {
+				v = 1
+			}
+			return []selfSample{{value: v}}
+		}),
+	}
+}
+
+// lease is the part of a coordination.k8s.io/v1 Lease that the elector uses.
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"` // makes updates conditional
+	} `json:"metadata"`
+	Spec leaseSpec `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// expired reports whether the lease has gone unrenewed for its duration.
+func (l *lease) expired(now time.Time) bool {
+	renewed := parseLeaseTime(l.Spec.RenewTime)
+	return !now.Before(renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// leaseTimeFormat is the format of Kubernetes' MicroTime.
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+func formatLeaseTime(t time.Time) string {
+	return t.UTC().Format(leaseTimeFormat)
+}
+
+// parseLeaseTime returns the zero time if s is missing or invalid, so that
+// such a lease is expired.
+func parseLeaseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, s)
+	return t
+}
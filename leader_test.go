@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+// fakeLeases is just enough of the API server for one lease, with
+// conditional updates by resource version.
+type fakeLeases struct {
+	mtx     sync.Mutex
+	lease   *lease
+	version int
+}
+
+func (f *fakeLeases) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	const path = "/apis/coordination.k8s.io/v1/namespaces/ns/leases"
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == path+"/aggregator":
+		if f.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(f.lease)
+	case r.Method == http.MethodPost && r.URL.Path == path:
+		if f.lease != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.store(w, r, http.StatusCreated)
+	case r.Method == http.MethodPut && r.URL.Path == path+"/aggregator":
+		var l lease
+		json.NewDecoder(r.Body).Decode(&l)
+		if f.lease == nil || l.Metadata.ResourceVersion != f.lease.Metadata.ResourceVersion {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.lease = &l
+		f.version++
+		f.lease.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeLeases) store(w http.ResponseWriter, r *http.Request, code int) {
+	var l lease
+	json.NewDecoder(r.Body).Decode(&l)
+	f.lease = &l
+	f.version++
+	f.lease.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	w.WriteHeader(code)
+}
+
+func TestLeaseElector(t *testing.T) {
+	leases := &fakeLeases{}
+	server := httptest.NewServer(leases)
+	defer server.Close()
+
+	now := time.Unix(1000, 0)
+	elector := func(identity string) *leaseElector {
+		token := func() (string, error) { return "secret", nil }
+		e := newLeaseElector(server.URL, "ns", "aggregator", identity, 15*time.Second, server.Client(), token, log.NewNopLogger())
+		e.now = func() time.Time { return now }
+		return e
+	}
+	a, b := elector("a"), elector("b")
+	ctx := context.Background()
+
+	a.elect(ctx) // creates the lease
+	b.elect(ctx)
+	if !a.isLeader() || b.isLeader() {
+		t.Fatalf("want a leader, have a %v, b %v", a.isLeader(), b.isLeader())
+	}
+
+	now = now.Add(10 * time.Second)
+	a.elect(ctx) // renews
+	now = now.Add(10 * time.Second)
+	b.elect(ctx)
+	if !a.isLeader() || b.isLeader() {
+		t.Fatalf("after renewal: want a leader, have a %v, b %v", a.isLeader(), b.isLeader())
+	}
+
+	now = now.Add(15 * time.Second) // a has stopped renewing
+	b.elect(ctx)
+	if !b.isLeader() {
+		t.Fatalf("after expiry: want b leader")
+	}
+	a.elect(ctx)
+	if a.isLeader() {
+		t.Fatalf("after expiry: want a not leader")
+	}
+	if want, have := 1, leases.lease.Spec.LeaseTransitions; want != have {
+		t.Errorf("transitions: want %d, have %d", want, have)
+	}
+
+	b.release()
+	if b.isLeader() || leases.lease.Spec.HolderIdentity != "" {
+		t.Fatalf("after release: want no holder, have %q", leases.lease.Spec.HolderIdentity)
+	}
+	a.elect(ctx)
+	if !a.isLeader() {
+		t.Fatalf("after release: want a leader")
+	}
+}
+
+func TestLeaseElectorStepsDown(t *testing.T) {
+	up := true
+	leases := &fakeLeases{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		leases.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	now := time.Unix(1000, 0)
+	e := newLeaseElector(server.URL, "ns", "aggregator", "a", 15*time.Second, server.Client(), func() (string, error) { return "secret", nil }, log.NewNopLogger())
+	e.now = func() time.Time { return now }
+	e.elect(context.Background())
+	up = false
+	now = now.Add(5 * time.Second)
+	e.elect(context.Background())
+	if !e.isLeader() {
+		t.Fatalf("want still leader shortly after the API server fails")
+	}
+	now = now.Add(5 * time.Second)
+	e.elect(context.Background())
+	if e.isLeader() {
+		t.Fatalf("want stepped down before the lease expires")
+	}
+}
+
+func TestExpositionFollower(t *testing.T) {
+	u, _ := aggregator.NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total foos."}`,
+		`foo_total{} 1`,
+	})...)
+	tm := newTelemetry(u)
+	tm.leader = &leaseElector{}
+	tm.register(tm.leader.metrics()...)
+	output := scrape(t, exposition(u, tm))
+	if strings.Contains(output, "# TYPE foo_total") {
+		t.Errorf("want no aggregated series from a follower, have\n%s", output)
+	}
+	if !strings.Contains(output, "aggregator_leader{} 0.000000") {
+		t.Errorf("want aggregator_leader 0, have\n%s", output)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func newBaseLogger(w io.Writer, format string) (log.Logger, error) {
+	switch format {
+	case "logfmt":
+		return log.NewLogfmtLogger(w), nil
+	case "json":
+		return log.NewJSONLogger(w), nil
+	default:
+		return nil, fmt.Errorf("invalid log format '%s'", format)
+	}
+}
+
+// logLevels are the levels a levelSwitch can be set to, most verbose first.
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// levelSwitch is a level-filtering logger whose level can be changed at
+// runtime, indefinitely, or for a while. It's safe for concurrent use.
+type levelSwitch struct {
+	loggers []log.Logger // one per logLevels entry
+	current int32        // atomic, index into loggers
+
+	mtx      sync.Mutex
+	revert   *time.Timer // nil unless the level is set for a while
+	revertTo string
+	until    time.Time
+}
+
+func newLevelSwitch(next log.Logger, initial string) (*levelSwitch, error) {
+	s := &levelSwitch{
+		loggers: []log.Logger{
+			level.NewFilter(next, level.AllowDebug()),
+			level.NewFilter(next, level.AllowInfo()),
+			level.NewFilter(next, level.AllowWarn()),
+			level.NewFilter(next, level.AllowError()),
+		},
+	}
+	if err := s.set(initial); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *levelSwitch) Log(keyvals ...interface{}) error {
+	return s.loggers[atomic.LoadInt32(&s.current)].Log(keyvals...)
+}
+
+func (s *levelSwitch) level() string {
+	return logLevels[atomic.LoadInt32(&s.current)]
+}
+
+// set sets the level indefinitely, cancelling any pending revert.
+func (s *levelSwitch) set(lvl string) error {
+	i, err := levelIndex(lvl)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.cancelRevert()
+	atomic.StoreInt32(&s.current, int32(i))
+	return nil
+}
+
+// setFor sets the level for d, after which it reverts to the level it had
+// before, unless it's set again in the meantime. Setting it for a while
+// again, before it reverts, reverts to the same level, at the new time.
+func (s *levelSwitch) setFor(lvl string, d time.Duration) error {
+	i, err := levelIndex(lvl)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	revertTo := s.level()
+	if s.revert != nil {
+		revertTo = s.revertTo
+		s.cancelRevert()
+	}
+	atomic.StoreInt32(&s.current, int32(i))
+	var revert *time.Timer
+	revert = time.AfterFunc(d, func() {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		if s.revert != revert {
+			return // set again since
+		}
+		s.cancelRevert()
+		j, _ := levelIndex(revertTo)
+		atomic.StoreInt32(&s.current, int32(j))
+		level.Info(s.loggers[0]).Log("log_level", revertTo, "reverted_after", d)
+	})
+	s.revert, s.revertTo, s.until = revert, revertTo, time.Now().Add(d)
+	return nil
+}
+
+// reverting returns when the level will revert, and to which level, if it's
+// set for a while.
+func (s *levelSwitch) reverting() (to string, at time.Time, ok bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.revertTo, s.until, s.revert != nil
+}
+
+// cancelRevert cancels any pending revert. s.mtx must be held.
+func (s *levelSwitch) cancelRevert() {
+	if s.revert != nil {
+		s.revert.Stop()
+	}
+	s.revert, s.revertTo, s.until = nil, "", time.Time{}
+}
+
+func levelIndex(lvl string) (int, error) {
+	for i, candidate := range logLevels {
+		if candidate == lvl {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level '%s'", lvl)
+}
+
+// logLevelHandler reports the current log level on GET, and changes it on
+// PUT or POST with a level parameter, e.g. /api/v1/log-level?level=debug,
+// and a duration parameter, to revert it after a while, e.g. duration=30s.
+func logLevelHandler(s *levelSwitch) http.Handler {
+	type response struct {
+		Level    string     `json:"level"`
+		RevertTo string     `json:"revert_to,omitempty"`
+		Until    *time.Time `json:"until,omitempty"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "PUT", "POST":
+			var err error
+			if param := r.FormValue("duration"); param == "" {
+				err = s.set(r.FormValue("level"))
+			} else if d, parseErr := time.ParseDuration(param); parseErr != nil {
+				err = fmt.Errorf("invalid duration '%s'", param)
+			} else {
+				err = s.setFor(r.FormValue("level"), d)
+			}
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		default:
+			respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		resp := response{Level: s.level()}
+		if to, at, ok := s.reverting(); ok {
+			resp.RevertTo, resp.Until = to, &at
+		}
+		respondJSON(w, http.StatusOK, resp)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func TestLevelSwitch(t *testing.T) {
+	var buf bytes.Buffer
+	s, err := newLevelSwitch(log.NewLogfmtLogger(&buf), "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	level.Debug(s).Log("msg", "one")
+	level.Info(s).Log("msg", "two")
+	if err := s.set("debug"); err != nil {
+		t.Fatal(err)
+	}
+	level.Debug(s).Log("msg", "three")
+	if err := s.set("error"); err != nil {
+		t.Fatal(err)
+	}
+	level.Warn(s).Log("msg", "four")
+	level.Error(s).Log("msg", "five")
+
+	if want, have := "level=info msg=two\nlevel=debug msg=three\nlevel=error msg=five\n", buf.String(); want != have {
+		t.Fatalf("want\n%s\nhave\n%s", want, have)
+	}
+	if err := s.set("verbose"); err == nil {
+		t.Fatal("want error for invalid level, have none")
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	s, _ := newLevelSwitch(log.NewNopLogger(), "info")
+	h := logLevelHandler(s)
+
+	for _, testcase := range []struct {
+		method, query string
+		code          int
+		level         string
+	}{
+		{"GET", "", http.StatusOK, "info"},
+		{"PUT", "level=debug", http.StatusOK, "debug"},
+		{"POST", "level=loud", http.StatusBadRequest, "debug"},
+		{"DELETE", "", http.StatusMethodNotAllowed, "debug"},
+		{"PUT", "level=error&duration=1h", http.StatusOK, "error"},
+		{"PUT", "level=warn&duration=soon", http.StatusBadRequest, "error"},
+		{"PUT", "level=warn&duration=-1s", http.StatusBadRequest, "error"},
+	} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(testcase.method, "/api/v1/log-level?"+testcase.query, nil)
+		h.ServeHTTP(rec, req)
+		if want, have := testcase.code, rec.Code; want != have {
+			t.Errorf("%s %s: code: want %d, have %d", testcase.method, testcase.query, want, have)
+		}
+		if want, have := testcase.level, s.level(); want != have {
+			t.Errorf("%s %s: level: want %s, have %s", testcase.method, testcase.query, want, have)
+		}
+	}
+
+	if to, _, ok := s.reverting(); !ok || to != "debug" {
+		t.Errorf("want reverting to debug, have %q, %v", to, ok)
+	}
+
+	if _, err := newBaseLogger(&strings.Builder{}, "xml"); err == nil {
+		t.Errorf("want error for invalid log format, have none")
+	}
+}
+
+func TestLevelSwitchFor(t *testing.T) {
+	s, _ := newLevelSwitch(log.NewNopLogger(), "info")
+	if err := s.setFor("debug", 0); err == nil {
+		t.Fatal("want error for zero duration, have none")
+	}
+	if err := s.setFor("debug", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setFor("warn", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if to, _, ok := s.reverting(); !ok || to != "info" {
+		t.Fatalf("want reverting to info, have %q, %v", to, ok)
+	}
+	waitForLevel(t, s, "info")
+	if _, _, ok := s.reverting(); ok {
+		t.Error("want no pending revert once reverted, have one")
+	}
+
+	// Setting the level indefinitely cancels the revert.
+	if err := s.setFor("debug", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.set("error"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if want, have := "error", s.level(); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
+
+func waitForLevel(t *testing.T, s *levelSwitch, lvl string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for s.level() != lvl {
+		if time.Now().After(deadline) {
+			t.Fatalf("want level %s, have %s", lvl, s.level())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
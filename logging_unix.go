@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// debugToggleSignals toggle debug logging on and off.
+var debugToggleSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// debugToggleSignals toggle debug logging on and off. Windows has no
+// suitable signal, so use the admin endpoint instead.
+var debugToggleSignals []os.Signal
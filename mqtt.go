@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MQTT 3.1.1 control packet types, the high nibble of a packet's first byte.
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPubAck     = 4
+	mqttSubscribe  = 8
+	mqttSubAck     = 9
+	mqttPingReq    = 12
+	mqttPingResp   = 13
+	mqttDisconnect = 14
+)
+
+const (
+	mqttLevel          = 4       // protocol level of 3.1.1
+	mqttMaxPacket      = 4 << 20 // bytes, after the fixed header
+	mqttRetainFlag     = 0x01    // of a PUBLISH
+	mqttQoSFlags       = 0x06    // of a PUBLISH
+	mqttSubscribeFlags = 0x02    // required of a SUBSCRIBE
+	mqttSubFailure     = 0x80    // SUBACK return code
+)
+
+// mqttPacket is an MQTT control packet, with its fixed header decoded.
+type mqttPacket struct {
+	kind  byte // packet type
+	flags byte // low nibble of the first byte
+	body  []byte
+}
+
+// readMQTTPacket reads a packet, refusing any larger than mqttMaxPacket.
+func readMQTTPacket(r *bufio.Reader) (mqttPacket, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+	var n, shift int
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; i == 3 {
+			return mqttPacket{}, fmt.Errorf("malformed remaining length")
+		}
+	}
+	if n > mqttMaxPacket {
+		return mqttPacket{}, fmt.Errorf("packet of %d bytes exceeds %d", n, mqttMaxPacket)
+	}
+	p := mqttPacket{kind: first >> 4, flags: first & 0x0f, body: make([]byte, n)}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return mqttPacket{}, err
+	}
+	return p, nil
+}
+
+// bytes returns the packet encoded with its fixed header.
+func (p mqttPacket) bytes() []byte {
+	b := []byte{p.kind<<4 | p.flags}
+	n := len(p.body)
+	for {
+		c := byte(n & 0x7f)
+		if n >>= 7; n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, p.body...)
+}
+
+// appendMQTTString appends s with its 2-byte length, as MQTT encodes strings.
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// readMQTTString returns the string at the start of b, and the rest of b.
+func readMQTTString(b []byte) (string, []byte, error) {
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return "", nil, fmt.Errorf("malformed string")
+	}
+	n := 2 + int(binary.BigEndian.Uint16(b))
+	return string(b[2:n]), b[n:], nil
+}
+
+// mqttConnectPacket returns a CONNECT for a clean session. An empty client ID
+// has the broker assign one.
+func mqttConnectPacket(clientID, username, password string, keepAlive uint16) mqttPacket {
+	var flags byte = 0x02 // clean session
+	if username != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, mqttLevel, flags)
+	body = binary.BigEndian.AppendUint16(body, keepAlive)
+	body = appendMQTTString(body, clientID)
+	if username != "" {
+		body = appendMQTTString(body, username)
+	}
+	if password != "" {
+		body = appendMQTTString(body, password)
+	}
+	return mqttPacket{kind: mqttConnect, body: body}
+}
+
+// mqttConnAckError returns the error of a CONNACK's return code, if any.
+func mqttConnAckError(p mqttPacket) error {
+	if p.kind != mqttConnAck || len(p.body) != 2 {
+		return fmt.Errorf("expected CONNACK, got packet type %d", p.kind)
+	}
+	switch code := p.body[1]; code {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("connection refused: unacceptable protocol version")
+	case 2:
+		return fmt.Errorf("connection refused: client ID rejected")
+	case 3:
+		return fmt.Errorf("connection refused: server unavailable")
+	case 4:
+		return fmt.Errorf("connection refused: bad user name or password")
+	case 5:
+		return fmt.Errorf("connection refused: not authorized")
+	default:
+		return fmt.Errorf("connection refused: return code %d", code)
+	}
+}
+
+// mqttSubscribePacket returns a SUBSCRIBE to every filter, at the QoS.
+func mqttSubscribePacket(id uint16, filters []string, qos byte) mqttPacket {
+	body := binary.BigEndian.AppendUint16(nil, id)
+	for _, f := range filters {
+		body = appendMQTTString(body, f)
+		body = append(body, qos)
+	}
+	return mqttPacket{kind: mqttSubscribe, flags: mqttSubscribeFlags, body: body}
+}
+
+// mqttMessage is a received PUBLISH.
+type mqttMessage struct {
+	topic    string
+	qos      byte
+	retained bool
+	id       uint16 // if qos > 0
+	payload  []byte
+}
+
+func parseMQTTPublish(p mqttPacket) (mqttMessage, error) {
+	m := mqttMessage{qos: (p.flags & mqttQoSFlags) >> 1, retained: p.flags&mqttRetainFlag != 0}
+	topic, rest, err := readMQTTString(p.body)
+	if err != nil {
+		return m, fmt.Errorf("PUBLISH: %v", err)
+	}
+	m.topic = topic
+	if m.qos > 0 {
+		if len(rest) < 2 {
+			return m, fmt.Errorf("PUBLISH: missing packet ID")
+		}
+		m.id, rest = binary.BigEndian.Uint16(rest), rest[2:]
+	}
+	m.payload = rest
+	return m, nil
+}
+
+func mqttPubAckPacket(id uint16) mqttPacket {
+	return mqttPacket{kind: mqttPubAck, body: binary.BigEndian.AppendUint16(nil, id)}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"github.com/pkg/errors"
+)
+
+// payloadResult is how the lines of a payload were handled.
+type payloadResult struct {
+	accepted int
+	rejected int
+	limited  int   // lines rejected by limits, which may be accepted later
+	bad      error // the first line that couldn't be decoded or parsed, if any
+}
+
+// handlePayload handles the lines of a message received from a queue or
+// stream, rather than a socket, as decoded by decodePayload, as if they were
+// sent with the handshake h. Like a UDP packet, a payload that can't be
+// decoded is rejected as a single line.
+func (in *ingester) handlePayload(logger log.Logger, source string, h handshake, payload []byte) payloadResult {
+	in.t.bytesRead(source, len(payload))
+	var d aggregator.Decompressor
+	defer d.Release()
+	data, err := decodePayload(&d, payload)
+	if err != nil {
+		reason := rejectParse
+		if _, ok := err.(decompressError); ok {
+			reason = rejectDecompress
+		}
+		in.t.lineReceived(source)
+		in.reject(logger, nil, source, reason, err)
+		return payloadResult{rejected: 1, bad: err}
+	}
+	in.t.decompressed(payload, data)
+	var r payloadResult
+	r.accepted, r.rejected, _ = in.handleLines(logger, source, false, h, bytes.NewReader(data), func(err error) {
+		switch {
+		case isLimitError(err):
+			r.limited++
+		case r.bad == nil && isParseError(err):
+			r.bad = err
+		}
+	})
+	return r
+}
+
+// isLimitError returns true if a line was rejected by a limit, rather than
+// for its contents.
+func isLimitError(err error) bool {
+	return err == errRateLimited || aggregator.RejectReason(err) == aggregator.ReasonLimitExceeded
+}
+
+// isParseError returns true if a line was rejected because it couldn't be
+// decompressed or parsed, so that it never will be.
+func isParseError(err error) bool {
+	switch err.(type) {
+	case decompressError, lineTooLongError, parseError:
+		return true
+	}
+	return false
+}
+
+// gzipBase64Prefix is how gzipped data starts once it's base64-encoded.
+const gzipBase64Prefix = "H4sI"
+
+// decodePayload returns the lines of a message received from a queue or
+// stream. Its body is lines in any of the formats accepted on the socket, or
+// a JSON array of observations, a line each. The body may be gzipped, and, as
+// queues like SQS only carry text, base64-encoded once it's gzipped. The
+// result is only valid until d is next used.
+func decodePayload(d *aggregator.Decompressor, payload []byte) ([]byte, error) {
+	if bytes.HasPrefix(payload, []byte(gzipBase64Prefix)) {
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(payload)))
+		n, err := base64.StdEncoding.Decode(decoded, bytes.TrimSpace(payload))
+		if err != nil {
+			return nil, decompressError{errors.Wrap(err, "decoding base64")}
+		}
+		payload = decoded[:n]
+	}
+	data, err := d.Decompress(payload)
+	if err != nil {
+		return nil, decompressError{err}
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(trimmed, &batch); err != nil {
+			return nil, parseError{err}
+		}
+		var buf bytes.Buffer
+		for _, o := range batch {
+			if err := json.Compact(&buf, o); err != nil {
+				return nil, parseError{err}
+			}
+			buf.WriteByte('\n')
+		}
+		data = buf.Bytes()
+	}
+	return data, nil
+}
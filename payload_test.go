@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodePayload(t *testing.T) {
+	lines := "foo{} 1\nbar{} 2\n"
+	for name, tc := range map[string]struct {
+		payload []byte
+		want    string
+		wantErr string
+	}{
+		"lines": {
+			payload: []byte(lines),
+			want:    lines,
+		},
+		"gzipped": {
+			payload: gzipped(t, lines),
+			want:    lines,
+		},
+		"gzipped base64": {
+			payload: []byte(base64.StdEncoding.EncodeToString(gzipped(t, lines))),
+			want:    lines,
+		},
+		"JSON array": {
+			payload: []byte("[\n  {\"name\": \"foo\", \"value\": 1},\n  {\"name\": \"bar\", \"value\": 2}\n]"),
+			want:    "{\"name\":\"foo\",\"value\":1}\n{\"name\":\"bar\",\"value\":2}\n",
+		},
+		"gzipped JSON array": {
+			payload: gzipped(t, `[{"name":"foo","value":1}]`),
+			want:    "{\"name\":\"foo\",\"value\":1}\n",
+		},
+		"bad base64": {
+			payload: []byte(gzipBase64Prefix + "!!!"),
+			wantErr: "decompression error",
+		},
+		"bad gzip": {
+			payload: []byte{31, 139, 0},
+			wantErr: "decompression error",
+		},
+		"bad JSON array": {
+			payload: []byte(`[{"name":"foo"`),
+			wantErr: "parse error",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var d aggregator.Decompressor
+			defer d.Release()
+			have, err := decodePayload(&d, tc.payload)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("want error containing %q, have %v", tc.wantErr, err)
+			}
+			if want := tc.want; want != string(have) {
+				t.Fatalf("want %q, have %q", want, have)
+			}
+		})
+	}
+}
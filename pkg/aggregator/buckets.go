@@ -0,0 +1,39 @@
+package aggregator
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// parseBuckets returns the declared upper bounds of a histogram's buckets,
+// which must be finite, and in increasing order, without duplicates. The +Inf
+// bucket is always rendered, so it may be declared, as the last bucket, but
+// it's left out.
+func parseBuckets(buckets []float64) ([]float64, error) {
+	if n := len(buckets); n > 0 && math.IsInf(buckets[n-1], 1) {
+		buckets = buckets[:n-1]
+	}
+	for i, max := range buckets {
+		if math.IsNaN(max) || math.IsInf(max, 0) {
+			return nil, fmt.Errorf("bucket %d is %v, but buckets must be finite, apart from a last +Inf", i, max)
+		}
+		if i > 0 && max <= buckets[i-1] {
+			return nil, fmt.Errorf("bucket %d is %v, but buckets must be in increasing order, without duplicates", i, max)
+		}
+	}
+	return buckets, nil
+}
+
+// formatLE formats the upper bound of a bucket as its le label value, as
+// client_golang does, so that the same bucket has the same series whichever
+// is scraped.
+func formatLE(max float64) string {
+	switch {
+	case max == 0:
+		return "0" // including -0
+	case math.IsInf(max, 1):
+		return "+Inf"
+	}
+	return strconv.FormatFloat(max, 'g', -1, 64)
+}
@@ -0,0 +1,109 @@
+package aggregator
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseBuckets(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		buckets []float64
+		want    []float64
+		err     bool
+	}{
+		"none":        {nil, nil, false},
+		"increasing":  {[]float64{-1, 0, 0.5, 1}, []float64{-1, 0, 0.5, 1}, false},
+		"last +Inf":   {[]float64{1, 2, math.Inf(1)}, []float64{1, 2}, false},
+		"only +Inf":   {[]float64{math.Inf(1)}, []float64{}, false},
+		"unsorted":    {[]float64{1, 0.5}, nil, true},
+		"duplicate":   {[]float64{1, 1}, nil, true},
+		"NaN":         {[]float64{1, math.NaN()}, nil, true},
+		"-Inf":        {[]float64{math.Inf(-1), 1}, nil, true},
+		"inner +Inf":  {[]float64{1, math.Inf(1), math.Inf(1)}, nil, true},
+		"zero and -0": {[]float64{math.Copysign(0, -1), 0}, nil, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			buckets, err := parseBuckets(testcase.buckets)
+			if testcase.err {
+				if err == nil {
+					t.Fatalf("want error, have %v", buckets)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(testcase.want) == 0 && len(buckets) == 0 {
+				return
+			}
+			if want, have := testcase.want, buckets; !reflect.DeepEqual(want, have) {
+				t.Errorf("want %v, have %v", want, have)
+			}
+		})
+	}
+}
+
+func TestFormatLE(t *testing.T) {
+	for max, want := range map[float64]string{
+		0:                    "0",
+		math.Copysign(0, -1): "0",
+		1:                    "1",
+		-1:                   "-1",
+		0.1:                  "0.1",
+		2.50:                 "2.5",
+		1e6:                  "1e+06",
+		1e-7:                 "1e-07",
+		math.Inf(1):          "+Inf",
+	} {
+		if have := formatLE(max); want != have {
+			t.Errorf("%v: want %q, have %q", max, want, have)
+		}
+	}
+}
+
+func TestInvalidBuckets(t *testing.T) {
+	u, _ := NewUniverse()
+	for _, line := range []string{
+		`{"name":"foo_seconds","type":"histogram","help":"Foo duration in seconds.","buckets":[1, 0.5]}`,
+		`{"name":"foo_seconds","type":"histogram","help":"Foo duration in seconds.","buckets":[0.5, 0.5, 1]}`,
+	} {
+		o, err := ParseLine([]byte(line), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := u.Observe(o); err == nil {
+			t.Errorf("%s: want error, have none", line)
+		}
+	}
+	if _, ok := u.Lookup("foo_seconds", nil); ok {
+		t.Error("want no foo_seconds, have it")
+	}
+}
+
+func TestSnapshotLE(t *testing.T) {
+	u, _ := NewUniverse()
+	for _, line := range []string{
+		`{"name":"foo_delta","type":"histogram","help":"Foo delta.","buckets":[-0, 1]}`,
+		`foo_delta{} 0.5`,
+	} {
+		o, err := ParseLine([]byte(line), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := u.Observe(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, ok := u.Lookup("foo_delta", nil)
+	if !ok {
+		t.Fatal("want foo_delta, have none")
+	}
+	var les []string
+	for _, b := range s.Buckets {
+		les = append(les, b.LE)
+	}
+	if want, have := []string{"0", "1", "+Inf"}, les; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
@@ -0,0 +1,83 @@
+package aggregator
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PacketCipher encrypts and authenticates datagrams with AES-GCM, under a
+// key shared by the senders and the aggregator. An encrypted datagram is a
+// random nonce, followed by the sealed payload, which is compressed first, if
+// it's compressed at all. It's safe for concurrent use.
+type PacketCipher struct {
+	aead cipher.AEAD
+}
+
+// NewPacketCipher returns a cipher with the key, which must be 16, 24, or 32
+// bytes, for AES-128, AES-192, or AES-256.
+func NewPacketCipher(key []byte) (*PacketCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &PacketCipher{aead: aead}, nil
+}
+
+// ParsePacketKey decodes a hex-encoded key, like the output of
+// `openssl rand -hex 32`.
+func ParsePacketKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.Wrap(err, "key must be hex-encoded")
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("key must be 16, 24, or 32 bytes, not %d", len(key))
+	}
+}
+
+// Overhead is how much longer an encrypted datagram is than its payload. A
+// nil cipher has none.
+func (c *PacketCipher) Overhead() int {
+	if c == nil {
+		return 0
+	}
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+// Seal appends the encrypted datagram of p to dst, and returns the result.
+func (c *PacketCipher) Seal(dst, p []byte) []byte {
+	n := len(dst)
+	dst = append(dst, make([]byte, c.aead.NonceSize())...)
+	nonce := dst[n:]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // the system's source of randomness is broken
+	}
+	return c.aead.Seal(dst, nonce, p, nil)
+}
+
+// Open decrypts the datagram p in place, and returns its payload. It fails
+// if p wasn't encrypted with the same key, or was modified since.
+func (c *PacketCipher) Open(p []byte) ([]byte, error) {
+	if len(p) < c.Overhead() {
+		return nil, fmt.Errorf("encrypted datagram is too short")
+	}
+	nonce, sealed := p[:c.aead.NonceSize()], p[c.aead.NonceSize():]
+	payload, err := c.aead.Open(sealed[:0], nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("datagram can't be decrypted with the key")
+	}
+	return payload, nil
+}
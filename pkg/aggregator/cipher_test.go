@@ -0,0 +1,59 @@
+package aggregator
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketCipher(t *testing.T) {
+	key, err := ParsePacketKey("000102030405060708090a0b0c0d0e0f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewPacketCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`foo_total{} 1`)
+	sealed := c.Seal(nil, payload)
+	if want, have := len(payload)+c.Overhead(), len(sealed); want != have {
+		t.Fatalf("sealed length: want %d, have %d", want, have)
+	}
+	if bytes.Contains(sealed, payload) {
+		t.Fatalf("sealed datagram contains the payload")
+	}
+	if bytes.Equal(sealed, c.Seal(nil, payload)) {
+		t.Fatalf("sealing twice gave the same datagram, so the nonce was reused")
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	other, _ := NewPacketCipher(bytes.Repeat([]byte{1}, 16))
+	for name, testcase := range map[string]struct {
+		c       *PacketCipher
+		p       []byte
+		wantErr bool
+	}{
+		"valid":     {c, append([]byte(nil), sealed...), false},
+		"tampered":  {c, tampered, true},
+		"other key": {other, append([]byte(nil), sealed...), true},
+		"too short": {c, sealed[:c.Overhead()-1], true},
+		"plaintext": {c, payload, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			have, err := testcase.c.Open(testcase.p)
+			if (err != nil) != testcase.wantErr {
+				t.Fatalf("want error %v, have %v", testcase.wantErr, err)
+			}
+			if err == nil && !bytes.Equal(payload, have) {
+				t.Fatalf("want %q, have %q", payload, have)
+			}
+		})
+	}
+
+	for _, s := range []string{"", "xyz", "0001", "000102030405060708090a0b0c0d0e0f00"} {
+		if _, err := ParsePacketKey(s); err == nil {
+			t.Errorf("ParsePacketKey(%q): want error, have none", s)
+		}
+	}
+}
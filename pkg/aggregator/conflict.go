@@ -0,0 +1,190 @@
+package aggregator
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// TypeConflictPolicy decides what happens to an observation whose type, or
+// other declared parameters, conflict with those of an existing metric.
+type TypeConflictPolicy string
+
+const (
+	// ConflictIgnore observes the value with the existing metric's type, as
+	// if it hadn't been declared again.
+	ConflictIgnore TypeConflictPolicy = "ignore"
+
+	// ConflictReject rejects the observation.
+	ConflictReject TypeConflictPolicy = "reject"
+
+	// ConflictRename observes the value in a metric named with
+	// ConflictSuffix, declared as the observation declares it.
+	ConflictRename TypeConflictPolicy = "rename"
+
+	// ConflictCoerce turns an existing counter into a gauge, keeping the
+	// values of its series, when a gauge is declared with its name. Other
+	// conflicts are rejected.
+	ConflictCoerce TypeConflictPolicy = "coerce"
+
+	// ConflictReplace ignores conflicts, like ConflictIgnore, until a metric
+	// has had a number of them since it was last declared without one, when
+	// it's replaced by the new declaration, and its series are removed.
+	ConflictReplace TypeConflictPolicy = "replace"
+)
+
+// ConflictSuffix is added to the name of a metric, for the observations
+// that conflict with it, with ConflictRename.
+const ConflictSuffix = "_conflict"
+
+// Resolutions of a type conflict, as counted by TypeConflicts.
+const (
+	ConflictIgnored  = "ignored"
+	ConflictRejected = "rejected"
+	ConflictRenamed  = "renamed"
+	ConflictCoerced  = "coerced"
+	ConflictReplaced = "replaced"
+)
+
+// DefaultConflictReplaceAfter is the default number of conflicts after which
+// a metric is replaced, with ConflictReplace.
+const DefaultConflictReplaceAfter = 10
+
+// SetTypeConflictPolicy sets what happens to observations that conflict with
+// an existing metric, and, with ConflictReplace, after how many conflicts the
+// metric is replaced. Only observations that declare a type can conflict. It
+// must be called before the universe is served.
+func (u *Universe) SetTypeConflictPolicy(policy TypeConflictPolicy, replaceAfter int) error {
+	switch policy {
+	case ConflictIgnore, ConflictReject, ConflictRename, ConflictCoerce, ConflictReplace:
+	default:
+		return fmt.Errorf("invalid type conflict policy '%s'", policy)
+	}
+	if replaceAfter < 1 {
+		return fmt.Errorf("conflicts before a metric is replaced must be positive")
+	}
+	u.policies.conflict, u.policies.replaceAfter = policy, replaceAfter
+	return nil
+}
+
+// TypeConflicts returns the number of observations that conflicted with an
+// existing metric, by how they were resolved.
+func (u *Universe) TypeConflicts() map[string]uint64 {
+	counts := map[string]uint64{}
+	for _, s := range u.shards {
+		s.mtx.Lock()
+		for resolution, n := range s.conflicts {
+			counts[resolution] += n
+		}
+		s.mtx.Unlock()
+	}
+	return counts
+}
+
+// resolveConflict checks whether o, which declares a type, conflicts with the
+// collection c, and if so, resolves the conflict according to the policy. It
+// returns the observation to observe, and the collection to observe it in,
+// which may have been replaced. The shard must be locked.
+func (s *universeShard) resolveConflict(c *timeseriesCollection, o Observation, p *observePolicies) (*timeseriesCollection, Observation, error) {
+	err := c.checkRedeclaration(o)
+	if err == nil {
+		c.conflicts = 0
+		return c, o, nil
+	}
+	c.conflicts++
+	err = RejectError{ReasonTypeMismatch, err}
+	resolution := ConflictIgnored
+	defer func() { s.conflicts[resolution]++ }()
+	switch p.conflict {
+	case ConflictReject:
+		resolution = ConflictRejected
+		return c, o, err
+
+	case ConflictRename:
+		o.Name += ConflictSuffix
+		n := o.metricName()
+		rc, ok := s.collections[n]
+		if !ok {
+			if rc, err = newTimeseriesCollection(o); err != nil {
+				resolution = ConflictRejected
+				return c, o, errors.Wrap(err, "error creating new timeseries collection")
+			}
+			s.collections[n] = rc
+		} else if err := rc.checkRedeclaration(o); err != nil {
+			resolution = ConflictRejected
+			return c, o, errors.Wrapf(err, "conflicts with %s too", o.Name)
+		}
+		resolution = ConflictRenamed
+		return rc, o, nil
+
+	case ConflictCoerce:
+		if c.typ != "counter" || o.Type != "gauge" {
+			resolution = ConflictRejected
+			return c, o, errors.Wrap(err, "only counters can be coerced, to gauges")
+		}
+		if err := s.pageInAll(c, o.metricName(), p.spill); err != nil {
+			resolution = ConflictRejected
+			return c, o, err
+		}
+		nc, err := s.coerce(c, o)
+		if err != nil {
+			resolution = ConflictRejected
+			return c, o, err
+		}
+		resolution = ConflictCoerced
+		return nc, o, nil
+
+	case ConflictReplace:
+		if c.conflicts < p.replaceAfter {
+			return c, o, nil
+		}
+		nc, err := newTimeseriesCollection(o)
+		if err != nil {
+			return c, o, nil // invalid, so ignored
+		}
+		for k := range c.values {
+			s.remove(c, k)
+		}
+		p.spill.dropAll(o.metricName())
+		s.collections[o.metricName()] = nc
+		resolution = ConflictReplaced
+		return nc, o, nil
+	}
+	return c, o, nil
+}
+
+// coerce replaces the counter collection c with a gauge collection, declared
+// by o, whose series have the values of the counter's series. The shard must
+// be locked.
+func (s *universeShard) coerce(c *timeseriesCollection, o Observation) (*timeseriesCollection, error) {
+	nc, err := newTimeseriesCollection(o)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating new timeseries collection")
+	}
+	for k, v := range c.values {
+		cv := v.(*counter)
+		cv.retire() // so that its value is final
+		gv, err := newGauge(nc.declared(Observation{Name: cv.n, Labels: cv.labels}))
+		if err != nil {
+			return nil, err
+		}
+		if cv.touched() {
+			value := cv.value.load()
+			gv.observe(Observation{Value: &value})
+		}
+		gv.markSeen(cv.seenAt())
+		nc.values[k] = gv
+		nc.bytes += seriesBytes(k, gv)
+	}
+	nc.utf8 = c.utf8
+	for k := range c.values {
+		s.remove(c, k)
+	}
+	s.collections[o.metricName()] = nc
+	atomic.AddInt64(&s.bytes, nc.bytes)
+	for k := range nc.values {
+		s.storeLockFree(nc, k)
+	}
+	return nc, nil
+}
@@ -0,0 +1,112 @@
+package aggregator
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTypeConflictPolicy(t *testing.T) {
+	const conflict = `{"name":"foo_total","type":"gauge","help":"Current foos.","labels":{"a":"1"},"value":5}`
+	for name, testcase := range map[string]struct {
+		policy    TypeConflictPolicy
+		conflicts int
+		wantErr   bool
+		want      string
+		resolved  map[string]uint64
+	}{
+		"ignore": {
+			policy:    ConflictIgnore,
+			conflicts: 1,
+			want: `
+				# HELP foo_total Total number of foos.
+				# TYPE foo_total counter
+				foo_total{a="1"} 8.000000
+				foo_total{a="2"} 2.000000
+			`,
+			resolved: map[string]uint64{ConflictIgnored: 1},
+		},
+		"reject": {
+			policy:    ConflictReject,
+			conflicts: 1,
+			wantErr:   true,
+			want: `
+				# HELP foo_total Total number of foos.
+				# TYPE foo_total counter
+				foo_total{a="1"} 3.000000
+				foo_total{a="2"} 2.000000
+			`,
+			resolved: map[string]uint64{ConflictRejected: 1},
+		},
+		"rename": {
+			policy:    ConflictRename,
+			conflicts: 2,
+			want: `
+				# HELP foo_total Total number of foos.
+				# TYPE foo_total counter
+				foo_total{a="1"} 3.000000
+				foo_total{a="2"} 2.000000
+
+				# HELP foo_total_conflict Current foos.
+				# TYPE foo_total_conflict gauge
+				foo_total_conflict{a="1"} 5.000000
+			`,
+			resolved: map[string]uint64{ConflictRenamed: 2},
+		},
+		"coerce": {
+			policy:    ConflictCoerce,
+			conflicts: 1,
+			want: `
+				# HELP foo_total Current foos.
+				# TYPE foo_total gauge
+				foo_total{a="1"} 5.000000
+				foo_total{a="2"} 2.000000
+			`,
+			resolved: map[string]uint64{ConflictCoerced: 1},
+		},
+		"replace after 2": {
+			policy:    ConflictReplace,
+			conflicts: 2,
+			want: `
+				# HELP foo_total Current foos.
+				# TYPE foo_total gauge
+				foo_total{a="1"} 5.000000
+			`,
+			resolved: map[string]uint64{ConflictIgnored: 1, ConflictReplaced: 1},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			u, _ := NewUniverse()
+			if err := u.SetTypeConflictPolicy(testcase.policy, 2); err != nil {
+				t.Fatal(err)
+			}
+			loadObservations(t, u, makeObservations(t, []string{
+				`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+				`foo_total{a="1"} 3`,
+				`foo_total{a="2"} 1`,
+				`{"name":"foo_total","type":"counter","help":"Total number of foos."}`, // resets the count of conflicts
+				`{"name":"foo_total","type":"counter","help":"Total number of foos.","labels":{"a":"2"},"value":1}`,
+			}))
+			for i := 0; i < testcase.conflicts; i++ {
+				err := u.Observe(makeObservations(t, []string{conflict})[0])
+				if (err != nil) != testcase.wantErr {
+					t.Fatalf("want error %v, have %v", testcase.wantErr, err)
+				}
+			}
+			if want, have := normalizeResponse(testcase.want), normalizeResponse(scrape(t, u)); want != have {
+				t.Errorf("\n---WANT---\n%s\n---HAVE---\n%s", want, have)
+			}
+			if want, have := testcase.resolved, u.TypeConflicts(); !cmp.Equal(want, have) {
+				t.Error(cmp.Diff(want, have))
+			}
+		})
+	}
+
+	u, _ := NewUniverse()
+	if err := u.SetTypeConflictPolicy("overwrite", 1); err == nil {
+		t.Errorf("invalid policy: want error, have none")
+	}
+	if err := u.SetTypeConflictPolicy(ConflictReplace, 0); err == nil {
+		t.Errorf("replace after 0: want error, have none")
+	}
+}
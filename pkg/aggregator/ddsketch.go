@@ -0,0 +1,178 @@
+package aggregator
+
+import (
+	"math"
+)
+
+// ddsketch is a DDSketch: a compact summary of observations, from which any
+// quantile can be estimated to within a relative error, whatever the
+// distribution of the observations. See https://arxiv.org/abs/1908.10693.
+//
+// Observations are counted in logarithmically sized bins, so that every value
+// in a bin is within the relative error of the bin's representative value.
+// Each of the positive and negative stores has at most maxSketchBins bins; if
+// observations span more, the lowest bins are collapsed, which only affects
+// the accuracy of the lowest quantiles.
+type ddsketch struct {
+	gamma    float64 // ratio of the bounds of each bin
+	logGamma float64
+	positive sketchStore
+	negative sketchStore // of the absolute values
+	zero     uint64      // including values too small to index
+	count    uint64
+	sum      float64
+}
+
+// maxSketchBins is the most bins in each sketch store. With a relative error
+// of 1%, that's enough for values spanning 17 orders of magnitude without
+// collapsing.
+const maxSketchBins = 2048
+
+// minSketchValue is the smallest magnitude that's indexed; smaller values are
+// counted as zero.
+const minSketchValue = 1e-300
+
+func newDDSketch(relativeAccuracy float64) *ddsketch {
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	return &ddsketch{gamma: gamma, logGamma: math.Log(gamma)}
+}
+
+func (s *ddsketch) add(v float64) {
+	switch {
+	case v >= minSketchValue:
+		s.positive.add(s.index(v))
+	case v <= -minSketchValue:
+		s.negative.add(s.index(-v))
+	default:
+		s.zero++
+	}
+	s.count++
+	s.sum += v
+}
+
+// merge adds the observations in o, which must have the same relative
+// accuracy, to s.
+func (s *ddsketch) merge(o *ddsketch) {
+	s.positive.merge(&o.positive)
+	s.negative.merge(&o.negative)
+	s.zero += o.zero
+	s.count += o.count
+	s.sum += o.sum
+}
+
+// reset removes every observation, keeping the allocated bins.
+func (s *ddsketch) reset() {
+	s.positive.reset()
+	s.negative.reset()
+	s.zero, s.count, s.sum = 0, 0, 0
+}
+
+// index returns the bin of the positive value v.
+func (s *ddsketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+// value returns the representative value of bin i, which is within the
+// relative error of every value in the bin.
+func (s *ddsketch) value(i int) float64 {
+	return 2 * math.Pow(s.gamma, float64(i)) / (s.gamma + 1)
+}
+
+// quantile estimates the q-quantile of the observations. It returns NaN if
+// there are none.
+func (s *ddsketch) quantile(q float64) float64 {
+	if s.count == 0 {
+		return math.NaN()
+	}
+	rank := uint64(q * float64(s.count-1))
+	var n uint64
+	for i := len(s.negative.bins) - 1; i >= 0; i-- {
+		if n += s.negative.bins[i]; n > rank {
+			return -s.value(s.negative.offset + i)
+		}
+	}
+	if n += s.zero; n > rank {
+		return 0
+	}
+	for i, c := range s.positive.bins {
+		if n += c; n > rank {
+			return s.value(s.positive.offset + i)
+		}
+	}
+	return s.value(s.positive.offset + len(s.positive.bins) - 1) // unreachable
+}
+
+// sketchStore counts observations in contiguous bins, starting at offset.
+type sketchStore struct {
+	bins   []uint64
+	offset int
+}
+
+func (s *sketchStore) add(i int) {
+	low := s.grow(i, i)
+	if i < low {
+		i = low // collapsed
+	}
+	s.bins[i-low]++
+}
+
+func (s *sketchStore) merge(o *sketchStore) {
+	if len(o.bins) == 0 {
+		return
+	}
+	low := s.grow(o.offset, o.offset+len(o.bins)-1)
+	for j, n := range o.bins {
+		k := o.offset + j - low
+		if k < 0 {
+			k = 0 // collapsed
+		}
+		s.bins[k] += n
+	}
+}
+
+// grow extends the bins to cover low through high, collapsing the lowest if
+// that's more than maxSketchBins, and returns the lowest index.
+func (s *sketchStore) grow(low, high int) int {
+	if len(s.bins) > 0 {
+		if s.offset < low {
+			low = s.offset
+		}
+		if top := s.offset + len(s.bins) - 1; top > high {
+			high = top
+		}
+	}
+	if high-low+1 > maxSketchBins {
+		low = high - maxSketchBins + 1
+	}
+	if len(s.bins) == 0 || low != s.offset || high != s.offset+len(s.bins)-1 {
+		s.resize(low, high)
+	}
+	return low
+}
+
+// resize changes the range of the bins to low through high, collapsing any
+// bins below low into it.
+func (s *sketchStore) resize(low, high int) {
+	var bins []uint64
+	if n := high - low + 1; len(s.bins) == 0 && cap(s.bins) >= n {
+		bins = s.bins[:n] // reset, so the bins are already zero
+	} else {
+		bins = make([]uint64, n)
+	}
+	for j, n := range s.bins {
+		k := s.offset + j - low
+		if k < 0 {
+			k = 0
+		}
+		bins[k] += n
+	}
+	s.bins, s.offset = bins, low
+}
+
+// reset removes every observation, keeping the allocated bins.
+func (s *sketchStore) reset() {
+	for j := range s.bins {
+		s.bins[j] = 0
+	}
+	s.bins = s.bins[:0]
+}
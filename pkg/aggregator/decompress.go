@@ -0,0 +1,132 @@
+package aggregator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// gzipReaders and decompressBuffers pool gzip readers and the buffers they
+// decompress into, which are large enough that allocating them for every
+// packet or line puts a lot of pressure on the GC.
+var (
+	gzipReaders       sync.Pool // *gzipReader
+	decompressBuffers = sync.Pool{New: func() interface{} { return &bytes.Buffer{} }}
+)
+
+// maxPooledBufferSize is the capacity of the largest buffer that's returned
+// to the pool. Larger buffers, grown by unusually large payloads, are left
+// for the GC, so that they're not kept around indefinitely.
+const maxPooledBufferSize = 1 << 20
+
+// gzipReader is a reusable gzip reader and its source.
+type gzipReader struct {
+	src bytes.Reader
+	zr  *gzip.Reader
+}
+
+// unZipData decompresses gzipped data into buf, and returns its contents.
+func unZipData(buf *bytes.Buffer, data []byte) ([]byte, error) {
+	r, _ := gzipReaders.Get().(*gzipReader)
+	if r == nil {
+		r = &gzipReader{}
+	}
+	r.src.Reset(data)
+	var err error
+	if r.zr == nil {
+		r.zr, err = gzip.NewReader(&r.src)
+	} else {
+		err = r.zr.Reset(&r.src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReaders.Put(r)
+
+	buf.Reset()
+	if _, err := buf.ReadFrom(r.zr); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decompressor transparently decompresses gzipped packets or lines, or
+// zstd-compressed ones on request, into a buffer taken from the pool when it's
+// first needed.
+type Decompressor struct {
+	buf *bytes.Buffer
+}
+
+// Decompress decompresses data if it is gzipped. The result is only valid
+// until the next call, or until Release is called.
+func (d *Decompressor) Decompress(data []byte) ([]byte, error) {
+	if !IsGzipped(data) {
+		return data, nil
+	}
+	if d.buf == nil {
+		d.buf = decompressBuffers.Get().(*bytes.Buffer)
+	}
+	return unZipData(d.buf, data)
+}
+
+// DecompressZstd decompresses data, which must be zstd-compressed. The
+// result is only valid until the next call, or until Release is called.
+func (d *Decompressor) DecompressZstd(data []byte) ([]byte, error) {
+	dec, err := zstdDecoder()
+	if err != nil {
+		return nil, err
+	}
+	if d.buf == nil {
+		d.buf = decompressBuffers.Get().(*bytes.Buffer)
+	}
+	out, err := dec.DecodeAll(data, d.buf.Bytes()[:0])
+	if err != nil {
+		return nil, err
+	}
+	d.buf = bytes.NewBuffer(out) // the same buffer, unless it had to grow
+	return out, nil
+}
+
+// zstdOnce creates zstdDec, the shared zstd decoder, or zstdErr.
+var (
+	zstdOnce sync.Once
+	zstdDec  *zstd.Decoder
+	zstdErr  error
+)
+
+// maxZstdSize is the largest size zstd-compressed data may decompress to,
+// rather than the 64GiB a frame can claim by default.
+const maxZstdSize = 64 << 20
+
+// zstdDecoder returns the zstd decoder shared by every Decompressor, which is
+// created when it's first needed. Its DecodeAll is safe for concurrent use.
+func zstdDecoder() (*zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdDec, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxZstdSize))
+	})
+	return zstdDec, zstdErr
+}
+
+// Release returns the decompressor's buffer, if any, to the pool.
+func (d *Decompressor) Release() {
+	if d.buf == nil {
+		return
+	}
+	if d.buf.Cap() <= maxPooledBufferSize {
+		decompressBuffers.Put(d.buf)
+	}
+	d.buf = nil
+}
+
+// IsZstd checks if the given byte slice starts with a zstd frame.
+func IsZstd(packet []byte) bool {
+	return len(packet) >= 4 && packet[0] == 0x28 && packet[1] == 0xb5 && packet[2] == 0x2f && packet[3] == 0xfd
+}
+
+// IsGzipped checks if the given byte slice represents a gzip-compressed stream.
+func IsGzipped(packet []byte) bool {
+	return len(packet) >= 2 && packet[0] == 31 && packet[1] == 139
+}
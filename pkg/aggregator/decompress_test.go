@@ -0,0 +1,125 @@
+package aggregator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestUnZipData(t *testing.T) {
+	expectedOutput := []byte("Hello, World!")
+
+	compressedData := compressData(expectedOutput)
+
+	output, err := unZipData(&bytes.Buffer{}, compressedData)
+	if err != nil {
+		t.Errorf("unZipData returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(output, expectedOutput) {
+		t.Errorf("unZipData did not return the expected output. Got: %s, Expected: %s", output, expectedOutput)
+	}
+}
+
+func compressData(data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	if err != nil {
+		panic(err)
+	}
+	err = gz.Close()
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestIsGzipped(t *testing.T) {
+	testCases := []struct {
+		input    []byte
+		expected bool
+	}{
+		{[]byte{31, 139, 8, 0, 0, 0, 0, 0, 0, 255}, true},  // Gzipped data
+		{[]byte{31, 139}, true},                            // Gzipped data with minimum length
+		{[]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, false},      // Not gzipped data
+		{[]byte{31, 138, 8, 0, 0, 0, 0, 0, 0, 255}, false}, // Not gzipped data
+	}
+
+	for _, tc := range testCases {
+		result := IsGzipped(tc.input)
+		if result != tc.expected {
+			t.Errorf("IsGzipped have %v for input %v, want %v", result, tc.input, tc.expected)
+		}
+	}
+}
+
+func TestTransparentDecompressGZip(t *testing.T) {
+	testCases := []struct {
+		input          []byte
+		expectedOutput []byte
+		expectedError  error
+	}{
+		{compressData([]byte("Hello, World!")), []byte("Hello, World!"), nil},      // Gzipped data
+		{[]byte("Hello, World!"), []byte("Hello, World!"), nil},                    // Gzipped data
+		{[]byte{31, 139, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, nil, gzip.ErrHeader}, // Non-gzipped data
+	}
+
+	for _, tc := range testCases {
+		var d Decompressor
+		output, err := d.Decompress(tc.input)
+
+		if !reflect.DeepEqual(output, tc.expectedOutput) {
+			t.Errorf("transparentDecompressGZip did not return the expected output. Have: %v, Want: %v", output, tc.expectedOutput)
+		}
+
+		if !errors.Is(err, tc.expectedError) {
+			t.Errorf("transparentDecompressGZip returned unexpected error. Have: %v, Want: %v", err, tc.expectedError)
+		}
+	}
+}
+
+func TestDecompressorReuse(t *testing.T) {
+	var d Decompressor
+	defer d.Release()
+	for _, s := range []string{"Hello, World!", "foo", strings.Repeat("bar", 1000), "baz"} {
+		output, err := d.Decompress(compressData([]byte(s)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := s, string(output); want != have {
+			t.Fatalf("want %q, have %q", want, have)
+		}
+	}
+}
+
+func TestDecompressZstd(t *testing.T) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	var d Decompressor
+	defer d.Release()
+	for _, s := range []string{"Hello, World!", strings.Repeat("bar", 1000), "baz"} {
+		data := enc.EncodeAll([]byte(s), nil)
+		if !IsZstd(data) {
+			t.Fatalf("%q: want zstd magic bytes, have %x", s, data[:4])
+		}
+		output, err := d.DecompressZstd(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := s, string(output); want != have {
+			t.Fatalf("want %q, have %q", want, have)
+		}
+	}
+	if _, err := d.DecompressZstd(compressData([]byte("gzipped"))); err == nil {
+		t.Errorf("gzipped: want error, have none")
+	}
+}
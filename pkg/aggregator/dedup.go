@@ -0,0 +1,78 @@
+package aggregator
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// DefaultRecentIDs is the default number of observation IDs remembered for
+// each metric.
+const DefaultRecentIDs = 1024
+
+// errDuplicate is returned by a shard for an observation whose ID it has
+// already observed. It's not an error to the caller.
+var errDuplicate = fmt.Errorf("duplicate observation")
+
+// SetRecentIDs sets the number of the most recent observation IDs remembered
+// for each metric, so that a retried observation with the same ID is ignored,
+// rather than counted twice. Zero ignores IDs. It must be called before the
+// universe is served.
+func (u *Universe) SetRecentIDs(n int) error {
+	if n < 0 {
+		return fmt.Errorf("recent IDs can't be negative")
+	}
+	u.policies.recentIDs = n
+	return nil
+}
+
+// Duplicates returns the number of observations that have been ignored
+// because their ID had already been observed.
+func (u *Universe) Duplicates() uint64 {
+	return atomic.LoadUint64(&u.duplicates)
+}
+
+// observed returns err, the result of an observation, counting and ignoring
+// duplicates, stale observations, and dropped non-finite values.
+func (u *Universe) observed(err error) error {
+	switch err {
+	case errDuplicate:
+		atomic.AddUint64(&u.duplicates, 1)
+		return nil
+	case errStale:
+		atomic.AddUint64(&u.stale, 1)
+		return nil
+	case errNonFiniteDropped:
+		atomic.AddUint64(&u.nonFiniteDropped, 1)
+		return nil
+	}
+	return err
+}
+
+// recentIDs is a fixed number of the most recently observed IDs, of which
+// the oldest is forgotten when a new one is added. It's not goroutine-safe.
+type recentIDs struct {
+	ring []string
+	next int
+	set  map[string]struct{}
+}
+
+func newRecentIDs(n int) *recentIDs {
+	return &recentIDs{ring: make([]string, 0, n), set: make(map[string]struct{}, n)}
+}
+
+func (r *recentIDs) contains(id string) bool {
+	_, ok := r.set[id]
+	return ok
+}
+
+// add remembers id, which must not already be remembered.
+func (r *recentIDs) add(id string) {
+	if len(r.ring) < cap(r.ring) {
+		r.ring = append(r.ring, id)
+	} else {
+		delete(r.set, r.ring[r.next])
+		r.ring[r.next] = id
+		r.next = (r.next + 1) % len(r.ring)
+	}
+	r.set[id] = struct{}{}
+}
@@ -0,0 +1,53 @@
+package aggregator
+
+import (
+	"testing"
+)
+
+func TestRecentIDs(t *testing.T) {
+	u, _ := NewUniverse()
+	if err := u.SetRecentIDs(2); err != nil {
+		t.Fatal(err)
+	}
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`{"name":"bar_total","type":"counter","help":"Total number of bars."}`,
+		`foo_total{} 1`,
+	}))
+	for _, line := range []string{
+		`{"name":"foo_total","value":1,"id":"a"}`,
+		`{"name":"foo_total","value":1,"id":"a"}`, // duplicate
+		`{"name":"bar_total","value":1,"id":"a"}`, // another metric
+		`{"name":"foo_total","value":1,"id":"b"}`,
+		`{"name":"foo_total","value":1,"id":"c"}`, // forgets a
+		`{"name":"foo_total","value":1,"id":"a"}`,
+		`{"name":"foo_total","value":1,"id":"c"}`, // duplicate
+		`{"name":"foo_total","value":1}`,
+		`{"name":"foo_total","value":"+Inf","id":"d"}`, // rejected
+	} {
+		o, err := ParseLine([]byte(line), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.Observe(o)
+	}
+	if err := u.ObserveBatch(makeObservations(t, []string{
+		`{"name":"foo_total","value":1,"id":"d"}`,
+		`{"name":"foo_total","value":1,"id":"d"}`, // duplicate
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]float64{"foo_total": 7, "bar_total": 1} {
+		if s, _ := u.Lookup(name, nil); *s.Value != want {
+			t.Errorf("%s: want %v, have %v", name, want, *s.Value)
+		}
+	}
+	if want, have := uint64(3), u.Duplicates(); want != have {
+		t.Errorf("Duplicates: want %d, have %d", want, have)
+	}
+
+	if err := u.SetRecentIDs(-1); err == nil {
+		t.Errorf("negative recent IDs: want error, have none")
+	}
+}
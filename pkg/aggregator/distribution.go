@@ -0,0 +1,203 @@
+package aggregator
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Defaults for the parameters of a distribution.
+var (
+	defaultDistributionQuantiles        = []float64{0.5, 0.9, 0.99}
+	defaultDistributionRelativeAccuracy = 0.01
+)
+
+// The bounds of a distribution's relative accuracy. Towards 0, the sketch's
+// bins narrow until they can't be told apart, and its maxSketchBins cover a
+// tiny range of values; towards 1, every value falls in the lowest bins, and
+// every quantile is estimated as 0.
+const (
+	minDistributionRelativeAccuracy = 1e-4
+	maxDistributionRelativeAccuracy = 0.5
+)
+
+// distributionParams are the declared parameters of a distribution.
+type distributionParams struct {
+	quantiles     []float64
+	accuracy      float64
+	window        time.Duration // 0 is the lifetime of the process
+	windowBuckets int
+}
+
+// parseDistributionParams returns the parameters declared by o, or their
+// defaults.
+func parseDistributionParams(o Observation) (p distributionParams, err error) {
+	p = distributionParams{quantiles: o.Quantiles, accuracy: o.RelativeAccuracy}
+	if len(p.quantiles) == 0 {
+		p.quantiles = defaultDistributionQuantiles
+	}
+	if p.accuracy == 0 {
+		p.accuracy = defaultDistributionRelativeAccuracy
+	}
+	for _, q := range p.quantiles {
+		if !(q >= 0 && q <= 1) {
+			return p, fmt.Errorf("quantile %v isn't between 0 and 1", q)
+		}
+	}
+	if !(p.accuracy >= minDistributionRelativeAccuracy && p.accuracy <= maxDistributionRelativeAccuracy) {
+		return p, fmt.Errorf("relative accuracy %v isn't between %v and %v", p.accuracy, minDistributionRelativeAccuracy, maxDistributionRelativeAccuracy)
+	}
+	p.window, p.windowBuckets, err = parseWindow(o)
+	return p, err
+}
+
+func (p distributionParams) equal(other distributionParams) bool {
+	return equalBuckets(p.quantiles, other.quantiles) &&
+		p.accuracy == other.accuracy &&
+		p.window == other.window &&
+		p.windowBuckets == other.windowBuckets
+}
+
+// declared returns o with the parameters.
+func (p distributionParams) declared(o Observation) Observation {
+	o.Quantiles, o.RelativeAccuracy = p.quantiles, p.accuracy
+	o.Window, o.WindowBuckets = "", p.windowBuckets
+	if p.window > 0 {
+		o.Window = p.window.String()
+	}
+	return o
+}
+
+// distribution stores observations in a DDSketch, rather than fixed buckets,
+// and is rendered as a summary of its quantiles. It's not goroutine-safe.
+type distribution struct {
+	lastSeen
+	n         string
+	labels    map[string]string
+	quantiles []float64
+	sum       float64 // over the lifetime of the process, as in a summary
+	count     uint64  // over the lifetime of the process, as in a summary
+	window    *sketchWindow
+	prefix    distributionPrefixes
+}
+
+// distributionPrefixes are the rendered names and labels of a distribution's
+// samples.
+type distributionPrefixes struct {
+	quantiles []string
+	sum       string
+	count     string
+}
+
+func newDistribution(o Observation) (*distribution, error) {
+	p, err := parseDistributionParams(o)
+	if err != nil {
+		return nil, err
+	}
+	return &distribution{
+		n:         o.Name,
+		labels:    o.Labels,
+		quantiles: p.quantiles,
+		window:    newSketchWindow(p, time.Now),
+		prefix: distributionPrefixes{
+			quantiles: renderQuantilePrefixes(o.Name, o.Labels, p.quantiles),
+			sum:       renderSeries(o.Name+"_sum", o.Labels),
+			count:     renderSeries(o.Name+"_count", o.Labels),
+		},
+	}, nil
+}
+
+func (d *distribution) metricName() metricName {
+	return metricName(d.n)
+}
+
+func (d *distribution) timeseriesKey() timeseriesKey {
+	return makeTimeseriesKey(d.n, d.labels)
+}
+
+func (d *distribution) observe(o Observation) error {
+	if o.Value == nil {
+		return nil // declaration
+	}
+	if math.IsNaN(*o.Value) || math.IsInf(*o.Value, 0) {
+		return rejectf(ReasonBadValue, "distribution values must be finite")
+	}
+	d.window.add(*o.Value)
+	d.sum += *o.Value
+	d.count++
+	return nil
+}
+
+func (d *distribution) touched() bool { return d.count > 0 }
+
+func (d *distribution) renderText() string {
+	var b []byte
+	s := d.window.sketch()
+	for i, q := range d.quantiles {
+		b = appendSample(b, d.prefix.quantiles[i], s.quantile(q))
+	}
+	b = appendSample(b, d.prefix.sum, d.sum)
+	b = appendCountSample(b, d.prefix.count, d.count)
+	return string(b)
+}
+
+func (d *distribution) snapshot() SeriesSnapshot {
+	sum, count := d.sum, d.count
+	var quantiles map[string]float64
+	if s := d.window.sketch(); s.count > 0 {
+		quantiles = make(map[string]float64, len(d.quantiles))
+		for _, q := range d.quantiles {
+			quantiles[formatQuantile(q)] = s.quantile(q)
+		}
+	}
+	return SeriesSnapshot{Name: d.n, Labels: d.labels, Sum: &sum, Count: &count, Quantiles: quantiles}
+}
+
+// sketchWindow is a sliding window of observations: a ring of sketches, of
+// which the oldest is reset as the window moves on. Without a window, there's
+// a single sketch, which covers every observation.
+type sketchWindow struct {
+	sketches []*ddsketch
+	ring     windowRing
+	merged   *ddsketch // of every sketch, reused for each query
+}
+
+func newSketchWindow(p distributionParams, now func() time.Time) *sketchWindow {
+	w := &sketchWindow{sketches: []*ddsketch{newDDSketch(p.accuracy)}}
+	if p.window > 0 {
+		w.sketches = make([]*ddsketch, p.windowBuckets)
+		for i := range w.sketches {
+			w.sketches[i] = newDDSketch(p.accuracy)
+		}
+		w.ring = newWindowRing(p.window, p.windowBuckets, now)
+		w.merged = newDDSketch(p.accuracy)
+	}
+	return w
+}
+
+func (w *sketchWindow) add(v float64) {
+	w.rotate()
+	w.sketches[w.ring.head].add(v)
+}
+
+// sketch returns a sketch of the observations in the window, which is only
+// valid until the next call.
+func (w *sketchWindow) sketch() *ddsketch {
+	if w.merged == nil {
+		return w.sketches[0]
+	}
+	w.rotate()
+	w.merged.reset()
+	for _, s := range w.sketches {
+		w.merged.merge(s)
+	}
+	return w.merged
+}
+
+// rotate resets the sketches that have left the window.
+func (w *sketchWindow) rotate() {
+	if w.merged == nil {
+		return
+	}
+	w.ring.rotate(func(i int) { w.sketches[i].reset() })
+}
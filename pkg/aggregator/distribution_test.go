@@ -0,0 +1,161 @@
+package aggregator
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDDSketchAccuracy(t *testing.T) {
+	const accuracy = 0.01
+	for name, gen := range map[string]func(r *rand.Rand) float64{
+		"uniform":     func(r *rand.Rand) float64 { return r.Float64() * 100 },
+		"exponential": func(r *rand.Rand) float64 { return r.ExpFloat64() },
+		"lognormal":   func(r *rand.Rand) float64 { return math.Exp(3 * r.NormFloat64()) },
+		"mixed signs": func(r *rand.Rand) float64 { return r.NormFloat64() * 1000 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			var (
+				r      = rand.New(rand.NewSource(1))
+				s      = newDDSketch(accuracy)
+				values = make([]float64, 10000)
+			)
+			for i := range values {
+				values[i] = gen(r)
+				s.add(values[i])
+			}
+			sort.Float64s(values)
+			for _, q := range []float64{0, 0.01, 0.5, 0.9, 0.99, 1} {
+				want := values[int(q*float64(len(values)-1))]
+				have := s.quantile(q)
+				if math.Abs(have-want) > accuracy*math.Abs(want) {
+					t.Errorf("q=%v: want %v ±%v%%, have %v", q, want, 100*accuracy, have)
+				}
+			}
+		})
+	}
+}
+
+func TestDDSketchCollapse(t *testing.T) {
+	s := newDDSketch(0.01)
+	for _, v := range []float64{1e-200, 1e-100, 1, 1e100} {
+		s.add(v)
+	}
+	if want, have := maxSketchBins, len(s.positive.bins); want != have {
+		t.Fatalf("bins: want %d, have %d", want, have)
+	}
+	// The lowest values are collapsed, but the highest are still accurate.
+	if want, have := 1e100, s.quantile(1); math.Abs(have-want) > 0.01*want {
+		t.Errorf("max: want %v, have %v", want, have)
+	}
+	if want, have := uint64(4), s.count; want != have {
+		t.Errorf("count: want %d, have %d", want, have)
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	u, _ := NewUniverse()
+	lines := []string{
+		`{"name":"rtt_seconds","type":"distribution","help":"Round trip time.","quantiles":[0.5,0.99]}`,
+	}
+	for i := 1; i <= 100; i++ {
+		lines = append(lines, fmt.Sprintf(`rtt_seconds{} %v`, float64(i)/100))
+	}
+	loadObservations(t, u, makeObservations(t, lines))
+	if want, have := normalizeResponse(`
+		# HELP rtt_seconds Round trip time.
+		# TYPE rtt_seconds summary
+		rtt_seconds{quantile="0.5"} 0.501539
+		rtt_seconds{quantile="0.99"} 0.990000
+		rtt_seconds_sum{} 50.500000
+		rtt_seconds_count{} 100
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	s, _ := u.Lookup("rtt_seconds", nil)
+	if want, have := 2, len(s.Quantiles); want != have {
+		t.Errorf("quantiles: want %d, have %v", want, s.Quantiles)
+	}
+
+	for name, o := range map[string]Observation{
+		"change quantiles": {Name: "rtt_seconds", Type: "distribution", Help: "Round trip time.", Quantiles: []float64{0.5}},
+		"change accuracy":  {Name: "rtt_seconds", Type: "distribution", Help: "Round trip time.", Quantiles: []float64{0.5, 0.99}, RelativeAccuracy: 0.05},
+		"bad quantile":     {Name: "foo", Type: "distribution", Help: "Foo.", Quantiles: []float64{2}},
+		"bad accuracy":     {Name: "foo", Type: "distribution", Help: "Foo.", RelativeAccuracy: 1},
+	} {
+		if err := u.CheckDeclaration(o); err == nil {
+			t.Errorf("%s: want error, have none", name)
+		}
+	}
+	if err := u.Observe(Observation{Name: "rtt_seconds", Value: func(v float64) *float64 { return &v }(math.Inf(1))}); err == nil {
+		t.Errorf("+Inf: want error, have none")
+	}
+}
+
+func TestSketchWindow(t *testing.T) {
+	p, err := parseDistributionParams(Observation{Window: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		now = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		w   = newSketchWindow(p, func() time.Time { return now })
+	)
+	w.add(1000) // slot [0s, 10s)
+	now = now.Add(25 * time.Second)
+	w.add(1) // slot [20s, 30s)
+	if want, have := uint64(2), w.sketch().count; want != have {
+		t.Fatalf("at 25s: want %d observations, have %d", want, have)
+	}
+
+	// The first slot has left the window once 6 slots have started since.
+	now = now.Add(35 * time.Second)
+	if want, have := uint64(1), w.sketch().count; want != have {
+		t.Fatalf("at 60s: want %d observation, have %d", want, have)
+	}
+	if want, have := 1.0, w.sketch().quantile(1); math.Abs(have-want) > 0.01 {
+		t.Errorf("at 60s: want max %v, have %v", want, have)
+	}
+
+	// After a whole window without observations, the window is empty.
+	now = now.Add(time.Hour)
+	if want, have := uint64(0), w.sketch().count; want != have {
+		t.Fatalf("after an hour: want %d observations, have %d", want, have)
+	}
+	w.add(2)
+	now = now.Add(59 * time.Second)
+	if want, have := uint64(1), w.sketch().count; want != have {
+		t.Fatalf("59s later: want %d observation, have %d", want, have)
+	}
+}
+
+func TestParseDistributionParams(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		o       Observation
+		wantErr bool
+	}{
+		"defaults":               {Observation{}, false},
+		"window":                 {Observation{Window: "5m", WindowBuckets: 5}, false},
+		"bad window":             {Observation{Window: "5 minutes"}, true},
+		"negative window":        {Observation{Window: "-5m"}, true},
+		"buckets without window": {Observation{WindowBuckets: 5}, true},
+		"too many buckets":       {Observation{Window: "1h", WindowBuckets: 20000000}, true},
+		"too short buckets":      {Observation{Window: "1ns", WindowBuckets: 2}, true},
+		"short window":           {Observation{Window: "5s"}, true}, // in 6 buckets, by default
+		"accuracy":               {Observation{RelativeAccuracy: 0.001}, false},
+		"accuracy bounds":        {Observation{RelativeAccuracy: 0.5}, false},
+		"accuracy too fine":      {Observation{RelativeAccuracy: 1e-17}, true}, // every bucket would be the same
+		"accuracy too coarse":    {Observation{RelativeAccuracy: 0.9999999999999999}, true},
+		"negative accuracy":      {Observation{RelativeAccuracy: -0.01}, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseDistributionParams(testcase.o); (err != nil) != testcase.wantErr {
+				t.Errorf("want error %v, have %v", testcase.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+// Package aggregator is the aggregation engine of prometheus-aggregator, for
+// embedding in other programs.
+//
+// A Universe holds every timeseries, and serves them in the Prometheus text
+// exposition format. Observations are declared, and then observed, either
+// directly, or by parsing lines in the JSON or Prometheus format with
+// ParseLine. Serve, ServePacket, and Handler read lines from stream
+// listeners, packet connections, and HTTP requests respectively.
+//
+//	u, _ := aggregator.NewUniverse()
+//	ln, _ := net.Listen("tcp", ":8191")
+//	go aggregator.Serve(ln, u)
+//	http.Handle("/metrics", u)
+package aggregator
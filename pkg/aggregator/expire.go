@@ -0,0 +1,91 @@
+package aggregator
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Expire removes every timeseries that hasn't been observed for longer than
+// its TTL as of now, and returns how many were removed. The TTL of a
+// timeseries is the one it was last observed with, if any, or else the one in
+// its metric's declaration, if any, or else defaultTTL; a TTL of zero keeps
+// it forever. As with Delete, collections are retained
+// even if they become empty.
+//
+// Timeseries are only timestamped once Expire has been called, with the now
+// of the latest call, which Evict moves on by a nanosecond each time it looks
+// for series to evict, so it should be called periodically, at an interval
+// much shorter than the TTLs. The rates of counters are computed from their
+// values at each call, too, so it should also be much shorter than their
+// windows.
+func (u *Universe) Expire(now time.Time, defaultTTL time.Duration) int {
+	ns := now.UnixNano()
+	atomic.StoreInt64(&u.clock, ns)
+	var expired int
+	for _, s := range u.shards {
+		s.mtx.Lock()
+		for n, c := range s.collections {
+			if len(c.rates.windows) > 0 {
+				c.sampleRates(ns)
+			}
+			ttl := defaultTTL
+			if c.ttl != nil {
+				ttl = *c.ttl
+			}
+			if ttl == 0 && !c.seriesTTLs {
+				continue
+			}
+			for k, v := range c.values {
+				if !v.touched() {
+					continue // a declaration, which isn't rendered
+				}
+				seen := v.seenAt()
+				if seen == 0 {
+					v.markSeen(ns) // not observed since the first call
+					continue
+				}
+				ttl := ttl
+				if own, ok := v.ownTTL(); ok {
+					ttl = own
+				}
+				if ttl != 0 && time.Duration(ns-seen) > ttl {
+					s.remove(c, k)
+					expired++
+				}
+			}
+			expired += u.policies.spill.expire(n, ns, ttl)
+		}
+		s.mtx.Unlock()
+	}
+	return expired
+}
+
+func parseTTL(s string) (*time.Duration, error) {
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid ttl")
+	}
+	if ttl < 0 {
+		return nil, fmt.Errorf("ttl must not be negative")
+	}
+	return &ttl, nil
+}
+
+// lastSeen is when a timeseries was last observed, by the universe's clock,
+// and its own TTL, if it was observed with one.
+type lastSeen struct {
+	unixNano int64 // atomic
+	ttl      int64 // atomic; nanoseconds plus one, or 0 for the metric's TTL
+}
+
+func (l *lastSeen) markSeen(unixNano int64)  { atomic.StoreInt64(&l.unixNano, unixNano) }
+func (l *lastSeen) seenAt() int64            { return atomic.LoadInt64(&l.unixNano) }
+func (l *lastSeen) setTTL(ttl time.Duration) { atomic.StoreInt64(&l.ttl, int64(ttl)+1) }
+
+func (l *lastSeen) ownTTL() (time.Duration, bool) {
+	ttl := atomic.LoadInt64(&l.ttl)
+	return time.Duration(ttl - 1), ttl != 0
+}
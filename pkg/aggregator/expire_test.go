@@ -0,0 +1,137 @@
+package aggregator
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"stable_total","type":"counter","help":"Never expires.","ttl":"0"}`,
+		`{"name":"job_seconds","type":"gauge","help":"Expires quickly.","ttl":"1m"}`,
+		`{"name":"other","type":"gauge","help":"Default TTL."}`,
+		`stable_total{} 1`,
+		`job_seconds{job="a"} 1`,
+		`other{} 1`,
+	}))
+
+	var (
+		start      = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		defaultTTL = 10 * time.Minute
+	)
+	if want, have := 0, u.Expire(start, defaultTTL); want != have {
+		t.Fatalf("first call: want %d expired, have %d", want, have)
+	}
+
+	// Observing job b keeps it, and job a expires after its TTL.
+	u.Expire(start.Add(50*time.Second), defaultTTL)
+	loadObservations(t, u, makeObservations(t, []string{`job_seconds{job="b"} 1`}))
+	if want, have := 1, u.Expire(start.Add(61*time.Second), defaultTTL); want != have {
+		t.Fatalf("after 61s: want %d expired, have %d", want, have)
+	}
+	if _, ok := u.Lookup("job_seconds", map[string]string{"job": "a"}); ok {
+		t.Errorf("job a: want expired, have found")
+	}
+	if _, ok := u.Lookup("job_seconds", map[string]string{"job": "b"}); !ok {
+		t.Errorf("job b: want found, have expired")
+	}
+
+	// Observed series stay, even via the lock-free path, and series with no
+	// TTL stay forever.
+	loadObservations(t, u, makeObservations(t, []string{`other{} 2`}))
+	if want, have := 1, u.Expire(start.Add(5*time.Minute), defaultTTL); want != have {
+		t.Fatalf("after 5m: want %d expired, have %d", want, have)
+	}
+	if _, ok := u.Lookup("other", nil); !ok {
+		t.Errorf("other after 5m: want found, have expired")
+	}
+	if want, have := 1, u.Expire(start.Add(time.Hour), defaultTTL); want != have {
+		t.Fatalf("after an hour: want %d expired, have %d", want, have)
+	}
+	if _, ok := u.Lookup("stable_total", nil); !ok {
+		t.Errorf("stable_total: want found, have expired")
+	}
+
+	// The collection is kept, so the metric can be observed again.
+	loadObservations(t, u, makeObservations(t, []string{`job_seconds{job="c"} 1`}))
+	if _, ok := u.Lookup("job_seconds", map[string]string{"job": "c"}); !ok {
+		t.Errorf("job c: want found, have none")
+	}
+}
+
+func TestTTLDeclaration(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo","type":"gauge","help":"Foo."}`,
+	}))
+	for name, testcase := range map[string]struct {
+		o       Observation
+		wantErr bool
+	}{
+		"new ttl":      {Observation{Name: "bar", Type: "gauge", Help: "Bar.", TTL: "5m"}, false},
+		"changed ttl":  {Observation{Name: "foo", Type: "gauge", Help: "Foo.", TTL: "5m"}, false},
+		"invalid ttl":  {Observation{Name: "bar", Type: "gauge", Help: "Bar.", TTL: "5 minutes"}, true},
+		"negative ttl": {Observation{Name: "foo", Type: "gauge", Help: "Foo.", TTL: "-5m"}, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := u.CheckDeclaration(testcase.o); (err != nil) != testcase.wantErr {
+				t.Errorf("want error %v, have %v", testcase.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSeriesTTL(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"up","type":"gauge","help":"Whether the sender is up.","ttl":"0"}`,
+		`{"name":"up","labels":{"host":"a"},"value":1,"ttl":"30s"}`,
+		`{"name":"up","labels":{"host":"b"},"value":1}`,
+		`{"name":"other","type":"gauge","help":"Default TTL."}`,
+		`{"name":"other","labels":{"host":"a"},"value":1,"ttl":"0"}`,
+	}))
+	if err := u.Observe(Observation{Name: "up", Labels: map[string]string{"host": "c"}, Value: new(float64), TTL: "soon"}); err == nil {
+		t.Errorf("invalid ttl: want error, have none")
+	}
+
+	var (
+		start      = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		defaultTTL = 10 * time.Minute
+	)
+	u.Expire(start, defaultTTL)
+
+	// The series' own TTL survives a snapshot.
+	var buf bytes.Buffer
+	if err := u.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := NewUniverse()
+	if _, err := restored.ReadSnapshot(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, u := range map[string]*Universe{"observed": u, "restored": restored} {
+		t.Run(name, func(t *testing.T) {
+			if want, have := 1, u.Expire(start.Add(31*time.Second), defaultTTL); want != have {
+				t.Fatalf("after 31s: want %d expired, have %d", want, have)
+			}
+			if _, ok := u.Lookup("up", map[string]string{"host": "a"}); ok {
+				t.Errorf("host a: want expired, have found")
+			}
+			if want, have := 0, u.Expire(start.Add(time.Hour), defaultTTL); want != have {
+				t.Fatalf("after an hour: want %d expired, have %d", want, have)
+			}
+		})
+	}
+
+	// Observing a series again without a TTL keeps its own.
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"up","labels":{"host":"a"},"value":1,"ttl":"30s"}`,
+		`{"name":"up","labels":{"host":"a"},"value":1}`,
+	}))
+	if want, have := 1, u.Expire(start.Add(time.Hour+31*time.Second), defaultTTL); want != have {
+		t.Fatalf("after 1h31s: want %d expired, have %d", want, have)
+	}
+}
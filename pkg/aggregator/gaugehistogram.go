@@ -0,0 +1,65 @@
+package aggregator
+
+// gaugeHistogram is a histogram of a snapshot of current state, e.g. the ages
+// of the items in a queue, which goes down as well as up. Each snapshot is
+// identified by the timestamp of its observations: an observation with a
+// later timestamp than the current snapshot's starts a new one, and one with
+// an earlier timestamp is stale. An observation without a value starts an
+// empty snapshot. It's exported as a histogram in the Prometheus text format,
+// which has no gauge histograms, and as a gaugehistogram, with _gcount and
+// _gsum samples, in the OpenMetrics format. It's not goroutine-safe.
+type gaugeHistogram struct {
+	histogram
+	stamp   int64 // of the current snapshot, 0 before the first
+	gprefix struct{ gsum, gcount string }
+}
+
+func newGaugeHistogram(o Observation) (*gaugeHistogram, error) {
+	h, err := newHistogram(o)
+	if err != nil {
+		return nil, err
+	}
+	g := &gaugeHistogram{histogram: *h}
+	g.gprefix.gsum = renderSeries(o.Name+"_gsum", o.Labels)
+	g.gprefix.gcount = renderSeries(o.Name+"_gcount", o.Labels)
+	return g, nil
+}
+
+func (g *gaugeHistogram) observe(o Observation) error {
+	if o.Value == nil && o.Timestamp == 0 {
+		return nil // declaration
+	}
+	switch {
+	case o.Timestamp == 0:
+		return rejectf(ReasonBadValue, "gauge histogram observations must have the timestamp of their snapshot")
+	case o.Timestamp < g.stamp:
+		return errStale
+	case o.Timestamp > g.stamp:
+		g.reset()
+		g.stamp = o.Timestamp
+	}
+	return g.histogram.observe(o)
+}
+
+// reset empties the snapshot.
+func (g *gaugeHistogram) reset() {
+	g.sum, g.count = 0, 0
+	for i := range g.buckets {
+		g.buckets[i].count = 0
+	}
+}
+
+func (g *gaugeHistogram) touched() bool { return g.stamp != 0 }
+
+// renderOpenMetrics renders the samples with the names of a gauge histogram
+// in the OpenMetrics format.
+func (g *gaugeHistogram) renderOpenMetrics() string {
+	var b []byte
+	for i, bucket := range g.buckets {
+		b = appendCountSample(b, g.prefix.buckets[i], bucket.count)
+	}
+	b = appendCountSample(b, g.prefix.buckets[len(g.buckets)], g.count)
+	b = appendCountSample(b, g.gprefix.gcount, g.count)
+	b = appendSample(b, g.gprefix.gsum, g.sum)
+	return string(b)
+}
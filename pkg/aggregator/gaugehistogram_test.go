@@ -0,0 +1,155 @@
+package aggregator
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGaugeHistogram(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"queue_age_seconds","type":"gaugehistogram","help":"Ages of queued items in seconds.","buckets":[1,10]}`,
+	})...)
+	if have := scrape(t, u); have != "" {
+		t.Fatalf("want nothing before the first snapshot, have %q", have)
+	}
+
+	for _, step := range []struct {
+		line    string
+		wantErr string
+		want    string // the sample lines
+	}{
+		{
+			line: `queue_age_seconds{} 0.5 2000`,
+			want: `
+				queue_age_seconds_bucket{le="1"} 1
+				queue_age_seconds_bucket{le="10"} 1
+				queue_age_seconds_bucket{le="+Inf"} 1
+				queue_age_seconds_sum{} 0.500000
+				queue_age_seconds_count{} 1
+			`,
+		},
+		{
+			line: `queue_age_seconds{} 5 2000`, // the same snapshot
+			want: `
+				queue_age_seconds_bucket{le="1"} 1
+				queue_age_seconds_bucket{le="10"} 2
+				queue_age_seconds_bucket{le="+Inf"} 2
+				queue_age_seconds_sum{} 5.500000
+				queue_age_seconds_count{} 2
+			`,
+		},
+		{
+			line: `queue_age_seconds{} 50 1000`, // stale
+			want: `
+				queue_age_seconds_bucket{le="1"} 1
+				queue_age_seconds_bucket{le="10"} 2
+				queue_age_seconds_bucket{le="+Inf"} 2
+				queue_age_seconds_sum{} 5.500000
+				queue_age_seconds_count{} 2
+			`,
+		},
+		{
+			line:    `queue_age_seconds{} 50`,
+			wantErr: "must have the timestamp",
+			want: `
+				queue_age_seconds_bucket{le="1"} 1
+				queue_age_seconds_bucket{le="10"} 2
+				queue_age_seconds_bucket{le="+Inf"} 2
+				queue_age_seconds_sum{} 5.500000
+				queue_age_seconds_count{} 2
+			`,
+		},
+		{
+			line: `{"name":"queue_age_seconds","timestamp":3000}`, // empty
+			want: `
+				queue_age_seconds_bucket{le="1"} 0
+				queue_age_seconds_bucket{le="10"} 0
+				queue_age_seconds_bucket{le="+Inf"} 0
+				queue_age_seconds_sum{} 0.000000
+				queue_age_seconds_count{} 0
+			`,
+		},
+		{
+			line: `queue_age_seconds{} 20 4000`,
+			want: `
+				queue_age_seconds_bucket{le="1"} 0
+				queue_age_seconds_bucket{le="10"} 0
+				queue_age_seconds_bucket{le="+Inf"} 1
+				queue_age_seconds_sum{} 20.000000
+				queue_age_seconds_count{} 1
+			`,
+		},
+	} {
+		err := u.Observe(makeObservations(t, []string{step.line})[0])
+		switch {
+		case step.wantErr == "" && err != nil:
+			t.Fatalf("%s: %v", step.line, err)
+		case step.wantErr != "" && (err == nil || !strings.Contains(err.Error(), step.wantErr)):
+			t.Fatalf("%s: want error containing %q, have %v", step.line, step.wantErr, err)
+		}
+		want := normalizeResponse(`
+			# HELP queue_age_seconds Ages of queued items in seconds.
+			# TYPE queue_age_seconds histogram` + step.want)
+		if have := normalizeResponse(scrape(t, u)); want != have {
+			t.Fatalf("%s:\n---WANT---\n%s\n\n---HAVE---\n%s\n", step.line, want, have)
+		}
+	}
+}
+
+func TestGaugeHistogramOpenMetrics(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"queue_age_seconds","type":"gaugehistogram","help":"Ages of queued items in seconds.","buckets":[1],"unit":"seconds"}`,
+		`queue_age_seconds{queue="a"} 0.5 2000`,
+		`queue_age_seconds{queue="a"} 2 2000`,
+	})...)
+	u.SetOpenMetrics(true)
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", OpenMetricsContentType)
+	u.ServeHTTP(rec, req)
+	if want, have := normalizeResponse(`
+		# HELP queue_age_seconds Ages of queued items in seconds.
+		# TYPE queue_age_seconds gaugehistogram
+		# UNIT queue_age_seconds seconds
+		queue_age_seconds_bucket{le="1",queue="a"} 1
+		queue_age_seconds_bucket{le="+Inf",queue="a"} 2
+		queue_age_seconds_gcount{queue="a"} 2
+		queue_age_seconds_gsum{queue="a"} 2.500000
+		# EOF
+	`), normalizeResponse(rec.Body.String()); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestGaugeHistogramSnapshot(t *testing.T) {
+	decl := `{"name":"queue_age_seconds","type":"gaugehistogram","help":"Ages of queued items in seconds.","buckets":[1]}`
+	src, _ := NewUniverse(makeObservations(t, []string{decl, `queue_age_seconds{} 0.5 2000`})...)
+	var buf bytes.Buffer
+	if err := src.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later snapshot is kept, rather than added to.
+	dst, _ := NewUniverse(makeObservations(t, []string{decl, `queue_age_seconds{} 5 3000`})...)
+	want := scrape(t, dst)
+	if _, err := dst.ReadSnapshot(bytes.NewReader(buf.Bytes()), false); err != nil {
+		t.Fatal(err)
+	}
+	if have := scrape(t, dst); want != have {
+		t.Fatalf("merge:\n---WANT---\n%s\n---HAVE---\n%s", want, have)
+	}
+
+	if _, err := dst.ReadSnapshot(bytes.NewReader(buf.Bytes()), true); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := scrape(t, src), scrape(t, dst); want != have {
+		t.Fatalf("replace:\n---WANT---\n%s\n---HAVE---\n%s", want, have)
+	}
+	loadObservations(t, dst, makeObservations(t, []string{`queue_age_seconds{} 50 1000`}))
+	if want, have := scrape(t, src), scrape(t, dst); want != have {
+		t.Fatalf("stale after replace:\n---WANT---\n%s\n---HAVE---\n%s", want, have)
+	}
+}
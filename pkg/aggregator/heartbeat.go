@@ -0,0 +1,41 @@
+package aggregator
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// heartbeatPrefix starts a heartbeat line, like "#heartbeat web-1", with
+// which a sender says it's still running, even when it has nothing to
+// observe. The sender's name is optional. Like the sequence header, it's a
+// comment in the text format, so it can't be mistaken for an observation.
+const heartbeatPrefix = "#heartbeat"
+
+// Heartbeat returns the heartbeat line for the named sender, without a
+// trailing newline.
+func Heartbeat(sender string) []byte {
+	if sender == "" {
+		return []byte(heartbeatPrefix)
+	}
+	return []byte(heartbeatPrefix + " " + sender)
+}
+
+// ParseHeartbeat reports whether line, after it's decompressed, is a
+// heartbeat, and if so, returns the name of its sender, which may be empty.
+func ParseHeartbeat(line []byte) (sender string, ok bool, err error) {
+	if !bytes.HasPrefix(line, []byte(heartbeatPrefix)) {
+		return "", false, nil
+	}
+	rest := line[len(heartbeatPrefix):]
+	if len(rest) > 0 && rest[0] != ' ' {
+		return "", false, nil // e.g. "#heartbeats", just another comment
+	}
+	switch fields := bytes.Fields(rest); len(fields) {
+	case 0:
+		return "", true, nil
+	case 1:
+		return string(fields[0]), true, nil
+	default:
+		return "", true, fmt.Errorf("heartbeat must be %q, optionally followed by a sender", heartbeatPrefix)
+	}
+}
@@ -0,0 +1,27 @@
+package aggregator
+
+import "testing"
+
+func TestParseHeartbeat(t *testing.T) {
+	for input, want := range map[string]struct {
+		sender string
+		ok     bool
+		err    bool
+	}{
+		"#heartbeat":             {"", true, false},
+		"#heartbeat web-1":       {"web-1", true, false},
+		"#heartbeat  web-1 ":     {"web-1", true, false},
+		"#heartbeat web-1 web-2": {"", true, true},
+		"#heartbeats":            {"", false, false},
+		"#seq web-1 1":           {"", false, false},
+		`foo_total{} 1`:          {"", false, false},
+	} {
+		sender, ok, err := ParseHeartbeat([]byte(input))
+		if sender != want.sender || ok != want.ok || (err != nil) != want.err {
+			t.Errorf("%q: want (%q, %v, error %v), have (%q, %v, %v)", input, want.sender, want.ok, want.err, sender, ok, err)
+		}
+	}
+	if sender, ok, err := ParseHeartbeat(Heartbeat("web-1")); sender != "web-1" || !ok || err != nil {
+		t.Errorf("Heartbeat: want web-1, have (%q, %v, %v)", sender, ok, err)
+	}
+}
@@ -0,0 +1,126 @@
+package aggregator
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Interner deduplicates metric names, label names, and label values, so that
+// series with the same strings share their memory, rather than each holding
+// copies from the lines that created them. It holds at most max strings, of
+// at most maxInternedLen bytes each, so that high cardinality values, like
+// IDs, can't make it grow without bound; once it's full, new strings are
+// simply not interned. A nil Interner interns nothing.
+type Interner struct {
+	hits   uint64 // atomic, first for alignment
+	misses uint64 // atomic
+	max    int
+	full   int32 // atomic, whether max strings are interned
+
+	mtx     sync.RWMutex
+	strings map[string]string
+	bytes   int
+}
+
+// DefaultInternMaxStrings is the default maximum number of interned strings.
+const DefaultInternMaxStrings = 65536
+
+// maxInternedLen is the length of the longest string that's interned. Longer
+// strings are unlikely to repeat.
+const maxInternedLen = 128
+
+// NewInterner returns an interner that holds at most max strings.
+func NewInterner(max int) *Interner {
+	return &Interner{
+		max:     max,
+		strings: map[string]string{},
+	}
+}
+
+// intern returns b as a string, which is shared with earlier callers with
+// the same b, if possible.
+func (i *Interner) intern(b []byte) string {
+	if i == nil || len(b) > maxInternedLen {
+		return string(b)
+	}
+	i.mtx.RLock()
+	s, ok := i.strings[string(b)] // no allocation
+	i.mtx.RUnlock()
+	if ok {
+		atomic.AddUint64(&i.hits, 1)
+		return s
+	}
+	return i.add(string(b))
+}
+
+// internString is intern for strings that have already been allocated, such
+// as those decoded from JSON.
+func (i *Interner) internString(s string) string {
+	if i == nil || len(s) > maxInternedLen {
+		return s
+	}
+	i.mtx.RLock()
+	existing, ok := i.strings[s]
+	i.mtx.RUnlock()
+	if ok {
+		atomic.AddUint64(&i.hits, 1)
+		return existing
+	}
+	return i.add(s)
+}
+
+// add interns s, if there's room, after a miss.
+func (i *Interner) add(s string) string {
+	atomic.AddUint64(&i.misses, 1)
+	if atomic.LoadInt32(&i.full) == 1 {
+		return s
+	}
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	if existing, ok := i.strings[s]; ok {
+		return existing
+	}
+	if len(i.strings) >= i.max {
+		atomic.StoreInt32(&i.full, 1)
+		return s
+	}
+	i.strings[s] = s
+	i.bytes += len(s)
+	return s
+}
+
+// internObservation interns the name and labels of o.
+func (i *Interner) internObservation(o *Observation) {
+	if i == nil {
+		return
+	}
+	o.Name = i.internString(o.Name)
+	if len(o.Labels) == 0 {
+		return
+	}
+	labels := make(map[string]string, len(o.Labels))
+	for k, v := range o.Labels {
+		labels[i.internString(k)] = i.internString(v)
+	}
+	o.Labels = labels
+}
+
+// InternStats describes an interner's effectiveness and size.
+type InternStats struct {
+	Hits    uint64 // strings found in the table
+	Misses  uint64 // strings not found in the table
+	Strings int    // strings in the table
+	Bytes   int    // total length of the strings in the table
+}
+
+// Stats returns the interner's current stats.
+func (i *Interner) Stats() InternStats {
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+	return InternStats{
+		Hits:    atomic.LoadUint64(&i.hits),
+		Misses:  atomic.LoadUint64(&i.misses),
+		Strings: len(i.strings),
+		Bytes:   i.bytes,
+	}
+}
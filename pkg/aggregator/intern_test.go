@@ -0,0 +1,55 @@
+package aggregator
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestInterner(t *testing.T) {
+	i := NewInterner(2)
+	for _, s := range []string{"foo", "bar", "foo", "baz", "baz", "bar", strings.Repeat("x", maxInternedLen+1)} {
+		if want, have := s, i.intern([]byte(s)); want != have {
+			t.Fatalf("want %q, have %q", want, have)
+		}
+	}
+	// baz doesn't fit, and the long string isn't considered.
+	if want, have := uint64(2), i.Stats().Hits; want != have {
+		t.Errorf("hits: want %d, have %d", want, have)
+	}
+	if want, have := uint64(4), i.Stats().Misses; want != have {
+		t.Errorf("misses: want %d, have %d", want, have)
+	}
+	if want, have := map[string]string{"foo": "foo", "bar": "bar"}, i.strings; !cmp.Equal(want, have) {
+		t.Errorf("strings: %s", cmp.Diff(want, have))
+	}
+	if want, have := 6, i.bytes; want != have {
+		t.Errorf("bytes: want %d, have %d", want, have)
+	}
+
+	var nilInterner *Interner
+	if want, have := "foo", nilInterner.intern([]byte("foo")); want != have {
+		t.Errorf("nil interner: want %q, have %q", want, have)
+	}
+}
+
+func TestParseLineInterned(t *testing.T) {
+	i := NewInterner(DefaultInternMaxStrings)
+	for _, line := range []string{
+		`{"name":"foo","type":"counter","help":"Total foos.","labels":{"code":"200"}}`,
+		`foo{code="200"} 1`,
+		`foo{code="500"} 1`,
+	} {
+		if _, err := ParseLine([]byte(line), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// foo, code, 200, and 500.
+	if want, have := 4, len(i.strings); want != have {
+		t.Errorf("strings: want %d, have %d", want, have)
+	}
+	if want, have := uint64(5), i.Stats().Hits; want != have {
+		t.Errorf("hits: want %d, have %d", want, have)
+	}
+}
@@ -0,0 +1,75 @@
+package aggregator
+
+import (
+	"fmt"
+)
+
+// Limits bound the size of each observation, so a client that accidentally
+// sends, say, a megabyte label value can't exhaust memory with it. Zero is
+// unlimited.
+type Limits struct {
+	MaxLabels          int // per series
+	MaxLabelValueBytes int
+	MaxNameBytes       int // of the metric name, and of each label name
+}
+
+// SetLimits sets the limits that observations and declarations must be
+// within. It may be called while the universe is served. Existing series
+// aren't affected.
+func (u *Universe) SetLimits(l Limits) error {
+	if l.MaxLabels < 0 || l.MaxLabelValueBytes < 0 || l.MaxNameBytes < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	u.limits.Store(l)
+	return nil
+}
+
+// Limits returns the limits set with SetLimits, which are zero until set.
+func (u *Universe) Limits() Limits {
+	l, _ := u.limits.Load().(Limits)
+	return l
+}
+
+// Kinds of limit, in a LimitError.
+const (
+	LimitSize   = "size"   // any of the Limits
+	LimitMemory = "memory" // the memory limit, set with SetMemoryLimit
+)
+
+// LimitError is the error for an observation that's rejected because it would
+// exceed one of the universe's limits, rather than because it's invalid, so
+// that limit breaches can be told apart from bad data.
+type LimitError struct {
+	Limit string // LimitSize or LimitMemory
+	Err   error
+}
+
+func (e LimitError) Error() string {
+	return e.Err.Error()
+}
+
+// check returns an error describing the first limit o exceeds, if any.
+func (l Limits) check(o Observation) error {
+	if err := l.exceeded(o); err != nil {
+		return LimitError{LimitSize, err}
+	}
+	return nil
+}
+
+func (l Limits) exceeded(o Observation) error {
+	if l.MaxNameBytes > 0 && len(o.Name) > l.MaxNameBytes {
+		return fmt.Errorf("metric name is %d bytes, exceeding the maximum of %d", len(o.Name), l.MaxNameBytes)
+	}
+	if l.MaxLabels > 0 && len(o.Labels) > l.MaxLabels {
+		return fmt.Errorf("%d labels exceed the maximum of %d", len(o.Labels), l.MaxLabels)
+	}
+	for name, value := range o.Labels {
+		if l.MaxNameBytes > 0 && len(name) > l.MaxNameBytes {
+			return fmt.Errorf("label name is %d bytes, exceeding the maximum of %d", len(name), l.MaxNameBytes)
+		}
+		if l.MaxLabelValueBytes > 0 && len(value) > l.MaxLabelValueBytes {
+			return fmt.Errorf("label %q value is %d bytes, exceeding the maximum of %d", name, len(value), l.MaxLabelValueBytes)
+		}
+	}
+	return nil
+}
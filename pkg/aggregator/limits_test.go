@@ -0,0 +1,62 @@
+package aggregator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	}))
+	if err := u.SetLimits(Limits{MaxLabels: 2, MaxLabelValueBytes: 8, MaxNameBytes: 16}); err != nil {
+		t.Fatal(err)
+	}
+	for name, testcase := range map[string]struct {
+		line    string
+		wantErr string
+	}{
+		"within":           {`foo_total{a="12345678",b="2"} 1`, ""},
+		"too many labels":  {`foo_total{a="1",b="2",c="3"} 1`, "3 labels exceed the maximum of 2"},
+		"long label value": {`foo_total{a="123456789"} 1`, `label "a" value is 9 bytes`},
+		"long label name":  {`foo_total{abcdefghijklmnopq="1"} 1`, "label name is 17 bytes"},
+		"long metric name": {`{"name":"foo_bar_baz_qux_total","type":"counter","help":"Foo."}`, "metric name is 21 bytes"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			o, err := ParseLine([]byte(testcase.line), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = u.Observe(o)
+			switch {
+			case testcase.wantErr == "" && err != nil:
+				t.Errorf("want no error, have %v", err)
+			case testcase.wantErr != "" && (err == nil || !strings.Contains(err.Error(), testcase.wantErr)):
+				t.Errorf("want error containing %q, have %v", testcase.wantErr, err)
+			case testcase.wantErr != "":
+				if e, ok := err.(LimitError); !ok || e.Limit != LimitSize {
+					t.Errorf("want a %s LimitError, have %#v", LimitSize, err)
+				}
+			}
+			if _, _, _, err := u.DryRun(o); (err != nil) != (testcase.wantErr != "") {
+				t.Errorf("DryRun: want error %v, have %v", testcase.wantErr != "", err)
+			}
+		})
+	}
+
+	err := u.ObserveBatch(makeObservations(t, []string{
+		`foo_total{a="1"} 1`,
+		`foo_total{a="123456789"} 1`,
+	}))
+	if errs, ok := err.(BatchError); !ok || errs[0] != nil || errs[1] == nil {
+		t.Errorf("ObserveBatch: want only the second to fail, have %v", err)
+	}
+	if _, ok := u.Lookup("foo_total", map[string]string{"a": "123456789"}); ok {
+		t.Errorf("series over the limits was created")
+	}
+
+	if err := u.SetLimits(Limits{MaxLabels: -1}); err == nil {
+		t.Errorf("negative limit: want error, have none")
+	}
+}
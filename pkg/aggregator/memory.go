@@ -0,0 +1,282 @@
+package aggregator
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ShedPolicy decides what happens once the series in a universe are
+// estimated to use its memory limit.
+type ShedPolicy string
+
+const (
+	// ShedReject rejects observations that would create new series. Existing
+	// series carry on being observed.
+	ShedReject ShedPolicy = "reject"
+
+	// ShedEvict accepts new series, and Evict removes the least recently
+	// observed series, until the estimate is back within the limit.
+	ShedEvict ShedPolicy = "evict"
+
+	// ShedSpill is ShedEvict, except that Evict spills series to the spill
+	// directory, rather than removing them. Spilled series are still
+	// scraped, read from disk, and they're paged back in when they're
+	// observed again.
+	ShedSpill ShedPolicy = "spill"
+)
+
+// Approximate sizes in bytes, on 64-bit platforms, of the parts of a series
+// that don't depend on its name and labels. The estimate of a series is fixed
+// when it's created, so that it can be subtracted exactly when the series is
+// removed, and it doesn't account for sharing interned strings.
+const (
+	seriesOverheadBytes = 256  // the value, and its entries in the collection and lock-free maps
+	labelOverheadBytes  = 64   // per label, its map entry and string headers
+	bucketOverheadBytes = 32   // per histogram bucket, or gauge min/max window bucket
+	sketchBytes         = 1024 // per distribution sketch, which grows with the spread of values
+)
+
+// SetMemoryLimit sets the estimated memory, in bytes, that the series in the
+// universe may use, and what happens once they do. Zero is unlimited. It must
+// be called before the universe is served.
+func (u *Universe) SetMemoryLimit(max int64, shed ShedPolicy) error {
+	if max < 0 {
+		return fmt.Errorf("memory limit can't be negative")
+	}
+	switch shed {
+	case ShedReject, ShedEvict:
+	case ShedSpill:
+		if u.policies.spill == nil {
+			return fmt.Errorf("shed policy '%s' requires a spill directory", shed)
+		}
+	default:
+		return fmt.Errorf("invalid shed policy '%s'", shed)
+	}
+	u.policies.memory = &memoryPool{max: max, shed: shed, universes: []*Universe{u}}
+	return nil
+}
+
+// ResizeMemoryLimit changes the memory limit set with SetMemoryLimit, keeping
+// its shed policy, for every universe that shares it. Zero is unlimited. It
+// may be called while the universe is served.
+func (u *Universe) ResizeMemoryLimit(max int64) error {
+	if max < 0 {
+		return fmt.Errorf("memory limit can't be negative")
+	}
+	if u.policies.memory == nil {
+		return fmt.Errorf("memory limit isn't set")
+	}
+	atomic.StoreInt64(&u.policies.memory.max, max)
+	return nil
+}
+
+// ShareMemoryLimit makes the universe share the memory limit of root, and
+// its shed policy, rather than having its own: the series of both count
+// towards the limit, and root's Evict evicts from both, while the
+// universe's Evict does nothing. The limit of root must be set first. It
+// must be called before the universe is served, but root may be served
+// already.
+func (u *Universe) ShareMemoryLimit(root *Universe) error {
+	pool := root.policies.memory
+	if pool == nil {
+		return fmt.Errorf("memory limit isn't set")
+	}
+	if pool.shed == ShedSpill && u.policies.spill == nil {
+		return fmt.Errorf("shed policy '%s' requires a spill directory", pool.shed)
+	}
+	pool.mtx.Lock()
+	pool.universes = append(pool.universes, u)
+	pool.mtx.Unlock()
+	u.policies.memory = pool
+	return nil
+}
+
+// memoryPool is a memory limit, and the universes whose series count
+// towards it. The first universe is the one whose limit it is, which evicts
+// from them all.
+type memoryPool struct {
+	max  int64 // atomic, estimated memory of every series, 0 is unlimited, first for alignment
+	shed ShedPolicy
+
+	mtx       sync.RWMutex
+	universes []*Universe
+}
+
+// members returns the universes in the pool.
+func (p *memoryPool) members() []*Universe {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.universes[:len(p.universes):len(p.universes)]
+}
+
+// bytes returns the estimated memory used by the series of every universe in
+// the pool.
+func (p *memoryPool) bytes() int64 {
+	var n int64
+	for _, u := range p.members() {
+		n += u.MemoryBytes()
+	}
+	return n
+}
+
+// MemoryBytes returns the estimated memory used by every series in the
+// universe.
+func (u *Universe) MemoryBytes() int64 {
+	var n int64
+	for _, s := range u.shards {
+		n += atomic.LoadInt64(&s.bytes)
+	}
+	return n
+}
+
+// FamilyMemoryBytes returns the estimated memory used by the series of each
+// collection, by metric name.
+func (u *Universe) FamilyMemoryBytes() map[string]int64 {
+	bytes := map[string]int64{}
+	for _, s := range u.shards {
+		s.mtx.Lock()
+		for n, c := range s.collections {
+			bytes[string(n)] = c.bytes
+		}
+		s.mtx.Unlock()
+	}
+	return bytes
+}
+
+// checkMemory returns an error if a new series would be rejected, because
+// the memory limit has been reached.
+func (p *observePolicies) checkMemory() error {
+	if m := p.memory; m != nil && m.shed == ShedReject {
+		if max := atomic.LoadInt64(&m.max); max > 0 && m.bytes() >= max {
+			return LimitError{LimitMemory, fmt.Errorf("memory limit of %d bytes reached, so new series are rejected", max)}
+		}
+	}
+	return nil
+}
+
+// Evict removes the least recently observed series, with ShedEvict, or
+// spills them, with ShedSpill, until the estimated memory they use is within
+// the limit, and returns how many were removed. Like Expire, after which it
+// should be called, it should be called periodically. Series that are only
+// declared aren't removed, and series of metrics with top K labels, which
+// may fold them away, are removed rather than spilled. If the universe
+// shares the limit of another, it evicts nothing, and the other evicts from
+// both.
+func (u *Universe) Evict() int {
+	m := u.policies.memory
+	if m == nil || (m.shed != ShedEvict && m.shed != ShedSpill) {
+		return 0
+	}
+	max := atomic.LoadInt64(&m.max)
+	if max <= 0 {
+		return 0
+	}
+	members := m.members()
+	if members[0] != u {
+		return 0
+	}
+	excess := m.bytes() - max
+	if excess <= 0 {
+		return 0
+	}
+	type candidate struct {
+		i     int // of the universe in members
+		s     *universeShard
+		n     metricName
+		k     timeseriesKey
+		seen  int64
+		bytes int64
+	}
+	// Every observation stamps its series with the clock, which only Expire
+	// moves, so it's moved on by a tick, to tell series observed since the
+	// candidates were found, which aren't evicted, from the candidates.
+	fresh := make([]int64, len(members))
+	for i, member := range members {
+		if now := atomic.LoadInt64(&member.clock); now != 0 {
+			fresh[i] = atomic.AddInt64(&member.clock, 1)
+		}
+	}
+	var candidates []candidate
+	for i, member := range members {
+		for _, s := range member.shards {
+			s.mtx.Lock()
+			for n, c := range s.collections {
+				for k, v := range c.values {
+					if v.touched() && (fresh[i] == 0 || v.seenAt() < fresh[i]) {
+						candidates = append(candidates, candidate{i, s, n, k, v.seenAt(), seriesBytes(k, v)})
+					}
+				}
+			}
+			s.mtx.Unlock()
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].seen != candidates[j].seen {
+			return candidates[i].seen < candidates[j].seen
+		}
+		if candidates[i].i != candidates[j].i {
+			return candidates[i].i < candidates[j].i
+		}
+		return candidates[i].k < candidates[j].k
+	})
+	var evicted int
+	for _, x := range candidates {
+		if excess <= 0 {
+			break
+		}
+		x.s.mtx.Lock()
+		if c, ok := x.s.collections[x.n]; ok {
+			if v, ok := c.values[x.k]; ok && v.seenAt() == x.seen { // not observed since
+				if m.shed == ShedSpill && c.topK == nil {
+					// Retired first, so that it's spilled with every observation.
+					retireLockFree(v)
+					members[x.i].policies.spill.put(x.n, x.k, v) // if it fails, the series is lost, as with ShedEvict
+				}
+				x.s.remove(c, x.k)
+				excess -= x.bytes
+				evicted++
+			}
+		}
+		x.s.mtx.Unlock()
+	}
+	return evicted
+}
+
+// remove removes the series k from the collection c, in the shard, which
+// must be locked.
+func (s *universeShard) remove(c *timeseriesCollection, k timeseriesKey) {
+	retireLockFree(c.values[k])
+	b := seriesBytes(k, c.values[k])
+	delete(c.values, k)
+	s.lockFree.Delete(k)
+	c.bytes -= b
+	atomic.AddInt64(&s.bytes, -b)
+}
+
+// seriesBytes estimates the memory used by the series k, whose value is v.
+// The key is stored once, and rendered into the prefix of each sample.
+func seriesBytes(k timeseriesKey, v timeseriesValue) int64 {
+	n := seriesOverheadBytes + 2*len(k)
+	for name, value := range seriesLabels(v) {
+		n += labelOverheadBytes + len(name) + len(value)
+	}
+	switch v := v.(type) {
+	case *counter:
+		if v.rates != nil {
+			n += len(v.rates.samples)*16 + len(v.rates.prefixes)*2*len(k)
+		}
+	case *gauge:
+		if v.minMax != nil {
+			n += len(v.minMax.buckets)*bucketOverheadBytes + 2*len(k)
+		}
+	case *histogram:
+		n += len(v.buckets)*(bucketOverheadBytes+len(k)) + 2*len(k)
+	case *gaugeHistogram:
+		n += len(v.buckets)*(bucketOverheadBytes+len(k)) + 4*len(k)
+	case *distribution:
+		n += len(v.window.sketches)*sketchBytes + (len(v.quantiles)+1)*len(k)
+	}
+	return int64(n)
+}
@@ -0,0 +1,169 @@
+package aggregator
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryAccounting(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`{"name":"bar_seconds","type":"histogram","help":"Bar duration.","buckets":[0.1,1]}`,
+		`{"name":"baz","type":"distribution","help":"Baz.","quantiles":[0.5,0.9]}`,
+		`{"name":"qux","type":"gauge","help":"Qux.","top_k":1,"top_k_label":"q"}`,
+	}))
+	declared := u.MemoryBytes()
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{code="200"} 1`,
+		`foo_total{code="500"} 1`,
+		`foo_total{code="500"} 1`, // not a new series
+		`bar_seconds{x="1"} 0.5`,
+		`baz{x="1"} 1`,
+		`qux{q="a"} 1`,
+		`qux{q="b"} 1`,
+		`qux{q="b"} 1`, // b replaces a in the top 1
+	}))
+
+	var sum int64
+	for _, n := range u.FamilyMemoryBytes() {
+		sum += n
+	}
+	if have := u.MemoryBytes(); have != sum || have <= declared {
+		t.Fatalf("want the sum of the families, %d, more than declared, %d, have %d", sum, declared, have)
+	}
+	families := u.FamilyMemoryBytes()
+	if families["baz"] <= families["foo_total"] {
+		t.Errorf("want a distribution series to be estimated larger than two counter series, have %v", families)
+	}
+
+	u.Delete("foo_total", map[string]string{"code": "200"})
+	u.Delete("foo_total", map[string]string{"code": "500"})
+	u.Expire(time.Unix(1, 0), time.Second) // timestamps the rest
+	u.Expire(time.Unix(3, 0), time.Second)
+	if want, have := declared, u.MemoryBytes(); want != have {
+		t.Errorf("after removing every series: want %d, as declared, have %d", want, have)
+	}
+}
+
+func TestMemoryLimitReject(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	if err := u.SetMemoryLimit(u.MemoryBytes()+1, ShedReject); err != nil {
+		t.Fatal(err)
+	}
+	loadObservations(t, u, makeObservations(t, []string{`foo_total{a="1"} 1`}))
+	o := makeObservations(t, []string{`foo_total{a="2"} 1`})[0]
+	if err := u.Observe(o); err == nil || !strings.Contains(err.Error(), "memory limit") {
+		t.Errorf("new series: want memory limit error, have %v", err)
+	} else if e, ok := err.(LimitError); !ok || e.Limit != LimitMemory {
+		t.Errorf("new series: want a %s LimitError, have %#v", LimitMemory, err)
+	}
+	if err := u.ObserveBatch([]Observation{o}); err == nil {
+		t.Errorf("new series in a batch: want error, have none")
+	}
+	loadObservations(t, u, makeObservations(t, []string{`foo_total{a="1"} 1`}))
+	if s, _ := u.Lookup("foo_total", map[string]string{"a": "1"}); *s.Value != 2 {
+		t.Errorf("existing series: want 2, have %v", *s.Value)
+	}
+	if want, have := 0, u.Evict(); want != have {
+		t.Errorf("Evict: want %d, have %d", want, have)
+	}
+	if err := u.ResizeMemoryLimit(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Observe(o); err != nil {
+		t.Errorf("new series once unlimited: want no error, have %v", err)
+	}
+}
+
+func TestMemoryLimitEvict(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	declared := u.MemoryBytes()
+	for i := 0; i < 4; i++ {
+		u.Expire(time.Unix(int64(i+1), 0), 0)
+		loadObservations(t, u, makeObservations(t, []string{fmt.Sprintf(`foo_total{a="%d"} 1`, i)}))
+	}
+	perSeries := (u.MemoryBytes() - declared) / 4
+	if err := u.SetMemoryLimit(declared+2*perSeries, ShedEvict); err != nil {
+		t.Fatal(err)
+	}
+	loadObservations(t, u, makeObservations(t, []string{`foo_total{a="0"} 2`})) // now the most recent
+	if want, have := 2, u.Evict(); want != have {
+		t.Fatalf("Evict: want %d, have %d", want, have)
+	}
+	for a, want := range map[string]bool{"0": true, "1": false, "2": false, "3": true} {
+		if _, have := u.Lookup("foo_total", map[string]string{"a": a}); want != have {
+			t.Errorf("a=%s: want %v, have %v", a, want, have)
+		}
+	}
+	if want, have := 0, u.Evict(); want != have {
+		t.Errorf("Evict within the limit: want %d, have %d", want, have)
+	}
+}
+
+func TestShareMemoryLimit(t *testing.T) {
+	decls := makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})
+	root, _ := NewUniverse(decls...)
+	other, _ := NewUniverse(decls...)
+	if err := other.ShareMemoryLimit(root); err == nil {
+		t.Errorf("before the limit is set: want error, have none")
+	}
+	declared := root.MemoryBytes() + other.MemoryBytes()
+	for i, u := range []*Universe{root, other, other} {
+		root.Expire(time.Unix(int64(i+1), 0), 0)
+		other.Expire(time.Unix(int64(i+1), 0), 0)
+		loadObservations(t, u, makeObservations(t, []string{fmt.Sprintf(`foo_total{a="%d"} 1`, i)}))
+	}
+	perSeries := (root.MemoryBytes() + other.MemoryBytes() - declared) / 3
+	if err := root.SetMemoryLimit(declared+2*perSeries, ShedEvict); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.ShareMemoryLimit(root); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 0, other.Evict(); want != have {
+		t.Errorf("Evict of the sharing universe: want %d, have %d", want, have)
+	}
+	if want, have := 1, root.Evict(); want != have {
+		t.Fatalf("Evict: want %d, have %d", want, have)
+	}
+	if _, ok := root.Lookup("foo_total", map[string]string{"a": "0"}); ok {
+		t.Errorf("a=0, the least recently observed of both: want evicted, have it")
+	}
+	for _, a := range []string{"1", "2"} {
+		if _, ok := other.Lookup("foo_total", map[string]string{"a": a}); !ok {
+			t.Errorf("a=%s: want it, have none", a)
+		}
+	}
+
+	if err := root.SetMemoryLimit(root.MemoryBytes()+other.MemoryBytes(), ShedReject); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.ShareMemoryLimit(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Observe(makeObservations(t, []string{`foo_total{a="3"} 1`})[0]); err == nil {
+		t.Errorf("new series over the shared limit: want error, have none")
+	}
+}
+
+func TestSetMemoryLimitErrors(t *testing.T) {
+	u, _ := NewUniverse()
+	if err := u.SetMemoryLimit(-1, ShedReject); err == nil {
+		t.Errorf("negative: want error, have none")
+	}
+	if err := u.SetMemoryLimit(1, "drop"); err == nil {
+		t.Errorf("invalid policy: want error, have none")
+	}
+	if err := u.ResizeMemoryLimit(1); err == nil {
+		t.Errorf("resize before it's set: want error, have none")
+	}
+}
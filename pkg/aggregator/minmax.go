@@ -0,0 +1,150 @@
+package aggregator
+
+import (
+	"fmt"
+	"time"
+)
+
+// minMaxParams are the declared parameters of a gauge's min and max series.
+type minMaxParams struct {
+	enabled       bool
+	window        time.Duration // 0 is since the last scrape
+	windowBuckets int
+}
+
+// parseMinMaxParams returns the parameters declared by o, for a gauge.
+func parseMinMaxParams(o Observation) (p minMaxParams, err error) {
+	p.enabled = o.MinMax
+	if p.window, p.windowBuckets, err = parseWindow(o); err != nil {
+		return p, err
+	}
+	if p.window > 0 && !p.enabled {
+		return p, fmt.Errorf("a gauge's window only applies with min_max")
+	}
+	return p, nil
+}
+
+// declared returns o with the parameters.
+func (p minMaxParams) declared(o Observation) Observation {
+	o.MinMax, o.Window, o.WindowBuckets = p.enabled, "", p.windowBuckets
+	if p.window > 0 {
+		o.Window = p.window.String()
+	}
+	return o
+}
+
+// minMax is the lowest and highest values of a gauge, since the last scrape,
+// or over a sliding window: a ring of buckets, of which the oldest is reset as
+// the window moves on. Gauges with a minMax are only observed with their
+// shard locked, so it's not goroutine-safe.
+type minMax struct {
+	buckets []extremes
+	ring    windowRing // unused without a window
+	window  bool
+	last    float64 // the gauge's value, from which reset buckets start
+	started bool    // whether there's a last value
+	prefix  struct{ min, max string }
+}
+
+// extremes are the lowest and highest values in a bucket, or neither.
+type extremes struct {
+	min, max float64
+	set      bool
+}
+
+func (e *extremes) add(v float64) {
+	if !e.set || v < e.min {
+		e.min = v
+	}
+	if !e.set || v > e.max {
+		e.max = v
+	}
+	e.set = true
+}
+
+func newMinMax(p minMaxParams, name string, labels map[string]string, now func() time.Time) *minMax {
+	m := &minMax{buckets: make([]extremes, 1)}
+	if p.window > 0 {
+		m.buckets = make([]extremes, p.windowBuckets)
+		m.ring = newWindowRing(p.window, p.windowBuckets, now)
+		m.window = true
+	}
+	m.prefix.min = renderSeries(name+"_min", labels)
+	m.prefix.max = renderSeries(name+"_max", labels)
+	return m
+}
+
+// add records v, the new value of the gauge.
+func (m *minMax) add(v float64) {
+	m.rotate()
+	m.buckets[m.ring.head].add(v)
+	m.last, m.started = v, true
+}
+
+// current returns the extremes of every bucket. The gauge must be touched.
+func (m *minMax) current() extremes {
+	m.rotate()
+	var e extremes
+	for _, b := range m.buckets {
+		if b.set {
+			e.add(b.min)
+			e.add(b.max)
+		}
+	}
+	return e
+}
+
+// scraped starts a new interval, if there's no window.
+func (m *minMax) scraped() {
+	if !m.window {
+		m.reset(0)
+	}
+}
+
+// rotate resets the buckets that have left the window, starting them with
+// the gauge's value, which it still had at the start of the bucket.
+func (m *minMax) rotate() {
+	if !m.window {
+		return
+	}
+	m.ring.rotate(m.reset)
+}
+
+func (m *minMax) reset(i int) {
+	m.buckets[i] = extremes{min: m.last, max: m.last, set: m.started}
+}
+
+// appendMinMax appends the min and max gauge families of the gauge
+// collection c, which must be locked, to b. Without a window, it starts a new
+// interval for each series.
+func (c *timeseriesCollection) appendMinMax(b []byte, n metricName) []byte {
+	over := "since the last scrape"
+	if c.minMax.window > 0 {
+		over = "over the last " + c.minMax.window.String()
+	}
+	keys := sortTimeseriesKeys(c.values)
+	for _, family := range []struct {
+		suffix, adjective string
+		sample            func(*minMax) (prefix string, value float64)
+	}{
+		{"_min", "Lowest", func(m *minMax) (string, float64) { return m.prefix.min, m.current().min }},
+		{"_max", "Highest", func(m *minMax) (string, float64) { return m.prefix.max, m.current().max }},
+	} {
+		name := string(n) + family.suffix
+		b = append(b, "# HELP "+renderName(name)+" "+family.adjective+" value of "+string(n)+", "+over+".\n"...)
+		b = append(b, "# TYPE "+renderName(name)+" gauge\n"...)
+		for _, k := range keys {
+			g := c.values[k].(*gauge)
+			if !g.touched() {
+				continue
+			}
+			prefix, value := family.sample(g.minMax)
+			b = appendSample(b, prefix, value)
+		}
+		b = append(b, '\n')
+	}
+	for _, v := range c.values {
+		v.(*gauge).minMax.scraped()
+	}
+	return b
+}
@@ -0,0 +1,88 @@
+package aggregator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMinMax(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"queue_depth","type":"gauge","help":"Current queue depth.","min_max":true}`,
+		`queue_depth{queue="a"} 5`,
+		`queue_depth{queue="a"} 20`,
+		`queue_depth{queue="a"} 2`,
+		`queue_depth{queue="a"} 10`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP queue_depth Current queue depth.
+		# TYPE queue_depth gauge
+		queue_depth{queue="a"} 10.000000
+
+		# HELP queue_depth_min Lowest value of queue_depth, since the last scrape.
+		# TYPE queue_depth_min gauge
+		queue_depth_min{queue="a"} 2.000000
+
+		# HELP queue_depth_max Highest value of queue_depth, since the last scrape.
+		# TYPE queue_depth_max gauge
+		queue_depth_max{queue="a"} 20.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	// The next interval starts from the gauge's value.
+	loadObservations(t, u, makeObservations(t, []string{`queue_depth{queue="a"} 12`}))
+	s, _ := u.Lookup("queue_depth", map[string]string{"queue": "a"})
+	if s.Min == nil || s.Max == nil {
+		t.Fatalf("snapshot: want min and max, have %+v", s)
+	}
+	if want, have := 10.0, *s.Min; want != have {
+		t.Errorf("min: want %v, have %v", want, have)
+	}
+	if want, have := 12.0, *s.Max; want != have {
+		t.Errorf("max: want %v, have %v", want, have)
+	}
+
+	for name, o := range map[string]Observation{
+		"disable min_max":        {Name: "queue_depth", Type: "gauge", Help: "Current queue depth."},
+		"window without min_max": {Name: "foo", Type: "gauge", Help: "Foo.", Window: "1m"},
+		"too many buckets":       {Name: "foo", Type: "gauge", Help: "Foo.", MinMax: true, Window: "1h", WindowBuckets: 20000000},
+		"too short buckets":      {Name: "foo", Type: "gauge", Help: "Foo.", MinMax: true, Window: "1ns"},
+	} {
+		if err := u.CheckDeclaration(o); err == nil {
+			t.Errorf("%s: want error, have none", name)
+		}
+	}
+}
+
+func TestMinMaxWindow(t *testing.T) {
+	p, err := parseMinMaxParams(Observation{MinMax: true, Window: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		now = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		m   = newMinMax(p, "foo", nil, func() time.Time { return now })
+	)
+	m.add(100) // bucket [0s, 10s)
+	m.add(50)
+	now = now.Add(25 * time.Second)
+	m.add(1) // bucket [20s, 30s)
+	if want, have := (extremes{1, 100, true}), m.current(); want != have {
+		t.Fatalf("at 25s: want %+v, have %+v", want, have)
+	}
+	m.scraped() // no effect with a window
+
+	// Once the first bucket leaves the window, the gauge was 50 at the start
+	// of the next.
+	now = now.Add(35 * time.Second)
+	if want, have := (extremes{1, 50, true}), m.current(); want != have {
+		t.Fatalf("at 60s: want %+v, have %+v", want, have)
+	}
+
+	// After a whole window without observations, only the value is left.
+	now = now.Add(time.Hour)
+	if want, have := (extremes{1, 1, true}), m.current(); want != have {
+		t.Fatalf("after an hour: want %+v, have %+v", want, have)
+	}
+}
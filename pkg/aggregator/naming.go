@@ -0,0 +1,65 @@
+package aggregator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CounterSuffixPolicy decides what happens to counters whose names don't end
+// with _total, as the naming conventions say they should.
+type CounterSuffixPolicy string
+
+const (
+	// CounterSuffixIgnore exports counters as they're named.
+	CounterSuffixIgnore CounterSuffixPolicy = "ignore"
+
+	// CounterSuffixReject rejects the declarations of counters without the
+	// suffix.
+	CounterSuffixReject CounterSuffixPolicy = "reject"
+
+	// CounterSuffixAppend appends the suffix to the names of counters
+	// without it, when they're exported. They're still observed, and
+	// looked up, by the names they're declared with.
+	CounterSuffixAppend CounterSuffixPolicy = "append"
+)
+
+// SetCounterSuffixPolicy sets what happens to counters whose names don't end
+// with _total. It must be called before the universe is served.
+func (u *Universe) SetCounterSuffixPolicy(policy CounterSuffixPolicy) error {
+	switch policy {
+	case CounterSuffixIgnore, CounterSuffixReject, CounterSuffixAppend:
+	default:
+		return fmt.Errorf("invalid counter suffix policy '%s'", policy)
+	}
+	u.policies.counterSuffix = policy
+	return nil
+}
+
+// checkNaming returns an error if o declares a metric whose name doesn't
+// follow the naming conventions that the policies enforce.
+func (p *observePolicies) checkNaming(o Observation) error {
+	if err := p.checkUnit(o); err != nil {
+		return err
+	}
+	if o.Type == "counter" && p.counterSuffix == CounterSuffixReject && !strings.HasSuffix(o.Name, "_total") {
+		return fmt.Errorf("counter name %s doesn't end with _total", o.Name)
+	}
+	return nil
+}
+
+// exportedName returns the name a metric of the type is exported with.
+func (p *observePolicies) exportedName(name, typ string) string {
+	if typ == "counter" && p.counterSuffix == CounterSuffixAppend && !strings.HasSuffix(name, "_total") {
+		return name + "_total"
+	}
+	return name
+}
+
+// renameSample returns the rendered sample with its metric name, which may
+// be quoted, replaced.
+func renameSample(sample, name, newName string) string {
+	if strings.HasPrefix(sample, `{"`+name+`"`) {
+		return `{"` + newName + sample[len(name)+2:]
+	}
+	return newName + sample[len(name):]
+}
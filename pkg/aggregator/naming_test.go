@@ -0,0 +1,91 @@
+package aggregator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCounterSuffixReject(t *testing.T) {
+	u, _ := NewUniverse()
+	if err := u.SetCounterSuffixPolicy(CounterSuffixReject); err != nil {
+		t.Fatal(err)
+	}
+	for decl, wantErr := range map[string]bool{
+		`{"name":"foo","type":"counter","help":"Foos."}`:       true,
+		`{"name":"foo_total","type":"counter","help":"Foos."}`: false,
+		`{"name":"bar","type":"gauge","help":"Bars."}`:         false,
+	} {
+		o := makeObservations(t, []string{decl})[0]
+		if err := u.CheckDeclaration(o); (err != nil) != wantErr {
+			t.Errorf("%s: CheckDeclaration: want error %v, have %v", decl, wantErr, err)
+		}
+		if err := u.Observe(o); (err != nil) != wantErr {
+			t.Errorf("%s: Observe: want error %v, have %v", decl, wantErr, err)
+		}
+	}
+}
+
+func TestCounterSuffixAppend(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"foo","type":"counter","help":"Foos."}`,
+		`{"name":"http.requests","type":"counter","help":"HTTP requests."}`,
+		`{"name":"bar_total","type":"counter","help":"Bars."}`,
+		`{"name":"baz","type":"gauge","help":"Current baz."}`,
+	})...)
+	if err := u.SetCounterSuffixPolicy(CounterSuffixAppend); err != nil {
+		t.Fatal(err)
+	}
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo{code="200"} 1`,
+		`{"name":"http.requests","value":2}`,
+		`bar_total{} 3`,
+		`baz{} 4`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP bar_total Bars.
+		# TYPE bar_total counter
+		bar_total{} 3.000000
+
+		# HELP baz Current baz.
+		# TYPE baz gauge
+		baz{} 4.000000
+
+		# HELP foo_total Foos.
+		# TYPE foo_total counter
+		foo_total{code="200"} 1.000000
+
+		# HELP "http.requests_total" HTTP requests.
+		# TYPE "http.requests_total" counter
+		{"http.requests_total"} 2.000000
+	`), normalizeResponse(scrapeUTF8(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+	if _, ok := u.Lookup("foo", map[string]string{"code": "200"}); !ok {
+		t.Error("want foo looked up by its declared name, have nothing")
+	}
+}
+
+func scrapeUTF8(t *testing.T, h http.Handler) string {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/plain;version=1.0.0;escaping=allow-utf-8")
+	h.ServeHTTP(rec, req)
+	return rec.Body.String()
+}
+
+func TestRenameSample(t *testing.T) {
+	for sample, want := range map[string]string{
+		`foo{} 1.000000` + "\n":               `foo_total{} 1.000000` + "\n",
+		`foo{a="b"} 1.000000` + "\n":          `foo_total{a="b"} 1.000000` + "\n",
+		`{"foo.bar","a"="b"} 1.000000` + "\n": `{"foo.bar_total","a"="b"} 1.000000` + "\n",
+	} {
+		name := "foo"
+		if sample[0] == '{' {
+			name = "foo.bar"
+		}
+		if have := renameSample(sample, name, name+"_total"); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+}
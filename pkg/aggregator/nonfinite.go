@@ -0,0 +1,189 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// NonFinitePolicy decides what happens to observed values of +Inf, -Inf, and
+// NaN, for a type of metric.
+type NonFinitePolicy string
+
+const (
+	// NonFiniteAccept observes the value as it is.
+	NonFiniteAccept NonFinitePolicy = "accept"
+
+	// NonFiniteClamp observes +Inf and -Inf as the largest and smallest
+	// finite values, and rejects NaN, which can't be clamped.
+	NonFiniteClamp NonFinitePolicy = "clamp"
+
+	// NonFiniteReject rejects the observation with an error.
+	NonFiniteReject NonFinitePolicy = "reject"
+
+	// NonFiniteDrop ignores the observation, without an error, and counts
+	// it, for clients that can't help sending the odd NaN.
+	NonFiniteDrop NonFinitePolicy = "drop"
+)
+
+// errNonFiniteDropped is returned by a shard for an observation dropped by
+// NonFiniteDrop. It's not an error to the caller.
+var errNonFiniteDropped = fmt.Errorf("non-finite observation dropped")
+
+// defaultNonFinitePolicies only accept non-finite values for gauges, which
+// legitimately take them. A single infinite observation of a counter, or the
+// sum of a histogram, would make it infinite forever.
+var defaultNonFinitePolicies = map[string]NonFinitePolicy{
+	"counter":        NonFiniteReject,
+	"gauge":          NonFiniteAccept,
+	"histogram":      NonFiniteReject,
+	"gaugehistogram": NonFiniteReject,
+	"distribution":   NonFiniteReject,
+}
+
+// SetNonFinitePolicy sets the policy for non-finite values observed for
+// metrics of the type. Distributions can't accept them. It must be called
+// before the universe is served.
+func (u *Universe) SetNonFinitePolicy(typ string, p NonFinitePolicy) error {
+	if _, ok := defaultNonFinitePolicies[typ]; !ok {
+		return fmt.Errorf("invalid type '%s'", typ)
+	}
+	switch p {
+	case NonFiniteAccept, NonFiniteClamp, NonFiniteReject, NonFiniteDrop:
+	default:
+		return fmt.Errorf("invalid policy '%s'", p)
+	}
+	if typ == "distribution" && p == NonFiniteAccept {
+		return fmt.Errorf("distributions can't accept non-finite values")
+	}
+	u.policies.nonFinite[typ] = p
+	return nil
+}
+
+// ParseNonFinitePolicies parses policies by type, like
+// "gauge=accept,counter=clamp", into a map for SetNonFinitePolicy.
+func ParseNonFinitePolicies(s string) (map[string]NonFinitePolicy, error) {
+	policies := map[string]NonFinitePolicy{}
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		eq := strings.IndexByte(field, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%q isn't type=policy", field)
+		}
+		policies[field[:eq]] = NonFinitePolicy(field[eq+1:])
+	}
+	return policies, nil
+}
+
+// NonFiniteDropped returns the number of observations that have been ignored,
+// because their values weren't finite, and the policy was NonFiniteDrop.
+func (u *Universe) NonFiniteDropped() uint64 {
+	return atomic.LoadUint64(&u.nonFiniteDropped)
+}
+
+// parseNaNPolicy parses the nan parameter of a declaration of the type, which
+// overrides the type's policy for NaN values. Only gauges can accept them.
+func parseNaNPolicy(o Observation) (NonFinitePolicy, error) {
+	switch p := NonFinitePolicy(o.NaN); p {
+	case "", NonFiniteDrop, NonFiniteReject:
+		return p, nil
+	case NonFiniteAccept:
+		if o.Type != "gauge" {
+			return "", fmt.Errorf("only gauges can accept NaN")
+		}
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid nan policy '%s', must be drop, accept, or reject", p)
+	}
+}
+
+// applyNonFinite returns v, which is non-finite, as it should be observed in
+// the collection c, according to its NaN policy, if it's NaN and it has one,
+// or else the policies.
+func (c *timeseriesCollection) applyNonFinite(policies map[string]NonFinitePolicy, v float64) (float64, error) {
+	p, typ := policies[c.typ], c.typ
+	if math.IsNaN(v) && c.nan != "" {
+		p = c.nan
+	}
+	switch p {
+	case NonFiniteAccept:
+		return v, nil
+	case NonFiniteClamp:
+		switch {
+		case math.IsInf(v, 1):
+			return math.MaxFloat64, nil
+		case math.IsInf(v, -1):
+			return -math.MaxFloat64, nil
+		default:
+			return 0, rejectf(ReasonBadValue, "NaN can't be clamped")
+		}
+	case NonFiniteDrop:
+		return 0, errNonFiniteDropped
+	default:
+		return 0, rejectf(ReasonBadValue, "non-finite %s values are rejected", typ)
+	}
+}
+
+func isFinite(v float64) bool {
+	return !math.IsInf(v, 0) && !math.IsNaN(v)
+}
+
+// observationJSON is an Observation without its methods, so it can be
+// encoded and decoded as JSON without recursing.
+type observationJSON Observation
+
+// MarshalJSON encodes a non-finite value as a string, like "+Inf", which JSON
+// numbers can't represent.
+func (o Observation) MarshalJSON() ([]byte, error) {
+	aux := struct {
+		observationJSON
+		Value *jsonFloat `json:"value,omitempty"`
+	}{observationJSON: observationJSON(o), Value: (*jsonFloat)(o.Value)}
+	return json.Marshal(aux)
+}
+
+// UnmarshalJSON accepts a value that's a string, like "+Inf", "-Inf", "NaN",
+// or "1e-9", as well as a number.
+func (o *Observation) UnmarshalJSON(p []byte) error {
+	aux := struct {
+		*observationJSON
+		Value *jsonFloat `json:"value"`
+	}{observationJSON: (*observationJSON)(o)}
+	if err := json.Unmarshal(p, &aux); err != nil {
+		return err
+	}
+	o.Value = (*float64)(aux.Value)
+	return nil
+}
+
+// jsonFloat is a float64 that's a string in JSON if it's not finite.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	if !isFinite(float64(f)) {
+		return []byte(`"` + strconv.FormatFloat(float64(f), 'f', -1, 64) + `"`), nil
+	}
+	return json.Marshal(float64(f))
+}
+
+func (f *jsonFloat) UnmarshalJSON(p []byte) error {
+	s := string(p)
+	if len(p) > 0 && p[0] == '"' {
+		if err := json.Unmarshal(p, &s); err != nil {
+			return err
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return errors.Wrapf(err, "bad value (%s)", s)
+	}
+	*f = jsonFloat(v)
+	return nil
+}
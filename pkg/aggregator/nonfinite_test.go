@@ -0,0 +1,142 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestNonFinitePolicy(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`{"name":"bar","type":"gauge","help":"Current bar."}`,
+		`{"name":"baz_seconds","type":"histogram","help":"Baz duration in seconds.","buckets":[1]}`,
+		`foo_total{} 1`,
+		`bar{} 1`,
+	}))
+	if err := u.SetNonFinitePolicy("histogram", NonFiniteClamp); err != nil {
+		t.Fatal(err)
+	}
+	for name, testcase := range map[string]struct {
+		line    string
+		wantErr bool
+	}{
+		"counter +Inf":   {`foo_total{} +Inf`, true},
+		"gauge +Inf":     {`bar{} +Inf`, false},
+		"gauge NaN":      {`bar{} NaN`, false},
+		"histogram +Inf": {`baz_seconds{} +Inf`, false},
+		"histogram NaN":  {`baz_seconds{} NaN`, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			o, err := ParseLine([]byte(testcase.line), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := u.Observe(o); (err != nil) != testcase.wantErr {
+				t.Errorf("want error %v, have %v", testcase.wantErr, err)
+			}
+		})
+	}
+
+	if s, _ := u.Lookup("foo_total", nil); *s.Value != 1 {
+		t.Errorf("foo_total: want 1, have %v", *s.Value)
+	}
+	if s, _ := u.Lookup("baz_seconds", nil); *s.Sum != math.MaxFloat64 || *s.Count != 1 {
+		t.Errorf("baz_seconds: want clamped +Inf, have sum %v, count %v", *s.Sum, *s.Count)
+	}
+
+	for name, testcase := range map[string]struct {
+		typ string
+		p   NonFinitePolicy
+	}{
+		"bad type":            {"summary", NonFiniteAccept},
+		"bad policy":          {"gauge", "ignore"},
+		"distribution accept": {"distribution", NonFiniteAccept},
+	} {
+		if err := u.SetNonFinitePolicy(testcase.typ, testcase.p); err == nil {
+			t.Errorf("%s: want error, have none", name)
+		}
+	}
+}
+
+func TestNaNPolicy(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_seconds","type":"histogram","help":"Foo duration in seconds.","buckets":[1],"nan":"drop"}`,
+		`{"name":"bar","type":"gauge","help":"Current bar.","nan":"reject"}`,
+		`{"name":"baz_total","type":"counter","help":"Total number of bazzes."}`,
+		`foo_seconds{} 0.5`,
+	}))
+	if err := u.SetNonFinitePolicy("counter", NonFiniteDrop); err != nil {
+		t.Fatal(err)
+	}
+	for name, testcase := range map[string]struct {
+		line    string
+		wantErr bool
+	}{
+		"histogram drops NaN":         {`foo_seconds{} NaN`, false},
+		"histogram still rejects Inf": {`foo_seconds{} +Inf`, true},
+		"gauge rejects NaN":           {`bar{} NaN`, true},
+		"gauge still accepts Inf":     {`bar{} +Inf`, false},
+		"counter drops NaN":           {`baz_total{} NaN`, false},
+		"counter drops Inf":           {`baz_total{} +Inf`, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			o, err := ParseLine([]byte(testcase.line), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := u.Observe(o); (err != nil) != testcase.wantErr {
+				t.Errorf("want error %v, have %v", testcase.wantErr, err)
+			}
+		})
+	}
+	if want, have := uint64(3), u.NonFiniteDropped(); want != have {
+		t.Errorf("dropped: want %d, have %d", want, have)
+	}
+	if s, _ := u.Lookup("foo_seconds", nil); *s.Sum != 0.5 || *s.Count != 1 {
+		t.Errorf("foo_seconds: want NaN dropped, have sum %v, count %v", *s.Sum, *s.Count)
+	}
+
+	for name, decl := range map[string]string{
+		"bad policy":     `{"name":"qux","type":"gauge","help":"Current qux.","nan":"ignore"}`,
+		"counter accept": `{"name":"qux_total","type":"counter","help":"Total number of quxes.","nan":"accept"}`,
+		"changed policy": `{"name":"bar","type":"gauge","help":"Current bar.","nan":"drop"}`,
+	} {
+		o, err := ParseLine([]byte(decl), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := u.CheckDeclaration(o); err == nil {
+			t.Errorf("%s: want error, have none", name)
+		}
+	}
+}
+
+func TestObservationJSON(t *testing.T) {
+	for _, input := range []string{
+		`{"name":"foo","type":"","help":"","value":1e-9}`,
+		`{"name":"foo","type":"","help":"","value":"+Inf"}`,
+		`{"name":"foo","type":"","help":"","value":"-Inf"}`,
+		`{"name":"foo","type":"","help":"","value":"NaN"}`,
+		`{"name":"foo","type":"gauge","help":"Foo."}`,
+	} {
+		t.Run(input, func(t *testing.T) {
+			o, err := ParseLine([]byte(input), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := json.Marshal(o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, have := input, string(buf); want != have {
+				t.Errorf("want %s, have %s", want, have)
+			}
+		})
+	}
+	if _, err := ParseLine([]byte(`{"name":"foo","value":"many"}`), nil); err == nil {
+		t.Errorf("want error for a bad value, have none")
+	}
+}
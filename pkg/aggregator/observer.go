@@ -0,0 +1,59 @@
+package aggregator
+
+import "fmt"
+
+// Observer applies observations. A Universe is an Observer.
+type Observer interface {
+	Observe(Observation) error
+
+	// ObserveBatch observes each observation in order. If any fail, the
+	// error is a BatchError.
+	ObserveBatch([]Observation) error
+}
+
+// BatchError holds the error for each observation in a batch, by index.
+// Observations with a nil error succeeded.
+type BatchError []error
+
+func (e BatchError) Error() string {
+	var (
+		failed int
+		first  error
+	)
+	for _, err := range e {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d of %d observations failed, first: %v", failed, len(e), first)
+}
+
+// BatchErrorAt returns the error of the i'th observation in a batch, given
+// the error returned by ObserveBatch.
+func BatchErrorAt(err error, i int) error {
+	if errs, ok := err.(BatchError); ok {
+		return errs[i]
+	}
+	return err
+}
+
+// ObserveEach implements ObserveBatch for observers that can't do better
+// than observing one observation at a time.
+func ObserveEach(o Observer, obs []Observation) error {
+	var errs BatchError
+	for i := range obs {
+		if err := o.Observe(obs[i]); err != nil {
+			if errs == nil {
+				errs = make(BatchError, len(obs))
+			}
+			errs[i] = err
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package aggregator
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// OpenMetricsContentType is the content type of the OpenMetrics text format.
+const OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// openMetricsEOF ends the OpenMetrics text format.
+const openMetricsEOF = "# EOF\n"
+
+// SetOpenMetrics sets whether scrapes that accept the OpenMetrics text format
+// are served it, with the units of metrics. Otherwise, every scrape is served
+// the Prometheus text format. It must be called before the universe is
+// served.
+func (u *Universe) SetOpenMetrics(enabled bool) {
+	u.openMetrics = enabled
+}
+
+// ServesOpenMetrics returns true if r is served the OpenMetrics text format.
+func (u *Universe) ServesOpenMetrics(r *http.Request) bool {
+	return u.openMetrics && AcceptsOpenMetrics(r)
+}
+
+// AcceptsOpenMetrics returns true if the Accept header of r includes the
+// OpenMetrics text format, as Prometheus's does by default, whatever its
+// preference.
+func AcceptsOpenMetrics(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			params := strings.Split(mediaRange, ";")
+			if strings.TrimSpace(params[0]) != "application/openmetrics-text" {
+				continue
+			}
+			accepted := true
+			for _, param := range params[1:] {
+				if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+					weight, err := strconv.ParseFloat(q[2:], 64)
+					accepted = err == nil && weight > 0
+				}
+			}
+			if accepted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// openMetricsFamily returns the OpenMetrics family name and type of a metric.
+// A counter's family is named without its _total suffix, and a counter
+// without one can only be exported as unknown.
+func openMetricsFamily(name, typ string) (string, string) {
+	if typ != "counter" {
+		return name, typ
+	}
+	if !strings.HasSuffix(name, "_total") {
+		return name, "unknown"
+	}
+	return strings.TrimSuffix(name, "_total"), typ
+}
+
+// OpenMetricsText rewrites the metadata in b, in the Prometheus text format,
+// as that of the OpenMetrics format, for metrics that aren't in a universe.
+// Blank lines are dropped, and b mustn't have quoted names.
+func OpenMetricsText(b []byte) []byte {
+	type family struct{ name, typ string }
+	var (
+		lines    = strings.Split(string(b), "\n")
+		counters = map[string]family{}
+	)
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE" && fields[3] == "counter" {
+			name, typ := openMetricsFamily(fields[2], fields[3])
+			counters[fields[2]] = family{name, typ}
+		}
+	}
+	var out bytes.Buffer
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if fields := strings.SplitN(line, " ", 4); len(fields) >= 3 && fields[0] == "#" {
+			if f, ok := counters[fields[2]]; ok {
+				fields[2] = f.name
+				if fields[1] == "TYPE" {
+					fields[3] = f.typ
+				}
+				line = strings.Join(fields, " ")
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// dropBlankLines returns b without its blank lines, which the OpenMetrics
+// format doesn't allow.
+func dropBlankLines(b []byte) []byte {
+	if !bytes.Contains(b, []byte("\n\n")) && !bytes.HasPrefix(b, []byte("\n")) {
+		return b
+	}
+	out := make([]byte, 0, len(b))
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) > 0 && line[0] != '\n' {
+			out = append(out, line...)
+		}
+	}
+	return out
+}
@@ -0,0 +1,139 @@
+package aggregator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenMetrics(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_seconds_total","type":"counter","help":"Total seconds of foo.","unit":"seconds"}`,
+		`{"name":"bar","type":"counter","help":"Number of bars."}`,
+		`{"name":"baz_bytes","type":"gauge","help":"Current size of baz.","unit":"bytes"}`,
+		`{"name":"qux","type":"gauge","help":"Current qux.","unit":"seconds"}`,
+	})...)
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_seconds_total{} 1`,
+		`bar{} 2`,
+		`baz_bytes{} 3`,
+		`qux{} 4`,
+	}))
+	const accept = "application/openmetrics-text;version=1.0.0;q=0.5,text/plain;version=0.0.4;q=0.4"
+
+	for name, testcase := range map[string]struct {
+		enabled     bool
+		contentType string
+		want        string
+	}{
+		"disabled": {
+			enabled:     false,
+			contentType: "text/plain; version=0.0.4",
+			want: `
+				# HELP bar Number of bars.
+				# TYPE bar counter
+				bar{} 2.000000
+
+				# HELP baz_bytes Current size of baz.
+				# TYPE baz_bytes gauge
+				baz_bytes{} 3.000000
+
+				# HELP foo_seconds_total Total seconds of foo.
+				# TYPE foo_seconds_total counter
+				foo_seconds_total{} 1.000000
+
+				# HELP qux Current qux.
+				# TYPE qux gauge
+				qux{} 4.000000
+			`,
+		},
+		"enabled": {
+			enabled:     true,
+			contentType: OpenMetricsContentType,
+			want: `
+				# HELP bar Number of bars.
+				# TYPE bar unknown
+				bar{} 2.000000
+				# HELP baz_bytes Current size of baz.
+				# TYPE baz_bytes gauge
+				# UNIT baz_bytes bytes
+				baz_bytes{} 3.000000
+				# HELP foo_seconds Total seconds of foo.
+				# TYPE foo_seconds counter
+				# UNIT foo_seconds seconds
+				foo_seconds_total{} 1.000000
+				# HELP qux Current qux.
+				# TYPE qux gauge
+				qux{} 4.000000
+				# EOF
+			`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			u.SetOpenMetrics(testcase.enabled)
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept", accept)
+			u.ServeHTTP(rec, req)
+			if want, have := testcase.contentType, rec.Header().Get("Content-Type"); want != have {
+				t.Errorf("Content-Type: want %q, have %q", want, have)
+			}
+			if want, have := normalizeResponse(testcase.want), normalizeResponse(rec.Body.String()); want != have {
+				t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+			}
+		})
+	}
+}
+
+func TestAcceptsOpenMetrics(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		accept string
+		want   bool
+	}{
+		"none":       {"", false},
+		"text":       {"text/plain;version=0.0.4", false},
+		"prometheus": {"application/openmetrics-text;version=1.0.0;q=0.6,application/openmetrics-text;version=0.0.1;q=0.5,text/plain;version=0.0.4;q=0.4,*/*;q=0.1", true},
+		"zero q":     {"application/openmetrics-text;q=0, text/plain", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept", testcase.accept)
+			if want, have := testcase.want, AcceptsOpenMetrics(req); want != have {
+				t.Errorf("want %v, have %v", want, have)
+			}
+		})
+	}
+}
+
+func TestOpenMetricsText(t *testing.T) {
+	in := strings.Join([]string{
+		"# HELP a_total Total number of as.",
+		"# TYPE a_total counter",
+		"a_total{} 1",
+		"",
+		"# HELP b Number of bs.",
+		"# TYPE b counter",
+		"b{} 2",
+		"",
+		"# HELP c Current c.",
+		"# TYPE c gauge",
+		"c{} 3",
+		"",
+	}, "\n")
+	want := strings.Join([]string{
+		"# HELP a Total number of as.",
+		"# TYPE a counter",
+		"a_total{} 1",
+		"# HELP b Number of bs.",
+		"# TYPE b unknown",
+		"b{} 2",
+		"# HELP c Current c.",
+		"# TYPE c gauge",
+		"c{} 3",
+		"",
+	}, "\n")
+	if have := string(OpenMetricsText([]byte(in))); want != have {
+		t.Errorf("\n---WANT---\n%s\n---HAVE---\n%s", want, have)
+	}
+}
@@ -0,0 +1,249 @@
+package aggregator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// LineFormat is the format of lines, either of which is detected by
+// LineFormatAuto.
+type LineFormat string
+
+const (
+	// LineFormatAuto detects the format of each line.
+	LineFormatAuto LineFormat = "auto"
+
+	// LineFormatJSON only accepts JSON lines.
+	LineFormatJSON LineFormat = "json"
+
+	// LineFormatPrometheus only accepts lines in the Prometheus text format,
+	// which may start with a quoted metric name, without checking whether
+	// they're JSON.
+	LineFormatPrometheus LineFormat = "prometheus"
+)
+
+// ParseLineFormat parses the name of a line format. The empty string is
+// LineFormatAuto.
+func ParseLineFormat(s string) (LineFormat, error) {
+	switch f := LineFormat(s); f {
+	case "":
+		return LineFormatAuto, nil
+	case LineFormatAuto, LineFormatJSON, LineFormatPrometheus:
+		return f, nil
+	default:
+		return "", fmt.Errorf("invalid line format '%s', must be auto, json, or prometheus", s)
+	}
+}
+
+// ParseLine parses a line in either format, interning its strings with strs,
+// which may be nil.
+func ParseLine(p []byte, strs *Interner) (o Observation, err error) {
+	return ParseLineAs(p, strs, LineFormatAuto)
+}
+
+// ParseLineAs parses a line in the format, interning its strings with strs,
+// which may be nil. A line in the other format is rejected.
+func ParseLineAs(p []byte, strs *Interner, format LineFormat) (o Observation, err error) {
+	isJSON := format == LineFormatJSON || (format != LineFormatPrometheus && IsJSON(p))
+	if len(p) <= 0 {
+		err = rejectf(ReasonEmptyLine, "invalid (empty) line")
+	} else if isJSON {
+		if p[0] != '{' {
+			err = rejectf(ReasonBadFormat, "line isn't JSON, the only format accepted")
+		} else if err = json.Unmarshal(p, &o); err == nil {
+			if err = checkValues(o); err == nil {
+				strs.internObservation(&o)
+			}
+		}
+	} else if isHelpOrType(bytes.TrimSpace(p)) {
+		err = rejectf(ReasonBadFormat, "HELP and TYPE comments aren't supported, declare metrics in JSON instead")
+	} else {
+		err = prometheusUnmarshal(p, &o, strs)
+	}
+	return o, err
+}
+
+// IsComment reports whether line is blank, or a comment other than HELP or
+// TYPE, neither of which is an observation, so that it can be skipped rather
+// than parsed. Heartbeats are comments too, so should be looked for first.
+func IsComment(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	return len(line) == 0 || (line[0] == '#' && !isHelpOrType(line))
+}
+
+// isHelpOrType reports whether line is a HELP or TYPE comment, which would
+// declare a metric in the Prometheus text format, so it mustn't be skipped
+// silently.
+func isHelpOrType(line []byte) bool {
+	if len(line) == 0 || line[0] != '#' {
+		return false
+	}
+	fields := bytes.Fields(line[1:])
+	return len(fields) > 0 && (bytes.Equal(fields[0], []byte("HELP")) || bytes.Equal(fields[0], []byte("TYPE")))
+}
+
+// IsJSON reports whether the line p is in JSON, rather than the Prometheus
+// text format. Both may start with a brace, if the text format has a quoted
+// metric name, like {"http.server.duration"} 1, but in JSON, the first quoted
+// string is followed by a colon.
+func IsJSON(p []byte) bool {
+	if len(p) == 0 || p[0] != '{' {
+		return false
+	}
+	return !quotedName(p)
+}
+
+func quotedName(p []byte) bool {
+	if len(p) < 2 || p[1] != '"' {
+		return false
+	}
+	q := bytes.IndexByte(p[2:], '"')
+	if q < 0 {
+		return false
+	}
+	rest := bytes.TrimLeft(p[2+q+1:], " \t")
+	return len(rest) > 0 && (rest[0] == ',' || rest[0] == '}')
+}
+
+// prometheusUnmarshal parses a line in the Prometheus text format, with an
+// optional timestamp in milliseconds after the value. It's on
+// the hot path, so it avoids intermediate allocations: the only allocations
+// are the strings and map that end up in the observation, and strings are
+// interned with strs, if it's not nil.
+func prometheusUnmarshal(p []byte, o *Observation, strs *Interner) error {
+	p = bytes.TrimSpace(p)
+	x := bytes.LastIndexByte(p, ' ')
+	if x < 1 {
+		return fmt.Errorf("bad format: couldn't find space")
+	}
+
+	id, val := bytes.TrimSpace(p[:x]), bytes.TrimSpace(p[x+1:])
+	if len(id) > 0 && id[len(id)-1] != '}' {
+		if y := bytes.LastIndexByte(id, ' '); y >= 1 {
+			ts, err := strconv.ParseInt(string(val), 10, 64)
+			if err != nil {
+				return rejectf(ReasonBadValue, "bad timestamp (%s)", string(val))
+			}
+			o.Timestamp = ts
+			id, val = bytes.TrimSpace(id[:y]), bytes.TrimSpace(id[y+1:])
+		}
+	}
+
+	value, ok := parseSimpleFloat(val)
+	if !ok {
+		var err error
+		if value, err = strconv.ParseFloat(string(val), 64); err != nil {
+			return errors.Wrapf(err, "bad value (%s)", string(val))
+		}
+	}
+
+	y := bytes.IndexByte(id, '{')
+	if y < 0 {
+		return fmt.Errorf("bad format: couldn't find opening brace")
+	}
+	if id[len(id)-1] != '}' {
+		return fmt.Errorf("bad format: couldn't find terminating brace")
+	}
+
+	name, labels := id[:y], id[y+1:len(id)-1]
+	if bytes.IndexByte(labels, ' ') >= 0 {
+		return rejectf(ReasonLabelError, "bad format: labels section may not contain spaces")
+	}
+
+	labelmap := make(map[string]string, bytes.Count(labels, []byte("=")))
+	for len(labels) > 0 {
+		pair := labels
+		if c := bytes.IndexByte(labels, ','); c >= 0 {
+			pair, labels = labels[:c], labels[c+1:]
+		} else {
+			labels = nil
+		}
+		var k, v []byte
+		if len(pair) > 0 && pair[0] == '"' {
+			// A quoted UTF-8 name: the metric name, if it's on its own,
+			// or else a label name.
+			q := bytes.IndexByte(pair[1:], '"')
+			if q < 0 {
+				return fmt.Errorf("bad format: unterminated quoted name")
+			}
+			k, v = pair[1:q+1], pair[q+2:]
+			if len(v) == 0 {
+				if len(name) > 0 {
+					return fmt.Errorf("bad format: metric name given twice")
+				}
+				name = k
+				continue
+			}
+			if v[0] != '=' {
+				return rejectf(ReasonLabelError, "bad format: quoted label name must be followed by =")
+			}
+			v = v[1:]
+		} else {
+			z := bytes.IndexByte(pair, '=')
+			if z < 0 {
+				continue
+			}
+			k, v = pair[:z], pair[z+1:]
+		}
+		if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+			return rejectf(ReasonLabelError, "bad format: label value must be wrapped in quotes")
+		}
+		v = v[1 : len(v)-1]
+		labelmap[strs.intern(k)] = strs.intern(v)
+	}
+
+	o.Name = strs.intern(name)
+	o.Labels = labelmap
+	o.Value = &value
+
+	return nil
+}
+
+// pow10 holds the powers of ten that are exactly representable as float64s.
+var pow10 = [...]float64{1e0, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9, 1e10, 1e11, 1e12, 1e13, 1e14, 1e15}
+
+// parseSimpleFloat parses values like 12, -3, and 4.56 without converting
+// them to strings. It reports false for anything else, including values with
+// more than 15 digits, which should be parsed with strconv.ParseFloat. Within
+// those limits, the mantissa and power of ten are exact, so dividing them
+// gives the correctly rounded result, the same as strconv.ParseFloat.
+func parseSimpleFloat(b []byte) (float64, bool) {
+	neg := false
+	if len(b) > 0 && (b[0] == '-' || b[0] == '+') {
+		neg, b = b[0] == '-', b[1:]
+	}
+	var (
+		mantissa uint64
+		digits   int
+		decimals = -1 // digits after the decimal point, or -1 if there's none
+	)
+	for i, c := range b {
+		switch {
+		case c >= '0' && c <= '9':
+			mantissa = mantissa*10 + uint64(c-'0')
+			digits++
+			if decimals >= 0 {
+				decimals++
+			}
+		case c == '.' && decimals < 0 && i > 0:
+			decimals = 0
+		default:
+			return 0, false
+		}
+	}
+	if digits == 0 || digits > 15 || decimals == 0 {
+		return 0, false
+	}
+	f := float64(mantissa)
+	if decimals > 0 {
+		f /= pow10[decimals]
+	}
+	if neg {
+		f = -f
+	}
+	return f, true
+}
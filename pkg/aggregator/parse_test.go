@@ -0,0 +1,258 @@
+package aggregator
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestParseLine(t *testing.T) {
+	// Test that we can parse a line with JSON.
+	msg := []byte(`{"name":"foo_total","type":"counter","help":"Total number of foos."}`)
+	o, err := ParseLine(msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "foo_total", o.Name; want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestParsePrometheus(t *testing.T) {
+	fp := func(f float64) (p *float64) {
+		p = new(float64)
+		*p = f
+		return p
+	}
+
+	for name, testcase := range map[string]struct {
+		input string
+		obs   Observation
+		err   bool
+	}{
+		"only spaces": {
+			input: `    `,
+			err:   true,
+		},
+		"empty": {
+			input: ``,
+			err:   true,
+		},
+		"help comment": {
+			input: `# HELP foo Total foos.`,
+			err:   true,
+		},
+		"no braces": {
+			input: `foo 1`,
+			err:   true,
+		},
+		"leading space": {
+			input: ` foo{} 1`,
+			obs:   Observation{Name: "foo", Value: fp(1.00), Labels: map[string]string{}},
+		},
+		"trailing space": {
+			input: `foo{} 1 `,
+			obs:   Observation{Name: "foo", Value: fp(1.00), Labels: map[string]string{}},
+		},
+		"ascii value": {
+			input: `foo{} A`,
+			err:   true,
+		},
+		"most basic": {
+			input: `foo{} 1`,
+			obs:   Observation{Name: "foo", Value: fp(1.00), Labels: map[string]string{}},
+		},
+		"with label": {
+			input: `foo{code="200"} 2.34`,
+			obs:   Observation{Name: "foo", Value: fp(2.34), Labels: map[string]string{"code": "200"}},
+		},
+		"with timestamp": {
+			input: `foo{code="200"} 2.34 1700000000000`,
+			obs:   Observation{Name: "foo", Value: fp(2.34), Labels: map[string]string{"code": "200"}, Timestamp: 1700000000000},
+		},
+		"bad timestamp": {
+			input: `foo{} 1 now`,
+			err:   true,
+		},
+		"missing quotes": {
+			input: `foo{code=200} 2.34`,
+			err:   true,
+		},
+		"missing closing brace": {
+			input: `foo{code="200" 7`,
+			err:   true,
+		},
+		"double closing brace": {
+			input: `foo{code="200"}} 7`,
+			err:   true,
+		},
+		"two labels": {
+			input: `foo{code="200",err="false"} 7`,
+			obs:   Observation{Name: "foo", Value: fp(7.00), Labels: map[string]string{"code": "200", "err": "false"}},
+		},
+		"space between labels": {
+			input: `foo{code="200", err="false"} 7`,
+			err:   true,
+		},
+		"space instead of comma": {
+			input: `foo{code="200" err="false"} 7`,
+			err:   true,
+		},
+		"empty label value": {
+			input: `foo{code=} 7`,
+			err:   true,
+		},
+		"lone quote": {
+			input: `foo{code="} 7`,
+			err:   true,
+		},
+		"exponent": {
+			input: `foo{} 1.5e3`,
+			obs:   Observation{Name: "foo", Value: fp(1500), Labels: map[string]string{}},
+		},
+		"negative": {
+			input: `foo{} -0.25`,
+			obs:   Observation{Name: "foo", Value: fp(-0.25), Labels: map[string]string{}},
+		},
+		"quoted metric name": {
+			input: `{"http.server.duration",code="200"} 1`,
+			obs:   Observation{Name: "http.server.duration", Value: fp(1), Labels: map[string]string{"code": "200"}},
+		},
+		"quoted label name": {
+			input: `foo{"net.peer.name"="db"} 1`,
+			obs:   Observation{Name: "foo", Value: fp(1), Labels: map[string]string{"net.peer.name": "db"}},
+		},
+		"metric name twice": {
+			input: `foo{"bar"} 1`,
+			err:   true,
+		},
+		"unterminated quoted name": {
+			input: `{"foo} 1`,
+			err:   true,
+		},
+		"scientific notation": {
+			input: `foo{} 1e-9`,
+			obs:   Observation{Name: "foo", Value: fp(1e-9), Labels: map[string]string{}},
+		},
+		"+Inf": {
+			input: `foo{} +Inf`,
+			obs:   Observation{Name: "foo", Value: fp(math.Inf(1)), Labels: map[string]string{}},
+		},
+		"-Inf": {
+			input: `foo{} -Inf`,
+			obs:   Observation{Name: "foo", Value: fp(math.Inf(-1)), Labels: map[string]string{}},
+		},
+		"NaN": {
+			input: `foo{} NaN`,
+			obs:   Observation{Name: "foo", Value: fp(math.NaN()), Labels: map[string]string{}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var obs Observation
+			err := prometheusUnmarshal([]byte(testcase.input), &obs, nil)
+			if want, have := testcase.err, err != nil; want != have {
+				t.Fatalf("err: want %v, have %v (%v)", want, have, err)
+			}
+			if want, have := testcase.obs, obs; !cmp.Equal(want, have, cmpopts.EquateNaNs()) {
+				t.Fatal(cmp.Diff(want, have, cmpopts.EquateNaNs()))
+			}
+		})
+	}
+}
+
+func TestParseSimpleFloat(t *testing.T) {
+	for _, input := range []string{
+		"0", "-0", "+0", "1", "-1", "+7", "2.34", "0.1", "0.3", "-0.25", "007.50",
+		"123456789012345", "1.23456789012345", "0.000000000000001", "999999999999999",
+		"1234567890123456", "1.5e3", "1.", ".5", "-", "+", "", "1..2", "0x10",
+		"Inf", "-Inf", "NaN", "1_000", "A",
+	} {
+		t.Run(input, func(t *testing.T) {
+			want, err := strconv.ParseFloat(input, 64)
+			have, ok := parseSimpleFloat([]byte(input))
+			if !ok {
+				return // strconv.ParseFloat is used instead
+			}
+			if err != nil {
+				t.Fatalf("parsed %v, but strconv.ParseFloat fails: %v", have, err)
+			}
+			if math.Float64bits(want) != math.Float64bits(have) {
+				t.Fatalf("want %v, have %v", want, have)
+			}
+		})
+	}
+}
+
+func TestParsePrometheusAllocs(t *testing.T) {
+	line := []byte(`http_requests_total{code="200",method="GET"} 1`)
+	allocs := testing.AllocsPerRun(100, func() {
+		var o Observation
+		if err := prometheusUnmarshal(line, &o, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// The name, two label names and values, the map and its bucket, and the
+	// value.
+	if max := 8.0; allocs > max {
+		t.Errorf("want at most %v allocations per line, have %v", max, allocs)
+	}
+}
+
+func TestIsComment(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		line string
+		want bool
+	}{
+		"empty":       {``, true},
+		"blank":       {" \t ", true},
+		"comment":     {`# foos by code`, true},
+		"indented":    {`  # foos by code`, true},
+		"heartbeat":   {`#heartbeat web-1`, true},
+		"help":        {`# HELP foo Total foos.`, false},
+		"type":        {`# TYPE foo counter`, false},
+		"observation": {`foo{} 1`, false},
+		"JSON":        {`{"name":"foo","value":1}`, false},
+	} {
+		if want, have := testcase.want, IsComment([]byte(testcase.line)); want != have {
+			t.Errorf("%s: want %v, have %v", name, want, have)
+		}
+	}
+}
+
+func TestParseLineAs(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		line   string
+		format LineFormat
+		want   string // the metric name
+		err    bool
+	}{
+		"auto JSON":                {`{"name":"foo","value":1}`, LineFormatAuto, "foo", false},
+		"auto Prometheus":          {`foo{} 1`, LineFormatAuto, "foo", false},
+		"auto quoted name":         {`{"foo.bar"} 1`, LineFormatAuto, "foo.bar", false},
+		"JSON":                     {`{"name":"foo","value":1}`, LineFormatJSON, "foo", false},
+		"JSON, given Prometheus":   {`foo{} 1`, LineFormatJSON, "", true},
+		"JSON, given quoted name":  {`{"foo.bar"} 1`, LineFormatJSON, "", true},
+		"Prometheus":               {`foo{} 1`, LineFormatPrometheus, "foo", false},
+		"Prometheus, quoted name":  {`{"foo.bar"} 1`, LineFormatPrometheus, "foo.bar", false},
+		"Prometheus, given JSON":   {`{"name":"foo","value":1}`, LineFormatPrometheus, "", true},
+		"Prometheus, given a TYPE": {`# TYPE foo counter`, LineFormatPrometheus, "", true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			o, err := ParseLineAs([]byte(testcase.line), nil, testcase.format)
+			if want, have := testcase.err, err != nil; want != have {
+				t.Fatalf("want error %v, have %v", want, err)
+			}
+			if want, have := testcase.want, o.Name; !testcase.err && want != have {
+				t.Errorf("want %q, have %q", want, have)
+			}
+		})
+	}
+	for s, wantErr := range map[string]bool{"": false, "auto": false, "json": false, "prometheus": false, "statsd": true} {
+		if _, err := ParseLineFormat(s); wantErr != (err != nil) {
+			t.Errorf("%q: want error %v, have %v", s, wantErr, err)
+		}
+	}
+}
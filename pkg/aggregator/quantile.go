@@ -0,0 +1,111 @@
+package aggregator
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// ExportQuantiles adds an estimate of each quantile, from 0 to 1, of every
+// histogram series to the exposition format, as a gauge family named after
+// the histogram with the suffix _quantile, and to its SeriesSnapshot. The
+// estimates are computed from the buckets at scrape time, the same way as
+// PromQL's histogram_quantile, for consumers that can't compute them
+// themselves. It must be called before the universe is served.
+func (u *Universe) ExportQuantiles(qs ...float64) error {
+	for _, q := range qs {
+		if !(q >= 0 && q <= 1) {
+			return fmt.Errorf("quantile %v isn't between 0 and 1", q)
+		}
+	}
+	u.quantiles = qs
+	return nil
+}
+
+// bucketQuantile estimates the q-quantile of a histogram's observations from
+// its cumulative buckets, by linear interpolation within the bucket that
+// contains it, assuming the lowest bucket starts at zero if its upper bound
+// is positive. A quantile in the +Inf bucket is the highest finite upper
+// bound. It returns NaN if there are no observations, or no finite buckets.
+func bucketQuantile(q float64, buckets []bucket, count uint64) float64 {
+	if count == 0 || len(buckets) == 0 {
+		return math.NaN()
+	}
+	rank := q * float64(count)
+	i := 0
+	for i < len(buckets) && float64(buckets[i].count) < rank {
+		i++
+	}
+	if i == len(buckets) {
+		return buckets[len(buckets)-1].max
+	}
+	var (
+		upper      = buckets[i].max
+		lower      = 0.0
+		lowerCount = uint64(0)
+	)
+	if i > 0 {
+		lower, lowerCount = buckets[i-1].max, buckets[i-1].count
+	} else if upper <= 0 {
+		return upper
+	}
+	if buckets[i].count == lowerCount {
+		return upper // only possible for q == 0
+	}
+	return lower + (upper-lower)*(rank-float64(lowerCount))/float64(buckets[i].count-lowerCount)
+}
+
+// appendQuantiles appends the quantile gauge family of the histogram
+// collection c, which must be locked, to b.
+func (c *timeseriesCollection) appendQuantiles(b []byte, n metricName, qs []float64) []byte {
+	name := string(n) + "_quantile"
+	b = append(b, "# HELP "+renderName(name)+" Quantiles of "+string(n)+", estimated from its buckets.\n"...)
+	b = append(b, "# TYPE "+renderName(name)+" gauge\n"...)
+	for _, k := range sortTimeseriesKeys(c.values) {
+		h := c.values[k].(*histogram)
+		if !h.touched() {
+			continue
+		}
+		if len(h.prefix.quantiles) != len(qs) {
+			h.prefix.quantiles = renderQuantilePrefixes(name, h.labels, qs)
+		}
+		for i, q := range qs {
+			b = appendSample(b, h.prefix.quantiles[i], bucketQuantile(q, h.buckets, h.count))
+		}
+	}
+	return append(b, '\n')
+}
+
+func renderQuantilePrefixes(name string, labels map[string]string, qs []float64) []string {
+	labelscopy := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		labelscopy[k] = v
+	}
+	prefixes := make([]string, len(qs))
+	for i, q := range qs {
+		labelscopy["quantile"] = formatQuantile(q)
+		prefixes[i] = renderSeries(name, labelscopy)
+	}
+	return prefixes
+}
+
+// quantiles returns the estimates of the histogram's quantiles, by quantile,
+// omitting those that can't be estimated.
+func (h *histogram) quantiles(qs []float64) map[string]float64 {
+	var m map[string]float64
+	for _, q := range qs {
+		v := bucketQuantile(q, h.buckets, h.count)
+		if math.IsNaN(v) {
+			continue
+		}
+		if m == nil {
+			m = make(map[string]float64, len(qs))
+		}
+		m[formatQuantile(q)] = v
+	}
+	return m
+}
+
+func formatQuantile(q float64) string {
+	return strconv.FormatFloat(q, 'g', -1, 64)
+}
@@ -0,0 +1,83 @@
+package aggregator
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBucketQuantile(t *testing.T) {
+	buckets := []bucket{{0.1, 0}, {0.5, 2}, {1, 3}, {10, 4}}
+	for name, testcase := range map[string]struct {
+		q       float64
+		buckets []bucket
+		count   uint64
+		want    float64
+	}{
+		"median":           {0.5, buckets, 4, 0.5},
+		"p90":              {0.9, buckets, 4, 6.4},
+		"max":              {1, buckets, 4, 10},
+		"lowest bucket":    {0.5, []bucket{{1, 2}}, 2, 0.5},
+		"negative bucket":  {0.5, []bucket{{-1, 2}}, 2, -1},
+		"+Inf bucket":      {0.9, []bucket{{1, 1}}, 10, 1},
+		"no observations":  {0.5, buckets[:1], 0, math.NaN()},
+		"no finite bucket": {0.5, nil, 3, math.NaN()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			have := bucketQuantile(testcase.q, testcase.buckets, testcase.count)
+			if want := testcase.want; want != have && !(math.IsNaN(want) && math.IsNaN(have)) {
+				t.Errorf("want %v, have %v", want, have)
+			}
+		})
+	}
+}
+
+func TestExportQuantiles(t *testing.T) {
+	u, _ := NewUniverse()
+	if err := u.ExportQuantiles(0.5, 1.5); err == nil {
+		t.Errorf("want error for quantile 1.5, have none")
+	}
+	if err := u.ExportQuantiles(0.5, 0.9); err != nil {
+		t.Fatal(err)
+	}
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"bar_seconds","type":"histogram","help":"Bar duration in seconds.","buckets":[0.1, 0.5, 1, 10]}`,
+		`bar_seconds{code="200"} 0.123`,
+		`bar_seconds{code="200"} 0.234`,
+		`bar_seconds{code="200"} 0.501`,
+		`bar_seconds{code="200"} 8.000`,
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`foo_total{} 1`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP bar_seconds Bar duration in seconds.
+		# TYPE bar_seconds histogram
+		bar_seconds_bucket{code="200",le="0.1"} 0
+		bar_seconds_bucket{code="200",le="0.5"} 2
+		bar_seconds_bucket{code="200",le="1"} 3
+		bar_seconds_bucket{code="200",le="10"} 4
+		bar_seconds_bucket{code="200",le="+Inf"} 4
+		bar_seconds_sum{code="200"} 8.858000
+		bar_seconds_count{code="200"} 4
+
+		# HELP bar_seconds_quantile Quantiles of bar_seconds, estimated from its buckets.
+		# TYPE bar_seconds_quantile gauge
+		bar_seconds_quantile{code="200",quantile="0.5"} 0.500000
+		bar_seconds_quantile{code="200",quantile="0.9"} 6.400000
+
+		# HELP foo_total Total number of foos.
+		# TYPE foo_total counter
+		foo_total{} 1.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	s, ok := u.Lookup("bar_seconds", map[string]string{"code": "200"})
+	if !ok {
+		t.Fatal("bar_seconds: not found")
+	}
+	if want, have := map[string]float64{"0.5": 0.5, "0.9": 6.4}, s.Quantiles; !cmp.Equal(want, have) {
+		t.Errorf("quantiles: %s", cmp.Diff(want, have))
+	}
+}
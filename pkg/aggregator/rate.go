@@ -0,0 +1,183 @@
+package aggregator
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rateRingSamples is the number of past values of a counter kept to compute
+// its rates, spaced evenly over the longest window.
+const rateRingSamples = 60
+
+// rateParams are the windows over which a counter's per-second rates are
+// exported.
+type rateParams struct {
+	windows []time.Duration // sorted, distinct
+}
+
+// parseRateParams returns the rate windows declared by o, for a counter.
+// Windows are whole seconds, so that they name their series, as in
+// foo_total:rate5m.
+func parseRateParams(o Observation) (p rateParams, err error) {
+	for _, s := range o.Rates {
+		w, err := time.ParseDuration(s)
+		if err != nil {
+			return p, errors.Wrap(err, "invalid rate window")
+		}
+		if w < time.Second || w%time.Second != 0 {
+			return p, fmt.Errorf("rate window %s must be a whole number of seconds", s)
+		}
+		p.windows = append(p.windows, w)
+	}
+	sort.Slice(p.windows, func(i, j int) bool { return p.windows[i] < p.windows[j] })
+	for i := 1; i < len(p.windows); i++ {
+		if p.windows[i] == p.windows[i-1] {
+			return p, fmt.Errorf("rate window %s is given more than once", p.windows[i])
+		}
+	}
+	return p, nil
+}
+
+func (p rateParams) equal(q rateParams) bool {
+	if len(p.windows) != len(q.windows) {
+		return false
+	}
+	for i := range p.windows {
+		if p.windows[i] != q.windows[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// declared returns o with the parameters.
+func (p rateParams) declared(o Observation) Observation {
+	o.Rates = nil
+	for _, w := range p.windows {
+		o.Rates = append(o.Rates, rateWindowName(w))
+	}
+	return o
+}
+
+// rateWindowName returns the shortest name of a window, in the largest unit
+// that divides it, e.g. 5m, or 90s.
+func rateWindowName(w time.Duration) string {
+	switch {
+	case w%time.Hour == 0:
+		return strconv.FormatInt(int64(w/time.Hour), 10) + "h"
+	case w%time.Minute == 0:
+		return strconv.FormatInt(int64(w/time.Minute), 10) + "m"
+	default:
+		return strconv.FormatInt(int64(w/time.Second), 10) + "s"
+	}
+}
+
+// rateSample is the value of a counter at a time, in Unix nanoseconds.
+type rateSample struct {
+	t int64
+	v float64
+}
+
+// rateRing is a ring of a counter's past values, from which its rates are
+// computed. It's only used with the counter's shard locked.
+type rateRing struct {
+	samples  []rateSample
+	head     int   // the next sample to overwrite
+	n        int   // samples in the ring
+	spacing  int64 // minimum nanoseconds between samples
+	windows  []time.Duration
+	prefixes []string // rendered name and labels, by window
+}
+
+func newRateRing(p rateParams, name string, labels map[string]string) *rateRing {
+	longest := p.windows[len(p.windows)-1]
+	r := &rateRing{
+		samples: make([]rateSample, rateRingSamples+1),
+		spacing: int64(longest / rateRingSamples),
+		windows: p.windows,
+	}
+	for _, w := range p.windows {
+		r.prefixes = append(r.prefixes, renderSeries(name+":rate"+rateWindowName(w), labels))
+	}
+	return r
+}
+
+// sample records the counter's value at now, unless the last sample is too
+// recent.
+func (r *rateRing) sample(now int64, v float64) {
+	if r.n > 0 && now-r.at(r.n-1).t < r.spacing {
+		return
+	}
+	r.samples[r.head] = rateSample{now, v}
+	r.head = (r.head + 1) % len(r.samples)
+	if r.n < len(r.samples) {
+		r.n++
+	}
+}
+
+// at returns the i'th sample, oldest first.
+func (r *rateRing) at(i int) rateSample {
+	return r.samples[(r.head-r.n+i+len(r.samples))%len(r.samples)]
+}
+
+// rate returns the per-second rate of the counter over the window ending at
+// the latest sample, from the oldest sample within it, or zero if there are
+// fewer than two samples.
+func (r *rateRing) rate(window time.Duration) float64 {
+	if r.n < 2 {
+		return 0
+	}
+	latest := r.at(r.n - 1)
+	for i := 0; i < r.n-1; i++ {
+		if s := r.at(i); latest.t-s.t <= int64(window) {
+			if latest.t == s.t {
+				return 0
+			}
+			return (latest.v - s.v) / time.Duration(latest.t-s.t).Seconds()
+		}
+	}
+	return 0 // samples are further apart than the window
+}
+
+// rates returns the rate over each window, by name, e.g. 5m.
+func (r *rateRing) rates() map[string]float64 {
+	rates := make(map[string]float64, len(r.windows))
+	for _, w := range r.windows {
+		rates[rateWindowName(w)] = r.rate(w)
+	}
+	return rates
+}
+
+// sampleRates samples the value of each of the counters of c, which must be
+// locked, at now.
+func (c *timeseriesCollection) sampleRates(now int64) {
+	for _, v := range c.values {
+		if ctr := v.(*counter); ctr.rates != nil && ctr.touched() {
+			ctr.rates.sample(now, ctr.value.load())
+		}
+	}
+}
+
+// appendRates appends a gauge family of the rates of the counter collection
+// c, which must be locked, over each window, to b.
+func (c *timeseriesCollection) appendRates(b []byte, n metricName) []byte {
+	keys := sortTimeseriesKeys(c.values)
+	for i, w := range c.rates.windows {
+		name := string(n) + ":rate" + rateWindowName(w)
+		b = append(b, "# HELP "+renderName(name)+" Per-second rate of "+string(n)+", over the last "+rateWindowName(w)+".\n"...)
+		b = append(b, "# TYPE "+renderName(name)+" gauge\n"...)
+		for _, k := range keys {
+			ctr := c.values[k].(*counter)
+			if !ctr.touched() {
+				continue
+			}
+			b = appendSample(b, ctr.rates.prefixes[i], ctr.rates.rate(w))
+		}
+		b = append(b, '\n')
+	}
+	return b
+}
@@ -0,0 +1,82 @@
+package aggregator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRates(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"jobs_total","type":"counter","help":"Total jobs.","rates":["1m","5m"]}`,
+		`jobs_total{queue="a"} 10`,
+	}))
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= 30; i++ { // 10s apart, for 5m
+		u.Expire(start.Add(time.Duration(i)*10*time.Second), 0)
+		if i < 27 {
+			loadObservations(t, u, makeObservations(t, []string{`jobs_total{queue="a"} 6`})) // 0.6/s for 4.5m
+		}
+	}
+	if want, have := normalizeResponse(`
+		# HELP jobs_total Total jobs.
+		# TYPE jobs_total counter
+		jobs_total{queue="a"} 172.000000
+
+		# HELP jobs_total:rate1m Per-second rate of jobs_total, over the last 1m.
+		# TYPE jobs_total:rate1m gauge
+		jobs_total:rate1m{queue="a"} 0.300000
+
+		# HELP jobs_total:rate5m Per-second rate of jobs_total, over the last 5m.
+		# TYPE jobs_total:rate5m gauge
+		jobs_total:rate5m{queue="a"} 0.540000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	s, _ := u.Lookup("jobs_total", map[string]string{"queue": "a"})
+	if want, have := 0.54, s.Rates["5m"]; want != have {
+		t.Errorf("snapshot: want 5m rate %v, have %v", want, have)
+	}
+
+	for name, o := range map[string]Observation{
+		"change rates":     {Name: "jobs_total", Type: "counter", Help: "Total jobs.", Rates: []string{"5m"}},
+		"gauge":            {Name: "foo", Type: "gauge", Help: "Foo.", Rates: []string{"5m"}},
+		"fraction":         {Name: "foo_total", Type: "counter", Help: "Foo.", Rates: []string{"1500ms"}},
+		"duplicate window": {Name: "foo_total", Type: "counter", Help: "Foo.", Rates: []string{"1m", "60s"}},
+	} {
+		if err := u.CheckDeclaration(o); err == nil {
+			t.Errorf("%s: want error, have none", name)
+		}
+	}
+	if err := u.CheckDeclaration(Observation{Name: "jobs_total", Type: "counter", Help: "Total jobs.", Rates: []string{"300s", "60s"}}); err != nil {
+		t.Errorf("same rates: %v", err)
+	}
+}
+
+func TestRateRing(t *testing.T) {
+	p, err := parseRateParams(Observation{Rates: []string{"1m"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRateRing(p, "foo_total", nil)
+	if want, have := 0.0, r.rate(time.Minute); want != have {
+		t.Fatalf("empty: want %v, have %v", want, have)
+	}
+	const second = int64(time.Second)
+	for i := int64(0); i <= 200; i++ { // every second, so every sample is kept
+		r.sample(i*second, float64(2*i))
+	}
+	if want, have := rateRingSamples+1, r.n; want != have {
+		t.Fatalf("samples: want %d, have %d", want, have)
+	}
+	if want, have := 2.0, r.rate(time.Minute); want != have {
+		t.Errorf("rate: want %v, have %v", want, have)
+	}
+
+	// Samples further apart than the window can't give a rate.
+	r.sample(1000*second, 2000)
+	if want, have := 0.0, r.rate(time.Minute); want != have {
+		t.Errorf("after a gap: want %v, have %v", want, have)
+	}
+}
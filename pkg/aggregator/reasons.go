@@ -0,0 +1,58 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Reasons a line or observation is rejected, as classified by RejectReason,
+// so that producer bugs can be told apart from limits that are set too low.
+const (
+	ReasonEmptyLine     = "empty_line"
+	ReasonBadFormat     = "bad_format"
+	ReasonBadValue      = "bad_value"
+	ReasonUnknownMetric = "unknown_metric"
+	ReasonTypeMismatch  = "type_mismatch"
+	ReasonLabelError    = "label_error"
+	ReasonLimitExceeded = "limit_exceeded"
+)
+
+// RejectError is the error for a line or observation that's rejected for one
+// of the reasons above, where the reason can't be told from the error's type.
+type RejectError struct {
+	Reason string
+	Err    error
+}
+
+func (e RejectError) Error() string {
+	return e.Err.Error()
+}
+
+func rejectf(reason, format string, args ...interface{}) error {
+	return RejectError{reason, fmt.Errorf(format, args...)}
+}
+
+// RejectReason returns the reason for an error returned by ParseLine, or by
+// observing, which may have been wrapped with github.com/pkg/errors, or the
+// empty string if the reason isn't known.
+func RejectReason(err error) string {
+	for err != nil {
+		switch e := err.(type) {
+		case RejectError:
+			return e.Reason
+		case LimitError:
+			return ReasonLimitExceeded
+		case *strconv.NumError:
+			return ReasonBadValue
+		case *json.SyntaxError, *json.UnmarshalTypeError:
+			return ReasonBadFormat
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return ""
+}
@@ -0,0 +1,49 @@
+package aggregator
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestRejectReason(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	}))
+	if err := u.SetLimits(Limits{MaxLabels: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetTypeConflictPolicy(ConflictReject, DefaultConflictReplaceAfter); err != nil {
+		t.Fatal(err)
+	}
+	for name, testcase := range map[string]struct {
+		line string
+		want string
+	}{
+		"empty line":          {``, ReasonEmptyLine},
+		"no space":            {`foo_total{}`, ""},
+		"bad value":           {`foo_total{} A`, ReasonBadValue},
+		"bad JSON value":      {`{"name":"foo_total","value":"A"}`, ReasonBadValue},
+		"bad JSON":            {`{"name":`, ReasonBadFormat},
+		"unquoted label":      {`foo_total{a=1} 1`, ReasonLabelError},
+		"unknown metric":      {`bar_total{} 1`, ReasonUnknownMetric},
+		"type mismatch":       {`{"name":"foo_total","type":"gauge","help":"Current foos.","value":1}`, ReasonTypeMismatch},
+		"non-finite value":    {`foo_total{} +Inf`, ReasonBadValue},
+		"limit exceeded":      {`foo_total{a="1",b="2"} 1`, ReasonLimitExceeded},
+		"invalid declaration": {`{"name":"baz_total","type":"counter"}`, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			o, err := ParseLine([]byte(testcase.line), nil)
+			if err == nil {
+				err = u.Observe(o)
+			}
+			if err == nil {
+				t.Fatal("want error, have none")
+			}
+			if want, have := testcase.want, RejectReason(errors.Wrap(err, "wrapped")); want != have {
+				t.Errorf("want %q, have %q (%v)", want, have, err)
+			}
+		})
+	}
+}
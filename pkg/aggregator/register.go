@@ -0,0 +1,51 @@
+package aggregator
+
+import (
+	"fmt"
+)
+
+// checkSeries returns an error if the series that o declares can't be
+// pre-registered.
+func checkSeries(o Observation, schema *labelSchema) error {
+	if len(o.Series) == 0 {
+		return nil
+	}
+	if o.Type != "counter" && o.Type != "gauge" {
+		return fmt.Errorf("only counters and gauges can declare series")
+	}
+	zero := 0.0
+	for _, labels := range o.Series {
+		if _, err := schema.apply(Observation{Name: o.Name, Labels: labels, Value: &zero}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// register creates the series of c declared by o that don't exist yet, at
+// zero, so that they're exported before they're first observed. They're kept
+// forever, unless they're observed with a TTL of their own. Series that were
+// spilled are paged in, as they exist. The shard must be locked.
+func (s *universeShard) register(c *timeseriesCollection, o Observation, sp *spillStore) error {
+	for _, labels := range o.Series {
+		zero := 0.0
+		r, err := c.schema.apply(Observation{Name: o.Name, Labels: labels, Value: &zero, Op: "add"})
+		if err != nil {
+			return err
+		}
+		k := r.timeseriesKey()
+		if err := s.pageIn(c, o.metricName(), k, sp); err != nil {
+			return err
+		}
+		if _, ok := c.values[k]; ok {
+			continue
+		}
+		if err := c.observe(r); err != nil {
+			return err
+		}
+		c.values[k].setTTL(0)
+		c.seriesTTLs = true
+		s.storeLockFree(c, k)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package aggregator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegisteredSeries(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"jobs_total","type":"counter","help":"Jobs.","series":[{"status":"ok"},{"status":"fail"}]}`,
+	}))
+	for _, status := range []string{"ok", "fail"} {
+		s, ok := u.Lookup("jobs_total", map[string]string{"status": status})
+		if !ok {
+			t.Fatalf("%s: want registered, have none", status)
+		}
+		if want, have := 0.0, *s.Value; want != have {
+			t.Fatalf("%s: want %v, have %v", status, want, have)
+		}
+	}
+
+	// Observing a registered series counts from zero, and redeclaring adds
+	// new series, without resetting existing ones.
+	loadObservations(t, u, makeObservations(t, []string{
+		`jobs_total{status="ok"} 3`,
+		`{"name":"jobs_total","type":"counter","help":"Jobs.","series":[{"status":"ok"},{"status":"retry"}]}`,
+	}))
+	for status, want := range map[string]float64{"ok": 3, "fail": 0, "retry": 0} {
+		s, ok := u.Lookup("jobs_total", map[string]string{"status": status})
+		if !ok {
+			t.Fatalf("%s: want found, have none", status)
+		}
+		if have := *s.Value; want != have {
+			t.Fatalf("%s: want %v, have %v", status, want, have)
+		}
+	}
+
+	// Registered series are kept forever, even with a default TTL.
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	u.Expire(start, time.Minute)
+	if want, have := 0, u.Expire(start.Add(time.Hour), time.Minute); want != have {
+		t.Fatalf("want %d expired, have %d", want, have)
+	}
+	if _, ok := u.Lookup("jobs_total", map[string]string{"status": "fail"}); !ok {
+		t.Fatalf("fail: want found, have expired")
+	}
+}
+
+func TestRegisteredSeriesDeclaration(t *testing.T) {
+	for name, tc := range map[string]struct {
+		decl       string
+		wantErr    bool
+		wantLabels map[string]string
+	}{
+		"gauge": {
+			decl:       `{"name":"queue_depth","type":"gauge","help":"Depth.","series":[{"queue":"a"}]}`,
+			wantLabels: map[string]string{"queue": "a"},
+		},
+		"histogram": {
+			decl:    `{"name":"latency_seconds","type":"histogram","help":"Latency.","buckets":[1],"series":[{"path":"/"}]}`,
+			wantErr: true,
+		},
+		"rejected by schema": {
+			decl:    `{"name":"jobs_total","type":"counter","help":"Jobs.","label_names":["status"],"series":[{"queue":"a"}]}`,
+			wantErr: true,
+		},
+		"normalized by schema": {
+			decl:       `{"name":"jobs_total","type":"counter","help":"Jobs.","label_names":["status"],"label_policy":"normalize","series":[{"status":"ok","queue":"a"}]}`,
+			wantLabels: map[string]string{"status": "ok"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			u, _ := NewUniverse()
+			o := makeObservations(t, []string{tc.decl})[0]
+			err := u.Observe(o)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, have none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := u.Lookup(o.Name, tc.wantLabels); !ok {
+				t.Fatalf("%v: want registered, have none", tc.wantLabels)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package aggregator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Policies for observations without exactly the declared label names of
+// their metric.
+const (
+	// LabelPolicyReject rejects the observation, with ReasonLabelError.
+	LabelPolicyReject = "reject"
+
+	// LabelPolicyNormalize drops undeclared labels, and sets missing ones
+	// to the empty string, so that inconsistent senders can't fragment a
+	// metric's series.
+	LabelPolicyNormalize = "normalize"
+)
+
+// labelSchema is the label names that every series of a metric must have,
+// and no others.
+type labelSchema struct {
+	names     []string // sorted
+	normalize bool
+}
+
+// newLabelSchema returns the label schema declared by o, or nil if there
+// isn't one.
+func newLabelSchema(o Observation) (*labelSchema, error) {
+	if len(o.LabelNames) == 0 {
+		if o.LabelPolicy != "" {
+			return nil, fmt.Errorf("label_policy must be given with label_names")
+		}
+		return nil, nil
+	}
+	s := &labelSchema{names: append([]string(nil), o.LabelNames...)}
+	switch o.LabelPolicy {
+	case "", LabelPolicyReject:
+	case LabelPolicyNormalize:
+		s.normalize = true
+	default:
+		return nil, fmt.Errorf("label_policy must be %s or %s, not %q", LabelPolicyReject, LabelPolicyNormalize, o.LabelPolicy)
+	}
+	sort.Strings(s.names)
+	for i, name := range s.names {
+		switch {
+		case name == "":
+			return nil, fmt.Errorf("label_names can't be empty")
+		case name == "le" || name == "quantile":
+			return nil, fmt.Errorf("label_names can't include %q", name)
+		case i > 0 && name == s.names[i-1]:
+			return nil, fmt.Errorf("label_names has %q more than once", name)
+		}
+	}
+	return s, nil
+}
+
+func (s *labelSchema) equal(o Observation) bool {
+	other, err := newLabelSchema(o)
+	if err != nil {
+		return false
+	}
+	if s == nil || other == nil {
+		return s == nil && other == nil
+	}
+	return s.normalize == other.normalize && strings.Join(s.names, "\x00") == strings.Join(other.names, "\x00")
+}
+
+// declared returns o with the label schema.
+func (s *labelSchema) declared(o Observation) Observation {
+	o.LabelNames, o.LabelPolicy = nil, ""
+	if s != nil {
+		o.LabelNames, o.LabelPolicy = s.names, LabelPolicyReject
+		if s.normalize {
+			o.LabelPolicy = LabelPolicyNormalize
+		}
+	}
+	return o
+}
+
+// apply returns o if it has exactly the label names of the schema, and
+// otherwise normalizes it, or returns an error, as the policy says. The
+// labels are copied, rather than modified.
+func (s *labelSchema) apply(o Observation) (Observation, error) {
+	if s == nil || o.Value == nil {
+		return o, nil
+	}
+	var missing, extra []string
+	for _, name := range s.names {
+		if _, ok := o.Labels[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(o.Labels)+len(missing) > len(s.names) {
+		for name := range o.Labels {
+			if i := sort.SearchStrings(s.names, name); i == len(s.names) || s.names[i] != name {
+				extra = append(extra, name)
+			}
+		}
+		sort.Strings(extra)
+	}
+	if len(missing) == 0 && len(extra) == 0 {
+		return o, nil
+	}
+	if !s.normalize {
+		var problems []string
+		if len(missing) > 0 {
+			problems = append(problems, "missing "+strings.Join(missing, ", "))
+		}
+		if len(extra) > 0 {
+			problems = append(problems, "undeclared "+strings.Join(extra, ", "))
+		}
+		return o, rejectf(ReasonLabelError, "labels must be %s: %s", strings.Join(s.names, ", "), strings.Join(problems, "; "))
+	}
+	labels := make(map[string]string, len(s.names))
+	for _, name := range s.names {
+		labels[name] = o.Labels[name]
+	}
+	o.Labels = labels
+	return o, nil
+}
@@ -0,0 +1,110 @@
+package aggregator
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestLabelSchema(t *testing.T) {
+	for name, tc := range map[string]struct {
+		policy     string
+		labels     map[string]string
+		wantLabels map[string]string
+		wantErr    bool
+	}{
+		"exact": {
+			labels:     map[string]string{"method": "GET", "code": "200"},
+			wantLabels: map[string]string{"method": "GET", "code": "200"},
+		},
+		"missing": {
+			labels:  map[string]string{"method": "GET"},
+			wantErr: true,
+		},
+		"undeclared": {
+			labels:  map[string]string{"method": "GET", "code": "200", "path": "/"},
+			wantErr: true,
+		},
+		"normalized missing": {
+			policy:     LabelPolicyNormalize,
+			labels:     map[string]string{"method": "GET"},
+			wantLabels: map[string]string{"method": "GET", "code": ""},
+		},
+		"normalized undeclared": {
+			policy:     LabelPolicyNormalize,
+			labels:     map[string]string{"method": "GET", "code": "200", "path": "/"},
+			wantLabels: map[string]string{"method": "GET", "code": "200"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			u, _ := NewUniverse()
+			decl := Observation{Name: "requests_total", Type: "counter", Help: "Total requests.", LabelNames: []string{"method", "code"}, LabelPolicy: tc.policy}
+			if err := u.Observe(decl); err != nil {
+				t.Fatal(err)
+			}
+			value := 1.0
+			err := u.Observe(Observation{Name: "requests_total", Labels: tc.labels, Value: &value})
+			if tc.wantErr {
+				if want, have := ReasonLabelError, RejectReason(err); want != have {
+					t.Fatalf("want %s, have %s (%v)", want, have, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := u.Lookup("requests_total", tc.wantLabels); !ok {
+				t.Fatalf("%v: want found, have none", tc.wantLabels)
+			}
+			if _, ok := u.Lookup("requests_total", tc.labels); ok && !reflect.DeepEqual(tc.labels, tc.wantLabels) {
+				t.Fatalf("%v: want normalized, have found", tc.labels)
+			}
+		})
+	}
+}
+
+func TestLabelSchemaDeclaration(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Foos.","label_names":["a","b"]}`,
+	}))
+	for name, tc := range map[string]struct {
+		o       Observation
+		wantErr bool
+	}{
+		"same names in another order": {Observation{Name: "foo_total", Type: "counter", Help: "Foos.", LabelNames: []string{"b", "a"}, LabelPolicy: LabelPolicyReject}, false},
+		"changed names":               {Observation{Name: "foo_total", Type: "counter", Help: "Foos.", LabelNames: []string{"a"}}, true},
+		"changed policy":              {Observation{Name: "foo_total", Type: "counter", Help: "Foos.", LabelNames: []string{"a", "b"}, LabelPolicy: LabelPolicyNormalize}, true},
+		"no names":                    {Observation{Name: "foo_total", Type: "counter", Help: "Foos."}, true},
+		"duplicate name":              {Observation{Name: "bar_total", Type: "counter", Help: "Bars.", LabelNames: []string{"a", "a"}}, true},
+		"le":                          {Observation{Name: "bar", Type: "histogram", Help: "Bars.", Buckets: []float64{1}, LabelNames: []string{"le"}}, true},
+		"policy without names":        {Observation{Name: "bar_total", Type: "counter", Help: "Bars.", LabelPolicy: LabelPolicyNormalize}, true},
+		"unknown policy":              {Observation{Name: "bar_total", Type: "counter", Help: "Bars.", LabelNames: []string{"a"}, LabelPolicy: "drop"}, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := u.CheckDeclaration(tc.o); (err != nil) != tc.wantErr {
+				t.Errorf("want error %v, have %v", tc.wantErr, err)
+			}
+		})
+	}
+
+	// The schema is kept in snapshots.
+	var buf bytes.Buffer
+	if err := u.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := NewUniverse()
+	if _, err := restored.ReadSnapshot(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	value := 1.0
+	if err := restored.Observe(Observation{Name: "foo_total", Labels: map[string]string{"a": "1"}, Value: &value}); RejectReason(err) != ReasonLabelError {
+		t.Errorf("restored: want %s, have %v", ReasonLabelError, err)
+	}
+	if _, _, _, err := restored.DryRun(Observation{Name: "foo_total", Labels: map[string]string{"a": "1", "b": "2"}, Value: &value}); err != nil {
+		t.Errorf("dry run: %v", err)
+	}
+	if _, ok := restored.Lookup("foo_total", map[string]string{"a": "1", "b": "2"}); ok {
+		t.Errorf("dry run: want nothing observed, have series")
+	}
+}
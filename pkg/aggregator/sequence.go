@@ -0,0 +1,41 @@
+package aggregator
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// sequencePrefix starts the optional first line of a datagram, which
+// numbers it, like "#seq web-1 42", so that the aggregator can count the
+// datagrams from each sender that never arrive. It's a comment in the text
+// format, so it can't be mistaken for an observation.
+const sequencePrefix = "#seq "
+
+// SequenceHeader numbers a datagram from a sender.
+type SequenceHeader struct {
+	Sender string
+	Number uint64
+}
+
+// SplitSequenceHeader splits the sequence header from the start of a
+// datagram, after it's decrypted and decompressed, and returns it, or nil if
+// there isn't one, and the rest of the datagram.
+func SplitSequenceHeader(p []byte) (*SequenceHeader, []byte, error) {
+	if !bytes.HasPrefix(p, []byte(sequencePrefix)) {
+		return nil, p, nil
+	}
+	header, rest := p[len(sequencePrefix):], []byte(nil)
+	if i := bytes.IndexByte(header, '\n'); i >= 0 {
+		header, rest = header[:i], header[i+1:]
+	}
+	fields := bytes.Fields(header)
+	if len(fields) != 2 {
+		return nil, p, fmt.Errorf("sequence header must be %q followed by a sender and a number", sequencePrefix)
+	}
+	n, err := strconv.ParseUint(string(fields[1]), 10, 64)
+	if err != nil {
+		return nil, p, fmt.Errorf("bad sequence number %q", fields[1])
+	}
+	return &SequenceHeader{Sender: string(fields[0]), Number: n}, rest, nil
+}
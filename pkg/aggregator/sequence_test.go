@@ -0,0 +1,41 @@
+package aggregator
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSplitSequenceHeader(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		input   string
+		header  *SequenceHeader
+		rest    string
+		wantErr bool
+	}{
+		"none":          {"foo{} 1", nil, "foo{} 1", false},
+		"header":        {"#seq web-1 42\nfoo{} 1", &SequenceHeader{"web-1", 42}, "foo{} 1", false},
+		"header only":   {"#seq web-1 42", &SequenceHeader{"web-1", 42}, "", false},
+		"json":          {"#seq a 0\n{\"name\":\"foo\",\"value\":1}", &SequenceHeader{"a", 0}, `{"name":"foo","value":1}`, false},
+		"no sender":     {"#seq 42\nfoo{} 1", nil, "", true},
+		"bad number":    {"#seq web-1 x\nfoo{} 1", nil, "", true},
+		"negative":      {"#seq web-1 -1\nfoo{} 1", nil, "", true},
+		"other comment": {"# HELP foo\nfoo{} 1", nil, "# HELP foo\nfoo{} 1", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			header, rest, err := SplitSequenceHeader([]byte(testcase.input))
+			if (err != nil) != testcase.wantErr {
+				t.Fatalf("want error %v, have %v", testcase.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(testcase.header, header); diff != "" {
+				t.Errorf("header: %s", diff)
+			}
+			if want, have := testcase.rest, string(rest); want != have {
+				t.Errorf("rest: want %q, have %q", want, have)
+			}
+		})
+	}
+}
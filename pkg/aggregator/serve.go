@@ -0,0 +1,228 @@
+package aggregator
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Server reads lines from listeners, and observes them. It's the listener
+// plumbing of the prometheus-aggregator command, without its telemetry, rate
+// limits, or queueing, for embedding the aggregator in another program.
+type Server struct {
+	// Observer observes each parsed line, typically a *Universe. It must
+	// be set.
+	Observer Observer
+
+	// MaxLineBytes is the maximum length of a line or packet, after
+	// decompression. Zero means DefaultMaxLineBytes.
+	MaxLineBytes int
+
+	// Interner, if not nil, interns the strings of parsed lines.
+	Interner *Interner
+
+	// Cipher, if not nil, decrypts each packet read by ServePacket, before
+	// it's decompressed. Packets that can't be decrypted are rejected.
+	Cipher *PacketCipher
+
+	// ErrorHandler, if not nil, is called with each rejected line, and the
+	// reason it was rejected. It may be called concurrently.
+	ErrorHandler func(line []byte, err error)
+}
+
+// DefaultMaxLineBytes is the default maximum line or packet size.
+const DefaultMaxLineBytes = bufio.MaxScanTokenSize
+
+// Serve is a convenience function for Server.Serve with the defaults.
+func Serve(ln net.Listener, o Observer) error {
+	return (&Server{Observer: o}).Serve(ln)
+}
+
+// ServePacket is a convenience function for Server.ServePacket with the
+// defaults.
+func ServePacket(conn net.PacketConn, o Observer) error {
+	return (&Server{Observer: o}).ServePacket(conn)
+}
+
+// Handler returns a handler that observes the lines POSTed to it, with the
+// defaults. To serve the observations, use the Universe itself.
+func Handler(o Observer) http.Handler {
+	return &Server{Observer: o}
+}
+
+// Serve accepts connections from ln, and observes the newline-delimited lines
+// read from each, until ln.Accept fails, whose error it returns. Connections
+// are read until they're closed, or a line is too long.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			s.readLines(conn, nil)
+		}()
+	}
+}
+
+// ServePacket observes each packet read from conn as a single line, until the
+// read fails, whose error it returns.
+func (s *Server) ServePacket(conn net.PacketConn) error {
+	overhead := s.Cipher.Overhead()
+	buf := make([]byte, s.maxLineBytes()+overhead+1) // room to detect truncation
+	var d Decompressor
+	defer d.Release()
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if n > s.maxLineBytes()+overhead {
+			s.reject(buf[:n], s.tooLong())
+			continue
+		}
+		packet := buf[:n]
+		if s.Cipher != nil {
+			if packet, err = s.Cipher.Open(packet); err != nil {
+				s.reject(buf[:n], errors.Wrap(err, "decryption error"))
+				continue
+			}
+		}
+		s.handleLine(&d, packet, true)
+	}
+}
+
+// ServeHTTP observes each line in the body of a POST, which may be gzipped
+// as a whole. It responds 204 No Content if every line is accepted, and 400
+// Bad Request, describing the first rejected line, otherwise.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "decompression error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		body = zr
+	}
+
+	var (
+		lines, rejected int
+		first           error
+	)
+	err := s.readLines(body, func(err error) {
+		lines++
+		if err != nil {
+			if first == nil {
+				first = errors.Wrapf(err, "line %d", lines)
+			}
+			rejected++
+		}
+	})
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case first != nil:
+		http.Error(w, fmt.Sprintf("%d of %d lines rejected, first: %v", rejected, lines, first), http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// readLines observes each line in r, and calls result, which may be nil,
+// with the outcome of each. A line that's too long ends the stream, as do
+// read errors, which are returned.
+func (s *Server) readLines(r io.Reader, result func(error)) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, s.maxLineBytes()+1) // room for the newline
+	var d Decompressor
+	defer d.Release()
+	for sc.Scan() {
+		err := s.handleLine(&d, sc.Bytes(), false)
+		if result != nil {
+			result(err)
+		}
+	}
+	if err := sc.Err(); err == bufio.ErrTooLong {
+		s.reject(nil, s.tooLong())
+		return s.tooLong()
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// handleLine decompresses, parses, and observes a single line, or packet,
+// ignoring the sequence header a packet may start with, heartbeats, blank
+// lines, and comments.
+func (s *Server) handleLine(d *Decompressor, line []byte, packet bool) error {
+	data, err := d.Decompress(line)
+	if err != nil {
+		return s.reject(line, errors.Wrap(err, "decompression error"))
+	}
+	if len(data) > s.maxLineBytes() {
+		return s.reject(line, s.tooLong())
+	}
+	if packet {
+		header, rest, err := SplitSequenceHeader(data)
+		if err != nil {
+			return s.reject(data, errors.Wrap(err, "parse error"))
+		}
+		if header != nil && len(rest) == 0 {
+			return nil
+		}
+		data = rest
+	}
+	if _, ok, err := ParseHeartbeat(data); ok {
+		if err != nil {
+			return s.reject(data, errors.Wrap(err, "parse error"))
+		}
+		return nil // there's nowhere to record it
+	}
+	if IsComment(data) {
+		return nil
+	}
+	o, err := ParseLine(data, s.Interner)
+	if err != nil {
+		return s.reject(data, errors.Wrap(err, "parse error"))
+	}
+	if len(o.Values) > 0 {
+		err = s.Observer.ObserveBatch(o.Split())
+	} else {
+		err = s.Observer.Observe(o)
+	}
+	if err != nil {
+		return s.reject(data, errors.Wrap(err, "observation error"))
+	}
+	return nil
+}
+
+func (s *Server) reject(line []byte, err error) error {
+	if s.ErrorHandler != nil {
+		s.ErrorHandler(line, err)
+	}
+	return err
+}
+
+func (s *Server) maxLineBytes() int {
+	if s.MaxLineBytes > 0 {
+		return s.MaxLineBytes
+	}
+	return DefaultMaxLineBytes
+}
+
+func (s *Server) tooLong() error {
+	return fmt.Errorf("line exceeds maximum of %d bytes", s.maxLineBytes())
+}
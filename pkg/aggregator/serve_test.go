@@ -0,0 +1,173 @@
+package aggregator
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	u, _ := NewUniverse()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var (
+		mtx      sync.Mutex
+		rejected []string
+	)
+	s := &Server{Observer: u, ErrorHandler: func(line []byte, err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		rejected = append(rejected, string(line))
+	}}
+	go s.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(conn, `{"name":"foo_total","type":"counter","help":"Total number of foos."}`)
+	fmt.Fprintln(conn, `bar_total{} 1`) // undeclared
+	fmt.Fprintln(conn, `#heartbeat web-1`)
+	fmt.Fprintln(conn, `foo_total{code="200"} 1`)
+	fmt.Fprintln(conn, `foo_total{code="200"} 2`)
+	conn.Close()
+
+	waitForValue(t, u, "foo_total", map[string]string{"code": "200"}, 3)
+	mtx.Lock()
+	defer mtx.Unlock()
+	if want, have := []string{`bar_total{} 1`}, rejected; fmt.Sprint(want) != fmt.Sprint(have) {
+		t.Errorf("rejected: want %q, have %q", want, have)
+	}
+}
+
+func TestServePacket(t *testing.T) {
+	u, _ := NewUniverse()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go ServePacket(conn, u)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte(`{"name":"foo","type":"gauge","help":"Current foo."}`))
+	client.Write(compressData([]byte(`foo{} 7`)))
+	client.Write([]byte("#seq web-1 1\nfoo{} 8"))
+
+	waitForValue(t, u, "foo", nil, 8)
+}
+
+func TestHandler(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	h := Handler(u)
+
+	for name, testcase := range map[string]struct {
+		method string
+		body   string
+		gzip   bool
+		code   int
+	}{
+		"accepted": {
+			method: "POST",
+			body:   "foo_total{} 1\n",
+			code:   http.StatusNoContent,
+		},
+		"gzipped": {
+			method: "POST",
+			body:   "foo_total{} 1\nfoo_total{} 1",
+			gzip:   true,
+			code:   http.StatusNoContent,
+		},
+		"rejected": {
+			method: "POST",
+			body:   "foo_total{} 1\nbar_total{} 1\n",
+			code:   http.StatusBadRequest,
+		},
+		"GET": {
+			method: "GET",
+			code:   http.StatusMethodNotAllowed,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			body := []byte(testcase.body)
+			if testcase.gzip {
+				body = compressData(body)
+			}
+			req := httptest.NewRequest(testcase.method, "/", bytes.NewReader(body))
+			if testcase.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if want, have := testcase.code, rec.Code; want != have {
+				t.Fatalf("want %d, have %d: %s", want, have, rec.Body.String())
+			}
+		})
+	}
+
+	// One from each accepted or rejected request, and two gzipped.
+	if s, ok := u.Lookup("foo_total", nil); !ok || *s.Value != 4 {
+		t.Fatalf("want 4, have %v", s.Value)
+	}
+}
+
+func TestServeLineTooLong(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	var errs []error
+	s := &Server{Observer: u, MaxLineBytes: 16, ErrorHandler: func(_ []byte, err error) { errs = append(errs, err) }}
+
+	err := s.readLines(strings.NewReader("foo_total{} 1\nfoo_total{} 1234567890\nfoo_total{} 1\n"), nil)
+	if err == nil {
+		t.Fatal("want error, have none")
+	}
+	if want, have := 1, len(errs); want != have {
+		t.Fatalf("want %d rejected, have %d", want, have)
+	}
+	if s, ok := u.Lookup("foo_total", nil); !ok || *s.Value != 1 {
+		t.Fatalf("want 1, have %v", s.Value)
+	}
+
+	// Compressed lines are limited after decompression.
+	errs = nil
+	if err := s.handleLine(&Decompressor{}, compressData([]byte(`foo_total{} 1234567890`)), false); err == nil {
+		t.Fatal("want error, have none")
+	}
+	if want, have := 1, len(errs); want != have {
+		t.Fatalf("want %d rejected, have %d", want, have)
+	}
+}
+
+// waitForValue waits for the series to have the value, which is observed
+// asynchronously.
+func waitForValue(t *testing.T, u *Universe, name string, labels map[string]string, value float64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, ok := u.Lookup(name, labels)
+		if ok && *s.Value == value {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s%v: want %v, have %v", name, labels, value, s.Value)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
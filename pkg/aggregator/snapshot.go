@@ -0,0 +1,399 @@
+package aggregator
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// snapshotVersion is the version of the snapshot format written by
+// WriteSnapshot. ReadSnapshot rejects snapshots of any other version.
+const snapshotVersion = 1
+
+// snapshotLine is one line of a snapshot, which is newline-delimited JSON: a
+// header with the version, then each metric's declaration, followed by the
+// state of each of its series.
+type snapshotLine struct {
+	Version     int          `json:"version,omitempty"`
+	Declaration *Observation `json:"declaration,omitempty"`
+	Series      *seriesState `json:"series,omitempty"`
+}
+
+// seriesState is the state of a single series, from which it's restored.
+type seriesState struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Value     *snapshotFloat    `json:"value,omitempty"`     // counters and gauges
+	Sum       *snapshotFloat    `json:"sum,omitempty"`       // histograms and distributions
+	Count     *uint64           `json:"count,omitempty"`     // histograms and distributions
+	Buckets   []uint64          `json:"buckets,omitempty"`   // histograms, excluding +Inf, not cumulative
+	Sketch    *sketchState      `json:"sketch,omitempty"`    // distributions, over the window
+	Timestamp int64             `json:"timestamp,omitempty"` // gauge histograms, of the snapshot
+	LastSeen  int64             `json:"last_seen,omitempty"`
+	TTL       string            `json:"ttl,omitempty"` // the series' own, if any
+}
+
+// sketchState is the state of a DDSketch, without its relative accuracy,
+// which is declared.
+type sketchState struct {
+	Positive       []uint64      `json:"positive,omitempty"`
+	PositiveOffset int           `json:"positive_offset,omitempty"`
+	Negative       []uint64      `json:"negative,omitempty"`
+	NegativeOffset int           `json:"negative_offset,omitempty"`
+	Zero           uint64        `json:"zero,omitempty"`
+	Count          uint64        `json:"count"`
+	Sum            snapshotFloat `json:"sum"`
+}
+
+// snapshotFloat is encoded as a string, like the values of the Prometheus
+// API, as gauges may be NaN or infinite, which JSON numbers can't be.
+type snapshotFloat float64
+
+func (f snapshotFloat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatFloat(float64(f), 'g', -1, 64))
+}
+
+func (f *snapshotFloat) UnmarshalJSON(buf []byte) error {
+	var s string
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return err
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*f = snapshotFloat(v)
+	return nil
+}
+
+func newSnapshotFloat(v float64) *snapshotFloat {
+	f := snapshotFloat(v)
+	return &f
+}
+
+// WriteSnapshot writes the state of every metric to w, so that it can be
+// restored by ReadSnapshot, in another universe, or another process. As with
+// ServeHTTP, only one collection is locked at a time, so the snapshot isn't
+// consistent across metrics. The windows of gauges' minimums and maximums,
+// and the counts of top K labels, aren't included.
+func (u *Universe) WriteSnapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(snapshotLine{Version: snapshotVersion}); err != nil {
+		return err
+	}
+	for _, n := range u.metricNames() {
+		if err := u.writeCollectionSnapshot(enc, n); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (u *Universe) writeCollectionSnapshot(enc *json.Encoder, n metricName) error {
+	s := u.shard(n)
+	defer s.mtx.Unlock()
+	c, ok := s.collections[n]
+	if !ok {
+		return nil // removed since the names were listed
+	}
+	decl := c.declaration(n)
+	if err := enc.Encode(snapshotLine{Declaration: &decl}); err != nil {
+		return err
+	}
+	keys, values := c.withSpilled(n, u.policies.spill)
+	for _, k := range keys {
+		v := values[k]
+		if !v.touched() {
+			continue // a declaration
+		}
+		if err := enc.Encode(snapshotLine{Series: stateOf(v)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stateOf(v timeseriesValue) *seriesState {
+	st := &seriesState{Labels: seriesLabels(v), LastSeen: v.seenAt()}
+	if ttl, ok := v.ownTTL(); ok {
+		st.TTL = ttl.String()
+	}
+	switch v := v.(type) {
+	case *counter:
+		st.Name, st.Value = v.n, newSnapshotFloat(v.value.load())
+	case *gauge:
+		st.Name, st.Value = v.n, newSnapshotFloat(v.value.load())
+	case *histogram:
+		count := v.count
+		st.Name, st.Sum, st.Count = v.n, newSnapshotFloat(v.sum), &count
+		st.Buckets = make([]uint64, len(v.buckets))
+		for i, b := range v.buckets {
+			st.Buckets[i] = b.count
+		}
+	case *gaugeHistogram:
+		st = stateOf(&v.histogram)
+		st.Timestamp = v.stamp
+	case *distribution:
+		count := v.count
+		st.Name, st.Sum, st.Count = v.n, newSnapshotFloat(v.sum), &count
+		sk := v.window.sketch()
+		st.Sketch = &sketchState{
+			Positive:       append([]uint64(nil), sk.positive.bins...),
+			PositiveOffset: sk.positive.offset,
+			Negative:       append([]uint64(nil), sk.negative.bins...),
+			NegativeOffset: sk.negative.offset,
+			Zero:           sk.zero,
+			Count:          sk.count,
+			Sum:            snapshotFloat(sk.sum),
+		}
+	}
+	return st
+}
+
+// ReadSnapshot restores the metrics in a snapshot written by WriteSnapshot,
+// and returns how many series it restored. With replace, every existing
+// metric is removed first. Otherwise, the snapshot is merged: metrics are
+// declared as if by Declare, counters, histograms, and distributions are
+// added to any existing series, gauges keep the value of whichever series
+// was observed most recently, and gauge histograms the later snapshot. The
+// whole snapshot is checked before any of it is restored, so an error leaves
+// the universe as it was. Restored series aren't subject to the memory limit.
+func (u *Universe) ReadSnapshot(r io.Reader, replace bool) (int, error) {
+	lines, err := readSnapshot(r)
+	if err != nil {
+		return 0, err
+	}
+	if err := u.checkSnapshot(lines, replace); err != nil {
+		return 0, err
+	}
+	if replace {
+		u.reset()
+	}
+	var restored int
+	for _, l := range lines {
+		switch {
+		case l.Declaration != nil:
+			if _, err := u.Declare(*l.Declaration); err != nil {
+				return restored, err // checked, so only if declared concurrently
+			}
+		case l.Series != nil:
+			if err := u.restore(*l.Series); err != nil {
+				return restored, err
+			}
+			restored++
+		}
+	}
+	return restored, nil
+}
+
+func readSnapshot(r io.Reader) ([]snapshotLine, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var header snapshotLine
+	if err := dec.Decode(&header); err != nil {
+		return nil, errors.Wrap(err, "invalid snapshot")
+	}
+	if header.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d, must be %d", header.Version, snapshotVersion)
+	}
+	var lines []snapshotLine
+	for i := 2; ; i++ {
+		var l snapshotLine
+		err := dec.Decode(&l)
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid snapshot, line %d", i)
+		}
+		if (l.Declaration == nil) == (l.Series == nil) {
+			return nil, fmt.Errorf("invalid snapshot, line %d: want a declaration or a series", i)
+		}
+		lines = append(lines, l)
+	}
+}
+
+// checkSnapshot returns an error if any of the lines couldn't be restored.
+func (u *Universe) checkSnapshot(lines []snapshotLine, replace bool) error {
+	declared := map[string]Observation{}
+	for _, l := range lines {
+		if o := l.Declaration; o != nil {
+			if o.Value != nil {
+				return fmt.Errorf("%s: declaration has a value", o.Name)
+			}
+			if _, ok := declared[o.Name]; ok {
+				return fmt.Errorf("%s: declared more than once", o.Name)
+			}
+			var err error
+			if replace {
+				if err = u.Limits().check(*o); err == nil {
+					_, err = newTimeseriesCollection(*o)
+				}
+			} else {
+				err = u.CheckDeclaration(*o)
+			}
+			if err != nil {
+				return errors.Wrap(err, o.Name)
+			}
+			declared[o.Name] = *o
+			continue
+		}
+		st := l.Series
+		o, ok := declared[st.Name]
+		if !ok {
+			return fmt.Errorf("%s: series isn't declared first", st.Name)
+		}
+		if err := u.Limits().check(Observation{Name: st.Name, Labels: st.Labels}); err != nil {
+			return errors.Wrap(err, st.Name)
+		}
+		if err := st.check(o); err != nil {
+			return errors.Wrap(err, st.Name)
+		}
+	}
+	return nil
+}
+
+// check returns an error if the state isn't that of a series of the
+// declared metric.
+func (st seriesState) check(decl Observation) error {
+	if st.TTL != "" {
+		if _, err := parseTTL(st.TTL); err != nil {
+			return err
+		}
+	}
+	switch decl.Type {
+	case "counter", "gauge":
+		if st.Value == nil {
+			return fmt.Errorf("%s series has no value", decl.Type)
+		}
+	case "histogram", "gaugehistogram":
+		if st.Sum == nil || st.Count == nil || len(st.Buckets) != len(decl.Buckets) {
+			return fmt.Errorf("%s series must have a sum, a count, and %d buckets", decl.Type, len(decl.Buckets))
+		}
+		if decl.Type == "gaugehistogram" && st.Timestamp <= 0 {
+			return fmt.Errorf("gaugehistogram series must have a timestamp")
+		}
+	case "distribution":
+		if st.Sum == nil || st.Count == nil || st.Sketch == nil {
+			return fmt.Errorf("distribution series must have a sum, a count, and a sketch")
+		}
+		if len(st.Sketch.Positive) > maxSketchBins || len(st.Sketch.Negative) > maxSketchBins {
+			return fmt.Errorf("distribution sketch has more than %d bins", maxSketchBins)
+		}
+	}
+	return nil
+}
+
+// reset removes every metric, including spilled series.
+func (u *Universe) reset() {
+	u.policies.spill.reset()
+	for _, s := range u.shards {
+		s.mtx.Lock()
+		for n, c := range s.collections {
+			for k := range c.values {
+				s.remove(c, k)
+			}
+			delete(s.collections, n)
+		}
+		s.mtx.Unlock()
+	}
+}
+
+// restore creates the series with the state st, or merges st into it, if
+// it exists. Its metric must have been declared.
+func (u *Universe) restore(st seriesState) error {
+	n := metricName(st.Name)
+	s := u.shard(n)
+	defer s.mtx.Unlock()
+	c, ok := s.collections[n]
+	if !ok {
+		return fmt.Errorf("%s: metric was removed while being restored", st.Name)
+	}
+	defer func(before int64) { atomic.AddInt64(&s.bytes, c.bytes-before) }(c.bytes)
+	k := Observation{Name: st.Name, Labels: st.Labels}.timeseriesKey()
+	if err := s.pageIn(c, n, k, u.policies.spill); err != nil {
+		return err
+	}
+	if _, err := c.restore(st); err != nil {
+		return err
+	}
+	s.storeLockFree(c, k)
+	return nil
+}
+
+// restore creates the series of c with the state st, or merges st into it,
+// if it exists, and returns its key.
+func (c *timeseriesCollection) restore(st seriesState) (timeseriesKey, error) {
+	o := Observation{Name: st.Name, Labels: st.Labels}
+	k := o.timeseriesKey()
+	if err := c.observe(o); err != nil { // creates the series, without a value
+		return k, err
+	}
+	v := c.values[k]
+	switch v := v.(type) {
+	case *counter:
+		v.value.add(float64(*st.Value))
+		atomic.StoreUint32(&v.touch, 1)
+	case *gauge:
+		if !v.touched() || st.LastSeen >= v.seenAt() {
+			v.value.store(float64(*st.Value))
+		}
+		atomic.StoreUint32(&v.touch, 1)
+	case *histogram:
+		if len(st.Buckets) != len(v.buckets) {
+			return k, fmt.Errorf("%s: histogram buckets changed while being restored", st.Name)
+		}
+		v.sum += float64(*st.Sum)
+		v.count += *st.Count
+		for i, n := range st.Buckets {
+			v.buckets[i].count += n
+		}
+	case *gaugeHistogram:
+		if len(st.Buckets) != len(v.buckets) {
+			return k, fmt.Errorf("%s: gauge histogram buckets changed while being restored", st.Name)
+		}
+		if v.touched() && st.Timestamp < v.stamp {
+			break // the current snapshot is later
+		}
+		v.sum, v.count, v.stamp = float64(*st.Sum), *st.Count, st.Timestamp
+		for i, n := range st.Buckets {
+			v.buckets[i].count = n
+		}
+	case *distribution:
+		v.sum += float64(*st.Sum)
+		v.count += *st.Count
+		v.window.restore(*st.Sketch)
+	}
+	if st.LastSeen > v.seenAt() {
+		v.markSeen(st.LastSeen)
+	}
+	if _, ok := v.ownTTL(); !ok && st.TTL != "" {
+		ttl, _ := parseTTL(st.TTL) // checked by checkSnapshot, or written by stateOf
+		v.setTTL(*ttl)
+		c.seriesTTLs = true
+	}
+	return k, nil
+}
+
+// restore adds the observations in the sketch state to the current bucket of
+// the window, as if they had just been observed.
+func (w *sketchWindow) restore(st sketchState) {
+	w.rotate()
+	head := w.sketches[w.ring.head]
+	restored := &ddsketch{
+		gamma:    head.gamma,
+		logGamma: head.logGamma,
+		positive: sketchStore{bins: st.Positive, offset: st.PositiveOffset},
+		negative: sketchStore{bins: st.Negative, offset: st.NegativeOffset},
+		zero:     st.Zero,
+		count:    st.Count,
+		sum:      float64(st.Sum),
+	}
+	head.merge(restored)
+}
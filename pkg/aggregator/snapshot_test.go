@@ -0,0 +1,122 @@
+package aggregator
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var snapshotObservations = []string{
+	`{"name":"foo_total","type":"counter","help":"Total number of foos.","ttl":"1h"}`,
+	`foo_total{code="200"} 3`,
+	`foo_total{code="404"} 1`,
+	`{"name":"bar","type":"gauge","help":"Current bar."}`,
+	`bar{} NaN`,
+	`{"name":"baz_seconds","type":"histogram","help":"Baz duration in seconds.","buckets":[0.1,1]}`,
+	`baz_seconds{} 0.05`,
+	`baz_seconds{} 0.5`,
+	`{"name":"qux_seconds","type":"distribution","help":"Qux duration in seconds.","quantiles":[0.5]}`,
+	`qux_seconds{} 1`,
+	`qux_seconds{} 2`,
+	`qux_seconds{} 3`,
+	`{"name":"quux","type":"gauge","help":"Declared, but never observed."}`,
+}
+
+func TestSnapshot(t *testing.T) {
+	src, _ := NewUniverse()
+	loadObservations(t, src, makeObservations(t, snapshotObservations))
+	var buf bytes.Buffer
+	if err := src.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.String()
+
+	dst, _ := NewShardedUniverse(3) // sharding needn't match
+	loadObservations(t, dst, makeObservations(t, []string{
+		`{"name":"old_total","type":"counter","help":"Removed by replace."}`,
+		`old_total{} 1`,
+	}))
+	if n, err := dst.ReadSnapshot(strings.NewReader(snapshot), true); err != nil || n != 5 {
+		t.Fatalf("replace: want 5 series, have %d, %v", n, err)
+	}
+	if want, have := scrape(t, src), scrape(t, dst); want != have {
+		t.Fatalf("replace:\n---WANT---\n%s\n---HAVE---\n%s", want, have)
+	}
+	counts := dst.SeriesCounts()
+	if _, ok := counts["quux"]; !ok {
+		t.Errorf("replace: want the unobserved declaration restored, have %v", counts)
+	}
+	if _, ok := counts["old_total"]; ok {
+		t.Errorf("replace: want old_total removed, have %v", counts)
+	}
+
+	// Merging adds counters, histograms, and distributions, and takes the
+	// snapshot's gauge, which was observed no less recently.
+	loadObservations(t, dst, makeObservations(t, []string{`bar{} 7`}))
+	if _, err := dst.ReadSnapshot(strings.NewReader(snapshot), false); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := normalizeResponse(`
+		# HELP bar Current bar.
+		# TYPE bar gauge
+		bar{} NaN
+
+		# HELP baz_seconds Baz duration in seconds.
+		# TYPE baz_seconds histogram
+		baz_seconds_bucket{le="0.1"} 2
+		baz_seconds_bucket{le="1"} 4
+		baz_seconds_bucket{le="+Inf"} 4
+		baz_seconds_sum{} 1.100000
+		baz_seconds_count{} 4
+
+		# HELP foo_total Total number of foos.
+		# TYPE foo_total counter
+		foo_total{code="200"} 6.000000
+		foo_total{code="404"} 2.000000
+
+		# HELP qux_seconds Qux duration in seconds.
+		# TYPE qux_seconds summary
+		qux_seconds{quantile="0.5"} 1.993662
+		qux_seconds_sum{} 12.000000
+		qux_seconds_count{} 6
+	`), normalizeResponse(scrape(t, dst)); want != have {
+		t.Fatalf("merge:\n---WANT---\n%s\n---HAVE---\n%s", want, have)
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	const header = `{"version":1}` + "\n"
+	for name, testcase := range map[string]struct {
+		snapshot string
+		wantErr  string
+	}{
+		"no header":  {"", "unsupported snapshot version 0"},
+		"version":    {`{"version":2}`, "unsupported snapshot version 2"},
+		"bad line":   {header + `{"series":{"name":"foo_total"`, "invalid snapshot, line 2"},
+		"empty line": {header + `{}`, "want a declaration or a series"},
+		"undeclared": {header + `{"series":{"name":"foo_total","value":"1"}}`, "series isn't declared first"},
+		"conflict":   {header + `{"declaration":{"name":"foo_total","type":"gauge","help":"Foo."}}`, "can't change type"},
+		"twice": {header + `{"declaration":{"name":"bar_total","type":"counter","help":"Bar."}}` + "\n" +
+			`{"declaration":{"name":"bar_total","type":"counter","help":"Bar."}}`, "declared more than once"},
+		"no value": {header + `{"declaration":{"name":"bar_total","type":"counter","help":"Bar."}}` + "\n" +
+			`{"series":{"name":"bar_total"}}`, "counter series has no value"},
+		"buckets": {header + `{"declaration":{"name":"bar_seconds","type":"histogram","help":"Bar.","buckets":[1]}}` + "\n" +
+			`{"series":{"name":"bar_seconds","sum":"1","count":1,"buckets":[1,1]}}`, "histogram series must have"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			u, _ := NewUniverse()
+			loadObservations(t, u, makeObservations(t, []string{
+				`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+				`foo_total{} 1`,
+			}))
+			before := scrape(t, u)
+			_, err := u.ReadSnapshot(strings.NewReader(testcase.snapshot+"\n"+`{"series":{"name":"foo_total","value":"1"}}`), false)
+			if err == nil || !strings.Contains(err.Error(), testcase.wantErr) {
+				t.Fatalf("want error containing %q, have %v", testcase.wantErr, err)
+			}
+			if after := scrape(t, u); before != after {
+				t.Errorf("want the universe unchanged, have\n%s", after)
+			}
+		})
+	}
+}
@@ -0,0 +1,401 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// spillCompactBytes is the size of a spill file below which superseded
+// entries aren't compacted away.
+const spillCompactBytes = 1 << 20
+
+// SpillStats are statistics of the series spilled to disk with ShedSpill.
+type SpillStats struct {
+	Series   int    // spilled, and not yet paged back in, expired, or deleted
+	Bytes    int64  // of the spill file, including superseded entries
+	Spilled  uint64 // total series spilled
+	PagedIn  uint64 // total series paged back in, to be observed
+	Failures uint64 // total failures to write or read the spill file, whose series are lost
+}
+
+// spillStore holds the series spilled from a universe in a file, in the
+// encoding of snapshots, one series per line, with an index in memory of
+// where each series is. Entries are appended, so the file grows until it's
+// compacted, once most of it is superseded. Its methods may be called with
+// any shard locked.
+type spillStore struct {
+	dir string
+
+	mtx    sync.Mutex
+	f      *os.File
+	size   int64 // of f
+	live   int64 // bytes of the entries in index
+	index  map[metricName]map[timeseriesKey]spillEntry
+	series int
+	stats  SpillStats
+}
+
+// spillEntry is where a spilled series is in the file, and what's needed to
+// expire it without reading it.
+type spillEntry struct {
+	off, n int64
+	seen   int64          // unix nanoseconds, as of the last Expire before it was spilled
+	ttl    *time.Duration // its own, if any
+}
+
+// SetSpillDir sets the directory to which ShedSpill spills series. Each
+// universe spills to a file of its own, which is removed at once, where the
+// platform allows, so that it doesn't outlive the process. It must be called
+// before the universe is served.
+func (u *Universe) SetSpillDir(dir string) error {
+	f, err := createSpillFile(dir)
+	if err != nil {
+		return err
+	}
+	u.policies.spill = &spillStore{dir: dir, f: f, index: map[metricName]map[timeseriesKey]spillEntry{}}
+	return nil
+}
+
+func createSpillFile(dir string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, "series-*.spill")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating spill file")
+	}
+	os.Remove(f.Name()) // kept open, where that's allowed
+	return f, nil
+}
+
+// SpillStats returns statistics of the series spilled to disk, which are
+// zero unless series are spilled.
+func (u *Universe) SpillStats() SpillStats {
+	return u.policies.spill.statistics()
+}
+
+func (sp *spillStore) statistics() SpillStats {
+	if sp == nil {
+		return SpillStats{}
+	}
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	stats := sp.stats
+	stats.Series, stats.Bytes = sp.series, sp.size
+	return stats
+}
+
+// put spills the series k, whose value is v. If it can't be written, it's
+// lost, as if it had been evicted.
+func (sp *spillStore) put(n metricName, k timeseriesKey, v timeseriesValue) error {
+	st := stateOf(v)
+	buf, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	if _, err := sp.f.WriteAt(buf, sp.size); err != nil {
+		sp.stats.Failures++
+		return errors.Wrap(err, "writing spill file")
+	}
+	e := spillEntry{off: sp.size, n: int64(len(buf)), seen: st.LastSeen}
+	if ttl, ok := v.ownTTL(); ok {
+		e.ttl = &ttl
+	}
+	sp.size += e.n
+	sp.add(n, k, e)
+	sp.stats.Spilled++
+	return nil
+}
+
+func (sp *spillStore) add(n metricName, k timeseriesKey, e spillEntry) {
+	if sp.index[n] == nil {
+		sp.index[n] = map[timeseriesKey]spillEntry{}
+	}
+	if old, ok := sp.index[n][k]; ok {
+		sp.live -= old.n
+		sp.series--
+	}
+	sp.index[n][k] = e
+	sp.live += e.n
+	sp.series++
+}
+
+// take returns the state of the spilled series k, if there is one, and
+// forgets it, as it's paged back in.
+func (sp *spillStore) take(n metricName, k timeseriesKey) (*seriesState, error) {
+	if sp == nil {
+		return nil, nil
+	}
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	e, ok := sp.index[n][k]
+	if !ok {
+		return nil, nil
+	}
+	st, err := sp.read(e)
+	if err != nil {
+		return nil, err
+	}
+	sp.remove(n, k)
+	sp.tidy()
+	sp.stats.PagedIn++
+	return st, nil
+}
+
+// states returns the state of every spilled series of the metric, by key,
+// except those that can't be read.
+func (sp *spillStore) states(n metricName) map[timeseriesKey]*seriesState {
+	if sp == nil {
+		return nil
+	}
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	if len(sp.index[n]) == 0 {
+		return nil
+	}
+	states := make(map[timeseriesKey]*seriesState, len(sp.index[n]))
+	for k, e := range sp.index[n] {
+		if st, err := sp.read(e); err == nil {
+			states[k] = st
+		}
+	}
+	return states
+}
+
+// peek returns the state of the spilled series k, if there is one, and it
+// can be read.
+func (sp *spillStore) peek(n metricName, k timeseriesKey) *seriesState {
+	if sp == nil {
+		return nil
+	}
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	e, ok := sp.index[n][k]
+	if !ok {
+		return nil
+	}
+	st, _ := sp.read(e)
+	return st
+}
+
+// has reports whether the series k is spilled.
+func (sp *spillStore) has(n metricName, k timeseriesKey) bool {
+	if sp == nil {
+		return false
+	}
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	_, ok := sp.index[n][k]
+	return ok
+}
+
+// count returns the number of spilled series of the metric.
+func (sp *spillStore) count(n metricName) int {
+	if sp == nil {
+		return 0
+	}
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	return len(sp.index[n])
+}
+
+// read returns the state of the series in the entry, counting a failure if
+// it can't be read. The mutex must be held.
+func (sp *spillStore) read(e spillEntry) (*seriesState, error) {
+	buf := make([]byte, e.n)
+	if _, err := sp.f.ReadAt(buf, e.off); err != nil {
+		sp.stats.Failures++
+		return nil, errors.Wrap(err, "reading spill file")
+	}
+	var st seriesState
+	if err := json.Unmarshal(buf, &st); err != nil {
+		sp.stats.Failures++
+		return nil, errors.Wrap(err, "reading spill file")
+	}
+	return &st, nil
+}
+
+// drop forgets the spilled series k, and reports whether there was one.
+func (sp *spillStore) drop(n metricName, k timeseriesKey) bool {
+	if sp == nil {
+		return false
+	}
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	if _, ok := sp.index[n][k]; !ok {
+		return false
+	}
+	sp.remove(n, k)
+	sp.tidy()
+	return true
+}
+
+// dropAll forgets every spilled series of the metric.
+func (sp *spillStore) dropAll(n metricName) {
+	if sp == nil {
+		return
+	}
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	for k := range sp.index[n] {
+		sp.remove(n, k)
+	}
+	sp.tidy()
+}
+
+// expire forgets the spilled series of the metric that haven't been
+// observed for longer than their TTL, or else ttl, as of now, and returns how
+// many.
+func (sp *spillStore) expire(n metricName, now int64, ttl time.Duration) int {
+	if sp == nil {
+		return 0
+	}
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	var expired int
+	for k, e := range sp.index[n] {
+		ttl := ttl
+		if e.ttl != nil {
+			ttl = *e.ttl
+		}
+		if ttl != 0 && e.seen != 0 && time.Duration(now-e.seen) > ttl {
+			sp.remove(n, k)
+			expired++
+		}
+	}
+	sp.tidy()
+	return expired
+}
+
+// remove forgets the entry of the series k. The mutex must be held.
+func (sp *spillStore) remove(n metricName, k timeseriesKey) {
+	sp.live -= sp.index[n][k].n
+	sp.series--
+	delete(sp.index[n], k)
+	if len(sp.index[n]) == 0 {
+		delete(sp.index, n)
+	}
+}
+
+// tidy compacts the file, once most of it is superseded. If that fails, the
+// file carries on growing. The mutex must be held.
+func (sp *spillStore) tidy() {
+	if sp.size > spillCompactBytes && sp.size > 2*sp.live {
+		sp.compact()
+	}
+}
+
+// compact rewrites the file with only the entries in the index. The mutex
+// must be held.
+func (sp *spillStore) compact() error {
+	f, err := createSpillFile(sp.dir)
+	if err != nil {
+		return err
+	}
+	index := make(map[metricName]map[timeseriesKey]spillEntry, len(sp.index))
+	var size int64
+	for n, entries := range sp.index {
+		index[n] = make(map[timeseriesKey]spillEntry, len(entries))
+		for k, e := range entries {
+			buf := make([]byte, e.n)
+			if _, err := sp.f.ReadAt(buf, e.off); err != nil {
+				f.Close()
+				return err
+			}
+			if _, err := f.WriteAt(buf, size); err != nil {
+				f.Close()
+				return err
+			}
+			e.off = size
+			size += e.n
+			index[n][k] = e
+		}
+	}
+	sp.f.Close()
+	sp.f, sp.size, sp.index = f, size, index
+	return nil
+}
+
+// reset forgets every spilled series.
+func (sp *spillStore) reset() {
+	if sp == nil {
+		return
+	}
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	sp.index = map[metricName]map[timeseriesKey]spillEntry{}
+	sp.live, sp.series = 0, 0
+	sp.compact()
+}
+
+// pageIn restores the spilled series k of the collection c, if there is one,
+// so that it can be observed. The shard must be locked.
+func (s *universeShard) pageIn(c *timeseriesCollection, n metricName, k timeseriesKey, sp *spillStore) error {
+	st, err := sp.take(n, k)
+	if err != nil || st == nil {
+		return err
+	}
+	if _, err := c.restore(*st); err != nil {
+		return errors.Wrapf(err, "paging in %s", k)
+	}
+	return nil
+}
+
+// pageInAll restores every spilled series of the collection c, before it's
+// converted to another type. The shard must be locked.
+func (s *universeShard) pageInAll(c *timeseriesCollection, n metricName, sp *spillStore) error {
+	defer func(before int64) { atomic.AddInt64(&s.bytes, c.bytes-before) }(c.bytes)
+	for k := range sp.states(n) {
+		if err := s.pageIn(c, n, k, sp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withSpilled returns the values of the collection c, the declaration of n,
+// and of its spilled series, as they would be if they were paged in, but
+// without paging them in, and their keys, sorted. If the spilled series
+// can't be read, only the values in memory are returned.
+func (c *timeseriesCollection) withSpilled(n metricName, sp *spillStore) ([]timeseriesKey, map[timeseriesKey]timeseriesValue) {
+	states := sp.states(n)
+	if len(states) == 0 {
+		return sortTimeseriesKeys(c.values), c.values
+	}
+	spilled, err := newTimeseriesCollection(c.declaration(n))
+	if err != nil {
+		return sortTimeseriesKeys(c.values), c.values
+	}
+	values := make(map[timeseriesKey]timeseriesValue, len(c.values)+len(states))
+	for k, v := range c.values {
+		values[k] = v
+	}
+	for k, st := range states {
+		if _, err := spilled.restore(*st); err == nil {
+			values[k] = spilled.values[k]
+		}
+	}
+	return sortTimeseriesKeys(values), values
+}
+
+// spilled returns the spilled series k of the collection c, the declaration
+// of n, as it would be if it were paged in, without paging it in.
+func (c *timeseriesCollection) spilled(n metricName, k timeseriesKey, sp *spillStore) (timeseriesValue, bool) {
+	st := sp.peek(n, k)
+	if st == nil {
+		return nil, false
+	}
+	spilled, err := newTimeseriesCollection(c.declaration(n))
+	if err != nil {
+		return nil, false
+	}
+	if _, err := spilled.restore(*st); err != nil {
+		return nil, false
+	}
+	return spilled.values[k], true
+}
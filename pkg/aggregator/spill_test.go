@@ -0,0 +1,185 @@
+package aggregator
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimitSpill(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`{"name":"bar_seconds","type":"histogram","help":"Bar duration.","buckets":[0.1,1]}`,
+		`{"name":"baz","type":"distribution","help":"Baz.","quantiles":[0.5]}`,
+		`{"name":"qux","type":"gauge","help":"Qux."}`,
+	})...)
+	if err := u.SetSpillDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	declared := u.MemoryBytes()
+	for i := 0; i < 4; i++ {
+		u.Expire(time.Unix(int64(i+1), 0), 0)
+		loadObservations(t, u, makeObservations(t, []string{
+			fmt.Sprintf(`foo_total{a="%d"} 1`, i),
+			fmt.Sprintf(`bar_seconds{a="%d"} 0.5`, i),
+			fmt.Sprintf(`baz{a="%d"} %d`, i, i),
+			fmt.Sprintf(`qux{a="%d"} %d`, i, i),
+		}))
+	}
+	before, snapshot, series := scrape(t, u), writeSnapshot(t, u), totalSeries(u.SeriesCounts())
+	if err := u.SetMemoryLimit(declared+(u.MemoryBytes()-declared)/2, ShedSpill); err != nil {
+		t.Fatal(err)
+	}
+	spilled := u.Evict()
+	if spilled == 0 {
+		t.Fatalf("Evict: want series spilled, have none")
+	}
+	if stats := u.SpillStats(); stats.Series != spilled || stats.Spilled != uint64(spilled) || stats.Bytes == 0 {
+		t.Errorf("stats: want %d series spilled, have %+v", spilled, stats)
+	}
+
+	// Spilled series are still scraped, snapshotted, counted, and looked up.
+	if want, have := before, scrape(t, u); want != have {
+		t.Errorf("scrape: want\n%s\nhave\n%s", want, have)
+	}
+	if want, have := snapshot, writeSnapshot(t, u); want != have {
+		t.Errorf("snapshot: want\n%s\nhave\n%s", want, have)
+	}
+	if want, have := series, totalSeries(u.SeriesCounts()); want != have {
+		t.Errorf("series: want %d, have %d", want, have)
+	}
+	if s, ok := u.Lookup("foo_total", map[string]string{"a": "0"}); !ok || *s.Value != 1 {
+		t.Errorf("spilled series: want 1, have %+v", s)
+	}
+
+	// Observing a spilled series pages it back in.
+	loadObservations(t, u, makeObservations(t, []string{`foo_total{a="0"} 2`, `bar_seconds{a="0"} 2`}))
+	if s, _ := u.Lookup("foo_total", map[string]string{"a": "0"}); *s.Value != 3 {
+		t.Errorf("paged in counter: want 3, have %v", *s.Value)
+	}
+	if s, _ := u.Lookup("bar_seconds", map[string]string{"a": "0"}); *s.Count != 2 || *s.Sum != 2.5 {
+		t.Errorf("paged in histogram: want a count of 2 and a sum of 2.5, have %+v", s)
+	}
+	if stats := u.SpillStats(); stats.Series != spilled-2 || stats.PagedIn != 2 {
+		t.Errorf("stats: want %d series spilled, and 2 paged in, have %+v", spilled-2, stats)
+	}
+
+	// Spilled series are deleted, expired, and reset like any other.
+	if !u.Delete("baz", map[string]string{"a": "0"}) {
+		t.Errorf("Delete: want the spilled series deleted, have none")
+	}
+	if _, ok := u.Lookup("baz", map[string]string{"a": "0"}); ok {
+		t.Errorf("deleted series: want none, have it")
+	}
+	u.Expire(time.Unix(10, 0), time.Second)
+	if want, have := 0, u.SpillStats().Series; want != have {
+		t.Errorf("after expiry: want %d series spilled, have %d", want, have)
+	}
+}
+
+func TestSpillCompact(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`foo_total{a="1"} 1`,
+		`foo_total{a="2"} 2`,
+	})...)
+	if err := u.SetSpillDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	sp := u.policies.spill
+	s := u.shard("foo_total")
+	c := s.collections["foo_total"]
+	for i := 0; i < 3; i++ { // superseded twice
+		for k, v := range c.values {
+			if err := sp.put("foo_total", k, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s.mtx.Unlock()
+	sp.mtx.Lock()
+	size := sp.size
+	err := sp.compact()
+	sp.mtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := sp.statistics(); stats.Series != 3 || stats.Bytes != size/3 { // and the declaration's
+		t.Errorf("want 3 series in %d bytes, have %+v", size/3, stats)
+	}
+	for a, want := range map[string]float64{"1": 1, "2": 2} {
+		st := sp.peek("foo_total", makeTimeseriesKey("foo_total", map[string]string{"a": a}))
+		if st == nil || float64(*st.Value) != want {
+			t.Errorf("a=%s: want %v, have %+v", a, want, st)
+		}
+	}
+}
+
+func TestMemoryLimitSpillConcurrent(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	if err := u.SetSpillDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetMemoryLimit(u.MemoryBytes(), ShedSpill); err != nil {
+		t.Fatal(err)
+	}
+
+	// Observations of a series as it's spilled, without the lock, aren't
+	// lost: they're either spilled with it, or page it back in.
+	const writers, observations = 4, 2000
+	o := makeObservations(t, []string{`foo_total{a="1"} 1`})[0]
+	done := make(chan struct{})
+	for i := 0; i < writers; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for j := 0; j < observations; j++ {
+				if err := u.Observe(o); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	var spilled int
+	for running, i := writers, 1; running > 0; i++ {
+		select {
+		case <-done:
+			running--
+		default:
+			u.Expire(time.Unix(int64(i), 0), 0)
+			spilled += u.Evict()
+		}
+	}
+	if spilled == 0 {
+		t.Log("no series spilled while observed")
+	}
+	if s, ok := u.Lookup("foo_total", map[string]string{"a": "1"}); !ok || *s.Value != writers*observations {
+		t.Errorf("want %d, have %+v", writers*observations, s)
+	}
+}
+
+func TestSetMemoryLimitSpillWithoutDir(t *testing.T) {
+	u, _ := NewUniverse()
+	if err := u.SetMemoryLimit(1, ShedSpill); err == nil {
+		t.Errorf("want error, have none")
+	}
+}
+
+func writeSnapshot(t *testing.T, u *Universe) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := u.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func totalSeries(counts map[string]int) int {
+	var n int
+	for _, count := range counts {
+		n += count
+	}
+	return n
+}
@@ -0,0 +1,129 @@
+package aggregator
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// DefaultSuggestedBuckets is the default number of buckets suggested for a
+// histogram.
+const DefaultSuggestedBuckets = 10
+
+// SetBucketSamples sets the number of raw values sampled from the
+// observations of each histogram, from which SuggestBuckets suggests its
+// buckets. Zero disables sampling. It must be called before the universe is
+// served.
+func (u *Universe) SetBucketSamples(n int) error {
+	if n < 0 {
+		return fmt.Errorf("bucket samples can't be negative")
+	}
+	u.policies.bucketSamples = n
+	return nil
+}
+
+// BucketSuggestion is the buckets suggested for a histogram by
+// SuggestBuckets, from a sample of the values it's observed.
+type BucketSuggestion struct {
+	Name      string    `json:"name"`
+	Buckets   []float64 `json:"buckets"`   // as declared
+	Suggested []float64 `json:"suggested"` // the values at evenly spaced quantiles
+	Samples   int       `json:"samples"`
+	Observed  uint64    `json:"observed"` // values the samples were taken from
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+}
+
+// SuggestBuckets suggests up to n buckets for the histogram name, so that
+// each has about the same number of its observations. Their upper bounds are
+// the sampled values at evenly spaced quantiles, rounded up to two
+// significant digits, so the last is at least the greatest value sampled.
+// It returns an error if name isn't a histogram, or has no samples.
+func (u *Universe) SuggestBuckets(name string, n int) (BucketSuggestion, error) {
+	if n <= 0 {
+		return BucketSuggestion{}, fmt.Errorf("number of buckets must be positive")
+	}
+	s := u.shard(metricName(name))
+	c, ok := s.collections[metricName(name)]
+	if !ok || c.typ != "histogram" {
+		s.mtx.Unlock()
+		return BucketSuggestion{}, fmt.Errorf("no histogram named %s", name)
+	}
+	if c.samples == nil {
+		s.mtx.Unlock()
+		return BucketSuggestion{}, fmt.Errorf("histogram %s has no sampled values", name)
+	}
+	values := append([]float64(nil), c.samples.values...)
+	suggestion := BucketSuggestion{
+		Name:     name,
+		Buckets:  append([]float64{}, c.buckets...),
+		Samples:  len(values),
+		Observed: c.samples.seen,
+	}
+	s.mtx.Unlock()
+
+	sort.Float64s(values)
+	suggestion.Min, suggestion.Max = values[0], values[len(values)-1]
+	suggestion.Suggested = suggestBuckets(values, n)
+	return suggestion, nil
+}
+
+// suggestBuckets returns up to n upper bounds, at evenly spaced quantiles of
+// the sorted values, rounded up.
+func suggestBuckets(sorted []float64, n int) []float64 {
+	buckets := make([]float64, 0, n)
+	for i := 1; i <= n; i++ {
+		rank := int(math.Ceil(float64(i)*float64(len(sorted))/float64(n))) - 1
+		if rank < 0 {
+			continue
+		}
+		max := roundUp(sorted[rank])
+		if len(buckets) > 0 && max <= buckets[len(buckets)-1] {
+			continue
+		}
+		buckets = append(buckets, max)
+	}
+	return buckets
+}
+
+// roundUp rounds v up to two significant digits, e.g. 0.0123 to 0.013, and
+// 4567 to 4600.
+func roundUp(v float64) float64 {
+	if v == 0 {
+		return 0
+	}
+	scale := math.Pow(10, math.Floor(math.Log10(math.Abs(v)))-1)
+	r := v / scale
+	if math.Abs(r-math.Round(r)) < 1e-9 {
+		r = math.Round(r) // e.g. 0.31 / 0.01
+	}
+	// Formatting removes the error of multiplying by the scale, e.g. so that
+	// 0.7 isn't 0.7000000000000001.
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(math.Ceil(r)*scale, 'g', 3, 64), 64)
+	return rounded
+}
+
+// bucketSamples is a uniform random sample of a fixed number of the values
+// observed by a histogram, by reservoir sampling. It's not goroutine-safe.
+type bucketSamples struct {
+	values []float64
+	seen   uint64
+}
+
+func newBucketSamples(n int) *bucketSamples {
+	return &bucketSamples{values: make([]float64, 0, n)}
+}
+
+// add samples v, such that every value seen is equally likely to be kept.
+func (b *bucketSamples) add(v float64) {
+	b.seen++
+	if len(b.values) < cap(b.values) {
+		b.values = append(b.values, v)
+		return
+	}
+	if i := rand.Int63n(int64(b.seen)); i < int64(len(b.values)) {
+		b.values[i] = v
+	}
+}
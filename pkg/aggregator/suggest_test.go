@@ -0,0 +1,79 @@
+package aggregator
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRoundUp(t *testing.T) {
+	for v, want := range map[float64]float64{
+		0:       0,
+		1:       1,
+		0.31:    0.31,
+		0.0123:  0.013,
+		0.7:     0.7,
+		4567:    4600,
+		99.5:    100,
+		-0.0123: -0.012,
+	} {
+		if have := roundUp(v); want != have {
+			t.Errorf("%v: want %v, have %v", v, want, have)
+		}
+	}
+}
+
+func TestSuggestBuckets(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		sorted []float64
+		n      int
+		want   []float64
+	}{
+		"even":          {[]float64{1, 2, 3, 4, 5, 6, 7, 8}, 4, []float64{2, 4, 6, 8}},
+		"rounded":       {[]float64{0.0101, 0.0202, 0.0303, 0.0404}, 2, []float64{0.021, 0.041}},
+		"fewer values":  {[]float64{1, 2}, 4, []float64{1, 2}},
+		"duplicates":    {[]float64{1, 1, 1, 5}, 4, []float64{1, 5}},
+		"single bucket": {[]float64{0.1, 0.2, 0.25}, 1, []float64{0.25}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if want, have := testcase.want, suggestBuckets(testcase.sorted, testcase.n); !cmp.Equal(want, have) {
+				t.Fatal(cmp.Diff(want, have))
+			}
+		})
+	}
+}
+
+func TestBucketSamples(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_seconds","type":"histogram","help":"Foo duration in seconds.","buckets":[1]}`,
+	})...)
+	if err := u.SetBucketSamples(10); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, fmt.Sprintf(`foo_seconds{code="%d"} %d`, i%2, i))
+	}
+	loadObservations(t, u, makeObservations(t, lines))
+
+	s, err := u.SuggestBuckets("foo_seconds", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 10, s.Samples; want != have {
+		t.Errorf("samples: want %d, have %d", want, have)
+	}
+	if want, have := uint64(1000), s.Observed; want != have {
+		t.Errorf("observed: want %d, have %d", want, have)
+	}
+	if s.Min < 0 || s.Max > 999 || s.Min > s.Max {
+		t.Errorf("min %v and max %v outside of the observed values", s.Min, s.Max)
+	}
+	if len(s.Suggested) == 0 || s.Suggested[len(s.Suggested)-1] < s.Max {
+		t.Errorf("suggested %v: want the last bucket to be at least %v", s.Suggested, s.Max)
+	}
+	if _, err := u.SuggestBuckets("foo_seconds", 0); err == nil {
+		t.Error("0 buckets: want error, have none")
+	}
+}
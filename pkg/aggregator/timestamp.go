@@ -0,0 +1,46 @@
+package aggregator
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxClockSkew is the default of how far ahead of the aggregator's
+// clock an observation's timestamp may be.
+const DefaultMaxClockSkew = time.Minute
+
+// errStale is returned by a gauge for a timestamped observation that's older
+// than the gauge's value. It's not an error to the caller.
+var errStale = fmt.Errorf("stale observation")
+
+// SetMaxClockSkew sets how far ahead of the aggregator's clock an
+// observation's timestamp may be. Observations with later timestamps are
+// rejected, as they'd otherwise keep a gauge from being set until the
+// aggregator caught up. Zero doesn't limit timestamps. It must be called
+// before the universe is served.
+func (u *Universe) SetMaxClockSkew(max time.Duration) error {
+	if max < 0 {
+		return fmt.Errorf("max clock skew can't be negative")
+	}
+	u.policies.maxSkew = max
+	return nil
+}
+
+// StaleObservations returns the number of timestamped gauge observations that
+// have been ignored, because the gauge had been set by a later one.
+func (u *Universe) StaleObservations() uint64 {
+	return atomic.LoadUint64(&u.stale)
+}
+
+// checkTimestamp returns an error if the timestamp of o, if any, is too far
+// ahead of now.
+func (p *observePolicies) checkTimestamp(o Observation, now time.Time) error {
+	if o.Timestamp == 0 || p.maxSkew == 0 {
+		return nil
+	}
+	if ahead := time.Unix(0, o.Timestamp*int64(time.Millisecond)).Sub(now); ahead > p.maxSkew {
+		return rejectf(ReasonBadValue, "timestamp is %s ahead of the aggregator's clock, more than the maximum skew of %s", ahead.Round(time.Millisecond), p.maxSkew)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package aggregator
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGaugeTimestamps(t *testing.T) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for name, testcase := range map[string]struct {
+		lines   []string
+		want    string
+		stale   uint64
+		wantErr bool
+	}{
+		"newer wins": {
+			lines: []string{`foo{} 1 ` + strconv.FormatInt(now-2000, 10), `foo{} 2 ` + strconv.FormatInt(now-1000, 10)},
+			want:  `foo{} 2.000000`,
+		},
+		"delayed is ignored": {
+			lines: []string{`foo{} 2 ` + strconv.FormatInt(now-1000, 10), `foo{} 1 ` + strconv.FormatInt(now-2000, 10)},
+			want:  `foo{} 2.000000`,
+			stale: 1,
+		},
+		"untimestamped always set": {
+			lines: []string{`foo{} 2 ` + strconv.FormatInt(now-1000, 10), `foo{} 3`, `foo{} 1 ` + strconv.FormatInt(now-2000, 10)},
+			want:  `foo{} 3.000000`,
+			stale: 1,
+		},
+		"JSON": {
+			lines: []string{`{"name":"foo","value":2,"timestamp":` + strconv.FormatInt(now-1000, 10) + `}`, `{"name":"foo","value":1,"timestamp":` + strconv.FormatInt(now-2000, 10) + `}`},
+			want:  `foo{} 2.000000`,
+			stale: 1,
+		},
+		"same time": {
+			lines: []string{`foo{} 1 ` + strconv.FormatInt(now, 10), `foo{} 2 ` + strconv.FormatInt(now, 10)},
+			want:  `foo{} 2.000000`,
+		},
+		"too far ahead": {
+			lines:   []string{`foo{} 1 ` + strconv.FormatInt(now+int64(time.Hour/time.Millisecond), 10)},
+			wantErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			u, _ := NewUniverse()
+			loadObservations(t, u, makeObservations(t, []string{
+				`{"name":"foo","type":"gauge","help":"Current foo."}`,
+			}))
+			var err error
+			for _, o := range makeObservations(t, testcase.lines) {
+				if err = u.Observe(o); err != nil {
+					break
+				}
+			}
+			if testcase.wantErr {
+				if err == nil || RejectReason(err) != ReasonBadValue {
+					t.Fatalf("want %s error, have %v", ReasonBadValue, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output := scrape(t, u); !strings.Contains(output, testcase.want) {
+				t.Errorf("want %q, have\n%s", testcase.want, output)
+			}
+			if want, have := testcase.stale, u.StaleObservations(); want != have {
+				t.Errorf("stale: want %d, have %d", want, have)
+			}
+		})
+	}
+}
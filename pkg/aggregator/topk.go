@@ -0,0 +1,154 @@
+package aggregator
+
+import (
+	"fmt"
+)
+
+// topKOther is the label value that values outside the top K are folded into.
+const topKOther = "other"
+
+// topKCandidates is how many candidate values are counted for each of the
+// top K. More candidates make the counts of values near the Kth more
+// accurate, at the cost of memory.
+const topKCandidates = 10
+
+// MaxTopK is the largest top_k a declaration may give, which bounds the
+// candidates counted, and so the memory of every top-K metric.
+const MaxTopK = 1000
+
+// topK keeps only the K values of a label with the most observations, by
+// the space-saving algorithm: a fixed number of candidates are counted, and a
+// value that isn't a candidate replaces the one with the lowest count,
+// inheriting it, so a frequent value can't be starved by infrequent ones.
+// See https://www.cs.ucsb.edu/sites/default/files/documents/2005-23.pdf.
+// It's not goroutine-safe.
+type topK struct {
+	label    string
+	k        int
+	counters []topKCounter // sorted by count, descending, at most k*topKCandidates
+	index    map[string]int
+}
+
+type topKCounter struct {
+	value string
+	count uint64
+}
+
+// newTopK returns the top-K label declared by o, or nil if there isn't one.
+func newTopK(o Observation) (*topK, error) {
+	switch {
+	case o.TopKLabel == "" && o.TopK == 0:
+		return nil, nil
+	case o.TopKLabel == "" || o.TopK <= 0:
+		return nil, fmt.Errorf("top_k must be positive, and given with top_k_label")
+	case o.TopK > MaxTopK:
+		return nil, fmt.Errorf("top_k can't be more than %d", MaxTopK)
+	case o.TopKLabel == "le" || o.TopKLabel == "quantile":
+		return nil, fmt.Errorf("top_k_label can't be %q", o.TopKLabel)
+	}
+	return &topK{
+		label: o.TopKLabel,
+		k:     o.TopK,
+		index: map[string]int{},
+	}, nil
+}
+
+func (t *topK) equal(o Observation) bool {
+	if t == nil {
+		return o.TopKLabel == "" && o.TopK == 0
+	}
+	return t.label == o.TopKLabel && t.k == o.TopK
+}
+
+// declared returns o with the top-K label.
+func (t *topK) declared(o Observation) Observation {
+	o.TopKLabel, o.TopK = "", 0
+	if t != nil {
+		o.TopKLabel, o.TopK = t.label, t.k
+	}
+	return o
+}
+
+// add counts an observation of v, and returns the value that left the top K
+// as a result, if any.
+func (t *topK) add(v string) (left string, ok bool) {
+	i, found := t.index[v]
+	if !found {
+		if len(t.counters) < t.k*topKCandidates {
+			t.counters = append(t.counters, topKCounter{value: v})
+			i = len(t.counters) - 1
+		} else {
+			i = len(t.counters) - 1 // the lowest count, which v inherits
+			delete(t.index, t.counters[i].value)
+			t.counters[i].value = v
+		}
+		t.index[v] = i
+	}
+	t.counters[i].count++
+	for ; i > 0 && t.counters[i].count > t.counters[i-1].count; i-- {
+		t.counters[i], t.counters[i-1] = t.counters[i-1], t.counters[i]
+		t.index[t.counters[i].value], t.index[t.counters[i-1].value] = i, i-1
+		if i == t.k {
+			left, ok = t.counters[i].value, true
+		}
+	}
+	return left, ok
+}
+
+// fold returns o with the label set to topKOther, if its value isn't in the
+// top K. The labels are copied, rather than modified.
+func (t *topK) fold(o Observation) Observation {
+	v, ok := o.Labels[t.label]
+	if !ok {
+		return o
+	}
+	if i, found := t.index[v]; found && i < t.k {
+		return o
+	}
+	labels := make(map[string]string, len(o.Labels))
+	for name, value := range o.Labels {
+		labels[name] = value
+	}
+	labels[t.label] = topKOther
+	o.Labels = labels
+	return o
+}
+
+// route counts o, and returns it with its label folded if necessary, for the
+// collection c, which must be locked. Timeseries whose label value leaves the
+// top K are removed, so the number of values stays bounded.
+func (c *timeseriesCollection) route(o Observation) Observation {
+	if c.topK == nil || o.Value == nil {
+		return o
+	}
+	v, ok := o.Labels[c.topK.label]
+	if !ok {
+		return o
+	}
+	if left, ok := c.topK.add(v); ok {
+		for k, tv := range c.values {
+			if seriesLabels(tv)[c.topK.label] == left {
+				c.bytes -= seriesBytes(k, tv)
+				delete(c.values, k)
+			}
+		}
+	}
+	return c.topK.fold(o)
+}
+
+func seriesLabels(v timeseriesValue) map[string]string {
+	switch v := v.(type) {
+	case *counter:
+		return v.labels
+	case *gauge:
+		return v.labels
+	case *histogram:
+		return v.labels
+	case *gaugeHistogram:
+		return v.labels
+	case *distribution:
+		return v.labels
+	default:
+		return nil
+	}
+}
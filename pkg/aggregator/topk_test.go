@@ -0,0 +1,107 @@
+package aggregator
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTopK(t *testing.T) {
+	u, _ := NewUniverse()
+	lines := []string{
+		`{"name":"http_requests_total","type":"counter","help":"Total number of HTTP requests.","top_k_label":"path","top_k":2}`,
+	}
+	for _, path := range []struct {
+		value string
+		n     int
+	}{{"/a", 10}, {"/b", 5}, {"/c", 3}} {
+		for i := 0; i < path.n; i++ {
+			lines = append(lines, fmt.Sprintf(`http_requests_total{code="200",path=%q} 1`, path.value))
+		}
+	}
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`http_requests_total{code="200",path="/tail/%d"} 1`, i))
+	}
+	loadObservations(t, u, makeObservations(t, lines))
+
+	if _, ok := u.Lookup("http_requests_total", map[string]string{"code": "200", "path": "/a"}); !ok {
+		t.Errorf("/a: want found, have none")
+	}
+	for _, path := range []string{"/c", "/tail/0", "/tail/19"} {
+		if _, ok := u.Lookup("http_requests_total", map[string]string{"code": "200", "path": path}); ok {
+			t.Errorf("%s: want folded, have found", path)
+		}
+	}
+	other, ok := u.Lookup("http_requests_total", map[string]string{"code": "200", "path": "other"})
+	if !ok {
+		t.Fatalf("other: want found, have none")
+	}
+	if want, have := 3+20.0, *other.Value; want != have {
+		t.Errorf("other: want %v, have %v", want, have)
+	}
+
+	// A value that climbs into the top K replaces the one it displaces,
+	// which is removed, and then folded.
+	lines = lines[:0]
+	for i := 0; i < 20; i++ {
+		lines = append(lines, `http_requests_total{code="200",path="/d"} 1`)
+	}
+	lines = append(lines, `http_requests_total{code="200",path="/b"} 1`)
+	loadObservations(t, u, makeObservations(t, lines))
+	if _, ok := u.Lookup("http_requests_total", map[string]string{"code": "200", "path": "/d"}); !ok {
+		t.Errorf("/d: want found, have none")
+	}
+	if _, ok := u.Lookup("http_requests_total", map[string]string{"code": "200", "path": "/b"}); ok {
+		t.Errorf("/b: want removed, have found")
+	}
+	if want, have := 3+1, u.SeriesCounts()["http_requests_total"]; want != have { // and the declaration
+		t.Errorf("series: want %d, have %d", want, have)
+	}
+
+	for name, o := range map[string]Observation{
+		"change k":        {Name: "http_requests_total", Type: "counter", Help: "Total number of HTTP requests.", TopKLabel: "path", TopK: 3},
+		"remove top k":    {Name: "http_requests_total", Type: "counter", Help: "Total number of HTTP requests."},
+		"k without label": {Name: "foo", Type: "counter", Help: "Foo.", TopK: 3},
+		"huge k":          {Name: "foo", Type: "counter", Help: "Foo.", TopKLabel: "x", TopK: 1 << 62},
+		"k over the max":  {Name: "foo", Type: "counter", Help: "Foo.", TopKLabel: "x", TopK: MaxTopK + 1},
+		"le":              {Name: "foo", Type: "histogram", Help: "Foo.", Buckets: []float64{1}, TopKLabel: "le", TopK: 3},
+	} {
+		if err := u.CheckDeclaration(o); err == nil {
+			t.Errorf("%s: want error, have none", name)
+		}
+	}
+}
+
+func TestTopKAdd(t *testing.T) {
+	o := Observation{TopKLabel: "path", TopK: 2}
+	tk, err := newTopK(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testcase := range []struct {
+		value    string
+		wantLeft string
+	}{
+		{"a", ""},
+		{"a", ""},
+		{"b", ""},
+		{"c", ""},
+		{"c", "b"}, // c overtakes b
+		{"b", ""},
+		{"b", "c"}, // and b overtakes c again
+	} {
+		if left, _ := tk.add(testcase.value); testcase.wantLeft != left {
+			t.Errorf("add %s: want %q to leave, have %q", testcase.value, testcase.wantLeft, left)
+		}
+	}
+
+	// Candidates beyond the capacity replace the lowest count, and inherit it.
+	for i := 0; i < 2*topKCandidates*o.TopK; i++ {
+		tk.add(fmt.Sprintf("tail%d", i))
+	}
+	if want, have := topKCandidates*o.TopK, len(tk.counters); want != have {
+		t.Errorf("candidates: want %d, have %d", want, have)
+	}
+	if want, have := "b", tk.counters[0].value; want != have {
+		t.Errorf("top: want %q, have %q", want, have)
+	}
+}
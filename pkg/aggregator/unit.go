@@ -0,0 +1,42 @@
+package aggregator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseUnit checks the declared unit of a metric, which, like the units of
+// the OpenMetrics format, becomes the end of a metric name.
+func parseUnit(unit string) (string, error) {
+	for _, r := range unit {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_') {
+			return "", fmt.Errorf("unit %q may only have lowercase letters, digits, and underscores", unit)
+		}
+	}
+	return unit, nil
+}
+
+// SetRequireUnitSuffix sets whether a metric declared with a unit must have a
+// name that ends with it, like request_duration_seconds, or, for a counter,
+// request_duration_seconds_total. Otherwise, the unit of a metric whose name
+// doesn't end with it is kept, but not exported, as the OpenMetrics format
+// forbids it. It must be called before the universe is served.
+func (u *Universe) SetRequireUnitSuffix(required bool) {
+	u.policies.unitSuffix = required
+}
+
+// checkUnit returns an error if o declares a unit that its name doesn't end
+// with, and the policy requires it to.
+func (p *observePolicies) checkUnit(o Observation) error {
+	if !p.unitSuffix || o.Unit == "" {
+		return nil
+	}
+	if family, _ := openMetricsFamily(o.Name, o.Type); !hasUnitSuffix(family, o.Unit) {
+		return fmt.Errorf("name %s doesn't end with its unit, %s", o.Name, o.Unit)
+	}
+	return nil
+}
+
+func hasUnitSuffix(family, unit string) bool {
+	return strings.HasSuffix(family, "_"+unit)
+}
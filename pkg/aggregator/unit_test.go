@@ -0,0 +1,43 @@
+package aggregator
+
+import "testing"
+
+func TestUnitDeclarations(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		suffix  bool
+		decl    string
+		wantErr bool
+	}{
+		"unit":                   {false, `{"name":"foo_seconds","type":"gauge","help":"Foo.","unit":"seconds"}`, false},
+		"bad unit":               {false, `{"name":"foo_seconds","type":"gauge","help":"Foo.","unit":"Seconds"}`, true},
+		"no suffix":              {false, `{"name":"foo","type":"gauge","help":"Foo.","unit":"seconds"}`, false},
+		"required suffix":        {true, `{"name":"foo_seconds","type":"gauge","help":"Foo.","unit":"seconds"}`, false},
+		"required counter":       {true, `{"name":"foo_seconds_total","type":"counter","help":"Foo.","unit":"seconds"}`, false},
+		"required missing":       {true, `{"name":"foo","type":"gauge","help":"Foo.","unit":"seconds"}`, true},
+		"required counter total": {true, `{"name":"foo_total","type":"counter","help":"Foo.","unit":"total"}`, true},
+		"required without unit":  {true, `{"name":"foo","type":"gauge","help":"Foo."}`, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			u, _ := NewUniverse()
+			u.SetRequireUnitSuffix(testcase.suffix)
+			o := makeObservations(t, []string{testcase.decl})[0]
+			if err := u.CheckDeclaration(o); (err != nil) != testcase.wantErr {
+				t.Errorf("CheckDeclaration: want error %v, have %v", testcase.wantErr, err)
+			}
+			if err := u.Observe(o); (err != nil) != testcase.wantErr {
+				t.Errorf("Observe: want error %v, have %v", testcase.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestUnitRedeclaration(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_seconds","type":"gauge","help":"Foo.","unit":"seconds"}`,
+	})...)
+	if err := u.CheckDeclaration(makeObservations(t, []string{
+		`{"name":"foo_seconds","type":"gauge","help":"Foo.","unit":"milliseconds"}`,
+	})[0]); err == nil {
+		t.Error("want error changing unit, have none")
+	}
+}
@@ -0,0 +1,1409 @@
+package aggregator
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// Universe of all received observations by metric name.
+	// It's partitioned into shards by metric name, each with
+	// a coarse-grained mutex. Counters and gauges are updated
+	// atomically, and can be observed without the mutex once
+	// they exist; all other subtypes (histogram, etc.) are NOT
+	// goroutine-safe.
+	Universe struct {
+		clock            int64  // atomic, unix nanoseconds as of the last Expire, first for alignment
+		duplicates       uint64 // atomic
+		stale            uint64 // atomic
+		nonFiniteDropped uint64 // atomic
+		shards           []*universeShard
+		quantiles        []float64 // of histograms, to export
+		openMetrics      bool      // served to scrapes that accept it
+		policies         observePolicies
+		limits           atomic.Value // Limits
+	}
+
+	// observePolicies are the universe's settings for how every shard
+	// observes observations.
+	observePolicies struct {
+		nonFinite     map[string]NonFinitePolicy // by type
+		recentIDs     int                        // per metric, 0 ignores IDs
+		memory        *memoryPool                // the memory limit, nil until set
+		spill         *spillStore                // where ShedSpill spills series, nil until set
+		conflict      TypeConflictPolicy         // for observations that conflict with their metric
+		replaceAfter  int                        // conflicts before a metric is replaced
+		maxSkew       time.Duration              // how far ahead of now timestamps may be, 0 is unlimited
+		unitSuffix    bool                       // names of metrics declared with a unit must end with it
+		counterSuffix CounterSuffixPolicy        // for counters without _total
+		bucketSamples int                        // values sampled per histogram, 0 disables sampling
+	}
+
+	// universeShard holds the collections for a subset of metric names.
+	universeShard struct {
+		bytes       int64 // atomic, estimated memory of the series, first for alignment
+		mtx         sync.Mutex
+		collections map[metricName]*timeseriesCollection
+		lockFree    sync.Map          // timeseriesKey to counter or gauge, observed without mtx
+		conflicts   map[string]uint64 // type conflicts, by resolution
+	}
+
+	// metricName e.g. `http_requests_total`.
+	metricName string
+
+	// timeseriesCollection corresponds to one high order Prometheus metric.
+	// It has multiple timeseriesValues uniquely identified by their labels.
+	timeseriesCollection struct {
+		typ        string
+		help       string
+		buckets    []float64          // only used by histograms
+		dist       distributionParams // only used by distributions
+		minMax     minMaxParams       // only used by gauges
+		rates      rateParams         // only used by counters
+		topK       *topK              // nil unless declared
+		schema     *labelSchema       // nil unless declared
+		utf8       bool               // whether any series has a name that must be quoted
+		ttl        *time.Duration     // nil is the default TTL
+		seriesTTLs bool               // whether any series has its own TTL
+		nan        NonFinitePolicy    // for NaN values, overriding the type's, if not empty
+		unit       string             // e.g. seconds, if declared
+		ids        *recentIDs         // nil until an observation has an ID
+		samples    *bucketSamples     // nil until a histogram's value is sampled
+		conflicts  int                // since the last declaration without one
+		bytes      int64              // estimated memory of the values
+		values     map[timeseriesKey]timeseriesValue
+	}
+
+	// timeseriesKey is universally unique, e.g.
+	// `http_requests_total{method="GET",status_code="200"}`.
+	timeseriesKey string
+
+	// timeseriesValue is a set of observations for
+	// a unique metric name and set of labels.
+	timeseriesValue interface {
+		metricName() metricName
+		timeseriesKey() timeseriesKey
+		touched() bool
+		observe(Observation) error
+		markSeen(unixNano int64)
+		seenAt() int64
+		setTTL(ttl time.Duration)
+		ownTTL() (time.Duration, bool)
+		renderText() string
+		snapshot() SeriesSnapshot
+	}
+)
+
+// DefaultShards is the default number of universe shards.
+const DefaultShards = 16
+
+// NewUniverse returns a universe with the default number of shards, which
+// has observed each of the initial observations, typically declarations.
+func NewUniverse(initial ...Observation) (*Universe, error) {
+	return NewShardedUniverse(DefaultShards, initial...)
+}
+
+// NewShardedUniverse returns a universe partitioned into n shards. More
+// shards reduce lock contention between concurrent observations of
+// different metrics.
+func NewShardedUniverse(n int, initial ...Observation) (*Universe, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("shard count must be positive")
+	}
+	u := &Universe{shards: make([]*universeShard, n)}
+	u.policies.nonFinite = map[string]NonFinitePolicy{}
+	for typ, p := range defaultNonFinitePolicies {
+		u.policies.nonFinite[typ] = p
+	}
+	u.policies.recentIDs = DefaultRecentIDs
+	u.policies.conflict, u.policies.replaceAfter = ConflictIgnore, DefaultConflictReplaceAfter
+	u.policies.counterSuffix = CounterSuffixIgnore
+	u.policies.maxSkew = DefaultMaxClockSkew
+	for i := range u.shards {
+		u.shards[i] = &universeShard{collections: map[metricName]*timeseriesCollection{}, conflicts: map[string]uint64{}}
+	}
+	for _, o := range initial {
+		if err := u.Observe(o); err != nil {
+			return nil, errors.Wrap(err, "error loading initial set of observations")
+		}
+	}
+	return u, nil
+}
+
+// shard returns the shard for the metric name, locked. The caller must
+// unlock it.
+func (u *Universe) shard(n metricName) *universeShard {
+	s := u.unlockedShard(n)
+	s.mtx.Lock()
+	return s
+}
+
+func (u *Universe) unlockedShard(n metricName) *universeShard {
+	if len(u.shards) == 1 {
+		return u.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.TrimSuffix(string(n), ConflictSuffix))) // so a metric and its conflicts share a shard
+	return u.shards[h.Sum32()%uint32(len(u.shards))]
+}
+
+// Observe applies o to the timeseries it identifies, creating it, and its
+// collection, if necessary. Observing a metric before it's declared is an
+// error, as is declaring it again with a different type or buckets.
+func (u *Universe) Observe(o Observation) error {
+	n, k := o.metricName(), o.timeseriesKey()
+	// What happens to non-finite values depends on the type, which the
+	// lock-free path doesn't know, and IDs are remembered by the collection,
+	// as are type conflicts. Conflicts of other declared parameters are only
+	// looked for if they aren't ignored. Timestamps are compared with the
+	// gauge's under the lock, so that a newer value can't be overwritten, and
+	// series with their own TTL, or declared series, are marked or created by
+	// the collection.
+	// A series that's being removed, or spilled, is retired, and observed
+	// under the lock, once it's gone.
+	if v, ok := u.unlockedShard(n).lockFree.Load(k); ok && (o.Value == nil || isFinite(*o.Value)) && o.ID == "" && o.Timestamp == 0 && o.TTL == "" && len(o.Series) == 0 && u.lockFreeDeclaration(o, v.(timeseriesValue)) {
+		if lv := v.(lockFreeValue); lv.enter() {
+			defer lv.exit()
+			if err := lv.observe(o); err != nil {
+				return err
+			}
+			if now := atomic.LoadInt64(&u.clock); now != 0 {
+				lv.markSeen(now)
+			}
+			return nil
+		}
+	}
+
+	// Existing series were within the limits when they were created.
+	if err := u.Limits().check(o); err != nil {
+		return err
+	}
+	s := u.shard(n)
+	defer s.mtx.Unlock()
+	return u.observed(s.observe(o, atomic.LoadInt64(&u.clock), &u.policies))
+}
+
+// lockFreeDeclaration reports whether o, which would be observed by the
+// lock-free series v, can be, as it declares no type, or the type of v, and
+// other conflicts are ignored.
+func (u *Universe) lockFreeDeclaration(o Observation, v timeseriesValue) bool {
+	if o.Type == "" {
+		return true
+	}
+	if u.policies.conflict != ConflictIgnore {
+		return false
+	}
+	switch v.(type) {
+	case *counter:
+		return o.Type == "counter"
+	case *gauge:
+		return o.Type == "gauge"
+	}
+	return false
+}
+
+// ObserveBatch observes each observation in order, taking each shard's lock
+// once for all of the observations in that shard, rather than once per
+// observation. If any fail, the error is a BatchError.
+func (u *Universe) ObserveBatch(obs []Observation) error {
+	byShard := make(map[*universeShard][]int, len(u.shards))
+	for i, o := range obs {
+		s := u.unlockedShard(o.metricName())
+		byShard[s] = append(byShard[s], i)
+	}
+	var errs BatchError
+	now := atomic.LoadInt64(&u.clock)
+	for s, indexes := range byShard {
+		s.mtx.Lock()
+		for _, i := range indexes {
+			err := u.Limits().check(obs[i])
+			if err == nil {
+				err = u.observed(s.observe(obs[i], now, &u.policies))
+			}
+			if err != nil {
+				if errs == nil {
+					errs = make(BatchError, len(obs))
+				}
+				errs[i] = err
+			}
+		}
+		s.mtx.Unlock()
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// observe observes o, at now, the universe's clock, applying the universe's
+// policies. It returns errDuplicate if o's ID was observed recently. The
+// shard must be locked.
+func (s *universeShard) observe(o Observation, now int64, p *observePolicies) error {
+	n := o.metricName()
+	c, ok := s.collections[n]
+	switch {
+	case !ok:
+		if err := p.checkNaming(o); err != nil {
+			return err
+		}
+		var err error
+		if c, err = newTimeseriesCollection(o); err != nil {
+			err = errors.Wrap(err, "error creating new timeseries collection")
+			if o.Type == "" {
+				err = RejectError{ReasonUnknownMetric, err}
+			}
+			return err
+		}
+		s.collections[n] = c
+	case o.Type != "":
+		var err error
+		if c, o, err = s.resolveConflict(c, o, p); err != nil {
+			return err
+		}
+	}
+	defer func(before int64) { atomic.AddInt64(&s.bytes, c.bytes-before) }(c.bytes)
+	remember := o.ID != "" && o.Value != nil && p.recentIDs > 0
+	if remember && c.ids != nil && c.ids.contains(o.ID) {
+		return errDuplicate
+	}
+	if err := p.checkTimestamp(o, time.Now()); err != nil {
+		return err
+	}
+	var ttl *time.Duration // of the series
+	if o.Value != nil && o.TTL != "" {
+		var err error
+		if ttl, err = parseTTL(o.TTL); err != nil {
+			return err
+		}
+	}
+	if o.Value != nil && !isFinite(*o.Value) {
+		v, err := c.applyNonFinite(p.nonFinite, *o.Value)
+		if err != nil {
+			return err
+		}
+		o.Value = &v
+	}
+	var err error
+	if o, err = c.schema.apply(o); err != nil {
+		return err
+	}
+	o = c.route(o)
+	k := o.timeseriesKey()
+	if _, ok := c.values[k]; !ok {
+		if err := s.pageIn(c, o.metricName(), k, p.spill); err != nil {
+			return err
+		}
+	}
+	if _, ok := c.values[k]; !ok && o.Value != nil {
+		if err := p.checkMemory(); err != nil {
+			return err
+		}
+	}
+	if err := c.observe(o); err != nil {
+		return err
+	}
+	if remember {
+		if c.ids == nil {
+			c.ids = newRecentIDs(p.recentIDs)
+		}
+		c.ids.add(o.ID)
+	}
+	if c.typ == "histogram" && p.bucketSamples > 0 && o.Value != nil && isFinite(*o.Value) {
+		if c.samples == nil {
+			c.samples = newBucketSamples(p.bucketSamples)
+		}
+		c.samples.add(*o.Value)
+	}
+	if now != 0 {
+		c.values[k].markSeen(now)
+	}
+	if ttl != nil {
+		c.values[k].setTTL(*ttl)
+		c.seriesTTLs = true
+	}
+	s.storeLockFree(c, k)
+	if o.Type != "" {
+		return s.register(c, o, p.spill)
+	}
+	return nil
+}
+
+// storeLockFree makes the series k of the collection c observable without
+// the shard's lock, if it can be. The shard must be locked.
+func (s *universeShard) storeLockFree(c *timeseriesCollection, k timeseriesKey) {
+	if c.topK != nil {
+		return // every observation must be counted
+	}
+	switch v := c.values[k].(type) {
+	case *counter:
+		s.lockFree.Store(k, v)
+	case *gauge:
+		if v.minMax == nil {
+			s.lockFree.Store(k, v)
+		}
+	}
+}
+
+// lockFreeValue is a series that storeLockFree can make observable without
+// the shard's lock.
+type lockFreeValue interface {
+	timeseriesValue
+	enter() bool
+	exit()
+	retire()
+}
+
+// retireLockFree retires v, if it can be observed without the shard's lock,
+// waiting for writers that are observing it to finish, so that it can be
+// read, and removed, without losing their observations. The shard must be
+// locked.
+func retireLockFree(v timeseriesValue) {
+	if lv, ok := v.(lockFreeValue); ok {
+		lv.retire()
+	}
+}
+
+// lockFreeGate counts the writers observing a series without the shard's
+// lock, until it's retired, after which none can start.
+type lockFreeGate struct {
+	state int32 // atomic, writers in progress, plus gateRetired once retired
+}
+
+const gateRetired = 1 << 30
+
+// enter returns false if the series is retired, and otherwise counts a
+// writer, until exit.
+func (g *lockFreeGate) enter() bool {
+	if atomic.AddInt32(&g.state, 1) >= gateRetired {
+		atomic.AddInt32(&g.state, -1)
+		return false
+	}
+	return true
+}
+
+func (g *lockFreeGate) exit() { atomic.AddInt32(&g.state, -1) }
+
+// retire stops writers from entering, and waits for those that have to exit.
+// Writers only add to, or store, a value, so it's never long.
+func (g *lockFreeGate) retire() {
+	for {
+		state := atomic.LoadInt32(&g.state)
+		if state >= gateRetired || atomic.CompareAndSwapInt32(&g.state, state, state+gateRetired) {
+			break
+		}
+	}
+	for atomic.LoadInt32(&g.state) != gateRetired {
+		runtime.Gosched()
+	}
+}
+
+// CheckDeclaration returns an error if o isn't a valid declaration, or if it
+// conflicts with an existing collection.
+func (u *Universe) CheckDeclaration(o Observation) error {
+	if err := u.Limits().check(o); err != nil {
+		return err
+	}
+	s := u.shard(o.metricName())
+	defer s.mtx.Unlock()
+	if c, ok := s.collections[o.metricName()]; ok {
+		return c.checkRedeclaration(o)
+	}
+	if err := u.policies.checkNaming(o); err != nil {
+		return err
+	}
+	_, err := newTimeseriesCollection(o)
+	return err
+}
+
+// Declare adds a new collection for o, and reports whether it was added. If
+// the collection already exists, only its help string and TTL are updated, so
+// none of its timeseries are lost.
+func (u *Universe) Declare(o Observation) (bool, error) {
+	if err := u.Limits().check(o); err != nil {
+		return false, err
+	}
+	n := o.metricName()
+	s := u.shard(n)
+	defer s.mtx.Unlock()
+	if c, ok := s.collections[n]; ok {
+		if err := c.checkRedeclaration(o); err != nil {
+			return false, err
+		}
+		if o.Help != "" {
+			c.help = o.Help
+		}
+		if o.TTL != "" {
+			c.ttl, _ = parseTTL(o.TTL) // checked by checkRedeclaration
+		}
+		defer func(before int64) { atomic.AddInt64(&s.bytes, c.bytes-before) }(c.bytes)
+		return false, s.register(c, o, u.policies.spill)
+	}
+	if err := u.policies.checkNaming(o); err != nil {
+		return false, err
+	}
+	c, err := newTimeseriesCollection(o)
+	if err != nil {
+		return false, errors.Wrap(err, "error creating new timeseries collection")
+	}
+	if err := c.observe(o); err != nil {
+		return false, err
+	}
+	if err := s.register(c, o, u.policies.spill); err != nil {
+		return false, err
+	}
+	s.collections[n] = c
+	atomic.AddInt64(&s.bytes, c.bytes)
+	return true, nil
+}
+
+// DryRun reports what observing o would do, without observing it: the type of
+// the metric, whether the metric and series would be created, and the error
+// Observe would return, if any.
+func (u *Universe) DryRun(o Observation) (typ string, newMetric, newSeries bool, err error) {
+	n := o.metricName()
+	s := u.shard(n)
+	defer s.mtx.Unlock()
+	c, ok := s.collections[n]
+	if !ok {
+		newMetric = true
+		if err := u.policies.checkNaming(o); err != nil {
+			return o.Type, newMetric, false, err
+		}
+		if c, err = newTimeseriesCollection(o); err != nil {
+			return o.Type, newMetric, false, errors.Wrap(err, "error creating new timeseries collection")
+		}
+	}
+	if err := u.Limits().check(o); err != nil {
+		return c.typ, newMetric, false, err
+	}
+	o = c.declared(o)
+	if o, err = c.schema.apply(o); err != nil {
+		return c.typ, newMetric, false, err
+	}
+	if c.topK != nil && o.Value != nil {
+		o = c.topK.fold(o)
+	}
+	if _, ok := c.values[o.timeseriesKey()]; !ok && !u.policies.spill.has(n, o.timeseriesKey()) {
+		newSeries = true
+		if _, err := newTimeseriesValue(c.typ, o); err != nil {
+			return c.typ, newMetric, newSeries, errors.Wrap(err, "error creating new timeseries")
+		}
+	}
+	return c.typ, newMetric, newSeries, nil
+}
+
+// Lookup returns a snapshot of the timeseries uniquely identified by name and
+// labels, if it exists.
+func (u *Universe) Lookup(name string, labels map[string]string) (SeriesSnapshot, bool) {
+	sh := u.shard(metricName(name))
+	defer sh.mtx.Unlock()
+	c, ok := sh.collections[metricName(name)]
+	if !ok {
+		return SeriesSnapshot{}, false
+	}
+	k := makeTimeseriesKey(name, labels)
+	v, ok := c.values[k]
+	if !ok {
+		if v, ok = c.spilled(metricName(name), k, u.policies.spill); !ok {
+			return SeriesSnapshot{}, false
+		}
+	}
+	s := v.snapshot()
+	s.Type, s.Help = c.typ, c.help
+	if h, ok := v.(*histogram); ok {
+		s.Quantiles = h.quantiles(u.quantiles)
+	}
+	if s.Labels == nil {
+		s.Labels = map[string]string{}
+	}
+	return s, true
+}
+
+// Declarations returns the declaration of every metric, sorted by name, as it
+// would be given to declare the metric again, with its type, help, buckets,
+// TTL, and every other parameter.
+func (u *Universe) Declarations() []Observation {
+	decls := []Observation{}
+	for _, n := range u.metricNames() {
+		s := u.shard(n)
+		if c, ok := s.collections[n]; ok { // unless removed since the names were listed
+			decls = append(decls, c.declaration(n))
+		}
+		s.mtx.Unlock()
+	}
+	return decls
+}
+
+// Delete removes the timeseries uniquely identified by name and labels, and
+// reports whether it existed. The collection, and therefore its declaration,
+// is retained even if it becomes empty.
+func (u *Universe) Delete(name string, labels map[string]string) bool {
+	s := u.shard(metricName(name))
+	defer s.mtx.Unlock()
+	c, ok := s.collections[metricName(name)]
+	if !ok {
+		return false
+	}
+	k := makeTimeseriesKey(name, labels)
+	if _, ok := c.values[k]; !ok {
+		return u.policies.spill.drop(metricName(name), k)
+	}
+	s.remove(c, k)
+	return true
+}
+
+// SeriesCounts returns the number of timeseries in each collection, by
+// metric name.
+func (u *Universe) SeriesCounts() map[string]int {
+	counts := map[string]int{}
+	for _, s := range u.shards {
+		s.mtx.Lock()
+		for n, c := range s.collections {
+			counts[string(n)] = len(c.values) + u.policies.spill.count(n)
+		}
+		s.mtx.Unlock()
+	}
+	return counts
+}
+
+// LabelValueCounts returns the number of distinct values of each label name,
+// across the timeseries of every collection.
+func (u *Universe) LabelValueCounts() map[string]int {
+	values := map[string]map[string]struct{}{}
+	for _, s := range u.shards {
+		s.mtx.Lock()
+		for _, c := range s.collections {
+			for _, v := range c.values {
+				for name, value := range seriesLabels(v) {
+					if values[name] == nil {
+						values[name] = map[string]struct{}{}
+					}
+					values[name][value] = struct{}{}
+				}
+			}
+		}
+		s.mtx.Unlock()
+	}
+	counts := make(map[string]int, len(values))
+	for name, vs := range values {
+		counts[name] = len(vs)
+	}
+	return counts
+}
+
+func newTimeseriesCollection(o Observation) (*timeseriesCollection, error) {
+	c := &timeseriesCollection{
+		typ:    o.Type,
+		help:   o.Help,
+		values: map[timeseriesKey]timeseriesValue{},
+		utf8:   !isLegacyName(o.Name, false),
+	}
+	if o.TTL != "" {
+		ttl, err := parseTTL(o.TTL)
+		if err != nil {
+			return nil, err
+		}
+		c.ttl = ttl
+	}
+	topK, err := newTopK(o)
+	if err != nil {
+		return nil, err
+	}
+	c.topK = topK
+	if c.schema, err = newLabelSchema(o); err != nil {
+		return nil, err
+	}
+	if err := checkSeries(o, c.schema); err != nil {
+		return nil, err
+	}
+	if c.nan, err = parseNaNPolicy(o); err != nil {
+		return nil, err
+	}
+	if c.unit, err = parseUnit(o.Unit); err != nil {
+		return nil, err
+	}
+	if len(o.Rates) > 0 && o.Type != "counter" {
+		return nil, fmt.Errorf("only counters can have rates")
+	}
+	switch o.Type {
+	case "counter":
+		if c.rates, err = parseRateParams(o); err != nil {
+			return nil, err
+		}
+	case "gauge":
+		if c.minMax, err = parseMinMaxParams(o); err != nil {
+			return nil, err
+		}
+	case "histogram", "gaugehistogram":
+		if c.buckets, err = parseBuckets(o.Buckets); err != nil {
+			return nil, err
+		}
+	case "distribution":
+		if c.dist, err = parseDistributionParams(o); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid type '%s'", o.Type)
+	}
+	if o.Help == "" {
+		return nil, fmt.Errorf("help string cannot be empty")
+	}
+	return c, nil
+}
+
+// declared returns o with the type, help, and parameters of the collection.
+func (c *timeseriesCollection) declared(o Observation) Observation {
+	o.Type, o.Help, o.Buckets, o.NaN, o.Unit = c.typ, c.help, c.buckets, string(c.nan), c.unit
+	o = c.topK.declared(o)
+	o = c.schema.declared(o)
+	switch c.typ {
+	case "counter":
+		o = c.rates.declared(o)
+	case "gauge":
+		o = c.minMax.declared(o)
+	case "distribution":
+		o = c.dist.declared(o)
+	}
+	return o
+}
+
+// declaration returns the declaration of the collection, named n.
+func (c *timeseriesCollection) declaration(n metricName) Observation {
+	o := c.declared(Observation{Name: string(n)})
+	if c.ttl != nil {
+		o.TTL = c.ttl.String()
+	}
+	return o
+}
+
+// checkRedeclaration returns an error if o would change the type or buckets
+// of the collection, which can't be done without resetting its timeseries.
+func (c *timeseriesCollection) checkRedeclaration(o Observation) error {
+	if o.Type != c.typ {
+		return fmt.Errorf("can't change type from '%s' to '%s'", c.typ, o.Type)
+	}
+	if c.typ == "histogram" || c.typ == "gaugehistogram" {
+		buckets, err := parseBuckets(o.Buckets)
+		if err != nil {
+			return err
+		}
+		if !equalBuckets(buckets, c.buckets) {
+			return fmt.Errorf("can't change %s buckets", c.typ)
+		}
+	}
+	if c.typ == "counter" {
+		rates, err := parseRateParams(o)
+		if err != nil {
+			return err
+		}
+		if !rates.equal(c.rates) {
+			return fmt.Errorf("can't change counter rates")
+		}
+	}
+	if c.typ == "gauge" {
+		minMax, err := parseMinMaxParams(o)
+		if err != nil {
+			return err
+		}
+		if minMax != c.minMax {
+			return fmt.Errorf("can't change gauge min_max or window")
+		}
+	}
+	if c.typ == "distribution" {
+		dist, err := parseDistributionParams(o)
+		if err != nil {
+			return err
+		}
+		if !dist.equal(c.dist) {
+			return fmt.Errorf("can't change distribution quantiles, relative accuracy, or window")
+		}
+	}
+	if !c.topK.equal(o) {
+		return fmt.Errorf("can't change top_k or top_k_label")
+	}
+	if !c.schema.equal(o) {
+		return fmt.Errorf("can't change label_names or label_policy")
+	}
+	if err := checkSeries(o, c.schema); err != nil {
+		return err
+	}
+	if NonFinitePolicy(o.NaN) != c.nan {
+		return fmt.Errorf("can't change nan")
+	}
+	if o.Unit != c.unit {
+		return fmt.Errorf("can't change unit from '%s' to '%s'", c.unit, o.Unit)
+	}
+	if o.TTL != "" {
+		if _, err := parseTTL(o.TTL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func equalBuckets(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// touched should return true if any timeseries in the collection
+// has been touched. It's used to determine if we should render
+// the header stanza in the /metrics output.
+func (c *timeseriesCollection) touched() bool {
+	for _, v := range c.values {
+		if v.touched() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *timeseriesCollection) observe(o Observation) error {
+	o = c.declared(o) // first writer wins
+	k := o.timeseriesKey()
+	if _, ok := c.values[k]; !ok {
+		v, err := newTimeseriesValue(c.typ, o)
+		if err != nil {
+			return errors.Wrap(err, "error creating new timeseries")
+		}
+		c.values[k] = v
+		c.bytes += seriesBytes(k, v)
+		c.utf8 = c.utf8 || hasUTF8Names(o)
+	}
+	return c.values[k].observe(o)
+}
+
+func newTimeseriesValue(typ string, o Observation) (timeseriesValue, error) {
+	if o.Name == "" {
+		return nil, fmt.Errorf("a new timeseries value requires a name")
+	}
+	switch typ {
+	case "counter":
+		return newCounter(o)
+	case "gauge":
+		return newGauge(o)
+	case "histogram":
+		return newHistogram(o)
+	case "gaugehistogram":
+		return newGaugeHistogram(o)
+	case "distribution":
+		return newDistribution(o)
+	default:
+		return nil, fmt.Errorf("invalid timeseries type '%s' (programmer error)", typ)
+	}
+}
+
+//
+//
+//
+
+// ServeHTTP streams the exposition format to the client one collection at a
+// time. The universe lock is only held while a single collection is rendered,
+// so neither memory use nor lock hold time scales with the whole universe.
+// Names that aren't valid in the classic format are quoted if the client
+// allows UTF-8 names, and escaped otherwise. If OpenMetrics is enabled, and
+// the client accepts it, it's served instead.
+func (u *Universe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if u.ServeExposition(w, r) {
+		io.WriteString(w, openMetricsEOF)
+	}
+}
+
+// ServeExposition is ServeHTTP without the line that ends the OpenMetrics
+// format, so that more metrics can follow. It returns true if the format is
+// OpenMetrics.
+func (u *Universe) ServeExposition(w http.ResponseWriter, r *http.Request) (openMetrics bool) {
+	openMetrics = u.ServesOpenMetrics(r)
+	utf8 := !openMetrics && AllowsUTF8(r)
+	switch {
+	case openMetrics:
+		w.Header().Set("Content-Type", OpenMetricsContentType)
+	case utf8:
+		w.Header().Set("Content-Type", "text/plain; version=1.0.0; charset=utf-8; escaping=allow-utf-8")
+	default:
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	}
+	bw := bufio.NewWriter(w)
+	var buf bytes.Buffer
+	for _, n := range u.metricNames() {
+		if r.Context().Err() != nil {
+			return openMetrics // abandoned, e.g. timed out
+		}
+		buf.Reset()
+		u.renderCollection(&buf, n, utf8, openMetrics)
+		b := buf.Bytes()
+		if openMetrics {
+			b = dropBlankLines(b)
+		}
+		if _, err := bw.Write(b); err != nil {
+			return openMetrics // client went away
+		}
+	}
+	bw.Flush()
+	return openMetrics
+}
+
+// metricNames returns a sorted snapshot of the metric names in the universe.
+func (u *Universe) metricNames() []metricName {
+	var names []metricName
+	for _, s := range u.shards {
+		s.mtx.Lock()
+		for n := range s.collections {
+			names = append(names, n)
+		}
+		s.mtx.Unlock()
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// renderCollection writes the exposition format of the named collection to w,
+// if it exists and has been touched. Names that must be quoted are escaped
+// instead, unless utf8 is true. If openMetrics is true, the metadata is that
+// of the OpenMetrics format, but blank lines are left to the caller.
+func (u *Universe) renderCollection(w io.Writer, n metricName, utf8, openMetrics bool) {
+	s := u.shard(n)
+	defer s.mtx.Unlock()
+	c, ok := s.collections[n]
+	if !ok || (!c.touched() && u.policies.spill.count(n) == 0) {
+		return
+	}
+	keys, values := c.withSpilled(n, u.policies.spill)
+	if c.utf8 && !utf8 {
+		var (
+			out = w
+			buf bytes.Buffer
+		)
+		defer func() { out.Write(escapeExposition(buf.Bytes())) }()
+		w = &buf
+	}
+	exported := u.policies.exportedName(string(n), c.typ)
+	family, typ := exported, c.typ
+	switch {
+	case typ == "distribution":
+		typ = "summary"
+	case typ == "gaugehistogram" && !openMetrics:
+		typ = "histogram"
+	}
+	if openMetrics {
+		family, typ = openMetricsFamily(family, typ)
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", renderName(family), c.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", renderName(family), typ)
+	if openMetrics && c.unit != "" && hasUnitSuffix(family, c.unit) {
+		fmt.Fprintf(w, "# UNIT %s %s\n", renderName(family), c.unit)
+	}
+	for _, k := range keys {
+		v := values[k]
+		if !v.touched() {
+			continue
+		}
+		if exported != string(n) {
+			io.WriteString(w, renameSample(v.renderText(), string(n), exported))
+			continue
+		}
+		if g, ok := v.(*gaugeHistogram); ok && openMetrics {
+			io.WriteString(w, g.renderOpenMetrics())
+			continue
+		}
+		io.WriteString(w, v.renderText())
+	}
+	fmt.Fprintln(w)
+	if c.typ == "histogram" && len(u.quantiles) > 0 {
+		w.Write(c.appendQuantiles(nil, n, u.quantiles))
+	}
+	if c.typ == "gauge" && c.minMax.enabled {
+		w.Write(c.appendMinMax(nil, n))
+	}
+	if c.typ == "counter" && len(c.rates.windows) > 0 {
+		w.Write(c.appendRates(nil, n))
+	}
+}
+
+func sortTimeseriesKeys(values map[timeseriesKey]timeseriesValue) (keys []timeseriesKey) {
+	keys = make([]timeseriesKey, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+//
+//
+//
+
+// Observation is a single parsed line. A declaration has a type and help
+// string, and no value; an observation of an existing metric has a value, and
+// needn't repeat the type or help.
+type Observation struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Help    string            `json:"help"`
+	Buckets []float64         `json:"buckets,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Op      string            `json:"op,omitempty"`
+	Value   *float64          `json:"value,omitempty"`
+
+	// Prefix and Values are the values of several related metrics, in one
+	// observation, named with the prefix, like proc_ and cpu_seconds_total.
+	// Such an observation can't be observed as it is: Split it into an
+	// observation of each value.
+	Prefix string             `json:"prefix,omitempty"`
+	Values map[string]float64 `json:"values,omitempty"`
+
+	// Quantiles, RelativeAccuracy, Window, and WindowBuckets are the
+	// parameters of a distribution. Window is a duration, like "5m".
+	Quantiles        []float64 `json:"quantiles,omitempty"`
+	RelativeAccuracy float64   `json:"relative_accuracy,omitempty" yaml:"relative_accuracy"`
+	Window           string    `json:"window,omitempty"`
+	WindowBuckets    int       `json:"window_buckets,omitempty" yaml:"window_buckets"`
+
+	// MinMax adds the lowest and highest values of each series of a gauge,
+	// since the last scrape, or over the Window, if it's given.
+	MinMax bool `json:"min_max,omitempty" yaml:"min_max"`
+
+	// Rates adds the per-second rate of each series of a counter over each
+	// window, e.g. 5m, exported as foo_total:rate5m, for consumers that
+	// can't compute it with PromQL.
+	Rates []string `json:"rates,omitempty"`
+
+	// TopKLabel and TopK keep only the TopK values of the label with the
+	// most observations, folding the others into the value "other".
+	TopKLabel string `json:"top_k_label,omitempty" yaml:"top_k_label"`
+	TopK      int    `json:"top_k,omitempty" yaml:"top_k"`
+
+	// LabelNames are the labels that every series of the metric must have,
+	// and no others. LabelPolicy is what happens to an observation without
+	// exactly those labels: LabelPolicyReject, the default, or
+	// LabelPolicyNormalize.
+	LabelNames  []string `json:"label_names,omitempty" yaml:"label_names"`
+	LabelPolicy string   `json:"label_policy,omitempty" yaml:"label_policy"`
+
+	// Series are the labels of series of a counter or gauge that are
+	// created with its declaration, at zero, so that they're exported
+	// before they're first observed, as rate() and alerts on rarely
+	// incremented counters need. They're kept forever, unless they're
+	// observed with a TTL of their own.
+	Series []map[string]string `json:"series,omitempty" yaml:"series"`
+
+	// TTL is how long series of the metric are kept without being
+	// observed, like "10m", overriding the default given to Expire. "0"
+	// keeps them forever. With a value, it's the TTL of the observed
+	// series alone, overriding the metric's, until it's observed with
+	// another.
+	TTL string `json:"ttl,omitempty"`
+
+	// ID optionally identifies an observation, so that it's only observed
+	// once, even if a client sends it again, e.g. when retrying.
+	ID string `json:"id,omitempty"`
+
+	// NaN is what happens to NaN values of the metric, overriding the
+	// universe's policy for its type: "drop", "accept", for gauges, or
+	// "reject".
+	NaN string `json:"nan,omitempty"`
+
+	// Timestamp is optionally when a gauge was set, in milliseconds since
+	// the epoch, so that a delayed observation doesn't overwrite the value
+	// of a later one. Gauge histograms require it, to identify the snapshot
+	// that an observation is part of. Other types, and gauges that are
+	// added to, ignore it.
+	Timestamp int64 `json:"timestamp,omitempty"`
+
+	// Unit is the unit of the metric's values, like "seconds", exported
+	// in the OpenMetrics format if the name ends with it.
+	Unit string `json:"unit,omitempty"`
+}
+
+func (o Observation) metricName() metricName {
+	return metricName(o.Name)
+}
+
+func (o Observation) timeseriesKey() timeseriesKey {
+	return makeTimeseriesKey(o.Name, o.Labels)
+}
+
+//
+//
+//
+
+// SeriesSnapshot is a point-in-time view of a single timeseries,
+// suitable for JSON encoding.
+type SeriesSnapshot struct {
+	Name    string             `json:"name"`
+	Type    string             `json:"type"`
+	Help    string             `json:"help"`
+	Labels  map[string]string  `json:"labels"`
+	Value   *float64           `json:"value,omitempty"`   // counters and gauges
+	Sum     *float64           `json:"sum,omitempty"`     // histograms and distributions
+	Count   *uint64            `json:"count,omitempty"`   // histograms and distributions
+	Buckets []BucketSnapshot   `json:"buckets,omitempty"` // histograms
+	Min     *float64           `json:"min,omitempty"`     // gauges with min_max
+	Max     *float64           `json:"max,omitempty"`     // gauges with min_max
+	Rates   map[string]float64 `json:"rates,omitempty"`   // counters with rates, by window
+
+	// Quantiles are estimated from the buckets of histograms, by quantile,
+	// if they're exported, or from the sketches of distributions.
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+}
+
+// BucketSnapshot is a single histogram bucket of a SeriesSnapshot.
+type BucketSnapshot struct {
+	LE    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+//
+//
+//
+
+// counter is goroutine-safe.
+type counter struct {
+	value atomicFloat // first for alignment
+	lastSeen
+	lockFreeGate
+	touch  uint32 // atomic
+	n      string
+	h      string
+	labels map[string]string
+	prefix string    // rendered name and labels
+	rates  *rateRing // nil unless declared
+}
+
+func newCounter(o Observation) (*counter, error) {
+	p, err := parseRateParams(o)
+	if err != nil {
+		return nil, err
+	}
+	c := &counter{
+		n:      o.Name,
+		h:      o.Help,
+		labels: o.Labels,
+		prefix: renderSeries(o.Name, o.Labels),
+	}
+	if len(p.windows) > 0 {
+		c.rates = newRateRing(p, o.Name, o.Labels)
+	}
+	return c, nil
+}
+
+func (c *counter) metricName() metricName {
+	return metricName(c.n)
+}
+
+func (c *counter) timeseriesKey() timeseriesKey {
+	return makeTimeseriesKey(c.n, c.labels)
+}
+
+func (c *counter) observe(o Observation) error {
+	if o.Value == nil {
+		return nil // declaration
+	}
+	c.value.add(*o.Value)
+	atomic.StoreUint32(&c.touch, 1)
+	return nil
+}
+
+func (c *counter) touched() bool { return atomic.LoadUint32(&c.touch) == 1 }
+
+func (c *counter) renderText() string {
+	return renderSample(c.prefix, c.value.load())
+}
+
+func (c *counter) snapshot() SeriesSnapshot {
+	value := c.value.load()
+	s := SeriesSnapshot{Name: c.n, Labels: c.labels, Value: &value}
+	if c.rates != nil {
+		s.Rates = c.rates.rates()
+	}
+	return s
+}
+
+//
+//
+//
+
+// gauge is goroutine-safe.
+type gauge struct {
+	value atomicFloat // first for alignment
+	lastSeen
+	lockFreeGate
+	touch  uint32 // atomic
+	n      string
+	h      string
+	labels map[string]string
+	prefix string  // rendered name and labels
+	minMax *minMax // nil unless declared
+	stamp  int64   // of the latest timestamped value, guarded by the shard's lock
+}
+
+func newGauge(o Observation) (*gauge, error) {
+	p, err := parseMinMaxParams(o)
+	if err != nil {
+		return nil, err
+	}
+	g := &gauge{
+		n:      o.Name,
+		h:      o.Help,
+		labels: o.Labels,
+		prefix: renderSeries(o.Name, o.Labels),
+	}
+	if p.enabled {
+		g.minMax = newMinMax(p, o.Name, o.Labels, time.Now)
+	}
+	return g, nil
+}
+
+func (g *gauge) metricName() metricName {
+	return metricName(g.n)
+}
+
+func (g *gauge) timeseriesKey() timeseriesKey {
+	return makeTimeseriesKey(g.n, g.labels)
+}
+
+func (g *gauge) observe(o Observation) error {
+	if o.Value == nil {
+		return nil // declaration
+	}
+	switch o.Op {
+	case "add":
+		g.value.add(*o.Value)
+	default:
+		if o.Timestamp != 0 {
+			if o.Timestamp < g.stamp {
+				return errStale
+			}
+			g.stamp = o.Timestamp
+		}
+		g.value.store(*o.Value)
+	}
+	if g.minMax != nil {
+		g.minMax.add(g.value.load())
+	}
+	atomic.StoreUint32(&g.touch, 1)
+	return nil
+}
+
+func (g *gauge) touched() bool { return atomic.LoadUint32(&g.touch) == 1 }
+
+func (g *gauge) renderText() string {
+	return renderSample(g.prefix, g.value.load())
+}
+
+func (g *gauge) snapshot() SeriesSnapshot {
+	value := g.value.load()
+	s := SeriesSnapshot{Name: g.n, Labels: g.labels, Value: &value}
+	if g.minMax != nil && g.touched() {
+		e := g.minMax.current()
+		s.Min, s.Max = &e.min, &e.max
+	}
+	return s
+}
+
+//
+//
+//
+
+type histogram struct {
+	lastSeen
+	n       string
+	h       string
+	labels  map[string]string
+	sum     float64
+	count   uint64
+	buckets []bucket
+	prefix  histogramPrefixes
+}
+
+type bucket struct {
+	max   float64
+	count uint64
+}
+
+// histogramPrefixes are the rendered names and labels of a histogram's
+// samples.
+type histogramPrefixes struct {
+	buckets   []string // including the terminal +Inf bucket
+	sum       string
+	count     string
+	quantiles []string // rendered when first exported
+}
+
+func newHistogram(o Observation) (*histogram, error) {
+	buckets := make([]bucket, len(o.Buckets))
+	for i, v := range o.Buckets {
+		buckets[i] = bucket{max: v}
+	}
+	return &histogram{
+		n:       o.Name,
+		h:       o.Help,
+		labels:  o.Labels,
+		buckets: buckets,
+		prefix:  renderHistogramPrefixes(o.Name, o.Labels, o.Buckets),
+	}, nil
+}
+
+func renderHistogramPrefixes(name string, labels map[string]string, buckets []float64) histogramPrefixes {
+	p := histogramPrefixes{
+		buckets: make([]string, 0, len(buckets)+1),
+		sum:     renderSeries(name+"_sum", labels),
+		count:   renderSeries(name+"_count", labels),
+	}
+	labelscopy := map[string]string{}
+	for k, v := range labels {
+		labelscopy[k] = v
+	}
+	for _, max := range buckets {
+		labelscopy["le"] = formatLE(max)
+		p.buckets = append(p.buckets, renderSeries(name+"_bucket", labelscopy))
+	}
+	labelscopy["le"] = "+Inf"
+	p.buckets = append(p.buckets, renderSeries(name+"_bucket", labelscopy))
+	return p
+}
+
+func (h *histogram) metricName() metricName {
+	return metricName(h.n)
+}
+
+func (h *histogram) timeseriesKey() timeseriesKey {
+	return makeTimeseriesKey(h.n, h.labels)
+}
+
+func (h *histogram) observe(o Observation) error {
+	if o.Value == nil {
+		return nil // declaration
+	}
+	h.sum += *o.Value
+	h.count++
+	for i := range h.buckets {
+		if *o.Value <= h.buckets[i].max {
+			h.buckets[i].count++
+		}
+	}
+	return nil
+}
+
+func (h *histogram) touched() bool { return h.count > 0 }
+
+func (h *histogram) renderText() string {
+	var b []byte
+	{
+		// Render all of the individual buckets,
+		// including a terminal +Inf bucket.
+		for i, bucket := range h.buckets {
+			b = appendCountSample(b, h.prefix.buckets[i], bucket.count)
+		}
+		b = appendCountSample(b, h.prefix.buckets[len(h.buckets)], h.count)
+	}
+	{
+		// Render the aggregate statistics.
+		b = appendSample(b, h.prefix.sum, h.sum)
+		b = appendCountSample(b, h.prefix.count, h.count)
+	}
+	return string(b)
+}
+
+func (h *histogram) snapshot() SeriesSnapshot {
+	sum, count := h.sum, h.count
+	buckets := make([]BucketSnapshot, 0, len(h.buckets)+1)
+	for _, b := range h.buckets {
+		buckets = append(buckets, BucketSnapshot{LE: formatLE(b.max), Count: b.count})
+	}
+	buckets = append(buckets, BucketSnapshot{LE: "+Inf", Count: h.count})
+	return SeriesSnapshot{Name: h.n, Labels: h.labels, Sum: &sum, Count: &count, Buckets: buckets}
+}
+
+//
+//
+//
+
+// atomicFloat is a float64 that's read and updated atomically.
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+func (f *atomicFloat) store(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *atomicFloat) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&f.bits, old, next) {
+			return
+		}
+	}
+}
+
+//
+//
+//
+
+// renderSample renders a sample line from its precomputed name and labels,
+// and its value, in the same format as fmt's %f.
+func renderSample(prefix string, value float64) string {
+	return string(appendSample(make([]byte, 0, len(prefix)+32), prefix, value))
+}
+
+func appendSample(b []byte, prefix string, value float64) []byte {
+	b = append(b, prefix...)
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, value, 'f', 6, 64)
+	return append(b, '\n')
+}
+
+func appendCountSample(b []byte, prefix string, count uint64) []byte {
+	b = append(b, prefix...)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, count, 10)
+	return append(b, '\n')
+}
+
+func makeTimeseriesKey(name string, labels map[string]string) timeseriesKey {
+	return timeseriesKey(name + " " + renderLabels(labels))
+}
+
+func renderLabels(labels map[string]string) string {
+	parts := make([]string, len(labels))
+	for i, k := range sortLabelKeys(labels) {
+		parts[i] = fmt.Sprintf(`%s="%s"`, k, labels[k])
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func sortLabelKeys(labels map[string]string) (keys []string) {
+	keys = make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
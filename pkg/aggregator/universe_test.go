@@ -0,0 +1,326 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestThreeTypes(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`{"name":"foo_total","labels":{"code":"200"},"value": 1}`,
+		`{"name":"foo_total","labels":{"code":"404"},"value": 2}`,
+		`foo_total{code="200"} 4`,
+		`foo_total{code="404"} 8`,
+
+		`{"name":"bar_seconds","type":"histogram","help":"Bar duration in seconds.","buckets":[0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10]}`,
+		`{"name":"bar_seconds","value":0.123}`,
+		`{"name":"bar_seconds","value":0.234}`,
+		`{"name":"bar_seconds","value":0.501}`,
+		`{"name":"bar_seconds","value":8.000}`,
+
+		`{"name":"baz_size","type":"gauge","help":"Current size of baz widget."}`,
+		`{"name":"baz_size","value": 1}`,
+		`{"name":"baz_size","value": 2}`,
+		`baz_size{} 4`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP bar_seconds Bar duration in seconds.
+		# TYPE bar_seconds histogram
+		bar_seconds_bucket{le="0.01"} 0
+		bar_seconds_bucket{le="0.05"} 0
+		bar_seconds_bucket{le="0.1"} 0
+		bar_seconds_bucket{le="0.5"} 2
+		bar_seconds_bucket{le="1"} 3
+		bar_seconds_bucket{le="2"} 3
+		bar_seconds_bucket{le="5"} 3
+		bar_seconds_bucket{le="10"} 4
+		bar_seconds_bucket{le="+Inf"} 4
+		bar_seconds_sum{} 8.858000
+		bar_seconds_count{} 4
+		
+		# HELP baz_size Current size of baz widget.
+		# TYPE baz_size gauge
+		baz_size{} 4.000000
+		
+		# HELP foo_total Total number of foos.
+		# TYPE foo_total counter
+		foo_total{code="200"} 5.000000
+		foo_total{code="404"} 10.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestInitialDeclarations(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`{"name":"bar_seconds","type":"histogram","help":"Bar duration in seconds.","buckets":[0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10]}`,
+		`{"name":"baz_size","type":"gauge","help":"Current size of baz widget."}`,
+		`{"name":"qux_count","type":"counter","help":"Count of qux events."}`,
+	})...)
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{label="value"} 1`,
+		`bar_seconds{} 0.234`,
+		`baz_size{} 5`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP bar_seconds Bar duration in seconds.
+		# TYPE bar_seconds histogram
+		bar_seconds_bucket{le="0.01"} 0
+		bar_seconds_bucket{le="0.05"} 0
+		bar_seconds_bucket{le="0.1"} 0
+		bar_seconds_bucket{le="0.5"} 1
+		bar_seconds_bucket{le="1"} 1
+		bar_seconds_bucket{le="2"} 1
+		bar_seconds_bucket{le="5"} 1
+		bar_seconds_bucket{le="10"} 1
+		bar_seconds_bucket{le="+Inf"} 1
+		bar_seconds_sum{} 0.234000
+		bar_seconds_count{} 1
+		
+		# HELP baz_size Current size of baz widget.
+		# TYPE baz_size gauge
+		baz_size{} 5.000000
+		
+		# HELP foo_total Total number of foos.
+		# TYPE foo_total counter
+		foo_total{label="value"} 1.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestDeclarations(t *testing.T) {
+	decls := []string{
+		`{"name":"bar_seconds","type":"histogram","help":"Bar duration in seconds.","buckets":[0.1,1],"ttl":"1m0s"}`,
+		`{"name":"baz_size","type":"gauge","help":"Current size of baz widget.","label_names":["shard"],"label_policy":"reject"}`,
+		`{"name":"foo_total","type":"counter","help":"Total number of foos.","top_k_label":"path","top_k":10}`,
+	}
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{decls[2], decls[0], decls[1], `foo_total{path="/"} 1`}))
+	var have []string
+	for _, o := range u.Declarations() {
+		buf, err := json.Marshal(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have = append(have, string(buf))
+	}
+	if want, have := strings.Join(decls, "\n"), strings.Join(have, "\n"); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestScrapeWhileObserving(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`{"name":"bar_total","type":"counter","help":"Total number of bars."}`,
+	})...)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		loadObservations(t, u, makeObservations(t, []string{
+			`foo_total{code="200"} 1`,
+			`bar_total{code="200"} 1`,
+			`foo_total{code="500"} 1`,
+			`bar_total{code="500"} 1`,
+		}))
+	}()
+	for i := 0; i < 10; i++ {
+		scrape(t, u)
+	}
+	<-done
+
+	if want, have := normalizeResponse(`
+		# HELP bar_total Total number of bars.
+		# TYPE bar_total counter
+		bar_total{code="200"} 1.000000
+		bar_total{code="500"} 1.000000
+
+		# HELP foo_total Total number of foos.
+		# TYPE foo_total counter
+		foo_total{code="200"} 1.000000
+		foo_total{code="500"} 1.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestShardedUniverse(t *testing.T) {
+	var lines []string
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		lines = append(lines, fmt.Sprintf(`{"name":"%s_total","type":"counter","help":"Total %s."}`, name, name))
+	}
+	declarations := makeObservations(t, lines)
+	observations := makeObservations(t, []string{
+		`a_total{} 1`, `b_total{} 2`, `c_total{} 3`, `d_total{} 4`,
+		`e_total{} 5`, `f_total{} 6`, `g_total{} 7`, `h_total{} 8`,
+	})
+
+	want, _ := NewShardedUniverse(1, declarations...)
+	for i := 0; i < 4; i++ {
+		loadObservations(t, want, observations)
+	}
+
+	for _, shards := range []int{2, 3, 16} {
+		t.Run(fmt.Sprint(shards), func(t *testing.T) {
+			u, err := NewShardedUniverse(shards, declarations...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					loadObservations(t, u, observations)
+				}()
+			}
+			wg.Wait()
+			if want, have := scrape(t, want), scrape(t, u); want != have {
+				t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+			}
+		})
+	}
+
+	if _, err := NewShardedUniverse(0); err == nil {
+		t.Errorf("zero shards: want error, have none")
+	}
+}
+
+func TestConcurrentCountersAndGauges(t *testing.T) {
+	u, _ := NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`{"name":"bar","type":"gauge","help":"Current bar."}`,
+	})...)
+	observations := makeObservations(t, []string{
+		`foo_total{} 1`,
+		`{"name":"bar","op":"add","value":2}`,
+		`{"name":"bar","op":"add","value":-1}`,
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				loadObservations(t, u, observations)
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		scrape(t, u)
+	}
+	wg.Wait()
+
+	if want, have := normalizeResponse(`
+		# HELP bar Current bar.
+		# TYPE bar gauge
+		bar{} 8000.000000
+
+		# HELP foo_total Total number of foos.
+		# TYPE foo_total counter
+		foo_total{} 8000.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	// A deleted series starts again from zero.
+	u.Delete("foo_total", nil)
+	loadObservations(t, u, observations[:1])
+	if s, ok := u.Lookup("foo_total", nil); !ok || *s.Value != 1 {
+		t.Fatalf("after delete: want 1, have %v", s.Value)
+	}
+}
+
+func TestRenderSample(t *testing.T) {
+	for _, value := range []float64{0, 1, -2.5, 1e-7, 123456789.123, math.Inf(1), math.Inf(-1), math.NaN(), math.Copysign(0, -1)} {
+		if want, have := fmt.Sprintf("foo{} %f\n", value), renderSample("foo{}", value); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+}
+
+func TestObserveBatch(t *testing.T) {
+	u, _ := NewUniverse()
+	obs := makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`foo_total{} 1`,
+		`bar_total{} 1`, // undeclared
+		`{"name":"baz","type":"gauge","help":"Current baz."}`,
+		`baz{} 3`,
+		`foo_total{} 2`,
+		`baz{} 4`,
+	})
+	err := u.ObserveBatch(obs)
+	errs, ok := err.(BatchError)
+	if !ok {
+		t.Fatalf("want BatchError, have %v", err)
+	}
+	for i := range obs {
+		if want, have := i == 2, errs[i] != nil; want != have {
+			t.Errorf("Observation %d: want error %v, have %v", i, want, errs[i])
+		}
+	}
+	if want, have := normalizeResponse(`
+		# HELP baz Current baz.
+		# TYPE baz gauge
+		baz{} 4.000000
+
+		# HELP foo_total Total number of foos.
+		# TYPE foo_total counter
+		foo_total{} 3.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	if err := u.ObserveBatch(obs[5:]); err != nil {
+		t.Errorf("want no error, have %v", err)
+	}
+}
+func makeObservations(t *testing.T, lines []string) []Observation {
+	t.Helper()
+	observations := make([]Observation, len(lines))
+	for i, s := range lines {
+		o, err := ParseLine([]byte(s), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		observations[i] = o
+	}
+	return observations
+}
+
+func loadObservations(t *testing.T, obs Observer, observations []Observation) {
+	t.Helper()
+	for _, o := range observations {
+		if err := obs.Observe(o); err != nil {
+			t.Fatalf("%+v: %v", o, err)
+		}
+	}
+}
+
+func scrape(t *testing.T, h http.Handler) string {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	h.ServeHTTP(rec, req)
+	return rec.Body.String()
+}
+
+func normalizeResponse(s string) string {
+	lines := strings.Split(s, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
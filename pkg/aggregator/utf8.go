@@ -0,0 +1,194 @@
+package aggregator
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Metric and label names that aren't valid in the classic exposition format,
+// like the dotted names of OpenTelemetry, are rendered in the quoted syntax
+// of the UTF-8 names proposal, e.g. {"http.server.duration",code="200"}, for
+// scrapers that negotiate it. For other scrapers, they're escaped, by
+// replacing each invalid character with an underscore.
+// See https://github.com/prometheus/proposals/blob/main/proposals/2023-08-21-utf8.md.
+
+// isLegacyName reports whether s is a valid metric name in the classic
+// exposition format, or a valid label name, if label is true.
+func isLegacyName(s string, label bool) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range []byte(s) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		case c == ':' && !label:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// escapeName returns s with every character that isn't valid in a classic
+// metric or label name replaced with an underscore.
+func escapeName(s string, label bool) string {
+	if isLegacyName(s, label) {
+		return s
+	}
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case r >= '0' && r <= '9' && i > 0:
+		case r == ':' && !label:
+		default:
+			r = '_'
+		}
+		b.WriteRune(r)
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// renderName returns the metric name n as it's rendered in HELP and TYPE
+// lines.
+func renderName(n string) string {
+	if isLegacyName(n, false) {
+		return n
+	}
+	return `"` + n + `"`
+}
+
+// renderSeries returns the rendered name and labels of a sample.
+func renderSeries(name string, labels map[string]string) string {
+	parts := make([]string, 0, len(labels)+1)
+	if !isLegacyName(name, false) {
+		parts = append(parts, `"`+name+`"`)
+		name = ""
+	}
+	for _, k := range sortLabelKeys(labels) {
+		if isLegacyName(k, true) {
+			parts = append(parts, fmt.Sprintf(`%s="%s"`, k, labels[k]))
+		} else {
+			parts = append(parts, fmt.Sprintf(`"%s"="%s"`, k, labels[k]))
+		}
+	}
+	return name + "{" + strings.Join(parts, ",") + "}"
+}
+
+// hasUTF8Names reports whether o has a metric or label name that isn't valid
+// in the classic exposition format.
+func hasUTF8Names(o Observation) bool {
+	if !isLegacyName(o.Name, false) {
+		return true
+	}
+	for k := range o.Labels {
+		if !isLegacyName(k, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsUTF8 reports whether the Accept header of r allows the text format
+// with UTF-8 names, as Prometheus 3 does.
+func AllowsUTF8(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			params := strings.Split(mediaRange, ";")
+			if strings.TrimSpace(params[0]) != "text/plain" {
+				continue
+			}
+			for _, param := range params[1:] {
+				if strings.TrimSpace(param) == "escaping=allow-utf-8" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// escapeExposition rewrites the exposition format in b, as rendered by the
+// universe, from the quoted syntax to escaped names.
+func escapeExposition(b []byte) []byte {
+	var out []byte
+	for len(b) > 0 {
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line, b = b[:i+1], b[i+1:]
+		} else {
+			b = nil
+		}
+		out = append(out, escapeLine(line)...)
+	}
+	return out
+}
+
+func escapeLine(line []byte) []byte {
+	for _, comment := range []string{"# HELP ", "# TYPE "} {
+		if bytes.HasPrefix(line, []byte(comment+`"`)) {
+			rest := line[len(comment)+1:]
+			end := bytes.IndexByte(rest, '"')
+			if end < 0 {
+				return line
+			}
+			return append([]byte(comment+escapeName(string(rest[:end]), false)), rest[end+1:]...)
+		}
+	}
+	brace := bytes.IndexByte(line, '{')
+	if len(line) == 0 || line[0] == '#' || brace < 0 {
+		return line
+	}
+	var (
+		name   = string(line[:brace])
+		labels []string
+		p      = line[brace+1:]
+	)
+	for len(p) > 0 && p[0] != '}' {
+		var token string
+		if p[0] == '"' {
+			end := bytes.IndexByte(p[1:], '"')
+			if end < 0 {
+				return line
+			}
+			token, p = string(p[1:end+1]), p[end+2:]
+		} else {
+			end := bytes.IndexByte(p, '=')
+			if end < 0 {
+				return line
+			}
+			token, p = string(p[:end]), p[end:]
+		}
+		if len(p) > 0 && p[0] == '=' {
+			n := valueEnd(p[1:])
+			labels = append(labels, escapeName(token, true)+"="+string(p[1:1+n]))
+			p = p[1+n:]
+		} else {
+			name = escapeName(token, false) // the quoted metric name
+		}
+		if len(p) > 0 && p[0] == ',' {
+			p = p[1:]
+		}
+	}
+	if len(p) == 0 {
+		return line
+	}
+	return []byte(name + "{" + strings.Join(labels, ",") + string(p))
+}
+
+// valueEnd returns the length of the quoted label value at the start of p,
+// which ends at a quote followed by a comma or closing brace.
+func valueEnd(p []byte) int {
+	for i := 1; i < len(p); i++ {
+		if p[i] == '"' && i+1 < len(p) && (p[i+1] == ',' || p[i+1] == '}') {
+			return i + 1
+		}
+	}
+	return len(p)
+}
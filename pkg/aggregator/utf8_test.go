@@ -0,0 +1,88 @@
+package aggregator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUTF8Names(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"http.server.duration","type":"histogram","help":"Duration of HTTP requests.","buckets":[1]}`,
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`{"http.server.duration","http.method"="GET"} 0.5`,
+		`foo_total{} 1`,
+	}))
+
+	for name, testcase := range map[string]struct {
+		accept      string
+		contentType string
+		want        string
+	}{
+		"escaped": {
+			accept:      "text/plain;version=0.0.4",
+			contentType: "text/plain; version=0.0.4",
+			want: `
+				# HELP foo_total Total number of foos.
+				# TYPE foo_total counter
+				foo_total{} 1.000000
+
+				# HELP http_server_duration Duration of HTTP requests.
+				# TYPE http_server_duration histogram
+				http_server_duration_bucket{http_method="GET",le="1"} 1
+				http_server_duration_bucket{http_method="GET",le="+Inf"} 1
+				http_server_duration_sum{http_method="GET"} 0.500000
+				http_server_duration_count{http_method="GET"} 1
+
+			`,
+		},
+		"quoted": {
+			accept:      "application/openmetrics-text;version=1.0.0;escaping=allow-utf-8;q=0.5,text/plain;version=1.0.0;escaping=allow-utf-8;q=0.4",
+			contentType: "text/plain; version=1.0.0; charset=utf-8; escaping=allow-utf-8",
+			want: `
+				# HELP foo_total Total number of foos.
+				# TYPE foo_total counter
+				foo_total{} 1.000000
+
+				# HELP "http.server.duration" Duration of HTTP requests.
+				# TYPE "http.server.duration" histogram
+				{"http.server.duration_bucket","http.method"="GET",le="1"} 1
+				{"http.server.duration_bucket","http.method"="GET",le="+Inf"} 1
+				{"http.server.duration_sum","http.method"="GET"} 0.500000
+				{"http.server.duration_count","http.method"="GET"} 1
+
+			`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept", testcase.accept)
+			u.ServeHTTP(rec, req)
+			if want, have := testcase.contentType, rec.Header().Get("Content-Type"); want != have {
+				t.Errorf("Content-Type: want %q, have %q", want, have)
+			}
+			if want, have := normalizeResponse(testcase.want), normalizeResponse(rec.Body.String()); want != have {
+				t.Errorf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+			}
+		})
+	}
+}
+
+func TestEscapeName(t *testing.T) {
+	for input, want := range map[string]string{
+		"foo_bar:total": "foo_bar:total",
+		"http.server":   "http_server",
+		"1st":           "_st",
+		"café":          "caf_",
+		"":              "_",
+	} {
+		if have := escapeName(input, false); want != have {
+			t.Errorf("%q: want %q, have %q", input, want, have)
+		}
+	}
+	if want, have := "a_b", escapeName("a:b", true); want != have {
+		t.Errorf("label a:b: want %q, have %q", want, have)
+	}
+}
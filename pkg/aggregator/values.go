@@ -0,0 +1,49 @@
+package aggregator
+
+import (
+	"sort"
+)
+
+// checkValues returns an error if o has several values, but isn't a valid
+// multi-value observation.
+func checkValues(o Observation) error {
+	switch {
+	case len(o.Values) == 0 && o.Prefix != "":
+		return rejectf(ReasonBadFormat, "prefix given without values")
+	case len(o.Values) == 0:
+		return nil
+	case o.Name != "" || o.Value != nil:
+		return rejectf(ReasonBadFormat, "values can't be given with a name or value")
+	case o.Type != "" || o.Help != "":
+		return rejectf(ReasonBadFormat, "values can't declare metrics, declare each one on its own")
+	}
+	for name := range o.Values {
+		if name == "" {
+			return rejectf(ReasonBadFormat, "values can't have an empty name")
+		}
+	}
+	return nil
+}
+
+// Split returns the observations of each of the values of a multi-value
+// observation, named with its prefix, in order of name. They share the rest
+// of o, including its labels. An observation without values is returned as
+// it is.
+func (o Observation) Split() []Observation {
+	if len(o.Values) == 0 {
+		return []Observation{o}
+	}
+	names := make([]string, 0, len(o.Values))
+	for name := range o.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	obs := make([]Observation, len(names))
+	for i, name := range names {
+		value := o.Values[name]
+		obs[i] = o
+		obs[i].Name, obs[i].Value = o.Prefix+name, &value
+		obs[i].Prefix, obs[i].Values = "", nil
+	}
+	return obs
+}
@@ -0,0 +1,86 @@
+package aggregator
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseValues(t *testing.T) {
+	fp := func(f float64) *float64 { return &f }
+
+	for name, testcase := range map[string]struct {
+		input string
+		want  []Observation
+		err   bool
+	}{
+		"values": {
+			input: `{"prefix":"proc_","labels":{"pid":"1"},"values":{"rss_bytes":1048576,"cpu_seconds_total":1.2}}`,
+			want: []Observation{
+				{Name: "proc_cpu_seconds_total", Labels: map[string]string{"pid": "1"}, Value: fp(1.2)},
+				{Name: "proc_rss_bytes", Labels: map[string]string{"pid": "1"}, Value: fp(1048576)},
+			},
+		},
+		"no prefix": {
+			input: `{"values":{"a":1,"b":2},"op":"set"}`,
+			want: []Observation{
+				{Name: "a", Op: "set", Value: fp(1)},
+				{Name: "b", Op: "set", Value: fp(2)},
+			},
+		},
+		"single value": {
+			input: `{"name":"foo","value":1}`,
+			want:  []Observation{{Name: "foo", Value: fp(1)}},
+		},
+		"prefix without values": {input: `{"prefix":"proc_","value":1}`, err: true},
+		"name and values":       {input: `{"name":"foo","values":{"a":1}}`, err: true},
+		"value and values":      {input: `{"value":1,"values":{"a":1}}`, err: true},
+		"declaration":           {input: `{"type":"gauge","help":"A.","values":{"a":1}}`, err: true},
+		"empty name":            {input: `{"prefix":"proc_","values":{"":1}}`, err: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			o, err := ParseLine([]byte(testcase.input), nil)
+			if testcase.err {
+				if err == nil {
+					t.Fatal("want error, have none")
+				}
+				if want, have := ReasonBadFormat, RejectReason(err); want != have {
+					t.Errorf("reason: want %s, have %s", want, have)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := o.Split(); !cmp.Equal(testcase.want, have) {
+				t.Error(cmp.Diff(testcase.want, have))
+			}
+		})
+	}
+}
+
+func TestObserveValues(t *testing.T) {
+	u, _ := NewUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"proc_cpu_seconds_total","type":"counter","help":"CPU time."}`,
+		`{"name":"proc_rss_bytes","type":"gauge","help":"Resident memory."}`,
+	}))
+	o, err := ParseLine([]byte(`{"prefix":"proc_","values":{"cpu_seconds_total":1.5,"rss_bytes":1024}}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.ObserveBatch(o.Split()); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := normalizeResponse(`
+		# HELP proc_cpu_seconds_total CPU time.
+		# TYPE proc_cpu_seconds_total counter
+		proc_cpu_seconds_total{} 1.500000
+
+		# HELP proc_rss_bytes Resident memory.
+		# TYPE proc_rss_bytes gauge
+		proc_rss_bytes{} 1024.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
@@ -0,0 +1,84 @@
+package aggregator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// parseWindow returns the sliding window declared by o, and the number of
+// buckets it's made of, defaulting to defaultWindowBuckets. A window of 0
+// means o doesn't declare one. The buckets are bounded, since each series
+// allocates every one of them, and rotates through them on each observation.
+func parseWindow(o Observation) (window time.Duration, buckets int, err error) {
+	buckets = o.WindowBuckets
+	if o.Window != "" {
+		if window, err = time.ParseDuration(o.Window); err != nil {
+			return 0, 0, errors.Wrap(err, "invalid window")
+		}
+		if window <= 0 {
+			return 0, 0, fmt.Errorf("window must be positive")
+		}
+		if buckets == 0 {
+			buckets = defaultWindowBuckets
+		}
+	}
+	if buckets < 0 || (window == 0 && buckets > 0) {
+		return 0, 0, fmt.Errorf("window buckets must be positive, and only given with a window")
+	}
+	if buckets > maxWindowBuckets {
+		return 0, 0, fmt.Errorf("window buckets can't be more than %d", maxWindowBuckets)
+	}
+	if window > 0 && window/time.Duration(buckets) < minWindowBucket {
+		return 0, 0, fmt.Errorf("window buckets must each cover at least %s of the window", minWindowBucket)
+	}
+	return window, buckets, nil
+}
+
+const (
+	// defaultWindowBuckets is the default number of buckets of a sliding
+	// window.
+	defaultWindowBuckets = 6
+
+	// maxWindowBuckets is the most buckets a sliding window may have.
+	maxWindowBuckets = 60
+
+	// minWindowBucket is the least part of a sliding window each of its
+	// buckets may cover.
+	minWindowBucket = time.Second
+)
+
+// windowRing tracks which of a ring of buckets, each covering an equal part
+// of a sliding window, is current, as the window moves on. The window
+// therefore covers between window-window/buckets and window of observations.
+type windowRing struct {
+	buckets   int
+	head      int       // the current bucket
+	headStart time.Time // when the current bucket was reset
+	slot      time.Duration
+	now       func() time.Time
+}
+
+func newWindowRing(window time.Duration, buckets int, now func() time.Time) windowRing {
+	return windowRing{
+		buckets:   buckets,
+		headStart: now(),
+		slot:      window / time.Duration(buckets),
+		now:       now,
+	}
+}
+
+// rotate moves the head to the current bucket, calling reset with the index
+// of each bucket that has left the window, and is reused.
+func (r *windowRing) rotate(reset func(i int)) {
+	now := r.now()
+	for i := 0; i < r.buckets && !now.Before(r.headStart.Add(r.slot)); i++ {
+		r.head = (r.head + 1) % r.buckets
+		reset(r.head)
+		r.headStart = r.headStart.Add(r.slot)
+	}
+	if !now.Before(r.headStart.Add(r.slot)) {
+		r.headStart = now // nothing was observed for the whole window
+	}
+}
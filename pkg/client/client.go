@@ -0,0 +1,402 @@
+// Package client sends observations to a prometheus-aggregator.
+//
+// Metrics are declared when they're created, and observations are buffered,
+// and sent in the background by a single goroutine, so recording them never
+// blocks on the network. If the aggregator is unreachable, the client
+// reconnects with exponential backoff, buffering observations meanwhile, up
+// to a limit; declarations are sent again on every new connection, in case
+// the aggregator was restarted.
+//
+//	c, err := client.New("tcp://127.0.0.1:8191", client.Options{})
+//	if err != nil {
+//		...
+//	}
+//	defer c.Close()
+//	requests := c.NewCounter("http_requests_total", "Total number of HTTP requests.")
+//	requests.With("code", "200").Add(1)
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+// Options configure a Client. The zero value is the defaults.
+type Options struct {
+	// FlushInterval is how often buffered observations are sent. Zero
+	// means DefaultFlushInterval.
+	FlushInterval time.Duration
+
+	// MaxBatchBytes sends buffered observations before the flush interval,
+	// once there are this many bytes of them. Zero means
+	// DefaultMaxBatchBytes.
+	MaxBatchBytes int
+
+	// MaxBufferedBytes is the most observations that are buffered while
+	// the aggregator is unreachable; later observations are dropped. Zero
+	// means DefaultMaxBufferedBytes.
+	MaxBufferedBytes int
+
+	// MaxBackoff is the longest wait between attempts to connect. Zero
+	// means DefaultMaxBackoff.
+	MaxBackoff time.Duration
+
+	// Gzip compresses each datagram. It's only supported over UDP and
+	// unixgram, as compressed lines may contain newlines.
+	Gzip bool
+
+	// Key encrypts each datagram with AES-GCM, for an aggregator with the
+	// same -udp.key. It's 16, 24, or 32 bytes, and only supported over UDP
+	// and unixgram.
+	Key []byte
+
+	// ErrorHandler, if not nil, is called with errors connecting to and
+	// writing to the aggregator. It's called from the sending goroutine,
+	// and mustn't block.
+	ErrorHandler func(error)
+}
+
+// Defaults for Options.
+const (
+	DefaultFlushInterval    = time.Second
+	DefaultMaxBatchBytes    = 64 * 1024
+	DefaultMaxBufferedBytes = 1024 * 1024
+	DefaultMaxBackoff       = 30 * time.Second
+)
+
+// minBackoff is the first wait after failing to connect.
+const minBackoff = 100 * time.Millisecond
+
+// redeclareEvery is how often declarations are sent again over packet
+// networks.
+const redeclareEvery = time.Minute
+
+// Client buffers observations, and sends them to an aggregator. It's safe
+// for concurrent use.
+type Client struct {
+	dropped          uint64 // atomic, first for alignment
+	network, address string
+	packets          bool // each line is its own datagram
+	opts             Options
+
+	mtx          sync.Mutex
+	declarations [][]byte // in order of creation
+	declared     map[string]bool
+	pending      []byte // newline-terminated lines
+	closed       bool
+	closeErr     error
+
+	// Only used by the sending goroutine.
+	conn       net.Conn
+	sent       int       // declarations sent on conn
+	declaredAt time.Time // when declarations were last sent from the first
+	backoff    time.Duration
+	retryAt    time.Time
+	spare      []byte
+	zbuf       bytes.Buffer
+	zw         *gzip.Writer
+	cipher     *aggregator.PacketCipher
+	sealed     []byte
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns a client that sends to the aggregator at target, a URL like
+// tcp://127.0.0.1:8191 or udp://127.0.0.1:8191, in the same form as the
+// aggregator's -socket flag. It connects in the background, so an unreachable
+// aggregator isn't an error.
+func New(target string, opts Options) (*Client, error) {
+	network, address, err := parseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.MaxBatchBytes <= 0 {
+		opts.MaxBatchBytes = DefaultMaxBatchBytes
+	}
+	if opts.MaxBufferedBytes <= 0 {
+		opts.MaxBufferedBytes = DefaultMaxBufferedBytes
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	c := &Client{
+		network:  network,
+		address:  address,
+		packets:  strings.HasPrefix(network, "udp") || network == "unixgram",
+		opts:     opts,
+		declared: map[string]bool{},
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if opts.Gzip {
+		if !c.packets {
+			return nil, fmt.Errorf("gzip is only supported over UDP and unixgram, as compressed lines may contain newlines")
+		}
+		c.zw = gzip.NewWriter(&c.zbuf)
+	}
+	if opts.Key != nil {
+		if !c.packets {
+			return nil, fmt.Errorf("encryption is only supported over UDP and unixgram")
+		}
+		if c.cipher, err = aggregator.NewPacketCipher(opts.Key); err != nil {
+			return nil, err
+		}
+	}
+	go c.run()
+	return c, nil
+}
+
+// parseTarget parses the address of an aggregator.
+func parseTarget(target string) (network, address string, err error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", "", err
+	}
+	network = strings.ToLower(u.Scheme)
+	switch network {
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		address = u.Host
+	case "unix", "unixgram":
+		address = u.Path
+	default:
+		return "", "", fmt.Errorf("unsupported network %q", u.Scheme)
+	}
+	return network, address, nil
+}
+
+// Dropped returns the number of observations dropped so far, because the
+// buffer was full, or they couldn't be written.
+func (c *Client) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Flush sends buffered observations now, rather than waiting for the flush
+// interval. It doesn't wait for them to be sent.
+func (c *Client) Flush() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Heartbeat sends a heartbeat from the named sender, which may be empty,
+// with the next batch, so that the aggregator can tell the sender is still
+// running, even when it has nothing to observe.
+func (c *Client) Heartbeat(sender string) {
+	c.record(append(aggregator.Heartbeat(sender), '\n'))
+}
+
+// Close sends buffered observations, and closes the connection. It returns
+// an error if any couldn't be sent. Observations recorded after Close are
+// dropped.
+func (c *Client) Close() error {
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mtx.Unlock()
+	close(c.stop)
+	<-c.done
+	return c.closeErr
+}
+
+// declare records the declaration of a metric, which is sent before any
+// observations. Redeclaring a metric is a no-op.
+func (c *Client) declare(o aggregator.Observation) {
+	line, err := json.Marshal(o)
+	if err != nil {
+		return // only possible with NaN or infinite buckets, which are rejected anyway
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.declared[o.Name] {
+		return
+	}
+	c.declared[o.Name] = true
+	c.declarations = append(c.declarations, append(line, '\n'))
+}
+
+// record buffers a line, which must end with a newline.
+func (c *Client) record(line []byte) {
+	c.mtx.Lock()
+	if c.closed || len(c.pending)+len(line) > c.opts.MaxBufferedBytes {
+		c.mtx.Unlock()
+		atomic.AddUint64(&c.dropped, 1)
+		return
+	}
+	c.pending = append(c.pending, line...)
+	full := len(c.pending) >= c.opts.MaxBatchBytes
+	c.mtx.Unlock()
+	if full {
+		c.Flush()
+	}
+}
+
+// run sends buffered observations every flush interval, or when woken,
+// until the client is closed.
+func (c *Client) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flush(false)
+		case <-c.wake:
+			c.flush(false)
+		case <-c.stop:
+			c.flush(true)
+			if c.conn != nil {
+				c.conn.Close()
+			}
+			c.mtx.Lock()
+			if n := bytes.Count(c.pending, []byte("\n")); n > 0 {
+				atomic.AddUint64(&c.dropped, uint64(n))
+				c.closeErr = fmt.Errorf("%d observations weren't sent", n)
+			}
+			c.mtx.Unlock()
+			return
+		}
+	}
+}
+
+// flush sends declarations that haven't been sent on the connection, and
+// then the buffered lines. If the aggregator can't be reached, the lines stay
+// buffered. When closing, the backoff is ignored, as there's no later
+// attempt.
+func (c *Client) flush(closing bool) {
+	c.mtx.Lock()
+	idle := len(c.pending) == 0 && c.sent == len(c.declarations)
+	c.mtx.Unlock()
+	if idle && !c.redeclareDue() {
+		return
+	}
+	if !c.connect(closing) {
+		return
+	}
+	if c.redeclareDue() {
+		c.sent, c.declaredAt = 0, time.Now()
+	}
+
+	c.mtx.Lock()
+	declarations := c.declarations[c.sent:]
+	batch := c.pending
+	c.pending = c.spare[:0]
+	c.mtx.Unlock()
+
+	for _, line := range declarations {
+		if err := c.write(line); err != nil {
+			c.failed(err, batch)
+			return
+		}
+		c.sent++
+	}
+	if err := c.writeLines(batch); err != nil {
+		c.failed(err, batch)
+		return
+	}
+	c.spare = batch
+}
+
+// redeclareDue reports whether declarations should be sent again, which is
+// periodically over packet networks, where a restarted aggregator can't be
+// detected.
+func (c *Client) redeclareDue() bool {
+	return c.packets && c.conn != nil && time.Since(c.declaredAt) >= redeclareEvery
+}
+
+// connect dials the aggregator, if there's no connection, and reports
+// whether there is one.
+func (c *Client) connect(ignoreBackoff bool) bool {
+	if c.conn != nil {
+		return true
+	}
+	if !ignoreBackoff && time.Now().Before(c.retryAt) {
+		return false
+	}
+	conn, err := net.DialTimeout(c.network, c.address, c.opts.MaxBackoff)
+	if err != nil {
+		c.backoff *= 2
+		if c.backoff < minBackoff {
+			c.backoff = minBackoff
+		}
+		if c.backoff > c.opts.MaxBackoff {
+			c.backoff = c.opts.MaxBackoff
+		}
+		c.retryAt = time.Now().Add(c.backoff)
+		c.handleError(err)
+		return false
+	}
+	c.conn, c.backoff, c.sent, c.declaredAt = conn, 0, 0, time.Now()
+	return true
+}
+
+// failed closes the connection after a write error. The batch is dropped
+// rather than sent again, as some of it may have been received.
+func (c *Client) failed(err error, batch []byte) {
+	c.handleError(err)
+	c.conn.Close()
+	c.conn, c.sent = nil, 0
+	atomic.AddUint64(&c.dropped, uint64(bytes.Count(batch, []byte("\n"))))
+}
+
+// writeLines writes newline-terminated lines, as a single write on streams,
+// or one datagram per line.
+func (c *Client) writeLines(lines []byte) error {
+	if !c.packets {
+		return c.write(lines)
+	}
+	for len(lines) > 0 {
+		x := bytes.IndexByte(lines, '\n')
+		if err := c.write(lines[:x+1]); err != nil {
+			return err
+		}
+		lines = lines[x+1:]
+	}
+	return nil
+}
+
+// write writes lines to the connection, or a single line as a datagram,
+// without its newline, and gzipped and encrypted if configured.
+func (c *Client) write(p []byte) error {
+	if c.packets {
+		p = bytes.TrimSuffix(p, []byte("\n"))
+		if c.zw != nil {
+			c.zbuf.Reset()
+			c.zw.Reset(&c.zbuf)
+			c.zw.Write(p)
+			c.zw.Close()
+			p = c.zbuf.Bytes()
+		}
+		if c.cipher != nil {
+			c.sealed = c.cipher.Seal(c.sealed[:0], p)
+			p = c.sealed
+		}
+	}
+	_, err := c.conn.Write(p)
+	return err
+}
+
+func (c *Client) handleError(err error) {
+	if c.opts.ErrorHandler != nil {
+		c.opts.ErrorHandler(err)
+	}
+}
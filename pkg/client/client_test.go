@@ -0,0 +1,199 @@
+package client
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestClient(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			u, _ := aggregator.NewUniverse()
+			var key []byte
+			if network == "udp" {
+				key = []byte("0123456789abcdef")
+			}
+			target := serve(t, network, "127.0.0.1:0", u, key)
+
+			c, err := New(target, Options{Gzip: network == "udp", Key: key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			requests := c.NewCounter("requests_total", "Total requests.")
+			ok := requests.With("code", "200")
+			ok.Add(1)
+			ok.Add(2)
+			requests.With("path", "/a b,c").Add(1) // needs JSON
+			inflight := c.NewGauge("inflight", "Requests in flight.")
+			inflight.Add(3)
+			inflight.Add(-1)
+			duration := c.NewHistogram("duration_seconds", "Request duration.", []float64{0.1, 1})
+			duration.Observe(0.5)
+			c.NewDistribution("size_bytes", "Response size.", 0.5).With("code", "200").Observe(100)
+			c.Heartbeat("web-1")
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if want, have := normalize(`
+				# HELP duration_seconds Request duration.
+				# TYPE duration_seconds histogram
+				duration_seconds_bucket{le="0.1"} 0
+				duration_seconds_bucket{le="1"} 1
+				duration_seconds_bucket{le="+Inf"} 1
+				duration_seconds_sum{} 0.500000
+				duration_seconds_count{} 1
+
+				# HELP inflight Requests in flight.
+				# TYPE inflight gauge
+				inflight{} 2.000000
+
+				# HELP requests_total Total requests.
+				# TYPE requests_total counter
+				requests_total{code="200"} 3.000000
+				requests_total{path="/a b,c"} 1.000000
+
+				# HELP size_bytes Response size.
+				# TYPE size_bytes summary
+				size_bytes{code="200",quantile="0.5"} 100.494568
+				size_bytes_sum{code="200"} 100.000000
+				size_bytes_count{code="200"} 1
+			`), normalize(waitForScrape(t, u, "duration_seconds_count{} 1")); want != have {
+				t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+			}
+		})
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	// Find a free address, and leave nothing listening on it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	errs := make(chan error, 100)
+	c, err := New("tcp://"+addr, Options{
+		FlushInterval: 10 * time.Millisecond,
+		MaxBackoff:    50 * time.Millisecond,
+		ErrorHandler: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.NewCounter("foo_total", "Total foos.").Add(1)
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("want a connection error, have none")
+	}
+
+	// Lines are buffered until the aggregator is listening.
+	u, _ := aggregator.NewUniverse()
+	serve(t, "tcp", addr, u, nil)
+	waitForScrape(t, u, "foo_total{} 1")
+
+	if want, have := uint64(0), c.Dropped(); want != have {
+		t.Errorf("dropped: want %d, have %d", want, have)
+	}
+}
+
+func TestClientBufferFull(t *testing.T) {
+	c, err := New("tcp://127.0.0.1:1", Options{MaxBufferedBytes: 32, MaxBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	foo := c.NewCounter("foo_total", "Total foos.")
+	for i := 0; i < 4; i++ {
+		foo.Add(1) // 14 bytes each, so 2 fit
+	}
+	if want, have := uint64(2), c.Dropped(); want != have {
+		t.Errorf("dropped: want %d, have %d", want, have)
+	}
+	if err := c.Close(); err == nil {
+		t.Errorf("close: want error, have none")
+	}
+	if want, have := uint64(4), c.Dropped(); want != have {
+		t.Errorf("dropped after close: want %d, have %d", want, have)
+	}
+}
+
+func TestNewGzipTCP(t *testing.T) {
+	if _, err := New("tcp://127.0.0.1:8191", Options{Gzip: true}); err == nil {
+		t.Errorf("want error, have none")
+	}
+	if _, err := New("http://127.0.0.1:8191", Options{}); err == nil {
+		t.Errorf("want error, have none")
+	}
+	if _, err := New("tcp://127.0.0.1:8191", Options{Key: []byte("0123456789abcdef")}); err == nil {
+		t.Errorf("key over TCP: want error, have none")
+	}
+}
+
+// serve serves u on a new listener on the network and address, and returns
+// its target URL. Packets are decrypted with key, if it's not nil.
+func serve(t *testing.T, network, address string, u *aggregator.Universe, key []byte) string {
+	t.Helper()
+	if network == "udp" {
+		conn, err := net.ListenPacket(network, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		s := &aggregator.Server{Observer: u}
+		if key != nil {
+			if s.Cipher, err = aggregator.NewPacketCipher(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		go s.ServePacket(conn)
+		return network + "://" + conn.LocalAddr().String()
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go aggregator.Serve(ln, u)
+	return network + "://" + ln.Addr().String()
+}
+
+// waitForScrape scrapes u until the output contains want, which arrives
+// asynchronously, and returns it.
+func waitForScrape(t *testing.T, u *aggregator.Universe, want string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec := httptest.NewRecorder()
+		u.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		have := rec.Body.String()
+		if strings.Contains(have, want) {
+			return have
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want %q, have\n%s", want, have)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func normalize(s string) string {
+	lines := strings.Split(s, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
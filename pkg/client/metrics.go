@@ -0,0 +1,200 @@
+package client
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+// series is a metric name and labels, and the rendered line they prefix.
+type series struct {
+	c      *Client
+	name   string
+	labels []string // alternating names and values
+	prefix []byte   // rendered name and labels, up to the value
+	suffix string   // after the value
+}
+
+func newSeries(c *Client, name string, labels []string) series {
+	s := series{c: c, name: name, labels: labels}
+	s.prefix, s.suffix = renderPrefix(name, labels, "")
+	return s
+}
+
+// with returns the series with more labels. A name without a value is given
+// the value "unknown", as in go-kit's metrics.
+func (s series) with(labelValues []string) series {
+	if len(labelValues)%2 != 0 {
+		labelValues = append(labelValues, "unknown")
+	}
+	labels := make([]string, 0, len(s.labels)+len(labelValues))
+	labels = append(labels, s.labels...)
+	labels = append(labels, labelValues...)
+	return newSeries(s.c, s.name, labels)
+}
+
+// record sends an observation of the series with the value.
+func (s series) record(value float64) {
+	s.recordLine(s.prefix, s.suffix, value)
+}
+
+func (s series) recordLine(prefix []byte, suffix string, value float64) {
+	line := make([]byte, 0, len(prefix)+len(suffix)+24)
+	line = append(line, prefix...)
+	line = strconv.AppendFloat(line, value, 'g', -1, 64)
+	line = append(line, suffix...)
+	s.c.record(append(line, '\n'))
+}
+
+// renderPrefix renders the name and labels of a line, up to the value. Lines
+// are in the Prometheus format, unless the names or labels contain characters
+// that the aggregator's parser doesn't support in that format, or there's an
+// op, in which case they're JSON.
+func renderPrefix(name string, labels []string, op string) (prefix []byte, suffix string) {
+	if op == "" && isPlain(name) && isPlainLabels(labels) {
+		prefix = append(prefix, name...)
+		prefix = append(prefix, '{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				prefix = append(prefix, ',')
+			}
+			prefix = append(prefix, labels[i]...)
+			prefix = append(prefix, `="`...)
+			prefix = append(prefix, labels[i+1]...)
+			prefix = append(prefix, '"')
+		}
+		return append(prefix, "} "...), ""
+	}
+
+	var labelmap map[string]string
+	if len(labels) > 0 {
+		labelmap = make(map[string]string, len(labels)/2)
+		for i := 0; i < len(labels); i += 2 {
+			labelmap[labels[i]] = labels[i+1]
+		}
+	}
+	buf, _ := json.Marshal(struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels,omitempty"`
+		Op     string            `json:"op,omitempty"`
+	}{name, labelmap, op})
+	// The value is appended in place of the closing brace, for each
+	// observation.
+	return append(buf[:len(buf)-1], `,"value":`...), "}"
+}
+
+func isPlain(s string) bool {
+	return s != "" && !strings.ContainsAny(s, " \t\r\n,=\"{}\\")
+}
+
+func isPlainLabels(labels []string) bool {
+	for _, s := range labels {
+		if !isPlain(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// Counter is a counter, with zero or more labels.
+type Counter struct{ s series }
+
+// NewCounter declares a counter, and returns it without labels.
+func (c *Client) NewCounter(name, help string) *Counter {
+	c.declare(aggregator.Observation{Name: name, Type: "counter", Help: help})
+	return &Counter{newSeries(c, name, nil)}
+}
+
+// With returns the counter with additional labels, as alternating names and
+// values. It renders the labels, so the result should be kept if it's used
+// repeatedly.
+func (m *Counter) With(labelValues ...string) *Counter {
+	return &Counter{m.s.with(labelValues)}
+}
+
+// Add increments the counter by delta, which must not be negative.
+func (m *Counter) Add(delta float64) {
+	m.s.record(delta)
+}
+
+// Gauge is a gauge, with zero or more labels.
+type Gauge struct {
+	s         series
+	addPrefix []byte
+}
+
+// NewGauge declares a gauge, and returns it without labels.
+func (c *Client) NewGauge(name, help string) *Gauge {
+	c.declare(aggregator.Observation{Name: name, Type: "gauge", Help: help})
+	return newGauge(newSeries(c, name, nil))
+}
+
+func newGauge(s series) *Gauge {
+	g := &Gauge{s: s}
+	g.addPrefix, _ = renderPrefix(s.name, s.labels, "add")
+	return g
+}
+
+// With returns the gauge with additional labels, as alternating names and
+// values.
+func (m *Gauge) With(labelValues ...string) *Gauge {
+	return newGauge(m.s.with(labelValues))
+}
+
+// Set sets the gauge to value.
+func (m *Gauge) Set(value float64) {
+	m.s.record(value)
+}
+
+// Add adds delta to the gauge, in the aggregator, so that concurrent adds
+// from several clients are combined.
+func (m *Gauge) Add(delta float64) {
+	m.s.recordLine(m.addPrefix, "}", delta)
+}
+
+// Histogram is a histogram, with zero or more labels.
+type Histogram struct{ s series }
+
+// NewHistogram declares a histogram with the bucket upper bounds, and returns
+// it without labels.
+func (c *Client) NewHistogram(name, help string, buckets []float64) *Histogram {
+	c.declare(aggregator.Observation{Name: name, Type: "histogram", Help: help, Buckets: buckets})
+	return &Histogram{newSeries(c, name, nil)}
+}
+
+// With returns the histogram with additional labels, as alternating names
+// and values.
+func (m *Histogram) With(labelValues ...string) *Histogram {
+	return &Histogram{m.s.with(labelValues)}
+}
+
+// Observe records a single observation.
+func (m *Histogram) Observe(value float64) {
+	m.s.record(value)
+}
+
+// Distribution is a distribution, with zero or more labels. The aggregator
+// stores its observations in a sketch, rather than fixed buckets, and exports
+// its quantiles.
+type Distribution struct{ s series }
+
+// NewDistribution declares a distribution that exports the quantiles, or
+// the aggregator's defaults if none are given, and returns it without
+// labels.
+func (c *Client) NewDistribution(name, help string, quantiles ...float64) *Distribution {
+	c.declare(aggregator.Observation{Name: name, Type: "distribution", Help: help, Quantiles: quantiles})
+	return &Distribution{newSeries(c, name, nil)}
+}
+
+// With returns the distribution with additional labels, as alternating names
+// and values.
+func (m *Distribution) With(labelValues ...string) *Distribution {
+	return &Distribution{m.s.with(labelValues)}
+}
+
+// Observe records a single observation.
+func (m *Distribution) Observe(value float64) {
+	m.s.record(value)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+const (
+	pubsubEndpoint = "https://pubsub.googleapis.com/v1/"
+	pubsubScope    = "https://www.googleapis.com/auth/pubsub"
+)
+
+// pubsubInput receives lines from a Google Cloud Pub/Sub subscription, for
+// producers, e.g. Cloud Functions, without a network path to the aggregator.
+// Each message's data is a payload of lines, as decoded by decodePayload.
+// A message is acknowledged once its lines are handled, unless none are
+// accepted, and every rejection is by a limit, in which case it's
+// redelivered, as it may be accepted later. A message with a line that can't
+// be parsed is published to the dead-letter topic, if any, before it's
+// acknowledged, so that it can be inspected.
+type pubsubInput struct {
+	subscription string // projects/<project>/subscriptions/<name>
+	deadLetter   string // projects/<project>/topics/<name>, or empty
+	endpoint     string
+	token        func(ctx context.Context) (string, error) // nil for the emulator
+	client       *http.Client
+	source       string
+	in           *ingester
+	logger       log.Logger
+	ctx          context.Context
+	cancel       context.CancelFunc
+}
+
+// newPubSubInput returns an input for the subscription. If
+// $PUBSUB_EMULATOR_HOST is set, the emulator there is used instead of Pub/Sub.
+func newPubSubInput(subscription, deadLetter string, in *ingester, logger log.Logger) (*pubsubInput, error) {
+	parts := strings.Split(subscription, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "subscriptions" || parts[1] == "" || parts[3] == "" {
+		return nil, fmt.Errorf("%s isn't a subscription, e.g. projects/my-project/subscriptions/metrics", subscription)
+	}
+	if parts := strings.Split(deadLetter, "/"); deadLetter != "" && (len(parts) != 4 || parts[0] != "projects" || parts[2] != "topics") {
+		return nil, fmt.Errorf("%s isn't a topic, e.g. projects/my-project/topics/metrics-dead-letter", deadLetter)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pubsubInput{
+		subscription: subscription,
+		deadLetter:   deadLetter,
+		endpoint:     pubsubEndpoint,
+		client:       &http.Client{Timeout: 2 * time.Minute},
+		source:       "pubsub/" + parts[3],
+		in:           in,
+		logger:       log.With(logger, "input", "pubsub", "subscription", subscription),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		p.endpoint = "http://" + host + "/v1/"
+		return p, nil
+	}
+	ts, err := newGCPTokenSource(p.client, pubsubScope)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	p.token = ts.Token
+	return p, nil
+}
+
+type pubsubMessage struct {
+	AckID   string `json:"ackId"`
+	Message struct {
+		Data       []byte            `json:"data"`
+		Attributes map[string]string `json:"attributes,omitempty"`
+		MessageID  string            `json:"messageId"`
+	} `json:"message"`
+}
+
+// run pulls messages until the input is closed, or drained.
+func (p *pubsubInput) run() error {
+	p.in.track(p)
+	defer p.in.untrack(p)
+	for {
+		var resp struct {
+			ReceivedMessages []pubsubMessage `json:"receivedMessages"`
+		}
+		err := p.call(p.ctx, p.subscription+":pull", map[string]interface{}{"maxMessages": 100}, &resp)
+		if p.ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			level.Warn(p.logger).Log("during", "pull", "err", err)
+			if !sleepContext(p.ctx, inputRetryInterval) {
+				return nil
+			}
+			continue
+		}
+		p.handle(resp.ReceivedMessages)
+	}
+}
+
+// handle handles messages, and then acknowledges, redelivers, or
+// dead-letters each, even if the input's been closed since they were pulled.
+func (p *pubsubInput) handle(messages []pubsubMessage) {
+	var (
+		ack, nack []string
+		dead      []pubsubMessage
+		errs      []string
+	)
+	for _, m := range messages {
+		r := p.in.handlePayload(log.With(p.logger, "message_id", m.Message.MessageID), p.source, handshake{}, m.Message.Data)
+		switch {
+		case r.bad != nil && p.deadLetter != "":
+			dead = append(dead, m)
+			errs = append(errs, r.bad.Error())
+		case r.accepted == 0 && r.limited > 0 && r.limited == r.rejected:
+			nack = append(nack, m.AckID)
+		default:
+			ack = append(ack, m.AckID)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if len(dead) > 0 {
+		published := make([]map[string]interface{}, len(dead))
+		for i, m := range dead {
+			attributes := map[string]string{}
+			for k, v := range m.Message.Attributes {
+				attributes[k] = v
+			}
+			attributes["aggregator_error"] = errs[i]
+			attributes["aggregator_subscription"] = p.subscription
+			attributes["aggregator_message_id"] = m.Message.MessageID
+			published[i] = map[string]interface{}{"data": m.Message.Data, "attributes": attributes}
+		}
+		err := p.call(ctx, p.deadLetter+":publish", map[string]interface{}{"messages": published}, nil)
+		for _, m := range dead {
+			if err == nil {
+				ack = append(ack, m.AckID)
+			} else {
+				nack = append(nack, m.AckID)
+			}
+		}
+		if err != nil {
+			level.Warn(p.logger).Log("during", "dead-letter", "err", err, "consequence", "messages will be redelivered")
+		}
+	}
+	if len(ack) > 0 {
+		if err := p.call(ctx, p.subscription+":acknowledge", map[string]interface{}{"ackIds": ack}, nil); err != nil {
+			level.Warn(p.logger).Log("during", "acknowledge", "err", err, "consequence", "messages will be redelivered")
+		}
+	}
+	if len(nack) > 0 {
+		if err := p.call(ctx, p.subscription+":modifyAckDeadline", map[string]interface{}{"ackIds": nack, "ackDeadlineSeconds": 0}, nil); err != nil {
+			level.Warn(p.logger).Log("during", "redeliver", "err", err)
+		}
+	}
+}
+
+// call POSTs in to the method of the Pub/Sub API, e.g.
+// projects/p/subscriptions/s:pull, and decodes the response into out, if it
+// isn't nil.
+func (p *pubsubInput) call(ctx context.Context, method string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", p.endpoint+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != nil {
+		token, err := p.token(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&e)
+		if e.Error.Message == "" {
+			e.Error.Message = resp.Status
+		}
+		return fmt.Errorf("%s: %s", method[strings.LastIndexByte(method, ':')+1:], e.Error.Message)
+	}
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(out), "decoding response")
+}
+
+// Close stops pulling messages, once those already pulled are handled.
+func (p *pubsubInput) Close() error {
+	p.cancel()
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+// fakePubSub records the methods called on it, and their requests.
+type fakePubSub struct {
+	mtx      sync.Mutex
+	calls    map[string][]map[string]interface{}
+	publish  int // status of publish responses
+	messages []pubsubMessage
+}
+
+func (f *fakePubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&req)
+	method := r.URL.Path[strings.LastIndexByte(r.URL.Path, ':')+1:]
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.calls[method] = append(f.calls[method], req)
+	switch {
+	case method == "pull":
+		json.NewEncoder(w).Encode(map[string]interface{}{"receivedMessages": f.messages})
+		f.messages = nil
+	case method == "publish" && f.publish != 0:
+		http.Error(w, `{"error":{"message":"topic not found"}}`, f.publish)
+	default:
+		w.Write([]byte("{}"))
+	}
+}
+
+// ackIDs returns the ack IDs of the calls to method.
+func (f *fakePubSub) ackIDs(method string) string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	var ids []string
+	for _, req := range f.calls[method] {
+		for _, id := range req["ackIds"].([]interface{}) {
+			ids = append(ids, id.(string))
+		}
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, " ")
+}
+
+func pubsubMessages(data ...string) []pubsubMessage {
+	messages := make([]pubsubMessage, len(data))
+	for i, d := range data {
+		messages[i].AckID = string(rune('a' + i))
+		messages[i].Message.Data = []byte(d)
+		messages[i].Message.MessageID = string(rune('1' + i))
+	}
+	return messages
+}
+
+func TestPubSubInputHandle(t *testing.T) {
+	decl := `{"name":"foo","type":"counter","help":"Total foos."}`
+	for name, tc := range map[string]struct {
+		deadLetter string
+		publish    int
+		limited    bool
+		data       []string
+		wantAck    string
+		wantNack   string
+		wantDead   int
+	}{
+		"accepted": {
+			data:    []string{decl + "\nfoo{} 1", `[{"name":"foo","value":2}]`},
+			wantAck: "a b",
+		},
+		"dead-lettered": {
+			deadLetter: "projects/p/topics/dead",
+			data:       []string{decl + "\nfoo{} 1", "foo{ 2", `{"name":"foo","value":"x"}`},
+			wantAck:    "a b c",
+			wantDead:   2,
+		},
+		"parse error without dead letter topic": {
+			data:    []string{"foo{ 2"},
+			wantAck: "a",
+		},
+		"dead letter topic failing": {
+			deadLetter: "projects/p/topics/dead",
+			publish:    http.StatusNotFound,
+			data:       []string{decl, "foo{ 2"},
+			wantAck:    "a",
+			wantNack:   "b",
+			wantDead:   1,
+		},
+		"rate limited": {
+			limited:  true,
+			data:     []string{decl},
+			wantNack: "a",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake := &fakePubSub{calls: map[string][]map[string]interface{}{}, publish: tc.publish}
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+			os.Setenv("PUBSUB_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+			defer os.Unsetenv("PUBSUB_EMULATOR_HOST")
+
+			u, _ := aggregator.NewUniverse()
+			in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+			p, err := newPubSubInput("projects/p/subscriptions/metrics", tc.deadLetter, in, log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.limited {
+				in.limiter = newRateLimiter(rateLimits{SourceLines: 1}, defaultMaxSources)
+				in.limiter.allow(p.source, 1)
+			}
+			p.handle(pubsubMessages(tc.data...))
+
+			if want, have := tc.wantAck, fake.ackIDs("acknowledge"); want != have {
+				t.Errorf("acknowledged: want %q, have %q", want, have)
+			}
+			if want, have := tc.wantNack, fake.ackIDs("modifyAckDeadline"); want != have {
+				t.Errorf("redelivered: want %q, have %q", want, have)
+			}
+			var dead int
+			for _, req := range fake.calls["publish"] {
+				dead += len(req["messages"].([]interface{}))
+			}
+			if want, have := tc.wantDead, dead; want != have {
+				t.Errorf("dead-lettered: want %d, have %d", want, have)
+			}
+		})
+	}
+}
+
+func TestPubSubInputRun(t *testing.T) {
+	fake := &fakePubSub{
+		calls:    map[string][]map[string]interface{}{},
+		messages: pubsubMessages(`{"name":"foo","type":"counter","help":"Total foos."}` + "\nfoo{} 1"),
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	os.Setenv("PUBSUB_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+	defer os.Unsetenv("PUBSUB_EMULATOR_HOST")
+
+	u, _ := aggregator.NewUniverse()
+	in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+	p, err := newPubSubInput("projects/p/subscriptions/metrics", "", in, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- p.run() }()
+	waitFor(t, "acknowledge", func() bool { return fake.ackIDs("acknowledge") == "a" })
+	in.drain(time.Second) // closes the input
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if want, have := normalizeResponse(`
+		# HELP foo Total foos.
+		# TYPE foo counter
+		foo{} 1.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestGCPTokenSourceServiceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		r.ParseForm()
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(parts) != 3 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token", "expires_in": 3600})
+	}))
+	defer srv.Close()
+
+	buf, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "aggregator@p.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    srv.URL,
+	})
+	filename := filepath.Join(t.TempDir(), "key.json")
+	os.WriteFile(filename, buf, 0600)
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filename)
+	defer os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+
+	ts, err := newGCPTokenSource(http.DefaultClient, pubsubScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		token, err := ts.Token(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := "token", token; want != have {
+			t.Fatalf("want %q, have %q", want, have)
+		}
+	}
+	if want, have := 1, requests; want != have {
+		t.Fatalf("token requests: want %d (cached), have %d", want, have)
+	}
+}
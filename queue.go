@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"github.com/pkg/errors"
+)
+
+// ingestQueue decouples reading and parsing lines from observing them, so
+// that contention on the universe doesn't hold up network reads. Parsed
+// observations are queued, and applied by a pool of workers. Each worker has
+// its own queue, and observations are assigned to workers by metric name, so
+// observations of the same metric are applied in the order they're received.
+// When a queue is full, the overflow policy decides whether readers wait for
+// space, or the oldest queued observation is dropped to make room.
+type ingestQueue struct {
+	in       *ingester
+	policy   string
+	chs      []chan queuedObservation
+	dropped  *selfCounter
+	observed *selfCounter
+
+	mtx    sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type queuedObservation struct {
+	obs    aggregator.Observation
+	source string
+	logger log.Logger
+	sp     *span // the line, finished once it's observed
+	wait   *span // time spent in the queue
+	raw    recordedLine
+	parse  time.Duration // time spent parsing and transforming the line
+}
+
+// Overflow policies.
+const (
+	overflowBlock      = "block"
+	overflowDropOldest = "drop-oldest"
+)
+
+// errQueueFull is the error for observations dropped from a full queue.
+var errQueueFull = errors.New("ingest queue full")
+
+// newIngestQueue starts workers applying queued observations via in. The
+// ingester's queue should be set to the returned queue.
+func newIngestQueue(in *ingester, size, workers int, policy string) (*ingestQueue, error) {
+	switch policy {
+	case overflowBlock, overflowDropOldest:
+	default:
+		return nil, fmt.Errorf("invalid overflow policy %q", policy)
+	}
+	if size <= 0 || workers <= 0 {
+		return nil, fmt.Errorf("queue size and workers must be positive")
+	}
+	q := &ingestQueue{
+		in:       in,
+		policy:   policy,
+		chs:      make([]chan queuedObservation, workers),
+		dropped:  newSelfCounter("aggregator_ingest_queue_dropped_total", "Total number of observations dropped because the ingest queue was full."),
+		observed: newSelfCounter("aggregator_ingest_queue_observed_total", "Total number of observations taken from the ingest queue."),
+	}
+	per := (size + workers - 1) / workers
+	q.wg.Add(workers)
+	for i := range q.chs {
+		q.chs[i] = make(chan queuedObservation, per)
+		go q.work(q.chs[i])
+	}
+	return q, nil
+}
+
+// maxObserveBatch is the most queued observations a worker observes at once.
+const maxObserveBatch = 128
+
+// work observes queued observations in batches of whatever's queued, so that
+// a backlog is observed with fewer round trips to the universe's locks.
+func (q *ingestQueue) work(ch chan queuedObservation) {
+	defer q.wg.Done()
+	var (
+		batch []queuedObservation
+		obs   []aggregator.Observation
+		spans []*span
+	)
+	for o := range ch {
+		batch = append(batch[:0], o)
+	collect:
+		for len(batch) < maxObserveBatch {
+			select {
+			case o, ok := <-ch:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, o)
+			default:
+				break collect
+			}
+		}
+
+		obs, spans = obs[:0], spans[:0]
+		for _, o := range batch {
+			o.wait.finish(nil)
+			obs = append(obs, o.obs)
+			spans = append(spans, o.sp.child("observe"))
+		}
+		q.observed.add(uint64(len(batch)))
+		begin := time.Now()
+		err := q.in.o.ObserveBatch(obs)
+		share := time.Since(begin) / time.Duration(len(batch)) // each line's share of the batch
+		for i, o := range batch {
+			q.in.t.lineDuration.observe((o.parse + share).Seconds())
+			if q.in.observed(o.logger, o.source, o.obs, o.sp, spans[i], aggregator.BatchErrorAt(err, i)) == nil {
+				q.in.record.record(o.raw)
+			}
+		}
+	}
+}
+
+// push queues an observation, and reports whether it was queued. If it
+// wasn't, because the queue is nil or closed, the caller should observe it
+// directly.
+func (q *ingestQueue) push(o queuedObservation) bool {
+	if q == nil {
+		return false
+	}
+	q.mtx.RLock()
+	defer q.mtx.RUnlock()
+	if q.closed {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(o.obs.Name))
+	ch := q.chs[h.Sum32()%uint32(len(q.chs))]
+	if q.policy == overflowBlock {
+		ch <- o
+		return true
+	}
+	for {
+		select {
+		case ch <- o:
+			return true
+		default:
+		}
+		select {
+		case old := <-ch:
+			old.wait.finish(errQueueFull)
+			q.dropped.add(1)
+			q.in.reject(old.logger, old.sp, old.source, rejectQueueFull, errQueueFull)
+		default:
+		}
+	}
+}
+
+// close waits for the workers to apply every queued observation. Later
+// pushes fail, and are observed directly by the caller.
+func (q *ingestQueue) close() {
+	if q == nil {
+		return
+	}
+	q.mtx.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, ch := range q.chs {
+			close(ch)
+		}
+	}
+	q.mtx.Unlock()
+	q.wg.Wait()
+}
+
+// metrics returns the queue's telemetry.
+func (q *ingestQueue) metrics() []selfMetric {
+	return []selfMetric{
+		q.dropped,
+		q.observed,
+		newSelfGaugeFunc("aggregator_ingest_queue_depth", "Current number of observations in the ingest queue.", nil, func() []selfSample {
+			var n int
+			for _, ch := range q.chs {
+				n += len(ch)
+			}
+			return []selfSample{{value: float64(n)}}
+		}),
+		newSelfGaugeFunc("aggregator_ingest_queue_capacity", "Capacity of the ingest queue.", nil, func() []selfSample {
+			return []selfSample{{value: float64(len(q.chs) * cap(q.chs[0]))}}
+		}),
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestIngestQueue(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	tm := newTelemetry(u)
+	in := newIngester(u, tm, log.NewNopLogger())
+	q, err := newIngestQueue(in, 4, 2, overflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.queue = q
+
+	lines := []string{
+		`{"name":"foo","type":"counter","help":"Total foos."}`,
+		`{"name":"bar","type":"gauge","help":"Current bar."}`,
+	}
+	for i := 0; i < 100; i++ {
+		lines = append(lines, `foo{} 1`, `bar{} `+strings.Repeat("9", i%3+1))
+	}
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join(lines, "\n"))))
+	in.drain(0)
+
+	// Observations of the same metric are applied in order, so the gauge
+	// has the last value.
+	if want, have := normalizeResponse(`
+		# HELP bar Current bar.
+		# TYPE bar gauge
+		bar{} 9.000000
+
+		# HELP foo Total foos.
+		# TYPE foo counter
+		foo{} 100.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+	if want, have := uint64(202), q.observed.value(); want != have {
+		t.Errorf("observed: want %d, have %d", want, have)
+	}
+}
+
+func TestIngestQueueDropOldest(t *testing.T) {
+	o := &gatedObserver{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	u, _ := aggregator.NewUniverse()
+	tm := newTelemetry(u)
+	in := newIngester(o, tm, log.NewNopLogger())
+	q, err := newIngestQueue(in, 1, 1, overflowDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.queue = q
+
+	push := func(line string) {
+		if _, err := in.handleLine(log.NewNopLogger(), "test", identity{}, nil, []byte(line), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	push(`foo{n="1"} 1`)
+	<-o.entered // the worker is stuck on the first observation
+	push(`foo{n="2"} 1`)
+	push(`foo{n="3"} 1`)
+	push(`foo{n="4"} 1`)
+	close(o.release)
+	q.close()
+
+	if want, have := uint64(2), q.dropped.value(); want != have {
+		t.Errorf("dropped: want %d, have %d", want, have)
+	}
+	if want, have := uint64(2), tm.linesRejected.value(rejectQueueFull); want != have {
+		t.Errorf("rejected: want %d, have %d", want, have)
+	}
+	var have []string
+	for _, obs := range o.observed {
+		have = append(have, obs.Labels["n"])
+	}
+	if want := []string{"1", "4"}; !cmp.Equal(want, have) {
+		t.Errorf("observed: %s", cmp.Diff(want, have))
+	}
+}
+
+// gatedObserver records observations, but signals entered and then waits for
+// release to be closed before returning.
+type gatedObserver struct {
+	entered  chan struct{}
+	release  chan struct{}
+	observed []aggregator.Observation // only accessed by the single worker, and after close
+}
+
+func (o *gatedObserver) Observe(obs aggregator.Observation) error {
+	o.observed = append(o.observed, obs)
+	select {
+	case o.entered <- struct{}{}:
+	default:
+	}
+	<-o.release
+	return nil
+}
+
+func (o *gatedObserver) ObserveBatch(obs []aggregator.Observation) error {
+	return aggregator.ObserveEach(o, obs)
+}
@@ -0,0 +1,191 @@
+//go:build quic
+// +build quic
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/quic"
+)
+
+// quicALPN is the application protocol that QUIC senders must negotiate.
+const quicALPN = "prometheus-aggregator"
+
+// quicCloseTimeout is how long closing a stream waits for the sender to
+// acknowledge the replies written to it.
+const quicCloseTimeout = time.Second
+
+// quicListener accepts the streams of QUIC connections, each as if it were a
+// TCP connection, so that senders on lossy links get retransmission and
+// congestion control, without a lost packet holding up the lines of every
+// other stream. It's experimental.
+type quicListener struct {
+	ep      *quic.Endpoint
+	streams chan net.Conn
+	ctx     context.Context // done once the listener is closed
+	cancel  context.CancelFunc
+}
+
+func listenQUIC(address string, tlsConfig *tls.Config) (*quicListener, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = []string{quicALPN}
+	ep, err := quic.Listen("udp", address, &quic.Config{TLSConfig: tlsConfig})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &quicListener{ep: ep, streams: make(chan net.Conn), ctx: ctx, cancel: cancel}
+	go l.acceptConns()
+	return l, nil
+}
+
+func (l *quicListener) acceptConns() {
+	for {
+		conn, err := l.ep.Accept(l.ctx)
+		if err != nil {
+			return
+		}
+		go l.acceptStreams(conn)
+	}
+}
+
+func (l *quicListener) acceptStreams(conn *quic.Conn) {
+	for {
+		s, err := conn.AcceptStream(l.ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- &quicStream{Stream: s, conn: conn}:
+		case <-l.ctx.Done():
+			s.CloseRead()
+			return
+		}
+	}
+}
+
+// Accept returns the next stream opened by a sender.
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.streams:
+		return c, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting streams. Streams already accepted stay open, so they
+// can be drained, until shutdown.
+func (l *quicListener) Close() error {
+	l.cancel()
+	return nil
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return quicAddr(l.ep.LocalAddr())
+}
+
+// shutdown closes every connection, once the listener is closed and its
+// streams are drained.
+func (l *quicListener) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), quicCloseTimeout)
+	defer cancel()
+	return l.ep.Close(ctx)
+}
+
+// quicStream is a QUIC stream as a net.Conn. Replies to a unidirectional
+// stream, which can't be written to, are discarded. Reads can have deadlines,
+// but writes can't.
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+
+	mtx      sync.Mutex
+	deadline time.Time
+	cancel   context.CancelFunc // of the read in progress, if any
+	timer    *time.Timer        // cancels the read in progress at the deadline
+}
+
+func (s *quicStream) Read(p []byte) (int, error) {
+	s.mtx.Lock()
+	if !s.deadline.IsZero() && !time.Now().Before(s.deadline) {
+		s.mtx.Unlock()
+		return 0, os.ErrDeadlineExceeded
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.arm()
+	s.mtx.Unlock()
+
+	s.Stream.SetReadContext(ctx)
+	n, err := s.Stream.Read(p)
+
+	s.mtx.Lock()
+	s.cancel = nil
+	s.arm()
+	s.mtx.Unlock()
+	if err != nil && ctx.Err() != nil {
+		err = os.ErrDeadlineExceeded
+	}
+	cancel()
+	return n, err
+}
+
+// arm schedules the read in progress, if any, to be cancelled at the
+// deadline, if any. It must be called with the mutex held.
+func (s *quicStream) arm() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.cancel != nil && !s.deadline.IsZero() {
+		s.timer = time.AfterFunc(time.Until(s.deadline), s.cancel)
+	}
+}
+
+func (s *quicStream) Write(p []byte) (int, error) {
+	if s.IsReadOnly() {
+		return len(p), nil
+	}
+	n, err := s.Stream.Write(p)
+	if err == nil {
+		s.Stream.Flush()
+	}
+	return n, err
+}
+
+func (s *quicStream) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), quicCloseTimeout)
+	defer cancel()
+	s.Stream.SetWriteContext(ctx)
+	return s.Stream.Close()
+}
+
+func (s *quicStream) LocalAddr() net.Addr  { return quicAddr(s.conn.LocalAddr()) }
+func (s *quicStream) RemoteAddr() net.Addr { return quicAddr(s.conn.RemoteAddr()) }
+
+func (s *quicStream) SetDeadline(t time.Time) error { return s.SetReadDeadline(t) }
+
+func (s *quicStream) SetReadDeadline(t time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.deadline = t
+	s.arm()
+	return nil
+}
+
+func (s *quicStream) SetWriteDeadline(time.Time) error { return nil }
+
+// quicAddr returns addr as a UDP address, with IPv4 addresses in their 4-byte
+// form, as they'd be from a UDP socket.
+func quicAddr(addr netip.AddrPort) net.Addr {
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()))
+}
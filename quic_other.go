@@ -0,0 +1,24 @@
+//go:build !quic
+// +build !quic
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// errQUICUnsupported is returned by listenQUIC in builds without the quic
+// tag, which leave out golang.org/x/net/quic.
+var errQUICUnsupported = errors.New("QUIC isn't supported by this build; build with -tags quic")
+
+// quicListener is never listening without the quic tag.
+type quicListener struct{ net.Listener }
+
+func listenQUIC(string, *tls.Config) (*quicListener, error) {
+	return nil, errQUICUnsupported
+}
+
+func (l *quicListener) shutdown() error { return nil }
@@ -0,0 +1,103 @@
+//go:build quic
+// +build quic
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"golang.org/x/net/quic"
+)
+
+func TestQUICListener(t *testing.T) {
+	// Borrow the test server's certificate, for 127.0.0.1.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	ln, err := listenQUIC("127.0.0.1:0", &tls.Config{Certificates: srv.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.shutdown()
+
+	var (
+		dst, _ = aggregator.NewUniverse()
+		in     = newIngester(dst, newTelemetry(dst), log.NewNopLogger())
+	)
+	in.ack = true
+	go in.forwardListener(ln)
+
+	client, err := quic.Listen("udp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := client.Dial(ctx, "udp", ln.Addr().String(), &quic.Config{TLSConfig: &tls.Config{
+		RootCAs:    roots,
+		NextProtos: []string{quicALPN},
+		MinVersion: tls.VersionTLS13,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Each stream is read like a TCP connection, and replied to on -tcp.ack.
+	// The first is left open.
+	for i, line := range []string{
+		`{"name":"foo","type":"counter","help":"Total foos."}`,
+		`foo{} 2`,
+	} {
+		s, err := conn.NewStream(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetReadContext(ctx)
+		fmt.Fprintln(s, line)
+		s.Flush()
+		reply, err := bufio.NewReader(s).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := "+OK foo\n", reply; want != have {
+			t.Fatalf("%s: want %q, have %q", line, want, have)
+		}
+		if i > 0 {
+			s.Close()
+		}
+	}
+	if want, have := normalizeResponse(`
+		# HELP foo Total foos.
+		# TYPE foo counter
+		foo{} 2.000000
+	`), normalizeResponse(scrape(t, dst)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	// Without the drain, reads from the open stream would never return.
+	ln.Close()
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		in.drain(50 * time.Millisecond)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain didn't return")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimits are in lines or bytes per second. Zero means unlimited.
+type rateLimits struct {
+	SourceLines float64
+	SourceBytes float64
+	Lines       float64
+}
+
+// rateLimiter limits the rate of lines and bytes accepted from each source,
+// and the rate of lines accepted overall, so that a single runaway sender
+// can't starve the others. Each limit is a token bucket that holds one
+// second's worth of tokens, so short bursts are tolerated.
+type rateLimiter struct {
+	max     int // sources to track before evicting idle ones
+	maxLine int // byte buckets hold at least this much, so any line fits
+	now     func() time.Time
+	active  int32 // atomic, whether any limit is set, so unlimited is lock-free
+
+	mtx     sync.Mutex
+	limits  rateLimits
+	global  tokenBucket
+	sources map[string]*sourceBuckets
+}
+
+type sourceBuckets struct {
+	lines, bytes tokenBucket
+}
+
+func newRateLimiter(limits rateLimits, max int) *rateLimiter {
+	l := &rateLimiter{
+		max:     max,
+		maxLine: defaultMaxLineBytes,
+		now:     time.Now,
+		sources: map[string]*sourceBuckets{},
+	}
+	l.set(limits)
+	return l
+}
+
+func (l *rateLimiter) current() rateLimits {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.limits
+}
+
+// set changes the limits. Existing buckets keep their current tokens.
+func (l *rateLimiter) set(limits rateLimits) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.limits = limits
+	var active int32
+	if limits != (rateLimits{}) {
+		active = 1
+	}
+	atomic.StoreInt32(&l.active, active)
+}
+
+// allow reports whether a line of n bytes from source is within the limits,
+// and if so, takes it out of the relevant buckets.
+func (l *rateLimiter) allow(source string, n int) bool {
+	if l == nil || atomic.LoadInt32(&l.active) == 0 {
+		return true
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	b := l.get(source, now)
+	var (
+		lineBurst = math.Max(l.limits.SourceLines, 1)
+		byteBurst = math.Max(l.limits.SourceBytes, float64(l.maxLine))
+		allLines  = math.Max(l.limits.Lines, 1)
+	)
+	b.lines.refill(now, l.limits.SourceLines, lineBurst)
+	b.bytes.refill(now, l.limits.SourceBytes, byteBurst)
+	l.global.refill(now, l.limits.Lines, allLines)
+	if !b.lines.has(l.limits.SourceLines, 1) ||
+		!b.bytes.has(l.limits.SourceBytes, float64(n)) ||
+		!l.global.has(l.limits.Lines, 1) {
+		return false
+	}
+	b.lines.take(l.limits.SourceLines, 1)
+	b.bytes.take(l.limits.SourceBytes, float64(n))
+	l.global.take(l.limits.Lines, 1)
+	return true
+}
+
+// get returns the buckets for source. If max sources are already tracked,
+// sources whose buckets have refilled completely are evicted, as they're
+// indistinguishable from new ones. If that doesn't free up space, the source
+// shares the overflow source's buckets.
+func (l *rateLimiter) get(source string, now time.Time) *sourceBuckets {
+	if b, ok := l.sources[source]; ok {
+		return b
+	}
+	if len(l.sources) >= l.max {
+		for s, b := range l.sources {
+			if b.lines.full(now, l.limits.SourceLines) && b.bytes.full(now, l.limits.SourceBytes) {
+				delete(l.sources, s)
+			}
+		}
+	}
+	if len(l.sources) >= l.max {
+		source = sourceOverflow
+		if b, ok := l.sources[source]; ok {
+			return b
+		}
+	}
+	b := &sourceBuckets{
+		lines: tokenBucket{tokens: math.Max(l.limits.SourceLines, 1), last: now},
+		bytes: tokenBucket{tokens: math.Max(l.limits.SourceBytes, float64(l.maxLine)), last: now},
+	}
+	l.sources[source] = b
+	return b
+}
+
+// tokenBucket is a token bucket without its rate and burst, which are passed
+// to each method, so that limits can be changed without resetting buckets.
+// A zero rate is unlimited.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if rate <= 0 {
+		return
+	}
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	} else {
+		b.tokens = burst
+	}
+	b.tokens = math.Min(b.tokens, burst)
+	b.last = now
+}
+
+func (b *tokenBucket) has(rate, n float64) bool {
+	return rate <= 0 || b.tokens >= n
+}
+
+func (b *tokenBucket) take(rate, n float64) {
+	if rate > 0 {
+		b.tokens -= n
+	}
+}
+
+func (b *tokenBucket) full(now time.Time, rate float64) bool {
+	return rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*rate >= rate
+}
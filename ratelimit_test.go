@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	allowed := func(l *rateLimiter, source string, lines, size int) (n int) {
+		for i := 0; i < lines; i++ {
+			if l.allow(source, size) {
+				n++
+			}
+		}
+		return n
+	}
+
+	for name, testcase := range map[string]struct {
+		limits  rateLimits
+		sources []string
+		lines   int
+		size    int
+		want    int // per source
+	}{
+		"unlimited":       {rateLimits{}, []string{"a"}, 100, 10, 100},
+		"source lines":    {rateLimits{SourceLines: 10}, []string{"a", "b"}, 100, 10, 10},
+		"source bytes":    {rateLimits{SourceBytes: 100000}, []string{"a", "b"}, 100, 10000, 10},
+		"global lines":    {rateLimits{Lines: 10}, []string{"a", "b"}, 100, 10, 5},
+		"lines and bytes": {rateLimits{SourceLines: 5, SourceBytes: 100000}, []string{"a"}, 100, 10000, 5},
+	} {
+		t.Run(name, func(t *testing.T) {
+			l := newRateLimiter(testcase.limits, defaultMaxSources)
+			l.now = func() time.Time { return now }
+			have := map[string]int{}
+			for i := 0; i < testcase.lines; i++ {
+				for _, s := range testcase.sources {
+					have[s] += allowed(l, s, 1, testcase.size)
+				}
+			}
+			for _, s := range testcase.sources {
+				if want := testcase.want; want != have[s] {
+					t.Errorf("source %s: want %d, have %d", s, want, have[s])
+				}
+			}
+		})
+	}
+
+	t.Run("refill", func(t *testing.T) {
+		now := now
+		l := newRateLimiter(rateLimits{SourceLines: 10}, defaultMaxSources)
+		l.now = func() time.Time { return now }
+		if want, have := 10, allowed(l, "a", 20, 1); want != have {
+			t.Fatalf("initial burst: want %d, have %d", want, have)
+		}
+		now = now.Add(500 * time.Millisecond)
+		if want, have := 5, allowed(l, "a", 20, 1); want != have {
+			t.Fatalf("after 500ms: want %d, have %d", want, have)
+		}
+		l.set(rateLimits{})
+		if want, have := 20, allowed(l, "a", 20, 1); want != have {
+			t.Fatalf("after removing limits: want %d, have %d", want, have)
+		}
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		now := now
+		l := newRateLimiter(rateLimits{SourceLines: 1}, 2)
+		l.now = func() time.Time { return now }
+		allowed(l, "a", 1, 1)
+		allowed(l, "b", 1, 1)
+		if want, have := 1, allowed(l, "c", 2, 1); want != have {
+			t.Fatalf("overflow source: want %d, have %d", want, have)
+		}
+		if want, have := 0, allowed(l, "d", 1, 1); want != have {
+			t.Fatalf("second overflow source shares bucket: want %d, have %d", want, have)
+		}
+		now = now.Add(time.Second)
+		if want, have := 1, allowed(l, "d", 1, 1); want != have {
+			t.Fatalf("after idle sources are evicted: want %d, have %d", want, have)
+		}
+	})
+}
+
+func TestIngestRateLimit(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	tm := newTelemetry(u)
+	in := newIngester(u, tm, log.NewNopLogger())
+	in.limiter = newRateLimiter(rateLimits{SourceLines: 3}, defaultMaxSources)
+
+	lines := []string{`{"name":"foo","type":"counter","help":"Total foos."}`}
+	for i := 0; i < 5; i++ {
+		lines = append(lines, `foo{} 1`)
+	}
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join(lines, "\n"))))
+
+	if want, have := uint64(3), tm.linesRejected.value(rejectRateLimit); want != have {
+		t.Errorf("rejected: want %d, have %d", want, have)
+	}
+	if want, have := normalizeResponse(`
+		# HELP foo Total foos.
+		# TYPE foo counter
+		foo{} 2.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// recorder appends every accepted line to a file, with the time it was
+// received, so that traffic can be replayed later. Each record is the time in
+// RFC 3339 format, a space, and the line, after decompression. A nil recorder
+// records nothing.
+type recorder struct {
+	mtx sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+}
+
+// recordedLine is a copy of a line, and the time it was received, kept until
+// it's accepted.
+type recordedLine struct {
+	at   time.Time
+	line []byte
+}
+
+// recordFlushEvery is how often recorded lines are flushed to the file.
+const recordFlushEvery = time.Second
+
+func newRecorder(filename string) (*recorder, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// capture copies a line that may be recorded once it's accepted. The line is
+// only copied if the recorder isn't nil.
+func (r *recorder) capture(line []byte) recordedLine {
+	if r == nil {
+		return recordedLine{}
+	}
+	return recordedLine{at: time.Now(), line: append([]byte(nil), line...)}
+}
+
+// record appends a captured line to the file.
+func (r *recorder) record(l recordedLine) {
+	if r == nil || l.line == nil {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	var ts [64]byte
+	r.w.Write(l.at.UTC().AppendFormat(ts[:0], time.RFC3339Nano))
+	r.w.WriteByte(' ')
+	r.w.Write(l.line)
+	r.w.WriteByte('\n')
+}
+
+// flush writes buffered records to the file. Write errors are sticky, so
+// they're reported by every later flush.
+func (r *recorder) flush() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.w.Flush()
+}
+
+// run flushes periodically until ctx is canceled, and then closes the file.
+func (r *recorder) run(ctx context.Context, logger log.Logger) error {
+	ticker := time.NewTicker(recordFlushEvery)
+	defer ticker.Stop()
+	var failed bool
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.flush(); err != nil && !failed {
+				level.Error(logger).Log("record", "write failed", "err", err)
+				failed = true
+			}
+		case <-ctx.Done():
+			err := r.flush()
+			if cerr := r.f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				level.Error(logger).Log("record", "close failed", "err", err)
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// readRecord parses a record written by a recorder.
+func readRecord(p []byte) (recordedLine, error) {
+	x := bytes.IndexByte(p, ' ')
+	if x < 0 {
+		return recordedLine{}, errors.New("bad record: couldn't find space")
+	}
+	at, err := time.Parse(time.RFC3339Nano, string(p[:x]))
+	if err != nil {
+		return recordedLine{}, errors.Wrap(err, "bad record timestamp")
+	}
+	return recordedLine{at: at, line: p[x+1:]}, nil
+}
+
+// readRecords calls fn with each record in r, which is only valid until the
+// next call.
+func readRecords(r io.Reader, fn func(recordedLine) error) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 16*defaultMaxLineBytes)
+	for n := 1; s.Scan(); n++ {
+		l, err := readRecord(s.Bytes())
+		if err != nil {
+			return errors.Wrapf(err, "line %d", n)
+		}
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestRecordReplay(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "record.log")
+	r, err := newRecorder(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := aggregator.NewUniverse()
+	in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+	in.record = r
+	lines := []string{
+		`{"name":"foo","type":"counter","help":"Total foos."}`,
+		`foo{code="200"} 1`,
+		`foo{code="200"`, // rejected
+		`bar{} 1`,        // rejected, undeclared
+		`foo{code="500"} 2`,
+	}
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join(lines, "\n"))))
+	if err := r.flush(); err != nil {
+		t.Fatal(err)
+	}
+	r.f.Close()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var have []string
+	if err := readRecords(f, func(l recordedLine) error {
+		if time.Since(l.at) > time.Minute {
+			t.Errorf("%s: bad timestamp %s", l.line, l.at)
+		}
+		have = append(have, string(l.line))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{lines[0], lines[1], lines[4]}; !cmp.Equal(want, have) {
+		t.Fatalf("recorded: %s", cmp.Diff(want, have))
+	}
+
+	// Replay the recording into another aggregator.
+	u2, _ := aggregator.NewUniverse()
+	in2 := newIngester(u2, newTelemetry(u2), log.NewNopLogger())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go in2.forwardListener(ln)
+	f.Seek(0, io.SeekStart)
+	c := replayConfig{network: "tcp", address: ln.Addr().String(), pace: true, speed: 1000}
+	n, err := c.replay(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	in2.drain(time.Second)
+	if want, have := 3, n; want != have {
+		t.Errorf("replayed: want %d, have %d", want, have)
+	}
+	if want, have := scrape(t, u), scrape(t, u2); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestReadRecords(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		input string
+		err   bool
+	}{
+		"empty":          {"", false},
+		"valid":          {"2026-01-02T03:04:05.000000006Z foo{} 1\n", false},
+		"no space":       {"2026-01-02T03:04:05Z\n", true},
+		"bad timestamp":  {"yesterday foo{} 1\n", true},
+		"line has space": {"2026-01-02T03:04:05Z foo{a=\"b\"} 1 \n", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := readRecords(bytes.NewReader([]byte(testcase.input)), func(recordedLine) error { return nil })
+			if want, have := testcase.err, err != nil; want != have {
+				t.Fatalf("err: want %v, have %v (%v)", want, have, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// rejectLogger logs rejected lines. Logging every rejection can overwhelm
+// the logger when a client sends lots of bad data, so at most sample
+// rejections are logged individually per interval, and the aggregate counts
+// per reason and source are logged at the end of each interval.
+type rejectLogger struct {
+	logger log.Logger
+	sample int
+
+	mtx    sync.Mutex
+	logged int
+	counts map[rejectKey]uint64
+}
+
+type rejectKey struct{ reason, source string }
+
+// defaultRejectSample is the default number of rejected lines to log
+// individually per interval.
+const defaultRejectSample = 10
+
+func newRejectLogger(logger log.Logger, sample int) *rejectLogger {
+	return &rejectLogger{
+		logger: logger,
+		sample: sample,
+		counts: map[rejectKey]uint64{},
+	}
+}
+
+func (l *rejectLogger) setSample(sample int) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.sample = sample
+}
+
+// reject records a rejected line, and logs it to logger if it's sampled,
+// which it returns.
+func (l *rejectLogger) reject(logger log.Logger, source, reason string, err error) (sampled bool) {
+	l.mtx.Lock()
+	l.counts[rejectKey{reason, source}]++
+	sampled = l.logged < l.sample
+	if sampled {
+		l.logged++
+	}
+	l.mtx.Unlock()
+
+	if sampled {
+		level.Error(logger).Log("line", "rejected", "reason", reason, "err", err)
+	}
+	return sampled
+}
+
+// flush logs the aggregate counts since the last flush, and resets them.
+func (l *rejectLogger) flush() {
+	l.mtx.Lock()
+	counts := l.counts
+	l.counts = map[rejectKey]uint64{}
+	l.logged = 0
+	l.mtx.Unlock()
+
+	keys := make([]rejectKey, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].reason != keys[j].reason {
+			return keys[i].reason < keys[j].reason
+		}
+		return keys[i].source < keys[j].source
+	})
+	for _, k := range keys {
+		level.Warn(l.logger).Log("lines", "rejected", "reason", k.reason, "source", k.source, "count", counts[k])
+	}
+}
+
+// run flushes every interval until the context is canceled.
+func (l *rejectLogger) run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.flush()
+		case <-ctx.Done():
+			l.flush()
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestRejectLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.NewLogfmtLogger(&buf)
+	l := newRejectLogger(logger, 2)
+
+	for i := 0; i < 5; i++ {
+		l.reject(logger, "10.0.0.1", rejectParse, errors.New("bad"))
+	}
+	l.reject(logger, "10.0.0.2", rejectObserve, errors.New("worse"))
+	l.flush()
+	l.reject(logger, "10.0.0.1", rejectParse, errors.New("again"))
+	l.flush()
+
+	want := strings.Join([]string{
+		`level=error line=rejected reason=parse err=bad`,
+		`level=error line=rejected reason=parse err=bad`,
+		`level=warn lines=rejected reason=observe source=10.0.0.2 count=1`,
+		`level=warn lines=rejected reason=parse source=10.0.0.1 count=5`,
+		`level=error line=rejected reason=parse err=again`,
+		`level=warn lines=rejected reason=parse source=10.0.0.1 count=1`,
+	}, "\n") + "\n"
+	if have := buf.String(); want != have {
+		t.Fatalf("want\n%s\nhave\n%s", want, have)
+	}
+}
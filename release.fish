@@ -27,7 +27,7 @@ for pair in linux/amd64 darwin/amd64
 	set BIN    $DISTDIR/$FNAME
 	set TGZ    $DISTDIR/$FNAME.tar.gz
 	echo $BIN
-	env GOOS=$GOOS GOARCH=$GOARCH go build -o $BIN -ldflags="-X main.version=$VERSION" github.com/peterbourgon/prometheus-aggregator
+	env GOOS=$GOOS GOARCH=$GOARCH go build -o $BIN -ldflags="-X main.version=$VERSION -X main.revision=$REV" github.com/peterbourgon/prometheus-aggregator
 	tar -C $DISTDIR -c -z -v -f $TGZ $FNAME
 	rm $BIN
 end
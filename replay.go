@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// replayConfig describes how the replay subcommand re-sends recorded lines.
+type replayConfig struct {
+	network, address string
+	pace             bool    // wait between lines as long as when they were recorded
+	speed            float64 // with pace, divides the waits
+}
+
+// runReplay implements the replay subcommand, and returns the exit code.
+func runReplay(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var (
+		target = fs.String("target", "tcp://127.0.0.1:8191", "socket address of the aggregator to replay to")
+		pace   = fs.Bool("pace", false, "send lines at the pace they were recorded, rather than as fast as possible")
+		speed  = fs.Float64("speed", 1, "with -pace, speed up (or slow down) the recorded pace by this factor")
+	)
+	fs.Usage = usageFor(fs, "prometheus-aggregator replay [flags] <file>")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 1
+	}
+
+	c := replayConfig{pace: *pace, speed: *speed}
+	var err error
+	if c.network, c.address, err = parseTarget(*target); err != nil {
+		fmt.Fprintf(stdout, "-target: %v\n", err)
+		return 1
+	}
+	if c.speed <= 0 {
+		fmt.Fprintf(stdout, "-speed: must be positive\n")
+		return 1
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stdout, "replay: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	begin := time.Now()
+	n, err := c.replay(context.Background(), f)
+	fmt.Fprintf(stdout, "replayed %d lines in %s\n", n, time.Since(begin).Round(time.Millisecond))
+	if err != nil {
+		fmt.Fprintf(stdout, "replay: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// replay sends each recorded line in r, and returns the number sent.
+func (c replayConfig) replay(ctx context.Context, r io.Reader) (int, error) {
+	conn, err := net.Dial(c.network, c.address)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var (
+		w       = bufio.NewWriter(conn)
+		packets = isPacketNetwork(c.network)
+		n       int
+		first   time.Time
+		begin   = time.Now()
+	)
+	err = readRecords(r, func(l recordedLine) error {
+		if c.pace {
+			if first.IsZero() {
+				first = l.at
+			}
+			offset := time.Duration(float64(l.at.Sub(first)) / c.speed)
+			if wait := time.Until(begin.Add(offset)); wait > 0 {
+				if err := w.Flush(); err != nil {
+					return err
+				}
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		var err error
+		if packets {
+			_, err = conn.Write(l.line)
+		} else if _, err = w.Write(l.line); err == nil {
+			err = w.WriteByte('\n')
+		}
+		if err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	return n, err
+}
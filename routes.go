@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"github.com/pkg/errors"
+)
+
+// routeRule is a route from the routes section of the config file, which
+// observes the observations whose name and labels match in a universe of its
+// own, scraped separately, e.g. to keep debug metrics apart, with a short TTL.
+type routeRule struct {
+	Name        string            `yaml:"name"`         // scraped with ?route=
+	Match       string            `yaml:"match"`        // regexp on the name; empty matches every name
+	MatchLabels map[string]string `yaml:"match_labels"` // regexps on label values; a missing label is ""
+	TTL         string            `yaml:"ttl"`          // overrides -series.ttl; "0" keeps series forever
+}
+
+// route is a compiled routeRule, with its universe.
+type route struct {
+	routeRule
+	name   *regexp.Regexp
+	labels map[string]*regexp.Regexp
+	ttl    *time.Duration // nil for -series.ttl
+	u      *aggregator.Universe
+}
+
+// compileRoutes validates and compiles rules. As with transforms, regexps
+// are anchored at both ends.
+func compileRoutes(rules []routeRule) ([]*route, error) {
+	routes := make([]*route, len(rules))
+	seen := map[string]bool{}
+	for i, r := range rules {
+		x := &route{routeRule: r, labels: map[string]*regexp.Regexp{}}
+		if r.Name == "" {
+			return nil, fmt.Errorf("routes: %d: name is required", i)
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("routes: %d: name %q is used more than once", i, r.Name)
+		}
+		seen[r.Name] = true
+		match := r.Match
+		if match == "" {
+			match = ".*"
+		}
+		var err error
+		if x.name, err = compileAnchored(match); err != nil {
+			return nil, errors.Wrapf(err, "routes: %s: match", r.Name)
+		}
+		for name, expr := range r.MatchLabels {
+			if x.labels[name], err = compileAnchored(expr); err != nil {
+				return nil, errors.Wrapf(err, "routes: %s: match_labels: %s", r.Name, name)
+			}
+		}
+		if r.Match == "" && len(r.MatchLabels) == 0 {
+			return nil, fmt.Errorf("routes: %s: match or match_labels is required", r.Name)
+		}
+		if r.TTL != "" {
+			ttl, err := time.ParseDuration(r.TTL)
+			if err != nil {
+				return nil, errors.Wrapf(err, "routes: %s: ttl", r.Name)
+			}
+			if ttl < 0 {
+				return nil, fmt.Errorf("routes: %s: ttl can't be negative", r.Name)
+			}
+			x.ttl = &ttl
+		}
+		routes[i] = x
+	}
+	return routes, nil
+}
+
+func (x *route) match(o aggregator.Observation) bool {
+	if !x.name.MatchString(o.Name) {
+		return false
+	}
+	for name, re := range x.labels {
+		if !re.MatchString(o.Labels[name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// routeRouter is an Observer that observes each observation in the universe
+// of every route it matches, and those that match none in next. Declarations
+// are observed, or declared, in next, and, if they're accepted, in every
+// route's universe, which is created with the initial declarations, so that
+// every route accepts the same metrics.
+type routeRouter struct {
+	next   routeNext
+	routes []*route
+	routed *selfCounter
+}
+
+// routeNext is what a route router observes and declares in, besides the
+// universes of its routes: the default universe, or the tenant router.
+type routeNext interface {
+	aggregator.Observer
+	declarer
+}
+
+func newRouteRouter(rules []routeRule, next routeNext, initial []aggregator.Observation, newUniverse func([]aggregator.Observation) (*aggregator.Universe, error)) (*routeRouter, error) {
+	routes, err := compileRoutes(rules)
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range routes {
+		if x.u, err = newUniverse(initial); err != nil {
+			return nil, errors.Wrapf(err, "routes: %s", x.Name)
+		}
+	}
+	return &routeRouter{
+		next:   next,
+		routes: routes,
+		routed: newSelfCounter("aggregator_routed_observations_total", "Total number of observations observed in the universe of a route, by route.", "route"),
+	}, nil
+}
+
+// Observe implements aggregator.Observer. An observation that matches
+// several routes fails if any of them rejects it.
+func (r *routeRouter) Observe(o aggregator.Observation) error {
+	if o.Value == nil {
+		return r.declare(o)
+	}
+	var (
+		routed bool
+		first  error
+	)
+	for _, x := range r.routes {
+		if !x.match(o) {
+			continue
+		}
+		routed = true
+		r.routed.add(1, x.Name)
+		if err := x.u.Observe(o); err != nil && first == nil {
+			first = err
+		}
+	}
+	if !routed {
+		return r.next.Observe(o)
+	}
+	return first
+}
+
+// ObserveBatch implements aggregator.Observer.
+func (r *routeRouter) ObserveBatch(obs []aggregator.Observation) error {
+	return aggregator.ObserveEach(r, obs)
+}
+
+// declare observes a declaration in next, and, if it's accepted, in every
+// route's universe, where it's expected to be accepted too. If a route's
+// universe rejects it, the first such error is returned.
+func (r *routeRouter) declare(o aggregator.Observation) error {
+	if err := r.next.Observe(o); err != nil {
+		return err
+	}
+	var first error
+	for _, x := range r.routes {
+		if err := x.u.Observe(o); err != nil && first == nil {
+			first = errors.Wrapf(err, "route %s", x.Name)
+		}
+	}
+	return first
+}
+
+// Declare implements declarer, declaring o in next, and, if it's accepted, in
+// every route's universe, as declare observes it. It reports whether o was
+// added to next.
+func (r *routeRouter) Declare(o aggregator.Observation) (bool, error) {
+	added, err := r.next.Declare(o)
+	if err != nil {
+		return false, err
+	}
+	var first error
+	for _, x := range r.routes {
+		if _, err := x.u.Declare(o); err != nil && first == nil {
+			first = errors.Wrapf(err, "route %s", x.Name)
+		}
+	}
+	return added, first
+}
+
+// lookup returns the universe of the named route, if there is one.
+func (r *routeRouter) lookup(name string) (*aggregator.Universe, bool) {
+	for _, x := range r.routes {
+		if x.Name == name {
+			return x.u, true
+		}
+	}
+	return nil, false
+}
+
+// expire expires the series of every route's universe, as in Universe.Expire,
+// with the route's TTL, if it has one, returning the number expired. Series
+// over the memory limit, which routes share with the default universe, are
+// evicted by the default universe.
+func (r *routeRouter) expire(now time.Time, defaultTTL time.Duration) int {
+	var expired int
+	for _, x := range r.routes {
+		ttl := defaultTTL
+		if x.ttl != nil {
+			ttl = *x.ttl
+		}
+		expired += x.u.Expire(now, ttl)
+	}
+	return expired
+}
+
+// metrics returns the route router's self-telemetry.
+func (r *routeRouter) metrics() []selfMetric {
+	return []selfMetric{r.routed}
+}
+
+// routeHandler serves the route's universe for scrapes with a route query
+// parameter, e.g. /metrics?route=debug, and otherwise next. As with tenants,
+// a route's universe is served without the aggregator's self-telemetry, and
+// only by the leader.
+func routeHandler(r *routeRouter, leader *leaseElector, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Query().Get("route")
+		if name == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		u, ok := r.lookup(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown route %q", name), http.StatusNotFound)
+			return
+		}
+		serveUniverse(w, req, u, leader)
+	})
+}
+
+// routeSnapshotHandler serves the snapshot of the route's universe, as
+// snapshotHandler, for requests with a route query parameter, and otherwise
+// next.
+func routeSnapshotHandler(r *routeRouter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Query().Get("route")
+		if name == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		u, ok := r.lookup(name)
+		if !ok {
+			respondError(w, http.StatusNotFound, fmt.Sprintf("unknown route %q", name))
+			return
+		}
+		snapshotHandler(u).ServeHTTP(w, req)
+	})
+}
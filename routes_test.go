@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestRouteRouter(t *testing.T) {
+	c, err := loadConfig(writeConfig(t, `
+routes:
+  - name: billing
+    match: billing_.*
+    ttl: "0"
+  - name: debug
+    match: debug_.*|.*_debug
+    ttl: 1m
+  - name: eu
+    match_labels:
+      region: eu-.*
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial := []aggregator.Observation{{Name: "billing_invoices_total", Type: "counter", Help: "Invoices."}}
+	u, _ := aggregator.NewUniverse(initial...)
+	r, err := newRouteRouter(c.Routes, u, initial, func(decls []aggregator.Observation) (*aggregator.Universe, error) {
+		return aggregator.NewUniverse(decls...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newIngester(r, newTelemetry(u), log.NewNopLogger())
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`{"name":"debug_queue_debug","type":"gauge","help":"Queue."}`,
+		`{"name":"requests_total","type":"counter","help":"Requests."}`,
+		`billing_invoices_total{region="us-1"} 1`,
+		`billing_invoices_total{region="eu-1"} 2`, // billing and eu
+		`debug_queue_debug{} 3`,
+		`requests_total{region="us-1"} 4`,
+		`requests_total{region="eu-1"} 5`,
+	}, "\n"))))
+	if want, have := uint64(7), in.t.linesAccepted.value(); want != have {
+		t.Errorf("lines accepted: want %d, have %d", want, have)
+	}
+
+	for name, tc := range map[string]struct {
+		route string
+		want  []string
+		not   []string
+		code  int
+	}{
+		"default": {"", []string{`requests_total{region="us-1"} 4`}, []string{"billing_invoices_total{", "debug_queue_debug{", `region="eu-1"`}, http.StatusOK},
+		"billing": {"billing", []string{`billing_invoices_total{region="us-1"} 1`, `billing_invoices_total{region="eu-1"} 2`}, []string{"requests_total{"}, http.StatusOK},
+		"debug":   {"debug", []string{`debug_queue_debug{} 3`}, []string{"billing_invoices_total{"}, http.StatusOK},
+		"eu":      {"eu", []string{`billing_invoices_total{region="eu-1"} 2`, `requests_total{region="eu-1"} 5`}, []string{`region="us-1"`}, http.StatusOK},
+		"unknown": {"staging", nil, nil, http.StatusNotFound},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			routeHandler(r, nil, u).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics?route="+tc.route, nil))
+			if want, have := tc.code, rec.Code; want != have {
+				t.Fatalf("code: want %d, have %d", want, have)
+			}
+			body := rec.Body.String()
+			for _, want := range tc.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("want %s, have\n%s", want, body)
+				}
+			}
+			for _, not := range tc.not {
+				if strings.Contains(body, not) {
+					t.Errorf("want no %s, have\n%s", not, body)
+				}
+			}
+		})
+	}
+	if want, have := uint64(2), r.routed.value("eu"); want != have {
+		t.Errorf("routed to eu: want %d, have %d", want, have)
+	}
+
+	// Only the leader serves routes, like the default universe.
+	rec := httptest.NewRecorder()
+	routeHandler(r, &leaseElector{}, u).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics?route=billing", nil))
+	if body := rec.Body.String(); rec.Code != http.StatusOK || strings.Contains(body, "billing_invoices_total") {
+		t.Errorf("follower: want %d, and no series, have %d\n%s", http.StatusOK, rec.Code, body)
+	}
+
+	// A route's snapshot is of its own universe.
+	for route, want := range map[string]int{"billing": http.StatusOK, "staging": http.StatusNotFound} {
+		rec := httptest.NewRecorder()
+		routeSnapshotHandler(r, snapshotHandler(u)).ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/snapshot?route="+route, nil))
+		if have := rec.Code; want != have {
+			t.Errorf("snapshot of %s: want %d, have %d", route, want, have)
+		}
+		if body := rec.Body.String(); want == http.StatusOK && (!strings.Contains(body, `"us-1"`) || strings.Contains(body, `"series":{"name":"requests_total"`)) {
+			t.Errorf("snapshot of %s: want series of billing_invoices_total only, have\n%s", route, body)
+		}
+	}
+
+	// Each route's series expire with its TTL.
+	now := time.Now()
+	r.expire(now, time.Hour)
+	if expired := r.expire(now.Add(2*time.Minute), time.Hour); expired != 1 {
+		t.Errorf("expired: want 1, have %d", expired)
+	}
+	debug, _ := r.lookup("debug")
+	if _, ok := debug.Lookup("debug_queue_debug", nil); ok {
+		t.Errorf("debug_queue_debug: want expired, have it")
+	}
+}
+
+func TestRouteRouterDeclare(t *testing.T) {
+	filename := writeConfig(t, `
+routes:
+  - name: debug
+    match: debug_.*
+`)
+	c, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := aggregator.NewUniverse()
+	r, err := newRouteRouter(c.Routes, u, nil, func(decls []aggregator.Observation) (*aggregator.Universe, error) {
+		return aggregator.NewUniverse(decls...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Declarations from a reload, and from the API, reach every route.
+	reload := newReloader(filename, c, map[string]bool{}, u, r, newSourceStats(defaultMaxSources), newRejectLogger(log.NewNopLogger(), defaultRejectSample), newRateLimiter(rateLimits{}, defaultMaxSources), newScrapeCache(u, 0), newTransformer(nil), nil, log.NewNopLogger())
+	if err := os.WriteFile(filename, []byte("routes:\n  - name: debug\n    match: debug_.*\ndeclarations:\n  - name: debug_queue\n    type: gauge\n    help: Queue.\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reload.reload(); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	declarationsHandler(u, r, nil).ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/declarations", strings.NewReader(`{"name":"debug_total","type":"counter","help":"Debugs."}`)))
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("declarations: want %d, have %d: %s", want, have, rec.Body)
+	}
+	in := newIngester(r, newTelemetry(u), log.NewNopLogger())
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`debug_queue{} 1`,
+		`debug_total{} 2`,
+	}, "\n"))))
+	if want, have := uint64(2), in.t.linesAccepted.value(); want != have {
+		t.Errorf("lines accepted: want %d, have %d", want, have)
+	}
+	debug, _ := r.lookup("debug")
+	for _, name := range []string{"debug_queue", "debug_total"} {
+		if _, ok := debug.Lookup(name, nil); !ok {
+			t.Errorf("debug: want %s, have none", name)
+		}
+	}
+}
+
+func TestCompileRoutesErrors(t *testing.T) {
+	for name, rules := range map[string][]routeRule{
+		"no name":          {{Match: "foo"}},
+		"same name":        {{Name: "a", Match: "foo"}, {Name: "a", Match: "bar"}},
+		"no match":         {{Name: "a"}},
+		"bad match":        {{Name: "a", Match: "foo("}},
+		"bad match_labels": {{Name: "a", MatchLabels: map[string]string{"env": "["}}},
+		"bad ttl":          {{Name: "a", Match: "foo", TTL: "soon"}},
+		"negative ttl":     {{Name: "a", Match: "foo", TTL: "-1m"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := compileRoutes(rules); err == nil {
+				t.Fatal("want error, have none")
+			}
+		})
+	}
+}
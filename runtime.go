@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"runtime/metrics"
+	"strings"
+)
+
+// registerPprof mounts the net/http/pprof handlers on mux.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// runtimeMetrics exports the scalar metrics from package runtime/metrics,
+// with names derived from the runtime names, e.g. /gc/heap/allocs:bytes
+// becomes go_gc_heap_allocs_bytes_total. Histograms are skipped.
+type runtimeMetrics struct {
+	descs []metrics.Description
+}
+
+func newRuntimeMetrics() *runtimeMetrics {
+	var descs []metrics.Description
+	for _, d := range metrics.All() {
+		switch d.Kind {
+		case metrics.KindUint64, metrics.KindFloat64:
+			descs = append(descs, d)
+		}
+	}
+	return &runtimeMetrics{descs: descs}
+}
+
+func (m *runtimeMetrics) name() string { return "go_" }
+
+func (m *runtimeMetrics) renderText(w io.Writer) {
+	samples := make([]metrics.Sample, len(m.descs))
+	for i, d := range m.descs {
+		samples[i].Name = d.Name
+	}
+	metrics.Read(samples)
+	for i, s := range samples {
+		d := m.descs[i]
+		name, typ := runtimeMetricName(d.Name), "gauge"
+		if d.Cumulative {
+			name, typ = name+"_total", "counter"
+		}
+		renderSelfHeader(w, name, strings.Join(strings.Fields(d.Description), " "), typ)
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			fmt.Fprintf(w, "%s{} %d\n", name, s.Value.Uint64())
+		case metrics.KindFloat64:
+			fmt.Fprintf(w, "%s{} %f\n", name, s.Value.Float64())
+		}
+	}
+}
+
+// runtimeMetricName converts e.g. /gc/heap/allocs:bytes to go_gc_heap_allocs_bytes.
+func runtimeMetricName(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	return "go_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+// scrapeCache renders the wrapped handler at most once per TTL, and serves
+// the cached response to every scrape in between. Concurrent scrapes of an
+// expired cache wait for a single render, rather than each rendering their
+// own copy. A zero TTL disables the cache, and every scrape goes straight to
+// the wrapped handler. Scrapes that allow UTF-8 names, or accept OpenMetrics,
+// get a separate cached response, since they may be rendered differently.
+type scrapeCache struct {
+	next http.Handler
+	now  func() time.Time
+
+	mtx       sync.Mutex
+	ttl       time.Duration
+	responses map[responseFormat]*cachedResponse
+}
+
+// responseFormat is what a scrape accepts, that changes its response.
+type responseFormat struct {
+	utf8, openMetrics bool
+}
+
+type cachedResponse struct {
+	header  http.Header
+	code    int
+	body    []byte
+	expires time.Time
+}
+
+func newScrapeCache(next http.Handler, ttl time.Duration) *scrapeCache {
+	return &scrapeCache{
+		next:      next,
+		ttl:       ttl,
+		now:       time.Now,
+		responses: map[responseFormat]*cachedResponse{},
+	}
+}
+
+// setTTL changes the TTL, and expires the cached response.
+func (c *scrapeCache) setTTL(ttl time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.ttl = ttl
+	c.responses = map[responseFormat]*cachedResponse{}
+}
+
+func (c *scrapeCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mtx.Lock()
+	ttl := c.ttl
+	c.mtx.Unlock()
+	if ttl <= 0 {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	header, code, body := c.render(r)
+	for k, vs := range header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func (c *scrapeCache) render(r *http.Request) (http.Header, int, []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	format := responseFormat{aggregator.AllowsUTF8(r), aggregator.AcceptsOpenMetrics(r)}
+	resp, ok := c.responses[format]
+	if now := c.now(); !ok || now.After(resp.expires) {
+		rec := &bufferedResponseWriter{header: http.Header{}, code: http.StatusOK}
+		c.next.ServeHTTP(rec, r)
+		resp = &cachedResponse{header: rec.header, code: rec.code, body: rec.buf.Bytes(), expires: now.Add(c.ttl)}
+		if r.Context().Err() != nil {
+			return resp.header, resp.code, resp.body // abandoned, so maybe incomplete
+		}
+		c.responses[format] = resp
+	}
+	return resp.header, resp.code, resp.body
+}
+
+// bufferedResponseWriter captures a response in memory.
+type bufferedResponseWriter struct {
+	header http.Header
+	code   int
+	buf    bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header         { return w.header }
+func (w *bufferedResponseWriter) WriteHeader(code int)        { w.code = code }
+func (w *bufferedResponseWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
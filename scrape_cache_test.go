@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestScrapeCache(t *testing.T) {
+	u, _ := aggregator.NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	loadObservations(t, u, makeObservations(t, []string{`foo_total{} 1`}))
+
+	now := time.Unix(1000, 0)
+	c := newScrapeCache(u, 15*time.Second)
+	c.now = func() time.Time { return now }
+
+	first := scrape(t, c)
+
+	loadObservations(t, u, makeObservations(t, []string{`foo_total{} 1`}))
+	now = now.Add(10 * time.Second)
+	if want, have := first, scrape(t, c); want != have {
+		t.Fatalf("within TTL: want cached response\n%s\nhave\n%s", want, have)
+	}
+
+	now = now.Add(10 * time.Second)
+	if want, have := normalizeResponse(`
+		# HELP foo_total Total number of foos.
+		# TYPE foo_total counter
+		foo_total{} 2.000000
+	`), normalizeResponse(scrape(t, c)); want != have {
+		t.Fatalf("after TTL:\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestScrapeCacheHeaders(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	rec := &bufferedResponseWriter{header: http.Header{}}
+	req, _ := http.NewRequest("GET", "/", nil)
+	c := newScrapeCache(u, time.Minute)
+	c.ServeHTTP(rec, req)
+	if want, have := "text/plain; version=0.0.4", rec.header.Get("Content-Type"); want != have {
+		t.Fatalf("Content-Type: want %q, have %q", want, have)
+	}
+
+	// Scrapes that allow UTF-8 names aren't served the cached response.
+	rec = &bufferedResponseWriter{header: http.Header{}}
+	req.Header.Set("Accept", "text/plain;version=1.0.0;escaping=allow-utf-8")
+	c.ServeHTTP(rec, req)
+	if want, have := "text/plain; version=1.0.0; charset=utf-8; escaping=allow-utf-8", rec.header.Get("Content-Type"); want != have {
+		t.Fatalf("UTF-8 Content-Type: want %q, have %q", want, have)
+	}
+}
+
+func TestScrapeCacheDisabled(t *testing.T) {
+	u, _ := aggregator.NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	c := newScrapeCache(u, 0)
+	loadObservations(t, u, makeObservations(t, []string{`foo_total{} 1`}))
+	first := scrape(t, c)
+	loadObservations(t, u, makeObservations(t, []string{`foo_total{} 1`}))
+	if second := scrape(t, c); first == second {
+		t.Fatalf("zero TTL: want fresh response, have cached\n%s", second)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Reasons for answering a scrape with 503, used as label values.
+const (
+	scrapeOverload = "overload"
+	scrapeTimeout  = "timeout"
+)
+
+// scrapeLimiter bounds the number of scrapes that render at once, and how long
+// each may take, so that a stampede of scrapers can't hold the universe's
+// locks long enough to hold up ingest. Scrapes beyond the limit are answered
+// with 503 straight away; scrapes that take longer than the timeout are
+// answered with 503 when it expires, and their render is abandoned. It keeps
+// its slot until the render notices, so a slow render still counts towards
+// the limit. Zero disables either.
+type scrapeLimiter struct {
+	next     http.Handler
+	slots    chan struct{} // nil is unlimited
+	timeout  time.Duration
+	rejected func(reason string)
+}
+
+func newScrapeLimiter(next http.Handler, maxConcurrent int, timeout time.Duration, t *telemetry) http.Handler {
+	if maxConcurrent <= 0 && timeout <= 0 {
+		return next
+	}
+	l := &scrapeLimiter{next: next, timeout: timeout, rejected: func(string) {}}
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+	if t != nil {
+		l.rejected = func(reason string) { t.scrapesRejected.add(1, reason) }
+	}
+	return l
+}
+
+func (l *scrapeLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			l.rejected(scrapeOverload)
+			http.Error(w, "too many concurrent scrapes", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	release := func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+	if l.timeout <= 0 {
+		defer release()
+		l.next.ServeHTTP(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), l.timeout)
+	defer cancel()
+	rec := &bufferedResponseWriter{header: http.Header{}, code: http.StatusOK}
+	done := make(chan struct{})
+	go func() {
+		defer release()
+		defer close(done)
+		l.next.ServeHTTP(rec, r.WithContext(ctx))
+	}()
+	select {
+	case <-done:
+		for k, vs := range rec.header {
+			w.Header()[k] = vs
+		}
+		w.WriteHeader(rec.code)
+		w.Write(rec.buf.Bytes())
+	case <-ctx.Done():
+		if r.Context().Err() != nil {
+			return // client went away
+		}
+		l.rejected(scrapeTimeout)
+		http.Error(w, "scrape timed out", http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestScrapeLimiterOverload(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	var (
+		started = make(chan struct{})
+		finish  = make(chan struct{})
+		next    = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-finish
+			w.Write([]byte("ok"))
+		})
+		tel = newTelemetry(u)
+		l   = newScrapeLimiter(next, 1, 0, tel)
+	)
+
+	first := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		l.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		first <- rec.Code
+	}()
+	<-started
+
+	rec := httptest.NewRecorder()
+	l.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want, have := http.StatusServiceUnavailable, rec.Code; want != have {
+		t.Errorf("over the limit: want %d, have %d", want, have)
+	}
+	if want, have := uint64(1), tel.scrapesRejected.value(scrapeOverload); want != have {
+		t.Errorf("overload: want %d, have %d", want, have)
+	}
+
+	close(finish)
+	if want, have := http.StatusOK, <-first; want != have {
+		t.Errorf("within the limit: want %d, have %d", want, have)
+	}
+	go func() { <-started }()
+	rec = httptest.NewRecorder()
+	l.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Errorf("after the first finished: want %d, have %d", want, have)
+	}
+}
+
+func TestScrapeLimiterTimeout(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	var (
+		abandoned = make(chan struct{})
+		next      = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			close(abandoned)
+		})
+		tel = newTelemetry(u)
+		l   = newScrapeLimiter(next, 1, 10*time.Millisecond, tel)
+	)
+	rec := httptest.NewRecorder()
+	l.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want, have := http.StatusServiceUnavailable, rec.Code; want != have {
+		t.Errorf("want %d, have %d", want, have)
+	}
+	if want, have := uint64(1), tel.scrapesRejected.value(scrapeTimeout); want != have {
+		t.Errorf("timeout: want %d, have %d", want, have)
+	}
+	select {
+	case <-abandoned:
+	case <-time.After(time.Second):
+		t.Fatal("render wasn't abandoned")
+	}
+}
+
+func TestScrapeLimiterPassesThrough(t *testing.T) {
+	u, _ := aggregator.NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	loadObservations(t, u, makeObservations(t, []string{`foo_total{} 1`}))
+	l := newScrapeLimiter(u, 2, time.Minute, nil)
+	if want, have := normalizeResponse(`
+		# HELP foo_total Total number of foos.
+		# TYPE foo_total counter
+		foo_total{} 1.000000
+	`), normalizeResponse(scrape(t, l)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"github.com/pkg/errors"
+)
+
+// sendConfig describes where the send subcommand sends lines.
+type sendConfig struct {
+	network, address string
+	gzip             bool
+	cipher           *aggregator.PacketCipher // nil doesn't encrypt
+}
+
+// runSend implements the send subcommand, and returns the exit code.
+func runSend(args []string, stdin io.Reader, stdout io.Writer) int {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	var (
+		addr = fs.String("addr", "127.0.0.1:8191", "address of the aggregator, as host:port for TCP, or a URL like udp://host:port")
+		gz   = fs.Bool("gzip", false, "compress each datagram (UDP only)")
+		key  = fs.String("key", "", "hex-encoded AES key to encrypt each datagram with (UDP only; default: $"+udpKeyEnv+")")
+	)
+	fs.Usage = usageFor(fs, "prometheus-aggregator send [flags] [<line> ...]")
+	fs.Parse(args)
+
+	c := sendConfig{gzip: *gz}
+	if err := c.setAddr(*addr); err != nil {
+		fmt.Fprintf(stdout, "-addr: %v\n", err)
+		return 1
+	}
+	if c.gzip && !isPacketNetwork(c.network) {
+		fmt.Fprintf(stdout, "-gzip: only supported with UDP, as compressed lines may contain newlines\n")
+		return 1
+	}
+	if *key == "" && isPacketNetwork(c.network) {
+		*key = os.Getenv(udpKeyEnv)
+	}
+	if *key != "" {
+		if !isPacketNetwork(c.network) {
+			fmt.Fprintf(stdout, "-key: only supported with UDP\n")
+			return 1
+		}
+		k, err := aggregator.ParsePacketKey(*key)
+		if err == nil {
+			c.cipher, err = aggregator.NewPacketCipher(k)
+		}
+		if err != nil {
+			fmt.Fprintf(stdout, "-key: %v\n", err)
+			return 1
+		}
+	}
+
+	var r io.Reader = stdin
+	if fs.NArg() > 0 {
+		r = strings.NewReader(strings.Join(fs.Args(), "\n"))
+	}
+	if err := c.send(r); err != nil {
+		fmt.Fprintf(stdout, "send: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// setAddr parses the address, which defaults to TCP without a scheme.
+func (c *sendConfig) setAddr(addr string) (err error) {
+	if !strings.Contains(addr, "://") {
+		addr = "tcp://" + addr
+	}
+	c.network, c.address, err = parseTarget(addr)
+	return err
+}
+
+// send sends each line in r, skipping blank lines. Every line is parsed
+// before any are sent, so that a typo fails loudly, rather than only being
+// counted as rejected by the aggregator.
+func (c sendConfig) send(r io.Reader) error {
+	var lines [][]byte
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, defaultMaxLineBytes+1)
+	for i := 1; s.Scan(); i++ {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if _, err := aggregator.ParseLine(line, nil); err != nil {
+			return errors.Wrapf(err, "line %d", i)
+		}
+		lines = append(lines, append([]byte(nil), line...))
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	conn, err := net.Dial(c.network, c.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var (
+		w       = bufio.NewWriter(conn)
+		packets = isPacketNetwork(c.network)
+		zbuf    bytes.Buffer
+		zw      = gzip.NewWriter(&zbuf)
+	)
+	for _, line := range lines {
+		if c.gzip {
+			zbuf.Reset()
+			zw.Reset(&zbuf)
+			zw.Write(line)
+			zw.Close()
+			line = zbuf.Bytes()
+		}
+		if c.cipher != nil {
+			line = c.cipher.Seal(nil, line)
+		}
+		var err error
+		if packets {
+			_, err = conn.Write(line)
+		} else if _, err = w.Write(line); err == nil {
+			err = w.WriteByte('\n')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
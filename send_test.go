@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestSend(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		network string
+		gzip    bool
+		key     string
+	}{
+		"tcp":                {network: "tcp"},
+		"udp":                {network: "udp"},
+		"udp gzip":           {network: "udp", gzip: true},
+		"udp gzip encrypted": {network: "udp", gzip: true, key: "000102030405060708090a0b0c0d0e0f"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			u, _ := aggregator.NewUniverse()
+			in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+			var addr string
+			if testcase.network == "udp" {
+				conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				if testcase.key != "" {
+					key, _ := aggregator.ParsePacketKey(testcase.key)
+					in.cipher, _ = aggregator.NewPacketCipher(key)
+				}
+				go in.forwardPacketConn(conn)
+				addr = "udp://" + conn.LocalAddr().String()
+			} else {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer ln.Close()
+				go in.forwardListener(ln)
+				addr = ln.Addr().String() // TCP is the default
+			}
+
+			args := []string{"-addr", addr}
+			if testcase.gzip {
+				args = append(args, "-gzip")
+			}
+			if testcase.key != "" {
+				args = append(args, "-key", testcase.key)
+			}
+			stdin := strings.NewReader("{\"name\":\"foo_total\",\"type\":\"counter\",\"help\":\"Total foos.\"}\n\nfoo_total{code=\"200\"} 1\n")
+			var stdout bytes.Buffer
+			if want, have := 0, runSend(args, stdin, &stdout); want != have {
+				t.Fatalf("exit code: want %d, have %d: %s", want, have, stdout.String())
+			}
+			waitForSeriesValue(t, u, "foo_total", map[string]string{"code": "200"}, 1)
+			if want, have := 0, runSend(append(args, `foo_total{code="200"} 2`), nil, &stdout); want != have {
+				t.Fatalf("exit code: want %d, have %d: %s", want, have, stdout.String())
+			}
+			waitForSeriesValue(t, u, "foo_total", map[string]string{"code": "200"}, 3)
+		})
+	}
+}
+
+func TestSendInvalid(t *testing.T) {
+	// Nothing is listening, so a connection attempt would fail too.
+	c := sendConfig{network: "tcp", address: "127.0.0.1:1"}
+	err := c.send(strings.NewReader("foo_total{} 1\nfoo_total{ 1\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2: ") {
+		t.Fatalf("want line 2 parse error, have %v", err)
+	}
+
+	var stdout bytes.Buffer
+	if want, have := 1, runSend([]string{"-gzip", "foo_total{} 1"}, nil, &stdout); want != have {
+		t.Errorf("gzip over TCP: want exit code %d, have %d", want, have)
+	}
+	if want, have := 1, runSend([]string{"-key", "000102030405060708090a0b0c0d0e0f", "foo_total{} 1"}, nil, &stdout); want != have {
+		t.Errorf("key over TCP: want exit code %d, have %d", want, have)
+	}
+}
+
+// waitForSeriesValue waits for a series, which is observed asynchronously,
+// to have the value.
+func waitForSeriesValue(t *testing.T, u *aggregator.Universe, name string, labels map[string]string, value float64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, ok := u.Lookup(name, labels)
+		if ok && *s.Value == value {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s%v: want %v, have %+v", name, labels, value, s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+// sequenceTracker counts the datagrams that never arrive from each sender
+// that numbers them, by the gaps in their sequence numbers. Once max senders
+// are being tracked, new senders aren't.
+type sequenceTracker struct {
+	max int
+
+	mtx     sync.Mutex
+	senders map[senderKey]*sequenceState
+}
+
+// senderKey is a sender at a source, so that senders on different hosts
+// can use the same name.
+type senderKey struct{ source, sender string }
+
+type sequenceState struct {
+	last uint64
+	lost uint64
+}
+
+// sequenceRestart is how far a sequence number must go backwards to be
+// taken as the sender restarting, rather than a reordered datagram.
+const sequenceRestart = 1000
+
+func newSequenceTracker(max int) *sequenceTracker {
+	return &sequenceTracker{max: max, senders: map[senderKey]*sequenceState{}}
+}
+
+// observe records the datagram numbered by h, from source. Reordered and
+// duplicated datagrams are ignored; a reordered datagram has already been
+// counted as lost, by the gap it left.
+func (t *sequenceTracker) observe(source string, h *aggregator.SequenceHeader) {
+	k := senderKey{source, h.Sender}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	s, ok := t.senders[k]
+	switch {
+	case !ok && len(t.senders) >= t.max:
+	case !ok:
+		t.senders[k] = &sequenceState{last: h.Number}
+	case h.Number > s.last:
+		s.lost += h.Number - s.last - 1
+		s.last = h.Number
+	case s.last-h.Number >= sequenceRestart:
+		s.last = h.Number
+	}
+}
+
+func (t *sequenceTracker) metrics() []selfMetric {
+	return []selfMetric{
+		newSelfCounterFunc("aggregator_udp_lost_packets_total", "Total number of numbered datagrams that never arrived, by source and sender.", []string{"source", "sender"}, func() []selfSample {
+			t.mtx.Lock()
+			defer t.mtx.Unlock()
+			samples := make([]selfSample, 0, len(t.senders))
+			for k, s := range t.senders {
+				samples = append(samples, selfSample{labelValues: []string{k.source, k.sender}, value: float64(s.lost)})
+			}
+			return samples
+		}),
+	}
+}
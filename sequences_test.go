@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestSequenceTracker(t *testing.T) {
+	s := newSequenceTracker(2)
+	for _, x := range []struct {
+		source, sender string
+		n              uint64
+	}{
+		{"10.0.0.1", "a", 1},
+		{"10.0.0.1", "a", 2},
+		{"10.0.0.1", "a", 5}, // lost 3 and 4
+		{"10.0.0.1", "a", 4}, // reordered
+		{"10.0.0.1", "a", 5}, // duplicate
+		{"10.0.0.2", "a", 7}, // another source
+		{"10.0.0.2", "a", 9}, // lost 8
+		{"10.0.0.3", "b", 1}, // too many senders
+		{"10.0.0.3", "b", 3},
+		{"10.0.0.1", "a", 2000},
+		{"10.0.0.1", "a", 1}, // restarted
+		{"10.0.0.1", "a", 3}, // lost 2
+	} {
+		s.observe(x.source, &aggregator.SequenceHeader{Sender: x.sender, Number: x.n})
+	}
+	for k, want := range map[senderKey]uint64{
+		{"10.0.0.1", "a"}: 1997,
+		{"10.0.0.2", "a"}: 1,
+	} {
+		if have := s.senders[k].lost; want != have {
+			t.Errorf("%v: want %d lost, have %d", k, want, have)
+		}
+	}
+	if _, ok := s.senders[senderKey{"10.0.0.3", "b"}]; ok {
+		t.Errorf("want sender beyond the maximum untracked")
+	}
+}
+
+func TestSequencedPackets(t *testing.T) {
+	var (
+		dst, _ = aggregator.NewUniverse()
+		tm     = newTelemetry(dst)
+		in     = newIngester(dst, tm, log.NewNopLogger())
+	)
+	tm.register(in.sequences.metrics()...)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- in.forwardPacketConn(conn) }()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	fmt.Fprint(client, "#seq web-1 1\n"+`{"name":"foo","type":"counter","help":"Total foos."}`)
+	fmt.Fprint(client, "#seq web-1 2\nfoo{} 1")
+	fmt.Fprint(client, "#seq web-1 4\nfoo{} 1")
+	fmt.Fprint(client, "#seq web-1 5")
+	fmt.Fprint(client, "#seq web-1\nfoo{} 1")
+
+	in.drain(50 * time.Millisecond)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if want, have := uint64(1), tm.linesRejected.value(rejectParse); want != have {
+		t.Errorf("rejected: want %d, have %d", want, have)
+	}
+	output := scrape(t, exposition(dst, tm))
+	for _, want := range []string{
+		`foo{} 2.000000`,
+		`aggregator_udp_lost_packets_total{sender="web-1",source="127.0.0.1"} 1.000000`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output missing %q\n%s", want, output)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"github.com/pkg/errors"
+)
+
+// Outcomes of observations in the shadow universe.
+const (
+	shadowAccepted = "accepted"
+	shadowRejected = "rejected"
+	shadowDropped  = "dropped"
+)
+
+// shadow observes every received observation again, in a universe of its
+// own, with the transforms, declarations, and label limits of a proposed
+// config file, so that its output can be compared with the live universe's
+// before the proposal is promoted. Other settings of the file are ignored.
+type shadow struct {
+	filename    string
+	initial     []aggregator.Observation // e.g. from -declfile
+	limits      aggregator.Limits        // overridden by the file's
+	labels      map[string]string        // set after the transforms, as by the live transformer
+	newUniverse func([]aggregator.Observation) (*aggregator.Universe, error)
+	outcomes    *selfCounter
+
+	mtx        sync.RWMutex
+	u          *aggregator.Universe
+	transforms *transformer
+}
+
+func newShadow(filename string, initial []aggregator.Observation, limits aggregator.Limits, labels map[string]string, newUniverse func([]aggregator.Observation) (*aggregator.Universe, error)) (*shadow, error) {
+	s := &shadow{
+		filename:    filename,
+		initial:     initial,
+		limits:      limits,
+		labels:      labels,
+		newUniverse: newUniverse,
+		outcomes:    newSelfCounter("aggregator_shadow_observations_total", "Total number of observations observed in the shadow universe, by outcome.", "outcome"),
+	}
+	return s, s.load()
+}
+
+// load reads the shadow config file, and replaces the shadow universe with
+// an empty one, configured as it says. If the file is invalid, the shadow
+// universe is left as it is.
+func (s *shadow) load() error {
+	c, err := loadConfig(s.filename)
+	if err != nil {
+		return err
+	}
+	transforms, err := compileTransforms(c.Transforms)
+	if err != nil {
+		return err
+	}
+	decls := append(append([]aggregator.Observation(nil), s.initial...), c.Declarations...)
+	u, err := s.newUniverse(decls)
+	if err != nil {
+		return err
+	}
+	limits := s.limits
+	if v := c.Limits.MaxLabels; v != nil {
+		limits.MaxLabels = *v
+	}
+	if v := c.Limits.MaxLabelValueBytes; v != nil {
+		limits.MaxLabelValueBytes = *v
+	}
+	if v := c.Limits.MaxNameBytes; v != nil {
+		limits.MaxNameBytes = *v
+	}
+	if err := u.SetLimits(limits); err != nil {
+		return errors.Wrap(err, "limits")
+	}
+	t := newTransformer(transforms)
+	t.labels = s.labels
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.u, s.transforms = u, t
+	return nil
+}
+
+// universe returns the current shadow universe.
+func (s *shadow) universe() *aggregator.Universe {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.u
+}
+
+// observe observes obs, as received, before the live transforms, in the
+// shadow universe, and records the outcome. A nil shadow does nothing.
+func (s *shadow) observe(obs aggregator.Observation) {
+	if s == nil {
+		return
+	}
+	s.mtx.RLock()
+	u, t := s.u, s.transforms
+	s.mtx.RUnlock()
+	obs, ok := t.apply(obs)
+	switch {
+	case !ok:
+		s.outcomes.add(1, shadowDropped)
+	case u.Observe(obs) != nil:
+		s.outcomes.add(1, shadowRejected)
+	default:
+		s.outcomes.add(1, shadowAccepted)
+	}
+}
+
+// expire expires the series of the shadow universe, as in Universe.Expire,
+// and evicts any over the memory limit. Neither is counted in the live
+// universe's telemetry.
+func (s *shadow) expire(now time.Time, defaultTTL time.Duration) {
+	u := s.universe()
+	u.Expire(now, defaultTTL)
+	u.Evict()
+}
+
+// metrics returns the shadow's self-telemetry.
+func (s *shadow) metrics() []selfMetric {
+	return []selfMetric{
+		s.outcomes,
+		newSelfGaugeFunc("aggregator_shadow_series", "Current number of series in the shadow universe.", nil, func() []selfSample {
+			return []selfSample{{value: float64(totalSeries(s.universe().SeriesCounts()))}}
+		}),
+	}
+}
+
+// shadowHandler serves the shadow universe on GET, as it would be scraped,
+// to be compared with the metrics path, and, on PUT or POST, reloads the
+// shadow config file, starting over with an empty shadow universe.
+func shadowHandler(s *shadow) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			s.universe().ServeHTTP(w, r)
+		case "PUT", "POST":
+			if err := s.load(); err != nil {
+				respondError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+}
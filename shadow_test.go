@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestShadow(t *testing.T) {
+	filename := writeConfig(t, `
+limits:
+  max_labels: 1
+transforms:
+  - match: legacy_(.+)_ms
+    rename: ${1}_seconds
+    scale: 0.001
+  - match: debug_.*
+    drop: true
+declarations:
+  - name: request_seconds
+    type: gauge
+    help: Request duration.
+`)
+	u, _ := aggregator.NewUniverse()
+	s, err := newShadow(filename, nil, aggregator.Limits{}, nil, func(decls []aggregator.Observation) (*aggregator.Universe, error) {
+		return aggregator.NewUniverse(decls...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+	in.shadow = s
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`{"name":"legacy_request_ms","type":"gauge","help":"Request duration."}`,
+		`legacy_request_ms{code="200"} 1500`,
+		`legacy_request_ms{code="500",region="eu"} 250`, // over the shadow's label limit
+		`{"name":"debug_total","type":"counter","help":"Debugs."}`,
+		`debug_total{} 1`,
+	}, "\n"))))
+
+	// The live universe is as it would be without the shadow.
+	if want, have := normalizeResponse(`
+		# HELP debug_total Debugs.
+		# TYPE debug_total counter
+		debug_total{} 1.000000
+
+		# HELP legacy_request_ms Request duration.
+		# TYPE legacy_request_ms gauge
+		legacy_request_ms{code="200"} 1500.000000
+		legacy_request_ms{code="500",region="eu"} 250.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("live:\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	h := shadowHandler(s)
+	if want, have := normalizeResponse(`
+		# HELP request_seconds Request duration.
+		# TYPE request_seconds gauge
+		request_seconds{code="200"} 1.500000
+	`), normalizeResponse(scrape(t, h)); want != have {
+		t.Fatalf("shadow:\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+	for outcome, want := range map[string]uint64{shadowAccepted: 2, shadowRejected: 1, shadowDropped: 2} {
+		if have := s.outcomes.value(outcome); want != have {
+			t.Errorf("%s: want %d, have %d", outcome, want, have)
+		}
+	}
+
+	// An invalid proposal leaves the shadow as it is, and a valid one starts
+	// it over.
+	if err := os.WriteFile(filename, []byte("transforms:\n  - match: foo(\n    drop: true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/debug/shadow", nil))
+	if want, have := http.StatusBadRequest, rec.Code; want != have {
+		t.Errorf("invalid: want %d, have %d", want, have)
+	}
+	if !strings.Contains(scrape(t, h), "request_seconds{") {
+		t.Errorf("invalid: want the shadow kept, have it replaced")
+	}
+	if err := os.WriteFile(filename, []byte("transforms: []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/debug/shadow", nil))
+	if want, have := http.StatusNoContent, rec.Code; want != have {
+		t.Errorf("valid: want %d, have %d: %s", want, have, rec.Body)
+	}
+	if have := scrape(t, h); strings.TrimSpace(have) != "" {
+		t.Errorf("valid: want an empty shadow, have\n%s", have)
+	}
+}
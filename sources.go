@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sourceStats tracks ingest statistics per remote source, i.e. the IP address
+// of a sender. Once max sources are being tracked, statistics for any new
+// source are attributed to the overflow source.
+type sourceStats struct {
+	max int
+	now func() time.Time
+
+	mtx     sync.RWMutex
+	sources map[string]*sourceStat
+}
+
+// sourceStat fields are accessed atomically.
+type sourceStat struct {
+	lines    uint64
+	bytes    uint64
+	rejects  uint64
+	lastSeen int64 // unix nanoseconds
+}
+
+const (
+	sourceOverflow = "other"
+	sourceLocal    = "local"
+)
+
+func newSourceStats(max int) *sourceStats {
+	return &sourceStats{
+		max:     max,
+		now:     time.Now,
+		sources: map[string]*sourceStat{},
+	}
+}
+
+// setMax changes the maximum number of sources. Sources that are already
+// being tracked are kept, even if there are more than max of them.
+func (s *sourceStats) setMax(max int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.max = max
+}
+
+// get returns the statistics of source, and the source they're tracked as,
+// which is the overflow source once max sources are being tracked.
+func (s *sourceStats) get(source string) (string, *sourceStat) {
+	s.mtx.RLock()
+	st, ok := s.sources[source]
+	s.mtx.RUnlock()
+	if ok {
+		return source, st
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if st, ok := s.sources[source]; ok {
+		return source, st
+	}
+	if len(s.sources) >= s.max {
+		source = sourceOverflow
+		if st, ok := s.sources[source]; ok {
+			return source, st
+		}
+	}
+	st = &sourceStat{}
+	s.sources[source] = st
+	return source, st
+}
+
+func (s *sourceStats) line(source string) {
+	_, st := s.get(source)
+	atomic.AddUint64(&st.lines, 1)
+	atomic.StoreInt64(&st.lastSeen, s.now().UnixNano())
+}
+
+func (s *sourceStats) bytes(source string, n int) {
+	_, st := s.get(source)
+	atomic.AddUint64(&st.bytes, uint64(n))
+}
+
+// reject records a rejected line from source, and returns the source it's
+// tracked as.
+func (s *sourceStats) reject(source string) string {
+	source, st := s.get(source)
+	atomic.AddUint64(&st.rejects, 1)
+	return source
+}
+
+// sourceSnapshot is a point-in-time view of a sourceStat, suitable for JSON
+// encoding.
+type sourceSnapshot struct {
+	Source   string    `json:"source"`
+	Lines    uint64    `json:"lines"`
+	Bytes    uint64    `json:"bytes"`
+	Rejects  uint64    `json:"rejects"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func (s *sourceStats) snapshot() []sourceSnapshot {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	snapshots := make([]sourceSnapshot, 0, len(s.sources))
+	for source, st := range s.sources {
+		snapshots = append(snapshots, sourceSnapshot{
+			Source:   source,
+			Lines:    atomic.LoadUint64(&st.lines),
+			Bytes:    atomic.LoadUint64(&st.bytes),
+			Rejects:  atomic.LoadUint64(&st.rejects),
+			LastSeen: time.Unix(0, atomic.LoadInt64(&st.lastSeen)).UTC(),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Source < snapshots[j].Source })
+	return snapshots
+}
+
+// metrics returns per-source telemetry, computed at scrape time.
+func (s *sourceStats) metrics() []selfMetric {
+	sample := func(f func(sourceSnapshot) float64) func() []selfSample {
+		return func() []selfSample {
+			snapshots := s.snapshot()
+			samples := make([]selfSample, len(snapshots))
+			for i, snap := range snapshots {
+				samples[i] = selfSample{labelValues: []string{snap.Source}, value: f(snap)}
+			}
+			return samples
+		}
+	}
+	source := []string{"source"}
+	return []selfMetric{
+		newSelfCounterFunc("aggregator_source_lines_total", "Total number of lines received, by source.", source, sample(func(s sourceSnapshot) float64 { return float64(s.Lines) })),
+		newSelfCounterFunc("aggregator_source_bytes_total", "Total bytes received, by source.", source, sample(func(s sourceSnapshot) float64 { return float64(s.Bytes) })),
+		newSelfCounterFunc("aggregator_source_rejected_total", "Total number of lines rejected, by source.", source, sample(func(s sourceSnapshot) float64 { return float64(s.Rejects) })),
+		newSelfGaugeFunc("aggregator_source_last_seen_timestamp_seconds", "Time a line was last received, by source.", source, sample(func(s sourceSnapshot) float64 { return float64(s.LastSeen.UnixNano()) / 1e9 })),
+	}
+}
+
+// sourcesHandler serves per-source ingest statistics.
+func sourcesHandler(s *sourceStats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, http.StatusOK, s.snapshot())
+	})
+}
+
+// sourceOf returns the source identifier for a remote address, which is the
+// IP address for IP networks, the address string for other networks, and
+// sourceLocal if there's no address at all, e.g. for UNIX domain sockets.
+func sourceOf(addr net.Addr) string {
+	switch a := addr.(type) {
+	case nil:
+		return sourceLocal
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	default:
+		if host, _, err := net.SplitHostPort(a.String()); err == nil {
+			return host
+		}
+		if a.String() == "" {
+			return sourceLocal
+		}
+		return a.String()
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSourceStats(t *testing.T) {
+	s := newSourceStats(2)
+	s.now = func() time.Time { return time.Unix(1234, 0) }
+
+	s.line("10.0.0.1")
+	s.bytes("10.0.0.1", 100)
+	s.line("10.0.0.2")
+	s.reject("10.0.0.2")
+	s.line("10.0.0.3") // over the max
+	s.line("10.0.0.4") // over the max
+	s.reject("10.0.0.4")
+
+	want := []sourceSnapshot{
+		{Source: "10.0.0.1", Lines: 1, Bytes: 100, LastSeen: time.Unix(1234, 0).UTC()},
+		{Source: "10.0.0.2", Lines: 1, Rejects: 1, LastSeen: time.Unix(1234, 0).UTC()},
+		{Source: "other", Lines: 2, Rejects: 1, LastSeen: time.Unix(1234, 0).UTC()},
+	}
+	if have := s.snapshot(); !cmp.Equal(want, have) {
+		t.Fatal(cmp.Diff(want, have))
+	}
+}
+
+func TestSourceOf(t *testing.T) {
+	for _, testcase := range []struct {
+		addr net.Addr
+		want string
+	}{
+		{nil, "local"},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5555}, "10.1.2.3"},
+		{&net.UDPAddr{IP: net.ParseIP("::1"), Port: 5555}, "::1"},
+		{&net.UnixAddr{Name: "", Net: "unix"}, "local"},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unixgram"}, "/tmp/sock"},
+	} {
+		if want, have := testcase.want, sourceOf(testcase.addr); want != have {
+			t.Errorf("%v: want %q, have %q", testcase.addr, want, have)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parseTargetInfo parses comma-separated resource attributes, like
+// service.name=checkout,service.namespace=shop. Attributes whose label names
+// would be the same are an error.
+func parseTargetInfo(s string) (map[string]string, error) {
+	attrs, labels := map[string]string{}, map[string]string{}
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		eq := strings.IndexByte(field, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("%q isn't attribute=value", field)
+		}
+		name := field[:eq]
+		if other, ok := labels[attributeLabelName(name)]; ok && other != name {
+			return nil, fmt.Errorf("attributes %s and %s would both be label %s", other, name, attributeLabelName(name))
+		}
+		labels[attributeLabelName(name)] = name
+		attrs[name] = field[eq+1:]
+	}
+	return attrs, nil
+}
+
+// newTargetInfoMetric returns a constant gauge, with the resource attributes
+// as labels, as OpenTelemetry's Prometheus exporters export target_info. The
+// attribute names are translated into label names the same way, so that e.g.
+// service.name becomes service_name.
+func newTargetInfoMetric(attrs map[string]string) *selfFunc {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	labelNames := make([]string, len(names))
+	labelValues := make([]string, len(names))
+	for i, name := range names {
+		labelNames[i] = attributeLabelName(name)
+		labelValues[i] = labelValueEscaper.Replace(attrs[name])
+	}
+	return newSelfGaugeFunc("target_info", "Target metadata.", labelNames, func() []selfSample {
+		return []selfSample{{labelValues: labelValues, value: 1}}
+	})
+}
+
+// attributeLabelName replaces the characters of an attribute name that
+// aren't valid in a label name with underscores.
+func attributeLabelName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "key_" + name
+	}
+	return name
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
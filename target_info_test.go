@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTargetInfo(t *testing.T) {
+	attrs, err := parseTargetInfo(`service.name=checkout, service.namespace=shop,2fa.mode=say "hi"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	newTargetInfoMetric(attrs).renderText(&buf)
+	if want, have := normalizeResponse(`
+		# HELP target_info Target metadata.
+		# TYPE target_info gauge
+		target_info{key_2fa_mode="say \"hi\"",service_name="checkout",service_namespace="shop"} 1.000000
+	`), normalizeResponse(buf.String()); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestParseTargetInfoErrors(t *testing.T) {
+	for name, s := range map[string]string{
+		"no value":  `service.name`,
+		"no name":   `=checkout`,
+		"collision": `service.name=a,service_name=b`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if attrs, err := parseTargetInfo(s); err == nil {
+				t.Errorf("want error, have %v", attrs)
+			}
+		})
+	}
+}
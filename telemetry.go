@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+// telemetry is the aggregator's own instrumentation. It's rendered after the
+// universe on /metrics, with every metric under the aggregator_ prefix. It's
+// deliberately separate from the universe, so that instrumenting the ingest
+// path doesn't contend on the universe lock.
+type telemetry struct {
+	linesReceived          *selfCounter
+	linesAccepted          *selfCounter
+	linesRejected          *selfCounter
+	rejections             *selfCounter
+	linesDropped           *selfCounter
+	linesSkipped           *selfCounter
+	seriesExpired          *selfCounter
+	seriesEvicted          *selfCounter
+	limitBreaches          *selfCounter
+	bytesReceived          *selfCounter
+	decompressionFailures  *selfCounter
+	udpPackets             *selfCounter
+	tcpConnections         *selfCounter
+	tcpConnectionsActive   *selfGauge
+	tcpConnectionsRejected *selfCounter
+	tcpConnectionsTimedOut *selfCounter
+	denied                 *selfCounter
+	scrapesRejected        *selfCounter
+	scrapesNotModified     *selfCounter
+	scrapeDuration         *selfHistogram
+	lineBytes              *selfHistogram
+	decompressionRatio     *selfHistogram
+	lineDuration           *selfHistogram
+	sources                *sourceStats
+	leader                 *leaseElector // nil is always the leader
+
+	metrics []selfMetric
+}
+
+// Reasons for rejecting a line, used as label values. They say where the line
+// was rejected; rejectReason classifies why.
+const (
+	rejectDecompress   = "decompress"
+	rejectDecrypt      = "decrypt"
+	rejectHandshake    = "handshake"
+	rejectParse        = "parse"
+	rejectObserve      = "observe"
+	rejectRateLimit    = "rate_limit"
+	rejectTooLong      = "too_long"
+	rejectQueueFull    = "queue_full"
+	rejectUndeclared   = "undeclared"
+	rejectQuota        = "quota"
+	rejectUnauthorized = "unauthorized"
+)
+
+func newTelemetry(u *aggregator.Universe) *telemetry {
+	t := &telemetry{
+		linesReceived:          newSelfCounter("aggregator_lines_received_total", "Total number of lines received."),
+		linesAccepted:          newSelfCounter("aggregator_lines_accepted_total", "Total number of lines accepted."),
+		linesRejected:          newSelfCounter("aggregator_lines_rejected_total", "Total number of lines rejected, by reason.", "reason"),
+		rejections:             newSelfCounter("aggregator_rejections_total", "Total number of lines rejected, by classified reason and source.", "reason", "source"),
+		linesDropped:           newSelfCounter("aggregator_lines_dropped_total", "Total number of lines dropped by transforms."),
+		linesSkipped:           newSelfCounter("aggregator_lines_skipped_total", "Total number of blank and comment lines skipped."),
+		seriesExpired:          newSelfCounter("aggregator_series_expired_total", "Total number of series removed after their TTL."),
+		seriesEvicted:          newSelfCounter("aggregator_series_evicted_total", "Total number of series removed, or spilled to disk, to stay within the memory limit."),
+		limitBreaches:          newSelfCounter("aggregator_limit_breaches_total", "Total number of lines rejected, or eviction rounds, for exceeding a limit, by limit.", "limit"),
+		bytesReceived:          newSelfCounter("aggregator_bytes_received_total", "Total bytes of observation data received over the wire."),
+		decompressionFailures:  newSelfCounter("aggregator_decompression_failures_total", "Total number of lines or packets that failed to decompress."),
+		udpPackets:             newSelfCounter("aggregator_udp_packets_received_total", "Total number of UDP packets received."),
+		tcpConnections:         newSelfCounter("aggregator_tcp_connections_total", "Total number of TCP connections accepted."),
+		tcpConnectionsActive:   newSelfGauge("aggregator_tcp_connections_active", "Current number of open TCP connections."),
+		tcpConnectionsRejected: newSelfCounter("aggregator_tcp_connections_rejected_total", "Total number of TCP connections closed immediately, because too many were open."),
+		tcpConnectionsTimedOut: newSelfCounter("aggregator_tcp_connections_timed_out_total", "Total number of TCP connections closed after being idle."),
+		denied:                 newSelfCounter("aggregator_denied_total", "Total number of TCP connections, UDP packets, and HTTP requests dropped, because their source isn't allowed, by transport.", "transport"),
+		scrapesRejected:        newSelfCounter("aggregator_scrapes_rejected_total", "Total number of scrapes of /metrics answered with 503, because too many were in progress, or rendering took too long, by reason.", "reason"),
+		scrapesNotModified:     newSelfCounter("aggregator_scrapes_not_modified_total", "Total number of scrapes of /metrics answered with 304, because their ETag was current."),
+		scrapeDuration:         newSelfHistogram("aggregator_scrape_duration_seconds", "Time spent rendering /metrics.", []float64{.001, .005, .01, .05, .1, .5, 1, 5}),
+		lineBytes:              newSelfHistogram("aggregator_line_bytes", "Size of lines, after decompression.", []float64{16, 64, 256, 1024, 4096, 16384, 65536}),
+		decompressionRatio:     newSelfHistogram("aggregator_line_decompression_ratio", "Ratio of the size of gzipped lines and packets after decompression to their size before.", []float64{1, 2, 4, 8, 16, 32, 64, 128}),
+		lineDuration:           newSelfHistogram("aggregator_line_duration_seconds", "Time spent parsing, transforming, and observing each line, excluding time spent queued.", []float64{.000001, .000005, .00001, .00005, .0001, .0005, .001, .005, .01, .05}),
+		sources:                newSourceStats(defaultMaxSources),
+	}
+	t.metrics = []selfMetric{
+		t.linesReceived,
+		t.linesAccepted,
+		t.linesRejected,
+		t.rejections,
+		t.linesDropped,
+		t.linesSkipped,
+		t.seriesExpired,
+		t.seriesEvicted,
+		t.limitBreaches,
+		t.bytesReceived,
+		t.decompressionFailures,
+		t.udpPackets,
+		t.tcpConnections,
+		t.tcpConnectionsActive,
+		t.tcpConnectionsRejected,
+		t.tcpConnectionsTimedOut,
+		t.denied,
+		t.scrapesRejected,
+		t.scrapesNotModified,
+		t.scrapeDuration,
+		t.lineBytes,
+		t.decompressionRatio,
+		t.lineDuration,
+		newSelfCounterFunc("aggregator_observations_duplicate_total", "Total number of observations ignored, because their ID had already been observed.", nil, func() []selfSample {
+			return []selfSample{{value: float64(u.Duplicates())}}
+		}),
+		newSelfCounterFunc("aggregator_observations_non_finite_dropped_total", "Total number of observations ignored, because their values weren't finite, and the policy was to drop them.", nil, func() []selfSample {
+			return []selfSample{{value: float64(u.NonFiniteDropped())}}
+		}),
+		newSelfCounterFunc("aggregator_observations_stale_total", "Total number of timestamped gauge observations ignored, because the gauge had been set by a later one.", nil, func() []selfSample {
+			return []selfSample{{value: float64(u.StaleObservations())}}
+		}),
+		newSelfCounterFunc("aggregator_type_conflicts_total", "Total number of lines declaring a metric with a different type or parameters than it already has, by resolution.", []string{"resolution"}, func() []selfSample {
+			conflicts := u.TypeConflicts()
+			samples := make([]selfSample, 0, len(conflicts))
+			for resolution, n := range conflicts {
+				samples = append(samples, selfSample{labelValues: []string{resolution}, value: float64(n)})
+			}
+			return samples
+		}),
+		newSelfGaugeFunc("aggregator_family_series", "Current number of series, by metric family.", []string{"family"}, func() []selfSample {
+			counts := u.SeriesCounts()
+			samples := make([]selfSample, 0, len(counts))
+			for n, count := range counts {
+				samples = append(samples, selfSample{labelValues: []string{string(n)}, value: float64(count)})
+			}
+			return samples
+		}),
+		newSelfGaugeFunc("aggregator_family_memory_bytes", "Estimated memory used by series, by metric family.", []string{"family"}, func() []selfSample {
+			bytes := u.FamilyMemoryBytes()
+			samples := make([]selfSample, 0, len(bytes))
+			for n, b := range bytes {
+				samples = append(samples, selfSample{labelValues: []string{n}, value: float64(b)})
+			}
+			return samples
+		}),
+		newSelfGaugeFunc("aggregator_series_spilled", "Current number of series spilled to disk, with -series.memory-shed=spill.", nil, func() []selfSample {
+			return []selfSample{{value: float64(u.SpillStats().Series)}}
+		}),
+		newSelfGaugeFunc("aggregator_spill_file_bytes", "Current size of the file that series are spilled to, including superseded series.", nil, func() []selfSample {
+			return []selfSample{{value: float64(u.SpillStats().Bytes)}}
+		}),
+		newSelfCounterFunc("aggregator_series_paged_in_total", "Total number of spilled series paged back into memory, to be observed.", nil, func() []selfSample {
+			return []selfSample{{value: float64(u.SpillStats().PagedIn)}}
+		}),
+		newSelfCounterFunc("aggregator_spill_failures_total", "Total number of failures to write or read the file that series are spilled to, whose series are lost.", nil, func() []selfSample {
+			return []selfSample{{value: float64(u.SpillStats().Failures)}}
+		}),
+		newRuntimeMetrics(),
+		newBuildInfoMetric(),
+	}
+	sort.Slice(t.metrics, func(i, j int) bool { return t.metrics[i].name() < t.metrics[j].name() })
+	return t
+}
+
+// Classified reasons for rejecting a line, alongside those of the
+// aggregator package, for rejections outside of it.
+const (
+	reasonDecompress   = "decompress_failure"
+	reasonDecrypt      = "decrypt_failure"
+	reasonQueueFull    = "queue_full"
+	reasonUnauthorized = "unauthorized"
+	reasonOther        = "other"
+)
+
+// rejectReason classifies a line rejected with err, where reason says where
+// it was rejected, so that producer bugs, such as bad values or undeclared
+// metrics, can be told apart from misconfiguration, such as limits that are
+// too low.
+func rejectReason(reason string, err error) string {
+	switch reason {
+	case rejectDecompress:
+		return reasonDecompress
+	case rejectDecrypt:
+		return reasonDecrypt
+	case rejectHandshake:
+		return aggregator.ReasonBadFormat
+	case rejectRateLimit, rejectTooLong, rejectQuota:
+		return aggregator.ReasonLimitExceeded
+	case rejectQueueFull:
+		return reasonQueueFull
+	case rejectUndeclared:
+		return aggregator.ReasonUnknownMetric
+	case rejectUnauthorized:
+		return reasonUnauthorized
+	}
+	if r := aggregator.RejectReason(err); r != "" {
+		return r
+	}
+	if reason == rejectParse {
+		return aggregator.ReasonBadFormat
+	}
+	return reasonOther
+}
+
+// defaultMaxSources is the default number of distinct sources to track.
+const defaultMaxSources = 1000
+
+// register adds metrics to the telemetry. It must be called before the
+// telemetry is rendered.
+func (t *telemetry) register(metrics ...selfMetric) {
+	t.metrics = append(t.metrics, metrics...)
+	sort.Slice(t.metrics, func(i, j int) bool { return t.metrics[i].name() < t.metrics[j].name() })
+}
+
+func (t *telemetry) lineReceived(source string) {
+	t.linesReceived.add(1)
+	t.sources.line(source)
+}
+
+func (t *telemetry) bytesRead(source string, n int) {
+	t.bytesReceived.add(uint64(n))
+	t.sources.bytes(source, n)
+}
+
+// decompressed records the ratio of the size of data decompressed from
+// compressed to the size of compressed, if it was gzipped.
+func (t *telemetry) decompressed(compressed, data []byte) {
+	if aggregator.IsGzipped(compressed) {
+		t.decompressionRatio.observe(float64(len(data)) / float64(len(compressed)))
+	}
+}
+
+func (t *telemetry) lineAccepted() {
+	t.linesAccepted.add(1)
+}
+
+// lineRejected records a line from source rejected with err, where reason
+// says where it was rejected.
+func (t *telemetry) lineRejected(source, reason string, err error) {
+	t.linesRejected.add(1, reason)
+	t.rejections.add(1, rejectReason(reason, err), t.sources.reject(source))
+	if reason == rejectDecompress {
+		t.decompressionFailures.add(1)
+	}
+}
+
+func (t *telemetry) renderText(w io.Writer) {
+	for _, m := range t.metrics {
+		m.renderText(w)
+		fmt.Fprintln(w)
+	}
+}
+
+// exposition serves the universe, followed by the aggregator's telemetry, in
+// the OpenMetrics format if the universe serves it to the scrape. Replicas
+// that aren't the leader only serve their telemetry.
+func exposition(u *aggregator.Universe, t *telemetry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		begin := time.Now()
+		openMetrics := u.ServesOpenMetrics(r)
+		switch {
+		case t.leader.isLeader():
+			u.ServeExposition(w, r)
+		case openMetrics:
+			w.Header().Set("Content-Type", aggregator.OpenMetricsContentType)
+		default:
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		}
+		bw := bufio.NewWriter(w)
+		if openMetrics {
+			var buf bytes.Buffer
+			t.renderText(&buf)
+			bw.Write(aggregator.OpenMetricsText(buf.Bytes()))
+			io.WriteString(bw, "# EOF\n")
+		} else {
+			t.renderText(bw)
+		}
+		bw.Flush()
+		t.scrapeDuration.observe(time.Since(begin).Seconds())
+	})
+}
+
+// serveUniverse serves a universe without the aggregator's telemetry, as for
+// a tenant or route, if the replica is the leader, and otherwise an empty
+// exposition, as exposition serves followers.
+func serveUniverse(w http.ResponseWriter, r *http.Request, u *aggregator.Universe, leader *leaseElector) {
+	switch {
+	case leader.isLeader():
+		u.ServeHTTP(w, r)
+	case u.ServesOpenMetrics(r):
+		w.Header().Set("Content-Type", aggregator.OpenMetricsContentType)
+		io.WriteString(w, "# EOF\n")
+	default:
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	}
+}
+
+//
+//
+//
+
+type selfMetric interface {
+	name() string
+	renderText(io.Writer)
+}
+
+type selfSample struct {
+	labelValues []string
+	value       float64
+}
+
+func renderSelfHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+func renderSelfLabels(labelNames, labelValues []string) string {
+	order := make([]int, len(labelNames))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return labelNames[order[i]] < labelNames[order[j]] })
+	parts := make([]string, len(order))
+	for i, x := range order {
+		parts[i] = fmt.Sprintf(`%s="%s"`, labelNames[x], labelValues[x])
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// selfCounter is an integer counter, optionally with labels. Incrementing an
+// existing series only takes a read lock.
+type selfCounter struct {
+	n, h       string
+	labelNames []string
+
+	mtx    sync.RWMutex
+	values map[string]*selfCounterValue
+}
+
+type selfCounterValue struct {
+	value       uint64 // atomic, first for alignment
+	labelValues []string
+}
+
+func newSelfCounter(name, help string, labelNames ...string) *selfCounter {
+	return &selfCounter{
+		n:          name,
+		h:          help,
+		labelNames: labelNames,
+		values:     map[string]*selfCounterValue{},
+	}
+}
+
+func (c *selfCounter) name() string { return c.n }
+
+func (c *selfCounter) add(delta uint64, labelValues ...string) {
+	k := strings.Join(labelValues, "\xff")
+	c.mtx.RLock()
+	v, ok := c.values[k]
+	c.mtx.RUnlock()
+	if !ok {
+		c.mtx.Lock()
+		if v, ok = c.values[k]; !ok {
+			v = &selfCounterValue{labelValues: labelValues}
+			c.values[k] = v
+		}
+		c.mtx.Unlock()
+	}
+	atomic.AddUint64(&v.value, delta)
+}
+
+func (c *selfCounter) value(labelValues ...string) uint64 {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	if v, ok := c.values[strings.Join(labelValues, "\xff")]; ok {
+		return atomic.LoadUint64(&v.value)
+	}
+	return 0
+}
+
+func (c *selfCounter) renderText(w io.Writer) {
+	renderSelfHeader(w, c.n, c.h, "counter")
+	c.mtx.RLock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) <= 0 && len(c.labelNames) <= 0 {
+		fmt.Fprintf(w, "%s{} 0\n", c.n)
+	}
+	for _, k := range keys {
+		v := c.values[k]
+		fmt.Fprintf(w, "%s%s %d\n", c.n, renderSelfLabels(c.labelNames, v.labelValues), atomic.LoadUint64(&v.value))
+	}
+	c.mtx.RUnlock()
+}
+
+// selfGauge is an unlabeled integer gauge.
+type selfGauge struct {
+	n, h  string
+	value int64 // atomic
+}
+
+func newSelfGauge(name, help string) *selfGauge {
+	return &selfGauge{n: name, h: help}
+}
+
+func (g *selfGauge) name() string { return g.n }
+
+func (g *selfGauge) add(delta int64) { atomic.AddInt64(&g.value, delta) }
+
+func (g *selfGauge) renderText(w io.Writer) {
+	renderSelfHeader(w, g.n, g.h, "gauge")
+	fmt.Fprintf(w, "%s{} %d\n", g.n, atomic.LoadInt64(&g.value))
+}
+
+// selfFunc is a counter or gauge whose samples are computed at scrape time.
+type selfFunc struct {
+	n, h, typ  string
+	labelNames []string
+	samples    func() []selfSample
+}
+
+func newSelfGaugeFunc(name, help string, labelNames []string, samples func() []selfSample) *selfFunc {
+	return &selfFunc{n: name, h: help, typ: "gauge", labelNames: labelNames, samples: samples}
+}
+
+func newSelfCounterFunc(name, help string, labelNames []string, samples func() []selfSample) *selfFunc {
+	return &selfFunc{n: name, h: help, typ: "counter", labelNames: labelNames, samples: samples}
+}
+
+func (f *selfFunc) name() string { return f.n }
+
+func (f *selfFunc) renderText(w io.Writer) {
+	renderSelfHeader(w, f.n, f.h, f.typ)
+	lines := []string{}
+	for _, s := range f.samples() {
+		lines = append(lines, fmt.Sprintf("%s%s %f\n", f.n, renderSelfLabels(f.labelNames, s.labelValues), s.value))
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprint(w, line)
+	}
+}
+
+// selfHistogram is an unlabeled histogram.
+type selfHistogram struct {
+	n, h    string
+	buckets []float64
+
+	mtx    sync.Mutex
+	counts []uint64 // by bucket
+	sum    float64
+	count  uint64
+}
+
+func newSelfHistogram(name, help string, buckets []float64) *selfHistogram {
+	return &selfHistogram{n: name, h: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *selfHistogram) name() string { return h.n }
+
+func (h *selfHistogram) observe(value float64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for i, max := range h.buckets {
+		if value <= max {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *selfHistogram) renderText(w io.Writer) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	renderSelfHeader(w, h.n, h.h, "histogram")
+	for i, max := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", h.n, max, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.n, h.count)
+	fmt.Fprintf(w, "%s_sum{} %f\n", h.n, h.sum)
+	fmt.Fprintf(w, "%s_count{} %d\n", h.n, h.count)
+}
+
+// internMetrics returns the telemetry of an interner.
+func internMetrics(i *aggregator.Interner) []selfMetric {
+	stat := func(f func(aggregator.InternStats) float64) func() []selfSample {
+		return func() []selfSample { return []selfSample{{value: f(i.Stats())}} }
+	}
+	return []selfMetric{
+		newSelfCounterFunc("aggregator_intern_hits_total", "Total number of strings found in the intern table.", nil, stat(func(s aggregator.InternStats) float64 { return float64(s.Hits) })),
+		newSelfCounterFunc("aggregator_intern_misses_total", "Total number of strings not found in the intern table.", nil, stat(func(s aggregator.InternStats) float64 { return float64(s.Misses) })),
+		newSelfGaugeFunc("aggregator_intern_strings", "Current number of interned strings.", nil, stat(func(s aggregator.InternStats) float64 { return float64(s.Strings) })),
+		newSelfGaugeFunc("aggregator_intern_bytes", "Current total length of interned strings.", nil, stat(func(s aggregator.InternStats) float64 { return float64(s.Bytes) })),
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestTelemetry(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	tm := newTelemetry(u)
+	src, w := io.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newIngester(u, tm, log.NewNopLogger()).handleConn(src)
+	}()
+
+	fmt.Fprintln(w, `{"name":"foo","type":"counter","help":"Total foos.","value":1}`)
+	fmt.Fprintln(w, `foo{} 2`)
+	fmt.Fprintln(w, `foo{} A`)
+	fmt.Fprintln(w, `bar{} 1`)
+	fmt.Fprintln(w, string([]byte{31, 139, 0, 0}))
+	w.Close()
+	<-done
+
+	for _, testcase := range []struct {
+		c      *selfCounter
+		labels []string
+		want   uint64
+	}{
+		{tm.linesReceived, nil, 5},
+		{tm.linesAccepted, nil, 2},
+		{tm.linesRejected, []string{rejectParse}, 1},
+		{tm.linesRejected, []string{rejectObserve}, 1},
+		{tm.linesRejected, []string{rejectDecompress}, 1},
+		{tm.decompressionFailures, nil, 1},
+		{tm.rejections, []string{aggregator.ReasonBadValue, sourceLocal}, 1},
+		{tm.rejections, []string{aggregator.ReasonUnknownMetric, sourceLocal}, 1},
+		{tm.rejections, []string{reasonDecompress, sourceLocal}, 1},
+	} {
+		if want, have := testcase.want, testcase.c.value(testcase.labels...); want != have {
+			t.Errorf("%s%v: want %d, have %d", testcase.c.name(), testcase.labels, want, have)
+		}
+	}
+
+	output := scrape(t, exposition(u, tm))
+	for _, want := range []string{
+		`foo{} 3.000000`,
+		`aggregator_lines_rejected_total{reason="parse"} 1`,
+		`aggregator_family_series{family="foo"} 1.000000`,
+		`aggregator_tcp_connections_active{} 0`,
+		`# TYPE aggregator_scrape_duration_seconds histogram`,
+		`aggregator_line_bytes_count{} 4`,
+		`aggregator_line_duration_seconds_count{} 4`,
+		`aggregator_line_decompression_ratio_count{} 0`,
+		`# TYPE go_gc_heap_allocs_bytes_total counter`,
+		`aggregator_build_info{goversion="` + runtime.Version() + `",revision="unknown",version="HEAD (dev/unreleased)"} 1.000000`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output missing %q\n%s", want, output)
+		}
+	}
+}
+
+func TestRuntimeMetricName(t *testing.T) {
+	for input, want := range map[string]string{
+		"/gc/heap/allocs:bytes":               "go_gc_heap_allocs_bytes",
+		"/sched/goroutines:goroutines":        "go_sched_goroutines_goroutines",
+		"/godebug/non-default-behavior:x":     "go_godebug_non_default_behavior_x",
+		"/memory/classes/heap/free:bytes":     "go_memory_classes_heap_free_bytes",
+		"/cpu/classes/gc/mark/assist:cpu-sec": "go_cpu_classes_gc_mark_assist_cpu_sec",
+	} {
+		if have := runtimeMetricName(input); want != have {
+			t.Errorf("%s: want %s, have %s", input, want, have)
+		}
+	}
+}
+
+func TestOpenMetricsExposition(t *testing.T) {
+	u, _ := aggregator.NewUniverse(makeObservations(t, []string{
+		`{"name":"foo_seconds_total","type":"counter","help":"Total seconds of foo.","unit":"seconds"}`,
+	})...)
+	u.SetOpenMetrics(true)
+	loadObservations(t, u, makeObservations(t, []string{`foo_seconds_total{} 1`}))
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0")
+	exposition(u, newTelemetry(u)).ServeHTTP(rec, req)
+
+	if want, have := aggregator.OpenMetricsContentType, rec.Header().Get("Content-Type"); want != have {
+		t.Errorf("Content-Type: want %q, have %q", want, have)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE foo_seconds counter\n# UNIT foo_seconds seconds\nfoo_seconds_total{} 1.000000\n",
+		"# TYPE aggregator_lines_received counter\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("want %q, have none", want)
+		}
+	}
+	if strings.Contains(body, "\n\n") {
+		t.Error("want no blank lines, have some")
+	}
+	if want := "\n# EOF\n"; !strings.HasSuffix(body, want) || strings.Count(body, "# EOF") != 1 {
+		t.Errorf("want to end with a single %q, have %q", want, body[len(body)-20:])
+	}
+}
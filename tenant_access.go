@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"github.com/pkg/errors"
+)
+
+// Kinds of limit breached by observations rejected for exceeding one of
+// their tenant's quotas.
+const (
+	limitTenantLines  = "tenant_lines"
+	limitTenantBytes  = "tenant_bytes"
+	limitTenantSeries = "tenant_series"
+)
+
+// apiKeyHeader is the header of HTTP ingest requests with an API key. It
+// isn't Authorization, which basic auth of the web config file may use.
+const apiKeyHeader = "X-API-Key"
+
+// tenantConfig is a tenant in the tenants section of the config file. Zero
+// quotas are unlimited.
+type tenantConfig struct {
+	APIKeySHA256   []string `yaml:"api_key_sha256"` // hex SHA-256 digests of the tenant's API keys
+	MaxSeries      int      `yaml:"max_series"`
+	LinesPerSecond float64  `yaml:"lines_per_second"`
+	BytesPerSecond float64  `yaml:"bytes_per_second"`
+}
+
+// tenantAccess authenticates the clients of tenants by API key, and holds
+// tenants to their quotas, so that one tenant can't use up another's
+// capacity. A tenant with API keys only accepts observations from clients
+// that authenticated with one of them; other tenants accept observations
+// from any client. Quotas are token buckets, like the rate limiter's, and
+// usage is only counted for tenants in the config file, so that it can't be
+// inflated by made-up tenants.
+type tenantAccess struct {
+	label   string
+	tenants map[string]tenantConfig
+	keys    map[[sha256.Size]byte]string // tenant by API key digest
+	maxLine int                          // byte buckets hold at least this much, so any line fits
+	now     func() time.Time
+
+	mtx     sync.Mutex
+	buckets map[string]*sourceBuckets
+
+	lines, bytes, rejections *selfCounter
+}
+
+func newTenantAccess(label string, tenants map[string]tenantConfig) (*tenantAccess, error) {
+	a := &tenantAccess{
+		label:      label,
+		tenants:    tenants,
+		keys:       map[[sha256.Size]byte]string{},
+		maxLine:    defaultMaxLineBytes,
+		now:        time.Now,
+		buckets:    map[string]*sourceBuckets{},
+		lines:      newSelfCounter("aggregator_tenant_lines_total", "Total number of lines within the quotas of each tenant in the config file.", "tenant"),
+		bytes:      newSelfCounter("aggregator_tenant_bytes_total", "Total number of bytes of lines within the quotas of each tenant in the config file.", "tenant"),
+		rejections: newSelfCounter("aggregator_tenant_quota_rejections_total", "Total number of observations rejected for exceeding a quota of their tenant, by tenant and quota.", "tenant", "quota"),
+	}
+	for tenant, c := range tenants {
+		if tenant == "" {
+			return nil, fmt.Errorf("tenants: name is required")
+		}
+		if c.MaxSeries < 0 || c.LinesPerSecond < 0 || c.BytesPerSecond < 0 {
+			return nil, fmt.Errorf("tenants: %s: quotas can't be negative", tenant)
+		}
+		for i, digest := range c.APIKeySHA256 {
+			var k [sha256.Size]byte
+			if n, err := hex.Decode(k[:], []byte(digest)); err != nil || n != len(k) || len(digest) != hex.EncodedLen(len(k)) {
+				return nil, fmt.Errorf("tenants: %s: api_key_sha256: %d: want a hex SHA-256 digest", tenant, i)
+			}
+			if other, ok := a.keys[k]; ok && other != tenant {
+				return nil, fmt.Errorf("tenants: %s: api_key_sha256: %d: the key of tenant %s too", tenant, i, other)
+			}
+			a.keys[k] = tenant
+		}
+		a.buckets[tenant] = &sourceBuckets{}
+	}
+	return a, nil
+}
+
+// keyed reports whether the tenant only accepts observations from clients
+// that authenticated with one of its API keys.
+func (a *tenantAccess) keyed(tenant string) bool {
+	return len(a.tenants[tenant].APIKeySHA256) > 0
+}
+
+// handshake authenticates the key of a handshake, and, if it's valid, or the
+// handshake's tenant needs no key, sets the tenant label on every
+// observation of the connection, as an input's labels are set. Without a
+// tenant label, a handshake can't have a tenant or a key.
+func (a *tenantAccess) handshake(h *handshake) error {
+	if h.Tenant == "" && h.Key == "" {
+		return nil
+	}
+	if a == nil {
+		return errors.New("tenants aren't supported without -ingest.tenant-label")
+	}
+	tenant := h.Tenant
+	if h.Key != "" {
+		t, ok := a.keys[sha256.Sum256([]byte(h.Key))]
+		switch {
+		case !ok:
+			return errors.New("invalid API key")
+		case tenant != "" && tenant != t:
+			return fmt.Errorf("API key isn't for tenant %q", tenant)
+		}
+		tenant, h.tenant = t, t
+	} else if a.keyed(tenant) {
+		return fmt.Errorf("tenant %q requires an API key", tenant)
+	}
+	labels := make(map[string]string, len(h.labels)+1)
+	for k, v := range h.labels {
+		labels[k] = v
+	}
+	labels[a.label] = tenant
+	h.labels = labels
+	return nil
+}
+
+// check returns an error if an observation of size bytes, sent by id, is
+// for a tenant with API keys that id didn't authenticate as, or exceeds one
+// of its tenant's rate quotas, and otherwise takes it out of them.
+// Declarations, and observations without a tenant, are always allowed.
+func (a *tenantAccess) check(id identity, obs aggregator.Observation, size int) error {
+	if a == nil || obs.Value == nil {
+		return nil
+	}
+	tenant := obs.Labels[a.label]
+	if tenant == "" {
+		return nil
+	}
+	if a.keyed(tenant) && id.tenant != tenant {
+		return unauthorizedError{tenant}
+	}
+	c, ok := a.tenants[tenant]
+	if !ok {
+		return nil
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	var (
+		now = a.now()
+		b   = a.buckets[tenant]
+	)
+	b.lines.refill(now, c.LinesPerSecond, math.Max(c.LinesPerSecond, 1))
+	b.bytes.refill(now, c.BytesPerSecond, math.Max(c.BytesPerSecond, float64(a.maxLine)))
+	if !b.lines.has(c.LinesPerSecond, 1) {
+		a.rejections.add(1, tenant, "lines")
+		return aggregator.LimitError{Limit: limitTenantLines, Err: fmt.Errorf("tenant %s exceeds its quota of %g lines per second", tenant, c.LinesPerSecond)}
+	}
+	if !b.bytes.has(c.BytesPerSecond, float64(size)) {
+		a.rejections.add(1, tenant, "bytes")
+		return aggregator.LimitError{Limit: limitTenantBytes, Err: fmt.Errorf("tenant %s exceeds its quota of %g bytes per second", tenant, c.BytesPerSecond)}
+	}
+	b.lines.take(c.LinesPerSecond, 1)
+	b.bytes.take(c.BytesPerSecond, float64(size))
+	a.lines.add(1, tenant)
+	a.bytes.add(uint64(size), tenant)
+	return nil
+}
+
+// checkSeries returns an error if observing o in the universe of its tenant,
+// u, would create a series beyond the tenant's max_series. Concurrent
+// observations may create a few more.
+func (a *tenantAccess) checkSeries(tenant string, u *aggregator.Universe, o aggregator.Observation) error {
+	if a == nil {
+		return nil
+	}
+	max := a.tenants[tenant].MaxSeries
+	if max <= 0 {
+		return nil
+	}
+	if _, _, newSeries, _ := u.DryRun(o); !newSeries || totalSeries(u.SeriesCounts()) < max {
+		return nil
+	}
+	a.rejections.add(1, tenant, "series")
+	return aggregator.LimitError{Limit: limitTenantSeries, Err: fmt.Errorf("tenant %s has its quota of %d series, so new series are rejected", tenant, max)}
+}
+
+// metrics returns the usage of each tenant in the config file, including
+// the series in its universe, if it has one, in r.
+func (a *tenantAccess) metrics(r *tenantRouter) []selfMetric {
+	return []selfMetric{
+		a.lines,
+		a.bytes,
+		a.rejections,
+		newSelfGaugeFunc("aggregator_tenant_series", "Current number of series of each tenant in the config file.", []string{"tenant"}, func() []selfSample {
+			names := make([]string, 0, len(a.tenants))
+			for tenant := range a.tenants {
+				names = append(names, tenant)
+			}
+			sort.Strings(names)
+			var samples []selfSample
+			for _, tenant := range names {
+				if u, ok := r.lookup(tenant); ok {
+					samples = append(samples, selfSample{labelValues: []string{tenant}, value: float64(totalSeries(u.SeriesCounts()))})
+				}
+			}
+			return samples
+		}),
+	}
+}
+
+// unauthorizedError is the error for an observation of a tenant with API
+// keys from a client that didn't authenticate as the tenant.
+type unauthorizedError struct{ tenant string }
+
+func (e unauthorizedError) Error() string {
+	return fmt.Sprintf("not authenticated as tenant %q", e.tenant)
+}
+
+// isQuotaError returns true if err, which may be wrapped, is for exceeding a
+// tenant's quota.
+func isQuotaError(err error) bool {
+	if e, ok := errors.Cause(err).(aggregator.LimitError); ok {
+		switch e.Limit {
+		case limitTenantLines, limitTenantBytes, limitTenantSeries:
+			return true
+		}
+	}
+	return false
+}
+
+// ingestStatus is the status of an HTTP ingest response whose first rejected
+// line was rejected with err: 429 for a tenant's quota, 403 for a tenant the
+// client isn't authenticated as, and otherwise 400.
+func ingestStatus(err error) int {
+	switch {
+	case isQuotaError(err):
+		return http.StatusTooManyRequests
+	case isUnauthorized(err):
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+func isUnauthorized(err error) bool {
+	_, ok := errors.Cause(err).(unauthorizedError)
+	return ok
+}
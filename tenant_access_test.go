@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestTenantAccess(t *testing.T) {
+	digest := func(key string) string {
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	}
+	newAccess := func(t *testing.T) (*ingester, *tenantRouter) {
+		t.Helper()
+		u, _ := aggregator.NewUniverse()
+		r, err := newTenantRouter("tenant", u, 10, func(decls []aggregator.Observation) (*aggregator.Universe, error) {
+			return aggregator.NewUniverse(decls...)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := newTenantAccess("tenant", map[string]tenantConfig{
+			"a": {APIKeySHA256: []string{digest("key-a")}},
+			"b": {LinesPerSecond: 2},
+			"c": {BytesPerSecond: 30},
+			"d": {MaxSeries: 2}, // foo_total{}, declared at zero, and one more
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Unix(1000, 0)
+		a.now = func() time.Time { return now }
+		a.maxLine = 20
+		r.access = a
+		in := newIngester(r, newTelemetry(u), log.NewNopLogger())
+		in.tenants = a
+		in.handleConn(io.NopCloser(strings.NewReader(`{"name":"foo_total","type":"counter","help":"Foos."}`)))
+		return in, r
+	}
+
+	for name, tc := range map[string]struct {
+		lines    []string
+		accepted uint64
+		reason   string
+		tenant   string
+		labels   map[string]string
+		want     float64
+	}{
+		"key": {
+			lines:    []string{`HELLO {"key":"key-a"}`, `foo_total{} 1`, `foo_total{} 2`},
+			accepted: 2,
+			tenant:   "a",
+			want:     3,
+		},
+		"key and tenant": {
+			lines:    []string{`HELLO {"tenant":"a","key":"key-a"}`, `foo_total{} 1`},
+			accepted: 1,
+			tenant:   "a",
+			want:     1,
+		},
+		"no key": {
+			lines:  []string{`foo_total{tenant="a"} 1`},
+			reason: rejectUnauthorized,
+		},
+		"another tenant's label": {
+			lines:    []string{`HELLO {"key":"key-a"}`, `foo_total{tenant="b"} 1`},
+			accepted: 1,
+			tenant:   "a",
+			want:     1,
+		},
+		"lines": {
+			lines:    []string{`foo_total{tenant="b"} 1`, `foo_total{tenant="b"} 2`, `foo_total{tenant="b"} 3`},
+			accepted: 2,
+			reason:   rejectQuota,
+			tenant:   "b",
+			want:     3,
+		},
+		"bytes": {
+			lines:    []string{`foo_total{tenant="c"} 1`, `foo_total{tenant="c"} 2`},
+			accepted: 1,
+			reason:   rejectQuota,
+			tenant:   "c",
+			want:     1,
+		},
+		"series": {
+			reason:   rejectObserve,
+			lines:    []string{`foo_total{tenant="d",code="200"} 1`, `foo_total{tenant="d",code="500"} 2`, `foo_total{tenant="d",code="200"} 3`},
+			accepted: 2,
+			tenant:   "d",
+			labels:   map[string]string{"code": "200"},
+			want:     4,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			in, r := newAccess(t)
+			in.handleConn(io.NopCloser(strings.NewReader(strings.Join(tc.lines, "\n"))))
+			if want, have := tc.accepted+1, in.t.linesAccepted.value(); want != have {
+				t.Errorf("lines accepted: want %d, have %d", want, have)
+			}
+			if tc.reason != "" {
+				if have := in.t.linesRejected.value(tc.reason); have != 1 {
+					t.Errorf("lines rejected for %s: want 1, have %d", tc.reason, have)
+				}
+			}
+			if tc.want == 0 {
+				return
+			}
+			u, ok := r.lookup(tc.tenant)
+			if !ok {
+				t.Fatalf("tenant %s: want a universe, have none", tc.tenant)
+			}
+			if s, ok := u.Lookup("foo_total", tc.labels); !ok || *s.Value != tc.want {
+				t.Errorf("tenant %s: want foo_total%v %g, have %+v", tc.tenant, tc.labels, tc.want, s)
+			}
+		})
+	}
+
+	t.Run("HTTP", func(t *testing.T) {
+		for name, tc := range map[string]struct {
+			key  string
+			body string
+			want int
+		}{
+			"key":         {"key-a", `foo_total{} 1`, http.StatusNoContent},
+			"invalid key": {"key-b", `foo_total{} 1`, http.StatusUnauthorized},
+			"no key":      {"", `foo_total{tenant="a"} 1`, http.StatusForbidden},
+			"quota":       {"", "foo_total{tenant=\"b\"} 1\nfoo_total{tenant=\"b\"} 2\nfoo_total{tenant=\"b\"} 3", http.StatusTooManyRequests},
+		} {
+			t.Run(name, func(t *testing.T) {
+				in, _ := newAccess(t)
+				req := httptest.NewRequest("POST", "/write", strings.NewReader(tc.body))
+				if tc.key != "" {
+					req.Header.Set(apiKeyHeader, tc.key)
+				}
+				rec := httptest.NewRecorder()
+				ingestHandler(in).ServeHTTP(rec, req)
+				if want, have := tc.want, rec.Code; want != have {
+					t.Errorf("code: want %d, have %d: %s", want, have, rec.Body)
+				}
+			})
+		}
+	})
+
+	t.Run("config", func(t *testing.T) {
+		for name, tenants := range map[string]map[string]tenantConfig{
+			"bad digest":    {"a": {APIKeySHA256: []string{"abc"}}},
+			"shared key":    {"a": {APIKeySHA256: []string{digest("k")}}, "b": {APIKeySHA256: []string{digest("k")}}},
+			"negative rate": {"a": {LinesPerSecond: -1}},
+		} {
+			if _, err := newTenantAccess("tenant", tenants); err == nil {
+				t.Errorf("%s: want error, have none", name)
+			}
+		}
+	})
+}
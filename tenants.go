@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"github.com/pkg/errors"
+)
+
+// limitTenants is the kind of limit breached by lines rejected for a new
+// tenant once -ingest.max-tenants have universes.
+const limitTenants = "tenants"
+
+// defaultMaxTenants is the default maximum number of tenant universes.
+const defaultMaxTenants = 100
+
+// tenantRouter is an Observer that observes each observation with the tenant
+// label in a universe of the tenant's own, without the label, so that one
+// listener can feed isolated universes, scraped separately. Observations
+// without the label, and declarations, are observed in the default universe.
+// Declarations are observed, or declared, in every tenant's universe too, and
+// a tenant's universe is created with the declarations of the default
+// universe, so that every tenant accepts the same metrics.
+type tenantRouter struct {
+	label       string
+	u           *aggregator.Universe
+	max         int
+	newUniverse func(decls []aggregator.Observation) (*aggregator.Universe, error)
+	access      *tenantAccess // nil doesn't hold tenants to max_series
+
+	mtx     sync.RWMutex
+	tenants map[string]*aggregator.Universe
+}
+
+func newTenantRouter(label string, u *aggregator.Universe, max int, newUniverse func([]aggregator.Observation) (*aggregator.Universe, error)) (*tenantRouter, error) {
+	if label == "" {
+		return nil, fmt.Errorf("no tenant label")
+	}
+	if max <= 0 {
+		return nil, fmt.Errorf("maximum number of tenants must be positive")
+	}
+	return &tenantRouter{
+		label:       label,
+		u:           u,
+		max:         max,
+		newUniverse: newUniverse,
+		tenants:     map[string]*aggregator.Universe{},
+	}, nil
+}
+
+// Observe implements aggregator.Observer.
+func (r *tenantRouter) Observe(o aggregator.Observation) error {
+	if o.Value == nil {
+		return r.declare(o)
+	}
+	tenant := o.Labels[r.label]
+	if tenant == "" {
+		return r.u.Observe(o)
+	}
+	labels := make(map[string]string, len(o.Labels)-1)
+	for k, v := range o.Labels {
+		if k != r.label {
+			labels[k] = v
+		}
+	}
+	o.Labels = labels
+	u, err := r.universe(tenant)
+	if err != nil {
+		return err
+	}
+	if err := r.access.checkSeries(tenant, u, o); err != nil {
+		return err
+	}
+	return u.Observe(o)
+}
+
+// ObserveBatch implements aggregator.Observer.
+func (r *tenantRouter) ObserveBatch(obs []aggregator.Observation) error {
+	return aggregator.ObserveEach(r, obs)
+}
+
+// declare observes a declaration in the default universe, and, if it's
+// accepted, in every tenant's universe, where it's expected to be accepted
+// too. If a tenant's universe rejects it, the first such error is returned.
+func (r *tenantRouter) declare(o aggregator.Observation) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err := r.u.Observe(o); err != nil {
+		return err
+	}
+	var first error
+	for tenant, u := range r.tenants {
+		if err := u.Observe(o); err != nil && first == nil {
+			first = errors.Wrapf(err, "tenant %s", tenant)
+		}
+	}
+	return first
+}
+
+// Declare implements declarer, declaring o in the default universe, and, if
+// it's accepted, in every tenant's universe, as declare observes it. It
+// reports whether o was added to the default universe.
+func (r *tenantRouter) Declare(o aggregator.Observation) (bool, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	added, err := r.u.Declare(o)
+	if err != nil {
+		return false, err
+	}
+	var first error
+	for tenant, u := range r.tenants {
+		if _, err := u.Declare(o); err != nil && first == nil {
+			first = errors.Wrapf(err, "tenant %s", tenant)
+		}
+	}
+	return added, first
+}
+
+// universe returns the tenant's universe, creating it if there are fewer
+// than the maximum.
+func (r *tenantRouter) universe(tenant string) (*aggregator.Universe, error) {
+	r.mtx.RLock()
+	u, ok := r.tenants[tenant]
+	r.mtx.RUnlock()
+	if ok {
+		return u, nil
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if u, ok := r.tenants[tenant]; ok {
+		return u, nil
+	}
+	if len(r.tenants) >= r.max {
+		return nil, aggregator.LimitError{Limit: limitTenants, Err: fmt.Errorf("tenant %q exceeds the maximum of %d tenants", tenant, r.max)}
+	}
+	u, err := r.newUniverse(r.u.Declarations())
+	if err != nil {
+		return nil, err
+	}
+	r.tenants[tenant] = u
+	return u, nil
+}
+
+// lookup returns the tenant's universe, if it has one.
+func (r *tenantRouter) lookup(tenant string) (*aggregator.Universe, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	u, ok := r.tenants[tenant]
+	return u, ok
+}
+
+// names returns the sorted names of the tenants.
+func (r *tenantRouter) names() []string {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	names := make([]string, 0, len(r.tenants))
+	for name := range r.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// expire expires the series of every tenant's universe, as in
+// Universe.Expire, returning the number expired. Series over the memory
+// limit, which tenants share with the default universe, are evicted by the
+// default universe.
+func (r *tenantRouter) expire(now time.Time, defaultTTL time.Duration) int {
+	var expired int
+	for _, name := range r.names() {
+		if u, ok := r.lookup(name); ok {
+			expired += u.Expire(now, defaultTTL)
+		}
+	}
+	return expired
+}
+
+// metrics returns the tenant router's self-telemetry.
+func (r *tenantRouter) metrics() []selfMetric {
+	return []selfMetric{
+		newSelfGaugeFunc("aggregator_tenants", "Current number of tenants with a universe of their own.", nil, func() []selfSample {
+			r.mtx.RLock()
+			defer r.mtx.RUnlock()
+			return []selfSample{{value: float64(len(r.tenants))}}
+		}),
+	}
+}
+
+// tenantHandler serves the tenant's universe for scrapes with a tenant query
+// parameter, e.g. /metrics?tenant=team-a, and otherwise next. A tenant's
+// universe is served without the aggregator's self-telemetry, and, like the
+// default universe, only by the leader.
+func tenantHandler(r *tenantRouter, leader *leaseElector, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tenant := req.URL.Query().Get("tenant")
+		if tenant == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		u, ok := r.lookup(tenant)
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown tenant %q", tenant), http.StatusNotFound)
+			return
+		}
+		serveUniverse(w, req, u, leader)
+	})
+}
+
+// tenantSnapshotHandler serves the snapshot of the tenant's universe, as
+// snapshotHandler, for requests with a tenant query parameter, and otherwise
+// next. Restoring a snapshot creates the tenant's universe, if it has none.
+func tenantSnapshotHandler(r *tenantRouter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tenant := req.URL.Query().Get("tenant")
+		if tenant == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		u, ok := r.lookup(tenant)
+		switch {
+		case ok:
+		case req.Method == "POST":
+			var err error
+			if u, err = r.universe(tenant); err != nil {
+				code := http.StatusInternalServerError
+				if isLimitError(err) {
+					code = http.StatusTooManyRequests
+				}
+				respondError(w, code, err.Error())
+				return
+			}
+		default:
+			respondError(w, http.StatusNotFound, fmt.Sprintf("unknown tenant %q", tenant))
+			return
+		}
+		snapshotHandler(u).ServeHTTP(w, req)
+	})
+}
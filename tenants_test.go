@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestTenantRouter(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	r, err := newTenantRouter("tenant", u, 2, func(decls []aggregator.Observation) (*aggregator.Universe, error) {
+		return aggregator.NewUniverse(decls...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newIngester(r, newTelemetry(u), log.NewNopLogger())
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`{"name":"foo_total","type":"counter","help":"Foos."}`,
+		`foo_total{code="200"} 1`,
+		`foo_total{code="200",tenant="a"} 2`,
+		`foo_total{code="500",tenant="b"} 3`,
+		`{"name":"bar","type":"gauge","help":"Bars."}`,
+		`bar{tenant="a"} 4`,
+		`foo_total{tenant="c"} 5`, // over the maximum
+	}, "\n"))))
+	if want, have := uint64(6), in.t.linesAccepted.value(); want != have {
+		t.Errorf("lines accepted: want %d, have %d", want, have)
+	}
+
+	for name, tc := range map[string]struct {
+		tenant string
+		want   string
+		code   int
+	}{
+		"default": {"", `foo_total{code="200"} 1`, http.StatusOK},
+		"a":       {"a", `foo_total{code="200"} 2`, http.StatusOK},
+		"b":       {"b", `foo_total{code="500"} 3`, http.StatusOK},
+		"c":       {"c", "", http.StatusNotFound},
+	} {
+		t.Run(name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { u.ServeHTTP(w, req) })
+			rec := httptest.NewRecorder()
+			tenantHandler(r, nil, next).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics?tenant="+tc.tenant, nil))
+			if want, have := tc.code, rec.Code; want != have {
+				t.Fatalf("code: want %d, have %d", want, have)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tc.want) || strings.Contains(body, "tenant=") {
+				t.Errorf("want %s, and no tenant label, have\n%s", tc.want, body)
+			}
+		})
+	}
+
+	// Only the leader serves tenants, like the default universe.
+	rec := httptest.NewRecorder()
+	tenantHandler(r, &leaseElector{}, u).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics?tenant=a", nil))
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("follower: want %d, have %d", want, have)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "foo_total") {
+		t.Errorf("follower: want no series, have\n%s", body)
+	}
+
+	// Declarations reach every tenant, even those created before them.
+	a, _ := r.lookup("a")
+	if _, ok := a.Lookup("bar", nil); !ok {
+		t.Errorf("tenant a: want bar, have none")
+	}
+	if want, have := []string{"a", "b"}, r.names(); strings.Join(want, ",") != strings.Join(have, ",") {
+		t.Errorf("tenants: want %v, have %v", want, have)
+	}
+}
+
+func TestTenantSnapshotHandler(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	r, err := newTenantRouter("tenant", u, 1, func(decls []aggregator.Observation) (*aggregator.Universe, error) {
+		return aggregator.NewUniverse(decls...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newIngester(r, newTelemetry(u), log.NewNopLogger())
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`{"name":"foo_total","type":"counter","help":"Foos."}`,
+		`foo_total{code="200"} 1`,
+		`foo_total{code="200",tenant="a"} 2`,
+	}, "\n"))))
+	h := tenantSnapshotHandler(r, snapshotHandler(u))
+	do := func(method, tenant string, body io.Reader) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, "/api/v1/snapshot?tenant="+tenant, body))
+		return rec
+	}
+
+	rec := do("GET", "a", nil)
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("GET a: want %d, have %d", want, have)
+	}
+	snapshot := rec.Body.String()
+	if !strings.Contains(snapshot, "foo_total") || strings.Contains(snapshot, "tenant") {
+		t.Errorf("GET a: want foo_total, without the tenant label, have\n%s", snapshot)
+	}
+	if want, have := http.StatusNotFound, do("GET", "b", nil).Code; want != have {
+		t.Errorf("GET an unknown tenant: want %d, have %d", want, have)
+	}
+	if want, have := http.StatusTooManyRequests, do("POST", "b", strings.NewReader(snapshot)).Code; want != have {
+		t.Errorf("POST over the maximum of tenants: want %d, have %d", want, have)
+	}
+	if want, have := http.StatusOK, do("POST", "a", strings.NewReader(snapshot)).Code; want != have {
+		t.Fatalf("POST a: want %d, have %d", want, have)
+	}
+	a, _ := r.lookup("a")
+	if s, ok := a.Lookup("foo_total", map[string]string{"code": "200"}); !ok || *s.Value != 4 {
+		t.Errorf("tenant a: want foo_total 4, merged, have %v", s)
+	}
+	if s, _ := u.Lookup("foo_total", map[string]string{"code": "200"}); *s.Value != 1 {
+		t.Errorf("default universe: want foo_total 1, unchanged, have %v", *s.Value)
+	}
+}
+
+func TestTenantRouterDeclare(t *testing.T) {
+	filename := writeConfig(t, "declarations: []\n")
+	c, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := aggregator.NewUniverse()
+	r, err := newTenantRouter("tenant", u, 2, func(decls []aggregator.Observation) (*aggregator.Universe, error) {
+		return aggregator.NewUniverse(decls...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newIngester(r, newTelemetry(u), log.NewNopLogger())
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`{"name":"foo_total","type":"counter","help":"Foos."}`,
+		`foo_total{tenant="a"} 1`,
+	}, "\n"))))
+
+	// Declarations from a reload, and from the API, reach existing tenants.
+	reload := newReloader(filename, c, map[string]bool{}, u, r, newSourceStats(defaultMaxSources), newRejectLogger(log.NewNopLogger(), defaultRejectSample), newRateLimiter(rateLimits{}, defaultMaxSources), newScrapeCache(u, 0), newTransformer(nil), nil, log.NewNopLogger())
+	if err := os.WriteFile(filename, []byte("declarations:\n  - name: bar\n    type: gauge\n    help: Bars.\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reload.reload(); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	declarationsHandler(u, r, nil).ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/declarations", strings.NewReader(`{"name":"baz","type":"gauge","help":"Bazs."}`)))
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("declarations: want %d, have %d: %s", want, have, rec.Body)
+	}
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`bar{tenant="a"} 2`,
+		`baz{tenant="a"} 3`,
+	}, "\n"))))
+	if want, have := uint64(4), in.t.linesAccepted.value(); want != have {
+		t.Errorf("lines accepted: want %d, have %d", want, have)
+	}
+	a, _ := r.lookup("a")
+	for _, name := range []string{"bar", "baz"} {
+		if _, ok := a.Lookup(name, nil); !ok {
+			t.Errorf("tenant a: want %s, have none", name)
+		}
+	}
+}
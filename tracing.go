@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// tracer records spans around the stages of the ingest pipeline, and exports
+// them in the OpenTelemetry protocol (OTLP) JSON encoding. A nil tracer, and
+// the nil spans it returns, are valid and do nothing, so the ingest path
+// doesn't need to check whether tracing is enabled.
+type tracer struct {
+	ratio float64 // fraction of root spans to sample
+	spans chan *span
+	sink  func([]*span) error
+	now   func() time.Time
+
+	mtx  sync.Mutex
+	rand *rand.Rand
+}
+
+type span struct {
+	t       *tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	start   time.Time
+	end     time.Time
+	attrs   []spanAttr
+	err     error
+}
+
+type spanAttr struct{ key, value string }
+
+const (
+	tracingBatchSize  = 512
+	tracingQueueSize  = 4096
+	tracingFlushEvery = 5 * time.Second
+)
+
+// newTracer returns a tracer that samples ratio of root spans, and exports
+// them to sink in batches. Spans are dropped if sink can't keep up.
+func newTracer(ratio float64, sink func([]*span) error) *tracer {
+	return &tracer{
+		ratio: ratio,
+		spans: make(chan *span, tracingQueueSize),
+		sink:  sink,
+		now:   time.Now,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// start begins a new root span, or returns nil if the span isn't sampled.
+func (t *tracer) start(name string) *span {
+	if t == nil || t.ratio <= 0 {
+		return nil
+	}
+	t.mtx.Lock()
+	sampled := t.rand.Float64() < t.ratio
+	var s *span
+	if sampled {
+		s = &span{t: t, name: name}
+		t.rand.Read(s.traceID[:])
+		t.rand.Read(s.spanID[:])
+	}
+	t.mtx.Unlock()
+	if s != nil {
+		s.start = t.now()
+	}
+	return s
+}
+
+// child begins a new span whose parent is s.
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{t: s.t, traceID: s.traceID, parent: s.spanID, name: name}
+	s.t.mtx.Lock()
+	s.t.rand.Read(c.spanID[:])
+	s.t.mtx.Unlock()
+	c.start = s.t.now()
+	return c
+}
+
+func (s *span) setAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, spanAttr{key, value})
+}
+
+// finish ends the span, marking it as failed if err is non-nil, and queues it
+// for export.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end, s.err = s.t.now(), err
+	select {
+	case s.t.spans <- s:
+	default: // drop
+	}
+}
+
+// run exports queued spans in batches until the context is canceled.
+func (t *tracer) run(ctx context.Context, logger log.Logger) error {
+	ticker := time.NewTicker(tracingFlushEvery)
+	defer ticker.Stop()
+	batch := make([]*span, 0, tracingBatchSize)
+	flush := func() {
+		if len(batch) <= 0 {
+			return
+		}
+		if err := t.sink(batch); err != nil {
+			level.Warn(logger).Log("tracing", "export failed", "spans", len(batch), "err", err)
+		}
+		batch = make([]*span, 0, tracingBatchSize)
+	}
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) >= tracingBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					flush()
+					return ctx.Err()
+				}
+			}
+		}
+	}
+}
+
+//
+//
+//
+
+// newTracingSink returns the sink for the named exporter: otlp posts spans to
+// endpoint, and stdout writes them to w. The none exporter returns a nil sink,
+// meaning tracing is disabled.
+func newTracingSink(exporter, endpoint string, w io.Writer) (func([]*span) error, error) {
+	switch exporter {
+	case "none", "":
+		return nil, nil
+	case "otlp":
+		if _, err := url.Parse(endpoint); err != nil {
+			return nil, errors.Wrap(err, "invalid endpoint")
+		}
+		return otlpSink(&http.Client{Timeout: 10 * time.Second}, endpoint), nil
+	case "stdout":
+		return writerSink(w), nil
+	default:
+		return nil, errors.Errorf("unsupported exporter %q", exporter)
+	}
+}
+
+// otlpSink returns a sink that posts spans to an OTLP/HTTP traces endpoint,
+// e.g. http://localhost:4318/v1/traces, using the JSON encoding.
+func otlpSink(client *http.Client, endpoint string) func([]*span) error {
+	return func(spans []*span) error {
+		buf, err := json.Marshal(otlpRequest(spans))
+		if err != nil {
+			return err
+		}
+		resp, err := client.Post(endpoint, "application/json", bytes.NewReader(buf))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode/100 != 2 {
+			return errors.Errorf("%s: %s", endpoint, resp.Status)
+		}
+		return nil
+	}
+}
+
+// writerSink returns a sink that writes spans to w as OTLP JSON, one request
+// object per line.
+func writerSink(w io.Writer) func([]*span) error {
+	var mtx sync.Mutex
+	return func(spans []*span) error {
+		buf, err := json.Marshal(otlpRequest(spans))
+		if err != nil {
+			return err
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		_, err = fmt.Fprintf(w, "%s\n", buf)
+		return err
+	}
+}
+
+// The following types are the subset of the OTLP JSON encoding we produce,
+// see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOK         = 1
+	otlpStatusError      = 2
+)
+
+func otlpRequest(spans []*span) otlpTraces {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: otlpStatusOK},
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for _, a := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpKeyValue{Key: a.key, Value: otlpAnyValue{StringValue: a.value}})
+		}
+		if s.err != nil {
+			o.Status = otlpStatus{Code: otlpStatusError, Message: s.err.Error()}
+		}
+		out[i] = o
+	}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: otlpAnyValue{StringValue: "prometheus-aggregator"}},
+			{Key: "service.version", Value: otlpAnyValue{StringValue: version}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/peterbourgon/prometheus-aggregator"},
+			Spans: out,
+		}},
+	}}}
+}
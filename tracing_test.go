@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestTracingIngest(t *testing.T) {
+	var spans []*span
+	tr := newTracer(1, func(batch []*span) error { spans = append(spans, batch...); return nil })
+
+	u, _ := aggregator.NewUniverse()
+	in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+	in.tracer = tr
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`foo_total{} 1`,
+		`bogus`,
+	}, "\n"))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tr.run(ctx, log.NewNopLogger())
+
+	var have []string
+	roots := map[[8]byte]*span{}
+	for _, s := range spans {
+		if s.parent == [8]byte{} {
+			roots[s.spanID] = s
+		}
+	}
+	for _, s := range spans {
+		name := s.name
+		if root, ok := roots[s.parent]; ok {
+			if root.traceID != s.traceID {
+				t.Errorf("%s: trace ID doesn't match parent", s.name)
+			}
+			name = root.name + "/" + name
+		}
+		if s.err != nil {
+			name += " (error)"
+		}
+		have = append(have, name)
+	}
+	sort.Strings(have)
+	want := []string{
+		"ingest.line",
+		"ingest.line",
+		"ingest.line (error)",
+		"ingest.line/decompress",
+		"ingest.line/decompress",
+		"ingest.line/decompress",
+		"ingest.line/observe",
+		"ingest.line/observe",
+		"ingest.line/parse",
+		"ingest.line/parse",
+		"ingest.line/parse (error)",
+	}
+	if !cmp.Equal(want, have) {
+		t.Fatal(cmp.Diff(want, have))
+	}
+}
+
+func TestTracingSampleRatio(t *testing.T) {
+	if s := newTracer(0, nil).start("x"); s != nil {
+		t.Errorf("ratio 0: want nil span, have %v", s)
+	}
+	var tr *tracer
+	s := tr.start("x")
+	s.child("y").finish(nil)
+	s.setAttr("k", "v")
+	s.finish(nil) // nil tracer and spans are no-ops
+}
+
+func TestOTLPSink(t *testing.T) {
+	var have otlpTraces
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if want, have := "application/json", r.Header.Get("content-type"); want != have {
+			t.Errorf("content-type: want %q, have %q", want, have)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&have); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	tr := newTracer(1, nil)
+	root := tr.start("ingest.packet")
+	root.setAttr("source", "127.0.0.1")
+	child := root.child("parse")
+	child.finish(io.ErrUnexpectedEOF)
+	root.finish(nil)
+
+	if err := otlpSink(server.Client(), server.URL)([]*span{root, child}); err != nil {
+		t.Fatal(err)
+	}
+	spans := have.ResourceSpans[0].ScopeSpans[0].Spans
+	if want, have := 2, len(spans); want != have {
+		t.Fatalf("spans: want %d, have %d", want, have)
+	}
+	if want, have := 32, len(spans[0].TraceID); want != have {
+		t.Errorf("trace ID length: want %d, have %d", want, have)
+	}
+	if want, have := spans[0].SpanID, spans[1].ParentSpanID; want != have {
+		t.Errorf("parent span ID: want %q, have %q", want, have)
+	}
+	if want, have := []otlpKeyValue{{Key: "source", Value: otlpAnyValue{StringValue: "127.0.0.1"}}}, spans[0].Attributes; !cmp.Equal(want, have) {
+		t.Error(cmp.Diff(want, have))
+	}
+	if want, have := (otlpStatus{Code: otlpStatusError, Message: io.ErrUnexpectedEOF.Error()}), spans[1].Status; want != have {
+		t.Errorf("status: want %+v, have %+v", want, have)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+	"github.com/pkg/errors"
+)
+
+// transformRule is a site-specific normalization from the transforms section
+// of the config file. It's applied to each received observation whose name
+// and labels match.
+type transformRule struct {
+	Match       string            `yaml:"match"`        // regexp on the name; empty matches every name
+	Template    string            `yaml:"template"`     // instead of match, e.g. svc.{service}.http.{code}.count
+	MatchLabels map[string]string `yaml:"match_labels"` // regexps on label values; a missing label is ""
+	Rename      string            `yaml:"rename"`       // $1 etc. expand to submatches of match
+	SetLabels   map[string]string `yaml:"set_labels"`
+	DropLabels  []string          `yaml:"drop_labels"`
+	Scale       *float64          `yaml:"scale"`   // multiplies the value
+	Convert     *unitConversion   `yaml:"convert"` // only applies to names with the from unit's suffix
+	Drop        bool              `yaml:"drop"`    // discards the observation
+	Expr        string            `yaml:"expr"`    // returns the actions, see evaluate
+}
+
+// transform is a compiled transformRule.
+type transform struct {
+	transformRule
+	name     *regexp.Regexp
+	labels   map[string]*regexp.Regexp
+	captures []string    // labels captured by the template, by submatch
+	convert  *conversion // nil doesn't convert
+	program  *vm.Program // the compiled expr, or nil
+}
+
+// templateLabel is a placeholder of a template, which captures a label.
+var templateLabel = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// validLabelName matches the label names that templates can capture, which
+// are also valid names of submatches.
+var validLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// compileTemplate compiles a template of a structured name, like
+// svc.{service}.http.{code}.count, into a regexp on the name, in which each
+// placeholder captures one dot-separated part of the name, as the label it
+// names, and returns the labels, in order of their submatches. Otherwise, the
+// template matches literally.
+func compileTemplate(template string) (*regexp.Regexp, []string, error) {
+	var (
+		expr     strings.Builder
+		captures []string
+		last     int
+	)
+	for _, m := range templateLabel.FindAllStringSubmatchIndex(template, -1) {
+		label := template[m[2]:m[3]]
+		if !validLabelName.MatchString(label) {
+			return nil, nil, fmt.Errorf("invalid label name %q", label)
+		}
+		for _, c := range captures {
+			if c == label {
+				return nil, nil, fmt.Errorf("label %q is captured more than once", label)
+			}
+		}
+		expr.WriteString(regexp.QuoteMeta(template[last:m[0]]))
+		expr.WriteString("(?P<" + label + ">[^.]+)")
+		captures, last = append(captures, label), m[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(template[last:]))
+	if len(captures) == 0 {
+		return nil, nil, fmt.Errorf("no labels to capture")
+	}
+	re, err := regexp.Compile("^" + expr.String() + "$")
+	return re, captures, err
+}
+
+// compileAnchored compiles a regexp anchored at both ends, as in Prometheus
+// relabeling.
+func compileAnchored(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// compileTransforms validates and compiles rules.
+func compileTransforms(rules []transformRule) ([]transform, error) {
+	transforms := make([]transform, len(rules))
+	for i, r := range rules {
+		t := transform{transformRule: r, labels: map[string]*regexp.Regexp{}}
+		match := r.Match
+		if match == "" {
+			match = ".*" // every name, rather than only the empty one
+		}
+		var err error
+		if r.Template != "" {
+			if r.Match != "" {
+				return nil, fmt.Errorf("transforms: %d: template can't be combined with match", i)
+			}
+			if t.name, t.captures, err = compileTemplate(r.Template); err != nil {
+				return nil, errors.Wrapf(err, "transforms: %d: template", i)
+			}
+		} else if t.name, err = compileAnchored(match); err != nil {
+			return nil, errors.Wrapf(err, "transforms: %d: match", i)
+		}
+		for name, expr := range r.MatchLabels {
+			if t.labels[name], err = compileAnchored(expr); err != nil {
+				return nil, errors.Wrapf(err, "transforms: %d: match_labels: %s", i, name)
+			}
+		}
+		if r.Convert != nil {
+			if t.convert, err = compileConversion(*r.Convert); err != nil {
+				return nil, errors.Wrapf(err, "transforms: %d: convert", i)
+			}
+		}
+		if r.Expr != "" {
+			if t.program, err = expr.Compile(r.Expr, expr.Env(exprEnv{})); err != nil {
+				return nil, errors.Wrapf(err, "transforms: %d: expr", i)
+			}
+		}
+		changes := r.Rename != "" || len(r.SetLabels) > 0 || len(r.DropLabels) > 0 || r.Scale != nil || r.Convert != nil
+		switch {
+		case r.Drop && changes:
+			return nil, fmt.Errorf("transforms: %d: drop can't be combined with other actions", i)
+		case r.Expr != "" && (r.Drop || changes):
+			return nil, fmt.Errorf("transforms: %d: expr can't be combined with other actions", i)
+		case !r.Drop && !changes && r.Expr == "":
+			return nil, fmt.Errorf("transforms: %d: no action", i)
+		case r.Scale != nil && (math.IsNaN(*r.Scale) || math.IsInf(*r.Scale, 0)):
+			return nil, fmt.Errorf("transforms: %d: scale must be finite", i)
+		case r.Convert != nil && (r.Rename != "" || r.Scale != nil):
+			return nil, fmt.Errorf("transforms: %d: convert renames and scales, so it can't be combined with rename or scale", i)
+		case r.Template != "" && r.Rename == "":
+			return nil, fmt.Errorf("transforms: %d: template needs rename, or the name would keep its labels", i)
+		}
+		transforms[i] = t
+	}
+	return transforms, nil
+}
+
+// transformer applies the transforms to received observations. The
+// transforms are replaced as a whole on reload, and read without locking, as
+// every line is transformed.
+type transformer struct {
+	failures   uint64            // atomic, first for alignment; exprs that failed
+	transforms atomic.Value      // []transform
+	labels     map[string]string // set after the transforms, e.g. pod labels
+}
+
+func newTransformer(transforms []transform) *transformer {
+	t := &transformer{}
+	t.set(transforms)
+	return t
+}
+
+func (t *transformer) set(transforms []transform) {
+	t.transforms.Store(transforms)
+}
+
+// failed returns the number of exprs that failed.
+func (t *transformer) failed() uint64 {
+	return atomic.LoadUint64(&t.failures)
+}
+
+// apply applies each matching transform to obs in order, so that later
+// transforms see the result of earlier ones, and then sets the transformer's
+// labels. It returns false if obs should be dropped. A transform whose expr
+// fails leaves obs unchanged, and is counted as a failure. A nil transformer
+// returns obs unchanged.
+func (t *transformer) apply(obs aggregator.Observation) (aggregator.Observation, bool) {
+	if t == nil {
+		return obs, true
+	}
+	copied := false // the labels and value are shared with the parser until copied
+	copyLabels := func(extra int) {
+		labels := make(map[string]string, len(obs.Labels)+extra)
+		for k, v := range obs.Labels {
+			labels[k] = v
+		}
+		obs.Labels, copied = labels, true
+	}
+	for _, x := range t.transforms.Load().([]transform) {
+		submatches := x.match(obs)
+		if submatches == nil {
+			continue
+		}
+		if x.program != nil {
+			a, err := x.evaluate(obs)
+			if err != nil {
+				atomic.AddUint64(&t.failures, 1)
+				continue
+			}
+			x.transformRule = a
+		}
+		if x.Drop {
+			return obs, false
+		}
+		if !copied && (len(x.SetLabels) > 0 || len(x.DropLabels) > 0 || len(x.captures) > 0) {
+			copyLabels(len(x.SetLabels) + len(x.captures))
+		}
+		for j, label := range x.captures {
+			obs.Labels[label] = obs.Name[submatches[2*j+2]:submatches[2*j+3]]
+		}
+		if x.Rename != "" && x.program != nil {
+			obs.Name = x.Rename // computed by the expr, so not expanded
+		} else if x.Rename != "" {
+			obs.Name = string(x.name.ExpandString(nil, x.Rename, obs.Name, submatches))
+		}
+		for _, name := range x.DropLabels {
+			delete(obs.Labels, name)
+		}
+		for name, value := range x.SetLabels {
+			obs.Labels[name] = value
+		}
+		if x.Scale != nil && obs.Value != nil {
+			v := *obs.Value * *x.Scale
+			obs.Value = &v
+		}
+		if x.convert != nil {
+			obs = x.convert.apply(obs)
+		}
+	}
+	if len(t.labels) > 0 {
+		if !copied {
+			copyLabels(len(t.labels))
+		}
+		for name, value := range t.labels {
+			obs.Labels[name] = value
+		}
+	}
+	return obs, true
+}
+
+// match returns the submatch indexes of the name, or nil if obs doesn't
+// match.
+func (x transform) match(obs aggregator.Observation) []int {
+	if x.convert != nil {
+		if _, ok := x.convert.rename(obs.Name); !ok {
+			return nil
+		}
+	}
+	submatches := x.name.FindStringSubmatchIndex(obs.Name)
+	if submatches == nil {
+		return nil
+	}
+	for name, re := range x.labels {
+		if !re.MatchString(obs.Labels[name]) {
+			return nil
+		}
+	}
+	return submatches
+}
+
+// exprEnv is the variables of an expr: the name and labels of an
+// observation, and its value, which is nil for a declaration.
+type exprEnv struct {
+	Name   string            `expr:"name"`
+	Labels map[string]string `expr:"labels"`
+	Value  interface{}       `expr:"value"`
+}
+
+// evaluate runs the transform's expr on obs, and returns the actions it
+// asks for as a rule. The expr returns nil or true to leave obs unchanged,
+// false to drop it, or a map of the actions of a rule: rename, set_labels,
+// drop_labels, scale, and drop.
+func (x transform) evaluate(obs aggregator.Observation) (transformRule, error) {
+	env := exprEnv{Name: obs.Name, Labels: obs.Labels}
+	if obs.Value != nil {
+		env.Value = *obs.Value
+	}
+	out, err := expr.Run(x.program, env)
+	if err != nil {
+		return transformRule{}, err
+	}
+	var a transformRule
+	switch out := out.(type) {
+	case nil:
+		return a, nil
+	case bool:
+		a.Drop = !out
+		return a, nil
+	case map[string]interface{}:
+		for k, v := range out {
+			var ok bool
+			switch k {
+			case "rename":
+				a.Rename, ok = v.(string)
+			case "set_labels":
+				a.SetLabels, ok = exprStrings(v)
+			case "drop_labels":
+				var labels []interface{}
+				if labels, ok = v.([]interface{}); ok {
+					a.DropLabels = make([]string, len(labels))
+					for i, label := range labels {
+						if a.DropLabels[i], ok = label.(string); !ok {
+							break
+						}
+					}
+				}
+			case "scale":
+				var scale float64
+				switch v := v.(type) {
+				case int:
+					scale, ok = float64(v), true
+				case float64:
+					scale, ok = v, !math.IsNaN(v) && !math.IsInf(v, 0)
+				}
+				a.Scale = &scale
+			case "drop":
+				a.Drop, ok = v.(bool)
+			default:
+				return transformRule{}, fmt.Errorf("unknown action %q", k)
+			}
+			if !ok {
+				return transformRule{}, fmt.Errorf("invalid %s %v", k, v)
+			}
+		}
+		return a, nil
+	default:
+		return transformRule{}, fmt.Errorf("want nil, a bool, or a map of actions, have %T", out)
+	}
+}
+
+// exprStrings returns a map of strings returned by an expr.
+func exprStrings(v interface{}) (map[string]string, bool) {
+	switch v := v.(type) {
+	case map[string]string:
+		return v, true
+	case map[string]interface{}:
+		m := make(map[string]string, len(v))
+		for k, s := range v {
+			var ok bool
+			if m[k], ok = s.(string); !ok {
+				return nil, false
+			}
+		}
+		return m, true
+	}
+	return nil, false
+}
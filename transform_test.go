@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestTransform(t *testing.T) {
+	c, err := loadConfig(writeConfig(t, `
+transforms:
+  - match: legacy_(.+)_ms
+    rename: ${1}_seconds
+    scale: 0.001
+  - match: .+_seconds
+    match_labels:
+      env: staging|dev
+    set_labels:
+      env: nonprod
+    drop_labels: [instance]
+  - match: debug_.*
+    drop: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transforms, err := compileTransforms(c.Transforms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := aggregator.NewUniverse()
+	tm := newTelemetry(u)
+	in := newIngester(u, tm, log.NewNopLogger())
+	in.transforms = newTransformer(transforms)
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`{"name":"legacy_request_ms","type":"gauge","help":"Request duration."}`,
+		`legacy_request_ms{env="dev",instance="a"} 1500`,
+		`legacy_request_ms{env="prod",instance="b"} 250`,
+		`{"name":"debug_total","type":"counter","help":"Total debugs."}`,
+		`debug_total{} 1`,
+	}, "\n"))))
+
+	if want, have := normalizeResponse(`
+		# HELP request_seconds Request duration.
+		# TYPE request_seconds gauge
+		request_seconds{env="nonprod"} 1.500000
+		request_seconds{env="prod",instance="b"} 0.250000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+	if want, have := uint64(2), tm.linesDropped.value(); want != have {
+		t.Errorf("dropped: want %d, have %d", want, have)
+	}
+
+	// Removing the transforms takes effect immediately.
+	in.transforms.set(nil)
+	in.handleConn(io.NopCloser(strings.NewReader(`{"name":"debug_total","type":"counter","help":"Total debugs."}`)))
+	if _, ok := u.Lookup("debug_total", nil); !ok {
+		t.Errorf("debug_total: want declared, have nothing")
+	}
+}
+
+func TestTransformTemplate(t *testing.T) {
+	c, err := loadConfig(writeConfig(t, `
+transforms:
+  - template: svc.{service}.http.{code}.{kind}
+    rename: http_requests_${kind}
+  - template: svc.{service}.queue.depth
+    rename: queue_depth
+    set_labels:
+      service: all
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transforms, err := compileTransforms(c.Transforms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := aggregator.NewUniverse()
+	in := newIngester(u, newTelemetry(u), log.NewNopLogger())
+	in.transforms = newTransformer(transforms)
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`{"name":"http_requests_total","type":"counter","help":"Total requests."}`,
+		`{"name":"queue_depth","type":"gauge","help":"Current queue depth."}`,
+		`svc.checkout.http.200.total{} 3`,
+		`svc.cart.http.500.total{region="eu"} 1`,
+		`svc.cart.queue.depth{} 7`,
+		`svc.cart.extra.http.500.total{} 1`, // too many parts, so it isn't transformed
+	}, "\n"))))
+
+	if want, have := normalizeResponse(`
+		# HELP http_requests_total Total requests.
+		# TYPE http_requests_total counter
+		http_requests_total{code="200",kind="total",service="checkout"} 3.000000
+		http_requests_total{code="500",kind="total",region="eu",service="cart"} 1.000000
+
+		# HELP queue_depth Current queue depth.
+		# TYPE queue_depth gauge
+		queue_depth{service="all"} 7.000000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestTransformExpr(t *testing.T) {
+	c, err := loadConfig(writeConfig(t, `
+transforms:
+  - match: legacy_.+
+    expr: |
+      value != nil && value < 0 ? false :
+      labels.unit == "ms" ? {"rename": trimPrefix(name, "legacy_") + "_seconds", "scale": 0.001, "drop_labels": ["unit"]} :
+      {"rename": trimPrefix(name, "legacy_"), "set_labels": {"host": lower(labels.host)}}
+  - match: broken
+    expr: '{"scale": "2"}'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transforms, err := compileTransforms(c.Transforms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := aggregator.NewUniverse()
+	tm := newTelemetry(u)
+	in := newIngester(u, tm, log.NewNopLogger())
+	in.transforms = newTransformer(transforms)
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`{"name":"request_seconds","type":"gauge","help":"Request duration."}`,
+		`{"name":"legacy_queue_depth","type":"gauge","help":"Queue depth."}`,
+		`legacy_request{unit="ms"} 1500`,
+		`legacy_queue_depth{host="A"} 3`,
+		`legacy_queue_depth{host="B"} -1`,
+		`{"name":"broken","type":"gauge","help":"Broken."}`,
+		`broken{} 1`,
+	}, "\n"))))
+
+	if want, have := normalizeResponse(`
+		# HELP broken Broken.
+		# TYPE broken gauge
+		broken{} 1.000000
+
+		# HELP queue_depth Queue depth.
+		# TYPE queue_depth gauge
+		queue_depth{host="a"} 3.000000
+
+		# HELP request_seconds Request duration.
+		# TYPE request_seconds gauge
+		request_seconds{} 1.500000
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+	if want, have := uint64(1), tm.linesDropped.value(); want != have {
+		t.Errorf("dropped: want %d, have %d", want, have)
+	}
+	if want, have := uint64(2), in.transforms.failed(); want != have { // the declaration and the observation
+		t.Errorf("failed: want %d, have %d", want, have)
+	}
+}
+
+func TestCompileTransformsErrors(t *testing.T) {
+	scale := 2.0
+	for name, rule := range map[string]transformRule{
+		"bad match":          {Match: "foo(", Drop: true},
+		"bad match_labels":   {MatchLabels: map[string]string{"env": "["}, Drop: true},
+		"no action":          {Match: "foo"},
+		"drop and rename":    {Match: "foo", Drop: true, Rename: "bar"},
+		"drop and scale":     {Match: "foo", Drop: true, Scale: &scale},
+		"convert and scale":  {Match: "foo", Convert: &unitConversion{"ms", "seconds"}, Scale: &scale},
+		"unknown unit":       {Convert: &unitConversion{"ms", "fortnights"}},
+		"other dimension":    {Convert: &unitConversion{"ms", "bytes"}},
+		"template and match": {Match: "foo", Template: "svc.{service}", Rename: "foo"},
+		"template no rename": {Template: "svc.{service}", DropLabels: []string{"a"}},
+		"template no labels": {Template: "svc.checkout", Rename: "foo"},
+		"template bad label": {Template: "svc.{service-name}", Rename: "foo"},
+		"template twice":     {Template: "{service}.{service}", Rename: "foo"},
+		"bad expr":           {Expr: "name +"},
+		"expr unknown var":   {Expr: "type == 'counter'"},
+		"expr and rename":    {Expr: "nil", Rename: "foo"},
+		"expr and drop":      {Expr: "nil", Drop: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := compileTransforms([]transformRule{rule}); err == nil {
+				t.Fatal("want error, have none")
+			}
+		})
+	}
+}
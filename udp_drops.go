@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// udpDropSampler periodically samples the number of datagrams the kernel has
+// dropped for a UDP socket, because its receive buffer was full. Those never
+// reach the aggregator, so they're otherwise invisible.
+type udpDropSampler struct {
+	drops uint64 // atomic, first for alignment
+	read  func() (uint64, error)
+}
+
+// udpDropsSampleEvery is how often kernel drops are sampled.
+const udpDropsSampleEvery = 10 * time.Second
+
+// errUDPDropsUnsupported is returned on platforms without kernel drop counts.
+var errUDPDropsUnsupported = errors.New("kernel drop counts aren't supported on this platform")
+
+func newUDPDropSampler(conn *net.UDPConn) (*udpDropSampler, error) {
+	read, err := udpDropsReader(conn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := read(); err != nil {
+		return nil, err
+	}
+	return &udpDropSampler{read: read}, nil
+}
+
+// run samples drops until ctx is canceled, and warns when they increase.
+func (s *udpDropSampler) run(ctx context.Context, every time.Duration, logger log.Logger) error {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := s.read()
+			if err != nil {
+				level.Debug(logger).Log("udp_drops", "sample failed", "err", err)
+				continue
+			}
+			if prev := atomic.SwapUint64(&s.drops, n); n > prev {
+				level.Warn(logger).Log("udp_drops", n-prev, "total", n, "msg", "kernel dropped datagrams, consider a larger -udp.receive-buffer")
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// metrics returns the sampler's telemetry.
+func (s *udpDropSampler) metrics() []selfMetric {
+	return []selfMetric{
+		newSelfCounterFunc("aggregator_udp_receive_drops_total", "Total number of datagrams dropped by the kernel because the socket's receive buffer was full, as of the last sample.", nil, func() []selfSample {
+			return []selfSample{{value: float64(atomic.LoadUint64(&s.drops))}}
+		}),
+	}
+}
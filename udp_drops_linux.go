@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// udpDropsReader returns a function that reads the kernel's drop count for
+// conn from /proc/net/udp or /proc/net/udp6, where the socket is identified
+// by its inode.
+func udpDropsReader(conn *net.UDPConn) (func() (uint64, error), error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		st      syscall.Stat_t
+		statErr error
+	)
+	if err := rc.Control(func(fd uintptr) { statErr = syscall.Fstat(int(fd), &st) }); err != nil {
+		return nil, err
+	}
+	if statErr != nil {
+		return nil, statErr
+	}
+	inode := strconv.FormatUint(uint64(st.Ino), 10)
+
+	return func() (uint64, error) {
+		for _, filename := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+			f, err := os.Open(filename)
+			if err != nil {
+				return 0, err
+			}
+			drops, ok, err := parseProcNetUDP(f, inode)
+			f.Close()
+			if err != nil {
+				return 0, errors.Wrap(err, filename)
+			}
+			if ok {
+				return drops, nil
+			}
+		}
+		return 0, fmt.Errorf("socket with inode %s not found", inode)
+	}, nil
+}
+
+// parseProcNetUDP returns the drops column of the socket with the inode, and
+// whether it was found.
+func parseProcNetUDP(r io.Reader, inode string) (uint64, bool, error) {
+	s := bufio.NewScanner(r)
+	s.Scan() // header
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 13 || fields[9] != inode {
+			continue
+		}
+		drops, err := strconv.ParseUint(fields[12], 10, 64)
+		if err != nil {
+			return 0, false, err
+		}
+		return drops, true, nil
+	}
+	return 0, false, s.Err()
+}
@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseProcNetUDP(t *testing.T) {
+	const procNetUDP = `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 00000000:1FFF 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 4242 2 0000000000000000 0
+  456: 0100007F:2000 00000000:0000 07 00000000:00000000 00:00000000 00000000  1000        0 5151 2 0000000000000000 17
+`
+	for inode, want := range map[string]struct {
+		drops uint64
+		ok    bool
+	}{
+		"4242": {0, true},
+		"5151": {17, true},
+		"9999": {0, false},
+	} {
+		drops, ok, err := parseProcNetUDP(strings.NewReader(procNetUDP), inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drops != want.drops || ok != want.ok {
+			t.Errorf("inode %s: want %d %v, have %d %v", inode, want.drops, want.ok, drops, ok)
+		}
+	}
+}
+
+func TestUDPDropSampler(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s, err := newUDPDropSampler(conn)
+	if err != nil {
+		t.Skipf("kernel drop counts unavailable: %v", err)
+	}
+	if drops, err := s.read(); err != nil || drops != 0 {
+		t.Errorf("want 0 drops, have %d (%v)", drops, err)
+	}
+}
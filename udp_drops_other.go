@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+)
+
+func udpDropsReader(*net.UDPConn) (func() (uint64, error), error) {
+	return nil, errUDPDropsUnsupported
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+)
+
+// buildInfo identifies the running binary. Version and revision are set at
+// build time, see release.fish.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	GoVersion string `json:"goversion"`
+}
+
+func currentBuildInfo() buildInfo {
+	return buildInfo{
+		Version:   version,
+		Revision:  revision,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// versionHandler serves the build info as JSON.
+func versionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, http.StatusOK, currentBuildInfo())
+	})
+}
+
+// newBuildInfoMetric returns a constant gauge, with the build info as labels,
+// following the common Prometheus convention.
+func newBuildInfoMetric() *selfFunc {
+	info := currentBuildInfo()
+	return newSelfGaugeFunc("aggregator_build_info", "A metric with a constant '1' value, labeled by the version, revision, and Go version of the build.", []string{"version", "revision", "goversion"}, func() []selfSample {
+		return []selfSample{{labelValues: []string{info.Version, info.Revision, info.GoVersion}, value: 1}}
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// webConfig follows the Prometheus web configuration file format, see
+// https://prometheus.io/docs/prometheus/latest/configuration/https/.
+type webConfig struct {
+	TLSServerConfig webTLSConfig      `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"` // user: bcrypt hash
+}
+
+type webTLSConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	MinVersion     string `yaml:"min_version"`
+}
+
+func loadWebConfig(filename string) (webConfig, error) {
+	var c webConfig
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return c, err
+	}
+	if err := yaml.UnmarshalStrict(buf, &c); err != nil {
+		return c, errors.Wrap(err, "error parsing web config")
+	}
+	if (c.TLSServerConfig.CertFile == "") != (c.TLSServerConfig.KeyFile == "") {
+		return c, fmt.Errorf("cert_file and key_file must be given together")
+	}
+	if c.TLSServerConfig.ClientCAFile != "" && c.TLSServerConfig.CertFile == "" {
+		return c, fmt.Errorf("client_ca_file requires cert_file and key_file")
+	}
+	for user, hash := range c.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return c, errors.Wrapf(err, "basic_auth_users: user %s", user)
+		}
+	}
+	return c, nil
+}
+
+// tlsConfig returns nil if TLS isn't configured.
+func (c webConfig) tlsConfig() (*tls.Config, error) {
+	tc := c.TLSServerConfig
+	if tc.CertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading certificate")
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch tc.MinVersion {
+	case "":
+	case "TLS10":
+		cfg.MinVersion = tls.VersionTLS10
+	case "TLS11":
+		cfg.MinVersion = tls.VersionTLS11
+	case "TLS12":
+		cfg.MinVersion = tls.VersionTLS12
+	case "TLS13":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("invalid min_version '%s'", tc.MinVersion)
+	}
+
+	switch tc.ClientAuthType {
+	case "", "NoClientCert":
+		cfg.ClientAuth = tls.NoClientCert
+	case "RequestClientCert":
+		cfg.ClientAuth = tls.RequestClientCert
+	case "RequireAnyClientCert", "RequireClientCert":
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	case "VerifyClientCertIfGiven":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "RequireAndVerifyClientCert":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid client_auth_type '%s'", tc.ClientAuthType)
+	}
+
+	if tc.ClientCAFile != "" {
+		buf, err := os.ReadFile(tc.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading client CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates found in client CA file")
+		}
+		cfg.ClientCAs = pool
+	}
+
+	return cfg, nil
+}
+
+// basicAuth wraps next so that requests must authenticate as one of users,
+// a map of username to bcrypt hash. If users is empty, next is returned.
+func basicAuth(next http.Handler, users map[string]string) http.Handler {
+	if len(users) <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if ok {
+			hash, known := users[user]
+			if !known {
+				hash = dummyBcryptHash // spend the same time on unknown users
+			}
+			err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+			if known && err == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="prometheus-aggregator"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// dummyBcryptHash is the hash of a random string at bcrypt.DefaultCost.
+const dummyBcryptHash = "$2a$10$tqIvxiJ3pCU4wzK165trBu0cpXucFo41TYO09FHYOdnsX6Bh7Md16"
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadWebConfig(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, testcase := range map[string]struct {
+		input string
+		err   bool
+	}{
+		"empty": {
+			input: ``,
+		},
+		"basic auth": {
+			input: "basic_auth_users:\n  alice: " + string(hash) + "\n",
+		},
+		"plaintext password": {
+			input: "basic_auth_users:\n  alice: hunter2\n",
+			err:   true,
+		},
+		"cert without key": {
+			input: "tls_server_config:\n  cert_file: server.crt\n",
+			err:   true,
+		},
+		"unknown field": {
+			input: "tls_server_config:\n  cert: server.crt\n",
+			err:   true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "web.yml")
+			if err := os.WriteFile(filename, []byte(testcase.input), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadWebConfig(filename)
+			if want, have := testcase.err, err != nil; want != have {
+				t.Fatalf("err: want %v, have %v (%v)", want, have, err)
+			}
+		})
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := basicAuth(ok, map[string]string{"alice": string(hash)})
+
+	for name, testcase := range map[string]struct {
+		user, pass string
+		code       int
+	}{
+		"correct":       {"alice", "hunter2", http.StatusOK},
+		"wrong pass":    {"alice", "hunter3", http.StatusUnauthorized},
+		"unknown user":  {"bob", "hunter2", http.StatusUnauthorized},
+		"no credential": {"", "", http.StatusUnauthorized},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/metrics", nil)
+			if testcase.user != "" {
+				req.SetBasicAuth(testcase.user, testcase.pass)
+			}
+			h.ServeHTTP(rec, req)
+			if want, have := testcase.code, rec.Code; want != have {
+				t.Fatalf("code: want %d, have %d", want, have)
+			}
+		})
+	}
+}
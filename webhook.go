@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// limitRate is the kind of limit breached by lines rejected by the rate
+// limiter, alongside aggregator.LimitSize and aggregator.LimitMemory.
+const limitRate = "rate"
+
+// webhook notifies an HTTP endpoint when limits are breached, so that they
+// can be acted on before scrapes start failing. The first breach is notified
+// straight away, and later ones at most once per interval, summarized by
+// limit, so that a flood of rejected lines is a single notification.
+type webhook struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+	now      func() time.Time
+	logger   log.Logger
+	failures *selfCounter
+
+	mtx     sync.Mutex
+	pending map[string]*limitBreach
+	ready   chan struct{} // signaled when the first breach is pending
+}
+
+// limitBreach summarizes the breaches of one limit since the last
+// notification.
+type limitBreach struct {
+	Limit  string `json:"limit"`
+	Count  uint64 `json:"count"`
+	Source string `json:"last_source,omitempty"`
+	Error  string `json:"last_error"`
+}
+
+// webhookNotification is the body POSTed to the webhook URL.
+type webhookNotification struct {
+	Time     time.Time     `json:"time"`
+	Breaches []limitBreach `json:"breaches"`
+}
+
+// webhookTimeout bounds each notification request.
+const webhookTimeout = 10 * time.Second
+
+func newWebhook(url string, interval time.Duration, logger log.Logger) *webhook {
+	return &webhook{
+		url:      url,
+		interval: interval,
+		client:   &http.Client{Timeout: webhookTimeout},
+		now:      time.Now,
+		logger:   log.With(logger, "webhook", url),
+		failures: newSelfCounter("aggregator_webhook_failures_total", "Total number of limit breach notifications that couldn't be sent."),
+		pending:  map[string]*limitBreach{},
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// breach records that limit was breached, by a line from source, if any.
+func (w *webhook) breach(source, limit string, err error) {
+	if w == nil {
+		return
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if len(w.pending) == 0 {
+		select {
+		case w.ready <- struct{}{}:
+		default:
+		}
+	}
+	b, ok := w.pending[limit]
+	if !ok {
+		b = &limitBreach{Limit: limit}
+		w.pending[limit] = b
+	}
+	b.Count++
+	b.Source, b.Error = source, err.Error()
+}
+
+// run sends notifications until ctx is canceled.
+func (w *webhook) run(ctx context.Context) error {
+	for {
+		select {
+		case <-w.ready:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := w.notify(ctx); err != nil {
+			w.failures.add(1)
+			level.Warn(w.logger).Log("err", err)
+		}
+		select {
+		case <-time.After(w.interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notify sends the pending breaches, if any, which are dropped even if they
+// can't be sent, so that a failing endpoint isn't sent an ever-growing
+// backlog.
+func (w *webhook) notify(ctx context.Context) error {
+	w.mtx.Lock()
+	n := webhookNotification{Time: w.now().UTC(), Breaches: make([]limitBreach, 0, len(w.pending))}
+	for _, b := range w.pending {
+		n.Breaches = append(n.Breaches, *b)
+	}
+	w.pending = map[string]*limitBreach{}
+	w.mtx.Unlock()
+	if len(n.Breaches) == 0 {
+		return nil
+	}
+	sort.Slice(n.Breaches, func(i, j int) bool { return n.Breaches[i].Limit < n.Breaches[j].Limit })
+
+	buf, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("notification failed: %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *webhook) metrics() []selfMetric {
+	return []selfMetric{w.failures}
+}
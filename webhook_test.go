@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
+)
+
+func TestWebhook(t *testing.T) {
+	notifications := make(chan webhookNotification, 10)
+	code := int32(http.StatusOK)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n webhookNotification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Error(err)
+		}
+		notifications <- n
+		w.WriteHeader(int(atomic.LoadInt32(&code)))
+	}))
+	defer s.Close()
+
+	w := newWebhook(s.URL, time.Hour, log.NewNopLogger())
+	w.now = func() time.Time { return time.Unix(1234, 0) }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.run(ctx)
+
+	w.breach("10.0.0.1", limitRate, errRateLimited)
+	select {
+	case n := <-notifications:
+		want := webhookNotification{Time: time.Unix(1234, 0).UTC(), Breaches: []limitBreach{
+			{Limit: "rate", Count: 1, Source: "10.0.0.1", Error: "rate limit exceeded"},
+		}}
+		if !cmp.Equal(want, n) {
+			t.Error(cmp.Diff(want, n))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the first breach wasn't notified straight away")
+	}
+
+	// Later breaches wait for the interval, and are summarized by limit.
+	w.breach("10.0.0.1", limitRate, errRateLimited)
+	w.breach("10.0.0.2", limitRate, errRateLimited)
+	w.breach("", aggregator.LimitMemory, errors.New("2 series evicted"))
+	select {
+	case n := <-notifications:
+		t.Fatalf("want no notification within the interval, have %+v", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	atomic.StoreInt32(&code, http.StatusInternalServerError)
+	if err := w.notify(ctx); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("want error from the endpoint, have %v", err)
+	}
+	want := []limitBreach{
+		{Limit: "memory", Count: 1, Error: "2 series evicted"},
+		{Limit: "rate", Count: 2, Source: "10.0.0.2", Error: "rate limit exceeded"},
+	}
+	if have := (<-notifications).Breaches; !cmp.Equal(want, have) {
+		t.Error(cmp.Diff(want, have))
+	}
+
+	// Breaches aren't sent twice, even if they failed.
+	if err := w.notify(ctx); err != nil {
+		t.Errorf("without breaches: want no error, have %v", err)
+	}
+	if len(notifications) > 0 {
+		t.Errorf("without breaches: want no notification, have %+v", <-notifications)
+	}
+}
+
+func TestIngestLimitBreaches(t *testing.T) {
+	u, _ := aggregator.NewUniverse()
+	if err := u.SetLimits(aggregator.Limits{MaxLabels: 1}); err != nil {
+		t.Fatal(err)
+	}
+	tm := newTelemetry(u)
+	in := newIngester(u, tm, log.NewNopLogger())
+	in.limiter = newRateLimiter(rateLimits{SourceLines: 3}, defaultMaxSources)
+	in.webhook = newWebhook("http://127.0.0.1:0", time.Hour, log.NewNopLogger())
+
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`{"name":"foo","type":"counter","help":"Total foos."}`,
+		`foo{a="1"} 1`,
+		`foo{a="1",b="2"} 1`, // too many labels
+		`foo{a="1"} 1`,       // over the rate limit
+	}, "\n"))))
+
+	for limit, want := range map[string]uint64{limitRate: 1, aggregator.LimitSize: 1, aggregator.LimitMemory: 0} {
+		if have := tm.limitBreaches.value(limit); want != have {
+			t.Errorf("%s: want %d breaches, have %d", limit, want, have)
+		}
+	}
+	if want, have := 2, len(in.webhook.pending); want != have {
+		t.Errorf("want %d pending notifications, have %d", want, have)
+	}
+}
@@ -3,31 +3,39 @@ package main
 import (
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/peterbourgon/prometheus-aggregator/pkg/aggregator"
 )
 
 func TestHandleConn(t *testing.T) {
 	// Set up our little universe.
 	var (
-		dst, _ = newUniverse()
+		dst, _ = aggregator.NewUniverse()
 		src, w = io.Pipe()
-		strict = true
 		logger = log.NewNopLogger()
+		in     = newIngester(dst, newTelemetry(dst), logger)
 	)
+	in.strict = true
 
 	// Take writes from the output of the pipe into the universe.
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		handleConn(src, dst, strict, logger)
+		in.handleConn(src)
 	}()
 
 	// Make writes to the input of the pipe.
 	fmt.Fprintln(w, `{"name":"foo","type":"counter","help":"Total foos.","labels":{"code":"412"},"value":1}`)
+	fmt.Fprintln(w, ``)                               // skipped, even when strict
+	fmt.Fprintln(w, `# foos that were preconditions`) // likewise
 	fmt.Fprintln(w, `{"name":"foo","labels":{"code":"412"},"value":2}`)
 	fmt.Fprintln(w, `foo{code="412"} 4`)
 
@@ -49,3 +57,326 @@ func TestHandleConn(t *testing.T) {
 		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
 	}
 }
+
+func TestHandleConnFormat(t *testing.T) {
+	var (
+		dst, _ = aggregator.NewUniverse()
+		src, w = io.Pipe()
+		logger = log.NewNopLogger()
+		in     = newIngester(dst, newTelemetry(dst), logger)
+	)
+	in.format = aggregator.LineFormatJSON
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		in.handleConn(src)
+	}()
+	fmt.Fprintln(w, `{"name":"foo","type":"counter","help":"Total foos."}`)
+	fmt.Fprintln(w, `{"name":"foo","value":1}`)
+	fmt.Fprintln(w, `foo{} 2`) // rejected
+	w.Close()
+	<-done
+
+	if want, have := normalizeResponse(`
+		# HELP foo Total foos.
+		# TYPE foo counter
+		foo{} 1.000000
+	`), normalizeResponse(scrape(t, dst)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestDrainConn(t *testing.T) {
+	var (
+		dst, _ = aggregator.NewUniverse()
+		src, w = net.Pipe()
+		logger = log.NewNopLogger()
+		in     = newIngester(dst, newTelemetry(dst), logger)
+	)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		in.handleConn(src)
+	}()
+
+	// The client never closes its end of the connection, so without the
+	// drain, handleConn would never return.
+	fmt.Fprintln(w, `{"name":"foo","type":"counter","help":"Total foos."}`)
+	fmt.Fprintln(w, `foo{} 1`)
+	fmt.Fprintln(w, `foo{} 2`)
+
+	in.drain(50 * time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handleConn didn't return after drain")
+	}
+
+	if want, have := normalizeResponse(`
+		# HELP foo Total foos.
+		# TYPE foo counter
+		foo{} 3.000000
+	`), normalizeResponse(scrape(t, dst)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestDrainPacketConn(t *testing.T) {
+	var (
+		dst, _ = aggregator.NewUniverse()
+		logger = log.NewNopLogger()
+		in     = newIngester(dst, newTelemetry(dst), logger)
+	)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	errc := make(chan error, 1)
+	go func() { errc <- in.forwardPacketConn(conn) }()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	fmt.Fprint(client, `{"name":"foo","type":"gauge","help":"Current foo."}`)
+	fmt.Fprint(client, `foo{} 42`)
+
+	in.drain(50 * time.Millisecond)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("forwardPacketConn: want nil error, have %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("forwardPacketConn didn't return after drain")
+	}
+
+	if want, have := normalizeResponse(`
+		# HELP foo Current foo.
+		# TYPE foo gauge
+		foo{} 42.000000
+	`), normalizeResponse(scrape(t, dst)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	var (
+		dst, _ = aggregator.NewUniverse()
+		tm     = newTelemetry(dst)
+		in     = newIngester(dst, tm, log.NewNopLogger())
+	)
+	in.maxConns = 1
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go in.forwardListener(ln)
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	fmt.Fprintln(first, `{"name":"foo","type":"counter","help":"Total foos."}`)
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("second connection: want EOF, have %v", err)
+	}
+	if want, have := uint64(1), tm.tcpConnectionsRejected.value(); want != have {
+		t.Fatalf("rejected connections: want %d, have %d", want, have)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	var (
+		dst, _ = aggregator.NewUniverse()
+		tm     = newTelemetry(dst)
+		in     = newIngester(dst, tm, log.NewNopLogger())
+		src, w = net.Pipe()
+	)
+	in.idleTimeout = 50 * time.Millisecond
+	defer w.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		in.handleConn(src)
+	}()
+
+	fmt.Fprintln(w, `{"name":"foo","type":"counter","help":"Total foos."}`)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handleConn didn't return after idle timeout")
+	}
+	if want, have := uint64(1), tm.tcpConnectionsTimedOut.value(); want != have {
+		t.Fatalf("timed out connections: want %d, have %d", want, have)
+	}
+}
+
+func TestLineReader(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		input string
+		max   int
+		want  []string // "!" marks a line that's too long
+	}{
+		"simple":          {"a\nbb\nccc\n", 10, []string{"a", "bb", "ccc"}},
+		"no final EOL":    {"a\nbb", 10, []string{"a", "bb"}},
+		"CRLF":            {"a\r\nbb\r\n", 10, []string{"a", "bb"}},
+		"empty lines":     {"a\n\nb\n", 10, []string{"a", "", "b"}},
+		"exactly max":     {"aaaa\nbbbbb\n", 4, []string{"aaaa", "!"}},
+		"too long":        {"a\n" + strings.Repeat("x", 10000) + "\nb\n", 100, []string{"a", "!", "b"}},
+		"too long at EOF": {"a\n" + strings.Repeat("x", 10000), 100, []string{"a", "!"}},
+		"long but OK":     {strings.Repeat("x", 10000) + "\n", 10000, []string{strings.Repeat("x", 10000)}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			lr := newLineReader(strings.NewReader(testcase.input), testcase.max)
+			var have []string
+			for {
+				line, err := lr.next()
+				if err == io.EOF {
+					break
+				}
+				if _, ok := err.(lineTooLongError); ok {
+					have = append(have, "!")
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				have = append(have, string(line))
+			}
+			if want := testcase.want; !cmp.Equal(want, have) {
+				t.Fatal(cmp.Diff(want, have))
+			}
+		})
+	}
+}
+
+func TestMaxLineBytes(t *testing.T) {
+	var (
+		dst, _ = aggregator.NewUniverse()
+		tm     = newTelemetry(dst)
+		in     = newIngester(dst, tm, log.NewNopLogger())
+	)
+	in.maxLineBytes = 64
+
+	in.handleConn(io.NopCloser(strings.NewReader(strings.Join([]string{
+		`{"name":"foo","type":"counter","help":"Total foos."}`,
+		`foo{label="` + strings.Repeat("x", 100) + `"} 1`,
+		string(compressData([]byte(`foo{label="` + strings.Repeat("x", 100) + `"} 1`))),
+		`foo{} 1`,
+	}, "\n"))))
+
+	if want, have := uint64(2), tm.linesRejected.value(rejectTooLong); want != have {
+		t.Errorf("rejected: want %d, have %d", want, have)
+	}
+	if want, have := normalizeResponse(`
+		# HELP foo Total foos.
+		# TYPE foo counter
+		foo{} 1.000000
+	`), normalizeResponse(scrape(t, dst)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestMaxPacketBytes(t *testing.T) {
+	var (
+		dst, _ = aggregator.NewUniverse()
+		tm     = newTelemetry(dst)
+		in     = newIngester(dst, tm, log.NewNopLogger())
+	)
+	in.maxLineBytes = 64
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- in.forwardPacketConn(conn) }()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	fmt.Fprint(client, `{"name":"foo","type":"gauge","help":"Current foo."}`)
+	fmt.Fprint(client, `foo{label="`+strings.Repeat("x", 100)+`"} 1`)
+	fmt.Fprint(client, `foo{} 42`)
+
+	in.drain(50 * time.Millisecond)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if want, have := uint64(1), tm.linesRejected.value(rejectTooLong); want != have {
+		t.Errorf("rejected: want %d, have %d", want, have)
+	}
+	if want, have := normalizeResponse(`
+		# HELP foo Current foo.
+		# TYPE foo gauge
+		foo{} 42.000000
+	`), normalizeResponse(scrape(t, dst)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestEncryptedPackets(t *testing.T) {
+	var (
+		dst, _ = aggregator.NewUniverse()
+		tm     = newTelemetry(dst)
+		in     = newIngester(dst, tm, log.NewNopLogger())
+	)
+	in.maxLineBytes = 64
+	in.cipher, _ = aggregator.NewPacketCipher([]byte("0123456789abcdef"))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- in.forwardPacketConn(conn) }()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write(in.cipher.Seal(nil, []byte(`{"name":"foo","type":"gauge","help":"Current foo."}`)))
+	client.Write([]byte(`foo{} 1`)) // unencrypted
+	client.Write(in.cipher.Seal(nil, []byte(`foo{label="`+strings.Repeat("x", 100)+`"} 1`)))
+	client.Write(in.cipher.Seal(nil, []byte(`foo{} 42`)))
+
+	in.drain(50 * time.Millisecond)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	for reason, want := range map[string]uint64{rejectDecrypt: 1, rejectTooLong: 1} {
+		if have := tm.linesRejected.value(reason); want != have {
+			t.Errorf("rejected %s: want %d, have %d", reason, want, have)
+		}
+	}
+	if want, have := normalizeResponse(`
+		# HELP foo Current foo.
+		# TYPE foo gauge
+		foo{} 42.000000
+	`), normalizeResponse(scrape(t, dst)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}